@@ -0,0 +1,29 @@
+// carrier.go
+
+package carriers
+
+// Name returns the type of the carrier handler, e.g. "twilio". Routes are named after the
+// carrier instead, see Carrier.Name.
+func (h *BaseCarrierHandler) Name() string {
+	return h.name
+}
+
+/*func (h *BaseCarrierHandler) Password() string {
+	return h.password
+}*/
+
+/*func (h *BaseCarrierHandler) UUID() string {
+	return h.UUID
+}*/
+
+/*func (h *BaseCarrierHandler) Username() string {
+	return h.username
+}*/
+
+// BaseCarrierHandler provides common functionality for carriers
+type BaseCarrierHandler struct {
+	name string
+	/*UUID string
+	username string
+	password string*/
+}
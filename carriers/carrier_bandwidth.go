@@ -0,0 +1,534 @@
+package carriers
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+const bandwidthMessagingAPI = "https://messaging.bandwidth.com/api/v2/users/"
+
+// bandwidthValidateCallbacks turns the check of the callback credentials off when set to "false",
+// carriers without callback_username then take callbacks from anyone.
+var bandwidthValidateCallbacks bool
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		bandwidthValidateCallbacks = cfg.Getenv("BANDWIDTH_VALIDATE_CALLBACKS") != "false"
+	})
+}
+
+// bandwidthNumbersAPI is the Numbers API of the dashboard, it answers in XML.
+const bandwidthNumbersAPI = "https://dashboard.bandwidth.com/api/accounts/"
+
+// BandwidthHandler implements CarrierHandler for the Bandwidth v2 Messages API. The username and
+// password are the API credentials, account_id and application_id come from the carrier config.
+type BandwidthHandler struct {
+	BaseCarrierHandler
+	gateway          *core.Gateway
+	carrier          *core.Carrier
+	username         string
+	password         string
+	accountID        string
+	applicationID    string
+	callbackUsername string
+	callbackPassword string
+	client           *http.Client
+}
+
+// NewBandwidthHandler initializes a new BandwidthHandler
+func NewBandwidthHandler(gateway *core.Gateway, carrier *core.Carrier, decryptedUsername string, decryptedPassword string) *BandwidthHandler {
+	return &BandwidthHandler{
+		BaseCarrierHandler: BaseCarrierHandler{name: "bandwidth"},
+		gateway:            gateway,
+		carrier:            carrier,
+		username:           decryptedUsername,
+		password:           decryptedPassword,
+		accountID:          carrier.Setting("account_id", "BANDWIDTH_ACCOUNT_ID"),
+		applicationID:      carrier.Setting("application_id", "BANDWIDTH_APPLICATION_ID"),
+		callbackUsername:   carrier.Setting("callback_username", ""),
+		callbackPassword:   carrier.Setting("callback_password", ""),
+		client:             &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// BandwidthMessage is the body of a Bandwidth send message request.
+type BandwidthMessage struct {
+	ApplicationID string   `json:"applicationId"`
+	To            []string `json:"to"`
+	From          string   `json:"from"`
+	Text          string   `json:"text,omitempty"`
+	Media         []string `json:"media,omitempty"`
+	Tag           string   `json:"tag,omitempty"`
+}
+
+// BandwidthMessageResponse is the message returned by the API and included in callbacks.
+type BandwidthMessageResponse struct {
+	ID        string   `json:"id"`
+	Owner     string   `json:"owner"`
+	Direction string   `json:"direction"`
+	To        []string `json:"to"`
+	From      string   `json:"from"`
+	Text      string   `json:"text"`
+	Media     []string `json:"media"`
+	Tag       string   `json:"tag"`
+}
+
+// BandwidthCallback is one event of a Bandwidth message callback, callbacks are posted as a
+// JSON array of events.
+type BandwidthCallback struct {
+	Type        string                   `json:"type"`
+	Time        string                   `json:"time"`
+	Description string                   `json:"description"`
+	To          string                   `json:"to"`
+	ErrorCode   int                      `json:"errorCode"`
+	Message     BandwidthMessageResponse `json:"message"`
+}
+
+// webhookPolicy checks the callback credentials of the messaging application, Bandwidth doesn't
+// sign its callbacks. A carrier without callback_username refuses every callback unless
+// BANDWIDTH_VALIDATE_CALLBACKS is false.
+func (h *BandwidthHandler) webhookPolicy() core.WebhookPolicy {
+	policy := core.WebhookPolicy{Algorithm: "basic"}
+	if bandwidthValidateCallbacks {
+		policy.Verify = func(w *core.InboundWebhook) error {
+			if h.callbackUsername == "" {
+				return errors.New("carrier has no callback credentials")
+			}
+			username, password, ok := w.Context.Request().BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(h.callbackUsername)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(password), []byte(h.callbackPassword)) != 1 {
+				return errors.New("callback credentials do not match")
+			}
+			return nil
+		}
+	}
+	return policy
+}
+
+// Inbound handles Bandwidth message callbacks, message-received events are routed to the client
+// and message-delivered/message-failed events update the delivery status. Messaging callbacks
+// take no BXML, they are answered with 200. Each event is handled on its own: when one can't be
+// queued the others still are, and the error makes Bandwidth retry the callback, whose events
+// queued before are skipped.
+func (h *BandwidthHandler) Inbound(c iris.Context) error {
+	var lm = h.gateway.LogManager
+
+	var callbacks []BandwidthCallback
+	if err := c.ReadJSON(&callbacks); err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Inbound.Bandwidth",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil,
+			err,
+		))
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	failed := 0
+	for _, callback := range callbacks {
+		switch callback.Type {
+		case "message-received":
+			if err := h.receive(callback); err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Carrier.Inbound.Bandwidth",
+					"GenericError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"logID": callback.Message.ID,
+					}, err,
+				))
+				failed++
+			}
+		case "message-sending", "message-delivered", "message-failed":
+			var errorCode string
+			if callback.ErrorCode != 0 {
+				errorCode = fmt.Sprintf("%d", callback.ErrorCode)
+			}
+			err := h.gateway.Router.CarrierDeliveryStatus(h.carrier.Name, callback.Message.ID, bandwidthDeliveryStatus(callback.Type), errorCode)
+			if err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Carrier.Inbound.Bandwidth",
+					"GenericError",
+					logrus.WarnLevel,
+					map[string]interface{}{
+						"logID":  callback.Message.ID,
+						"status": callback.Type,
+					}, err,
+				))
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d callback events not queued", failed, len(callbacks))
+	}
+
+	c.StatusCode(http.StatusOK)
+	return nil
+}
+
+// queueOnce queues a part of a received message unless it was queued before Bandwidth retried the
+// callback, the parts queued are remembered in the webhook nonces for twice WEBHOOK_TOLERANCE.
+func (h *BandwidthHandler) queueOnce(messageID string, part string, queue func() error) error {
+	key := core.WebhookNonce(h.carrier, "received:"+messageID+":"+part)
+	claimed, err := h.gateway.WebhookNonces.SetNX(key, "1")
+	if err == nil && !claimed {
+		return nil
+	}
+	if err := queue(); err != nil {
+		if claimed {
+			_ = h.gateway.WebhookNonces.Delete(key)
+		}
+		return err
+	}
+	return nil
+}
+
+// receive routes a received message to the client owning the number it was sent to.
+func (h *BandwidthHandler) receive(callback BandwidthCallback) error {
+	var lm = h.gateway.LogManager
+
+	to := callback.To
+	if to == "" && len(callback.Message.To) > 0 {
+		to = callback.Message.To[0]
+	}
+	if to == "" {
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Inbound.Bandwidth",
+			"CarrierNoDestinations",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"logID": callback.Message.ID,
+			},
+		))
+		return nil
+	}
+
+	from := callback.Message.From
+	messageID := core.IngressLogID(callback.Message.ID)
+
+	if len(callback.Message.Media) > 0 {
+		err := h.queueOnce(callback.Message.ID, "mms", func() error {
+			files := h.fetchMediaFiles(callback.Message.Media, messageID)
+			if len(files) == 0 {
+				return nil
+			}
+			msg := core.MsgQueueItem{
+				To:                to,
+				From:              from,
+				ReceivedTimestamp: time.Now(),
+				Type:              core.MsgQueueItemType.MMS,
+				Files:             files,
+				LogID:             messageID,
+				InboundCarrier:    h.carrier.Name,
+			}
+			core.NormalizeAddresses(&msg, nil)
+			return h.gateway.Router.OfferCarrierMessage(msg)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if strings.TrimSpace(callback.Message.Text) != "" {
+		for i, smsBody := range splitSMS(callback.Message.Text, 140) {
+			sms := core.MsgQueueItem{
+				To:                to,
+				From:              from,
+				ReceivedTimestamp: time.Now(),
+				Type:              core.MsgQueueItemType.SMS,
+				Message:           smsBody,
+				LogID:             messageID,
+				InboundCarrier:    h.carrier.Name,
+			}
+			core.NormalizeAddresses(&sms, nil)
+			err := h.queueOnce(callback.Message.ID, "sms:"+strconv.Itoa(i), func() error {
+				return h.gateway.Router.OfferCarrierMessage(sms)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bandwidthDeliveryStatus maps a Bandwidth callback type onto the gateway delivery statuses.
+func bandwidthDeliveryStatus(callbackType string) string {
+	switch callbackType {
+	case "message-delivered":
+		return core.DeliveryStatuses.Delivered
+	case "message-failed":
+		return core.DeliveryStatuses.Undelivered
+	}
+	return core.DeliveryStatuses.Sent
+}
+
+// fetchMediaFiles downloads the media of a received message, Bandwidth media requires the API
+// credentials.
+func (h *BandwidthHandler) fetchMediaFiles(media []string, messageID string) []core.MsgFile {
+	var lm = h.gateway.LogManager
+	var files []core.MsgFile
+
+	for _, mediaURL := range media {
+		content, contentType, err := h.fetchMedia(mediaURL)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.FetchMedia.Bandwidth",
+				"CarrierFetchMediaError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": messageID,
+					"error": err.Error(),
+				}, mediaURL,
+			))
+			continue
+		}
+		if strings.Contains(contentType, "application/smil") {
+			continue
+		}
+
+		files = append(files, core.MsgFile{
+			Filename:    path.Base(mediaURL),
+			ContentType: contentType,
+			Content:     content,
+			Size:        len(content),
+		})
+	}
+	return files
+}
+
+func (h *BandwidthHandler) fetchMedia(mediaURL string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", mediaURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.SetBasicAuth(h.username, h.password)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	content, err := io.ReadAll(resp.Body)
+	return content, resp.Header.Get("Content-Type"), err
+}
+
+// uploadMedia uploads a file to Bandwidth media storage and returns its URL. Outbound files carry
+// base64 content.
+func (h *BandwidthHandler) uploadMedia(ctx context.Context, file core.MsgFile, logID string) (string, error) {
+	content, err := base64.StdEncoding.DecodeString(string(file.Content))
+	if err != nil {
+		content = file.Content
+	}
+
+	mediaURL := bandwidthMessagingAPI + url.PathEscape(h.accountID) + "/media/" + url.PathEscape(logID+"-"+path.Base(file.Filename))
+	req, err := http.NewRequestWithContext(ctx, "PUT", mediaURL, bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(h.username, h.password)
+	req.Header.Set("Content-Type", file.ContentType)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return "", fmt.Errorf("media upload returned %d", resp.StatusCode)
+	}
+	return mediaURL, nil
+}
+
+// sendMessage posts a message to the Bandwidth Messages API and records the message ID for
+// delivery callbacks.
+func (h *BandwidthHandler) sendMessage(ctx context.Context, message BandwidthMessage, msg *core.MsgQueueItem) error {
+	message.ApplicationID = h.applicationID
+	if application := h.gateway.SendingNumber(msg.From).ApplicationID; application != "" {
+		message.ApplicationID = application
+	}
+	if h.accountID == "" || message.ApplicationID == "" {
+		return errors.New("bandwidth carrier needs account_id and application_id")
+	}
+	message.Tag = msg.LogID
+
+	payloadBytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", bandwidthMessagingAPI+url.PathEscape(h.accountID)+"/messages", bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(h.username, h.password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.New("failed to read response from Bandwidth")
+	}
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Type        string `json:"type"`
+			Description string `json:"description"`
+		}
+		err := fmt.Errorf("bandwidth returned %d", resp.StatusCode)
+		if json.Unmarshal(bodyBytes, &errResp) == nil && errResp.Type != "" {
+			err = fmt.Errorf("bandwidth returned %d: %s %s", resp.StatusCode, errResp.Type, errResp.Description)
+		}
+		return core.ClassifyError(core.HTTPErrorClass(resp.StatusCode), strconv.Itoa(resp.StatusCode), err)
+	}
+
+	var sent BandwidthMessageResponse
+	if err := json.Unmarshal(bodyBytes, &sent); err != nil {
+		return err
+	}
+	h.gateway.TrackCarrierMessage(h.carrier.Name, sent.ID, msg)
+
+	return nil
+}
+
+// CheckHealth lists the media of the account, which needs a reachable API and valid credentials.
+func (h *BandwidthHandler) CheckHealth() error {
+	req, err := http.NewRequest("GET", bandwidthMessagingAPI+url.PathEscape(h.accountID)+"/media", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(h.username, h.password)
+	return core.ProbeHTTP(h.client, req)
+}
+
+// listNumbers lists the in service numbers of the account from the Numbers API, 1000 per page.
+func (h *BandwidthHandler) listNumbers(ctx context.Context) ([]string, error) {
+	if h.accountID == "" {
+		return nil, errors.New("bandwidth carrier needs account_id")
+	}
+	var numbers []string
+	for page := 1; ; page++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s/inserviceNumbers?page=%d&size=1000", bandwidthNumbersAPI, url.PathEscape(h.accountID), page), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(h.username, h.password)
+
+		var list struct {
+			TotalCount int      `xml:"TotalCount"`
+			Numbers    []string `xml:"TelephoneNumbers>TelephoneNumber"`
+		}
+		resp, err := h.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, core.ClassifyError(core.HTTPErrorClass(resp.StatusCode), strconv.Itoa(resp.StatusCode), fmt.Errorf("bandwidth in service numbers returned %d", resp.StatusCode))
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the bandwidth in service numbers: %w", err)
+		}
+		numbers = append(numbers, list.Numbers...)
+		if len(list.Numbers) == 0 || len(numbers) >= list.TotalCount {
+			return numbers, nil
+		}
+	}
+}
+
+// SendSMS sends an SMS message via the Bandwidth Messages API
+func (h *BandwidthHandler) SendSMS(ctx context.Context, sms *core.MsgQueueItem) error {
+	message := BandwidthMessage{
+		To:   []string{sms.To},
+		From: sms.From,
+		Text: sms.Message,
+	}
+
+	if err := h.sendMessage(ctx, message, sms); err != nil {
+		var lm = h.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.SendSMS.Bandwidth",
+			"GenericError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"logID": sms.LogID,
+			}, err,
+		))
+		return err
+	}
+	return nil
+}
+
+// SendMMS uploads the files to Bandwidth media storage and sends them via the Messages API
+func (h *BandwidthHandler) SendMMS(ctx context.Context, mms *core.MsgQueueItem) error {
+	var lm = h.gateway.LogManager
+
+	message := BandwidthMessage{
+		To:   []string{mms.To},
+		From: mms.From,
+		Text: mms.Message,
+	}
+
+	for _, file := range mms.Files {
+		if strings.Contains(file.ContentType, "application/smil") {
+			continue
+		}
+
+		mediaURL, err := h.uploadMedia(ctx, file, mms.LogID)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.SendMMS.Bandwidth",
+				"SaveMediaError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": mms.LogID,
+				}, err,
+			))
+			return err
+		}
+		message.Media = append(message.Media, mediaURL)
+	}
+
+	if err := h.sendMessage(ctx, message, mms); err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Carrier.SendMMS.Bandwidth",
+			"GenericError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"logID": mms.LogID,
+			}, err,
+		))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package carriers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"zultys-smpp-mm4/core"
+)
+
+// PlivoHandler implements CarrierHandler for the Plivo Message API. The username is the auth ID
+// and the password the auth token, which also signs webhooks.
+type PlivoHandler struct {
+	restCarrier
+	authID    string
+	authToken string
+}
+
+// NewPlivoHandler initializes a new PlivoHandler
+func NewPlivoHandler(gateway *core.Gateway, carrier *core.Carrier, decryptedUsername string, decryptedPassword string) *PlivoHandler {
+	return &PlivoHandler{
+		restCarrier: newRestCarrier(gateway, carrier, "plivo", "Plivo", map[string]string{
+			"queued":      core.DeliveryStatuses.Queued,
+			"sent":        core.DeliveryStatuses.Sent,
+			"delivered":   core.DeliveryStatuses.Delivered,
+			"read":        core.DeliveryStatuses.Delivered,
+			"undelivered": core.DeliveryStatuses.Undelivered,
+			"failed":      core.DeliveryStatuses.Failed,
+			"rejected":    core.DeliveryStatuses.Failed,
+		}),
+		authID:    decryptedUsername,
+		authToken: decryptedPassword,
+	}
+}
+
+func (h *PlivoHandler) auth(req *http.Request) {
+	req.SetBasicAuth(h.authID, h.authToken)
+}
+
+// CheckHealth fetches the account, which needs a reachable API and valid credentials.
+func (h *PlivoHandler) CheckHealth() error {
+	_, err := h.do(restRequest{Method: "GET", URL: "https://api.plivo.com/v1/Account/" + url.PathEscape(h.authID) + "/", Auth: h.auth})
+	return err
+}
+
+// PlivoMessage is the body of a send message request.
+type PlivoMessage struct {
+	Src       string   `json:"src"`
+	Dst       string   `json:"dst"`
+	Text      string   `json:"text,omitempty"`
+	Type      string   `json:"type"`
+	MediaUrls []string `json:"media_urls,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	Method    string   `json:"method,omitempty"`
+}
+
+// Inbound handles Plivo inbound message and message status webhooks, both are form encoded and
+// signed with X-Plivo-Signature-V3.
+func (h *PlivoHandler) Inbound(c iris.Context) error {
+	if err := c.Request().ParseForm(); err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+	form := c.Request().PostForm
+
+	messageUUID := form.Get("MessageUUID")
+	if status := form.Get("Status"); status != "" {
+		h.reportStatus(messageUUID, status, form.Get("ErrorCode"))
+		c.StatusCode(http.StatusOK)
+		return nil
+	}
+
+	var files []core.MsgFile
+	if strings.EqualFold(form.Get("Type"), "mms") {
+		count, _ := strconv.Atoi(form.Get("MediaCount"))
+		for i := 0; i < count; i++ {
+			mediaURL := form.Get(fmt.Sprintf("Media%d", i))
+			if mediaURL == "" {
+				continue
+			}
+			file, err := h.fetchMedia(mediaURL, h.auth)
+			if err != nil {
+				continue
+			}
+			files = append(files, file)
+		}
+	}
+
+	if err := h.receive(form.Get("From"), form.Get("To"), form.Get("Text"), files, messageUUID); err != nil {
+		return err
+	}
+	c.StatusCode(http.StatusOK)
+	return nil
+}
+
+// webhookPolicy checks X-Plivo-Signature-V3, signed over the URL, the sorted parameters and
+// the nonce.
+func (h *PlivoHandler) webhookPolicy() core.WebhookPolicy {
+	return core.WebhookPolicy{
+		Algorithm: "hmac-sha256",
+		Status:    http.StatusForbidden,
+		Verify: func(w *core.InboundWebhook) error {
+			signed := requestURL(w.Context) + sortedParams(w.Form()) + "." + w.Header("X-Plivo-Signature-V3-Nonce")
+			return h.verifySignature(signed, w.Header("X-Plivo-Signature-V3"))
+		},
+		Nonce: func(w *core.InboundWebhook) string {
+			return w.Header("X-Plivo-Signature-V3-Nonce")
+		},
+	}
+}
+
+// verifySignature checks a V3 signature, which may list several comma separated signatures while
+// the auth token is being rotated.
+func (h *PlivoHandler) verifySignature(signed string, header string) error {
+	var err error
+	for _, signature := range strings.Split(header, ",") {
+		if err = verifyHMAC(h.authToken, []byte(signed), strings.TrimSpace(signature)); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (h *PlivoHandler) send(ctx context.Context, message PlivoMessage, msg *core.MsgQueueItem) error {
+	// Plivo takes numbers without the leading "+"
+	message.Src = strings.TrimPrefix(message.Src, "+")
+	message.Dst = strings.TrimPrefix(message.Dst, "+")
+	if callback := h.webhookURL(); callback != "" {
+		message.URL = callback
+		message.Method = "POST"
+	}
+
+	resp, err := h.do(restRequest{
+		Context: ctx,
+		Method:  "POST",
+		URL:     "https://api.plivo.com/v1/Account/" + url.PathEscape(h.authID) + "/Message/",
+		JSON:    message,
+		Auth:    h.auth,
+	})
+	if err != nil {
+		return err
+	}
+
+	var sent struct {
+		MessageUUID []string `json:"message_uuid"`
+	}
+	if err := json.Unmarshal(resp, &sent); err != nil {
+		return err
+	}
+	for _, id := range sent.MessageUUID {
+		h.gateway.TrackCarrierMessage(h.carrier.Name, id, msg)
+	}
+	return nil
+}
+
+// SendSMS sends an SMS message via Plivo
+func (h *PlivoHandler) SendSMS(ctx context.Context, sms *core.MsgQueueItem) error {
+	err := h.send(ctx, PlivoMessage{Src: sms.From, Dst: sms.To, Text: sms.Message, Type: "sms"}, sms)
+	if err != nil {
+		h.logSendError("SendSMS", sms, err)
+	}
+	return err
+}
+
+// SendMMS sends an MMS message via Plivo
+func (h *PlivoHandler) SendMMS(ctx context.Context, mms *core.MsgQueueItem) error {
+	urls, err := h.mediaURLs(mms)
+	if err == nil {
+		err = h.send(ctx, PlivoMessage{Src: mms.From, Dst: mms.To, Text: mms.Message, Type: "mms", MediaUrls: urls}, mms)
+	}
+	if err != nil {
+		h.logSendError("SendMMS", mms, err)
+	}
+	return err
+}
@@ -0,0 +1,362 @@
+package carriers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/proto/carrierplugin"
+)
+
+// PluginHandler implements CarrierHandler by calling a carrier plugin, a sidecar process serving
+// the CarrierPlugin service of proto/carrier_plugin.proto over gRPC. The url comes from the carrier
+// config or from the plugin registering itself, the password is the bearer token sent to the
+// plugin.
+type PluginHandler struct {
+	restCarrier
+	mu     sync.RWMutex
+	url    string
+	secret string
+	conn   *grpc.ClientConn // nil until the plugin has a url
+	client carrierplugin.CarrierPluginClient
+}
+
+// pluginCallTimeout bounds a call to a plugin made without a deadline of its own.
+const pluginCallTimeout = 30 * time.Second
+
+// PluginRegisterRequest is the body of POST /plugins/register.
+type PluginRegisterRequest struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// NewPluginHandler initializes a new PluginHandler
+func NewPluginHandler(gateway *core.Gateway, carrier *core.Carrier, decryptedUsername string, decryptedPassword string) *PluginHandler {
+	h := &PluginHandler{
+		restCarrier: newRestCarrier(gateway, carrier, "plugin", "Plugin", map[string]string{
+			core.DeliveryStatuses.Queued:      core.DeliveryStatuses.Queued,
+			core.DeliveryStatuses.Sent:        core.DeliveryStatuses.Sent,
+			core.DeliveryStatuses.Delivered:   core.DeliveryStatuses.Delivered,
+			core.DeliveryStatuses.Failed:      core.DeliveryStatuses.Failed,
+			core.DeliveryStatuses.Undelivered: core.DeliveryStatuses.Undelivered,
+		}),
+		secret: decryptedPassword,
+	}
+	if url := carrier.Setting("url", ""); url != "" {
+		conn, err := dialPlugin(url)
+		if err != nil {
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"Carrier.Plugin",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"carrier": carrier.Name,
+				}, err,
+			))
+		} else {
+			h.url, h.conn, h.client = url, conn, carrierplugin.NewCarrierPluginClient(conn)
+		}
+	}
+	return h
+}
+
+// dialPlugin creates the connection to a plugin, TLS when the url is https://host:port. The
+// connection is made on the first call.
+func dialPlugin(url string) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	target := strings.TrimPrefix(url, "http://")
+	if strings.HasPrefix(target, "https://") {
+		target = strings.TrimPrefix(target, "https://")
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	return grpc.NewClient(strings.TrimRight(target, "/"), grpc.WithTransportCredentials(creds))
+}
+
+// pluginContext adds the secret of the plugin to the call, and a deadline when it has none.
+func pluginContext(ctx context.Context, secret string) (context.Context, context.CancelFunc) {
+	if secret != "" && secret != "-" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+secret)
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, pluginCallTimeout)
+}
+
+// pluginError classifies the status of a failed call like the HTTP statuses of REST carriers.
+func pluginError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch st.Code() {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return core.ClassifyError(core.ErrorClasses.AuthFailure, st.Code().String(), err)
+	case codes.ResourceExhausted:
+		return core.ClassifyError(core.ErrorClasses.Congestion, st.Code().String(), err)
+	case codes.InvalidArgument, codes.Unimplemented:
+		return core.PermanentFailure(err)
+	}
+	return err
+}
+
+// plugin returns the client and the secret of the plugin.
+func (h *PluginHandler) plugin() (carrierplugin.CarrierPluginClient, string, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.client == nil {
+		return nil, "", fmt.Errorf("plugin carrier %s is not registered", h.carrier.Name)
+	}
+	return h.client, h.secret, nil
+}
+
+// checkPluginHealth calls the Health method of a plugin.
+func checkPluginHealth(client carrierplugin.CarrierPluginClient, secret string) error {
+	ctx, cancel := pluginContext(context.Background(), secret)
+	defer cancel()
+	health, err := client.Health(ctx, &carrierplugin.HealthRequest{})
+	if err != nil {
+		return pluginError(err)
+	}
+	if !health.GetOk() {
+		return errors.New("plugin reports unhealthy")
+	}
+	return nil
+}
+
+// CheckHealth calls the Health method of the plugin.
+func (h *PluginHandler) CheckHealth() error {
+	client, secret, err := h.plugin()
+	if err != nil {
+		return err
+	}
+	return checkPluginHealth(client, secret)
+}
+
+// Inbound forwards the carrier webhook to the plugin, then routes the messages and reports the
+// statuses it parsed out of it.
+func (h *PluginHandler) Inbound(c iris.Context) error {
+	body, err := c.GetBody()
+	if err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	headers := make(map[string]string)
+	for key, values := range c.Request().Header {
+		headers[key] = strings.Join(values, ",")
+	}
+
+	client, secret, err := h.plugin()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := pluginContext(context.Background(), secret)
+	defer cancel()
+	resp, err := client.Inbound(ctx, &carrierplugin.InboundRequest{
+		Method:  c.Method(),
+		Url:     requestURL(c),
+		Headers: headers,
+		Body:    body,
+	})
+	if err != nil {
+		return pluginError(err)
+	}
+
+	for _, st := range resp.GetStatuses() {
+		h.reportStatus(st.GetCarrierMessageId(), st.GetStatus(), st.GetErrorCode())
+	}
+	for _, msg := range resp.GetMessages() {
+		files := make([]core.MsgFile, 0, len(msg.GetFiles()))
+		for _, f := range msg.GetFiles() {
+			files = append(files, core.MsgFile{Filename: f.GetFilename(), ContentType: f.GetContentType(), Content: f.GetContent(), Size: len(f.GetContent())})
+		}
+		if err := h.receive(msg.GetFrom(), msg.GetTo(), msg.GetText(), files, msg.GetLogId()); err != nil {
+			return err
+		}
+	}
+
+	httpStatus := int(resp.GetHttpStatus())
+	if httpStatus == 0 {
+		httpStatus = http.StatusOK
+	}
+	c.StatusCode(httpStatus)
+	if len(resp.GetHttpBody()) > 0 {
+		if resp.GetHttpContentType() != "" {
+			c.ContentType(resp.GetHttpContentType())
+		}
+		_, err = c.Write(resp.GetHttpBody())
+	}
+	return err
+}
+
+func (h *PluginHandler) send(ctx context.Context, msg *core.MsgQueueItem, files []*carrierplugin.File) error {
+	client, secret, err := h.plugin()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := pluginContext(ctx, secret)
+	defer cancel()
+	resp, err := client.Send(ctx, &carrierplugin.SendRequest{
+		Message: &carrierplugin.Message{
+			LogId:      msg.LogID,
+			Type:       string(msg.Type),
+			From:       msg.From,
+			To:         msg.To,
+			Text:       msg.Message,
+			Files:      files,
+			CampaignId: h.gateway.SendingNumber(msg.From).CampaignID,
+		},
+		CallbackUrl: h.webhookURL(),
+	})
+	if err != nil {
+		return pluginError(err)
+	}
+
+	if resp.GetError() != "" {
+		err := errors.New(resp.GetError())
+		if resp.GetErrorClass() != "" {
+			err = core.ClassifyError(core.ErrorClass(resp.GetErrorClass()), "", err)
+		}
+		if resp.GetPermanent() && !errors.Is(err, core.ErrPermanentFailure) {
+			return core.PermanentFailure(err)
+		}
+		return err
+	}
+	h.gateway.TrackCarrierMessage(h.carrier.Name, resp.GetCarrierMessageId(), msg)
+	return nil
+}
+
+// SendSMS sends an SMS through the plugin
+func (h *PluginHandler) SendSMS(ctx context.Context, sms *core.MsgQueueItem) error {
+	err := h.send(ctx, sms, nil)
+	if err != nil {
+		h.logSendError("SendSMS", sms, err)
+	}
+	return err
+}
+
+// SendMMS sends an MMS through the plugin, files carry both their content and a media store URL
+func (h *PluginHandler) SendMMS(ctx context.Context, mms *core.MsgQueueItem) error {
+	urls, err := h.mediaURLs(mms)
+	if err == nil {
+		var files []*carrierplugin.File
+		i := 0
+		for _, f := range mms.Files {
+			if strings.Contains(f.ContentType, "application/smil") {
+				continue
+			}
+			files = append(files, &carrierplugin.File{Filename: f.Filename, ContentType: f.ContentType, Content: f.Content, Url: urls[i]})
+			i++
+		}
+		err = h.send(ctx, mms, files)
+	}
+	if err != nil {
+		h.logSendError("SendMMS", mms, err)
+	}
+	return err
+}
+
+// RegisterPlugin points a plugin carrier at the URL of the plugin, creating the carrier the first
+// time the plugin registers. The plugin must answer Health at the new URL before it is used, until
+// then the carrier keeps calling the old one.
+func RegisterPlugin(gateway *core.Gateway, req PluginRegisterRequest) (string, error) {
+	if req.Name == "" || req.URL == "" {
+		return "", errors.New("name and url are required")
+	}
+
+	gateway.Mu.RLock()
+	handler, exists := gateway.Carriers[req.Name]
+	gateway.Mu.RUnlock()
+
+	if !exists {
+		config, _ := json.Marshal(map[string]string{"url": req.URL})
+		secret := req.Secret
+		if secret == "" {
+			secret = "-"
+		}
+		carrier := &core.Carrier{Name: req.Name, Type: "plugin", Username: "-", Password: secret, Config: string(config)}
+		if err := gateway.AddCarrier(carrier); err != nil {
+			return "", err
+		}
+		gateway.Mu.RLock()
+		handler = gateway.Carriers[req.Name]
+		gateway.Mu.RUnlock()
+	}
+
+	plugin, ok := handler.(*PluginHandler)
+	if !ok {
+		return "", fmt.Errorf("carrier %s is not a plugin carrier", req.Name)
+	}
+
+	conn, err := dialPlugin(req.URL)
+	if err != nil {
+		return "", err
+	}
+	client := carrierplugin.NewCarrierPluginClient(conn)
+	plugin.mu.RLock()
+	secret := plugin.secret
+	plugin.mu.RUnlock()
+	if req.Secret != "" {
+		secret = req.Secret
+	}
+	if err := checkPluginHealth(client, secret); err != nil {
+		_ = conn.Close()
+		return "", fmt.Errorf("plugin health check failed: %w", err)
+	}
+
+	plugin.mu.Lock()
+	previous := plugin.conn
+	plugin.url, plugin.secret, plugin.conn, plugin.client = req.URL, secret, conn, client
+	plugin.mu.Unlock()
+	if previous != nil {
+		_ = previous.Close()
+	}
+
+	// keep the url across restarts
+	config, _ := json.Marshal(map[string]string{"url": req.URL})
+	plugin.carrier.Config = string(config)
+	if err := gateway.DB.Model(&core.Carrier{}).Where("name = ?", req.Name).Update("config", string(config)).Error; err != nil {
+		return "", err
+	}
+	return plugin.carrier.UUID, nil
+}
+
+// PluginRegistrar serves Gateway.Register of proto/carrier_plugin.proto, the gRPC form of
+// POST /plugins/register.
+type PluginRegistrar struct {
+	carrierplugin.UnimplementedGatewayServer
+	gateway *core.Gateway
+}
+
+// NewPluginRegistrar creates the registrar of the plugins of a gateway.
+func NewPluginRegistrar(gateway *core.Gateway) *PluginRegistrar {
+	return &PluginRegistrar{gateway: gateway}
+}
+
+func (r *PluginRegistrar) Register(ctx context.Context, req *carrierplugin.RegisterRequest) (*carrierplugin.RegisterResponse, error) {
+	if _, err := core.GRPCKey(ctx, "POST", "/plugins/register"); err != nil {
+		return nil, err
+	}
+	uuid, err := RegisterPlugin(r.gateway, PluginRegisterRequest{Name: req.GetName(), URL: req.GetUrl(), Secret: req.GetSecret()})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &carrierplugin.RegisterResponse{Uuid: uuid}, nil
+}
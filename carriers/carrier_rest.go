@@ -0,0 +1,362 @@
+package carriers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// restCarrier is the shared toolkit of carriers with a REST messaging API: an HTTP client that
+// retries throttled requests, the webhook URL of the carrier, signature helpers and delivery
+// status normalization. Webhooks are checked before Inbound, see inbound_webhook.go. A carrier
+// embeds it and only implements the request and webhook formats.
+type restCarrier struct {
+	BaseCarrierHandler
+	area    string // carrier name in log areas, e.g. "Sinch"
+	gateway *core.Gateway
+	carrier *core.Carrier
+	client  *http.Client
+
+	// statuses maps the carrier's delivery statuses onto DeliveryStatuses, unknown statuses are
+	// treated as queued.
+	statuses map[string]string
+}
+
+// restRetries is how often a throttled (429) or unavailable (503) request is retried, other
+// failures aren't retried here since the carrier may have accepted the message.
+const restRetries = 3
+
+// newRestCarrier builds the toolkit for a carrier.
+func newRestCarrier(gateway *core.Gateway, carrier *core.Carrier, name string, area string, statuses map[string]string) restCarrier {
+	return restCarrier{
+		BaseCarrierHandler: BaseCarrierHandler{name: name},
+		area:               area,
+		gateway:            gateway,
+		carrier:            carrier,
+		client:             &http.Client{Timeout: 30 * time.Second},
+		statuses:           statuses,
+	}
+}
+
+// webhookURL is where the carrier posts inbound messages and delivery statuses, empty when the
+// public address of the gateway isn't known.
+func (rc *restCarrier) webhookURL() string {
+	base := core.Getenv("SERVER_ADDRESS")
+	if base == "" {
+		return ""
+	}
+	return strings.TrimRight(base, "/") + "/inbound/" + rc.carrier.UUID
+}
+
+// restRequest describes a call to the carrier API.
+type restRequest struct {
+	Context context.Context // the call and its retries give up when it is done, nil for none
+	Method  string
+	URL     string
+	JSON    interface{} // encoded as the JSON body when set
+	Body    []byte      // raw body when JSON isn't set
+	Headers map[string]string
+	Auth    func(req *http.Request) // sets the credentials
+}
+
+// restError is a carrier API error response.
+type restError struct {
+	Status int
+	Body   string
+}
+
+func (e *restError) Error() string {
+	body := e.Body
+	if len(body) > 200 {
+		body = body[:200]
+	}
+	return fmt.Sprintf("carrier returned %d: %s", e.Status, strings.TrimSpace(body))
+}
+
+// do sends the request and retries throttling, honouring Retry-After.
+// Error statuses are returned as restError, marked permanent for client errors that would fail
+// the same way again.
+func (rc *restCarrier) do(r restRequest) ([]byte, error) {
+	body := r.Body
+	if r.JSON != nil {
+		var err error
+		if body, err = json.Marshal(r.JSON); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, r.Method, r.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if r.JSON != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for key, value := range r.Headers {
+			req.Header.Set(key, value)
+		}
+		if r.Auth != nil {
+			r.Auth(req)
+		}
+
+		resp, err := rc.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return respBody, nil
+		}
+
+		apiErr := &restError{Status: resp.StatusCode, Body: string(respBody)}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			if attempt >= restRetries {
+				return nil, core.ClassifyError(core.ErrorClasses.Congestion, strconv.Itoa(resp.StatusCode), apiErr)
+			}
+			select {
+			case <-time.After(retryAfter(resp.Header.Get("Retry-After"), attempt)):
+			case <-ctx.Done():
+				return nil, core.ClassifyError(core.ErrorClasses.Congestion, strconv.Itoa(resp.StatusCode), apiErr)
+			}
+			continue
+		}
+		if class := core.HTTPErrorClass(resp.StatusCode); class != core.ErrorClasses.Unknown {
+			return nil, core.ClassifyError(class, strconv.Itoa(resp.StatusCode), apiErr)
+		}
+		if restPermanentStatus(resp.StatusCode) {
+			return nil, core.PermanentFailure(apiErr)
+		}
+		return nil, apiErr
+	}
+}
+
+// retryAfter returns the delay requested by a Retry-After header, or a backoff from 1s.
+func retryAfter(header string, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return min(time.Duration(seconds)*time.Second, 30*time.Second)
+	}
+	return time.Second << attempt
+}
+
+// restPermanentStatus reports whether an error status fails the same way on every attempt, auth
+// failures are classified instead since other routes may still work.
+func restPermanentStatus(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// fetchMedia downloads inbound media into a MsgFile, auth may be nil for public URLs.
+func (rc *restCarrier) fetchMedia(mediaURL string, auth func(req *http.Request)) (core.MsgFile, error) {
+	req, err := http.NewRequest("GET", mediaURL, nil)
+	if err != nil {
+		return core.MsgFile{}, err
+	}
+	if auth != nil {
+		auth(req)
+	}
+
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		return core.MsgFile{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return core.MsgFile{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return core.MsgFile{}, err
+	}
+	return core.MsgFile{
+		Filename:    path.Base(mediaURL),
+		ContentType: resp.Header.Get("Content-Type"),
+		Content:     content,
+		Size:        len(content),
+	}, nil
+}
+
+// mediaURLs saves the files of an outbound MMS to the media store and returns their public URLs.
+func (rc *restCarrier) mediaURLs(mms *core.MsgQueueItem) ([]string, error) {
+	var urls []string
+	for _, file := range mms.Files {
+		if strings.Contains(file.ContentType, "application/smil") {
+			continue
+		}
+		id, err := rc.gateway.SaveMsgFileMedia(file, mms.LogID)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, core.Getenv("SERVER_ADDRESS")+"/media/"+strconv.Itoa(int(id)))
+	}
+	return urls, nil
+}
+
+// receive routes an inbound message to the client owning the destination number, files make it
+// an MMS and text is sent as SMS. The carrier's message ID is the log ID of the messages.
+func (rc *restCarrier) receive(from, to, text string, files []core.MsgFile, messageID string) error {
+	messageID = core.IngressLogID(messageID)
+	if len(files) > 0 {
+		msg := core.MsgQueueItem{
+			To:                to,
+			From:              from,
+			ReceivedTimestamp: time.Now(),
+			Type:              core.MsgQueueItemType.MMS,
+			Files:             files,
+			LogID:             messageID,
+			InboundCarrier:    rc.carrier.Name,
+		}
+		core.NormalizeAddresses(&msg, nil)
+		if err := rc.gateway.Router.OfferCarrierMessage(msg); err != nil {
+			return err
+		}
+	}
+
+	if strings.TrimSpace(text) != "" {
+		for _, smsBody := range splitSMS(text, 140) {
+			sms := core.MsgQueueItem{
+				To:                to,
+				From:              from,
+				ReceivedTimestamp: time.Now(),
+				Type:              core.MsgQueueItemType.SMS,
+				Message:           smsBody,
+				LogID:             messageID,
+				InboundCarrier:    rc.carrier.Name,
+			}
+			core.NormalizeAddresses(&sms, nil)
+			if err := rc.gateway.Router.OfferCarrierMessage(sms); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reportStatus normalizes a carrier delivery status and updates the message, failures are only
+// logged since the carrier shouldn't resend the callback.
+func (rc *restCarrier) reportStatus(carrierMessageID string, status string, errorCode string) {
+	normalized, ok := rc.statuses[strings.ToLower(status)]
+	if !ok {
+		normalized = core.DeliveryStatuses.Queued
+	}
+
+	if err := rc.gateway.Router.CarrierDeliveryStatus(rc.carrier.Name, carrierMessageID, normalized, errorCode); err != nil {
+		var lm = rc.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Inbound."+rc.area,
+			"GenericError",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"logID":  carrierMessageID,
+				"status": status,
+			}, err,
+		))
+	}
+}
+
+// logSendError logs a failed send for the message.
+func (rc *restCarrier) logSendError(area string, msg *core.MsgQueueItem, err error) {
+	var lm = rc.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Carrier."+area+"."+rc.area,
+		"GenericError",
+		logrus.ErrorLevel,
+		rc.gateway.MsgFields(msg, map[string]interface{}{
+			"route": rc.carrier.Name,
+		}), err,
+	))
+}
+
+// signHMAC returns the HMAC of data keyed with secret, base64 encoded.
+func signHMAC(newHash func() hash.Hash, secret string, data []byte) string {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(data)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyHMAC compares a base64 signature with the HMAC-SHA256 of data in constant time.
+func verifyHMAC(secret string, data []byte, signature string) error {
+	if signature == "" {
+		return errors.New("missing signature")
+	}
+	if !hmac.Equal([]byte(signHMAC(sha256.New, secret, data)), []byte(signature)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// verifyHMACSHA1 is verifyHMAC for carriers still signing with SHA-1.
+func verifyHMACSHA1(secret string, data []byte, signature string) error {
+	if signature == "" {
+		return errors.New("missing signature")
+	}
+	if !hmac.Equal([]byte(signHMAC(sha1.New, secret, data)), []byte(signature)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// sortedParams concatenates form parameters as key+value sorted by key, the signing input most
+// carriers use for form encoded webhooks.
+func sortedParams(form map[string][]string) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		for _, value := range form[key] {
+			b.WriteString(key)
+			b.WriteString(value)
+		}
+	}
+	return b.String()
+}
+
+// requestURL is the URL the carrier requested, built from SERVER_ADDRESS when set since the
+// gateway usually sits behind a proxy.
+func requestURL(c iris.Context) string {
+	uri := c.Request().URL.RequestURI()
+	if base := core.Getenv("SERVER_ADDRESS"); base != "" {
+		return strings.TrimRight(base, "/") + uri
+	}
+	scheme := "https"
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	} else if c.Request().TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + c.Host() + uri
+}
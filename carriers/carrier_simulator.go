@@ -0,0 +1,273 @@
+package carriers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// SimulatorHandler implements CarrierHandler without a carrier behind it, for testing the flows
+// from the clients through the gateway and back end to end. Sends are accepted after the
+// configured latency or fail at the configured rates, every accepted message gets a delivery
+// status picked from the status profile, and with loopback it comes back as an inbound message
+// from its destination. Inbound messages and statuses can also be posted to it like to a webhook
+// carrier, with the password as bearer token.
+type SimulatorHandler struct {
+	restCarrier
+	latency     time.Duration
+	jitter      time.Duration
+	errorRate   float64
+	rejectRate  float64
+	errorCode   string
+	statuses    []simulatedStatus
+	statusDelay time.Duration
+	loopback    bool
+	token       string
+}
+
+// simulatedStatus is a delivery status of the profile with its weight.
+type simulatedStatus struct {
+	status string
+	weight float64
+}
+
+// simulatorIDs numbers the messages the simulator accepts, after the start time so they don't
+// repeat the IDs of an earlier run.
+var (
+	simulatorEpoch = time.Now().Unix()
+	simulatorIDs   atomic.Int64
+)
+
+// NewSimulatorHandler initializes a new SimulatorHandler from the carrier config.
+func NewSimulatorHandler(gateway *core.Gateway, carrier *core.Carrier, decryptedUsername string, decryptedPassword string) (*SimulatorHandler, error) {
+	statuses, err := parseSimulatedStatuses(carrier.Setting("statuses", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid statuses for carrier %s: %w", carrier.Name, err)
+	}
+	token := decryptedPassword
+	if token == "-" {
+		token = ""
+	}
+
+	h := &SimulatorHandler{
+		restCarrier: newRestCarrier(gateway, carrier, "simulator", "Simulator", map[string]string{
+			core.DeliveryStatuses.Queued:      core.DeliveryStatuses.Queued,
+			core.DeliveryStatuses.Sent:        core.DeliveryStatuses.Sent,
+			core.DeliveryStatuses.Delivered:   core.DeliveryStatuses.Delivered,
+			core.DeliveryStatuses.Failed:      core.DeliveryStatuses.Failed,
+			core.DeliveryStatuses.Undelivered: core.DeliveryStatuses.Undelivered,
+		}),
+		errorCode:   carrier.Setting("error_code", ""),
+		statuses:    statuses,
+		statusDelay: time.Second,
+		loopback:    carrier.Setting("loopback", "") == "true",
+		token:       token,
+	}
+	settings := []struct {
+		key      string
+		duration *time.Duration
+		rate     *float64
+	}{
+		{key: "latency", duration: &h.latency},
+		{key: "jitter", duration: &h.jitter},
+		{key: "status_delay", duration: &h.statusDelay},
+		{key: "error_rate", rate: &h.errorRate},
+		{key: "reject_rate", rate: &h.rejectRate},
+	}
+	for _, setting := range settings {
+		value := carrier.Setting(setting.key, "")
+		if value == "" {
+			continue
+		}
+		if setting.duration != nil {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid %s for carrier %s: %s", setting.key, carrier.Name, value)
+			}
+			*setting.duration = d
+			continue
+		}
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid %s for carrier %s, expected 0 to 1: %s", setting.key, carrier.Name, value)
+		}
+		*setting.rate = rate
+	}
+	return h, nil
+}
+
+// parseSimulatedStatuses parses a profile like "delivered:0.9,undelivered:0.1", a status without
+// a weight has weight 1 and "none" reports no status. The default is delivered.
+func parseSimulatedStatuses(profile string) ([]simulatedStatus, error) {
+	if profile == "" {
+		return []simulatedStatus{{status: core.DeliveryStatuses.Delivered, weight: 1}}, nil
+	}
+	var statuses []simulatedStatus
+	for _, part := range strings.Split(profile, ",") {
+		status, weight, found := strings.Cut(strings.TrimSpace(part), ":")
+		status = strings.ToLower(status)
+		if status != "none" && status != core.DeliveryStatuses.Delivered && status != core.DeliveryStatuses.Failed &&
+			status != core.DeliveryStatuses.Undelivered {
+			return nil, fmt.Errorf("unknown status %q", status)
+		}
+		w := 1.0
+		if found {
+			var err error
+			if w, err = strconv.ParseFloat(weight, 64); err != nil || w < 0 {
+				return nil, fmt.Errorf("invalid weight of %s: %s", status, weight)
+			}
+		}
+		statuses = append(statuses, simulatedStatus{status: status, weight: w})
+	}
+	return statuses, nil
+}
+
+// pickStatus picks a status of the profile by weight, empty for none.
+func (h *SimulatorHandler) pickStatus() string {
+	var total float64
+	for _, s := range h.statuses {
+		total += s.weight
+	}
+	pick := rand.Float64() * total
+	for _, s := range h.statuses {
+		if pick < s.weight {
+			if s.status == "none" {
+				return ""
+			}
+			return s.status
+		}
+		pick -= s.weight
+	}
+	return ""
+}
+
+// CheckHealth always succeeds, the simulator has nothing to reach.
+func (h *SimulatorHandler) CheckHealth() error {
+	return nil
+}
+
+// Discards reports whether the simulator delivers nothing, it does unless the messages loop back.
+func (h *SimulatorHandler) Discards() bool {
+	return !h.loopback
+}
+
+// webhookPolicy checks the bearer token when the simulator has one.
+func (h *SimulatorHandler) webhookPolicy() core.WebhookPolicy {
+	policy := core.WebhookPolicy{Algorithm: "bearer"}
+	if h.token != "" {
+		policy.Verify = func(w *core.InboundWebhook) error {
+			if w.Header("Authorization") != "Bearer "+h.token {
+				return errors.New("missing or wrong bearer token")
+			}
+			return nil
+		}
+	}
+	return policy
+}
+
+// Inbound takes messages and statuses posted to the simulator in the format of webhook carriers,
+// to test inbound traffic without a message sent first.
+func (h *SimulatorHandler) Inbound(c iris.Context) error {
+	var inbound WebhookInbound
+	if err := c.ReadJSON(&inbound); err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	if inbound.Status != "" {
+		h.reportStatus(inbound.ID, inbound.Status, inbound.ErrorCode)
+		c.StatusCode(http.StatusNoContent)
+		return nil
+	}
+
+	if inbound.To == "" {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	var files []core.MsgFile
+	for _, mediaURL := range inbound.MediaURLs {
+		file, err := h.fetchMedia(mediaURL, nil)
+		if err != nil {
+			c.StatusCode(http.StatusBadRequest)
+			return nil
+		}
+		files = append(files, file)
+	}
+
+	if err := h.receive(inbound.From, inbound.To, inbound.Text, files, inbound.ID); err != nil {
+		return err
+	}
+	c.StatusCode(http.StatusNoContent)
+	return nil
+}
+
+// send simulates the carrier taking the message.
+func (h *SimulatorHandler) send(ctx context.Context, msg *core.MsgQueueItem) error {
+	delay := h.latency
+	if h.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(h.jitter)))
+	}
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return fmt.Errorf("simulated send abandoned: %w", ctx.Err())
+	}
+
+	pick := rand.Float64()
+	if pick < h.rejectRate {
+		return core.ClassifyError(core.CarrierErrorClass("simulator", h.errorCode), h.errorCode,
+			core.PermanentFailure(errors.New("simulated rejection")))
+	}
+	if pick < h.rejectRate+h.errorRate {
+		return errors.New("simulated carrier error")
+	}
+
+	id := fmt.Sprintf("sim-%x-%d", simulatorEpoch, simulatorIDs.Add(1))
+	h.gateway.TrackCarrierMessage(h.carrier.Name, id, msg)
+
+	if status := h.pickStatus(); status != "" {
+		errorCode := ""
+		if status != core.DeliveryStatuses.Delivered {
+			errorCode = h.errorCode
+		}
+		time.AfterFunc(h.statusDelay, func() { h.reportStatus(id, status, errorCode) })
+	}
+
+	if h.loopback {
+		// answered from the destination, after the message was handed over
+		sent := *msg
+		time.AfterFunc(h.statusDelay, func() {
+			if err := h.receive(sent.To, sent.From, sent.Message, sent.Files, id+"-loopback"); err != nil {
+				h.logSendError("Loopback", &sent, err)
+			}
+		})
+	}
+	return nil
+}
+
+// SendSMS accepts an SMS like a carrier would
+func (h *SimulatorHandler) SendSMS(ctx context.Context, sms *core.MsgQueueItem) error {
+	err := h.send(ctx, sms)
+	if err != nil {
+		h.logSendError("SendSMS", sms, err)
+	}
+	return err
+}
+
+// SendMMS accepts an MMS like a carrier would
+func (h *SimulatorHandler) SendMMS(ctx context.Context, mms *core.MsgQueueItem) error {
+	err := h.send(ctx, mms)
+	if err != nil {
+		h.logSendError("SendMMS", mms, err)
+	}
+	return err
+}
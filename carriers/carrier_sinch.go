@@ -0,0 +1,212 @@
+package carriers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/kataras/iris/v12"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// SinchHandler implements CarrierHandler for the Sinch SMS REST API (XMS). The username is the
+// service plan ID and the password the API token, region and webhook_secret come from the
+// carrier config.
+type SinchHandler struct {
+	restCarrier
+	apiToken      string
+	baseURL       string
+	webhookSecret string
+}
+
+// NewSinchHandler initializes a new SinchHandler
+func NewSinchHandler(gateway *core.Gateway, carrier *core.Carrier, decryptedUsername string, decryptedPassword string) *SinchHandler {
+	region := carrier.Setting("region", "")
+	if region == "" {
+		region = "us"
+	}
+	return &SinchHandler{
+		restCarrier: newRestCarrier(gateway, carrier, "sinch", "Sinch", map[string]string{
+			"queued":     core.DeliveryStatuses.Queued,
+			"dispatched": core.DeliveryStatuses.Sent,
+			"delivered":  core.DeliveryStatuses.Delivered,
+			"failed":     core.DeliveryStatuses.Undelivered,
+			"expired":    core.DeliveryStatuses.Undelivered,
+			"rejected":   core.DeliveryStatuses.Failed,
+			"aborted":    core.DeliveryStatuses.Failed,
+			"cancelled":  core.DeliveryStatuses.Failed,
+			"deleted":    core.DeliveryStatuses.Failed,
+		}),
+		apiToken:      decryptedPassword,
+		baseURL:       "https://" + region + ".sms.api.sinch.com/xms/v1/" + url.PathEscape(decryptedUsername),
+		webhookSecret: carrier.Setting("webhook_secret", ""),
+	}
+}
+
+func (h *SinchHandler) auth(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+h.apiToken)
+}
+
+// CheckHealth lists a single batch, which needs a reachable API and a valid token.
+func (h *SinchHandler) CheckHealth() error {
+	_, err := h.do(restRequest{Method: "GET", URL: h.baseURL + "/batches?page_size=1", Auth: h.auth})
+	return err
+}
+
+// SinchBatch is the body of a send batch request, Body is the text or, for mt_media, an object
+// with the media URL.
+type SinchBatch struct {
+	From            string      `json:"from"`
+	To              []string    `json:"to"`
+	Type            string      `json:"type,omitempty"`
+	Body            interface{} `json:"body"`
+	DeliveryReport  string      `json:"delivery_report,omitempty"`
+	CallbackURL     string      `json:"callback_url,omitempty"`
+	ClientReference string      `json:"client_reference,omitempty"`
+}
+
+type SinchMediaBody struct {
+	URL     string `json:"url"`
+	Message string `json:"message,omitempty"`
+}
+
+// SinchCallback is an inbound message (mo_*) or a delivery report.
+type SinchCallback struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	From      string          `json:"from"`
+	To        string          `json:"to"`
+	Body      json.RawMessage `json:"body"`
+	BatchID   string          `json:"batch_id"`
+	Recipient string          `json:"recipient"`
+	Status    string          `json:"status"`
+	Code      int             `json:"code"`
+}
+
+// webhookPolicy checks the HMAC-SHA256 of the body, the nonce and the timestamp when the carrier
+// has a webhook secret.
+func (h *SinchHandler) webhookPolicy() core.WebhookPolicy {
+	policy := core.WebhookPolicy{Algorithm: "hmac-sha256"}
+	if h.webhookSecret != "" {
+		policy.Verify = func(w *core.InboundWebhook) error {
+			// signed over body.nonce.timestamp
+			signed := string(w.Body) + "." + w.Header("x-sinch-webhook-signature-nonce") + "." +
+				w.Header("x-sinch-webhook-signature-timestamp")
+			return verifyHMAC(h.webhookSecret, []byte(signed), w.Header("x-sinch-webhook-signature"))
+		}
+		policy.Timestamp = func(w *core.InboundWebhook) (time.Time, error) {
+			return core.UnixTimestamp(w.Header("x-sinch-webhook-signature-timestamp"))
+		}
+		policy.Nonce = func(w *core.InboundWebhook) string {
+			return w.Header("x-sinch-webhook-signature-nonce")
+		}
+	}
+	return policy
+}
+
+// Inbound handles Sinch inbound messages and delivery reports.
+func (h *SinchHandler) Inbound(c iris.Context) error {
+	body, err := c.GetBody()
+	if err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	var callback SinchCallback
+	if err := json.Unmarshal(body, &callback); err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(callback.Type, "recipient_delivery_report"), strings.HasPrefix(callback.Type, "delivery_report"):
+		var errorCode string
+		if callback.Code != 0 {
+			errorCode = strconv.Itoa(callback.Code)
+		}
+		h.reportStatus(callback.BatchID, callback.Status, errorCode)
+
+	case callback.Type == "mo_text":
+		var text string
+		_ = json.Unmarshal(callback.Body, &text)
+		if err := h.receive(callback.From, callback.To, text, nil, callback.ID); err != nil {
+			return err
+		}
+
+	case callback.Type == "mo_media":
+		var media SinchMediaBody
+		_ = json.Unmarshal(callback.Body, &media)
+		var files []core.MsgFile
+		if media.URL != "" {
+			file, err := h.fetchMedia(media.URL, nil)
+			if err != nil {
+				c.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+			files = append(files, file)
+		}
+		if err := h.receive(callback.From, callback.To, media.Message, files, callback.ID); err != nil {
+			return err
+		}
+	}
+
+	c.StatusCode(http.StatusOK)
+	return nil
+}
+
+func (h *SinchHandler) send(ctx context.Context, batch SinchBatch, msg *core.MsgQueueItem) error {
+	batch.DeliveryReport = "per_recipient"
+	batch.CallbackURL = h.webhookURL()
+	batch.ClientReference = msg.LogID
+
+	resp, err := h.do(restRequest{Context: ctx, Method: "POST", URL: h.baseURL + "/batches", JSON: batch, Auth: h.auth})
+	if err != nil {
+		return err
+	}
+
+	var sent struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(resp, &sent); err != nil {
+		return err
+	}
+	h.gateway.TrackCarrierMessage(h.carrier.Name, sent.ID, msg)
+	return nil
+}
+
+// SendSMS sends an SMS batch via Sinch
+func (h *SinchHandler) SendSMS(ctx context.Context, sms *core.MsgQueueItem) error {
+	err := h.send(ctx, SinchBatch{From: sms.From, To: []string{sms.To}, Body: sms.Message}, sms)
+	if err != nil {
+		h.logSendError("SendSMS", sms, err)
+	}
+	return err
+}
+
+// SendMMS sends an mt_media batch per file via Sinch, the text goes with the first file
+func (h *SinchHandler) SendMMS(ctx context.Context, mms *core.MsgQueueItem) error {
+	urls, err := h.mediaURLs(mms)
+	if err != nil {
+		h.logSendError("SendMMS", mms, err)
+		return err
+	}
+
+	text := mms.Message
+	for _, mediaURL := range urls {
+		batch := SinchBatch{
+			From: mms.From,
+			To:   []string{mms.To},
+			Type: "mt_media",
+			Body: SinchMediaBody{URL: mediaURL, Message: text},
+		}
+		if err := h.send(ctx, batch, mms); err != nil {
+			h.logSendError("SendMMS", mms, err)
+			return err
+		}
+		text = ""
+	}
+	return nil
+}
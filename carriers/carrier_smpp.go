@@ -0,0 +1,407 @@
+package carriers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/smpp"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+// smppCarrierMaxBackoff caps the delay between bind attempts to an aggregator.
+const smppCarrierMaxBackoff = time.Minute
+
+// errSMPPNotBound is returned for sends while the bind to the aggregator is down.
+var errSMPPNotBound = errors.New("smpp carrier is not bound")
+
+// SMPPCarrier implements CarrierHandler for aggregators reached over SMPP instead of REST. It
+// keeps a transceiver bind open, rebinding with backoff when it drops, and checks it with
+// enquire_link. The username and password are the system_id and password, the config holds
+// "address" (host:port), "tls", "tls_skip_verify", "system_type" and "enquire_link". Delivery
+// receipts are reported through the same pipeline as REST carrier statuses.
+type SMPPCarrier struct {
+	restCarrier
+	address     string
+	systemID    string
+	password    string
+	systemType  string
+	tlsConfig   *tls.Config
+	enquireLink time.Duration
+
+	mu       sync.RWMutex
+	session  *smpp.Session
+	bindErr  error
+	sequence atomic.Int32
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSMPPCarrier initializes a new SMPPCarrier and starts binding to the aggregator
+func NewSMPPCarrier(gateway *core.Gateway, carrier *core.Carrier, decryptedUsername string, decryptedPassword string) *SMPPCarrier {
+	h := &SMPPCarrier{
+		restCarrier: newRestCarrier(gateway, carrier, "smpp", "SMPP", map[string]string{
+			// stat values of receipt texts and message_state names
+			"enroute":       core.DeliveryStatuses.Sent,
+			"acceptd":       core.DeliveryStatuses.Sent,
+			"accepted":      core.DeliveryStatuses.Sent,
+			"delivrd":       core.DeliveryStatuses.Delivered,
+			"delivered":     core.DeliveryStatuses.Delivered,
+			"expired":       core.DeliveryStatuses.Undelivered,
+			"undeliv":       core.DeliveryStatuses.Undelivered,
+			"undeliverable": core.DeliveryStatuses.Undelivered,
+			"deleted":       core.DeliveryStatuses.Failed,
+			"rejectd":       core.DeliveryStatuses.Failed,
+			"rejected":      core.DeliveryStatuses.Failed,
+		}),
+		address:     carrier.Setting("address", ""),
+		systemID:    decryptedUsername,
+		password:    decryptedPassword,
+		systemType:  carrier.Setting("system_type", ""),
+		enquireLink: 30 * time.Second,
+		bindErr:     errSMPPNotBound,
+		stop:        make(chan struct{}),
+	}
+	if d, err := time.ParseDuration(carrier.Setting("enquire_link", "")); err == nil && d > 0 {
+		h.enquireLink = d
+	}
+	if carrier.Setting("tls", "") == "true" {
+		host, _, _ := net.SplitHostPort(h.address)
+		h.tlsConfig = &tls.Config{ServerName: host, InsecureSkipVerify: carrier.Setting("tls_skip_verify", "") == "true"}
+	}
+	go h.run()
+	return h
+}
+
+// Close unbinds from the aggregator and stops rebinding, called when the carriers are reloaded.
+func (h *SMPPCarrier) Close() error {
+	h.stopOnce.Do(func() { close(h.stop) })
+	return nil
+}
+
+// nextSequence numbers the PDUs of the bind, it keeps counting over rebinds so the aggregator
+// can't take a new request for one of the previous connection.
+func (h *SMPPCarrier) nextSequence() int32 {
+	n := h.sequence.Add(1) & 0x7FFFFFFF
+	if n == 0 {
+		n = h.sequence.Add(1)
+	}
+	return n
+}
+
+// run keeps the bind up until the carrier is closed.
+func (h *SMPPCarrier) run() {
+	backoff := time.Second
+	for {
+		session, err := h.bind()
+		if err != nil {
+			h.setSession(nil, err)
+			h.logBind("SMPPCarrierBindFailed", logrus.ErrorLevel, err)
+			select {
+			case <-h.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, smppCarrierMaxBackoff)
+			continue
+		}
+
+		backoff = time.Second
+		h.setSession(session, nil)
+		h.logBind("SMPPCarrierBound", logrus.InfoLevel, h.address)
+		h.serve(session)
+		_ = session.Parent.Close()
+		h.setSession(nil, errSMPPNotBound)
+
+		select {
+		case <-h.stop:
+			return
+		default:
+			h.logBind("SMPPCarrierUnbound", logrus.WarnLevel, h.address)
+		}
+	}
+}
+
+// bind connects to the aggregator and binds as a transceiver.
+func (h *SMPPCarrier) bind() (*smpp.Session, error) {
+	if h.address == "" {
+		return nil, errors.New("smpp carrier has no address")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	session, err := smpp.Dial(ctx, h.address, h.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	session.NextSequence = h.nextSequence
+	session.ReadTimeout = 3 * h.enquireLink
+	session.WriteTimeout = core.SMPPResponseTimeout
+
+	resp, err := session.Submit(ctx, &pdu.BindTransceiver{
+		SystemID:   h.systemID,
+		Password:   h.password,
+		SystemType: h.systemType,
+		Version:    pdu.SMPPVersion34,
+	})
+	if err == nil && resp == nil {
+		err = errors.New("no bind_transceiver_resp")
+	}
+	if err == nil {
+		if status := pdu.ReadCommandStatus(resp); status != 0 {
+			err = core.ClassifyError(core.SMPPErrorClass(status), fmt.Sprintf("0x%08X", uint32(status)), &core.SMPPError{Status: status})
+		}
+	}
+	if err != nil {
+		_ = session.Parent.Close()
+		return nil, fmt.Errorf("bind to %s failed: %w", h.address, err)
+	}
+	return session, nil
+}
+
+func (h *SMPPCarrier) setSession(session *smpp.Session, err error) {
+	h.mu.Lock()
+	h.session = session
+	h.bindErr = err
+	h.mu.Unlock()
+}
+
+// serve answers the PDUs of the aggregator and sends enquire_link until the connection is lost
+// or the carrier is closed.
+func (h *SMPPCarrier) serve(session *smpp.Session) {
+	ticker := time.NewTicker(h.enquireLink)
+	defer ticker.Stop()
+	// the session blocks on PDUs nobody reads until its connection is gone
+	defer func() {
+		go func() {
+			for {
+				select {
+				case <-session.PDU():
+				case <-session.Done():
+					return
+				}
+			}
+		}()
+	}()
+
+	for {
+		select {
+		case <-h.stop:
+			unbind(session)
+			return
+		case <-session.Done():
+			return
+		case <-ticker.C:
+			go h.enquire(session)
+		case packet, ok := <-session.PDU():
+			if !ok {
+				return
+			}
+			h.handlePDU(session, packet)
+		}
+	}
+}
+
+// unbind ends the bind, then drops the connection. Session.Close isn't used since it closes the
+// PDU channel the session may still write to.
+func unbind(session *smpp.Session) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, _ = session.Submit(ctx, new(pdu.Unbind))
+	_ = session.Parent.Close()
+}
+
+// enquire drops the connection when the aggregator doesn't answer an enquire_link, run rebinds.
+func (h *SMPPCarrier) enquire(session *smpp.Session) {
+	ctx, cancel := context.WithTimeout(context.Background(), core.SMPPResponseTimeout)
+	defer cancel()
+	if _, err := session.Submit(ctx, new(pdu.EnquireLink)); err != nil {
+		h.logBind("SMPPEnquireLinkError", logrus.ErrorLevel, err)
+		_ = session.Parent.Close()
+	}
+}
+
+func (h *SMPPCarrier) handlePDU(session *smpp.Session, packet any) {
+	var resp any
+	switch p := packet.(type) {
+	case *pdu.DeliverSM:
+		deliverResp := p.Resp().(*pdu.DeliverSMResp)
+		if err := h.handleDeliverSM(p); err != nil {
+			// the aggregator redelivers on a temporary error
+			h.logBind("GenericError", logrus.ErrorLevel, err)
+			deliverResp.Header.CommandStatus = pdu.ErrSystemError
+		}
+		resp = deliverResp
+	case *pdu.Unbind:
+		resp = p.Resp()
+		defer session.Parent.Close()
+	case pdu.Responsable:
+		resp = p.Resp()
+	default:
+		return
+	}
+	if err := session.Send(resp); err != nil {
+		h.logBind("SMPPPDUError", logrus.ErrorLevel, err)
+	}
+}
+
+// Delivery receipt TLVs beyond those in sms_server.go, see SMPP v5 section 4.8.4.42.
+const tagNetworkErrorCode uint16 = 0x0423
+
+var smppReceiptField = regexp.MustCompile(`(?i)\b(id|stat|err):(\S+)`)
+
+// handleDeliverSM reports a delivery receipt or routes a mobile originated message.
+func (h *SMPPCarrier) handleDeliverSM(deliverSM *pdu.DeliverSM) error {
+	if deliverSM.ESMClass.MessageType&0b0001 != 0 || deliverSM.ESMClass.MessageType&0b1000 != 0 {
+		id, status, errorCode := parseSMPPReceipt(deliverSM)
+		if id == "" {
+			return errors.New("delivery receipt without a message id")
+		}
+		h.reportStatus(id, status, errorCode)
+		return nil
+	}
+
+	text, err := deliverSM.Message.Parse()
+	if err != nil {
+		return err
+	}
+	return h.receive(deliverSM.SourceAddr.String(), deliverSM.DestAddr.String(), text, nil, primitive.NewObjectID().Hex())
+}
+
+// parseSMPPReceipt returns the message id, stat and error code of a delivery receipt, from its
+// TLVs when present and the receipt text otherwise.
+func parseSMPPReceipt(deliverSM *pdu.DeliverSM) (id string, status string, errorCode string) {
+	for _, m := range smppReceiptField.FindAllStringSubmatch(string(deliverSM.Message.Message), -1) {
+		switch strings.ToLower(m[1]) {
+		case "id":
+			id = m[2]
+		case "stat":
+			status = m[2]
+		case "err":
+			errorCode = m[2]
+		}
+	}
+	if v, ok := deliverSM.Tags[core.TagReceiptedMessageID]; ok && len(v) > 0 {
+		id = string(bytes.TrimRight(v, "\x00"))
+	}
+	if v, ok := deliverSM.Tags[core.TagMessageState]; ok && len(v) == 1 {
+		status = pdu.MessageState(v[0]).String()
+	}
+	if v, ok := deliverSM.Tags[tagNetworkErrorCode]; ok && len(v) == 3 {
+		errorCode = fmt.Sprintf("%03d", int(v[1])<<8|int(v[2]))
+	}
+	return
+}
+
+// Inbound isn't used, aggregators deliver messages and receipts over the bind.
+func (h *SMPPCarrier) Inbound(c iris.Context) error {
+	c.StatusCode(http.StatusNotFound)
+	return nil
+}
+
+// CheckHealth reports whether the bind to the aggregator is up.
+func (h *SMPPCarrier) CheckHealth() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.session == nil {
+		return h.bindErr
+	}
+	return nil
+}
+
+// smppAddress is the address of a number in a submit_sm, international for E.164 numbers and
+// network specific for short codes.
+func smppAddress(number string) pdu.Address {
+	if core.IsShortCode(number) {
+		return pdu.Address{TON: 0x03, NPI: 0x00, No: number}
+	}
+	return pdu.Address{TON: 0x01, NPI: 0x01, No: strings.TrimPrefix(number, "+")}
+}
+
+// submit sends the text as submit_sm segments requesting delivery receipts, the message_id of
+// every segment is tracked for them and their receipts are aggregated into one for the client.
+func (h *SMPPCarrier) submit(ctx context.Context, msg *core.MsgQueueItem, text string) error {
+	h.mu.RLock()
+	session, bindErr := h.session, h.bindErr
+	h.mu.RUnlock()
+	if session == nil {
+		return bindErr
+	}
+
+	segments, dataCoding := core.SMPPSegments(text)
+	multipartID := ""
+	for _, encoded := range segments {
+		submitSM := &pdu.SubmitSM{
+			SourceAddr: smppAddress(msg.From),
+			DestAddr:   smppAddress(msg.To),
+			Message:    pdu.ShortMessage{Message: encoded, DataCoding: dataCoding},
+			RegisteredDelivery: pdu.RegisteredDelivery{
+				MCDeliveryReceipt: 1,
+			},
+		}
+
+		submitCtx, cancel := context.WithTimeout(ctx, core.SMPPResponseTimeout)
+		resp, err := session.Submit(submitCtx, submitSM)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error sending SubmitSM: %v", err)
+		}
+		if status := pdu.ReadCommandStatus(resp); status != 0 {
+			return core.ClassifyError(core.SMPPErrorClass(status), fmt.Sprintf("0x%08X", uint32(status)), &core.SMPPError{Status: status})
+		}
+		if submitResp, ok := resp.(*pdu.SubmitSMResp); ok && submitResp.MessageID != "" {
+			if multipartID == "" {
+				multipartID = submitResp.MessageID
+			}
+			h.gateway.TrackCarrierSegment(h.carrier.Name, submitResp.MessageID, msg, len(segments), multipartID)
+		}
+	}
+	return nil
+}
+
+// SendSMS sends an SMS over the bind
+func (h *SMPPCarrier) SendSMS(ctx context.Context, sms *core.MsgQueueItem) error {
+	err := h.submit(ctx, sms, sms.Message)
+	if err != nil {
+		h.logSendError("SendSMS", sms, err)
+	}
+	return err
+}
+
+// SendMMS sends the text of an MMS with links to its files in the media store, SMPP has no MMS
+func (h *SMPPCarrier) SendMMS(ctx context.Context, mms *core.MsgQueueItem) error {
+	urls, err := h.mediaURLs(mms)
+	if err == nil {
+		text := strings.TrimSpace(strings.Join(append([]string{mms.Message}, urls...), "\n"))
+		err = h.submit(ctx, mms, text)
+	}
+	if err != nil {
+		h.logSendError("SendMMS", mms, err)
+	}
+	return err
+}
+
+func (h *SMPPCarrier) logBind(template string, level logrus.Level, args ...interface{}) {
+	var lm = h.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Carrier.Bind.SMPP",
+		template,
+		level,
+		map[string]interface{}{
+			"carrier":  h.carrier.Name,
+			"systemID": h.systemID,
+		}, args...,
+	))
+}
@@ -0,0 +1,582 @@
+package carriers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// telnyxValidateSignature turns Ed25519 webhook signature validation off when set to "false".
+var telnyxValidateSignature bool
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		telnyxValidateSignature = cfg.Getenv("TELNYX_VALIDATE_SIGNATURE") != "false"
+	})
+}
+
+// TelnyxHandler implements CarrierHandler for Telnyx
+type TelnyxHandler struct {
+	BaseCarrierHandler
+	gateway            *core.Gateway
+	carrier            *core.Carrier
+	password           string
+	messagingProfileID string
+	publicKey          ed25519.PublicKey
+}
+
+// NewTelnyxHandler initializes a new TelnyxHandler. The password is the API key, the messaging
+// profile and webhook public key come from the carrier config or the environment.
+func NewTelnyxHandler(gateway *core.Gateway, carrier *core.Carrier, decryptedUsername string, decryptedPassword string) *TelnyxHandler {
+	h := &TelnyxHandler{
+		BaseCarrierHandler: BaseCarrierHandler{name: "telnyx"},
+		gateway:            gateway,
+		carrier:            carrier,
+		password:           decryptedPassword,
+		messagingProfileID: carrier.Setting("messaging_profile_id", "TELNYX_MESSAGING_PROFILE_ID"),
+	}
+
+	if key := carrier.Setting("public_key", "TELNYX_PUBLIC_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err == nil && len(decoded) == ed25519.PublicKeySize {
+			h.publicKey = ed25519.PublicKey(decoded)
+		} else {
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"Carrier.Telnyx",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"carrier": carrier.Name,
+				}, "invalid Telnyx public key",
+			))
+		}
+	}
+	return h
+}
+
+// TelnyxMessage represents the structure of Telnyx outbound messages
+type TelnyxMessage struct {
+	From               string   `json:"from"`
+	To                 string   `json:"to"`
+	Text               string   `json:"text,omitempty"`
+	Subject            string   `json:"subject,omitempty"`
+	MediaUrls          []string `json:"media_urls,omitempty"`
+	MessagingProfileID string   `json:"messaging_profile_id,omitempty"`
+	WebhookURL         string   `json:"webhook_url,omitempty"`
+	WebhookFailoverURL string   `json:"webhook_failover_url,omitempty"`
+}
+
+// TelnyxResponse represents the response from Telnyx API
+type TelnyxResponse struct {
+	Data TelnyxMessageData `json:"data"`
+}
+
+type TelnyxMessageData struct {
+	ID string `json:"id"`
+	// Add other relevant fields as needed
+}
+
+// Inbound handles incoming Telnyx webhooks, received MMS and SMS messages are routed to the
+// client and message.sent/message.finalized events update the delivery status.
+func (h *TelnyxHandler) Inbound(c iris.Context) error {
+	var lm = h.gateway.LogManager
+
+	body, err := c.GetBody()
+	if err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	// Parse the Telnyx webhook JSON payload
+	var webhookPayload TelnyxWebhookPayload
+	if err := json.Unmarshal(body, &webhookPayload); err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Inbound.Telnyx",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil,
+			err,
+		))
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	if len(webhookPayload.Data.Payload.To) <= 0 {
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Inbound.Telnyx",
+			"CarrierNoDestinations",
+			logrus.ErrorLevel,
+			nil,
+		))
+
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	switch webhookPayload.Data.EventType {
+	case "message.received":
+	case "message.sent", "message.finalized":
+		payload := webhookPayload.Data.Payload
+		var errorCode string
+		if len(payload.Errors) > 0 {
+			errorCode = payload.Errors[0].Code
+		}
+		status := payload.To[0].Status
+		err := h.gateway.Router.CarrierDeliveryStatus(h.carrier.Name, payload.ID, telnyxDeliveryStatus(status), errorCode)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.Inbound.Telnyx",
+				"GenericError",
+				logrus.WarnLevel,
+				map[string]interface{}{
+					"logID":  payload.ID,
+					"status": status,
+				}, err,
+			))
+		}
+		c.StatusCode(http.StatusOK)
+		return nil
+	default:
+		c.StatusCode(http.StatusOK)
+		return nil
+	}
+
+	// Extract necessary fields
+	from := webhookPayload.Data.Payload.From.PhoneNumber
+	to := webhookPayload.Data.Payload.To[0].PhoneNumber
+	text := webhookPayload.Data.Payload.Text
+	messageID := core.IngressLogID(webhookPayload.Data.Payload.ID)
+
+	numMedia := len(webhookPayload.Data.Payload.Media)
+
+	var files []core.MsgFile
+	if numMedia > 0 {
+		ff := h.fetchTelnyxMediaFiles(webhookPayload.Data.Payload.Media, messageID)
+		if len(ff) <= 0 {
+			c.StatusCode(http.StatusBadRequest)
+			return nil
+		}
+		files = ff
+	}
+
+	// Handle MMS if media files are present
+	if numMedia > 0 && len(files) > 0 {
+		msg := core.MsgQueueItem{
+			To:                to,
+			From:              from,
+			ReceivedTimestamp: time.Now(),
+			Type:              core.MsgQueueItemType.MMS,
+			Files:             files,
+			SkipNumberCheck:   false,
+			LogID:             messageID,
+			InboundCarrier:    h.carrier.Name,
+		}
+		core.NormalizeAddresses(&msg, nil)
+		if err := h.gateway.Router.OfferCarrierMessage(msg); err != nil {
+			return err
+		}
+	}
+
+	// Handle SMS if body is present
+	if strings.TrimSpace(text) != "" {
+		smsMessages := splitSMS(text, 140)
+		for _, smsBody := range smsMessages {
+			sms := core.MsgQueueItem{
+				To:                to,
+				From:              from,
+				ReceivedTimestamp: time.Now(),
+				Type:              core.MsgQueueItemType.SMS,
+				Message:           smsBody,
+				LogID:             messageID,
+				InboundCarrier:    h.carrier.Name,
+			}
+			core.NormalizeAddresses(&sms, nil)
+			if err := h.gateway.Router.OfferCarrierMessage(sms); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Respond with HTTP 200 OK
+	c.StatusCode(http.StatusOK)
+	return nil
+}
+
+// webhookPolicy checks the Ed25519 signature of the webhooks, which covers telnyx-timestamp.
+func (h *TelnyxHandler) webhookPolicy() core.WebhookPolicy {
+	policy := core.WebhookPolicy{Algorithm: "ed25519", Status: http.StatusForbidden}
+	if telnyxValidateSignature {
+		policy.Verify = func(w *core.InboundWebhook) error {
+			return h.validateSignature(w.Context, w.Body)
+		}
+		policy.Timestamp = func(w *core.InboundWebhook) (time.Time, error) {
+			return core.UnixTimestamp(w.Header("telnyx-timestamp"))
+		}
+		policy.Nonce = func(w *core.InboundWebhook) string {
+			return w.Header("telnyx-signature-ed25519")
+		}
+	}
+	return policy
+}
+
+// validateSignature checks the telnyx-signature-ed25519 header, the Ed25519 signature of the
+// telnyx-timestamp header and the raw body joined by "|".
+func (h *TelnyxHandler) validateSignature(c iris.Context, body []byte) error {
+	if h.publicKey == nil {
+		return errors.New("carrier has no public key")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(c.GetHeader("telnyx-signature-ed25519"))
+	if err != nil || len(signature) == 0 {
+		return errors.New("missing or invalid telnyx-signature-ed25519")
+	}
+
+	timestamp := c.GetHeader("telnyx-timestamp")
+	signed := append([]byte(timestamp+"|"), body...)
+	if !ed25519.Verify(h.publicKey, signed, signature) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// telnyxDeliveryStatus maps the status of a Telnyx recipient onto the gateway delivery statuses.
+func telnyxDeliveryStatus(status string) string {
+	switch status {
+	case "delivered":
+		return core.DeliveryStatuses.Delivered
+	case "delivery_failed":
+		return core.DeliveryStatuses.Undelivered
+	case "sending_failed":
+		return core.DeliveryStatuses.Failed
+	case "sent", "delivery_unconfirmed":
+		return core.DeliveryStatuses.Sent
+	}
+	return core.DeliveryStatuses.Queued
+}
+
+// TelnyxWebhookPayload represents the structure of Telnyx inbound webhook
+type TelnyxWebhookPayload struct {
+	Data TelnyxEventData `json:"data"`
+}
+
+type TelnyxEventData struct {
+	EventType  string               `json:"event_type"`
+	ID         string               `json:"id"`
+	OccurredAt string               `json:"occurred_at"`
+	Payload    TelnyxMessagePayload `json:"payload"`
+	RecordType string               `json:"record_type"`
+}
+
+type TelnyxMessagePayload struct {
+	Direction string              `json:"direction"`
+	ID        string              `json:"id"`
+	From      TelnyxPhoneNumber   `json:"from"`
+	To        []TelnyxPhoneNumber `json:"to"`
+	Text      string              `json:"text"`
+	Media     []TelnyxMedia       `json:"media"`
+	Errors    []TelnyxError       `json:"errors"`
+	// Add other relevant fields as needed
+}
+
+type TelnyxPhoneNumber struct {
+	PhoneNumber string `json:"phone_number"`
+	Carrier     string `json:"carrier"`
+	LineType    string `json:"line_type"`
+	Status      string `json:"status"`
+}
+
+type TelnyxMedia struct {
+	ContentType string `json:"content_type"`
+	URL         string `json:"url"`
+}
+
+// TelnyxError is an error reported for a message, in webhooks and API responses.
+type TelnyxError struct {
+	Code   string `json:"code"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+// fetchTelnyxMediaFiles retrieves media files from Telnyx webhook payload
+func (h *TelnyxHandler) fetchTelnyxMediaFiles(media []TelnyxMedia, messageID string) []core.MsgFile {
+	var files []core.MsgFile
+	for _, m := range media {
+		contentType := m.ContentType
+		mediaURL := m.URL
+
+		parts := strings.Split(contentType, "/")
+		if len(parts) != 2 {
+			// todo?
+			continue
+		}
+
+		/*extension := parts[1]*/
+		mediaSid := path.Base(mediaURL)
+		filename := fmt.Sprintf("%s" /*.%s"*/, mediaSid /*, extension*/) // e.g., mediaSid.jpg
+
+		// Fetch the media content
+		contentBytes, err := fetchMediaContentTelnyx(mediaURL)
+		if err != nil {
+			var lm = h.gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"Carrier.FetchMedia.Telnyx",
+				"CarrierFetchMediaError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": messageID,
+				}, mediaURL,
+			))
+			continue
+		}
+
+		// Create the MsgFile struct
+		file := core.MsgFile{
+			Filename:    filename,
+			ContentType: contentType,
+			Content:     contentBytes,
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// fetchMediaContentTelnyx retrieves media content from Telnyx URL
+func fetchMediaContentTelnyx(mediaURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Non-OK HTTP status: %s", resp.Status)
+	}
+
+	contentBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading media content: %w", err)
+	}
+
+	return contentBytes, nil
+}
+
+// sendMessage posts a message to the Telnyx v2 messages API and records the message ID for
+// delivery status webhooks.
+func (h *TelnyxHandler) sendMessage(ctx context.Context, message TelnyxMessage, msg *core.MsgQueueItem) error {
+	message.MessagingProfileID = h.messagingProfileID
+	if profile := h.gateway.SendingNumber(msg.From).MessagingProfileID; profile != "" {
+		message.MessagingProfileID = profile
+	}
+	if base := core.Getenv("SERVER_ADDRESS"); base != "" {
+		message.WebhookURL = strings.TrimRight(base, "/") + "/inbound/" + h.carrier.UUID
+	}
+
+	// Serialize to JSON
+	payloadBytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	// Create HTTP request
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.telnyx.com/v2/messages", bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return err
+	}
+
+	// Set headers
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+h.password)
+
+	// Perform the request
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Read and parse response
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.New("failed to read response from Telnyx")
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
+		var errResp struct {
+			Errors []TelnyxError `json:"errors"`
+		}
+		if json.Unmarshal(bodyBytes, &errResp) == nil && len(errResp.Errors) > 0 {
+			code := errResp.Errors[0].Code
+			err := fmt.Errorf("telnyx returned %d: %s %s", resp.StatusCode, code, errResp.Errors[0].Title)
+			if class := core.CarrierErrorClass("telnyx", code); class != core.ErrorClasses.Unknown {
+				return core.ClassifyError(class, code, err)
+			}
+			return core.ClassifyError(core.HTTPErrorClass(resp.StatusCode), strconv.Itoa(resp.StatusCode), err)
+		}
+		return core.ClassifyError(core.HTTPErrorClass(resp.StatusCode), strconv.Itoa(resp.StatusCode), fmt.Errorf("telnyx returned %d", resp.StatusCode))
+	}
+
+	// Telnyx took the message, an answer that doesn't parse only costs the delivery reports
+	var telnyxResp TelnyxResponse
+	if err := json.Unmarshal(bodyBytes, &telnyxResp); err != nil {
+		var lm = h.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Send.Telnyx",
+			"CarrierResponseUnparsed",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"logID": msg.LogID,
+			}, err,
+		))
+		return nil
+	}
+	h.gateway.TrackCarrierMessage(h.carrier.Name, telnyxResp.Data.ID, msg)
+
+	return nil
+}
+
+// CheckHealth fetches the account balance, which needs a reachable API and a valid API key.
+func (h *TelnyxHandler) CheckHealth() error {
+	req, err := http.NewRequest("GET", "https://api.telnyx.com/v2/balance", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.password)
+	return core.ProbeHTTP(&http.Client{Timeout: 30 * time.Second}, req)
+}
+
+// listNumbers lists the phone numbers of the account, 250 per page.
+func (h *TelnyxHandler) listNumbers(ctx context.Context) ([]string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	var numbers []string
+	for page := 1; ; page++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://api.telnyx.com/v2/phone_numbers?page[number]=%d&page[size]=250", page), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+h.password)
+		req.Header.Set("Accept", "application/json")
+
+		var list struct {
+			Data []struct {
+				PhoneNumber string `json:"phone_number"`
+			} `json:"data"`
+			Meta struct {
+				TotalPages int `json:"total_pages"`
+			} `json:"meta"`
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, core.ClassifyError(core.HTTPErrorClass(resp.StatusCode), strconv.Itoa(resp.StatusCode), fmt.Errorf("telnyx phone numbers returned %d", resp.StatusCode))
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the telnyx phone numbers: %w", err)
+		}
+		for _, number := range list.Data {
+			numbers = append(numbers, number.PhoneNumber)
+		}
+		if page >= list.Meta.TotalPages {
+			return numbers, nil
+		}
+	}
+}
+
+// SendSMS sends an SMS message via Telnyx API
+func (h *TelnyxHandler) SendSMS(ctx context.Context, sms *core.MsgQueueItem) error {
+	message := TelnyxMessage{
+		From: sms.From,
+		To:   sms.To,
+		Text: sms.Message,
+	}
+
+	if err := h.sendMessage(ctx, message, sms); err != nil {
+		var lm = h.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.SendSMS.Telnyx",
+			"GenericError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"logID": sms.LogID,
+			}, err,
+		))
+		return err
+	}
+	return nil
+}
+
+// SendMMS sends an MMS message via Telnyx API
+func (h *TelnyxHandler) SendMMS(ctx context.Context, mms *core.MsgQueueItem) error {
+	message := TelnyxMessage{
+		From:      mms.From,
+		To:        mms.To,
+		Subject:   "Picture", // Or derive from your context
+		MediaUrls: []string{},
+	}
+
+	var mediaUrls []string
+
+	if len(mms.Files) > 0 {
+		for _, i := range mms.Files {
+			if strings.Contains(i.ContentType, "application/smil") {
+				continue
+			}
+
+			id, err := h.gateway.SaveMsgFileMedia(i, mms.LogID)
+			if err != nil {
+				var lm = h.gateway.LogManager
+				lm.SendLog(lm.BuildLog(
+					"Carrier.SendMMS.Telnyx",
+					"SaveMediaError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"logID": mms.LogID,
+					}, err,
+				))
+				return err
+			}
+
+			mediaUrls = append(mediaUrls, core.Getenv("SERVER_ADDRESS")+"/media/"+strconv.Itoa(int(id)))
+		}
+		message.MediaUrls = mediaUrls
+	}
+
+	if err := h.sendMessage(ctx, message, mms); err != nil {
+		var lm = h.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.SendMMS.Telnyx",
+			"GenericError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"logID": mms.LogID,
+			}, err,
+		))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,534 @@
+package carriers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"github.com/twilio/twilio-go"
+	twilioClient "github.com/twilio/twilio-go/client"
+	twilioApi "github.com/twilio/twilio-go/rest/api/v2010"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// TwilioHandler implements CarrierHandler for Twilio
+type TwilioHandler struct {
+	BaseCarrierHandler
+	client     *twilio.RestClient
+	gateway    *core.Gateway
+	carrier    *core.Carrier
+	accountSid string
+	authToken  string
+}
+
+func NewTwilioHandler(gateway *core.Gateway, carrier *core.Carrier, decryptedUsername string, decryptedPassword string) *TwilioHandler {
+	return &TwilioHandler{
+		BaseCarrierHandler: BaseCarrierHandler{name: "twilio"},
+		client: twilio.NewRestClientWithParams(twilio.ClientParams{
+			Username: decryptedUsername,
+			Password: decryptedPassword,
+		}),
+		gateway:    gateway,
+		carrier:    carrier,
+		accountSid: decryptedUsername,
+		authToken:  decryptedPassword,
+	}
+}
+
+// twilioValidateSignature turns X-Twilio-Signature validation off when set to "false", e.g. behind
+// a proxy that rewrites the webhook URL.
+var twilioValidateSignature bool
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		twilioValidateSignature = cfg.Getenv("TWILIO_VALIDATE_SIGNATURE") != "false"
+	})
+}
+
+// twilioMediaClient fetches inbound media, Twilio redirects media URLs to its CDN.
+var twilioMediaClient = &http.Client{Timeout: 30 * time.Second}
+
+// Inbound handles incoming Twilio webhooks for MMS and SMS messages. Messages are answered with
+// an empty TwiML response, status callbacks with 204.
+func (h *TwilioHandler) Inbound(c iris.Context) error {
+	var lm = h.gateway.LogManager
+
+	if err := c.Request().ParseForm(); err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+	form := c.Request().PostForm
+
+	// Common parameters
+	from := form.Get("From")
+	to := form.Get("To")
+	body := form.Get("Body")
+	messageSid := form.Get("MessageSid")
+
+	if status := form.Get("MessageStatus"); status != "" {
+		// status callback for an outbound message
+		err := h.gateway.Router.CarrierDeliveryStatus(h.carrier.Name, messageSid, twilioDeliveryStatus(status), form.Get("ErrorCode"))
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.Inbound.Twilio",
+				"GenericError",
+				logrus.WarnLevel,
+				map[string]interface{}{
+					"logID":  messageSid,
+					"status": status,
+				}, err,
+			))
+		}
+		c.StatusCode(http.StatusNoContent)
+		return nil
+	}
+
+	if to == "" {
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Inbound.Twilio",
+			"CarrierNoDestinations",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"logID": messageSid,
+			},
+		))
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	transId := core.IngressLogID(messageSid)
+	if transId == "" {
+		transId = primitive.NewObjectID().Hex()
+	}
+
+	// Parse the number of media items
+	numMedia, err := strconv.Atoi(form.Get("NumMedia"))
+	if err != nil {
+		numMedia = 0
+	}
+
+	var files []core.MsgFile
+
+	// Fetch media files if present
+	if numMedia > 0 {
+		ff := h.fetchMediaFiles(form, numMedia, transId)
+		if len(ff) <= 0 {
+			c.StatusCode(http.StatusBadRequest)
+			return nil
+		}
+		files = ff
+	}
+
+	// Handle MMS if media files are present
+	if numMedia > 0 && len(files) > 0 {
+		msg := core.MsgQueueItem{
+			To:                to,
+			From:              from,
+			ReceivedTimestamp: time.Now(),
+			Type:              core.MsgQueueItemType.MMS,
+			Files:             files,
+			SkipNumberCheck:   false,
+			LogID:             transId,
+			InboundCarrier:    h.carrier.Name,
+		}
+		core.NormalizeAddresses(&msg, nil)
+		if err := h.gateway.Router.OfferCarrierMessage(msg); err != nil {
+			return err
+		}
+	}
+
+	// Handle SMS if body is present
+	if strings.TrimSpace(body) != "" {
+		smsMessages := splitSMS(body, 140)
+		for _, smsBody := range smsMessages {
+			sms := core.MsgQueueItem{
+				To:                to,
+				From:              from,
+				ReceivedTimestamp: time.Now(),
+				Type:              core.MsgQueueItemType.SMS,
+				Message:           smsBody,
+				LogID:             transId,
+				InboundCarrier:    h.carrier.Name,
+			}
+			core.NormalizeAddresses(&sms, nil)
+			if err := h.gateway.Router.OfferCarrierMessage(sms); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Empty TwiML response, replies are sent through the API
+	c.ContentType("text/xml")
+	_, err = c.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Response></Response>")
+	return err
+}
+
+// CheckHealth fetches the account, which fails when the API is unreachable or the credentials
+// are rejected.
+func (h *TwilioHandler) CheckHealth() error {
+	_, err := h.client.Api.FetchAccount(h.accountSid)
+	return classifyTwilioError(err)
+}
+
+// listNumbers lists the IncomingPhoneNumbers of the account. The Twilio client takes no context,
+// the listing runs to its end.
+func (h *TwilioHandler) listNumbers(ctx context.Context) ([]string, error) {
+	records, err := h.client.Api.ListIncomingPhoneNumber((&twilioApi.ListIncomingPhoneNumberParams{}).SetPageSize(1000))
+	if err != nil {
+		return nil, classifyTwilioError(err)
+	}
+	numbers := make([]string, 0, len(records))
+	for _, record := range records {
+		if record.PhoneNumber != nil {
+			numbers = append(numbers, *record.PhoneNumber)
+		}
+	}
+	return numbers, nil
+}
+
+// classifyTwilioError attaches the error class of the Twilio error code to an API error.
+func classifyTwilioError(err error) error {
+	var restErr *twilioClient.TwilioRestError
+	if !errors.As(err, &restErr) {
+		return err
+	}
+	if class := core.TwilioErrorClasses[restErr.Code]; class != core.ErrorClasses.Unknown {
+		return core.ClassifyError(class, strconv.Itoa(restErr.Code), err)
+	}
+	return core.ClassifyError(core.HTTPErrorClass(restErr.Status), strconv.Itoa(restErr.Status), err)
+}
+
+// twilioDeliveryStatus maps a Twilio MessageStatus onto the gateway delivery statuses.
+func twilioDeliveryStatus(status string) string {
+	switch status {
+	case "delivered", "read":
+		return core.DeliveryStatuses.Delivered
+	case "undelivered":
+		return core.DeliveryStatuses.Undelivered
+	case "failed", "canceled":
+		return core.DeliveryStatuses.Failed
+	case "sent":
+		return core.DeliveryStatuses.Sent
+	}
+	return core.DeliveryStatuses.Queued
+}
+
+// statusCallbackURL is the webhook Twilio posts delivery statuses to, empty when the public
+// address of the gateway isn't known.
+func (h *TwilioHandler) statusCallbackURL() string {
+	base := core.Getenv("SERVER_ADDRESS")
+	if base == "" {
+		return ""
+	}
+	return strings.TrimRight(base, "/") + "/inbound/" + h.carrier.UUID
+}
+
+// webhookPolicy checks X-Twilio-Signature, Twilio retries a webhook with the same
+// I-Twilio-Idempotency-Token.
+func (h *TwilioHandler) webhookPolicy() core.WebhookPolicy {
+	policy := core.WebhookPolicy{Algorithm: "hmac-sha1", Status: http.StatusForbidden}
+	if twilioValidateSignature {
+		policy.Verify = func(w *core.InboundWebhook) error {
+			return h.validateSignature(w.Context, w.Form())
+		}
+		policy.Nonce = func(w *core.InboundWebhook) string {
+			return w.Header("I-Twilio-Idempotency-Token")
+		}
+	}
+	return policy
+}
+
+// validateSignature checks X-Twilio-Signature, the base64 HMAC-SHA1 of the webhook URL followed
+// by the sorted POST parameters, keyed with the auth token of the carrier.
+func (h *TwilioHandler) validateSignature(c iris.Context, form url.Values) error {
+	if h.authToken == "" {
+		return errors.New("carrier has no auth token")
+	}
+	signed := requestURL(c) + sortedParams(form)
+	return verifyHMACSHA1(h.authToken, []byte(signed), c.GetHeader("X-Twilio-Signature"))
+}
+
+// fetchMediaFiles retrieves media files from Twilio, saves them to the media store and returns a
+// slice of MsgFile structs.
+func (h *TwilioHandler) fetchMediaFiles(form url.Values, numMedia int, logID string) []core.MsgFile {
+	var lm = h.gateway.LogManager
+	var files []core.MsgFile
+
+	for i := 0; i < numMedia; i++ {
+		mediaURL := form.Get(fmt.Sprintf("MediaUrl%d", i))
+		contentType := form.Get(fmt.Sprintf("MediaContentType%d", i))
+		mediaSid := path.Base(mediaURL)
+		parts := strings.Split(contentType, "/")
+
+		if mediaURL == "" || len(parts) != 2 {
+			continue
+		}
+
+		extension := parts[1]
+		filename := fmt.Sprintf("%s.%s", mediaSid, extension) // e.g., mediaSid.jpg
+
+		contentBytes, err := h.fetchMedia(mediaURL)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.FetchMedia.Twilio",
+				"CarrierFetchMediaError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": logID,
+					"error": err.Error(),
+				}, mediaURL,
+			))
+			continue
+		}
+
+		file := core.MsgFile{
+			Filename:    filename,
+			ContentType: contentType,
+			Content:     contentBytes,
+			Size:        len(contentBytes),
+		}
+
+		// the media store keeps base64, the message carries the raw content
+		id, err := h.gateway.SaveMsgFileMedia(core.MsgFile{
+			Filename:    filename,
+			ContentType: contentType,
+			Content:     []byte(base64.StdEncoding.EncodeToString(contentBytes)),
+		}, logID)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.FetchMedia.Twilio",
+				"SaveMediaError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": logID,
+				}, err,
+			))
+		} else {
+			file.URL = core.Getenv("SERVER_ADDRESS") + "/media/" + strconv.Itoa(int(id))
+		}
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// fetchMedia downloads a media URL with the carrier credentials, needed when the Twilio account
+// enforces HTTP auth on media. Media larger than API_MEDIA_MAX_SIZE is refused.
+func (h *TwilioHandler) fetchMedia(mediaURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.accountSid != "" {
+		req.SetBasicAuth(h.accountSid, h.authToken)
+	}
+
+	resp, err := twilioMediaClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, int64(core.APIMediaMaxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > core.APIMediaMaxSize {
+		return nil, fmt.Errorf("media exceeds %d bytes", core.APIMediaMaxSize)
+	}
+	return content, nil
+}
+
+// splitSMS splits the SMS content into multiple messages, each not exceeding maxBytes.
+// It ensures that multi-byte characters are not split.
+func splitSMS(body string, maxBytes int) []string {
+	var smsSegments []string
+	currentSegment := ""
+	currentBytes := 0
+
+	for _, r := range body {
+		runeBytes := len(string(r))
+		if currentBytes+runeBytes > maxBytes {
+			if currentSegment != "" {
+				smsSegments = append(smsSegments, currentSegment)
+			}
+			currentSegment = string(r)
+			currentBytes = runeBytes
+		} else {
+			currentSegment += string(r)
+			currentBytes += runeBytes
+		}
+	}
+
+	if currentSegment != "" {
+		smsSegments = append(smsSegments, currentSegment)
+	}
+
+	return smsSegments
+}
+
+// setMessagingService sends through the Messaging Service of the sending number, so the message
+// is attributed to the A2P campaign registered with it.
+func (h *TwilioHandler) setMessagingService(params *twilioApi.CreateMessageParams, from string) {
+	if sid := h.gateway.SendingNumber(from).MessagingServiceSID; sid != "" {
+		params.SetMessagingServiceSid(sid)
+	}
+}
+
+// twilioIdempotentClient sends the idempotency key of a message along with the requests of the
+// Twilio client, so Twilio drops a repeated send.
+type twilioIdempotentClient struct {
+	twilioClient.BaseClient
+	key string
+}
+
+func (c *twilioIdempotentClient) SendRequest(method string, rawURL string, data url.Values,
+	headers map[string]interface{}, body ...byte) (*http.Response, error) {
+	headers["I-Twilio-Idempotency-Token"] = c.key
+	return c.BaseClient.SendRequest(method, rawURL, data, headers, body...)
+}
+
+func (h *TwilioHandler) idempotent() bool { return true }
+
+// api is the Twilio API sending a message with its idempotency key.
+func (h *TwilioHandler) api(msg *core.MsgQueueItem) *twilioApi.ApiService {
+	return twilioApi.NewApiService(&twilioClient.RequestHandler{
+		Client: &twilioIdempotentClient{BaseClient: h.client.Client, key: core.IdempotencyKey(msg)},
+		Edge:   h.client.Edge,
+		Region: h.client.Region,
+	})
+}
+
+// createMessage creates the message, giving up when ctx is done. The Twilio client takes no
+// context, an abandoned call finishes in the background and its result is dropped.
+func (h *TwilioHandler) createMessage(ctx context.Context, msg *core.MsgQueueItem, params *twilioApi.CreateMessageParams) (*twilioApi.ApiV2010Message, error) {
+	type result struct {
+		resp *twilioApi.ApiV2010Message
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := h.api(msg).CreateMessage(params)
+		done <- result{resp, err}
+	}()
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("create message abandoned: %w", ctx.Err())
+	}
+}
+
+func (h *TwilioHandler) SendSMS(ctx context.Context, sms *core.MsgQueueItem) error {
+	params := &twilioApi.CreateMessageParams{}
+	params.SetTo(sms.To)
+	params.SetFrom(sms.From)
+	params.SetBody(sms.Message)
+	h.setMessagingService(params, sms.From)
+	if callback := h.statusCallbackURL(); callback != "" {
+		params.SetStatusCallback(callback)
+	}
+
+	resp, err := h.createMessage(ctx, sms, params)
+	if err != nil {
+		err = classifyTwilioError(err)
+		var lm = h.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.SendSMS.Telnyx",
+			"GenericError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"logID": sms.LogID,
+			}, err,
+		))
+		return err
+	}
+	if resp.Sid != nil {
+		h.gateway.TrackCarrierMessage(h.carrier.Name, *resp.Sid, sms)
+	}
+
+	/*	logf.Level = logrus.InfoLevel
+		// direction, carrier, type (mms/sms), sid/msid, from, to
+		logf.Message = fmt.Sprintf(LogMessages.Transaction, "outbound", logf.AdditionalData["carrier"], sms.From, sms.To)
+		logf.AddField("messageSid", *msg.Sid)
+		logf.AddField("from", sms.From)
+		logf.AddField("to", sms.To)
+		logf.Print()*/
+
+	return nil
+}
+
+func (h *TwilioHandler) SendMMS(ctx context.Context, mms *core.MsgQueueItem) error {
+
+	params := &twilioApi.CreateMessageParams{}
+	// clean to & from
+
+	params.SetTo(mms.To)
+	params.SetFrom(mms.From)
+	params.SetBody("")
+	h.setMessagingService(params, mms.From)
+
+	var mediaUrls []string
+
+	if len(mms.Files) > 0 {
+		for _, i := range mms.Files {
+			if strings.Contains(i.ContentType, "application/smil") {
+				continue
+			}
+
+			id, err := h.gateway.SaveMsgFileMedia(i, mms.LogID)
+			if err != nil {
+				var lm = h.gateway.LogManager
+				lm.SendLog(lm.BuildLog(
+					"Carrier.SendMMS.Twilio",
+					"SaveMediaError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"logID": mms.LogID,
+					}, err,
+				))
+				return err
+			}
+
+			mediaUrls = append(mediaUrls, core.Getenv("SERVER_ADDRESS")+"/media/"+strconv.Itoa(int(id)))
+		}
+		params.MediaUrl = &mediaUrls
+	}
+	if callback := h.statusCallbackURL(); callback != "" {
+		params.SetStatusCallback(callback)
+	}
+
+	resp, err := h.createMessage(ctx, mms, params)
+	if err != nil {
+		err = classifyTwilioError(err)
+		var lm = h.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.SendSMS.Telnyx",
+			"GenericError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"logID": mms.LogID,
+			}, err,
+		))
+		return err
+	}
+
+	if resp.Sid != nil {
+		h.gateway.TrackCarrierMessage(h.carrier.Name, *resp.Sid, mms)
+	}
+
+	return nil
+}
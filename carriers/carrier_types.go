@@ -0,0 +1,39 @@
+package carriers
+
+import (
+	"zultys-smpp-mm4/core"
+)
+
+// The built-in carrier types.
+func init() {
+	core.RegisterCarrierType("twilio", func(gateway *core.Gateway, carrier *core.Carrier, username string, password string) (core.CarrierHandler, error) {
+		return NewTwilioHandler(gateway, carrier, username, password), nil
+	})
+	core.RegisterCarrierType("telnyx", func(gateway *core.Gateway, carrier *core.Carrier, username string, password string) (core.CarrierHandler, error) {
+		return NewTelnyxHandler(gateway, carrier, username, password), nil
+	})
+	core.RegisterCarrierType("bandwidth", func(gateway *core.Gateway, carrier *core.Carrier, username string, password string) (core.CarrierHandler, error) {
+		return NewBandwidthHandler(gateway, carrier, username, password), nil
+	})
+	core.RegisterCarrierType("vonage", func(gateway *core.Gateway, carrier *core.Carrier, username string, password string) (core.CarrierHandler, error) {
+		return NewVonageHandler(gateway, carrier, username, password), nil
+	})
+	core.RegisterCarrierType("sinch", func(gateway *core.Gateway, carrier *core.Carrier, username string, password string) (core.CarrierHandler, error) {
+		return NewSinchHandler(gateway, carrier, username, password), nil
+	})
+	core.RegisterCarrierType("plivo", func(gateway *core.Gateway, carrier *core.Carrier, username string, password string) (core.CarrierHandler, error) {
+		return NewPlivoHandler(gateway, carrier, username, password), nil
+	})
+	core.RegisterCarrierType("webhook", func(gateway *core.Gateway, carrier *core.Carrier, username string, password string) (core.CarrierHandler, error) {
+		return NewWebhookHandler(gateway, carrier, username, password)
+	})
+	core.RegisterCarrierType("plugin", func(gateway *core.Gateway, carrier *core.Carrier, username string, password string) (core.CarrierHandler, error) {
+		return NewPluginHandler(gateway, carrier, username, password), nil
+	})
+	core.RegisterCarrierType("smpp", func(gateway *core.Gateway, carrier *core.Carrier, username string, password string) (core.CarrierHandler, error) {
+		return NewSMPPCarrier(gateway, carrier, username, password), nil
+	})
+	core.RegisterCarrierType("simulator", func(gateway *core.Gateway, carrier *core.Carrier, username string, password string) (core.CarrierHandler, error) {
+		return NewSimulatorHandler(gateway, carrier, username, password)
+	})
+}
@@ -0,0 +1,615 @@
+package carriers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+const vonageMessagesAPI = "https://api.nexmo.com/v1/messages"
+
+// vonageValidateSignature turns the webhook signature check off when set to "false", carriers
+// without signature_secret then take webhooks from anyone.
+var vonageValidateSignature bool
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		vonageValidateSignature = cfg.Getenv("VONAGE_VALIDATE_SIGNATURE") != "false"
+	})
+}
+
+// VonageHandler implements CarrierHandler for the Vonage Messages API with JWT application auth.
+// The username is the application ID and the password its PEM private key, webhooks are verified
+// with signature_secret from the carrier config.
+type VonageHandler struct {
+	BaseCarrierHandler
+	gateway         *core.Gateway
+	carrier         *core.Carrier
+	applicationID   string
+	privateKey      *rsa.PrivateKey
+	signatureSecret string
+	client          *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewVonageHandler initializes a new VonageHandler
+func NewVonageHandler(gateway *core.Gateway, carrier *core.Carrier, decryptedUsername string, decryptedPassword string) *VonageHandler {
+	h := &VonageHandler{
+		BaseCarrierHandler: BaseCarrierHandler{name: "vonage"},
+		gateway:            gateway,
+		carrier:            carrier,
+		applicationID:      decryptedUsername,
+		signatureSecret:    carrier.Setting("signature_secret", "VONAGE_SIGNATURE_SECRET"),
+		client:             &http.Client{Timeout: 30 * time.Second},
+	}
+
+	key, err := parseRSAPrivateKey(decryptedPassword)
+	if err != nil {
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Vonage",
+			"GenericError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"carrier": carrier.Name,
+			}, err,
+		))
+	}
+	h.privateKey = key
+	return h
+}
+
+// parseRSAPrivateKey parses a PKCS#8 or PKCS#1 PEM private key.
+func parseRSAPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(strings.ReplaceAll(data, `\n`, "\n")))
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// VonageMessage is the body of a Messages API send request.
+type VonageMessage struct {
+	MessageType string       `json:"message_type"`
+	Channel     string       `json:"channel"`
+	To          string       `json:"to"`
+	From        string       `json:"from"`
+	Text        string       `json:"text,omitempty"`
+	Image       *VonageMedia `json:"image,omitempty"`
+	Video       *VonageMedia `json:"video,omitempty"`
+	Audio       *VonageMedia `json:"audio,omitempty"`
+	Vcard       *VonageMedia `json:"vcard,omitempty"`
+	ClientRef   string       `json:"client_ref,omitempty"`
+}
+
+type VonageMedia struct {
+	URL     string `json:"url"`
+	Caption string `json:"caption,omitempty"`
+}
+
+// VonageWebhook is an inbound message or a message status, statuses carry Status.
+type VonageWebhook struct {
+	Channel     string       `json:"channel"`
+	MessageUUID string       `json:"message_uuid"`
+	To          string       `json:"to"`
+	From        string       `json:"from"`
+	Timestamp   string       `json:"timestamp"`
+	MessageType string       `json:"message_type"`
+	Text        string       `json:"text"`
+	Image       *VonageMedia `json:"image"`
+	Video       *VonageMedia `json:"video"`
+	Audio       *VonageMedia `json:"audio"`
+	Vcard       *VonageMedia `json:"vcard"`
+	Status      string       `json:"status"`
+	Error       *VonageError `json:"error"`
+}
+
+// VonageError is the error of a failed request or message status.
+type VonageError struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+// Inbound handles Vonage inbound message and message status webhooks, both can point at the same
+// URL.
+func (h *VonageHandler) Inbound(c iris.Context) error {
+	var lm = h.gateway.LogManager
+
+	body, err := c.GetBody()
+	if err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	var webhook VonageWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Inbound.Vonage",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil,
+			err,
+		))
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	if webhook.Status != "" {
+		var errorCode string
+		if webhook.Error != nil {
+			errorCode = path.Base(webhook.Error.Type)
+		}
+		err := h.gateway.Router.CarrierDeliveryStatus(h.carrier.Name, webhook.MessageUUID, vonageDeliveryStatus(webhook.Status), errorCode)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.Inbound.Vonage",
+				"GenericError",
+				logrus.WarnLevel,
+				map[string]interface{}{
+					"logID":  webhook.MessageUUID,
+					"status": webhook.Status,
+				}, err,
+			))
+		}
+		c.StatusCode(http.StatusOK)
+		return nil
+	}
+
+	if webhook.To == "" {
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Inbound.Vonage",
+			"CarrierNoDestinations",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"logID": webhook.MessageUUID,
+			},
+		))
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+	webhook.MessageUUID = core.IngressLogID(webhook.MessageUUID)
+
+	text := webhook.Text
+	var media *VonageMedia
+	for _, m := range []*VonageMedia{webhook.Image, webhook.Video, webhook.Audio, webhook.Vcard} {
+		if m != nil && m.URL != "" {
+			media = m
+			break
+		}
+	}
+
+	if media != nil {
+		if text == "" {
+			text = media.Caption
+		}
+		content, contentType, err := h.fetchMedia(media.URL)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.FetchMedia.Vonage",
+				"CarrierFetchMediaError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": webhook.MessageUUID,
+					"error": err.Error(),
+				}, media.URL,
+			))
+			c.StatusCode(http.StatusBadRequest)
+			return nil
+		}
+
+		msg := core.MsgQueueItem{
+			To:                webhook.To,
+			From:              webhook.From,
+			ReceivedTimestamp: time.Now(),
+			Type:              core.MsgQueueItemType.MMS,
+			Files: []core.MsgFile{{
+				Filename:    path.Base(media.URL),
+				ContentType: contentType,
+				Content:     content,
+				Size:        len(content),
+			}},
+			LogID:          webhook.MessageUUID,
+			InboundCarrier: h.carrier.Name,
+		}
+		core.NormalizeAddresses(&msg, nil)
+		if err := h.gateway.Router.OfferCarrierMessage(msg); err != nil {
+			return err
+		}
+	}
+
+	if strings.TrimSpace(text) != "" {
+		for _, smsBody := range splitSMS(text, 140) {
+			sms := core.MsgQueueItem{
+				To:                webhook.To,
+				From:              webhook.From,
+				ReceivedTimestamp: time.Now(),
+				Type:              core.MsgQueueItemType.SMS,
+				Message:           smsBody,
+				LogID:             webhook.MessageUUID,
+				InboundCarrier:    h.carrier.Name,
+			}
+			core.NormalizeAddresses(&sms, nil)
+			if err := h.gateway.Router.OfferCarrierMessage(sms); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.StatusCode(http.StatusOK)
+	return nil
+}
+
+// vonageClaims are the claims of the bearer JWT of a signed webhook.
+type vonageClaims struct {
+	IssuedAt    int64  `json:"iat"`
+	ID          string `json:"jti"`
+	PayloadHash string `json:"payload_hash"`
+}
+
+// webhookPolicy checks the bearer JWT of the webhooks, the token is issued when the webhook is
+// sent and its jti tells webhooks apart. A carrier without a signature secret refuses every
+// webhook unless VONAGE_VALIDATE_SIGNATURE is false.
+func (h *VonageHandler) webhookPolicy() core.WebhookPolicy {
+	policy := core.WebhookPolicy{Algorithm: "jwt-hs256"}
+	if vonageValidateSignature {
+		policy.Verify = func(w *core.InboundWebhook) error {
+			if h.signatureSecret == "" {
+				return errors.New("carrier has no signature secret")
+			}
+			return h.validateSignature(w.Context, w.Body)
+		}
+		policy.Timestamp = func(w *core.InboundWebhook) (time.Time, error) {
+			claims, err := vonageBearerClaims(w.Context)
+			if err != nil || claims.IssuedAt == 0 {
+				return time.Time{}, errors.New("token has no iat claim")
+			}
+			return time.Unix(claims.IssuedAt, 0), nil
+		}
+		policy.Nonce = func(w *core.InboundWebhook) string {
+			claims, _ := vonageBearerClaims(w.Context)
+			return claims.ID
+		}
+	}
+	return policy
+}
+
+// vonageBearerClaims decodes the claims of the bearer JWT, without checking its signature.
+func vonageBearerClaims(c iris.Context) (vonageClaims, error) {
+	var claims vonageClaims
+	parts := strings.Split(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "), ".")
+	if len(parts) != 3 {
+		return claims, errors.New("missing or malformed bearer token")
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(claimsJSON, &claims) != nil {
+		return claims, errors.New("malformed token claims")
+	}
+	return claims, nil
+}
+
+// validateSignature checks the bearer JWT of a signed webhook, signed HS256 with the signature
+// secret, and the payload_hash claim against the body.
+func (h *VonageHandler) validateSignature(c iris.Context, body []byte) error {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("missing or malformed bearer token")
+	}
+
+	mac := hmac.New(sha256.New, []byte(h.signatureSecret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+
+	claims, err := vonageBearerClaims(c)
+	if err != nil {
+		return err
+	}
+	if claims.PayloadHash != "" {
+		hash := sha256.Sum256(body)
+		if !strings.EqualFold(claims.PayloadHash, hex.EncodeToString(hash[:])) {
+			return errors.New("payload hash mismatch")
+		}
+	}
+	return nil
+}
+
+// vonageDeliveryStatus maps a Vonage message status onto the gateway delivery statuses.
+func vonageDeliveryStatus(status string) string {
+	switch status {
+	case "delivered", "read":
+		return core.DeliveryStatuses.Delivered
+	case "undeliverable", "failed":
+		return core.DeliveryStatuses.Undelivered
+	case "rejected":
+		return core.DeliveryStatuses.Failed
+	case "submitted":
+		return core.DeliveryStatuses.Sent
+	}
+	return core.DeliveryStatuses.Queued
+}
+
+// bearerToken returns a JWT for the application, reused until shortly before it expires.
+func (h *VonageHandler) bearerToken() (string, error) {
+	if h.privateKey == nil {
+		return "", core.PermanentFailure(errors.New("vonage carrier has no valid private key"))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if h.token != "" && now.Before(h.tokenExpiry.Add(-time.Minute)) {
+		return h.token, nil
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	expiry := now.Add(15 * time.Minute)
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"application_id": h.applicationID,
+		"iat":            now.Unix(),
+		"exp":            expiry.Unix(),
+		"jti":            hex.EncodeToString(jti),
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, h.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	h.token = signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	h.tokenExpiry = expiry
+	return h.token, nil
+}
+
+func (h *VonageHandler) fetchMedia(mediaURL string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", mediaURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if token, err := h.bearerToken(); err == nil {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	content, err := io.ReadAll(resp.Body)
+	return content, resp.Header.Get("Content-Type"), err
+}
+
+// sendMessage posts a message to the Messages API and records the message UUID for status
+// webhooks. Errors that will fail the same way on a retry are marked permanent.
+func (h *VonageHandler) sendMessage(ctx context.Context, message VonageMessage, msg *core.MsgQueueItem) error {
+	token, err := h.bearerToken()
+	if err != nil {
+		return err
+	}
+	message.ClientRef = msg.LogID
+
+	payloadBytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", vonageMessagesAPI, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.New("failed to read response from Vonage")
+	}
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		var errResp VonageError
+		err := fmt.Errorf("vonage returned %d", resp.StatusCode)
+		if json.Unmarshal(bodyBytes, &errResp) == nil && errResp.Title != "" {
+			err = fmt.Errorf("vonage returned %d: %s %s", resp.StatusCode, path.Base(errResp.Type), errResp.Title)
+		}
+		if class := core.HTTPErrorClass(resp.StatusCode); class != core.ErrorClasses.Unknown {
+			return core.ClassifyError(class, strconv.Itoa(resp.StatusCode), err)
+		}
+		if vonagePermanentStatus(resp.StatusCode) {
+			return core.PermanentFailure(err)
+		}
+		return err
+	}
+
+	var sent struct {
+		MessageUUID string `json:"message_uuid"`
+	}
+	if err := json.Unmarshal(bodyBytes, &sent); err != nil {
+		return err
+	}
+	h.gateway.TrackCarrierMessage(h.carrier.Name, sent.MessageUUID, msg)
+
+	return nil
+}
+
+// vonagePermanentStatus reports whether a Messages API error status fails the same way on every
+// attempt. Throttling (429), low balance (402), auth failures and server errors are retried.
+func vonagePermanentStatus(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// SendSMS sends an SMS message via the Vonage Messages API
+func (h *VonageHandler) SendSMS(ctx context.Context, sms *core.MsgQueueItem) error {
+	message := VonageMessage{
+		MessageType: "text",
+		Channel:     "sms",
+		To:          sms.To,
+		From:        sms.From,
+		Text:        sms.Message,
+	}
+
+	if err := h.sendMessage(ctx, message, sms); err != nil {
+		var lm = h.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.SendSMS.Vonage",
+			"GenericError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"logID": sms.LogID,
+			}, err,
+		))
+		return err
+	}
+	return nil
+}
+
+// SendMMS sends each file as its own MMS, the Messages API takes one media item per message. The
+// text goes as the caption of the first file. Once a part is sent a failure is permanent, a retry
+// would send the earlier parts again.
+func (h *VonageHandler) SendMMS(ctx context.Context, mms *core.MsgQueueItem) error {
+	var lm = h.gateway.LogManager
+
+	sent := 0
+	partial := func(err error) error {
+		if sent == 0 {
+			return err
+		}
+		// %v drops the error class, so the router doesn't retry a congestion or an auth failure
+		return core.PermanentFailure(fmt.Errorf("failed after %d parts were sent: %v", sent, err))
+	}
+
+	caption := mms.Message
+	for _, file := range mms.Files {
+		if strings.Contains(file.ContentType, "application/smil") {
+			continue
+		}
+
+		id, err := h.gateway.SaveMsgFileMedia(file, mms.LogID)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.SendMMS.Vonage",
+				"SaveMediaError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": mms.LogID,
+				}, err,
+			))
+			return partial(err)
+		}
+		media := &VonageMedia{URL: core.Getenv("SERVER_ADDRESS") + "/media/" + strconv.Itoa(int(id))}
+
+		message := VonageMessage{
+			Channel: "mms",
+			To:      mms.To,
+			From:    mms.From,
+		}
+		switch {
+		case strings.HasPrefix(file.ContentType, "image/"):
+			message.MessageType, message.Image = "image", media
+			media.Caption = caption
+			caption = ""
+		case strings.HasPrefix(file.ContentType, "video/"):
+			message.MessageType, message.Video = "video", media
+		case strings.HasPrefix(file.ContentType, "audio/"):
+			message.MessageType, message.Audio = "audio", media
+		case strings.Contains(file.ContentType, "vcard"):
+			message.MessageType, message.Vcard = "vcard", media
+		default:
+			continue
+		}
+
+		if err := h.sendMessage(ctx, message, mms); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.SendMMS.Vonage",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": mms.LogID,
+				}, err,
+			))
+			return partial(err)
+		}
+		sent++
+	}
+
+	// text without an image to carry it
+	if strings.TrimSpace(caption) != "" {
+		message := VonageMessage{
+			MessageType: "text",
+			Channel:     "sms",
+			To:          mms.To,
+			From:        mms.From,
+			Text:        caption,
+		}
+		if err := h.sendMessage(ctx, message, mms); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Carrier.SendMMS.Vonage",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": mms.LogID,
+				}, err,
+			))
+			return partial(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package carriers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// defaultWebhookPayload is the outbound body when the carrier config has no payload template.
+const defaultWebhookPayload = `{"from": {{json .From}}, "to": {{json .To}}, "type": {{json .Type}}, "text": {{json .Text}}, "media_urls": {{json .MediaURLs}}, "reference": {{json .LogID}}, "campaign_id": {{json .CampaignID}}}`
+
+// WebhookHandler implements CarrierHandler for in-house aggregators: outbound messages are POSTed
+// as JSON to the configured url, rendered from the payload template and signed with the shared
+// secret (the password). Inbound messages and statuses are POSTed to the gateway signed the same
+// way. The username, unless "-", is sent as a bearer token.
+type WebhookHandler struct {
+	restCarrier
+	url     string
+	token   string
+	secret  string
+	payload *template.Template
+	idField string
+}
+
+// WebhookPayload is the data available to the payload template.
+type WebhookPayload struct {
+	From       string
+	To         string
+	Type       string
+	Text       string
+	MediaURLs  []string
+	LogID      string
+	CampaignID string // 10DLC campaign of the sending number
+}
+
+// WebhookInbound is the body posted to the gateway, a message or, with status set, a delivery
+// status with one of the gateway delivery statuses.
+type WebhookInbound struct {
+	ID        string   `json:"id"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Text      string   `json:"text"`
+	MediaURLs []string `json:"media_urls"`
+	Status    string   `json:"status"`
+	ErrorCode string   `json:"error_code"`
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// NewWebhookHandler initializes a new WebhookHandler
+func NewWebhookHandler(gateway *core.Gateway, carrier *core.Carrier, decryptedUsername string, decryptedPassword string) (*WebhookHandler, error) {
+	payload := carrier.Setting("payload", "")
+	if payload == "" {
+		payload = defaultWebhookPayload
+	}
+	tmpl, err := template.New(carrier.Name).Funcs(webhookTemplateFuncs).Parse(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload template for carrier %s: %w", carrier.Name, err)
+	}
+
+	idField := carrier.Setting("id_field", "")
+	if idField == "" {
+		idField = "id"
+	}
+	token := decryptedUsername
+	if token == "-" {
+		token = ""
+	}
+
+	return &WebhookHandler{
+		restCarrier: newRestCarrier(gateway, carrier, "webhook", "Webhook", map[string]string{
+			core.DeliveryStatuses.Queued:      core.DeliveryStatuses.Queued,
+			core.DeliveryStatuses.Sent:        core.DeliveryStatuses.Sent,
+			core.DeliveryStatuses.Delivered:   core.DeliveryStatuses.Delivered,
+			core.DeliveryStatuses.Failed:      core.DeliveryStatuses.Failed,
+			core.DeliveryStatuses.Undelivered: core.DeliveryStatuses.Undelivered,
+		}),
+		url:     carrier.Setting("url", ""),
+		token:   token,
+		secret:  decryptedPassword,
+		payload: tmpl,
+		idField: idField,
+	}, nil
+}
+
+// sign returns the timestamp and signature headers, the base64 HMAC-SHA256 of
+// "timestamp.body" keyed with the shared secret.
+func (h *WebhookHandler) sign(body []byte) (string, string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return timestamp, signHMAC(sha256.New, h.secret, append([]byte(timestamp+"."), body...))
+}
+
+// webhookPolicy checks X-Gateway-Signature, signed like the requests of sign.
+func (h *WebhookHandler) webhookPolicy() core.WebhookPolicy {
+	return core.WebhookPolicy{
+		Algorithm: "hmac-sha256",
+		Verify: func(w *core.InboundWebhook) error {
+			signed := append([]byte(w.Header("X-Gateway-Timestamp")+"."), w.Body...)
+			return verifyHMAC(h.secret, signed, w.Header("X-Gateway-Signature"))
+		},
+		Timestamp: func(w *core.InboundWebhook) (time.Time, error) {
+			return core.UnixTimestamp(w.Header("X-Gateway-Timestamp"))
+		},
+		Nonce: func(w *core.InboundWebhook) string {
+			return w.Header("X-Gateway-Signature")
+		},
+	}
+}
+
+// Inbound handles messages and delivery statuses posted by the aggregator.
+func (h *WebhookHandler) Inbound(c iris.Context) error {
+	body, err := c.GetBody()
+	if err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	var inbound WebhookInbound
+	if err := json.Unmarshal(body, &inbound); err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	if inbound.Status != "" {
+		h.reportStatus(inbound.ID, inbound.Status, inbound.ErrorCode)
+		c.StatusCode(http.StatusNoContent)
+		return nil
+	}
+
+	if inbound.To == "" {
+		c.StatusCode(http.StatusBadRequest)
+		return nil
+	}
+
+	var files []core.MsgFile
+	for _, mediaURL := range inbound.MediaURLs {
+		file, err := h.fetchMedia(mediaURL, nil)
+		if err != nil {
+			c.StatusCode(http.StatusBadRequest)
+			return nil
+		}
+		files = append(files, file)
+	}
+
+	if err := h.receive(inbound.From, inbound.To, inbound.Text, files, inbound.ID); err != nil {
+		return err
+	}
+	c.StatusCode(http.StatusNoContent)
+	return nil
+}
+
+func (h *WebhookHandler) send(ctx context.Context, payload WebhookPayload, msg *core.MsgQueueItem) error {
+	if h.url == "" {
+		return core.PermanentFailure(errors.New("webhook carrier has no url"))
+	}
+
+	var body bytes.Buffer
+	if err := h.payload.Execute(&body, payload); err != nil {
+		return core.PermanentFailure(fmt.Errorf("failed to render payload: %w", err))
+	}
+
+	timestamp, signature := h.sign(body.Bytes())
+	headers := map[string]string{
+		"Content-Type":        "application/json",
+		"X-Gateway-Timestamp": timestamp,
+		"X-Gateway-Signature": signature,
+	}
+	if h.token != "" {
+		headers["Authorization"] = "Bearer " + h.token
+	}
+	if callback := h.webhookURL(); callback != "" {
+		headers["X-Gateway-Callback"] = callback
+	}
+
+	resp, err := h.do(restRequest{Context: ctx, Method: "POST", URL: h.url, Body: body.Bytes(), Headers: headers})
+	if err != nil {
+		return err
+	}
+
+	if id := jsonField(resp, h.idField); id != "" {
+		h.gateway.TrackCarrierMessage(h.carrier.Name, id, msg)
+	}
+	return nil
+}
+
+// jsonField returns the string or number at a dotted path of a JSON object, e.g. "data.id".
+func jsonField(body []byte, field string) string {
+	var value interface{}
+	if json.Unmarshal(body, &value) != nil {
+		return ""
+	}
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// SendSMS posts an SMS to the aggregator
+func (h *WebhookHandler) SendSMS(ctx context.Context, sms *core.MsgQueueItem) error {
+	err := h.send(ctx, WebhookPayload{From: sms.From, To: sms.To, Type: string(sms.Type), Text: sms.Message, LogID: sms.LogID, CampaignID: h.gateway.SendingNumber(sms.From).CampaignID}, sms)
+	if err != nil {
+		h.logSendError("SendSMS", sms, err)
+	}
+	return err
+}
+
+// SendMMS posts an MMS to the aggregator, with media URLs served from the media store
+func (h *WebhookHandler) SendMMS(ctx context.Context, mms *core.MsgQueueItem) error {
+	urls, err := h.mediaURLs(mms)
+	if err == nil {
+		err = h.send(ctx, WebhookPayload{From: mms.From, To: mms.To, Type: string(mms.Type), Text: mms.Message, MediaURLs: urls, LogID: mms.LogID, CampaignID: h.gateway.SendingNumber(mms.From).CampaignID}, mms)
+	}
+	if err != nil {
+		h.logSendError("SendMMS", mms, err)
+	}
+	return err
+}
@@ -0,0 +1,473 @@
+// gateway-ctl is a small operator tool for the gateway management API.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const usage = `usage: gateway-ctl [-url URL] [-key API_KEY] <command> [args]
+
+session commands:
+  session list
+  session kick <username>
+
+client and number commands:
+  client list
+  client add -username NAME -password PASSWORD [-name NAME] [-address ADDRESS]
+  number list
+  number add -client ID -number NUMBER -carrier CARRIER [-webhook URL]
+
+message commands:
+  route test -from NUMBER -to NUMBER [-type sms|mms] [-message TEXT]
+  send -from NUMBER -to NUMBER [-message TEXT] [-media FILE]... [-client USERNAME]
+  message show <message_id>
+  tail [-client USERNAME] [-number NUMBER] [-interval 2s]
+
+dead letter commands:
+  deadletter list [-queue client|carrier] [-type sms|mms] [-limit N]
+  deadletter show <id>
+  deadletter edit <id> [-to NUMBER] [-from NUMBER] [-message TEXT] [-queue QUEUE]
+  deadletter requeue <id>
+  deadletter purge <id>
+  deadletter purge-all [-queue client|carrier] [-type sms|mms]
+
+GATEWAY_URL and API_KEY are read from the environment when the flags are not set.
+`
+
+// apiClient talks to the gateway's HTTP management API using the shared API key.
+type apiClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+func main() {
+	baseURL := flag.String("url", envDefault("GATEWAY_URL", "http://localhost:3000"), "gateway web address")
+	apiKey := flag.String("key", os.Getenv("API_KEY"), "gateway API key")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &apiClient{
+		baseURL: strings.TrimRight(*baseURL, "/"),
+		apiKey:  *apiKey,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+
+	var err error
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "session", "sessions":
+		err = client.sessionCommand(args)
+	case "client", "clients":
+		err = client.clientCommand(args)
+	case "number", "numbers":
+		err = client.numberCommand(args)
+	case "route":
+		err = client.routeCommand(args)
+	case "send":
+		err = client.sendCommand(args)
+	case "message":
+		err = client.messageCommand(args)
+	case "tail":
+		err = client.tailCommand(args)
+	case "deadletter", "dl":
+		err = client.deadLetterCommand(args)
+	default:
+		err = fmt.Errorf("unknown command: %s", flag.Arg(0))
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func (c *apiClient) sessionCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("missing session subcommand")
+	}
+
+	switch args[0] {
+	case "list":
+		return c.do(http.MethodGet, "/admin/sessions/smpp", nil)
+	case "kick":
+		username, err := idArg(args)
+		if err != nil {
+			return err
+		}
+		return c.do(http.MethodPost, "/admin/sessions/smpp/"+username+"/kick", nil)
+	default:
+		return fmt.Errorf("unknown session subcommand: %s", args[0])
+	}
+}
+
+func (c *apiClient) clientCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("missing client subcommand")
+	}
+
+	fs := flag.NewFlagSet("client "+args[0], flag.ExitOnError)
+	username := fs.String("username", "", "SMPP and MM4 username")
+	password := fs.String("password", "", "SMPP and MM4 password")
+	name := fs.String("name", "", "display name")
+	address := fs.String("address", "", "MM4 address")
+
+	switch args[0] {
+	case "list":
+		return c.do(http.MethodGet, "/clients", nil)
+	case "add":
+		_ = fs.Parse(args[1:])
+		if *username == "" || *password == "" {
+			return fmt.Errorf("-username and -password are required")
+		}
+		return c.do(http.MethodPost, "/clients", map[string]string{
+			"username": *username,
+			"password": *password,
+			"name":     *name,
+			"address":  *address,
+		})
+	default:
+		return fmt.Errorf("unknown client subcommand: %s", args[0])
+	}
+}
+
+func (c *apiClient) numberCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("missing number subcommand")
+	}
+
+	fs := flag.NewFlagSet("number "+args[0], flag.ExitOnError)
+	clientID := fs.Uint("client", 0, "ID of the client the number is assigned to")
+	number := fs.String("number", "", "phone number")
+	carrier := fs.String("carrier", "", "carrier the number is hosted on")
+	webhook := fs.String("webhook", "", "webhook for messages to the number")
+
+	switch args[0] {
+	case "list":
+		return c.do(http.MethodGet, "/numbers", nil)
+	case "add":
+		_ = fs.Parse(args[1:])
+		if *clientID == 0 || *number == "" || *carrier == "" {
+			return fmt.Errorf("-client, -number and -carrier are required")
+		}
+		return c.do(http.MethodPost, "/numbers", map[string]interface{}{
+			"client_id": *clientID,
+			"number":    *number,
+			"carrier":   *carrier,
+			"webhook":   *webhook,
+		})
+	default:
+		return fmt.Errorf("unknown number subcommand: %s", args[0])
+	}
+}
+
+func (c *apiClient) routeCommand(args []string) error {
+	if len(args) < 1 || args[0] != "test" {
+		return fmt.Errorf("usage: route test -from NUMBER -to NUMBER")
+	}
+
+	fs := flag.NewFlagSet("route test", flag.ExitOnError)
+	from := fs.String("from", "", "source number")
+	to := fs.String("to", "", "destination number")
+	msgType := fs.String("type", "sms", "message type")
+	message := fs.String("message", "", "message body, for content based rules")
+	_ = fs.Parse(args[1:])
+	if *from == "" || *to == "" {
+		return fmt.Errorf("-from and -to are required")
+	}
+
+	// a dry run, nothing is sent
+	return c.do(http.MethodPost, "/routing/explain", map[string]string{
+		"from":    *from,
+		"to":      *to,
+		"type":    *msgType,
+		"message": *message,
+	})
+}
+
+// fileList collects a flag that may be repeated.
+type fileList []string
+
+func (f *fileList) String() string     { return strings.Join(*f, ",") }
+func (f *fileList) Set(v string) error { *f = append(*f, v); return nil }
+
+func (c *apiClient) sendCommand(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	from := fs.String("from", "", "source number")
+	to := fs.String("to", "", "destination number")
+	message := fs.String("message", "", "message body")
+	username := fs.String("client", "", "client sending, defaults to the owner of the source number")
+	var media fileList
+	fs.Var(&media, "media", "file to attach, sends an MMS (repeatable)")
+	_ = fs.Parse(args)
+	if *from == "" || *to == "" {
+		return fmt.Errorf("-from and -to are required")
+	}
+	if *message == "" && len(media) == 0 {
+		return fmt.Errorf("-message or -media is required")
+	}
+
+	req := map[string]interface{}{
+		"client":  *username,
+		"from":    *from,
+		"to":      *to,
+		"message": *message,
+	}
+	var files []map[string]interface{}
+	for _, path := range media {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// the gateway detects the content type, byte slices are sent base64 encoded
+		files = append(files, map[string]interface{}{
+			"filename": filepath.Base(path),
+			"content":  content,
+		})
+	}
+	if len(files) > 0 {
+		req["media"] = files
+	}
+	return c.do(http.MethodPost, "/messages", req)
+}
+
+func (c *apiClient) messageCommand(args []string) error {
+	if len(args) < 1 || args[0] != "show" {
+		return fmt.Errorf("usage: message show <message_id>")
+	}
+	id, err := idArg(args)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodGet, "/messages/"+id, nil)
+}
+
+// cdr is the part of a CDR printed by tail.
+type cdr struct {
+	ID          uint      `json:"id"`
+	LogID       string    `json:"log_id"`
+	Direction   string    `json:"direction"`
+	Client      string    `json:"client"`
+	Type        string    `json:"type"`
+	From        string    `json:"from_number"`
+	To          string    `json:"to_number"`
+	Route       string    `json:"route"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// tailCommand follows the delivery attempts of messages, as recorded in the CDRs, until
+// interrupted.
+func (c *apiClient) tailCommand(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	username := fs.String("client", "", "only messages of this client")
+	number := fs.String("number", "", "only messages from or to this number")
+	interval := fs.Duration("interval", 2*time.Second, "poll interval")
+	_ = fs.Parse(args)
+
+	// CDRs are written a little after their attempt, so every poll looks back a minute and skips
+	// the ones already printed
+	var latest time.Time
+	var lastID uint
+	for {
+		query := url.Values{}
+		setIfNotEmpty(query, "client", *username)
+		setIfNotEmpty(query, "number", *number)
+		since := latest
+		if since.IsZero() {
+			since = time.Now()
+		}
+		query.Set("since", since.Add(-time.Minute).Format(time.RFC3339Nano))
+		query.Set("limit", "500")
+
+		var records []cdr
+		if err := c.getJSON("/cdrs/?"+query.Encode(), &records); err != nil {
+			return err
+		}
+		// newest first
+		for i := len(records) - 1; i >= 0; i-- {
+			record := records[i]
+			if record.ID <= lastID {
+				continue
+			}
+			lastID = record.ID
+			if record.AttemptedAt.After(latest) {
+				latest = record.AttemptedAt
+			}
+			line := fmt.Sprintf("%s %-8s %-12s %s %s -> %s via %s: %s",
+				record.AttemptedAt.Local().Format("15:04:05"), record.Direction, record.Client,
+				record.Type, record.From, record.To, record.Route, record.Status)
+			if record.Error != "" {
+				line += " (" + record.Error + ")"
+			}
+			fmt.Println(line + " " + record.LogID)
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func (c *apiClient) deadLetterCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("missing deadletter subcommand")
+	}
+
+	fs := flag.NewFlagSet("deadletter "+args[0], flag.ExitOnError)
+	queue := fs.String("queue", "", "origin queue")
+	msgType := fs.String("type", "", "message type")
+	limit := fs.Int("limit", 100, "maximum number of results")
+	to := fs.String("to", "", "new destination number")
+	from := fs.String("from", "", "new source number")
+	message := fs.String("message", "", "new message body")
+
+	switch args[0] {
+	case "list":
+		_ = fs.Parse(args[1:])
+		query := url.Values{}
+		setIfNotEmpty(query, "queue", *queue)
+		setIfNotEmpty(query, "type", *msgType)
+		query.Set("limit", fmt.Sprint(*limit))
+		return c.do(http.MethodGet, "/deadletters/?"+query.Encode(), nil)
+	case "show":
+		id, err := idArg(args)
+		if err != nil {
+			return err
+		}
+		return c.do(http.MethodGet, "/deadletters/"+id, nil)
+	case "edit":
+		id, err := idArg(args)
+		if err != nil {
+			return err
+		}
+		_ = fs.Parse(args[2:])
+		update := map[string]string{}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "to":
+				update["to_number"] = *to
+			case "from":
+				update["from_number"] = *from
+			case "message":
+				update["message"] = *message
+			case "queue":
+				update["queue"] = *queue
+			}
+		})
+		return c.do(http.MethodPatch, "/deadletters/"+id, update)
+	case "requeue":
+		id, err := idArg(args)
+		if err != nil {
+			return err
+		}
+		return c.do(http.MethodPost, "/deadletters/"+id+"/requeue", nil)
+	case "purge":
+		id, err := idArg(args)
+		if err != nil {
+			return err
+		}
+		return c.do(http.MethodDelete, "/deadletters/"+id, nil)
+	case "purge-all":
+		_ = fs.Parse(args[1:])
+		query := url.Values{}
+		setIfNotEmpty(query, "queue", *queue)
+		setIfNotEmpty(query, "type", *msgType)
+		return c.do(http.MethodDelete, "/deadletters/?"+query.Encode(), nil)
+	default:
+		return fmt.Errorf("unknown deadletter subcommand: %s", args[0])
+	}
+}
+
+// do performs the request and pretty prints the JSON response to stdout.
+func (c *apiClient) do(method string, path string, body interface{}) error {
+	status, respBody, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, respBody, "", "  ") == nil {
+		respBody = pretty.Bytes()
+	}
+	fmt.Println(string(respBody))
+
+	if status >= 400 {
+		return fmt.Errorf("request failed: %d %s", status, http.StatusText(status))
+	}
+	return nil
+}
+
+// getJSON decodes the JSON response of a GET into dest.
+func (c *apiClient) getJSON(path string, dest interface{}) error {
+	status, respBody, err := c.request(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	if status >= 400 {
+		return fmt.Errorf("request failed: %d %s: %s", status, http.StatusText(status), strings.TrimSpace(string(respBody)))
+	}
+	return json.Unmarshal(respBody, dest)
+}
+
+func (c *apiClient) request(method string, path string, body interface{}) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.SetBasicAuth("gateway-ctl", c.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
+
+func idArg(args []string) (string, error) {
+	if len(args) < 2 {
+		return "", fmt.Errorf("missing id")
+	}
+	return url.PathEscape(args[1]), nil
+}
+
+func setIfNotEmpty(values url.Values, key string, value string) {
+	if value != "" {
+		values.Set(key, value)
+	}
+}
+
+func envDefault(key string, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
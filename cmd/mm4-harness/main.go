@@ -0,0 +1,502 @@
+// mm4-harness plays MM4_forward.REQ transactions built from fixture media against the MM4 server
+// of the gateway and checks how they come out of it, to catch MMS regressions in CI and local dev.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `usage: mm4-harness <command> [flags]
+
+commands:
+  generate [-out DIR]
+      writes the fixtures: JPEG, PNG and GIF images, a vCard, a text note, a SMIL presentation
+      and, when ffmpeg is installed, an MP4 video
+  play [-addr HOST:PORT] [-from NUMBER] [-to NUMBER] [-capture ADDR] [-fetch] [-timeout 30s] [DIR]
+      sends a message per fixture of DIR (default fixtures) to the MM4 server and checks that the
+      DATA is answered with 250; with -capture it also takes the messages the gateway routes on as
+      its webhook carrier and checks them, then exits 1 if any case failed
+
+The from number has to belong to the client whose address is the IP the harness connects from,
+case n is sent to the to number plus n, so its message is matched by the destination. With
+-capture the from number needs a webhook carrier posting to http://ADDR/, see the README.
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "generate":
+		err = generateCommand(args)
+	case "play":
+		err = playCommand(args)
+	default:
+		err = fmt.Errorf("unknown command: %s", flag.Arg(0))
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// fixtureTypes are the content types of the fixtures by extension, and the types their media
+// has after the gateway transcoded it.
+var fixtureTypes = map[string]struct {
+	contentType string
+	transcoded  string
+}{
+	".jpg":  {"image/jpeg", "image/jpeg"},
+	".jpeg": {"image/jpeg", "image/jpeg"},
+	".png":  {"image/png", "image/png"},
+	".gif":  {"image/gif", "image/png"},
+	".mp4":  {"video/mp4", "video/3gpp"},
+	".3gp":  {"video/3gpp", "video/3gpp"},
+	".vcf":  {"text/vcard", "text/vcard"},
+	".txt":  {"text/plain", "text/plain"},
+	".smil": {"application/smil", ""}, // not passed on as media
+}
+
+func generateCommand(args []string) error {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	out := flags.String("out", "fixtures", "directory to write the fixtures to")
+	_ = flags.Parse(args)
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+
+	bounds := image.Rect(0, 0, 320, 240)
+	gradient := image.NewRGBA(bounds)
+	paletted := image.NewPaletted(bounds, palette.Plan9)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			c := color.RGBA{R: uint8(x * 255 / bounds.Dx()), G: uint8(y * 255 / bounds.Dy()), B: 128, A: 255}
+			gradient.Set(x, y, c)
+			paletted.Set(x, y, c)
+		}
+	}
+	var jpg, pngImage, gifImage bytes.Buffer
+	if err := jpeg.Encode(&jpg, gradient, &jpeg.Options{Quality: 85}); err != nil {
+		return err
+	}
+	if err := png.Encode(&pngImage, gradient); err != nil {
+		return err
+	}
+	if err := gif.Encode(&gifImage, paletted, nil); err != nil {
+		return err
+	}
+
+	fixtures := map[string][]byte{
+		"photo.jpg":   jpg.Bytes(),
+		"diagram.png": pngImage.Bytes(),
+		"banner.gif":  gifImage.Bytes(),
+		"contact.vcf": []byte("BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Harness Contact\r\nN:Contact;Harness;;;\r\n" +
+			"TEL;TYPE=CELL:+15555550100\r\nEMAIL:harness@example.com\r\nEND:VCARD\r\n"),
+		"note.txt": []byte("MM4 harness test message: café, 東京 and 👍 survive the gateway.\r\n"),
+		"presentation.smil": []byte(`<smil>
+<head>
+<layout>
+<root-layout width="320px" height="480px"/>
+<region id="Image" width="100%" height="80%" fit="meet"/>
+<region id="Text" top="80%" width="100%" height="20%" fit="scroll"/>
+</layout>
+</head>
+<body>
+<par dur="5000ms">
+<img src="photo.jpg" region="Image"/>
+<text src="note.txt" region="Text"/>
+</par>
+</body>
+</smil>
+`),
+	}
+	for name, content := range fixtures {
+		if err := os.WriteFile(filepath.Join(*out, name), content, 0644); err != nil {
+			return err
+		}
+	}
+
+	// the gateway needs ffmpeg to transcode video, without it the case can't pass anyway
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		fmt.Println("ffmpeg not found, skipped clip.mp4")
+	} else if output, err := exec.Command("ffmpeg", "-y", "-loglevel", "error", "-f", "lavfi", "-i", "testsrc=duration=2:size=320x240:rate=15",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", filepath.Join(*out, "clip.mp4")).CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, output)
+	}
+	fmt.Printf("wrote the fixtures to %s\n", *out)
+	return nil
+}
+
+// part is a MIME part of a message.
+type part struct {
+	filename    string
+	contentType string
+	content     []byte
+}
+
+// testCase is a message to send and the media the gateway should route on with it.
+type testCase struct {
+	name  string
+	to    string
+	parts []part
+	media []string // content types expected after transcoding, in order
+}
+
+// captured is a message the gateway posted to the webhook carrier of the harness.
+type captured struct {
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Type      string   `json:"type"`
+	Text      string   `json:"text"`
+	MediaURLs []string `json:"media_urls"`
+	Reference string   `json:"reference"`
+}
+
+func playCommand(args []string) error {
+	flags := flag.NewFlagSet("play", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:2566", "MM4 server of the gateway")
+	from := flags.String("from", "+15551230001", "number of the client the harness sends as")
+	to := flags.String("to", "+15559870000", "destination of the first case")
+	capture := flags.String("capture", "", "listen address of the webhook carrier, empty to only check the MM4 reply")
+	fetch := flags.Bool("fetch", false, "fetch the media URLs and check their content types, needs the Postgres media store")
+	timeout := flags.Duration("timeout", 30*time.Second, "wait for a captured message")
+	_ = flags.Parse(args)
+
+	dir := "fixtures"
+	if flags.NArg() > 0 {
+		dir = flags.Arg(0)
+	}
+	cases, err := loadCases(dir, *to)
+	if err != nil {
+		return err
+	}
+
+	var messages chan captured
+	if *capture != "" {
+		listener, err := net.Listen("tcp", *capture)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		messages = make(chan captured, 16)
+		go func() { _ = http.Serve(listener, captureHandler(messages)) }()
+	}
+
+	failed := 0
+	for _, tc := range cases {
+		started := time.Now()
+		err := sendCase(*addr, *from, tc)
+		if err == nil && messages != nil {
+			err = checkCase(tc, *from, messages, *timeout, *fetch)
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %-14s %v\n", tc.name, err)
+			continue
+		}
+		fmt.Printf("ok   %-14s %s\n", tc.name, time.Since(started).Round(time.Millisecond))
+	}
+	fmt.Printf("%d cases, %d failed\n", len(cases), failed)
+	if failed > 0 {
+		return errors.New("cases failed")
+	}
+	return nil
+}
+
+// loadCases builds a case per fixture with a text part, and a case with the SMIL presentation
+// and the media it references.
+func loadCases(dir string, to string) ([]testCase, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]part)
+	var names []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		types, ok := fixtureTypes[ext]
+		if entry.IsDir() || !ok {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = part{filename: entry.Name(), contentType: types.contentType, content: content}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no fixtures in %s, run mm4-harness generate first", dir)
+	}
+
+	var cases []testCase
+	for _, name := range names {
+		file := files[name]
+		tc := testCase{name: strings.TrimSuffix(name, filepath.Ext(name))}
+		if file.contentType == "application/smil" {
+			// the SMIL is sent with what it references, only those are media
+			tc.parts = append(tc.parts, file)
+			for _, ref := range smilReferences(file.content) {
+				if referenced, ok := files[ref]; ok {
+					tc.parts = append(tc.parts, referenced)
+					tc.media = append(tc.media, transcodedType(ref))
+				}
+			}
+		} else {
+			text := part{filename: "text.txt", contentType: "text/plain", content: []byte("mm4-harness " + tc.name)}
+			tc.parts = []part{text, file}
+			tc.media = []string{"text/plain", transcodedType(name)}
+		}
+		cases = append(cases, tc)
+	}
+	for i := range cases {
+		if cases[i].to, err = offsetNumber(to, i); err != nil {
+			return nil, err
+		}
+	}
+	return cases, nil
+}
+
+func transcodedType(name string) string {
+	return fixtureTypes[strings.ToLower(filepath.Ext(name))].transcoded
+}
+
+// smilReferences returns the src attributes of a SMIL presentation.
+func smilReferences(smil []byte) []string {
+	var refs []string
+	for _, field := range strings.Fields(string(smil)) {
+		if value, ok := strings.CutPrefix(field, `src="`); ok {
+			if end := strings.IndexByte(value, '"'); end >= 0 {
+				refs = append(refs, value[:end])
+			}
+		}
+	}
+	return refs
+}
+
+// offsetNumber adds n to the number, keeping its length and plus sign.
+func offsetNumber(number string, n int) (string, error) {
+	digits := strings.TrimPrefix(number, "+")
+	value, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid number %s", number)
+	}
+	offset := fmt.Sprintf("%0*d", len(digits), value+uint64(n))
+	if strings.HasPrefix(number, "+") {
+		offset = "+" + offset
+	}
+	return offset, nil
+}
+
+// sendCase sends the case as an MM4_forward.REQ in one SMTP transaction, like the MMSC of a
+// Zultys system does, and returns an error unless every step is answered as expected.
+func sendCase(addr string, from string, tc testCase) error {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	reader := bufio.NewReader(conn)
+
+	transactionID := fmt.Sprintf("harness-%d", time.Now().UnixNano())
+	steps := []struct {
+		command string
+		code    string
+	}{
+		{"", "220"},
+		{"EHLO mm4-harness", "250"},
+		{fmt.Sprintf("MAIL FROM:<%s/TYPE=PLMN>", from), "250"},
+		{fmt.Sprintf("RCPT TO:<%s/TYPE=PLMN>", tc.to), "250"},
+		{"DATA", "354"},
+		{string(forwardRequest(from, tc, transactionID)) + ".", "250"},
+		{"QUIT", "221"},
+	}
+	for _, step := range steps {
+		if step.command != "" {
+			if _, err := conn.Write([]byte(step.command + "\r\n")); err != nil {
+				return err
+			}
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("no reply to %s: %v", commandName(step.command), err)
+		}
+		if reply = strings.TrimSpace(reply); !strings.HasPrefix(reply, step.code) {
+			return fmt.Errorf("%s answered with %q, expected %s", commandName(step.command), reply, step.code)
+		}
+	}
+	return nil
+}
+
+func commandName(command string) string {
+	switch {
+	case command == "":
+		return "greeting"
+	case strings.HasSuffix(command, "."):
+		return "message data"
+	}
+	name, _, _ := strings.Cut(command, " ")
+	return name
+}
+
+// forwardRequest builds the headers and multipart/related body of an MM4_forward.REQ, with the
+// parts base64 encoded and dot-stuffed for DATA.
+func forwardRequest(from string, tc testCase, transactionID string) []byte {
+	boundary := "harness-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "To: %s/TYPE=PLMN\r\n", tc.to)
+	fmt.Fprintf(&b, "From: %s/TYPE=PLMN\r\n", from)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/related; boundary=\"%s\"; type=\"application/smil\"\r\n", boundary)
+	b.WriteString("X-Mms-3GPP-MMS-Version: 6.10.0\r\n")
+	b.WriteString("X-Mms-Message-Type: MM4_forward.REQ\r\n")
+	fmt.Fprintf(&b, "X-Mms-Message-ID: <%s@mm4-harness>\r\n", transactionID)
+	fmt.Fprintf(&b, "X-Mms-Transaction-ID: %s\r\n", transactionID)
+	b.WriteString("X-Mms-Ack-Request: Yes\r\n")
+	b.WriteString("X-Mms-Originator-System: system@mm4-harness\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	b.WriteString("\r\n")
+
+	for i, p := range tc.parts {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s; name=\"%s\"\r\n", p.contentType, p.filename)
+		fmt.Fprintf(&b, "Content-ID: <%d.%s>\r\n", i, p.filename)
+		fmt.Fprintf(&b, "Content-Location: %s\r\n", p.filename)
+		b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		encoded := base64.StdEncoding.EncodeToString(p.content)
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		b.WriteString(encoded + "\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+
+	// base64 lines never start with a dot, only the header lines could
+	var stuffed bytes.Buffer
+	for _, line := range strings.SplitAfter(b.String(), "\r\n") {
+		if strings.HasPrefix(line, ".") {
+			stuffed.WriteByte('.')
+		}
+		stuffed.WriteString(line)
+	}
+	return stuffed.Bytes()
+}
+
+// captureHandler takes the messages the gateway posts to its webhook carrier and answers with a
+// message ID, like an aggregator.
+func captureHandler(messages chan<- captured) http.Handler {
+	var n int
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg captured
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&msg) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"id": "harness-%d"}`, n)
+		messages <- msg
+	})
+}
+
+// checkCase waits for the message of the case and compares it with what was sent.
+func checkCase(tc testCase, from string, messages <-chan captured, timeout time.Duration, fetch bool) error {
+	deadline := time.After(timeout)
+	for {
+		var msg captured
+		select {
+		case msg = <-messages:
+		case <-deadline:
+			return fmt.Errorf("the gateway routed no message to %s within %s", tc.to, timeout)
+		}
+		if digits(msg.To) != digits(tc.to) {
+			continue // of an earlier case that timed out
+		}
+
+		var problems []string
+		if msg.Type != "mms" {
+			problems = append(problems, fmt.Sprintf("type %q, expected mms", msg.Type))
+		}
+		if !sameNumber(msg.From, from) {
+			problems = append(problems, fmt.Sprintf("from %s, expected %s", msg.From, from))
+		}
+		if msg.Reference == "" {
+			problems = append(problems, "no log ID")
+		}
+		if len(msg.MediaURLs) != len(tc.media) {
+			problems = append(problems, fmt.Sprintf("%d media, expected %d", len(msg.MediaURLs), len(tc.media)))
+		} else if fetch {
+			for i, url := range msg.MediaURLs {
+				if contentType, err := mediaType(url); err != nil {
+					problems = append(problems, err.Error())
+				} else if !strings.HasPrefix(contentType, tc.media[i]) {
+					problems = append(problems, fmt.Sprintf("media %d is %s, expected %s", i+1, contentType, tc.media[i]))
+				}
+			}
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("message %s: %s", msg.Reference, strings.Join(problems, "; "))
+		}
+		return nil
+	}
+}
+
+// mediaType fetches a media URL of the gateway and returns its content type.
+func mediaType(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("media %s answered %s", url, resp.Status)
+	}
+	return resp.Header.Get("Content-Type"), nil
+}
+
+func digits(number string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+}
+
+// sameNumber compares numbers with and without the country code 1.
+func sameNumber(a, b string) bool {
+	a, b = strings.TrimPrefix(digits(a), "1"), strings.TrimPrefix(digits(b), "1")
+	return a == b
+}
@@ -0,0 +1,538 @@
+// smpp-load is a load generator for the SMPP listener of the gateway. It binds ESME sessions
+// like Zultys systems do, submits messages at a fixed rate and reports the submit latency, the
+// errors and the delivery receipts, for capacity planning of the router and queue pipeline.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"zultys-smpp-mm4/smpp"
+	"zultys-smpp-mm4/smpp/coding"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+const usage = `usage: smpp-load [flags]
+
+Binds -sessions transceiver sessions to -addr and submits -rate messages per second over them
+for -duration, or until -count messages were submitted. A -system-id containing %d binds each
+session as its own client, numbered from 1, since a client binds at most once.
+
+Numbers are a comma separated list or a range like +15551230000-+15551230999, picked uniformly
+or, with -dist zipf, with a few numbers sending and receiving most messages.
+
+Every -interval, and at the end, it prints the submitted messages and segments, the submits
+that failed per command_status, the messages skipped because every session window was full,
+the percentiles of the submit_sm_resp latency and the delivery receipts received.
+
+flags:
+`
+
+// Delivery receipt TLV, see SMPP v5 section 4.8.4.48.
+const tagReceiptedMessageID uint16 = 0x001E
+
+type config struct {
+	address      string
+	tls          bool
+	skipVerify   bool
+	systemID     string
+	password     string
+	sessions     int
+	window       int
+	rate         float64
+	duration     time.Duration
+	count        int64
+	timeout      time.Duration
+	interval     time.Duration
+	receiptWait  time.Duration
+	longRatio    float64
+	maxParts     int
+	unicodeRatio float64
+	from         string
+	to           string
+	dist         string
+	receipts     bool
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.address, "addr", envDefault("SMPP_ADDRESS", "localhost:2775"), "SMPP listener of the gateway")
+	flag.BoolVar(&cfg.tls, "tls", false, "connect over TLS")
+	flag.BoolVar(&cfg.skipVerify, "tls-skip-verify", false, "accept any certificate of the gateway")
+	flag.StringVar(&cfg.systemID, "system-id", os.Getenv("SMPP_SYSTEM_ID"), "system_id of the binds, %d numbers the sessions")
+	flag.StringVar(&cfg.password, "password", os.Getenv("SMPP_PASSWORD"), "password of the binds")
+	flag.IntVar(&cfg.sessions, "sessions", 1, "sessions to bind")
+	flag.IntVar(&cfg.window, "window", 10, "submits in flight per session")
+	flag.Float64Var(&cfg.rate, "rate", 10, "messages per second over all sessions")
+	flag.DurationVar(&cfg.duration, "duration", time.Minute, "how long to submit")
+	flag.Int64Var(&cfg.count, "count", 0, "messages to submit, 0 for no limit")
+	flag.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "wait for a submit_sm_resp")
+	flag.DurationVar(&cfg.interval, "interval", 5*time.Second, "how often to report")
+	flag.DurationVar(&cfg.receiptWait, "receipt-wait", 10*time.Second, "wait for the outstanding receipts at the end")
+	flag.Float64Var(&cfg.longRatio, "long-ratio", 0.1, "share of messages longer than one segment")
+	flag.IntVar(&cfg.maxParts, "max-parts", 3, "segments of the longest messages")
+	flag.Float64Var(&cfg.unicodeRatio, "unicode-ratio", 0.05, "share of messages needing UCS-2")
+	flag.StringVar(&cfg.from, "from", "+15551230000-+15551230099", "source numbers")
+	flag.StringVar(&cfg.to, "to", "+15559870000-+15559879999", "destination numbers")
+	flag.StringVar(&cfg.dist, "dist", "uniform", "number distribution, uniform or zipf")
+	flag.BoolVar(&cfg.receipts, "receipts", true, "request delivery receipts")
+	flag.Usage = func() {
+		_, _ = os.Stderr.WriteString(usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func envDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// message is a message to submit, split into its segments.
+type message struct {
+	from  string
+	to    string
+	parts []pdu.ShortMessage
+}
+
+// stats are the results collected by the sessions.
+type stats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	receipted []time.Duration // from the submit to the receipt
+	errors    map[string]int
+
+	messages atomic.Int64
+	segments atomic.Int64
+	failed   atomic.Int64
+	skipped  atomic.Int64
+	receipts atomic.Int64
+	inbound  atomic.Int64
+
+	pending sync.Map // message_id → submit time, while the receipt is outstanding
+}
+
+func (s *stats) submitted(latency time.Duration, id string, receipt bool) {
+	s.segments.Add(1)
+	s.mu.Lock()
+	s.latencies = append(s.latencies, latency)
+	s.mu.Unlock()
+	if receipt && id != "" {
+		s.pending.Store(id, time.Now())
+	}
+}
+
+func (s *stats) failure(reason string) {
+	s.failed.Add(1)
+	s.mu.Lock()
+	s.errors[reason]++
+	s.mu.Unlock()
+}
+
+func run(cfg config) error {
+	if cfg.systemID == "" {
+		return errors.New("-system-id is required")
+	}
+	if cfg.sessions < 1 || cfg.window < 1 || cfg.rate <= 0 {
+		return errors.New("-sessions, -window and -rate have to be positive")
+	}
+	if cfg.sessions > 1 && !strings.Contains(cfg.systemID, "%d") {
+		fmt.Fprintln(os.Stderr, "warning: the sessions share a system_id, each bind replaces the one before it")
+	}
+	from, err := parseNumbers(cfg.from)
+	if err != nil {
+		return fmt.Errorf("-from: %w", err)
+	}
+	to, err := parseNumbers(cfg.to)
+	if err != nil {
+		return fmt.Errorf("-to: %w", err)
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	gen := &generator{
+		random: random,
+		from:   newPicker(random, from, cfg.dist),
+		to:     newPicker(random, to, cfg.dist),
+		cfg:    cfg,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var tlsConfig *tls.Config
+	if cfg.tls {
+		tlsConfig = &tls.Config{InsecureSkipVerify: cfg.skipVerify}
+	}
+	s := &stats{errors: make(map[string]int)}
+	var sessions []*smpp.Session
+	for i := 1; i <= cfg.sessions; i++ {
+		systemID := cfg.systemID
+		if strings.Contains(systemID, "%d") {
+			systemID = fmt.Sprintf(systemID, i)
+		}
+		session, err := bind(ctx, cfg.address, tlsConfig, systemID, cfg.password)
+		if err != nil {
+			for _, session := range sessions {
+				unbind(session)
+			}
+			return err
+		}
+		go serve(session, s)
+		sessions = append(sessions, session)
+	}
+	fmt.Printf("bound %d sessions to %s, submitting %.1f msg/s\n", len(sessions), cfg.address, cfg.rate)
+
+	jobs := make(chan message, cfg.sessions*cfg.window)
+	var workers sync.WaitGroup
+	for _, session := range sessions {
+		for i := 0; i < cfg.window; i++ {
+			workers.Add(1)
+			go func(session *smpp.Session) {
+				defer workers.Done()
+				for msg := range jobs {
+					submit(session, msg, cfg, s)
+				}
+			}(session)
+		}
+	}
+
+	started := time.Now()
+	report := time.NewTicker(cfg.interval)
+	defer report.Stop()
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	deadline := time.After(cfg.duration)
+	var generated int64
+generate:
+	for {
+		select {
+		case <-ctx.Done():
+			break generate
+		case <-deadline:
+			break generate
+		case <-report.C:
+			printReport(s, time.Since(started), false)
+		case <-tick.C:
+			// as many as are due by now, so the rate holds whatever the ticker resolution
+			due := int64(time.Since(started).Seconds() * cfg.rate)
+			for ; generated < due; generated++ {
+				if cfg.count > 0 && generated >= cfg.count {
+					break generate
+				}
+				select {
+				case jobs <- gen.next():
+				default:
+					s.skipped.Add(1)
+				}
+			}
+		}
+	}
+	close(jobs)
+	workers.Wait()
+	elapsed := time.Since(started)
+
+	waitReceipts(ctx, s, cfg)
+	for _, session := range sessions {
+		unbind(session)
+	}
+	printReport(s, elapsed, true)
+	return nil
+}
+
+// bind connects and binds a transceiver session.
+func bind(ctx context.Context, address string, config *tls.Config, systemID string, password string) (*smpp.Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	session, err := smpp.Dial(ctx, address, config)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := session.Submit(ctx, &pdu.BindTransceiver{SystemID: systemID, Password: password, Version: pdu.SMPPVersion34})
+	if err == nil && resp == nil {
+		err = errors.New("no bind_transceiver_resp")
+	}
+	if err == nil {
+		if status := pdu.ReadCommandStatus(resp); status != 0 {
+			err = fmt.Errorf("command_status 0x%08X", uint32(status))
+		}
+	}
+	if err != nil {
+		_ = session.Parent.Close()
+		return nil, fmt.Errorf("bind of %s failed: %w", systemID, err)
+	}
+	return session, nil
+}
+
+// unbind ends the bind and drops the connection.
+func unbind(session *smpp.Session) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, _ = session.Submit(ctx, new(pdu.Unbind))
+	_ = session.Parent.Close()
+}
+
+// serve answers the PDUs of the gateway, counting the receipts and inbound messages, until the
+// connection is gone.
+func serve(session *smpp.Session, s *stats) {
+	for {
+		select {
+		case <-session.Done():
+			return
+		case packet, ok := <-session.PDU():
+			if !ok {
+				return
+			}
+			switch p := packet.(type) {
+			case *pdu.DeliverSM:
+				if id, ok := p.Tags[tagReceiptedMessageID]; ok {
+					s.receipts.Add(1)
+					if at, found := s.pending.LoadAndDelete(strings.TrimRight(string(id), "\x00")); found {
+						s.mu.Lock()
+						s.receipted = append(s.receipted, time.Since(at.(time.Time)))
+						s.mu.Unlock()
+					}
+				} else {
+					s.inbound.Add(1)
+				}
+				_ = session.Send(p.Resp())
+			case *pdu.Unbind:
+				_ = session.Send(p.Resp())
+				_ = session.Parent.Close()
+				return
+			case pdu.Responsable:
+				_ = session.Send(p.Resp())
+			}
+		}
+	}
+}
+
+// submit sends the segments of a message, a failed segment fails the message.
+func submit(session *smpp.Session, msg message, cfg config, s *stats) {
+	s.messages.Add(1)
+	for _, part := range msg.parts {
+		submitSM := &pdu.SubmitSM{
+			SourceAddr: pdu.Address{TON: 0x01, NPI: 0x01, No: strings.TrimPrefix(msg.from, "+")},
+			DestAddr:   pdu.Address{TON: 0x01, NPI: 0x01, No: strings.TrimPrefix(msg.to, "+")},
+			ESMClass:   pdu.ESMClass{UDHIndicator: len(msg.parts) > 1},
+			Message:    part,
+		}
+		if cfg.receipts {
+			submitSM.RegisteredDelivery.MCDeliveryReceipt = 1
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+		started := time.Now()
+		resp, err := session.Submit(ctx, submitSM)
+		cancel()
+		if err != nil {
+			s.failure("timeout")
+			return
+		}
+		if status := pdu.ReadCommandStatus(resp); status != 0 {
+			s.failure(fmt.Sprintf("0x%08X", uint32(status)))
+			return
+		}
+		var id string
+		if submitResp, ok := resp.(*pdu.SubmitSMResp); ok {
+			id = submitResp.MessageID
+		}
+		s.submitted(time.Since(started), id, cfg.receipts)
+	}
+}
+
+// waitReceipts waits up to -receipt-wait for the receipts still outstanding.
+func waitReceipts(ctx context.Context, s *stats, cfg config) {
+	if !cfg.receipts {
+		return
+	}
+	deadline := time.Now().Add(cfg.receiptWait)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		outstanding := false
+		s.pending.Range(func(any, any) bool {
+			outstanding = true
+			return false
+		})
+		if !outstanding {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func printReport(s *stats, elapsed time.Duration, final bool) {
+	s.mu.Lock()
+	latencies := append([]time.Duration(nil), s.latencies...)
+	receipted := append([]time.Duration(nil), s.receipted...)
+	reasons := make([]string, 0, len(s.errors))
+	for reason, n := range s.errors {
+		reasons = append(reasons, fmt.Sprintf("%s=%d", reason, n))
+	}
+	s.mu.Unlock()
+	sort.Strings(reasons)
+
+	messages, failed := s.messages.Load(), s.failed.Load()
+	fmt.Printf("%6s  messages %d (%.1f/s)  segments %d  failed %d (%.2f%%)  skipped %d  submit p50 %s p90 %s p99 %s max %s  receipts %d\n",
+		elapsed.Round(time.Second), messages, float64(messages)/elapsed.Seconds(), s.segments.Load(), failed,
+		percent(failed, messages), s.skipped.Load(), percentile(latencies, 0.5), percentile(latencies, 0.9),
+		percentile(latencies, 0.99), percentile(latencies, 1), s.receipts.Load())
+	if !final {
+		return
+	}
+	if len(reasons) > 0 {
+		fmt.Printf("errors: %s\n", strings.Join(reasons, " "))
+	}
+	if len(receipted) > 0 {
+		fmt.Printf("receipt latency p50 %s p90 %s p99 %s max %s\n", percentile(receipted, 0.5), percentile(receipted, 0.9),
+			percentile(receipted, 0.99), percentile(receipted, 1))
+	}
+	var outstanding int
+	s.pending.Range(func(any, any) bool {
+		outstanding++
+		return true
+	})
+	fmt.Printf("receipts outstanding %d, inbound deliver_sm %d\n", outstanding, s.inbound.Load())
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// percentile returns the q quantile of the durations, 1 for the maximum.
+func percentile(durations []time.Duration, q float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[int(q*float64(len(durations)-1))].Round(10 * time.Microsecond)
+}
+
+// parseNumbers expands a comma separated list of numbers or a range start-end.
+func parseNumbers(spec string) ([]string, error) {
+	if start, end, ok := strings.Cut(spec, "-"); ok && !strings.Contains(spec, ",") {
+		plus := strings.HasPrefix(start, "+")
+		first, err1 := strconv.ParseUint(strings.TrimPrefix(start, "+"), 10, 64)
+		last, err2 := strconv.ParseUint(strings.TrimPrefix(end, "+"), 10, 64)
+		if err1 != nil || err2 != nil || last < first {
+			return nil, fmt.Errorf("invalid range %s", spec)
+		}
+		if last-first >= 1000000 {
+			return nil, fmt.Errorf("range %s has more than a million numbers", spec)
+		}
+		numbers := make([]string, 0, last-first+1)
+		for n := first; n <= last; n++ {
+			number := strconv.FormatUint(n, 10)
+			if plus {
+				number = "+" + number
+			}
+			numbers = append(numbers, number)
+		}
+		return numbers, nil
+	}
+	var numbers []string
+	for _, number := range strings.Split(spec, ",") {
+		if number = strings.TrimSpace(number); number != "" {
+			numbers = append(numbers, number)
+		}
+	}
+	if len(numbers) == 0 {
+		return nil, errors.New("no numbers")
+	}
+	return numbers, nil
+}
+
+// picker picks numbers uniformly, or zipf distributed with the first numbers picked most.
+type picker struct {
+	random  *rand.Rand
+	numbers []string
+	zipf    *rand.Zipf
+}
+
+func newPicker(random *rand.Rand, numbers []string, dist string) *picker {
+	p := &picker{random: random, numbers: numbers}
+	if dist == "zipf" && len(numbers) > 1 {
+		// shuffled, so the busy numbers aren't next to each other
+		random.Shuffle(len(numbers), func(i, j int) { numbers[i], numbers[j] = numbers[j], numbers[i] })
+		p.zipf = rand.NewZipf(random, 1.2, 1, uint64(len(numbers)-1))
+	}
+	return p
+}
+
+func (p *picker) pick() string {
+	if p.zipf != nil {
+		return p.numbers[p.zipf.Uint64()]
+	}
+	return p.numbers[p.random.Intn(len(p.numbers))]
+}
+
+// generator builds the messages, only used by the goroutine generating the load.
+type generator struct {
+	random    *rand.Rand
+	from      *picker
+	to        *picker
+	cfg       config
+	reference uint16
+}
+
+var words = strings.Fields("the meeting is moved to tomorrow at ten please call me back when you can " +
+	"thanks for the update your order has shipped and will arrive on friday see you soon")
+
+func (g *generator) next() message {
+	// characters per message and per segment of a long message, GSM 7-bit text goes as ASCII
+	// like the gateway sends it
+	single, perPart := 140, 134
+	unicode := g.random.Float64() < g.cfg.unicodeRatio
+	if unicode {
+		single, perPart = 70, 67
+	}
+	length := 20 + g.random.Intn(single-20) // most messages fit one segment
+	if g.cfg.longRatio > 0 && g.random.Float64() < g.cfg.longRatio && g.cfg.maxParts > 1 {
+		parts := 2 + g.random.Intn(g.cfg.maxParts-1)
+		length = (parts-1)*perPart + 1 + g.random.Intn(perPart)
+	}
+
+	var text strings.Builder
+	if unicode {
+		text.WriteString("✓")
+	}
+	for utf8.RuneCountInString(text.String()) < length {
+		if text.Len() > 0 {
+			text.WriteByte(' ')
+		}
+		text.WriteString(words[g.random.Intn(len(words))])
+	}
+	body := string([]rune(text.String())[:length])
+
+	dataCoding := coding.BestSafeCoding(body)
+	if dataCoding == coding.GSM7BitCoding {
+		dataCoding = coding.ASCIICoding
+	}
+	g.reference++
+	parts, err := pdu.ComposeMultipartShortMessage(body, dataCoding, g.reference)
+	if err != nil {
+		// only for codings without a splitter, the text is plain
+		parts = []pdu.ShortMessage{{DataCoding: coding.ASCIICoding, Message: []byte(body)}}
+	}
+	return message{from: g.from.pick(), to: g.to.pick(), parts: parts}
+}
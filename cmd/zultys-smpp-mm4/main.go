@@ -0,0 +1,19 @@
+// zultys-smpp-mm4 runs the gateway, see the README for its configuration.
+package main
+
+import (
+	"log"
+	"os"
+
+	gateway "zultys-smpp-mm4"
+)
+
+func main() {
+	cfg, err := gateway.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := gateway.Run(cfg, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
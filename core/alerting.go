@@ -0,0 +1,464 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert rules, each is evaluated per queue, carrier route, client or sending number.
+var AlertRules = struct {
+	QueueDepth         string
+	CarrierErrorRate   string
+	DLRFailureRate     string
+	BindLoss           string
+	TrafficSpike       string
+	DestinationAnomaly string
+	DuplicateContent   string
+	EmergencyBlocked   string
+}{
+	QueueDepth:         "queue_depth",
+	CarrierErrorRate:   "carrier_error_rate",
+	DLRFailureRate:     "dlr_failure_rate",
+	BindLoss:           "bind_loss",
+	TrafficSpike:       "traffic_spike",
+	DestinationAnomaly: "destination_anomaly",
+	DuplicateContent:   "duplicate_content",
+	EmergencyBlocked:   "emergency_blocked",
+}
+
+// Alert states. A pending alert fires once its condition held for ALERT_FOR.
+var AlertStates = struct {
+	Pending  string
+	Firing   string
+	Resolved string
+}{
+	Pending:  "pending",
+	Firing:   "firing",
+	Resolved: "resolved",
+}
+
+// Thresholds of the rules, a threshold of 0 disables its rule.
+var (
+	alertInterval        time.Duration
+	alertFor             time.Duration
+	alertQueueDepth      float64
+	alertCarrierErrors   float64
+	alertDLRFailures     float64
+	alertDLRWindow       time.Duration
+	alertDLRMinMessages  int
+	alertBindLoss        time.Duration
+	alertResolvedHistory = 24 * time.Hour
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		alertInterval = cfg.Duration("ALERT_INTERVAL", 30*time.Second)
+		alertFor = cfg.Duration("ALERT_FOR", time.Minute)
+		alertQueueDepth = alertThreshold(cfg, "ALERT_QUEUE_DEPTH", 5000)
+		alertCarrierErrors = alertThreshold(cfg, "ALERT_CARRIER_ERROR_RATE", 0.25)
+		alertDLRFailures = alertThreshold(cfg, "ALERT_DLR_FAILURE_RATE", 0.5)
+		alertDLRWindow = cfg.Duration("ALERT_DLR_WINDOW", 15*time.Minute)
+		alertDLRMinMessages = cfg.Int("ALERT_DLR_MIN_MESSAGES", 20)
+		alertBindLoss = alertDuration(cfg, "ALERT_BIND_LOSS", 5*time.Minute)
+	})
+}
+
+// Alert is the state of a rule for one subject.
+type Alert struct {
+	Key        string     `json:"key"`
+	Rule       string     `json:"rule"`
+	Subject    string     `json:"subject"` // queue, carrier route, client or number
+	Value      float64    `json:"value"`
+	Threshold  float64    `json:"threshold"`
+	Summary    string     `json:"summary"`
+	State      string     `json:"state"`
+	Since      time.Time  `json:"since"` // since the condition holds
+	FiredAt    *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// alertCondition is a rule breached by a subject at the last evaluation.
+type alertCondition struct {
+	rule      string
+	subject   string
+	value     float64
+	threshold float64
+	summary   string
+	wait      time.Duration // how long it has to hold before firing
+}
+
+func (c alertCondition) key() string { return c.rule + ":" + c.subject }
+
+type alertNotifier interface {
+	name() string
+	notify(alert Alert, serverID string) error
+}
+
+// alerting tracks the alerts of this instance.
+var alerting = struct {
+	mu     sync.RWMutex
+	alerts map[string]*Alert
+	bound  map[string]time.Time // client: last evaluation it was bound over SMPP
+}{
+	alerts: make(map[string]*Alert),
+	bound:  make(map[string]time.Time),
+}
+
+func alertThreshold(cfg *Config, key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(cfg.Getenv(key), 64); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+func alertDuration(cfg *Config, key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(cfg.Getenv(key)); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+// alertConditions evaluates every rule.
+func (gateway *Gateway) alertConditions(now time.Time, boundClients func() ([]string, bool)) ([]alertCondition, error) {
+	var conditions []alertCondition
+
+	if alertQueueDepth > 0 {
+		for queue, depth := range gateway.QueueDepths() {
+			if float64(depth) >= alertQueueDepth {
+				conditions = append(conditions, alertCondition{
+					rule: AlertRules.QueueDepth, subject: queue, value: float64(depth), threshold: alertQueueDepth, wait: alertFor,
+					summary: fmt.Sprintf("Queue %s holds %d messages", queue, depth),
+				})
+			}
+		}
+	}
+
+	if alertCarrierErrors > 0 {
+		for _, route := range gateway.Router.RouteHealth() {
+			if route.Samples >= RouteErrorMinSamples && route.ErrorRate >= alertCarrierErrors {
+				conditions = append(conditions, alertCondition{
+					rule: AlertRules.CarrierErrorRate, subject: route.Route, value: route.ErrorRate, threshold: alertCarrierErrors, wait: alertFor,
+					summary: fmt.Sprintf("Carrier route %s fails %.0f%% of its sends", route.Route, route.ErrorRate*100),
+				})
+			}
+		}
+	}
+
+	if sessions, ok := boundClients(); alertBindLoss > 0 && ok {
+		bound := make(map[string]bool)
+		for _, username := range sessions {
+			bound[username] = true
+		}
+		alerting.mu.Lock()
+		for username := range bound {
+			alerting.bound[username] = now
+		}
+		for username, lastBound := range alerting.bound {
+			if bound[username] {
+				continue
+			}
+			if _, ok := gateway.Clients[username]; !ok {
+				delete(alerting.bound, username)
+				continue
+			}
+			conditions = append(conditions, alertCondition{
+				rule: AlertRules.BindLoss, subject: username, value: now.Sub(lastBound).Seconds(), threshold: alertBindLoss.Seconds(), wait: alertBindLoss,
+				summary: fmt.Sprintf("Client %s has no SMPP bind since %s", username, lastBound.UTC().Format(time.RFC3339)),
+			})
+		}
+		alerting.mu.Unlock()
+	}
+
+	conditions = append(conditions, gateway.anomalyConditions(now)...)
+	conditions = append(conditions, emergencyConditions(now)...)
+
+	if alertDLRFailures > 0 {
+		var rows []struct {
+			Carrier string
+			Final   int64
+			Failed  int64
+		}
+		err := gateway.DB.Model(&CarrierMessage{}).
+			Select("carrier, count(*) AS final, count(*) FILTER (WHERE status <> ?) AS failed", DeliveryStatuses.Delivered).
+			Where("updated_at >= ? AND status IN ?", now.Add(-alertDLRWindow),
+				[]string{DeliveryStatuses.Delivered, DeliveryStatuses.Failed, DeliveryStatuses.Undelivered}).
+			Group("carrier").
+			Scan(&rows).Error
+		if err != nil {
+			return conditions, err
+		}
+		for _, row := range rows {
+			if row.Final < int64(alertDLRMinMessages) {
+				continue
+			}
+			if rate := float64(row.Failed) / float64(row.Final); rate >= alertDLRFailures {
+				conditions = append(conditions, alertCondition{
+					rule: AlertRules.DLRFailureRate, subject: row.Carrier, value: rate, threshold: alertDLRFailures, wait: alertFor,
+					summary: fmt.Sprintf("Carrier %s reported %d of %d messages failed in the last %s", row.Carrier, row.Failed, row.Final, alertDLRWindow),
+				})
+			}
+		}
+	}
+	return conditions, nil
+}
+
+// updateAlerts moves the alerts through their states and returns the ones that fired or resolved.
+func updateAlerts(conditions []alertCondition, now time.Time) []Alert {
+	alerting.mu.Lock()
+	defer alerting.mu.Unlock()
+
+	var changed []Alert
+	active := make(map[string]bool, len(conditions))
+	for _, condition := range conditions {
+		key := condition.key()
+		active[key] = true
+
+		alert, ok := alerting.alerts[key]
+		if !ok || alert.State == AlertStates.Resolved {
+			alert = &Alert{Key: key, Rule: condition.rule, Subject: condition.subject, State: AlertStates.Pending, Since: now}
+			alerting.alerts[key] = alert
+		}
+		alert.Value, alert.Threshold, alert.Summary = condition.value, condition.threshold, condition.summary
+		if alert.State == AlertStates.Pending && now.Sub(alert.Since) >= condition.wait {
+			alert.State = AlertStates.Firing
+			alert.FiredAt = &now
+			changed = append(changed, *alert)
+		}
+	}
+
+	for key, alert := range alerting.alerts {
+		if active[key] {
+			continue
+		}
+		switch alert.State {
+		case AlertStates.Pending:
+			delete(alerting.alerts, key)
+		case AlertStates.Firing:
+			alert.State = AlertStates.Resolved
+			alert.ResolvedAt = &now
+			changed = append(changed, *alert)
+		case AlertStates.Resolved:
+			if now.Sub(*alert.ResolvedAt) > alertResolvedHistory {
+				delete(alerting.alerts, key)
+			}
+		}
+	}
+	return changed
+}
+
+// alertList is every tracked alert, firing first.
+func alertList() []Alert {
+	alerting.mu.RLock()
+	defer alerting.mu.RUnlock()
+	list := make([]Alert, 0, len(alerting.alerts))
+	for _, alert := range alerting.alerts {
+		list = append(list, *alert)
+	}
+	order := map[string]int{AlertStates.Firing: 0, AlertStates.Pending: 1, AlertStates.Resolved: 2}
+	sort.Slice(list, func(i, j int) bool {
+		if order[list[i].State] != order[list[j].State] {
+			return order[list[i].State] < order[list[j].State]
+		}
+		return list[i].Since.After(list[j].Since)
+	})
+	return list
+}
+
+// StartAlerting evaluates the alert rules every ALERT_INTERVAL and notifies about alerts that
+// fire or resolve. boundClients lists the clients with an SMPP session, false while the SMPP
+// server isn't running.
+func (gateway *Gateway) StartAlerting(boundClients func() ([]string, bool)) {
+	var lm = gateway.LogManager
+	notifiers := alertNotifiers()
+
+	ticker := time.NewTicker(alertInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		conditions, err := gateway.alertConditions(now, boundClients)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.Alerting",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+
+		for _, alert := range updateAlerts(conditions, now) {
+			template, level := "AlertFiring", logrus.ErrorLevel
+			if alert.State == AlertStates.Resolved {
+				template, level = "AlertResolved", logrus.InfoLevel
+			}
+			lm.SendLog(lm.BuildLog(
+				"System.Alerting",
+				template,
+				level,
+				map[string]interface{}{
+					"rule":    alert.Rule,
+					"subject": alert.Subject,
+					"value":   alert.Value,
+				}, alert.Summary,
+			))
+
+			for _, notifier := range notifiers {
+				go func(notifier alertNotifier, alert Alert) {
+					if err := notifier.notify(alert, gateway.ServerID); err != nil {
+						lm.SendLog(lm.BuildLog(
+							"System.Alerting",
+							"GenericError",
+							logrus.WarnLevel,
+							map[string]interface{}{
+								"notifier": notifier.name(),
+								"rule":     alert.Rule,
+							}, err,
+						))
+					}
+				}(notifier, alert)
+			}
+		}
+	}
+}
+
+// alertNotifiers are the notifiers configured by ALERT_EMAIL_TO, ALERT_SLACK_WEBHOOK_URL and
+// ALERT_PAGERDUTY_ROUTING_KEY.
+func alertNotifiers() []alertNotifier {
+	var notifiers []alertNotifier
+	if to := Getenv("ALERT_EMAIL_TO"); to != "" {
+		notifiers = append(notifiers, &emailNotifier{
+			addr:     Getenv("ALERT_SMTP_ADDR"),
+			username: Getenv("ALERT_SMTP_USERNAME"),
+			password: Getenv("ALERT_SMTP_PASSWORD"),
+			from:     EnvString("ALERT_EMAIL_FROM", "gateway@localhost"),
+			to:       strings.Split(to, ","),
+		})
+	}
+	if webhook := Getenv("ALERT_SLACK_WEBHOOK_URL"); webhook != "" {
+		notifiers = append(notifiers, &slackNotifier{url: webhook})
+	}
+	if key := Getenv("ALERT_PAGERDUTY_ROUTING_KEY"); key != "" {
+		notifiers = append(notifiers, &pagerDutyNotifier{routingKey: key, severity: EnvString("ALERT_PAGERDUTY_SEVERITY", "error")})
+	}
+	return notifiers
+}
+
+var alertClient = http.Client{Timeout: 10 * time.Second}
+
+func postAlertJSON(url string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := alertClient.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func alertTitle(alert Alert, serverID string) string {
+	return fmt.Sprintf("[%s] %s (%s)", strings.ToUpper(alert.State), alert.Summary, serverID)
+}
+
+// emailNotifier mails alerts over SMTP, authenticating when a username is set.
+type emailNotifier struct {
+	addr     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (n *emailNotifier) name() string { return "email" }
+
+func (n *emailNotifier) notify(alert Alert, serverID string) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		host, _, _ := strings.Cut(n.addr, ":")
+		auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n", n.from, strings.Join(n.to, ", "), alertTitle(alert, serverID))
+	fmt.Fprintf(&body, "%s\r\n\r\nRule: %s\r\nSubject: %s\r\nValue: %g\r\nThreshold: %g\r\nSince: %s\r\nServer: %s\r\n",
+		alert.Summary, alert.Rule, alert.Subject, alert.Value, alert.Threshold, alert.Since.UTC().Format(time.RFC3339), serverID)
+	return smtp.SendMail(n.addr, auth, n.from, n.to, []byte(body.String()))
+}
+
+// slackNotifier posts alerts to a Slack incoming webhook.
+type slackNotifier struct {
+	url string
+}
+
+func (n *slackNotifier) name() string { return "slack" }
+
+func (n *slackNotifier) notify(alert Alert, serverID string) error {
+	icon := ":red_circle:"
+	if alert.State == AlertStates.Resolved {
+		icon = ":large_green_circle:"
+	}
+	return postAlertJSON(n.url, map[string]string{"text": icon + " " + alertTitle(alert, serverID)})
+}
+
+// pagerDutyEventsURL is the PagerDuty Events API v2.
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDutyNotifier triggers and resolves PagerDuty incidents, deduplicated by the alert key so
+// every gateway instance reports to the same incident.
+type pagerDutyNotifier struct {
+	routingKey string
+	severity   string
+}
+
+func (n *pagerDutyNotifier) name() string { return "pagerduty" }
+
+func (n *pagerDutyNotifier) notify(alert Alert, serverID string) error {
+	event := map[string]interface{}{
+		"routing_key":  n.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    "zultys-smpp-mm4:" + alert.Key,
+	}
+	if alert.State == AlertStates.Resolved {
+		event["event_action"] = "resolve"
+	} else {
+		event["payload"] = map[string]interface{}{
+			"summary":   alert.Summary,
+			"source":    serverID,
+			"severity":  n.severity,
+			"component": alert.Subject,
+			"class":     alert.Rule,
+			"custom_details": map[string]interface{}{
+				"value":     alert.Value,
+				"threshold": alert.Threshold,
+				"since":     alert.Since,
+			},
+		}
+	}
+	return postAlertJSON(pagerDutyEventsURL, event)
+}
+
+// SetupAlertRoutes sets up the list of the alerts of this instance.
+func SetupAlertRoutes(app *iris.Application, gateway *Gateway) {
+	alerts := app.Party("/alerts", gateway.BasicAuthMiddleware)
+	{
+		// List the pending, firing and recently resolved alerts
+		alerts.Get("/", func(ctx iris.Context) {
+			ctx.JSON(alertList())
+		})
+	}
+}
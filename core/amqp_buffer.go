@@ -0,0 +1,263 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gorm.io/gorm"
+	"time"
+)
+
+// ErrPublishBufferFull is returned when a message can't be published, the in-memory buffer is
+// full and there is no outbox table to overflow into.
+var ErrPublishBufferFull = errors.New("amqp publish buffer full")
+
+const replayInterval = 10 * time.Second
+
+type bufferedPublish struct {
+	queue      string
+	publishing amqp.Publishing
+}
+
+// OutboxMessage is a publish that overflowed the in-memory buffer while RabbitMQ was
+// unavailable, it is replayed in insertion order once the broker is back.
+type OutboxMessage struct {
+	ID          uint   `gorm:"primaryKey"`
+	Owner       string `gorm:"index"` // server ID of the gateway that buffered it
+	Queue       string `gorm:"not null"`
+	ContentType string
+	Headers     string // JSON encoded amqp.Table
+	Expiration  string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// UseOutbox lets the client persist publishes to Postgres once the in-memory buffer is full,
+// owner keeps gateway instances sharing the database from replaying each other's rows.
+func (client *AMPQClient) UseOutbox(db *gorm.DB, owner string) {
+	client.m.Lock()
+	client.outbox = db
+	client.outboxOwner = owner
+	client.m.Unlock()
+}
+
+// Accepting reports whether a publish would currently succeed or be buffered.
+func (client *AMPQClient) Accepting() bool {
+	if client.Ready() {
+		return true
+	}
+	client.m.Lock()
+	defer client.m.Unlock()
+	return client.outbox != nil || len(client.buffer) < cap(client.buffer)
+}
+
+// QueueDepths reports the publishes held in memory while RabbitMQ is unreachable.
+func (client *AMPQClient) QueueDepths() map[string]int {
+	depth := len(client.buffer)
+	client.m.Lock()
+	if client.replayHead != nil {
+		depth++
+	}
+	client.m.Unlock()
+	return map[string]int{"amqp_buffer": depth}
+}
+
+func (client *AMPQClient) bufferPublish(queueName string, publishing amqp.Publishing) error {
+	select {
+	case client.buffer <- bufferedPublish{queue: queueName, publishing: publishing}:
+		return nil
+	default:
+	}
+
+	client.m.Lock()
+	outbox, owner := client.outbox, client.outboxOwner
+	client.m.Unlock()
+	if outbox == nil {
+		return ErrPublishBufferFull
+	}
+
+	headers, err := json.Marshal(publishing.Headers)
+	if err != nil {
+		return err
+	}
+	return outbox.Create(&OutboxMessage{
+		Owner:       owner,
+		Queue:       queueName,
+		ContentType: publishing.ContentType,
+		Headers:     string(headers),
+		Expiration:  publishing.Expiration,
+		Body:        publishing.Body,
+	}).Error
+}
+
+// replayLoop flushes buffered publishes after every reconnect, and periodically in case a
+// publish failed while the connection stayed up.
+func (client *AMPQClient) replayLoop() {
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-client.replayNow:
+		case <-ticker.C:
+		}
+
+		if client.Ready() {
+			client.replay()
+		}
+	}
+}
+
+// replay publishes the memory buffer and then the outbox, stopping at the first failure so the
+// remaining messages wait for the next reconnect. A publish that failed is kept at the head and
+// replayed first, ahead of what was buffered after it.
+func (client *AMPQClient) replay() {
+	client.m.Lock()
+	pending := client.replayHead
+	client.replayHead = nil
+	client.m.Unlock()
+	for {
+		if pending == nil {
+			select {
+			case next := <-client.buffer:
+				pending = &next
+			default:
+			}
+		}
+		if pending == nil {
+			break
+		}
+		if err := client.publishConfirmed(context.Background(), pending.queue, pending.publishing); err != nil {
+			client.logger.Printf("Replay to %s failed: %v", pending.queue, err)
+			client.m.Lock()
+			client.replayHead = pending
+			client.m.Unlock()
+			return
+		}
+		pending = nil
+	}
+
+	client.m.Lock()
+	outbox, owner := client.outbox, client.outboxOwner
+	client.m.Unlock()
+	if outbox == nil {
+		return
+	}
+
+	for {
+		var batch []OutboxMessage
+		if err := outbox.Where("owner = ?", owner).Order("id asc").Limit(100).Find(&batch).Error; err != nil || len(batch) == 0 {
+			return
+		}
+
+		for _, message := range batch {
+			var headers amqp.Table
+			if message.Headers != "" && message.Headers != "null" {
+				if err := json.Unmarshal([]byte(message.Headers), &headers); err != nil {
+					client.logger.Printf("Dropping unreadable outbox headers for message %d: %v", message.ID, err)
+				}
+			}
+
+			err := client.publishConfirmed(context.Background(), message.Queue, amqp.Publishing{
+				ContentType: message.ContentType,
+				Headers:     headers,
+				Expiration:  message.Expiration,
+				Body:        message.Body,
+			})
+			if err != nil {
+				client.logger.Printf("Replay of outbox message %d failed: %v", message.ID, err)
+				return
+			}
+			outbox.Delete(&OutboxMessage{}, message.ID)
+		}
+	}
+}
+
+// Subscribe returns a delivery channel for the queue that survives reconnects, the consumer is
+// re-established on every new channel. The returned channel is closed when the client closes.
+func (client *AMPQClient) Subscribe(queueName string) <-chan amqp.Delivery {
+	out := make(chan amqp.Delivery)
+
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-client.done:
+				return
+			default:
+			}
+
+			deliveries, err := client.ConsumeMessages(queueName)
+			if err != nil {
+				select {
+				case <-client.done:
+					return
+				case <-time.After(ReInitDelay):
+				}
+				continue
+			}
+
+			client.logger.Printf("Consuming from %s", queueName)
+			for delivery := range deliveries {
+				out <- delivery
+			}
+			client.logger.Printf("Consumer for %s closed, re-establishing", queueName)
+		}
+	}()
+
+	return out
+}
+
+// Consume implements MessageQueue on top of Subscribe, acks and nacks go to the AMQP channel the
+// message arrived on.
+func (client *AMPQClient) Consume(queueName string) <-chan QueueDelivery {
+	out := make(chan QueueDelivery)
+
+	go func() {
+		defer close(out)
+		for delivery := range client.Subscribe(queueName) {
+			delivery := delivery
+			out <- QueueDelivery{
+				Queue:   queueName,
+				Body:    delivery.Body,
+				Headers: plainHeaders(delivery.Headers),
+				ack: func() error {
+					return delivery.Ack(false)
+				},
+				nack: func(requeue bool) error {
+					return delivery.Nack(false, requeue)
+				},
+			}
+		}
+	}()
+	return out
+}
+
+// plainHeaders converts AMQP tables, including nested ones like x-death, to plain maps.
+func plainHeaders(table amqp.Table) map[string]interface{} {
+	if table == nil {
+		return nil
+	}
+	headers := make(map[string]interface{}, len(table))
+	for key, value := range table {
+		headers[key] = plainHeaderValue(value)
+	}
+	return headers
+}
+
+func plainHeaderValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case amqp.Table:
+		return plainHeaders(v)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = plainHeaderValue(item)
+		}
+		return values
+	}
+	return value
+}
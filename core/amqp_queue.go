@@ -0,0 +1,452 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// todo implement carrier delivery status queue in rabbitmq?
+
+type MsgQueueType string
+
+var MsgQueueItemType = struct {
+	SMS MsgQueueType
+	MMS MsgQueueType
+}{
+	SMS: "sms",
+	MMS: "mms",
+}
+
+// MsgQueueItem is the message passed between the ingress servers, the routers, RabbitMQ and the
+// dead letter and scheduler tables. Always serialize it with EncodeMsgQueueItem and read it with
+// DecodeMsgQueueItem, see msg_schema.go for the version history.
+type MsgQueueItem struct {
+	SchemaVersion      int          `json:"schema_version"`
+	TraceID            string       `json:"trace_id"` // stays the same across retries, dead letters and re-queues
+	To                 string       `json:"to_number"`
+	From               string       `json:"from_number"`
+	ReceivedTimestamp  time.Time    `json:"received_timestamp"`
+	QueuedTimestamp    time.Time    `json:"queued_timestamp"`
+	Type               MsgQueueType `json:"type"`               // mms or sms
+	Encoding           string       `json:"encoding,omitempty"` // data coding the message arrived in, e.g. gsm7 or ucs2
+	Files              []MsgFile    `json:"files"`              // inline content or media references
+	Message            string       `json:"message"`            // UTF-8 text
+	SkipNumberCheck    bool         `json:"skip_number_check"`
+	LogID              string       `json:"log_id"`
+	Attempts           int          `json:"attempts"`
+	Priority           int          `json:"priority"` // set by routing rules
+	Hops               int          `json:"hops"`
+	Trace              []string     `json:"trace,omitempty"`               // router queues the message passed through
+	ExpiresAt          time.Time    `json:"expires_at,omitempty"`          // zero means the message never expires
+	TraceParent        string       `json:"traceparent,omitempty"`         // W3C span context of the last span of the message, see tracing.go
+	InboundCarrier     string       `json:"inbound_carrier,omitempty"`     // carrier account an inbound message arrived on
+	SkipOptOut         bool         `json:"skip_opt_out,omitempty"`        // replies to opt-out keywords, see optout.go
+	Screened           bool         `json:"screened,omitempty"`            // passed the content filter, see content_filter.go
+	AllowInternational bool         `json:"allow_international,omitempty"` // the sender's flag for the flag international policy
+	SkipReceipt        bool         `json:"skip_receipt,omitempty"`        // the sender takes no delivery receipt for it, see ClientProfile
+
+	Delivery *QueueDelivery   `json:"-"`
+	Decision *RoutingDecision `json:"-"` // audit record of the current router, see routing_audit.go
+
+	CarrierMessageID string       `json:"-"` // ID the carrier assigned to the current send, for its CDR
+	SubmittedAs      MsgQueueType `json:"-"` // of a message sent as another type, see upgradeToMMS
+	SubmittedText    string       `json:"-"` // text of a transliterated message as submitted, see transliterateMessage
+	MirrorRoute      string       `json:"-"` // route of the rule that gets a copy of the message, see mirrorSend
+	Mirrored         bool         `json:"-"` // the copy sent to a mirror route
+}
+
+// MsgFile represents an individual file extracted from the MIME multipart message. A file
+// either carries its content inline or references media stored elsewhere by URL.
+type MsgFile struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Content     []byte `json:"content,omitempty"`
+	Base64Data  string `json:"base64_data,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Size        int    `json:"size,omitempty"`
+}
+
+// AMPQClient is the base struct for handling connection recovery, consumption, and publishing.
+type AMPQClient struct {
+	m               *sync.Mutex
+	queues          []string
+	logger          *log.Entry
+	connection      *amqp.Connection
+	channel         *amqp.Channel
+	done            chan bool
+	notifyConnClose chan *amqp.Error
+	notifyChanClose chan *amqp.Error
+	isReady         bool
+
+	buffer      chan bufferedPublish // publishes waiting for the broker, replayed after reconnect
+	outbox      *gorm.DB             // overflow for the buffer, see UseOutbox
+	outboxOwner string
+	replayHead  *bufferedPublish // a replay that failed, published before the buffer
+	replayNow   chan struct{}
+}
+
+const (
+	ReconnectDelay    = 1 * time.Second // initial delay, doubled after every failed attempt
+	MaxReconnectDelay = time.Minute
+	ReInitDelay       = 2 * time.Second
+
+	publishConfirmTimeout = 30 * time.Second
+)
+
+// RetryQueueName returns the name of the delayed retry queue for a queue.
+func RetryQueueName(queue string) string {
+	return queue + ".retry"
+}
+
+// Close will cleanly shut down the channel and connection.
+func (client *AMPQClient) Close() error {
+	client.m.Lock()
+	// we read and write isReady in two locations, so we grab the lock and hold onto
+	// it until we are finished
+	defer client.m.Unlock()
+
+	if !client.isReady {
+		return fmt.Errorf("connection already closed")
+	}
+	close(client.done)
+	err := client.channel.Close()
+	if err != nil {
+		return err
+	}
+	err = client.connection.Close()
+	if err != nil {
+		return err
+	}
+
+	client.isReady = false
+	return nil
+}
+
+// NewMsgQueueClient creates a new AMPQClient instance and attempts to connect to the server.
+func NewMsgQueueClient(addr string, queues []string) *AMPQClient {
+	logger := log.New()
+	logger.SetFormatter(logFormatter())
+	logger.SetLevel(log.InfoLevel)
+
+	client := AMPQClient{
+		m:         &sync.Mutex{},
+		queues:    queues,
+		logger:    logger.WithField("subsystem", "amqp"),
+		done:      make(chan bool),
+		buffer:    make(chan bufferedPublish, EnvInt("AMQP_BUFFER_SIZE", 10000)),
+		replayNow: make(chan struct{}, 1),
+	}
+
+	go client.handleReconnect(addr)
+	go client.replayLoop()
+	return &client
+}
+
+// handleReconnect handles reconnection logic, backing off exponentially while the broker is down
+func (client *AMPQClient) handleReconnect(addr string) {
+	delay := ReconnectDelay
+	for {
+		client.m.Lock()
+		client.isReady = false
+		client.m.Unlock()
+
+		client.logger.Println("Attempting to connect")
+		conn, err := client.connect(addr)
+		if err != nil {
+			client.logger.Printf("Failed to connect. Retrying in %s...", delay)
+			select {
+			case <-client.done:
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, MaxReconnectDelay)
+			continue
+		}
+		delay = ReconnectDelay
+
+		if done := client.handleReInit(conn); done {
+			break
+		}
+	}
+}
+
+// connect creates a new AMQP connection
+func (client *AMPQClient) connect(addr string) (*amqp.Connection, error) {
+	conn, err := amqp.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	client.changeConnection(conn)
+	client.logger.Println("Connected!")
+	return conn, nil
+}
+
+// handleReInit handles channel re-initialization
+func (client *AMPQClient) handleReInit(conn *amqp.Connection) bool {
+	for {
+		client.m.Lock()
+		client.isReady = false
+		client.m.Unlock()
+
+		err := client.init(conn)
+		if err != nil {
+			client.logger.Println("Failed to initialize channel. Retrying...")
+			select {
+			case <-client.done:
+				return true
+			case <-client.notifyConnClose:
+				client.logger.Println("Connection closed. Reconnecting...")
+				return false
+			case <-time.After(ReInitDelay):
+			}
+			continue
+		}
+
+		select {
+		case <-client.done:
+			return true
+		case <-client.notifyConnClose:
+			client.logger.Println("Connection closed. Reconnecting...")
+			return false
+		case <-client.notifyChanClose:
+			client.logger.Println("Channel closed. Re-initializing...")
+		}
+	}
+}
+
+// init initializes channel and declares all queues
+func (client *AMPQClient) init(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	err = ch.Confirm(false)
+	if err != nil {
+		return err
+	}
+
+	for _, queue := range client.queues {
+		_, err := ch.QueueDeclare(
+			queue,
+			true,  // Durable
+			false, // Delete when unused
+			false, // Exclusive
+			false, // No-wait
+			nil,   // Arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue '%s': %w", queue, err)
+		}
+		client.logger.Printf("Declared queue: %s", queue)
+
+		if queue == DeadLetterQueue {
+			continue
+		}
+
+		// delayed retries sit in the retry queue until their per-message TTL expires and are
+		// then dead-lettered back onto the original queue through the default exchange
+		_, err = ch.QueueDeclare(
+			RetryQueueName(queue),
+			true,  // Durable
+			false, // Delete when unused
+			false, // Exclusive
+			false, // No-wait
+			amqp.Table{
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queue,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue '%s': %w", RetryQueueName(queue), err)
+		}
+	}
+
+	// messages rejected without requeue (or expired) on the other queues are routed here
+	// through the dead letter exchange, see the gateway-dlx policy in rabbitmq/definitions.json
+	if StringInArray(DeadLetterQueue, client.queues) {
+		err = ch.ExchangeDeclare(deadLetterExchange, "fanout", true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("failed to declare exchange '%s': %w", deadLetterExchange, err)
+		}
+		err = ch.QueueBind(DeadLetterQueue, "", deadLetterExchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("failed to bind queue '%s': %w", DeadLetterQueue, err)
+		}
+	}
+
+	client.changeChannel(ch)
+	client.m.Lock()
+	client.isReady = true
+	client.m.Unlock()
+	client.logger.Println("Channel setup complete!")
+
+	// flush whatever was buffered while the broker was unavailable
+	select {
+	case client.replayNow <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (client *AMPQClient) changeConnection(conn *amqp.Connection) {
+	client.connection = conn
+	client.notifyConnClose = make(chan *amqp.Error, 1)
+	client.connection.NotifyClose(client.notifyConnClose)
+}
+
+func (client *AMPQClient) changeChannel(ch *amqp.Channel) {
+	client.channel = ch
+	client.notifyChanClose = make(chan *amqp.Error, 1)
+	client.channel.NotifyClose(client.notifyChanClose)
+}
+
+// Ready reports whether the client currently has a usable channel.
+func (client *AMPQClient) Ready() bool {
+	client.m.Lock()
+	defer client.m.Unlock()
+	return client.isReady && client.channel != nil
+}
+
+// Publish sends a message to the specified queue
+func (client *AMPQClient) Publish(ctx context.Context, queueName string, data []byte) error {
+	return client.PublishWithHeaders(ctx, queueName, data, nil)
+}
+
+// PublishWithHeaders sends a message with the provided AMQP headers to the specified queue
+func (client *AMPQClient) PublishWithHeaders(ctx context.Context, queueName string, data []byte, headers map[string]interface{}) error {
+	return client.publish(ctx, queueName, amqp.Publishing{
+		ContentType: "application/json",
+		Headers:     amqp.Table(headers),
+		Body:        data,
+	})
+}
+
+// PublishDelayed parks a message on the retry queue of queueName, once the delay expires
+// RabbitMQ dead-letters it back onto queueName.
+func (client *AMPQClient) PublishDelayed(ctx context.Context, queueName string, data []byte, headers map[string]interface{}, delay time.Duration) error {
+	if delay <= 0 {
+		return client.PublishWithHeaders(ctx, queueName, data, headers)
+	}
+	return client.publish(ctx, RetryQueueName(queueName), amqp.Publishing{
+		ContentType: "application/json",
+		Headers:     amqp.Table(headers),
+		Expiration:  strconv.FormatInt(delay.Milliseconds(), 10),
+		Body:        data,
+	})
+}
+
+// publish sends the message and waits for the broker to confirm it. When the broker is
+// unavailable or doesn't confirm, the message is buffered and replayed after reconnecting, so
+// a nil error means the message was either confirmed or safely buffered. A publish the caller
+// gave up on isn't buffered, the caller still has the message.
+func (client *AMPQClient) publish(ctx context.Context, queueName string, publishing amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if client.Ready() {
+		err := client.publishConfirmed(ctx, queueName, publishing)
+		if err == nil {
+			client.logger.Debugf("Message published to %s", queueName)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("publish to %s abandoned: %w", queueName, err)
+		}
+		client.logger.Printf("Publish to %s failed, buffering: %v", queueName, err)
+	}
+	return client.bufferPublish(queueName, publishing)
+}
+
+// publishConfirmed publishes with a deferred confirmation and waits for the broker's ack.
+func (client *AMPQClient) publishConfirmed(ctx context.Context, queueName string, publishing amqp.Publishing) error {
+	client.m.Lock()
+	ch := client.channel
+	ready := client.isReady
+	client.m.Unlock()
+
+	if !ready || ch == nil {
+		return fmt.Errorf("not ready")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, publishConfirmTimeout)
+	defer cancel()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", queueName, false, false, publishing)
+	if err != nil {
+		return err
+	}
+	if confirmation == nil {
+		// channel isn't in confirm mode, nothing to wait for
+		return nil
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("waiting for publisher confirm: %w", err)
+	}
+	if !acked {
+		return fmt.Errorf("broker nacked message to %s", queueName)
+	}
+	return nil
+}
+
+// UnsafePublish publishes a message without confirmation
+func (client *AMPQClient) UnsafePublish(queueName string, publishing amqp.Publishing) error {
+	client.m.Lock()
+	defer client.m.Unlock()
+
+	if client.isReady && client.channel == nil || client.channel == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	if !client.isReady {
+		return fmt.Errorf("not ready")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return client.channel.PublishWithContext(
+		ctx,
+		"",        // Exchange
+		queueName, // Router key
+		false,
+		false,
+		publishing,
+	)
+}
+
+// ConsumeMessages starts consuming messages from a specified queue
+func (client *AMPQClient) ConsumeMessages(queueName string) (<-chan amqp.Delivery, error) {
+	client.m.Lock()
+	defer client.m.Unlock()
+
+	if client.isReady && client.channel == nil || client.channel == nil {
+		return nil, fmt.Errorf("not connected")
+	}
+
+	if !client.isReady {
+		return nil, fmt.Errorf("not ready")
+	}
+
+	if err := client.channel.Qos(1, 0, false); err != nil {
+		return nil, fmt.Errorf("failed to set QoS: %w", err)
+	}
+
+	return client.channel.Consume(
+		queueName,
+		"",
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+}
@@ -0,0 +1,606 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKey authenticates a caller of the management API. The token is only shown when the key is
+// created, the hash of it is stored.
+type APIKey struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Name      string     `gorm:"not null" json:"name"`
+	Prefix    string     `json:"prefix"` // start of the token, to recognize it
+	Hash      string     `gorm:"uniqueIndex;not null" json:"-"`
+	Role      string     `gorm:"not null" json:"role"`
+	Clients   string     `json:"clients"`   // comma separated usernames the key is limited to, empty for all
+	TenantID  uint       `json:"tenant_id"` // tenant the key is limited to, 0 for the operator
+	Disabled  bool       `json:"disabled"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	Version   uint       `gorm:"not null;default:1" json:"version"`
+	Token     string     `gorm:"-" json:"token,omitempty"`
+}
+
+// Roles of the API keys.
+var APIRoles = struct {
+	ReadOnly     string
+	Provisioning string
+	Operator     string
+	Admin        string
+}{
+	ReadOnly:     "read_only",
+	Provisioning: "provisioning",
+	Operator:     "operator",
+	Admin:        "admin",
+}
+
+// What a management request does, see accessRules.
+var APIAccesses = struct {
+	Read      string
+	Provision string
+	Operate   string
+	Admin     string
+}{
+	Read:      "read",
+	Provision: "provision", // clients, numbers, carriers, routes, rates and webhooks
+	Operate:   "operate",   // sending, dead letters, schedules, sessions and reloads
+	Admin:     "admin",     // API keys, tenants and the audit log
+}
+
+var roleAccesses = map[string][]string{
+	APIRoles.ReadOnly:     {APIAccesses.Read},
+	APIRoles.Provisioning: {APIAccesses.Read, APIAccesses.Provision},
+	APIRoles.Operator:     {APIAccesses.Read, APIAccesses.Operate},
+	APIRoles.Admin:        {APIAccesses.Read, APIAccesses.Provision, APIAccesses.Operate, APIAccesses.Admin},
+}
+
+// accessRule gives the access a request needs by its method and path, a * segment matches any
+// segment and the path may continue after the pattern.
+type accessRule struct {
+	method  string // empty for any method
+	pattern string
+	access  string
+}
+
+// accessRules are matched in order, requests that match none need admin access.
+var accessRules = []accessRule{
+	{pattern: "/apikeys", access: APIAccesses.Admin},
+	{pattern: "/audit", access: APIAccesses.Admin},
+	{method: "POST", pattern: "/routing/explain", access: APIAccesses.Read},
+	{method: "GET", pattern: "/", access: APIAccesses.Read},
+	{pattern: "/tenants", access: APIAccesses.Admin},
+	{pattern: "/clients/reload", access: APIAccesses.Operate},
+	{pattern: "/carriers/reload", access: APIAccesses.Operate},
+	{pattern: "/carriers/*/probe", access: APIAccesses.Operate},
+	{pattern: "/routing/rules/reload", access: APIAccesses.Operate},
+	{pattern: "/clients", access: APIAccesses.Provision},
+	{pattern: "/numbers", access: APIAccesses.Provision},
+	{pattern: "/optouts", access: APIAccesses.Provision},
+	{pattern: "/autoreplies", access: APIAccesses.Provision},
+	{pattern: "/rewrites", access: APIAccesses.Provision},
+	{pattern: "/templates", access: APIAccesses.Provision},
+	{pattern: "/content/quarantine", access: APIAccesses.Operate},
+	{pattern: "/content", access: APIAccesses.Provision},
+	{pattern: "/carriers", access: APIAccesses.Provision},
+	{pattern: "/routing", access: APIAccesses.Provision},
+	{pattern: "/events/subscriptions", access: APIAccesses.Provision},
+	{pattern: "/usage/rates", access: APIAccesses.Provision},
+	{pattern: "/messages", access: APIAccesses.Operate},
+	{pattern: "/scheduled", access: APIAccesses.Operate},
+	{pattern: "/deadletters", access: APIAccesses.Operate},
+	{pattern: "/admin/sessions", access: APIAccesses.Operate},
+	{pattern: "/admin/lockouts", access: APIAccesses.Operate},
+	{pattern: "/admin/traces", access: APIAccesses.Operate},
+	{pattern: "/events/deliveries", access: APIAccesses.Operate},
+	{pattern: "/usage/rollup", access: APIAccesses.Operate},
+	{pattern: "/plugins", access: APIAccesses.Operate},
+	{pattern: "/maintenance", access: APIAccesses.Operate},
+}
+
+func (rule accessRule) matches(method string, path string) bool {
+	if rule.method != "" && rule.method != method {
+		return false
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	pattern := strings.Split(strings.Trim(rule.pattern, "/"), "/")
+	if pattern[0] == "" {
+		return true
+	}
+	if len(segments) < len(pattern) {
+		return false
+	}
+	for i, segment := range pattern {
+		if segment != "*" && segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// requiredAccess is the access a request needs.
+func requiredAccess(method string, path string) string {
+	if method == "HEAD" {
+		method = "GET"
+	}
+	for _, rule := range accessRules {
+		if rule.matches(method, path) {
+			return rule.access
+		}
+	}
+	return APIAccesses.Admin
+}
+
+// allows reports whether the role of a key includes an access.
+func (key *APIKey) allows(access string) bool {
+	return StringInArray(access, roleAccesses[key.Role])
+}
+
+// Scoped reports whether the key is limited to a tenant or to some clients.
+func (key *APIKey) Scoped() bool {
+	return key.TenantID != 0 || strings.TrimSpace(key.Clients) != ""
+}
+
+func (key *APIKey) ClientList() []string {
+	var list []string
+	for _, username := range strings.Split(key.Clients, ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			list = append(list, username)
+		}
+	}
+	return list
+}
+
+// masterKey is the caller authenticated with API_KEY, an unscoped admin.
+var masterKey = &APIKey{Name: "API_KEY", Role: APIRoles.Admin}
+
+// apiKeys caches the enabled keys by the hash of their token.
+var apiKeys = struct {
+	mu     sync.RWMutex
+	byHash map[string]*APIKey
+}{byHash: make(map[string]*APIKey)}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadAPIKeys loads the enabled keys.
+func (gateway *Gateway) loadAPIKeys() error {
+	var keys []APIKey
+	if err := gateway.DB.Where("disabled = ?", false).Find(&keys).Error; err != nil {
+		return err
+	}
+	byHash := make(map[string]*APIKey, len(keys))
+	for i := range keys {
+		byHash[keys[i].Hash] = &keys[i]
+	}
+
+	apiKeys.mu.Lock()
+	apiKeys.byHash = byHash
+	apiKeys.mu.Unlock()
+	return nil
+}
+
+// authenticate returns the key of a token, API_KEY authenticates as masterKey.
+func authenticate(token string) (*APIKey, bool) {
+	if master := Getenv("API_KEY"); master != "" && subtle.ConstantTimeCompare([]byte(token), []byte(master)) == 1 {
+		return masterKey, true
+	}
+	apiKeys.mu.RLock()
+	key, ok := apiKeys.byHash[hashAPIToken(token)]
+	apiKeys.mu.RUnlock()
+	if !ok || (key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt)) {
+		return nil, false
+	}
+	return key, true
+}
+
+// requestKey is the key a management request was authenticated with.
+func requestKey(ctx iris.Context) *APIKey {
+	if key, ok := ctx.Values().Get("apiKey").(*APIKey); ok {
+		return key
+	}
+	return masterKey
+}
+
+// KeyAllowsClient reports whether the key of a request may act for a client, nil for a client
+// that doesn't exist.
+func KeyAllowsClient(ctx iris.Context, client *Client) bool {
+	return requestKey(ctx).allowsClient(client)
+}
+
+// allowsClient reports whether the key may act for a client, nil for a client that doesn't exist.
+func (key *APIKey) allowsClient(client *Client) bool {
+	if !key.Scoped() {
+		return true
+	}
+	if client == nil || key.TenantID != 0 && client.TenantID != key.TenantID {
+		return false
+	}
+	clients := key.ClientList()
+	return len(clients) == 0 || StringInArray(client.Username, clients)
+}
+
+// CheckClientScope answers errForbidden when the key of a request may not act for a client.
+func (gateway *Gateway) CheckClientScope(ctx iris.Context, username string) error {
+	return gateway.CheckKeyScope(requestKey(ctx), username)
+}
+
+// CheckKeyScope answers errForbidden when the key may not act for a client.
+func (gateway *Gateway) CheckKeyScope(key *APIKey, username string) error {
+	gateway.Mu.RLock()
+	client := gateway.Clients[username]
+	gateway.Mu.RUnlock()
+	if !key.allowsClient(client) {
+		return fmt.Errorf("%w: the API key is not allowed to act for client %q", ErrForbidden, username)
+	}
+	return nil
+}
+
+// scopeResolver checks that the key of a request may act for what the request is about.
+type scopeResolver func(ctx iris.Context, gateway *Gateway) error
+
+// scopedRoutes are the routes keys limited to a tenant or to some clients may call, by method and
+// route. A nil resolver means the handler checks the clients itself, with checkClientScope or by
+// leaving out the clients the key may not see.
+var scopedRoutes = map[string]scopeResolver{
+	"GET /clients":                                     nil,
+	"GET /clients/{id:uint}":                           clientIDScope,
+	"PUT /clients/{id:uint}":                           clientIDScope,
+	"DELETE /clients/{id:uint}":                        clientIDScope,
+	"PATCH /clients/{id}/password":                     clientIDScope,
+	"GET /clients/{id}/numbers":                        clientIDScope,
+	"POST /clients/{id}/numbers":                       clientIDScope,
+	"GET /numbers/{id:uint}":                           numberIDScope,
+	"PUT /numbers/{id:uint}":                           numberIDScope,
+	"DELETE /numbers/{id:uint}":                        numberIDScope,
+	"POST /numbers/{id:uint}/verify":                   numberIDScope,
+	"POST /numbers/{id:uint}/confirm":                  numberIDScope,
+	"GET /optouts":                                     nil,
+	"POST /optouts":                                    nil,
+	"DELETE /optouts/{id:uint}":                        optOutIDScope,
+	"GET /autoreplies":                                 nil,
+	"POST /autoreplies":                                nil,
+	"PUT /autoreplies/{id:uint}":                       autoReplyIDScope,
+	"DELETE /autoreplies/{id:uint}":                    autoReplyIDScope,
+	"GET /rewrites":                                    nil,
+	"POST /rewrites":                                   nil,
+	"PUT /rewrites/{id:uint}":                          sourceRewriteIDScope,
+	"DELETE /rewrites/{id:uint}":                       sourceRewriteIDScope,
+	"POST /rewrites/test":                              nil,
+	"POST /messages":                                   nil,
+	"POST /messages/bulk":                              nil,
+	"GET /messages":                                    clientParamScope,
+	"GET /messages/conversation":                       numberParamScope,
+	"GET /cdrs":                                        clientParamScope,
+	"GET /usage":                                       clientParamScope,
+	"GET /usage/quota":                                 clientParamScope,
+	"GET /admin/clients/{username:string}/messages":    usernameScope,
+	"POST /admin/sessions/smpp/{username:string}/kick": usernameScope,
+	"GET /events/subscriptions":                        nil,
+	"POST /events/subscriptions":                       nil,
+	"PUT /events/subscriptions/{id:uint}":              subscriptionIDScope,
+	"DELETE /events/subscriptions/{id:uint}":           subscriptionIDScope,
+}
+
+// tenantRoutes are the routes keys limited to a tenant, but not to some of its clients, may call
+// besides scopedRoutes. A nil resolver means the handler leaves out the resources of other tenants
+// and gives the resources it creates to the key's tenant.
+var tenantRoutes = map[string]scopeResolver{
+	"GET /tenants":                               nil,
+	"GET /tenants/{id:uint}":                     tenantIDScope,
+	"POST /clients":                              nil,
+	"GET /numbers":                               nil,
+	"POST /numbers":                              nil,
+	"GET /carriers":                              nil,
+	"POST /carriers":                             nil,
+	"GET /carriers/{id:uint}":                    tenantRowScope(&Carrier{}),
+	"PUT /carriers/{id:uint}":                    tenantRowScope(&Carrier{}),
+	"DELETE /carriers/{id:uint}":                 tenantRowScope(&Carrier{}),
+	"GET /routing/rules":                         nil,
+	"POST /routing/rules":                        nil,
+	"PUT /routing/rules/{id:uint}":               tenantRowScope(&RoutingRule{}),
+	"DELETE /routing/rules/{id:uint}":            tenantRowScope(&RoutingRule{}),
+	"GET /routing/lcr":                           nil,
+	"POST /routing/lcr":                          nil,
+	"GET /routing/lcr/{id:uint}":                 tenantRowScope(&LCRRoute{}),
+	"PUT /routing/lcr/{id:uint}":                 tenantRowScope(&LCRRoute{}),
+	"DELETE /routing/lcr/{id:uint}":              tenantRowScope(&LCRRoute{}),
+	"GET /content/rules":                         nil,
+	"POST /content/rules":                        nil,
+	"PUT /content/rules/{id:uint}":               tenantRowScope(&ContentRule{}),
+	"DELETE /content/rules/{id:uint}":            tenantRowScope(&ContentRule{}),
+	"POST /content/rules/test":                   nil,
+	"GET /templates":                             nil,
+	"POST /templates":                            nil,
+	"GET /templates/{id:uint}":                   tenantRowScope(&MessageTemplate{}),
+	"PUT /templates/{id:uint}":                   tenantRowScope(&MessageTemplate{}),
+	"DELETE /templates/{id:uint}":                tenantRowScope(&MessageTemplate{}),
+	"POST /templates/{id:uint}/preview":          tenantRowScope(&MessageTemplate{}),
+	"GET /content/quarantine":                    nil,
+	"POST /content/quarantine/{id:uint}/release": tenantRowScope(&QuarantinedMessage{}),
+	"POST /content/quarantine/{id:uint}/reject":  tenantRowScope(&QuarantinedMessage{}),
+}
+
+// clientIDScope checks the client the id parameter names, by id or, on the routes that predate
+// the ids, by username.
+func clientIDScope(ctx iris.Context, gateway *Gateway) error {
+	if id, err := ctx.Params().GetUint("id"); err == nil {
+		client, ok := gateway.ClientByID(id)
+		if !ok {
+			return ErrNotFound
+		}
+		return gateway.CheckClientScope(ctx, client.Username)
+	}
+	return gateway.CheckClientScope(ctx, ctx.Params().Get("id"))
+}
+
+func numberIDScope(ctx iris.Context, gateway *Gateway) error {
+	var number ClientNumber
+	if err := gateway.DB.First(&number, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	client, ok := gateway.ClientByID(number.ClientID)
+	if !ok {
+		return ErrNotFound
+	}
+	return gateway.CheckClientScope(ctx, client.Username)
+}
+
+func clientParamScope(ctx iris.Context, gateway *Gateway) error {
+	client := ctx.URLParam("client")
+	if client == "" {
+		return fmt.Errorf("%w: the API key is limited to some clients, client is required", ErrForbidden)
+	}
+	return gateway.CheckClientScope(ctx, client)
+}
+
+func numberParamScope(ctx iris.Context, gateway *Gateway) error {
+	client := gateway.GetClient(ctx.URLParam("number"))
+	if client == nil {
+		return fmt.Errorf("%w: number does not belong to a client", ErrForbidden)
+	}
+	return gateway.CheckClientScope(ctx, client.Username)
+}
+
+func usernameScope(ctx iris.Context, gateway *Gateway) error {
+	return gateway.CheckClientScope(ctx, ctx.Params().Get("username"))
+}
+
+// subscriptionIDScope checks the client of a subscription, or its tenant for a global one.
+func subscriptionIDScope(ctx iris.Context, gateway *Gateway) error {
+	var sub EventSubscription
+	if err := gateway.DB.First(&sub, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if sub.Client == "" {
+		return CheckTenantScope(ctx, sub.TenantID)
+	}
+	return gateway.CheckClientScope(ctx, sub.Client)
+}
+
+// authorize checks the role, the tenant and the clients of the key a request was authenticated
+// with.
+func (gateway *Gateway) authorize(ctx iris.Context, key *APIKey) error {
+	access := requiredAccess(ctx.Method(), ctx.Path())
+	if !key.allows(access) {
+		return fmt.Errorf("%w: the %s role has no %s access", ErrForbidden, key.Role, access)
+	}
+	if !key.Scoped() {
+		return nil
+	}
+
+	route := ctx.GetCurrentRoute()
+	if route == nil {
+		return fmt.Errorf("%w: the API key is limited to a tenant or to some clients", ErrForbidden)
+	}
+	resolver, ok := scopedRoutes[route.Method()+" "+route.Path()]
+	if !ok && len(key.ClientList()) == 0 {
+		resolver, ok = tenantRoutes[route.Method()+" "+route.Path()]
+	}
+	if !ok {
+		return fmt.Errorf("%w: the API key is limited to a tenant or to some clients", ErrForbidden)
+	}
+	if resolver == nil {
+		return nil
+	}
+	return resolver(ctx, gateway)
+}
+
+// validateAPIKey checks the role, the tenant and the clients of a key.
+func (gateway *Gateway) validateAPIKey(key *APIKey) error {
+	if key.Name == "" {
+		return Invalid("name is required")
+	}
+	if _, ok := roleAccesses[key.Role]; !ok {
+		return Invalid("role must be one of read_only, provisioning, operator or admin")
+	}
+	if err := ValidateTenantID(key.TenantID); err != nil {
+		return err
+	}
+	clients := key.ClientList()
+	for _, username := range clients {
+		gateway.Mu.RLock()
+		client, ok := gateway.Clients[username]
+		gateway.Mu.RUnlock()
+		if !ok {
+			return Invalid("client %s does not exist", username)
+		}
+		if key.TenantID != 0 && client.TenantID != key.TenantID {
+			return Invalid("client %s belongs to another tenant", username)
+		}
+	}
+	key.Clients = strings.Join(clients, ",")
+	return nil
+}
+
+// createAPIKey stores a new key and answers with its token, which can't be read again.
+func (gateway *Gateway) createAPIKey(key APIKey) (APIKey, error) {
+	if err := gateway.validateAPIKey(&key); err != nil {
+		return key, err
+	}
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return key, err
+	}
+	token := "gwk_" + hex.EncodeToString(random)
+
+	key.ID = 0
+	key.Version = 0
+	key.Prefix = token[:12]
+	key.Hash = hashAPIToken(token)
+	if err := gateway.DB.Create(&key).Error; err != nil {
+		return key, err
+	}
+	if err := gateway.loadAPIKeys(); err != nil {
+		return key, err
+	}
+	key.Token = token
+	return key, nil
+}
+
+// updateAPIKey replaces the name, role, tenant, clients, expiry and state of a key, the token
+// stays.
+func (gateway *Gateway) updateAPIKey(id uint, key APIKey) (APIKey, error) {
+	if err := gateway.validateAPIKey(&key); err != nil {
+		return key, err
+	}
+	key.ID = id
+	if err := UpdateVersioned(gateway.DB, &key, id, &key.Version, "name", "role", "tenant_id", "clients", "disabled", "expires_at"); err != nil {
+		return key, err
+	}
+	if err := gateway.DB.First(&key, id).Error; err != nil {
+		return key, err
+	}
+	return key, gateway.loadAPIKeys()
+}
+
+// SetupAPIKeyRoutes sets up the management of the API keys.
+func SetupAPIKeyRoutes(app *iris.Application, gateway *Gateway) {
+	keys := app.Party("/apikeys", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// List keys, without their tokens
+		keys.Get("/", func(ctx iris.Context) {
+			var list []APIKey
+			if err := gateway.DB.Order("id asc").Find(&list).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(list)
+		})
+
+		// Create a key, the token is only in this answer
+		keys.Post("/", func(ctx iris.Context) {
+			var key APIKey
+			if err := ctx.ReadJSON(&key); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			key, err := gateway.createAPIKey(key)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(key)
+		})
+
+		// Replace a key, the body carries the version it was read with
+		keys.Put("/{id:uint}", func(ctx iris.Context) {
+			var key APIKey
+			if err := ctx.ReadJSON(&key); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			key, err := gateway.updateAPIKey(ctx.Params().GetUintDefault("id", 0), key)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(key)
+		})
+
+		// Revoke a key
+		keys.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := DeleteVersioned(gateway.DB, &APIKey{}, ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.loadAPIKeys(); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "API key deleted"})
+		})
+	}
+}
+
+// autoReplyIDScope checks the client of an auto-reply.
+func autoReplyIDScope(ctx iris.Context, gateway *Gateway) error {
+	var reply AutoReply
+	if err := gateway.DB.First(&reply, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	client, ok := gateway.ClientByID(reply.ClientID)
+	if !ok {
+		return ErrNotFound
+	}
+	return gateway.CheckClientScope(ctx, client.Username)
+}
+
+// GRPCKey authenticates the API key in the "authorization" metadata of a call, it needs the
+// access of the REST route of the call.
+func GRPCKey(ctx context.Context, method string, path string) (*APIKey, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 || !strings.HasPrefix(values[0], "Bearer ") {
+		return nil, status.Error(codes.Unauthenticated, "authorization metadata missing")
+	}
+	key, ok := authenticate(strings.TrimSpace(values[0][len("Bearer "):]))
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	if access := requiredAccess(method, path); !key.allows(access) {
+		return nil, status.Errorf(codes.PermissionDenied, "the %s role has no %s access", key.Role, access)
+	}
+	return key, nil
+}
+
+// sourceRewriteIDScope checks the client of a source rewrite.
+func sourceRewriteIDScope(ctx iris.Context, gateway *Gateway) error {
+	var rewrite SourceRewrite
+	if err := gateway.DB.First(&rewrite, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	client, ok := gateway.ClientByID(rewrite.ClientID)
+	if !ok {
+		return ErrNotFound
+	}
+	return gateway.CheckClientScope(ctx, client.Username)
+}
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"reflect"
+	"time"
+)
+
+// MessageArchive stores the message records and CDRs of high volumes apart from Postgres, which
+// keeps the provisioning. With ARCHIVE_DUAL_WRITE they are written to both, otherwise only to the
+// archive.
+type MessageArchive interface {
+	SaveRecord(record *MsgRecordDBItem) error
+	// SaveCDRs stores CDRs, a CDR saved again replaces the earlier one of its send.
+	SaveCDRs(records []*CDR) error
+	// PendingCDRs returns the CDRs of a carrier send still waiting for their final status.
+	PendingCDRs(logID string, route string) ([]*CDR, error)
+	Ping() error
+}
+
+var (
+	archiveBackend   string // none
+	archiveDualWrite bool
+	archiveRecordTTL time.Duration // zero keeps them forever
+	archiveCDRTTL    time.Duration
+	archiveTimeout   time.Duration
+)
+
+var archiveWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "archive_writes_total",
+	Help: "Writes of message records and CDRs to the archive by kind and result",
+}, []string{"kind", "result"})
+
+func init() {
+	prometheus.MustRegister(archiveWrites)
+	OnConfigure(func(cfg *Config) {
+		archiveBackend = cfg.String("ARCHIVE_BACKEND", "")
+		archiveDualWrite = cfg.Getenv("ARCHIVE_DUAL_WRITE") != "false"
+		archiveRecordTTL = cfg.Duration("ARCHIVE_RECORD_TTL", messageRecordRetention)
+		archiveCDRTTL = cfg.Duration("ARCHIVE_CDR_TTL", cdrRetention)
+		archiveTimeout = cfg.Duration("ARCHIVE_TIMEOUT", 5*time.Second)
+	})
+}
+
+// NewMessageArchive connects to the backend selected by ARCHIVE_BACKEND, nil when there is none.
+func NewMessageArchive() (MessageArchive, error) {
+	switch archiveBackend {
+	case "":
+		return nil, nil
+	case "mongodb":
+		return newMongoArchive(Getenv("ARCHIVE_MONGODB_URI"), EnvString("ARCHIVE_MONGODB_DATABASE", "gateway"))
+	}
+	return nil, fmt.Errorf("unknown ARCHIVE_BACKEND: %s", archiveBackend)
+}
+
+// usePostgres reports whether the message records and CDRs are written to Postgres.
+func (gateway *Gateway) usePostgres() bool {
+	return gateway.Archive == nil || archiveDualWrite
+}
+
+// archived records the outcome of an archive write, a failed write is logged and the data is kept
+// in Postgres if it was dual-written.
+func (gateway *Gateway) archived(kind string, err error) {
+	if err == nil {
+		archiveWrites.WithLabelValues(kind, MetricSuccess).Inc()
+		return
+	}
+	archiveWrites.WithLabelValues(kind, MetricError).Inc()
+	var lm = gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"System.Archive",
+		"GenericError",
+		logrus.ErrorLevel,
+		map[string]interface{}{
+			"kind": kind,
+		}, err,
+	))
+}
+
+// mongoArchive keeps the records and CDRs in the message_records and cdrs collections, with the
+// keys of the JSON API. TTL indexes expire them after ARCHIVE_RECORD_TTL and ARCHIVE_CDR_TTL.
+type mongoArchive struct {
+	client  *mongo.Client
+	records *mongo.Collection
+	cdrs    *mongo.Collection
+}
+
+func newMongoArchive(uri string, database string) (*mongoArchive, error) {
+	// documents are keyed like the JSON of the models
+	codec, err := bsoncodec.NewStructCodec(bsoncodec.JSONFallbackStructTagParser)
+	if err != nil {
+		return nil, err
+	}
+	registry := bson.NewRegistry()
+	registry.RegisterKindEncoder(reflect.Struct, codec)
+	registry.RegisterKindDecoder(reflect.Struct, codec)
+
+	ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetRegistry(registry).SetTimeout(archiveTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+
+	db := client.Database(database)
+	archive := &mongoArchive{client: client, records: db.Collection("message_records"), cdrs: db.Collection("cdrs")}
+	steps := []struct {
+		collection *mongo.Collection
+		index      mongo.IndexModel
+	}{
+		{archive.records, mongo.IndexModel{Keys: bson.D{{Key: "log_id", Value: 1}}}},
+		{archive.cdrs, mongo.IndexModel{
+			Keys:    bson.D{{Key: "log_id", Value: 1}, {Key: "direction", Value: 1}, {Key: "route", Value: 1}, {Key: "attempt", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		}},
+	}
+	for _, step := range steps {
+		if _, err := step.collection.Indexes().CreateOne(ctx, step.index); err != nil {
+			return nil, fmt.Errorf("failed to create the index of %s: %w", step.collection.Name(), err)
+		}
+	}
+	if err := ensureTTLIndex(ctx, archive.records, "received_timestamp", archiveRecordTTL); err != nil {
+		return nil, err
+	}
+	if err := ensureTTLIndex(ctx, archive.cdrs, "created_at", archiveCDRTTL); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// ensureTTLIndex expires the documents of a collection the ttl after the time of the field, a ttl
+// changed since the index was created is applied to it. A zero ttl drops the index.
+func ensureTTLIndex(ctx context.Context, collection *mongo.Collection, field string, ttl time.Duration) error {
+	const name = "expiry"
+	if ttl <= 0 {
+		if _, err := collection.Indexes().DropOne(ctx, name); err != nil && !isMongoCode(err, 27) { // IndexNotFound
+			return fmt.Errorf("failed to drop the TTL index of %s: %w", collection.Name(), err)
+		}
+		return nil
+	}
+
+	seconds := int32(ttl / time.Second)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetName(name).SetExpireAfterSeconds(seconds),
+	})
+	if isMongoCode(err, 85) { // IndexOptionsConflict, created with another ttl
+		err = collection.Database().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: collection.Name()},
+			{Key: "index", Value: bson.D{{Key: "name", Value: name}, {Key: "expireAfterSeconds", Value: seconds}}},
+		}).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the TTL index of %s: %w", collection.Name(), err)
+	}
+	return nil
+}
+
+func isMongoCode(err error, code int) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(code)
+}
+
+func (archive *mongoArchive) SaveRecord(record *MsgRecordDBItem) error {
+	_, err := archive.records.InsertOne(context.Background(), record)
+	return err
+}
+
+func (archive *mongoArchive) SaveCDRs(records []*CDR) error {
+	if len(records) == 0 {
+		return nil
+	}
+	now := time.Now()
+	writes := make([]mongo.WriteModel, 0, len(records))
+	for _, record := range records {
+		if record.CreatedAt.IsZero() {
+			record.CreatedAt = now
+		}
+		record.UpdatedAt = now
+		writes = append(writes, mongo.NewReplaceOneModel().
+			SetFilter(bson.D{
+				{Key: "log_id", Value: record.LogID},
+				{Key: "direction", Value: record.Direction},
+				{Key: "route", Value: record.Route},
+				{Key: "attempt", Value: record.Attempt},
+			}).
+			SetReplacement(record).
+			SetUpsert(true))
+	}
+	_, err := archive.cdrs.BulkWrite(context.Background(), writes, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (archive *mongoArchive) PendingCDRs(logID string, route string) ([]*CDR, error) {
+	cursor, err := archive.cdrs.Find(context.Background(), bson.D{
+		{Key: "log_id", Value: logID},
+		{Key: "route", Value: route},
+		{Key: "status", Value: DeliveryStatuses.Sent},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var records []*CDR
+	err = cursor.All(context.Background(), &records)
+	return records, err
+}
+
+func (archive *mongoArchive) Ping() error {
+	return archive.client.Ping(context.Background(), nil)
+}
+
+// CheckArchive reports the archive, a failing one degrades the gateway: the messages are still
+// routed, and kept in Postgres with ARCHIVE_DUAL_WRITE.
+func (gateway *Gateway) CheckArchive() HealthCheck {
+	started := time.Now()
+	if err := gateway.Archive.Ping(); err != nil {
+		return HealthCheck{Status: HealthDegraded, Error: err.Error()}
+	}
+	return HealthCheck{Status: HealthOK, Detail: fmt.Sprintf("ping %s", time.Since(started).Round(time.Millisecond))}
+}
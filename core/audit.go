@@ -0,0 +1,202 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditEntry records a change made through the management API: who made it, what it was and
+// how it ended.
+type AuditEntry struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ServerID  string    `json:"server_id"`
+	Actor     string    `gorm:"index" json:"actor"` // name of the API key, API_KEY for the master key
+	KeyID     uint      `json:"key_id,omitempty"`
+	Role      string    `json:"role"`
+	IP        string    `json:"ip"`
+	Method    string    `json:"method"`
+	Path      string    `gorm:"index" json:"path"`
+	Status    int       `json:"status"`
+	Body      string    `json:"body,omitempty"` // the request, secrets redacted
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+var (
+	auditEnabled   bool
+	auditRetention time.Duration // zero keeps the entries forever
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		auditEnabled = cfg.Getenv("AUDIT_LOG") != "false"
+		auditRetention = cfg.Duration("AUDIT_RETENTION", 0)
+	})
+}
+
+// auditBodyLimit is the most of a request body kept on its entry.
+const auditBodyLimit = 4096
+
+var auditEntries = make(chan *AuditEntry, 1000)
+
+// auditBody reads the body of a request for its entry and puts it back for the handler. JSON
+// bodies have their secrets redacted, other bodies aren't kept.
+func auditBody(ctx iris.Context) string {
+	req := ctx.Request()
+	if req.Body == nil || !strings.HasPrefix(ctx.GetContentTypeRequested(), "application/json") {
+		return ""
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil || len(body) == 0 {
+		return ""
+	}
+
+	var value interface{}
+	if json.Unmarshal(body, &value) != nil {
+		return ""
+	}
+	redacted, err := json.Marshal(redactSecrets(value))
+	if err != nil {
+		return ""
+	}
+	if len(redacted) > auditBodyLimit {
+		return string(redacted[:auditBodyLimit]) + "…"
+	}
+	return string(redacted)
+}
+
+// redactSecrets replaces the values of the fields that look like credentials.
+func redactSecrets(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for field, inner := range v {
+			name := strings.ToLower(field)
+			if strings.Contains(name, "password") || strings.Contains(name, "secret") ||
+				strings.Contains(name, "token") || strings.HasSuffix(name, "key") {
+				v[field] = "[redacted]"
+				continue
+			}
+			v[field] = redactSecrets(inner)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactSecrets(v[i])
+		}
+	}
+	return value
+}
+
+// recordAudit queues the entry of a request that changes something, body is read before the
+// request was handled.
+func (gateway *Gateway) recordAudit(ctx iris.Context, key *APIKey, body string) {
+	if !auditEnabled {
+		return
+	}
+	entry := &AuditEntry{
+		ServerID:  gateway.ServerID,
+		Actor:     key.Name,
+		KeyID:     key.ID,
+		Role:      key.Role,
+		IP:        ctx.Values().GetString("client_ip"),
+		Method:    ctx.Method(),
+		Path:      ctx.Request().URL.RequestURI(),
+		Status:    ctx.GetStatusCode(),
+		Body:      body,
+		CreatedAt: time.Now(),
+	}
+	select {
+	case auditEntries <- entry:
+	default:
+		// never hold up the API for the audit log
+	}
+}
+
+// AuditWriter writes the audit entries and reloads the API keys changed through other gateway
+// instances, the RetentionPurger purges entries older than AUDIT_RETENTION.
+func (gateway *Gateway) AuditWriter() {
+	var lm = gateway.LogManager
+	logErr := func(err error) {
+		lm.SendLog(lm.BuildLog(
+			"Server.Web.Audit",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil, err,
+		))
+	}
+
+	reload := time.NewTicker(time.Minute)
+	defer reload.Stop()
+
+	for {
+		select {
+		case entry := <-auditEntries:
+			if err := gateway.DB.Create(entry).Error; err != nil {
+				logErr(err)
+			}
+		case <-reload.C:
+			if err := gateway.loadAPIKeys(); err != nil {
+				logErr(err)
+			}
+		}
+	}
+}
+
+// SetupAuditRoutes sets up the search of the audit log.
+func SetupAuditRoutes(app *iris.Application, gateway *Gateway) {
+	audit := app.Party("/audit", gateway.BasicAuthMiddleware)
+	{
+		// List audit entries, newest first
+		audit.Get("/", func(ctx iris.Context) {
+			query := gateway.DB.Model(&AuditEntry{})
+			for _, param := range []string{"actor", "method"} {
+				if value := ctx.URLParam(param); value != "" {
+					query = query.Where(param+" = ?", value)
+				}
+			}
+			if path := ctx.URLParam("path"); path != "" {
+				query = query.Where("path LIKE ?", strings.NewReplacer("%", "\\%", "_", "\\_").Replace(path)+"%")
+			}
+			for param, op := range map[string]string{"since": ">=", "until": "<"} {
+				value := ctx.URLParam(param)
+				if value == "" {
+					continue
+				}
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					WriteProvisioningError(ctx, Invalid("%s must be an RFC 3339 time", param))
+					return
+				}
+				query = query.Where("created_at "+op+" ?", t)
+			}
+			if cursor := ctx.URLParam("cursor"); cursor != "" {
+				id, err := strconv.ParseUint(cursor, 10, 64)
+				if err != nil {
+					WriteProvisioningError(ctx, Invalid("cursor %q is not valid", cursor))
+					return
+				}
+				query = query.Where("id < ?", id)
+			}
+
+			limit := ctx.URLParamIntDefault("limit", 100)
+			if limit <= 0 || limit > 1000 {
+				limit = 100
+			}
+			entries := []AuditEntry{}
+			if err := query.Order("id desc").Limit(limit).Find(&entries).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			result := iris.Map{"entries": entries}
+			if len(entries) == limit {
+				result["next"] = strconv.FormatUint(uint64(entries[limit-1].ID), 10)
+			}
+			ctx.JSON(result)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AutoReply answers inbound messages to a client number before they are forwarded to the PBX,
+// e.g. with the office hours outside of them or with the text of a keyword. The first enabled
+// reply of the client whose criteria match answers, a sender gets it once per AUTO_REPLY_INTERVAL.
+// The message is forwarded to the client either way.
+type AutoReply struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	ClientID uint   `gorm:"index;not null" json:"client_id"`
+	Number   string `gorm:"index" json:"number"` // client number, empty for every number of the client
+	Position int    `json:"position"`            // replies are evaluated in ascending position
+	Disabled bool   `json:"disabled"`
+
+	Keywords  string `json:"keywords"`   // comma separated, a message consisting of one matches, empty matches any message
+	TimeStart string `json:"time_start"` // "HH:MM", the window may wrap past midnight, e.g. 17:00-09:00 for after hours
+	TimeEnd   string `json:"time_end"`
+	TimeZone  string `json:"time_zone"` // IANA zone of the window, defaults to UTC
+	Days      string `json:"days"`      // comma separated mon to sun the reply is active on, empty for every day
+
+	Reply string `gorm:"not null" json:"reply"` // template, {name} is the client, {number} the client number and {sender} the sender
+
+	Version uint `gorm:"not null;default:1" json:"version"`
+
+	keywords   map[string]bool
+	days       map[time.Weekday]bool
+	location   *time.Location
+	start, end int // minutes since midnight, -1 when there is no window
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Compile validates the reply and prepares its keywords, days and time window.
+func (reply *AutoReply) Compile() error {
+	if strings.TrimSpace(reply.Reply) == "" {
+		return fmt.Errorf("reply is required")
+	}
+	if reply.Keywords != "" {
+		reply.keywords = keywordSet(reply.Keywords)
+	} else {
+		reply.keywords = nil
+	}
+
+	reply.days = nil
+	for _, day := range strings.Split(reply.Days, ",") {
+		if day = strings.ToLower(strings.TrimSpace(day)); day == "" {
+			continue
+		}
+		weekday, ok := weekdays[day]
+		if !ok {
+			return fmt.Errorf("invalid days: %s is not one of mon, tue, wed, thu, fri, sat and sun", day)
+		}
+		if reply.days == nil {
+			reply.days = make(map[time.Weekday]bool)
+		}
+		reply.days[weekday] = true
+	}
+
+	var err error
+	reply.location = time.UTC
+	if reply.TimeZone != "" {
+		if reply.location, err = time.LoadLocation(reply.TimeZone); err != nil {
+			return fmt.Errorf("invalid time_zone: %w", err)
+		}
+	}
+	reply.start, reply.end = -1, -1
+	if reply.TimeStart != "" || reply.TimeEnd != "" {
+		if reply.start, err = parseClock(reply.TimeStart); err != nil {
+			return fmt.Errorf("invalid time_start: %w", err)
+		}
+		if reply.end, err = parseClock(reply.TimeEnd); err != nil {
+			return fmt.Errorf("invalid time_end: %w", err)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the reply answers a message of the sender to the client number at the
+// given time.
+func (reply *AutoReply) Matches(msg *MsgQueueItem, client *Client, now time.Time) bool {
+	if reply.Disabled || reply.ClientID != client.ID {
+		return false
+	}
+	if reply.Number != "" && NumberKey(reply.Number) != NumberKey(msg.To) {
+		return false
+	}
+	if reply.keywords != nil && !reply.keywords[MessageKeyword(msg.Message)] {
+		return false
+	}
+	local := now.In(reply.location)
+	if reply.days != nil && !reply.days[local.Weekday()] {
+		return false
+	}
+	if reply.start >= 0 && !inClockWindow(reply.start, reply.end, local) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,18 @@
+package core
+
+import (
+	"errors"
+)
+
+// ErrQueueFull is returned to ingress handlers when a message can neither be queued in memory
+// nor overflowed to RabbitMQ, SMPP clients get ESME_RMSGQFUL.
+var ErrQueueFull = errors.New("router queue full")
+
+// RouterQueueSize bounds the in-memory queues in front of the client and carrier routers.
+var RouterQueueSize int
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		RouterQueueSize = cfg.Int("ROUTER_QUEUE_SIZE", 1000)
+	})
+}
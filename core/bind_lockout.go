@@ -0,0 +1,223 @@
+package core
+
+import (
+	"encoding/json"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+var (
+	// bindLockoutEnabled locks out system_ids and IPs with too many failed binds unless BIND_LOCKOUT is
+	// false.
+	bindLockoutEnabled bool
+	// bindLockoutDuration is the first lockout of a system_id or IP with too many failed binds,
+	// each lockout in a row doubles it up to bindLockoutMax.
+	bindLockoutDuration time.Duration
+	bindLockoutMax      time.Duration
+	bindLockoutFailures int // of a system_id before it is locked out
+	bindLockoutIPLimit  int // of an IP, clients may share one behind NAT
+	// bindLockoutReset is how long after the last failed bind the failures and lockouts are forgotten.
+	bindLockoutReset time.Duration
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		bindLockoutEnabled = cfg.Getenv("BIND_LOCKOUT") != "false"
+		bindLockoutDuration = cfg.Duration("BIND_LOCKOUT_DURATION", time.Minute)
+		bindLockoutMax = cfg.Duration("BIND_LOCKOUT_MAX", time.Hour)
+		bindLockoutFailures = cfg.Int("BIND_LOCKOUT_FAILURES", 5)
+		bindLockoutIPLimit = cfg.Int("BIND_LOCKOUT_IP_FAILURES", 20)
+		bindLockoutReset = cfg.Duration("BIND_LOCKOUT_RESET", 24*time.Hour)
+	})
+}
+
+// BindLockoutKinds are what failed binds are counted by.
+var BindLockoutKinds = struct {
+	SystemID string
+	IP       string
+}{
+	SystemID: "system_id",
+	IP:       "ip",
+}
+
+// BindLockout counts the failed SMPP binds of a system_id or a source IP. It is kept in the cache,
+// so with the redis backend the instances of a cluster share it.
+type BindLockout struct {
+	Kind        string     `json:"kind"` // see BindLockoutKinds
+	Value       string     `json:"value"`
+	Failures    int        `json:"failures"` // since the last lockout
+	Lockouts    int        `json:"lockouts"` // in a row, each doubles the next one
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// Locked reports whether binds are refused at the time.
+func (lockout BindLockout) Locked(now time.Time) bool {
+	return lockout.LockedUntil != nil && now.Before(*lockout.LockedUntil)
+}
+
+// bindLockout returns the failed binds counted for a system_id or IP, false when there are none
+// or they were forgotten.
+func (gateway *Gateway) bindLockout(kind string, value string) (BindLockout, bool) {
+	lockout := BindLockout{Kind: kind, Value: value}
+	if !bindLockoutEnabled || value == "" {
+		return lockout, false
+	}
+	cached, ok, err := gateway.bindLockouts.Get(bindLockoutCacheKey + kind + ":" + value)
+	if err != nil || !ok || json.Unmarshal([]byte(cached), &lockout) != nil {
+		return BindLockout{Kind: kind, Value: value}, false
+	}
+	if !lockout.Locked(time.Now()) && time.Since(lockout.LastFailure) > bindLockoutReset {
+		return BindLockout{Kind: kind, Value: value}, false
+	}
+	return lockout, true
+}
+
+// BindLocked returns the lockout of the system_id or the IP of a bind, if either is locked out.
+func (gateway *Gateway) BindLocked(systemID string, ip string) (BindLockout, bool) {
+	now := time.Now()
+	for _, key := range [][2]string{{BindLockoutKinds.SystemID, systemID}, {BindLockoutKinds.IP, ip}} {
+		if lockout, ok := gateway.bindLockout(key[0], key[1]); ok && lockout.Locked(now) {
+			return lockout, true
+		}
+	}
+	return BindLockout{}, false
+}
+
+// BindFailed records a bind refused for its credentials as a security event and counts it.
+func (gateway *Gateway) BindFailed(systemID string, ip string) {
+	gateway.EmitEvent(EventTypes.BindFailed, systemID, map[string]interface{}{
+		"system_id": systemID,
+		"ip":        ip,
+	})
+	gateway.recordBindFailure(systemID, ip)
+}
+
+// recordBindFailure counts a failed bind of the system_id and the IP, and locks out the one that
+// reached its limit. Concurrent failures on several instances may be counted as one, which only
+// delays a lockout by a failure.
+func (gateway *Gateway) recordBindFailure(systemID string, ip string) {
+	if !bindLockoutEnabled {
+		return
+	}
+	gateway.countBindFailure(BindLockoutKinds.SystemID, systemID, bindLockoutFailures, systemID, ip)
+	gateway.countBindFailure(BindLockoutKinds.IP, ip, bindLockoutIPLimit, systemID, ip)
+}
+
+func (gateway *Gateway) countBindFailure(kind string, value string, limit int, systemID string, ip string) {
+	if value == "" {
+		return
+	}
+	var lm = gateway.LogManager
+	now := time.Now()
+	lockout, _ := gateway.bindLockout(kind, value)
+	lockout.Failures++
+	lockout.LastFailure = now
+	if lockout.Failures >= limit {
+		lockout.Failures = 0
+		lockout.Lockouts++
+		duration := bindLockoutDuration
+		for i := 1; i < lockout.Lockouts && duration < bindLockoutMax; i++ {
+			duration *= 2
+		}
+		if duration > bindLockoutMax {
+			duration = bindLockoutMax
+		}
+		until := now.Add(duration)
+		lockout.LockedUntil = &until
+
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.Lockout",
+			"BindLockedOut",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"kind":     kind,
+				"value":    value,
+				"lockouts": lockout.Lockouts,
+			}, until.UTC().Format(time.RFC3339),
+		))
+		smppBindLockouts.WithLabelValues(kind).Inc()
+		gateway.EmitEvent(EventTypes.BindLockedOut, systemID, map[string]interface{}{
+			"kind":         kind,
+			"value":        value,
+			"ip":           ip,
+			"lockouts":     lockout.Lockouts,
+			"locked_until": until.UTC(),
+		})
+	}
+
+	encoded, _ := json.Marshal(lockout)
+	if err := gateway.bindLockouts.Set(bindLockoutCacheKey+kind+":"+value, string(encoded)); err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.Lockout",
+			"GenericError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"kind":  kind,
+				"value": value,
+			}, err,
+		))
+	}
+}
+
+// ClearBindFailures forgets the failed binds of a system_id once it bound. Those of its IP are
+// kept, one valid account must not reset the count of an address guessing the others.
+func (gateway *Gateway) ClearBindFailures(systemID string) {
+	if _, ok := gateway.bindLockout(BindLockoutKinds.SystemID, systemID); ok {
+		_ = gateway.bindLockouts.Delete(bindLockoutCacheKey + BindLockoutKinds.SystemID + ":" + systemID)
+	}
+}
+
+// unlockBind lifts the lockout of a system_id or IP and forgets its failed binds.
+func (gateway *Gateway) unlockBind(kind string, value string) error {
+	if kind != BindLockoutKinds.SystemID && kind != BindLockoutKinds.IP {
+		return Invalid("kind must be system_id or ip")
+	}
+	if _, ok := gateway.bindLockout(kind, value); !ok {
+		return ErrNotFound
+	}
+	if err := gateway.bindLockouts.Delete(bindLockoutCacheKey + kind + ":" + value); err != nil {
+		return err
+	}
+	client := ""
+	if kind == BindLockoutKinds.SystemID {
+		client = value
+	}
+	gateway.EmitEvent(EventTypes.BindUnlocked, client, map[string]interface{}{
+		"kind":  kind,
+		"value": value,
+	})
+	return nil
+}
+
+// SetupBindLockoutRoutes sets up the routes of the SMPP bind lockouts.
+func SetupBindLockoutRoutes(app *iris.Application, gateway *Gateway) {
+	lockouts := app.Party("/admin/lockouts", gateway.BasicAuthMiddleware)
+	{
+		// Show the failed binds and the lockout of a system_id or IP
+		lockouts.Get("/{kind:string}/{value:string}", func(ctx iris.Context) {
+			kind := ctx.Params().Get("kind")
+			if kind != BindLockoutKinds.SystemID && kind != BindLockoutKinds.IP {
+				WriteProvisioningError(ctx, Invalid("kind must be system_id or ip"))
+				return
+			}
+			lockout, ok := gateway.bindLockout(kind, ctx.Params().Get("value"))
+			if !ok {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "No failed binds"})
+				return
+			}
+			ctx.JSON(iris.Map{"lockout": lockout, "locked": lockout.Locked(time.Now())})
+		})
+
+		// Lift the lockout of a system_id or IP
+		lockouts.Delete("/{kind:string}/{value:string}", func(ctx iris.Context) {
+			if err := gateway.unlockBind(ctx.Params().Get("kind"), ctx.Params().Get("value")); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Unlocked"})
+		})
+	}
+}
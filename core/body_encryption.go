@@ -0,0 +1,260 @@
+package core
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With BODY_ENCRYPTION the message bodies stored in Postgres and the archive are encrypted with
+// AES-GCM under a data key of the tenant of the message, the data keys are stored wrapped by the
+// key manager of KMS_PROVIDER, e.g. "body1:<data key ID>:<nonce and ciphertext>". Only keys of the
+// roles of BODY_DECRYPT_ROLES get the bodies back from the API.
+const bodyPrefix = "body1:"
+
+var (
+	bodyEncryption   bool
+	bodyDecryptRoles string
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		bodyEncryption = cfg.Getenv("BODY_ENCRYPTION") == "true"
+		bodyDecryptRoles = cfg.String("BODY_DECRYPT_ROLES", APIRoles.Operator+","+APIRoles.Admin)
+	})
+}
+
+// TenantDataKey is a data key the message bodies of a tenant are encrypted with. A tenant uses its
+// oldest key, instances creating one at once each keep theirs for what they encrypted with it.
+type TenantDataKey struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TenantID  uint      `gorm:"index;not null" json:"tenant_id"` // 0 for the clients of the operator
+	Wrapped   string    `gorm:"not null" json:"-"`               // the key manager and the wrapped key
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// bodyKeys caches the data keys in the clear, by tenant and by ID. The keys are loaded and
+// unwrapped outside mu, once for the callers waiting on the same key.
+var bodyKeys = struct {
+	mu       sync.Mutex
+	byTenant map[uint]uint
+	byID     map[uint][]byte
+	loading  map[string]*keyLoad // by "tenant:<tenant ID>" or "id:<data key ID>"
+}{byTenant: make(map[uint]uint), byID: make(map[uint][]byte), loading: make(map[string]*keyLoad)}
+
+// keyLoad is a load of a data key in flight, done is closed once it has the result.
+type keyLoad struct {
+	done chan struct{}
+	id   uint
+	key  []byte
+	err  error
+}
+
+// loadBodyKey runs load for the first caller of a name, the callers of the same name meanwhile
+// wait for its result.
+func loadBodyKey(name string, load func() (uint, []byte, error)) (uint, []byte, error) {
+	bodyKeys.mu.Lock()
+	if call, ok := bodyKeys.loading[name]; ok {
+		bodyKeys.mu.Unlock()
+		<-call.done
+		return call.id, call.key, call.err
+	}
+	call := &keyLoad{done: make(chan struct{})}
+	bodyKeys.loading[name] = call
+	bodyKeys.mu.Unlock()
+
+	call.id, call.key, call.err = load()
+
+	bodyKeys.mu.Lock()
+	delete(bodyKeys.loading, name)
+	bodyKeys.mu.Unlock()
+	close(call.done)
+	return call.id, call.key, call.err
+}
+
+// tenantDataKey returns the data key of a tenant, creating it on first use.
+func (gateway *Gateway) tenantDataKey(tenantID uint) (uint, []byte, error) {
+	bodyKeys.mu.Lock()
+	if id, ok := bodyKeys.byTenant[tenantID]; ok {
+		key := bodyKeys.byID[id]
+		bodyKeys.mu.Unlock()
+		return id, key, nil
+	}
+	bodyKeys.mu.Unlock()
+
+	return loadBodyKey("tenant:"+strconv.FormatUint(uint64(tenantID), 10), func() (uint, []byte, error) {
+		var row TenantDataKey
+		result := gateway.DB.Where("tenant_id = ?", tenantID).Order("id").Limit(1).Find(&row)
+		if result.Error != nil {
+			return 0, nil, result.Error
+		}
+		var key []byte
+		var err error
+		if result.RowsAffected == 0 {
+			var wrapped string
+			if key, wrapped, err = gateway.Keys.newDataKey(); err != nil {
+				return 0, nil, err
+			}
+			row = TenantDataKey{TenantID: tenantID, Wrapped: wrapped}
+			if err := gateway.DB.Create(&row).Error; err != nil {
+				return 0, nil, fmt.Errorf("failed to store data key: %w", err)
+			}
+		} else if key, err = gateway.bodyKey(row.ID); err != nil {
+			return 0, nil, err
+		}
+		bodyKeys.mu.Lock()
+		bodyKeys.byID[row.ID] = key
+		bodyKeys.byTenant[tenantID] = row.ID
+		bodyKeys.mu.Unlock()
+		return row.ID, key, nil
+	})
+}
+
+// bodyKey returns the data key of an ID.
+func (gateway *Gateway) bodyKey(id uint) ([]byte, error) {
+	bodyKeys.mu.Lock()
+	key, ok := bodyKeys.byID[id]
+	bodyKeys.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	_, key, err := loadBodyKey("id:"+strconv.FormatUint(uint64(id), 10), func() (uint, []byte, error) {
+		var row TenantDataKey
+		if err := gateway.DB.First(&row, id).Error; err != nil {
+			return 0, nil, fmt.Errorf("failed to load data key %d: %w", id, err)
+		}
+		name, encoded, ok := strings.Cut(row.Wrapped, ":")
+		if !ok {
+			return 0, nil, fmt.Errorf("malformed data key %d", row.ID)
+		}
+		wrapped, err := base64.RawStdEncoding.DecodeString(encoded)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to decode data key %d: %w", row.ID, err)
+		}
+		key, err := gateway.Keys.dataKey(name, encoded, wrapped)
+		if err != nil {
+			return 0, nil, err
+		}
+		bodyKeys.mu.Lock()
+		bodyKeys.byID[row.ID] = key
+		bodyKeys.mu.Unlock()
+		return row.ID, key, nil
+	})
+	return key, err
+}
+
+// SealBody encrypts a message body for storage under the data key of the tenant, empty bodies and
+// all bodies without BODY_ENCRYPTION are stored as they are.
+func (gateway *Gateway) SealBody(tenantID uint, text string) (string, error) {
+	if !bodyEncryption || text == "" || strings.HasPrefix(text, bodyPrefix) {
+		return text, nil
+	}
+	id, key, err := gateway.tenantDataKey(tenantID)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt message body: %w", err)
+	}
+	sealed, err := sealGCM(key, []byte(text))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt message body: %w", err)
+	}
+	return bodyPrefix + strconv.FormatUint(uint64(id), 10) + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openBody decrypts a stored message body, bodies stored in the clear are returned as they are.
+// It also works with BODY_ENCRYPTION turned off again, for what was stored before.
+func (gateway *Gateway) openBody(stored string) (string, error) {
+	if !strings.HasPrefix(stored, bodyPrefix) {
+		return stored, nil
+	}
+	idPart, encoded, ok := strings.Cut(strings.TrimPrefix(stored, bodyPrefix), ":")
+	id, err := strconv.ParseUint(idPart, 10, 64)
+	if !ok || err != nil {
+		return "", fmt.Errorf("malformed encrypted message body")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode message body: %w", err)
+	}
+	key, err := gateway.bodyKey(uint(id))
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openGCM(key, sealed)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt message body: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// SealPayload encrypts the stored payload of a message, the message duplicates its body and media
+// references in it.
+func (gateway *Gateway) SealPayload(msg *MsgQueueItem, payload []byte) (string, error) {
+	return gateway.SealBody(gateway.messageTenant(msg), string(payload))
+}
+
+// SealDeadLetter encrypts the payload of a dead letter, which may not be a message, under the
+// tenant of its numbers.
+func (gateway *Gateway) SealDeadLetter(deadLetter *DeadLetter) (err error) {
+	deadLetter.Payload, err = gateway.SealPayload(&MsgQueueItem{From: deadLetter.From, To: deadLetter.To}, []byte(deadLetter.Payload))
+	return err
+}
+
+// DecodePayload decrypts and decodes a payload stored by sealPayload.
+func (gateway *Gateway) DecodePayload(stored string) (MsgQueueItem, error) {
+	payload, err := gateway.openBody(stored)
+	if err != nil {
+		return MsgQueueItem{}, err
+	}
+	return DecodeMsgQueueItem([]byte(payload))
+}
+
+// messageTenant is the tenant whose data key encrypts a message, the tenant of its client.
+func (gateway *Gateway) messageTenant(msg *MsgQueueItem) uint {
+	return gateway.clientTenant(gateway.messageClient(msg))
+}
+
+// mayDecryptBodies reports whether the role of a key is in BODY_DECRYPT_ROLES.
+func (key *APIKey) mayDecryptBodies() bool {
+	for _, role := range strings.Split(bodyDecryptRoles, ",") {
+		if strings.TrimSpace(role) == key.Role {
+			return true
+		}
+	}
+	return false
+}
+
+// RevealBody is a stored body as the API answers it: decrypted for keys of the roles of
+// BODY_DECRYPT_ROLES, withheld as empty for the others. Bodies stored in the clear are answered
+// as they are.
+func (gateway *Gateway) RevealBody(ctx iris.Context, stored string) string {
+	if !strings.HasPrefix(stored, bodyPrefix) {
+		return stored
+	}
+	if !requestKey(ctx).mayDecryptBodies() {
+		return ""
+	}
+	text, err := gateway.openBody(stored)
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+// revealEnvelopes reveals the contents of envelopes read for the API.
+func (gateway *Gateway) revealEnvelopes(ctx iris.Context, envelopes []MessageEnvelope) {
+	for i := range envelopes {
+		envelopes[i].Content = gateway.RevealBody(ctx, envelopes[i].Content)
+	}
+}
+
+// RevealRecords reveals the data of message records read for the API.
+func (gateway *Gateway) RevealRecords(ctx iris.Context, records []MsgRecordDBItem) {
+	for i := range records {
+		records[i].MsgData = gateway.RevealBody(ctx, records[i].MsgData)
+	}
+}
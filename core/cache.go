@@ -0,0 +1,371 @@
+package core
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LookupCache caches the lookups of the routers by key for CACHE_TTL, empty values cache a miss
+// of the lookup. The local backend is an LRU cache per instance, the redis backend is shared by the
+// instances so a change is seen by all of them.
+type LookupCache interface {
+	Get(key string) (string, bool, error)
+	Set(key string, value string) error
+	// SetNX sets a key that isn't set yet, false when it is.
+	SetNX(key string, value string) (bool, error)
+	Delete(keys ...string) error
+	// Flush deletes every key with the prefix.
+	Flush(prefix string) error
+}
+
+var (
+	cacheBackend     string
+	CacheSize        int
+	cacheTTL         time.Duration
+	cacheRedisPrefix string
+)
+
+// Key prefixes of the cached lookups.
+const (
+	numberCacheKey = "number:" // a number to the client and number it belongs to
+	optOutCacheKey = "optout:" // a client number and a recipient to whether it opted out
+
+	carrierLookupCacheKey = "lookup:"    // a number to its carrier lookup, see number_lookup.go
+	AutoReplyCacheKey     = "autoreply:" // an auto-reply and a sender it answered, see auto_reply.go
+
+	invalidDestinationCacheKey = "invalid:" // a number to the carrier rejecting it, see invalid_destination.go
+	webhookNonceCacheKey       = "webhook:" // the nonce of a carrier webhook handled, see inbound_webhook.go
+	bindLockoutCacheKey        = "lockout:" // a system_id or IP to its failed SMPP binds, see bind_lockout.go
+)
+
+var cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cache_lookups_total",
+	Help: "Lookups of the cache by lookup and result",
+}, []string{"lookup", "result"})
+
+func init() {
+	prometheus.MustRegister(cacheLookups)
+	OnConfigure(func(cfg *Config) {
+		cacheBackend = cfg.String("CACHE_BACKEND", "local")
+		CacheSize = cfg.Int("CACHE_SIZE", 100000)
+		cacheTTL = cfg.Duration("CACHE_TTL", 5*time.Minute)
+		cacheRedisPrefix = cfg.String("CACHE_REDIS_PREFIX", "gateway:")
+	})
+}
+
+// CacheWithTTL is a cache on the backend of cache whose entries expire after the ttl instead, a
+// redis cache shares its client and prefix.
+func CacheWithTTL(cache LookupCache, ttl time.Duration) LookupCache {
+	if shared, ok := cache.(*redisCache); ok {
+		return &redisCache{client: shared.client, prefix: shared.prefix, ttl: ttl}
+	}
+	return NewLocalCache(CacheSize, ttl)
+}
+
+// NewLookupCache creates the backend selected by CACHE_BACKEND.
+func NewLookupCache() (LookupCache, error) {
+	switch cacheBackend {
+	case "local":
+		return NewLocalCache(CacheSize, cacheTTL), nil
+	case "redis":
+		client, err := newRedisClient(Getenv("CACHE_REDIS_URL"), 8)
+		if err != nil {
+			return nil, err
+		}
+		return &redisCache{client: client, prefix: cacheRedisPrefix, ttl: cacheTTL}, nil
+	}
+	return nil, fmt.Errorf("unknown CACHE_BACKEND: %s", cacheBackend)
+}
+
+type localCacheEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// localCache is an LRU cache of up to size entries that expire after the ttl.
+type localCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+func NewLocalCache(size int, ttl time.Duration) *localCache {
+	return &localCache{size: size, ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (cache *localCache) Get(key string) (string, bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return "", false, nil
+	}
+	entry := element.Value.(*localCacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return "", false, nil
+	}
+	cache.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+func (cache *localCache) Set(key string, value string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.set(key, value)
+	return nil
+}
+
+func (cache *localCache) SetNX(key string, value string) (bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, ok := cache.entries[key]; ok && !time.Now().After(element.Value.(*localCacheEntry).expires) {
+		return false, nil
+	}
+	cache.set(key, value)
+	return true, nil
+}
+
+// set sets a key with the cache locked.
+func (cache *localCache) set(key string, value string) {
+	expires := time.Now().Add(cache.ttl)
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*localCacheEntry)
+		entry.value, entry.expires = value, expires
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&localCacheEntry{key: key, value: value, expires: expires})
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*localCacheEntry).key)
+	}
+}
+
+func (cache *localCache) Delete(keys ...string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, key := range keys {
+		if element, ok := cache.entries[key]; ok {
+			cache.order.Remove(element)
+			delete(cache.entries, key)
+		}
+	}
+	return nil
+}
+
+func (cache *localCache) Flush(prefix string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for key, element := range cache.entries {
+		if strings.HasPrefix(key, prefix) {
+			cache.order.Remove(element)
+			delete(cache.entries, key)
+		}
+	}
+	return nil
+}
+
+// redisCache keeps the cache in Redis under the prefix, the entries expire by Redis.
+type redisCache struct {
+	client *redisClient
+	prefix string
+	ttl    time.Duration
+}
+
+func (cache *redisCache) Get(key string) (string, bool, error) {
+	reply, err := cache.client.do("GET", cache.prefix+key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	return value, ok, nil
+}
+
+func (cache *redisCache) Set(key string, value string) error {
+	_, err := cache.client.do("SET", cache.prefix+key, value, "PX", fmt.Sprint(cache.ttl.Milliseconds()))
+	return err
+}
+
+func (cache *redisCache) SetNX(key string, value string) (bool, error) {
+	reply, err := cache.client.do("SET", cache.prefix+key, value, "NX", "PX", fmt.Sprint(cache.ttl.Milliseconds()))
+	return err == nil && reply != nil, err
+}
+
+func (cache *redisCache) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := []string{"DEL"}
+	for _, key := range keys {
+		args = append(args, cache.prefix+key)
+	}
+	_, err := cache.client.do(args...)
+	return err
+}
+
+func (cache *redisCache) Flush(prefix string) error {
+	cursor := "0"
+	for {
+		reply, err := cache.client.do("SCAN", cursor, "MATCH", cache.prefix+prefix+"*", "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		cursor, _ = page[0].(string)
+		keys, _ := page[1].([]interface{})
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, key := range keys {
+				if name, ok := key.(string); ok {
+					args = append(args, name)
+				}
+			}
+			if _, err := cache.client.do(args...); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// provisioningChannel is the Redis channel instances announce provisioning changes on.
+func provisioningChannel() string {
+	return cacheRedisPrefix + "provisioning"
+}
+
+// cached returns the cached value of a lookup, or loads and caches it. A failing cache only costs
+// the lookup itself.
+func (gateway *Gateway) cached(lookup string, key string, load func() (string, error)) (string, error) {
+	if value, ok, err := gateway.Cache.Get(key); err == nil && ok {
+		cacheLookups.WithLabelValues(lookup, "hit").Inc()
+		return value, nil
+	} else if err != nil {
+		cacheLookups.WithLabelValues(lookup, MetricError).Inc()
+	} else {
+		cacheLookups.WithLabelValues(lookup, "miss").Inc()
+	}
+
+	value, err := load()
+	if err != nil {
+		return "", err
+	}
+	_ = gateway.Cache.Set(key, value)
+	return value, nil
+}
+
+// LookupNumber returns the client a number belongs to and the client number it matched, through
+// the cache in front of the NumberIndex. The carrier of the number comes with it.
+func (gateway *Gateway) LookupNumber(number string) (*Client, *ClientNumber, bool) {
+	key := NumberKey(number)
+	if key == "" {
+		return nil, nil, false
+	}
+	value, _ := gateway.cached("number", numberCacheKey+key, func() (string, error) {
+		client, matched, ok := gateway.NumberIndex.Lookup(key)
+		if !ok {
+			return "", nil
+		}
+		return client.Username + "\t" + NumberKey(matched.Number), nil
+	})
+	if value == "" {
+		return nil, nil, false
+	}
+
+	username, matched, _ := strings.Cut(value, "\t")
+	gateway.Mu.RLock()
+	client, ok := gateway.Clients[username]
+	gateway.Mu.RUnlock()
+	if ok {
+		for i := range client.Numbers {
+			if NumberKey(client.Numbers[i].Number) == matched {
+				return client, &client.Numbers[i], true
+			}
+		}
+	}
+	// cached by an instance that knows the client better, or stale
+	return gateway.NumberIndex.Lookup(key)
+}
+
+// flushNumberCache drops the cached number lookups, after the clients and numbers were reloaded.
+func (gateway *Gateway) flushNumberCache() {
+	if err := gateway.Cache.Flush(numberCacheKey); err != nil {
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"System.Cache",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil, err,
+		))
+	}
+}
+
+// cacheInstance tells the announcements of this instance from those of the others, SERVER_ID may
+// be unset or shared.
+var cacheInstance = primitive.NewObjectID().Hex()
+
+// announceProvisioning tells the other instances sharing the redis cache to reload the clients and
+// numbers, the local backend has nobody to tell.
+func (gateway *Gateway) announceProvisioning() {
+	cache, ok := gateway.Cache.(*redisCache)
+	if !ok {
+		return
+	}
+	if _, err := cache.client.do("PUBLISH", provisioningChannel(), cacheInstance); err != nil {
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"System.Cache",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil, err,
+		))
+	}
+}
+
+// ProvisioningListener reloads the clients and numbers whenever another instance announces a
+// change through Redis.
+func (gateway *Gateway) ProvisioningListener() {
+	var lm = gateway.LogManager
+	cache, ok := gateway.Cache.(*redisCache)
+	if !ok {
+		return
+	}
+
+	cache.client.subscribe(provisioningChannel(), func(instance string) {
+		if instance == cacheInstance {
+			return
+		}
+		if err := gateway.reloadClientsAndNumbers(); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.Cache",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+	}, func(err error) {
+		lm.SendLog(lm.BuildLog(
+			"System.Cache",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil, err,
+		))
+	})
+}
@@ -0,0 +1,263 @@
+// carrier.go
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Carrier represents a messaging carrier in the database.
+type Carrier struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	Name     string `gorm:"unique;not null" json:"name"` // e.g., "twilio", "telnyx"
+	Type     string `gorm:"not null" json:"type"`        // e.g., "twilio", "telnyx", "bandwidth", "vonage", "sinch", "plivo", "webhook", "plugin", "smpp", "simulator"
+	Username string `gorm:"not null" json:"username"`    // e.g., Account SID for Twilio (encrypted)
+	Password string `gorm:"not null" json:"password"`    // e.g., Auth Token for Twilio (encrypted)
+	UUID     string `gorm:"unique;not null" json:"uuid"`
+	TenantID uint   `gorm:"index" json:"tenant_id"` // 0 for a carrier shared by every tenant
+	// Config is a JSON object of carrier-specific settings that aren't secret, e.g.
+	// {"messaging_profile_id": "..."} for Telnyx.
+	Config  string `gorm:"type:text" json:"config,omitempty"`
+	Version uint   `gorm:"not null;default:1" json:"version"`
+}
+
+// Setting returns a carrier-specific setting from Config, or the environment variable env when the
+// carrier doesn't set it.
+func (carrier *Carrier) Setting(key string, env string) string {
+	if carrier.Config != "" {
+		var config map[string]interface{}
+		if err := json.Unmarshal([]byte(carrier.Config), &config); err == nil && config[key] != nil {
+			// numbers and booleans are accepted as well, e.g. {"rate": 10}
+			if value := fmt.Sprint(config[key]); value != "" {
+				return value
+			}
+		}
+	}
+	if env == "" {
+		return ""
+	}
+	return Getenv(env)
+}
+
+// CarrierHandler interface for different carrier handlers
+type CarrierHandler interface {
+	Inbound(c iris.Context) error
+	// SendSMS and SendMMS give up on the send when ctx is done.
+	SendSMS(ctx context.Context, sms *MsgQueueItem) error
+	SendMMS(ctx context.Context, sms *MsgQueueItem) error
+	Name() string
+	/*UUID()
+	Password()
+	Username()*/
+}
+
+// LoadCarriers loads carriers from the storage and initializes their handlers.
+func (gateway *Gateway) LoadCarriers() error {
+	// Fetch all carriers from the storage
+	carriers, err := gateway.Storage.Carriers()
+	if err != nil {
+		return err
+	}
+
+	carriersMap := make(map[string]CarrierHandler)
+	carriersMapUUIDs := make(map[string]Carrier)
+
+	// Initialize carrier handlers based on their type
+	for _, carrier := range carriers {
+		// Decrypt sensitive fields
+		decryptedUsername, err := gateway.storedSecret(carrier.Username)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt username for carrier %s: %w", carrier.Name, err)
+		}
+		decryptedPassword, err := gateway.storedSecret(carrier.Password)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt password for carrier %s: %w", carrier.Name, err)
+		}
+		// either may be a reference to a secret in Vault or AWS Secrets Manager
+		if decryptedUsername, err = settings.resolveSecret(decryptedUsername); err != nil {
+			return fmt.Errorf("failed to resolve username for carrier %s: %w", carrier.Name, err)
+		}
+		if decryptedPassword, err = settings.resolveSecret(decryptedPassword); err != nil {
+			return fmt.Errorf("failed to resolve password for carrier %s: %w", carrier.Name, err)
+		}
+
+		handler, err := gateway.newCarrierHandler(&carrier, decryptedUsername, decryptedPassword)
+		if err != nil {
+			return err
+		}
+		carriersMap[carrier.Name] = handler
+		gateway.Limits.configure(&carrier)
+		carriersMapUUIDs[carrier.UUID] = carrier
+	}
+
+	// Update the Gateway's Carriers map
+	gateway.Mu.Lock()
+	previous := gateway.Carriers
+	gateway.Carriers = carriersMap
+	gateway.CarrierUUIDs = carriersMapUUIDs
+	gateway.Mu.Unlock()
+
+	// handlers holding connections, e.g. SMPP binds, are replaced by the reloaded ones
+	for _, handler := range previous {
+		if closer, ok := handler.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+
+	gateway.Router.SyncCarrierRoutes()
+	return nil
+}
+
+// CarrierFactory creates the handler of a carrier from its decrypted credentials.
+type CarrierFactory func(gateway *Gateway, carrier *Carrier, username string, password string) (CarrierHandler, error)
+
+// carrierFactories are the carrier types the gateway can load, by lower case name.
+var carrierFactories = struct {
+	sync.RWMutex
+	types map[string]CarrierFactory
+}{types: make(map[string]CarrierFactory)}
+
+// RegisterCarrierType makes carriers of a type loadable, the carriers package registers the
+// built-in types. A type registered again replaces the previous factory.
+func RegisterCarrierType(carrierType string, factory CarrierFactory) {
+	carrierFactories.Lock()
+	defer carrierFactories.Unlock()
+	carrierFactories.types[strings.ToLower(carrierType)] = factory
+}
+
+// carrierFactory returns the factory of a carrier type, nil for unknown types.
+func carrierFactory(carrierType string) CarrierFactory {
+	carrierFactories.RLock()
+	defer carrierFactories.RUnlock()
+	return carrierFactories.types[strings.ToLower(carrierType)]
+}
+
+// KnownCarrierType reports whether carriers of the type can be loaded.
+func KnownCarrierType(carrierType string) bool {
+	return carrierFactory(carrierType) != nil
+}
+
+// newCarrierHandler initializes the handler for the type of the carrier.
+func (gateway *Gateway) newCarrierHandler(carrier *Carrier, decryptedUsername string, decryptedPassword string) (CarrierHandler, error) {
+	factory := carrierFactory(carrier.Type)
+	if factory == nil {
+		return nil, fmt.Errorf("unknown carrier type: %s", carrier.Type)
+	}
+	return factory(gateway, carrier, decryptedUsername, decryptedPassword)
+}
+
+// AddCarrier adds a new carrier to the database and initializes its handler.
+func (gateway *Gateway) AddCarrier(carrier *Carrier) error {
+	// Encrypt sensitive fields
+	encryptedUsername, err := gateway.encryptSecret(carrier.Username)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt username: %w", err)
+	}
+	encryptedPassword, err := gateway.encryptSecret(carrier.Password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt password: %w", err)
+	}
+
+	carrier.Username = encryptedUsername
+	carrier.Password = encryptedPassword
+
+	carrier.UUID = primitive.NewObjectID().Hex()
+
+	// Create the carrier in the database
+	if err := gateway.DB.Create(carrier).Error; err != nil {
+		return err
+	}
+
+	// Decrypt fields for handler initialization
+	decryptedUsername, err := gateway.decryptSecret(carrier.Username)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt username after encryption: %w", err)
+	}
+	decryptedPassword, err := gateway.decryptSecret(carrier.Password)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt password after encryption: %w", err)
+	}
+
+	// Initialize the carrier handler based on its type
+	handler, err := gateway.newCarrierHandler(carrier, decryptedUsername, decryptedPassword)
+	if err != nil {
+		return err
+	}
+
+	gateway.Limits.configure(carrier)
+
+	// Add the handler to the in-memory map
+	gateway.Mu.Lock()
+	gateway.Carriers[carrier.Name] = handler
+	gateway.CarrierUUIDs[carrier.UUID] = *carrier
+	gateway.Mu.Unlock()
+
+	gateway.Router.SyncCarrierRoutes()
+	return nil
+}
+
+// FindCarrierByUUID searches for an item with the given UUID in a slice of items
+func (gateway *Gateway) FindCarrierByUUID(uuid string) (*Carrier, bool) {
+	for _, item := range gateway.CarrierUUIDs {
+		if item.UUID == uuid {
+			return &item, true
+		}
+	}
+	return nil, false
+}
+
+// CarrierType returns the type of the named carrier, empty when it isn't loaded.
+func (gateway *Gateway) CarrierType(name string) string {
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+	for _, carrier := range gateway.CarrierUUIDs {
+		if carrier.Name == name {
+			return strings.ToLower(carrier.Type)
+		}
+	}
+	return ""
+}
+
+// CarrierSetting returns a setting of the named carrier, see Carrier.Setting, or the environment
+// variable env when the carrier isn't loaded.
+func (gateway *Gateway) CarrierSetting(name string, key string, env string) string {
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+	for _, carrier := range gateway.CarrierUUIDs {
+		if carrier.Name == name {
+			return carrier.Setting(key, env)
+		}
+	}
+	return Getenv(env)
+}
+
+// ReloadCarriers reloads carriers from the database and reinitializes their handlers.
+func (gateway *Gateway) ReloadCarriers() error {
+	if err := gateway.LoadCarriers(); err != nil {
+		return err
+	}
+	gateway.Reloaded()
+	return nil
+}
+
+// ProbeHTTP sends a health check request, anything but a 2xx response is a failure.
+func ProbeHTTP(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ClassifyError(HTTPErrorClass(resp.StatusCode), strconv.Itoa(resp.StatusCode), fmt.Errorf("health check returned %d", resp.StatusCode))
+	}
+	return nil
+}
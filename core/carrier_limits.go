@@ -0,0 +1,257 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/time/rate"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// carrierRateMaxWait bounds how long a send waits for its carrier's rate limit or a free
+	// concurrency slot before failing over to the next route.
+	carrierRateMaxWait time.Duration
+	// carrierRateShared counts sends in Postgres so every gateway instance shares the same
+	// rate limits, otherwise each instance limits on its own.
+	carrierRateShared bool
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		carrierRateMaxWait = cfg.Duration("CARRIER_RATE_MAX_WAIT", 30*time.Second)
+		carrierRateShared = cfg.Getenv("CARRIER_RATE_SHARED") == "true"
+	})
+}
+
+// ErrCarrierThrottled is returned by sendCarrier when the carrier's limits didn't allow the
+// send within CARRIER_RATE_MAX_WAIT.
+var ErrCarrierThrottled = errors.New("carrier rate limit exceeded")
+
+// carrierLimit is the outbound limit of a carrier: rate is messages per second for the carrier,
+// numberRate per sending number and concurrency the sends in flight on this instance. Zero is
+// unlimited.
+type carrierLimit struct {
+	rate        float64
+	numberRate  float64
+	concurrency int
+}
+
+// carrierLimitFromConfig reads the "rate", "number_rate" and "concurrency" settings of the
+// carrier, falling back to CARRIER_RATE, CARRIER_NUMBER_RATE and CARRIER_CONCURRENCY.
+func carrierLimitFromConfig(carrier *Carrier) carrierLimit {
+	limit := carrierLimit{
+		rate:       parseRate(carrier.Setting("rate", "CARRIER_RATE")),
+		numberRate: parseRate(carrier.Setting("number_rate", "CARRIER_NUMBER_RATE")),
+	}
+	if v, err := strconv.Atoi(carrier.Setting("concurrency", "CARRIER_CONCURRENCY")); err == nil && v > 0 {
+		limit.concurrency = v
+	}
+	return limit
+}
+
+func parseRate(value string) float64 {
+	if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 {
+		return v
+	}
+	return 0
+}
+
+// carrierLimiter enforces the limit of one carrier.
+type carrierLimiter struct {
+	limit   carrierLimit
+	carrier *rate.Limiter
+	slots   chan struct{} // nil without a concurrency cap
+
+	mu      sync.Mutex
+	numbers map[string]*numberLimiter
+}
+
+type numberLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+func newCarrierLimiter(limit carrierLimit) *carrierLimiter {
+	l := &carrierLimiter{
+		limit:   limit,
+		carrier: newTokenBucket(limit.rate),
+		numbers: make(map[string]*numberLimiter),
+	}
+	if limit.concurrency > 0 {
+		l.slots = make(chan struct{}, limit.concurrency)
+	}
+	return l
+}
+
+// newTokenBucket allows rate sends per second with a burst of one second's worth.
+func newTokenBucket(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 1)
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), max(1, int(perSecond)))
+}
+
+func (l *carrierLimiter) number(from string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, ok := l.numbers[from]
+	if !ok {
+		n = &numberLimiter{limiter: newTokenBucket(l.limit.numberRate)}
+		l.numbers[from] = n
+	}
+	n.lastUsed = time.Now()
+	return n.limiter
+}
+
+// prune forgets sending numbers idle for longer than idle.
+func (l *carrierLimiter) prune(idle time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for from, n := range l.numbers {
+		if time.Since(n.lastUsed) > idle {
+			delete(l.numbers, from)
+		}
+	}
+}
+
+// CarrierLimits holds the outbound rate limits and concurrency caps of the carriers.
+type CarrierLimits struct {
+	gateway  *Gateway
+	mu       sync.RWMutex
+	carriers map[string]*carrierLimiter
+}
+
+func newCarrierLimits(gateway *Gateway) *CarrierLimits {
+	return &CarrierLimits{gateway: gateway, carriers: make(map[string]*carrierLimiter)}
+}
+
+// configure (re)loads the limits of a carrier, keeping the limiter when they didn't change so
+// reloading carriers doesn't reset the buckets.
+func (limits *CarrierLimits) configure(carrier *Carrier) {
+	limit := carrierLimitFromConfig(carrier)
+
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	if current, ok := limits.carriers[carrier.Name]; ok && current.limit == limit {
+		return
+	}
+	limits.carriers[carrier.Name] = newCarrierLimiter(limit)
+}
+
+// Acquire waits until the carrier may send a message from the number, up to
+// CARRIER_RATE_MAX_WAIT. The returned release frees the concurrency slot once the send is done.
+func (limits *CarrierLimits) Acquire(carrier string, from string) (func(), error) {
+	limits.mu.RLock()
+	l, ok := limits.carriers[carrier]
+	limits.mu.RUnlock()
+	if !ok {
+		return func() {}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), carrierRateMaxWait)
+	defer cancel()
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %d sends in flight", ErrCarrierThrottled, l.limit.concurrency)
+		}
+	}
+	release := func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+
+	var err error
+	if carrierRateShared {
+		err = limits.waitShared(ctx, "carrier:"+carrier, l.limit.rate)
+		if err == nil {
+			err = limits.waitShared(ctx, "number:"+carrier+":"+from, l.limit.numberRate)
+		}
+	} else {
+		err = l.carrier.Wait(ctx)
+		if err == nil {
+			err = l.number(from).Wait(ctx)
+		}
+	}
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("%w: %v", ErrCarrierThrottled, err)
+	}
+	return release, nil
+}
+
+// CarrierRateWindow counts the sends of a limiter key in a window across gateway instances.
+type CarrierRateWindow struct {
+	Key    string `gorm:"primaryKey"`
+	Window int64  `gorm:"primaryKey;autoIncrement:false"` // unix time of the window start
+	Count  int    `gorm:"not null"`
+}
+
+// rateWindow returns the window length and the sends allowed in it for a rate, a window is at
+// least a second and long enough for one send.
+func rateWindow(perSecond float64) (time.Duration, int) {
+	seconds := 1.0
+	if perSecond < 1 {
+		seconds = math.Ceil(1 / perSecond)
+	}
+	return time.Duration(seconds) * time.Second, int(perSecond * seconds)
+}
+
+// waitShared takes a send from the fixed window counter of the key in Postgres, waiting for the
+// next window while the current one is used up.
+func (limits *CarrierLimits) waitShared(ctx context.Context, key string, perSecond float64) error {
+	if perSecond <= 0 {
+		return nil
+	}
+	window, allowed := rateWindow(perSecond)
+
+	for {
+		now := time.Now()
+		start := now.Truncate(window)
+
+		var count int
+		err := limits.gateway.DB.Raw(
+			`INSERT INTO carrier_rate_windows (key, "window", count) VALUES (?, ?, 1)
+			ON CONFLICT (key, "window") DO UPDATE SET count = carrier_rate_windows.count + 1
+			RETURNING count`,
+			key, start.Unix(),
+		).Scan(&count).Error
+		if err != nil {
+			return err
+		}
+		if count <= allowed {
+			return nil
+		}
+
+		select {
+		case <-time.After(start.Add(window).Sub(now)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// PurgeRateLimits forgets idle sending numbers and removes expired shared windows.
+func (gateway *Gateway) PurgeRateLimits() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		gateway.Limits.mu.RLock()
+		for _, l := range gateway.Limits.carriers {
+			l.prune(10 * time.Minute)
+		}
+		gateway.Limits.mu.RUnlock()
+
+		if carrierRateShared {
+			gateway.DB.Where(`"window" < ?`, time.Now().Add(-time.Hour).Unix()).Delete(&CarrierRateWindow{})
+		}
+	}
+}
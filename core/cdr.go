@@ -0,0 +1,510 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CDR is the detail record of one delivery attempt of a message, to a carrier route or to a
+// client. Carrier attempts are completed with the final status of the carrier's status callback.
+type CDR struct {
+	ID               uint       `gorm:"primaryKey" json:"id"`
+	LogID            string     `gorm:"index" json:"log_id"`
+	TraceID          string     `json:"trace_id"`
+	ServerID         string     `json:"server_id"`
+	Direction        string     `json:"direction"`
+	Client           string     `gorm:"index" json:"client"` // client billed: the sender, or the recipient of inbound messages
+	Type             string     `json:"type"`
+	From             string     `json:"from_number"`
+	To               string     `json:"to_number"`
+	Country          string     `json:"destination_country,omitempty"` // of outbound messages, see countryOf
+	Segments         int        `json:"segments"`
+	MediaCount       int        `json:"media_count"`
+	MediaSize        int        `json:"media_size"` // bytes
+	Route            string     `json:"route"`      // carrier route, or smpp: or mm4: and the client delivered to
+	Carrier          string     `json:"carrier,omitempty"`
+	CarrierMessageID string     `json:"carrier_message_id,omitempty"`
+	Attempt          int        `json:"attempt"`
+	Status           string     `json:"status"`
+	ErrorCode        string     `json:"error_code,omitempty"`
+	ErrorClass       string     `json:"error_class,omitempty"`
+	Error            string     `json:"error,omitempty"`
+	ReceivedAt       time.Time  `json:"received_at"` // ingress of the message
+	AttemptedAt      time.Time  `gorm:"index" json:"attempted_at"`
+	DurationMs       int64      `json:"duration_ms"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"` // final status, nil while a carrier's callback is pending
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// CDR directions.
+var CDRDirections = struct {
+	Outbound string // client to carrier
+	Inbound  string // carrier to client
+	Internal string // client to client
+}{
+	Outbound: "outbound",
+	Inbound:  "inbound",
+	Internal: "internal",
+}
+
+var (
+	cdrEnabled   bool
+	cdrRetention time.Duration // zero keeps CDRs forever
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		cdrEnabled = cfg.Getenv("CDR") != "false"
+		cdrRetention = cfg.Duration("CDR_RETENTION", 0)
+	})
+}
+
+// cdrEvent is a new CDR, or the final status of the CDRs of a carrier send.
+type cdrEvent struct {
+	record *CDR
+	status *cdrStatus
+}
+
+type cdrStatus struct {
+	carrier          string
+	carrierMessageID string
+	logID            string
+	status           string
+	errorCode        string
+	errorClass       ErrorClass
+}
+
+var cdrEvents = make(chan cdrEvent, 1000)
+
+// RecordCDR records an attempt to deliver the message on route, a carrier route or the client it
+// was delivered to.
+func (gateway *Gateway) RecordCDR(msg *MsgQueueItem, route string, toCarrier bool, started time.Time, err error) {
+	record := &CDR{
+		LogID:            msg.LogID,
+		TraceID:          msg.TraceID,
+		ServerID:         gateway.ServerID,
+		Type:             string(msg.Type),
+		From:             msg.From,
+		To:               msg.To,
+		Route:            route,
+		CarrierMessageID: msg.CarrierMessageID,
+		Attempt:          msg.Attempts + 1,
+		ReceivedAt:       msg.ReceivedTimestamp,
+		AttemptedAt:      started,
+		DurationMs:       time.Since(started).Milliseconds(),
+	}
+	record.Segments, record.MediaCount, record.MediaSize = messageUsage(msg)
+
+	record.Client = gateway.messageClient(msg)
+	switch {
+	case toCarrier:
+		record.Direction = CDRDirections.Outbound
+		record.Carrier = gateway.CarrierType(route)
+		record.Country = CountryOf(msg.To)
+	case gateway.GetClient(msg.From) != nil:
+		record.Direction = CDRDirections.Internal
+	default:
+		record.Direction = CDRDirections.Inbound
+	}
+
+	now := time.Now()
+	switch {
+	case err != nil:
+		class := ErrorClassOf(err)
+		record.Status = DeliveryStatuses.Failed
+		if class != ErrorClasses.Unknown {
+			record.Status = class.DeliveryStatus()
+		}
+		record.ErrorClass = string(class)
+		record.ErrorCode = errorCodeOf(err)
+		record.Error = err.Error()
+		record.CompletedAt = &now
+	case toCarrier:
+		// completed by the carrier's status callback, if it sends any
+		record.Status = DeliveryStatuses.Sent
+	default:
+		record.Status = DeliveryStatuses.Delivered
+		record.CompletedAt = &now
+	}
+
+	// the envelope of the message follows its attempts, with or without CDRs
+	gateway.recordEnvelope(msg, record)
+	if !cdrEnabled {
+		return
+	}
+
+	select {
+	case cdrEvents <- cdrEvent{record: record}:
+	default:
+		// never hold up delivery for the CDRs
+	}
+}
+
+// CompleteCDRs records the final status a carrier reported for a message on the CDRs of its send.
+func (gateway *Gateway) CompleteCDRs(record CarrierMessage, status string, errorCode string, class ErrorClass) {
+	if !cdrEnabled || !FinalDeliveryStatus(status) {
+		return
+	}
+	cdrEvents <- cdrEvent{status: &cdrStatus{
+		carrier:          record.Carrier,
+		carrierMessageID: record.CarrierMessageID,
+		logID:            record.LogID,
+		status:           status,
+		errorCode:        errorCode,
+		errorClass:       class,
+	}}
+}
+
+// messageUsage is what the message is billed by: its SMS segments, and the number and size of its
+// media.
+func messageUsage(msg *MsgQueueItem) (segments int, mediaCount int, mediaSize int) {
+	if msg.Type != MsgQueueItemType.MMS {
+		parts, _ := SMPPSegments(msg.Message)
+		return len(parts), 0, 0
+	}
+	for _, file := range msg.Files {
+		switch {
+		case len(file.Content) > 0:
+			mediaSize += len(file.Content)
+		case file.Size > 0:
+			mediaSize += file.Size
+		case file.Base64Data != "":
+			mediaSize += base64.StdEncoding.DecodedLen(len(file.Base64Data))
+		}
+	}
+	return 1, len(msg.Files), mediaSize
+}
+
+// CDRWriter writes CDRs to Postgres in batches and streams them to the CDR sinks, the
+// RetentionPurger purges records older than CDR_RETENTION.
+func (gateway *Gateway) CDRWriter() {
+	var lm = gateway.LogManager
+	sinks := cdrSinks()
+
+	flushTicker := time.NewTicker(time.Second)
+	defer flushTicker.Stop()
+
+	batch := make([]*CDR, 0, 100)
+	stream := func(records []*CDR) {
+		for _, sink := range sinks {
+			if err := sink.write(records); err != nil {
+				lm.SendLog(lm.BuildLog(
+					"System.CDR",
+					"GenericError",
+					logrus.WarnLevel,
+					map[string]interface{}{
+						"sink":    sink.name(),
+						"records": len(records),
+					}, err,
+				))
+			}
+		}
+	}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if gateway.usePostgres() {
+			if err := gateway.DB.CreateInBatches(batch, 100).Error; err != nil {
+				lm.SendLog(lm.BuildLog(
+					"System.CDR",
+					"GenericError",
+					logrus.ErrorLevel,
+					nil, err,
+				))
+			}
+		}
+		if gateway.Archive != nil {
+			gateway.archived("cdr", gateway.Archive.SaveCDRs(batch))
+		}
+		stream(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case event := <-cdrEvents:
+			if event.record != nil {
+				batch = append(batch, event.record)
+				if len(batch) >= 100 {
+					flush()
+				}
+				continue
+			}
+			// the CDR of the send may still be in the batch
+			flush()
+			completed, err := gateway.applyCDRStatus(event.status)
+			if err != nil {
+				lm.SendLog(lm.BuildLog(
+					"System.CDR",
+					"GenericError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"logID":   event.status.logID,
+						"carrier": event.status.carrier,
+					}, err,
+				))
+			}
+			if len(completed) > 0 {
+				stream(completed)
+			}
+		case <-flushTicker.C:
+			flush()
+		}
+	}
+}
+
+// applyCDRStatus completes the pending CDRs of the carrier send and returns them.
+func (gateway *Gateway) applyCDRStatus(status *cdrStatus) ([]*CDR, error) {
+	var records []*CDR
+	var err error
+	if gateway.usePostgres() {
+		err = gateway.DB.Where("log_id = ? AND route = ? AND status = ?", status.logID, status.carrier, DeliveryStatuses.Sent).
+			Find(&records).Error
+	} else {
+		records, err = gateway.Archive.PendingCDRs(status.logID, status.carrier)
+	}
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, record := range records {
+		record.Status = status.status
+		record.ErrorCode = status.errorCode
+		record.ErrorClass = string(status.errorClass)
+		record.CompletedAt = &now
+		if record.CarrierMessageID == "" {
+			record.CarrierMessageID = status.carrierMessageID
+		}
+		if !gateway.usePostgres() {
+			continue
+		}
+		if err := gateway.DB.Save(record).Error; err != nil {
+			return nil, err
+		}
+	}
+	if gateway.Archive != nil {
+		gateway.archived("cdr", gateway.Archive.SaveCDRs(records))
+	}
+	return records, nil
+}
+
+// cdrSink streams CDRs out of the gateway. A CDR is streamed when it is recorded, and again with
+// the same ID once a carrier reports its final status.
+type cdrSink interface {
+	name() string
+	write(records []*CDR) error
+}
+
+// cdrSinks are the sinks configured by CDR_FILE, CDR_AMQP_EXCHANGE and CDR_KAFKA_REST_URL.
+func cdrSinks() []cdrSink {
+	var sinks []cdrSink
+	if path := Getenv("CDR_FILE"); path != "" {
+		sinks = append(sinks, &cdrFileSink{path: path})
+	}
+	if exchange := Getenv("CDR_AMQP_EXCHANGE"); exchange != "" {
+		sinks = append(sinks, &cdrAMQPSink{
+			url:      EnvString("CDR_AMQP_URL", Getenv("AMQP_SERVER_URL")),
+			exchange: exchange,
+		})
+	}
+	if restURL := Getenv("CDR_KAFKA_REST_URL"); restURL != "" {
+		sinks = append(sinks, &cdrKafkaSink{
+			url:    strings.TrimRight(restURL, "/") + "/topics/" + url.PathEscape(EnvString("CDR_KAFKA_TOPIC", "cdrs")),
+			client: http.Client{Timeout: 10 * time.Second},
+		})
+	}
+	return sinks
+}
+
+// cdrFileSink appends CDRs to a file as JSON lines, the file is reopened when it was moved away.
+type cdrFileSink struct {
+	path string
+	file *os.File
+}
+
+func (sink *cdrFileSink) name() string { return "file" }
+
+func (sink *cdrFileSink) write(records []*CDR) error {
+	if sink.file != nil {
+		if _, err := os.Stat(sink.path); err != nil {
+			// rotated
+			sink.file.Close()
+			sink.file = nil
+		}
+	}
+	if sink.file == nil {
+		file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return err
+		}
+		sink.file = file
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	_, err := sink.file.Write(buf.Bytes())
+	return err
+}
+
+// cdrAMQPSink publishes CDRs to a durable topic exchange with the routing key
+// cdr.<direction>.<status>. It has its own connection, so it works with either queue backend.
+type cdrAMQPSink struct {
+	url      string
+	exchange string
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+func (sink *cdrAMQPSink) name() string { return "amqp" }
+
+func (sink *cdrAMQPSink) connect() error {
+	if sink.channel != nil && !sink.channel.IsClosed() {
+		return nil
+	}
+	if sink.conn != nil {
+		sink.conn.Close()
+	}
+	conn, err := amqp.Dial(sink.url)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.ExchangeDeclare(sink.exchange, "topic", true, false, false, false, nil)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	sink.conn, sink.channel = conn, ch
+	return nil
+}
+
+func (sink *cdrAMQPSink) write(records []*CDR) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if err := sink.connect(); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", sink.exchange, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, record := range records {
+		body, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		err = sink.channel.PublishWithContext(ctx, sink.exchange, "cdr."+record.Direction+"."+record.Status, false, false, amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    fmt.Sprintf("%d", record.ID),
+			Body:         body,
+		})
+		if err != nil {
+			sink.channel.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// cdrKafkaSink produces CDRs to a Kafka topic through the Confluent REST Proxy, keyed by log ID
+// so the records of a message stay in order.
+type cdrKafkaSink struct {
+	url    string
+	client http.Client
+}
+
+func (sink *cdrKafkaSink) name() string { return "kafka" }
+
+func (sink *cdrKafkaSink) write(records []*CDR) error {
+	type kafkaRecord struct {
+		Key   string `json:"key"`
+		Value *CDR   `json:"value"`
+	}
+	payload := struct {
+		Records []kafkaRecord `json:"records"`
+	}{}
+	for _, record := range records {
+		payload.Records = append(payload.Records, kafkaRecord{Key: record.LogID, Value: record})
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", sink.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to produce CDRs: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response from Kafka REST proxy: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SetupCDRRoutes sets up the CDR search for billing and disputes.
+func SetupCDRRoutes(app *iris.Application, gateway *Gateway) {
+	cdrs := app.Party("/cdrs", gateway.BasicAuthMiddleware)
+	{
+		// List CDRs, newest first
+		cdrs.Get("/", func(ctx iris.Context) {
+			query := gateway.DB.Order("id desc")
+			for _, param := range []string{"log_id", "client", "direction", "status", "route"} {
+				if value := ctx.URLParam(param); value != "" {
+					query = query.Where(param+" = ?", value)
+				}
+			}
+			if number := ctx.URLParam("number"); number != "" {
+				query = query.Where("\"from\" = ? OR \"to\" = ?", number, number)
+			}
+			for param, op := range map[string]string{"since": ">=", "until": "<"} {
+				value := ctx.URLParam(param)
+				if value == "" {
+					continue
+				}
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					WriteProvisioningError(ctx, Invalid("%s must be an RFC 3339 time", param))
+					return
+				}
+				query = query.Where("attempted_at "+op+" ?", t)
+			}
+
+			var list []CDR
+			if err := query.Limit(ctx.URLParamIntDefault("limit", 100)).Find(&list).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(list)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"zultys-smpp-mm4/smpp/coding"
+	"zultys-smpp-mm4/smpp/coding/gsm7bit"
+)
+
+// SMSTransliterate transliterates the messages sent on every carrier route that doesn't set
+// transliterate in its config.
+var SMSTransliterate bool
+
+// Results of a transliteration, the result label of sms_transliterations_total.
+const (
+	transliterated      = "transliterated"
+	transliterationKept = "kept" // characters without a GSM equivalent left the text UCS-2
+)
+
+var (
+	smsTransliterations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sms_transliterations_total",
+		Help: "SMS with characters outside GSM 03.38 a transliteration applied to, by client, route and result",
+	}, []string{"client", "route", "result"})
+	smsTransliterationSaved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sms_transliteration_segments_saved_total",
+		Help: "Segments saved by sending transliterated SMS as GSM 03.38 instead of UCS-2, by client and route",
+	}, []string{"client", "route"})
+)
+
+func init() {
+	prometheus.MustRegister(smsTransliterations, smsTransliterationSaved)
+	OnConfigure(func(cfg *Config) {
+		SMSTransliterate = cfg.Getenv("SMS_TRANSLITERATE") == "true"
+	})
+}
+
+// gsmEquivalents are the GSM 03.38 replacements of characters phones and word processors put in
+// texts, letters with diacritics GSM lacks are handled by gsmEquivalent.
+var gsmEquivalents = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '‛': "'", '′': "'", '`': "'", '´': "'",
+	'“': `"`, '”': `"`, '„': `"`, '‟': `"`, '″': `"`, '«': `"`, '»': `"`,
+	'‹': "<", '›': ">",
+	'‐': "-", '‑': "-", '‒': "-", '–': "-", '—': "-", '―': "-", '−': "-",
+	'…': "...", '•': "*", '·': ".", '×': "x", '÷': "/",
+	'\u2002': " ", '\u2003': " ", '\u2009': " ", '\u202f': " ", '\u3000': " ", '\t': " ",
+	'\u200b': "", '\u200d': "", '\ufeff': "", '\ufe0f': "", // zero width and emoji variation selectors
+	'©': "(c)", '®': "(R)", '™': "TM", '¢': "c", '°': "o",
+	'Ð': "D", 'ð': "d", 'Þ': "Th", 'þ': "th", 'Œ': "OE", 'œ': "oe", 'ł': "l", 'Ł': "L",
+	'🙂': ":)", '😊': ":)", '😀': ":D", '😃': ":D", '😄': ":D", '😁': ":D", '😉': ";)",
+	'😂': ":'D", '🙁': ":(", '☹': ":(", '😢': ":'(", '😛': ":P", '😜': ";P", '😮': ":O",
+	'❤': "<3", '♥': "<3", '👍': "(y)", '👎': "(n)", '✓': "v", '✔': "v",
+}
+
+// isGSM reports whether a character is in the GSM 03.38 alphabet or its extension.
+func isGSM(r rune) bool {
+	return unicode.Is(gsm7bit.DefaultAlphabet, r)
+}
+
+// gsmEquivalent is the GSM 03.38 replacement of a character, e.g. a for á. ok is false for
+// characters without one.
+func gsmEquivalent(r rune) (string, bool) {
+	if replacement, ok := gsmEquivalents[r]; ok {
+		return replacement, true
+	}
+	// a letter with a diacritic GSM doesn't have becomes the letter without it
+	var builder strings.Builder
+	for _, d := range norm.NFD.String(string(r)) {
+		if unicode.Is(unicode.Mn, d) {
+			continue
+		}
+		if !isGSM(d) {
+			return "", false
+		}
+		builder.WriteRune(d)
+	}
+	return builder.String(), builder.Len() > 0
+}
+
+// gsmTransliteration replaces the characters outside GSM 03.38 that have an equivalent, other
+// characters are kept.
+func gsmTransliteration(text string) string {
+	var builder strings.Builder
+	for _, r := range text {
+		if isGSM(r) {
+			builder.WriteRune(r)
+		} else if replacement, ok := gsmEquivalent(r); ok {
+			builder.WriteString(replacement)
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// transliterate replaces the characters outside GSM 03.38 of an SMS with their equivalents, so it
+// is sent as GSM instead of UCS-2. A text with characters that have none is kept as it is, it is
+// UCS-2 anyway and its other characters show as typed. ok is true when the text was replaced.
+func transliterate(text string) (string, bool) {
+	if coding.GSM7BitCoding.Validate(text) {
+		return text, false
+	}
+	result := gsmTransliteration(text)
+	if !coding.GSM7BitCoding.Validate(result) {
+		return text, false
+	}
+	return result, true
+}
+
+// TransliterateText transliterates the text of a message to or from a client on a route, and
+// counts it.
+func TransliterateText(client string, route string, text string) string {
+	if coding.GSM7BitCoding.Validate(text) {
+		return text
+	}
+	result, ok := transliterate(text)
+	if !ok {
+		smsTransliterations.WithLabelValues(client, route, transliterationKept).Inc()
+		return text
+	}
+	before, _ := SMPPSegments(text)
+	after, _ := SMPPSegments(result)
+	smsTransliterations.WithLabelValues(client, route, transliterated).Inc()
+	smsTransliterationSaved.WithLabelValues(client, route).Add(float64(len(before) - len(after)))
+	return result
+}
+
+// RevertTransliteration restores the text of a transliterated message, for the next route.
+func (msg *MsgQueueItem) RevertTransliteration() {
+	if msg.SubmittedText != "" {
+		msg.Message, msg.SubmittedText = msg.SubmittedText, ""
+	}
+}
@@ -0,0 +1,339 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BindAuthenticator checks the credentials of an SMPP bind. Client.Auth selects the authenticator
+// of a client, so the credentials of some clients can live in the identity system of the
+// enterprise, which also applies its lockout policies to them.
+type BindAuthenticator interface {
+	Name() string
+	// Authenticate reports whether the password is the client's. An error means the identity
+	// system couldn't tell, not that the password is wrong.
+	Authenticate(ctx context.Context, client *Client, username string, password string) (bool, error)
+}
+
+// ClientAuths are the authenticators of Client.Auth, local when empty.
+var ClientAuths = struct {
+	Local  string
+	RADIUS string
+	LDAP   string
+}{
+	Local:  "local",
+	RADIUS: "radius",
+	LDAP:   "ldap",
+}
+
+var bindAuthenticators = map[string]func() (BindAuthenticator, error){
+	ClientAuths.Local:  func() (BindAuthenticator, error) { return localAuthenticator{}, nil },
+	ClientAuths.RADIUS: newRADIUSAuthenticator,
+	ClientAuths.LDAP:   newLDAPAuthenticator,
+}
+
+// ValidateClientAuth checks the authenticator of a client.
+func ValidateClientAuth(auth string) error {
+	if auth == "" {
+		return nil
+	}
+	if _, ok := bindAuthenticators[auth]; !ok {
+		return Invalid("auth must be one of local, radius or ldap")
+	}
+	return nil
+}
+
+// clientAuthenticators creates the authenticators once they are first used, so RADIUS and LDAP
+// only need to be configured when a client uses them.
+type clientAuthenticators struct {
+	mu             sync.Mutex
+	authenticators map[string]BindAuthenticator
+}
+
+var authenticators = &clientAuthenticators{authenticators: make(map[string]BindAuthenticator)}
+
+func (auths *clientAuthenticators) get(name string) (BindAuthenticator, error) {
+	if name == "" {
+		name = ClientAuths.Local
+	}
+	auths.mu.Lock()
+	defer auths.mu.Unlock()
+	if authenticator, ok := auths.authenticators[name]; ok {
+		return authenticator, nil
+	}
+	newAuthenticator, ok := bindAuthenticators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown authenticator: %s", name)
+	}
+	authenticator, err := newAuthenticator()
+	if err != nil {
+		return nil, fmt.Errorf("authenticator %s: %w", name, err)
+	}
+	auths.authenticators[name] = authenticator
+	return authenticator, nil
+}
+
+// localAuthenticator compares the password with the one stored for the client.
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string {
+	return ClientAuths.Local
+}
+
+func (localAuthenticator) Authenticate(_ context.Context, client *Client, _ string, password string) (bool, error) {
+	return checkPassword(client.Password, password), nil
+}
+
+// RADIUS packet codes and attributes of RFC 2865 and RFC 3579.
+const (
+	radiusAccessRequest = 1
+	radiusAccessAccept  = 2
+	radiusAccessReject  = 3
+
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusNASIdentifier        = 32
+	radiusMessageAuthenticator = 80
+)
+
+// radiusAuthenticator checks the credentials with a PAP Access-Request to RADIUS_SERVER. The
+// requests carry a Message-Authenticator and answers without a valid one are ignored.
+type radiusAuthenticator struct {
+	server   string
+	secret   []byte
+	nasID    string
+	timeout  time.Duration
+	attempts int
+}
+
+func newRADIUSAuthenticator() (BindAuthenticator, error) {
+	auth := &radiusAuthenticator{
+		server:   Getenv("RADIUS_SERVER"),
+		secret:   []byte(Getenv("RADIUS_SECRET")),
+		nasID:    EnvString("RADIUS_NAS_IDENTIFIER", "zultys-smpp-mm4"),
+		timeout:  EnvDuration("RADIUS_TIMEOUT", 3*time.Second),
+		attempts: EnvInt("RADIUS_ATTEMPTS", 3),
+	}
+	if auth.server == "" || len(auth.secret) == 0 {
+		return nil, errors.New("RADIUS_SERVER and RADIUS_SECRET are required")
+	}
+	return auth, nil
+}
+
+func (auth *radiusAuthenticator) Name() string {
+	return ClientAuths.RADIUS
+}
+
+func (auth *radiusAuthenticator) Authenticate(ctx context.Context, _ *Client, username string, password string) (bool, error) {
+	if len(password) > 128 {
+		return false, nil
+	}
+	request, authenticator, err := auth.accessRequest(username, password)
+	if err != nil {
+		return false, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", auth.server)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	response := make([]byte, 4096)
+	for attempt := 0; attempt < auth.attempts; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return false, err
+		}
+		deadline := time.Now().Add(auth.timeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		_ = conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(response)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+					break // sent again
+				}
+				return false, err
+			}
+			// answers to other requests, or forged ones, are dropped
+			if code, ok := auth.verifyResponse(response[:n], request[1], authenticator); ok {
+				return code == radiusAccessAccept, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("no answer from RADIUS server %s", auth.server)
+}
+
+// accessRequest builds the Access-Request of the credentials, with its request authenticator.
+func (auth *radiusAuthenticator) accessRequest(username string, password string) ([]byte, []byte, error) {
+	header := make([]byte, 20)
+	if _, err := rand.Read(header[1:20]); err != nil {
+		return nil, nil, err
+	}
+	header[0] = radiusAccessRequest
+	authenticator := header[4:20]
+
+	var attributes bytes.Buffer
+	writeRADIUSAttribute(&attributes, radiusUserName, []byte(username))
+	writeRADIUSAttribute(&attributes, radiusUserPassword, auth.hidePassword(password, authenticator))
+	writeRADIUSAttribute(&attributes, radiusNASIdentifier, []byte(auth.nasID))
+	messageAuthenticator := attributes.Len() + 2
+	writeRADIUSAttribute(&attributes, radiusMessageAuthenticator, make([]byte, md5.Size))
+
+	packet := append(header, attributes.Bytes()...)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	mac := hmac.New(md5.New, auth.secret)
+	mac.Write(packet)
+	copy(packet[20+messageAuthenticator:], mac.Sum(nil))
+	return packet, append([]byte(nil), authenticator...), nil
+}
+
+// hidePassword obscures the password of a User-Password attribute as RFC 2865 5.2 describes.
+func (auth *radiusAuthenticator) hidePassword(password string, authenticator []byte) []byte {
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+	previous := authenticator
+	for i := 0; i < len(padded); i += 16 {
+		hash := md5.Sum(append(append([]byte(nil), auth.secret...), previous...))
+		for j := 0; j < 16; j++ {
+			padded[i+j] ^= hash[j]
+		}
+		previous = padded[i : i+16]
+	}
+	return padded
+}
+
+// verifyResponse checks that a packet answers the request with the identifier and authenticator
+// and returns its code.
+func (auth *radiusAuthenticator) verifyResponse(packet []byte, identifier byte, authenticator []byte) (byte, bool) {
+	if len(packet) < 20 || packet[1] != identifier || int(binary.BigEndian.Uint16(packet[2:4])) != len(packet) {
+		return 0, false
+	}
+	if packet[0] != radiusAccessAccept && packet[0] != radiusAccessReject {
+		return 0, false
+	}
+	hash := md5.New()
+	hash.Write(packet[:4])
+	hash.Write(authenticator)
+	hash.Write(packet[20:])
+	hash.Write(auth.secret)
+	if !hmac.Equal(hash.Sum(nil), packet[4:20]) {
+		return 0, false
+	}
+
+	// the Message-Authenticator of the response is computed over the request authenticator
+	signed := append([]byte(nil), packet...)
+	copy(signed[4:20], authenticator)
+	var received []byte
+	for offset := 20; offset+2 <= len(signed); {
+		length := int(signed[offset+1])
+		if length < 2 || offset+length > len(signed) {
+			return 0, false
+		}
+		if signed[offset] == radiusMessageAuthenticator && length == 2+md5.Size {
+			received = append([]byte(nil), signed[offset+2:offset+length]...)
+			copy(signed[offset+2:offset+length], make([]byte, md5.Size))
+		}
+		offset += length
+	}
+	if received == nil {
+		return 0, false
+	}
+	mac := hmac.New(md5.New, auth.secret)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), received) {
+		return 0, false
+	}
+	return packet[0], true
+}
+
+func writeRADIUSAttribute(buf *bytes.Buffer, attribute byte, value []byte) {
+	if len(value) > 253 {
+		value = value[:253]
+	}
+	buf.WriteByte(attribute)
+	buf.WriteByte(byte(len(value) + 2))
+	buf.Write(value)
+}
+
+// ldapAuthenticator checks the credentials with a simple bind to LDAP_URL as LDAP_BIND_DN, the DN
+// of the client with %s standing for the escaped system_id.
+type ldapAuthenticator struct {
+	url      string
+	bindDN   string
+	startTLS bool
+	timeout  time.Duration
+}
+
+func newLDAPAuthenticator() (BindAuthenticator, error) {
+	auth := &ldapAuthenticator{
+		url:      Getenv("LDAP_URL"),
+		bindDN:   Getenv("LDAP_BIND_DN"),
+		startTLS: Getenv("LDAP_START_TLS") == "true",
+		timeout:  EnvDuration("LDAP_TIMEOUT", 5*time.Second),
+	}
+	if auth.url == "" || !strings.Contains(auth.bindDN, "%s") {
+		return nil, errors.New("LDAP_URL and an LDAP_BIND_DN with %s for the system_id are required")
+	}
+	return auth, nil
+}
+
+func (auth *ldapAuthenticator) Name() string {
+	return ClientAuths.LDAP
+}
+
+func (auth *ldapAuthenticator) Authenticate(ctx context.Context, _ *Client, username string, password string) (bool, error) {
+	// an empty password would be an unauthenticated bind, which servers accept
+	if password == "" {
+		return false, nil
+	}
+	timeout := auth.timeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	conn, err := ldap.DialURL(auth.url, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(timeout)
+
+	if auth.startTLS {
+		host := strings.TrimPrefix(strings.TrimPrefix(auth.url, "ldap://"), "ldaps://")
+		host, _, _ = strings.Cut(host, "/")
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return false, err
+		}
+	}
+
+	err = conn.Bind(fmt.Sprintf(auth.bindDN, ldap.EscapeDN(username)), password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
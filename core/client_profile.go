@@ -0,0 +1,130 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"zultys-smpp-mm4/smpp/coding"
+)
+
+// ClientProfile is what the PBX of a client supports, Zultys firmware versions differ in it. The
+// zero profile is what the gateway assumed of every client before there were profiles: MMS, UCS-2
+// and group messages, no segment limit, a receipt for every submit and transceiver binds.
+type ClientProfile struct {
+	NoMMS             bool   `json:"no_mms"`              // messages with media for the client are rejected
+	MMSFallback       bool   `json:"mms_fallback"`        // with no_mms, messages with media are delivered as SMS with links instead
+	MediaLinkTTL      int    `json:"media_link_ttl"`      // seconds the links of mms_fallback work, 0 for MEDIA_LINK_TTL
+	NoUCS2            bool   `json:"no_ucs2"`             // characters outside GSM 03.38 are delivered as ?
+	MaxSegments       int    `json:"max_segments"`        // deliver_sm segments of a message, longer text is cut, 0 for no limit
+	ReceiptsOnRequest bool   `json:"receipts_on_request"` // receipts only for submits with registered_delivery set
+	BindTypes         string `json:"bind_types"`          // SMPP binds allowed, comma separated, empty for transceiver only
+	NoGroupMessages   bool   `json:"no_group_messages"`   // MM4 messages to more than one recipient are refused
+	// DeliverRate paces the deliver_sm of messages to the client per second, 0 for SMPP_DELIVER_RATE
+	DeliverRate float64 `json:"deliver_rate"`
+	// DeliverBurst is how many go out at once before DeliverRate applies, 0 for SMPP_DELIVER_BURST
+	DeliverBurst int `json:"deliver_burst"`
+	// Transliterate replaces the characters outside GSM 03.38 of the SMS the client sends and gets
+	// with their equivalents, e.g. smart quotes, when that keeps the message from going as UCS-2
+	Transliterate bool `json:"transliterate"`
+}
+
+// SMPP bind types of ClientProfile.BindTypes.
+var BindTypes = struct {
+	Transceiver string
+	Transmitter string
+	Receiver    string
+}{
+	Transceiver: "transceiver",
+	Transmitter: "transmitter",
+	Receiver:    "receiver",
+}
+
+// bindTypes is the list of BindTypes, transceiver when empty.
+func (profile ClientProfile) bindTypes() []string {
+	var types []string
+	for _, bindType := range strings.Split(profile.BindTypes, ",") {
+		if bindType = strings.ToLower(strings.TrimSpace(bindType)); bindType != "" {
+			types = append(types, bindType)
+		}
+	}
+	if len(types) == 0 {
+		types = []string{BindTypes.Transceiver}
+	}
+	return types
+}
+
+// AllowsBind reports whether the client may bind as the bind type.
+func (profile ClientProfile) AllowsBind(bindType string) bool {
+	for _, allowed := range profile.bindTypes() {
+		if allowed == bindType {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the bind types, the segment limit and the pacing, and normalizes the bind types.
+func (profile *ClientProfile) Validate() error {
+	if profile.MaxSegments < 0 {
+		return Invalid("profile.max_segments must not be negative")
+	}
+	if profile.MediaLinkTTL < 0 {
+		return Invalid("profile.media_link_ttl must not be negative")
+	}
+	if profile.DeliverRate < 0 || profile.DeliverBurst < 0 {
+		return Invalid("profile.deliver_rate and profile.deliver_burst must not be negative")
+	}
+	types := profile.bindTypes()
+	for _, bindType := range types {
+		switch bindType {
+		case BindTypes.Transceiver, BindTypes.Transmitter, BindTypes.Receiver:
+		default:
+			return Invalid("profile.bind_types: unknown bind type %s, use transceiver, transmitter or receiver", bindType)
+		}
+	}
+	if profile.BindTypes != "" {
+		profile.BindTypes = strings.Join(types, ",")
+	}
+	return nil
+}
+
+// DeliverText is the text of a message as the client can take it, characters it can't show are
+// replaced when it has no UCS-2: by their GSM equivalents, and by ? when they have none.
+func (profile ClientProfile) DeliverText(text string) string {
+	if !profile.NoUCS2 || coding.GSM7BitCoding.Validate(text) {
+		return text
+	}
+	var builder strings.Builder
+	for _, r := range gsmTransliteration(text) {
+		if gsm0338BasicSet[r] || gsm0338ExtendedSet[r] {
+			builder.WriteRune(r)
+		} else {
+			builder.WriteRune('?')
+		}
+	}
+	return builder.String()
+}
+
+// LimitSegments cuts the segments of a message to the number the client takes. The cut reports
+// how many segments were dropped.
+func (profile ClientProfile) LimitSegments(segments [][]byte) ([][]byte, int) {
+	if profile.MaxSegments == 0 || len(segments) <= profile.MaxSegments {
+		return segments, 0
+	}
+	return segments[:profile.MaxSegments], len(segments) - profile.MaxSegments
+}
+
+// GroupRecipients splits the To header of an MM4 message into its recipients.
+func GroupRecipients(to string) []string {
+	var recipients []string
+	for _, recipient := range strings.Split(to, ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			recipients = append(recipients, recipient)
+		}
+	}
+	return recipients
+}
+
+// ErrBindNotAllowed refuses a bind type the profile of the client doesn't allow.
+func ErrBindNotAllowed(client *Client, bindType string) error {
+	return fmt.Errorf("client %s may not bind as %s, its profile allows %s", client.Username, bindType, strings.Join(client.Profile.bindTypes(), ", "))
+}
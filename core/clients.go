@@ -0,0 +1,305 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+)
+
+type Client struct {
+	ID         uint           `gorm:"primaryKey" json:"id"`
+	TenantID   uint           `gorm:"index" json:"tenant_id"` // see Tenant, 0 for the operator
+	Username   string         `gorm:"unique;not null" json:"username"`
+	Password   string         `gorm:"not null" json:"password"` // bcrypt hash, or an encrypted secret reference, see storedPassword
+	Address    string         `json:"address"`
+	Name       string         `json:"name"`
+	LogPrivacy bool           `json:"log_privacy"`
+	Numbers    []ClientNumber `gorm:"foreignKey:ClientID" json:"numbers"`
+	// DefaultCountryCode is the calling code assumed for national numbers sent by the client,
+	// DEFAULT_COUNTRY_CODE is used when empty
+	DefaultCountryCode string         `json:"default_country_code"`
+	DialPlan           []DialPlanRule `gorm:"foreignKey:ClientID" json:"dial_plan"`
+	// Replies to the STOP, START and HELP keywords sent for the client, STOP_REPLY, START_REPLY
+	// and HELP_REPLY are used when empty, see keywordReply
+	StopReply  string `json:"stop_reply"`
+	StartReply string `json:"start_reply"`
+	HelpReply  string `json:"help_reply"`
+	// InternationalPolicy decides on messages to other countries than the sending number's, see
+	// InternationalPolicies, INTERNATIONAL_POLICY is used when empty
+	InternationalPolicy string `json:"international_policy"`
+	AllowedCountries    string `json:"allowed_countries"` // ISO 3166 codes allowed besides the sending number's, comma separated
+	// Profile is what the PBX of the client supports, see ClientProfile
+	Profile ClientProfile `gorm:"embedded;embeddedPrefix:profile_" json:"profile"`
+	// QuietHours hold the client's messages to carriers in the recipient's night, see QuietHours
+	QuietHours QuietHours `gorm:"embedded;embeddedPrefix:quiet_" json:"quiet_hours"`
+	// MonthlyQuota limits what the client sends to carriers per billing cycle, see MonthlyQuota
+	MonthlyQuota MonthlyQuota `gorm:"embedded;embeddedPrefix:quota_" json:"monthly_quota"`
+	// Auth is the authenticator of the SMPP binds of the client, see ClientAuths, local when empty
+	Auth    string `json:"auth"`
+	Version uint   `gorm:"not null;default:1" json:"version"` // see updateVersioned
+}
+
+type ClientNumber struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	ClientID uint   `gorm:"index;not null" json:"client_id"`
+	Number   string `gorm:"unique;not null" json:"number"`
+	Carrier  string `json:"carrier"`
+	WebHook  string `json:"webhook"` // this is the spot to send the web hook request for if we "receive" from the carrier
+	Type     string `json:"type"`    // see NumberTypes, empty to tell by the number
+	// MMSFallback delivers messages with media to the number as SMS with links to the media, for
+	// numbers of clients taking MMS on other numbers
+	MMSFallback bool `json:"mms_fallback"`
+	// MQTT delivers the messages to the number to the MQTT bridge instead of SMPP or MM4, and
+	// lets the bridge send from it
+	MQTT bool `json:"mqtt"`
+
+	// Carrier resources the number is registered with, used for messages sent from it instead of
+	// the defaults of the carrier.
+	MessagingServiceSID string `json:"messaging_service_sid"` // Twilio Messaging Service
+	MessagingProfileID  string `json:"messaging_profile_id"`  // Telnyx messaging profile
+	ApplicationID       string `json:"application_id"`        // Bandwidth messaging application
+	CampaignID          string `json:"campaign_id"`           // 10DLC campaign, passed to webhook and plugin carriers
+
+	// State is where the number is in its activation, see NumberStates. Messages are only routed
+	// for active numbers.
+	State       string `json:"state"`
+	StateReason string `json:"state_reason,omitempty"` // why the number was suspended or its verification failed
+
+	Version uint `gorm:"not null;default:1" json:"version"`
+}
+
+// storedPassword is the form a client password is stored in: a bcrypt hash, or the encrypted
+// reference when the password is a reference to a secret, which has to be resolved again when the
+// secret is rotated.
+func (gateway *Gateway) storedPassword(password string) (string, error) {
+	if _, _, _, ok := secretRef(password); ok {
+		return gateway.encryptSecret(password)
+	}
+	return HashPassword(password)
+}
+
+// clientPassword is the password of a client kept in memory for authClient: the hash, or the
+// secret a stored reference resolves to.
+func (gateway *Gateway) clientPassword(stored string) (string, error) {
+	if isPasswordHash(stored) {
+		return stored, nil
+	}
+	password, err := gateway.storedSecret(stored)
+	if err != nil {
+		return "", err
+	}
+	return settings.resolveSecret(password)
+}
+
+// loadClients loads clients from the storage, decrypts their credentials, and populates the in-memory map.
+func (gateway *Gateway) loadClients() error {
+	clients, err := gateway.Storage.Clients()
+	if err != nil {
+		return err
+	}
+
+	clientMap := make(map[string]*Client)
+	gateway.Mu.Lock()
+	defer gateway.Mu.Unlock()
+
+	for _, client := range clients {
+		decryptedUsername, err := gateway.storedSecret(client.Username)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt username for client %s: %w", client.Name, err)
+		}
+		password, err := gateway.clientPassword(client.Password)
+		if err != nil {
+			return fmt.Errorf("failed to load password for client %s: %w", client.Name, err)
+		}
+
+		// Update client struct with decrypted credentials
+		client.Username = decryptedUsername
+		client.Password = password
+
+		if err := client.compileDialPlan(); err != nil {
+			return err
+		}
+		if err := client.Profile.Validate(); err != nil {
+			return fmt.Errorf("client %s: %w", client.Name, err)
+		}
+		if err := ValidateClientAuth(client.Auth); err != nil {
+			return fmt.Errorf("client %s: %w", client.Name, err)
+		}
+
+		c := client // create a copy to avoid referencing the loop variable
+		clientMap[client.Username] = &c
+	}
+
+	gateway.Clients = clientMap
+	gateway.NumberIndex.Rebuild(clientMap)
+	return nil
+}
+
+func (gateway *Gateway) loadNumbers() error {
+	numbers, err := gateway.Storage.Numbers()
+	if err != nil {
+		return err
+	}
+
+	numberMap := make(map[string]*ClientNumber)
+	gateway.Mu.Lock()
+	defer gateway.Mu.Unlock()
+
+	for _, number := range numbers {
+		n := number // create a copy to avoid referencing the loop variable
+		numberMap[NumberKey(number.Number)] = &n
+	}
+
+	gateway.Numbers = numberMap
+	return nil
+}
+
+// AddClient encrypts the client's username, hashes its password, and stores the client in the
+// database and in-memory map.
+func (gateway *Gateway) AddClient(client *Client) error {
+	username, password := client.Username, client.Password
+
+	encryptedUsername, err := gateway.encryptSecret(username)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt username: %w", err)
+	}
+	storedPassword, err := gateway.storedPassword(password)
+	if err != nil {
+		return err
+	}
+
+	client.Username = encryptedUsername
+	client.Password = storedPassword
+
+	// Store in the database
+	if err := gateway.DB.Create(client).Error; err != nil {
+		return err
+	}
+
+	// Keep the username in the clear and the password as authClient compares it
+	client.Username = username
+	if client.Password, err = gateway.clientPassword(storedPassword); err != nil {
+		return err
+	}
+
+	if err := client.compileDialPlan(); err != nil {
+		return err
+	}
+
+	gateway.Mu.Lock()
+	gateway.Clients[client.Username] = client
+	gateway.Mu.Unlock()
+	gateway.announceProvisioning()
+
+	return nil
+}
+
+// AddNumber encrypts and adds a new number to a client.
+func (gateway *Gateway) AddNumber(clientUsername string, number *ClientNumber) error {
+	// Check if the client exists
+	gateway.Mu.RLock()
+	client, exists := gateway.Clients[clientUsername]
+	gateway.Mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("client with username %s does not exist", clientUsername)
+	}
+
+	// Validate if the carrier exists
+	gateway.Mu.RLock()
+	_, carrierExists := gateway.Carriers[number.Carrier]
+	gateway.Mu.RUnlock()
+	if !carrierExists {
+		return fmt.Errorf("carrier %s does not exist", number.Carrier)
+	}
+	if err := gateway.checkTenantNumber(client, number.Carrier, true); err != nil {
+		return err
+	}
+
+	// Numbers are stored in their normalized form
+	number.Number = NumberKey(number.Number)
+	if !ValidNumberType(number.Type) {
+		return fmt.Errorf("number type %q is not long, short_code or toll_free", number.Type)
+	}
+
+	// Check if the number already exists
+	gateway.Mu.RLock()
+	_, numberExists := gateway.Numbers[number.Number]
+	gateway.Mu.RUnlock()
+	if numberExists {
+		return fmt.Errorf("number %s already exists", number.Number)
+	}
+
+	number.ClientID = client.ID
+	number.State, number.StateReason = initialNumberState(), ""
+
+	// Create the number in the database
+	if err := gateway.DB.Create(number).Error; err != nil {
+		return fmt.Errorf("failed to add number to database: %w", err)
+	}
+
+	// Add the number to the in-memory map and the client
+	gateway.Mu.Lock()
+	gateway.Numbers[number.Number] = number
+	client.Numbers = append(client.Numbers, *number)
+	gateway.Mu.Unlock()
+	gateway.NumberIndex.Add(client, number)
+	gateway.flushNumberCache()
+	gateway.announceProvisioning()
+
+	// Log the addition
+	gateway.LogManager.SendLog(gateway.LogManager.BuildLog(
+		"Client.AddNumber",
+		fmt.Sprintf("Added number %s to client %s", number.Number, client.Username),
+		logrus.InfoLevel,
+		map[string]interface{}{
+			"client_id": client.ID,
+			"number":    number.Number,
+			"carrier":   number.Carrier,
+		},
+	))
+
+	return nil
+}
+
+// reloadClientsAndNumbers reloads clients and numbers from the database.
+func (gateway *Gateway) reloadClientsAndNumbers() error {
+	if err := gateway.loadClients(); err != nil {
+		return err
+	}
+	if err := gateway.loadNumbers(); err != nil {
+		return err
+	}
+	gateway.flushNumberCache()
+	gateway.Reloaded()
+	return nil
+}
+
+// ProvisioningChanged reloads clients and numbers after they were changed through this instance,
+// and has the other instances reload them.
+func (gateway *Gateway) ProvisioningChanged() error {
+	if err := gateway.reloadClientsAndNumbers(); err != nil {
+		return err
+	}
+	gateway.announceProvisioning()
+	return nil
+}
+
+func (gateway *Gateway) AuthClient(username string, password string) (bool, error) {
+	gateway.Mu.RLock()
+	var client Client
+	loaded, exists := gateway.Clients[username]
+	if exists {
+		client = *loaded
+	}
+	gateway.Mu.RUnlock()
+
+	if !exists {
+		return false, nil
+	}
+	authenticator, err := authenticators.get(client.Auth)
+	if err != nil {
+		return false, err
+	}
+	// bcrypt and the identity systems are slow, compare without holding the lock
+	return authenticator.Authenticate(context.Background(), &client, username, password)
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"time"
+)
+
+// SessionRegistration is the instance an SMPP client is bound to, instances of a cluster forward
+// the messages for a client to the instance holding its session. A client is bound to one instance,
+// the newest bind wins.
+type SessionRegistration struct {
+	Username string    `gorm:"primaryKey" json:"username"`
+	ServerID string    `gorm:"index;not null" json:"server_id"`
+	Address  string    `json:"address"` // of the client
+	BoundAt  time.Time `json:"bound_at"`
+	SeenAt   time.Time `gorm:"index" json:"seen_at"` // the last heartbeat of the instance
+}
+
+var (
+	ClusterEnabled    bool
+	ClusterHeartbeat  time.Duration
+	ClusterSessionTTL time.Duration // a registration not seen for this long is stale
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		ClusterEnabled = cfg.Getenv("CLUSTER_ENABLED") == "true"
+		ClusterHeartbeat = cfg.Duration("CLUSTER_HEARTBEAT", 10*time.Second)
+		ClusterSessionTTL = cfg.Duration("CLUSTER_SESSION_TTL", 30*time.Second)
+	})
+}
+
+// Headers of the messages forwarded to an instance.
+const (
+	ForwardKindHeader  = "x-forward-kind"
+	ForwardQueueHeader = "x-forward-queue" // the queue the message was routed from
+	ReceiptStateHeader = "x-receipt-state"
+	ReceiptErrorHeader = "x-receipt-error"
+)
+
+// Kinds of forwarded messages.
+var ForwardKinds = struct {
+	Message string
+	Receipt string
+}{
+	Message: "message", // delivered as deliver_sm
+	Receipt: "receipt", // a delivery receipt for a message the client submitted
+}
+
+// InstanceQueueName is the queue of the messages forwarded to an instance for the clients bound
+// to it, only that instance consumes it.
+func InstanceQueueName(serverID string) string {
+	return "instance." + serverID
+}
+
+// SessionInstance returns the other instance the client is bound to, or an empty string if it
+// isn't bound to another live instance.
+func (gateway *Gateway) SessionInstance(username string) (string, error) {
+	var registration SessionRegistration
+	result := gateway.DB.Where("username = ? AND server_id <> ? AND seen_at > ?", username, gateway.ServerID, time.Now().Add(-ClusterSessionTTL)).
+		Limit(1).Find(&registration)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	return registration.ServerID, nil
+}
@@ -0,0 +1,708 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every setting is an environment variable. CONFIG_FILE names a YAML or TOML file that sets them
+// by section, e.g. the host of the postgres section is POSTGRES_HOST. Variables set in the
+// environment or in .env take precedence over the file. LoadConfig reads them into a Config and
+// Configure applies it to the packages, nothing reads them on import.
+
+type configKind int
+
+const (
+	configString configKind = iota
+	configInt
+	configFloat
+	configDuration
+	configBool
+	configAddress // host:port
+	configURL
+	configFile // an existing file
+	configJSON
+)
+
+type configKey struct {
+	env      string
+	kind     configKind
+	options  []string // the allowed values, when set
+	required bool
+}
+
+// configSection groups the keys of a section of the config file, the file key is the variable
+// without the prefix, in lower case.
+type configSection struct {
+	name   string
+	prefix string
+	keys   []configKey
+}
+
+var configSchema = []configSection{
+	{name: "server", keys: []configKey{
+		{env: "SERVER_ID"},
+		{env: "SERVER_ADDRESS", kind: configURL},
+		{env: "API_KEY"},
+		{env: "ENCRYPTION_KEY", required: true},
+		{env: "LEGACY_ENCRYPTION_KEY"},
+		{env: "DEFAULT_COUNTRY_CODE", kind: configInt},
+		{env: "NUMBER_PREFIX_MATCH", kind: configBool},
+		{env: "SHORT_CODE_MIN_DIGITS", kind: configInt},
+		{env: "SHORT_CODE_MAX_DIGITS", kind: configInt},
+		{env: "TOLL_FREE_PREFIXES"},
+		{env: "API_MEDIA_MAX_SIZE", kind: configInt},
+		{env: "BULK_MAX_RECIPIENTS", kind: configInt},
+		{env: "TRANSCODE_TEMP_PATH"},
+		{env: "DEBUG", kind: configBool},
+	}},
+	{name: "listeners", keys: []configKey{
+		{env: "WEB_LISTEN", kind: configAddress},
+		{env: "SMPP_LISTEN", kind: configAddress},
+		{env: "MM4_LISTEN", kind: configAddress},
+		{env: "GRPC_LISTEN", kind: configAddress},
+		{env: "GRPC_STREAM_BUFFER", kind: configInt},
+		{env: "PROMETHEUS_LISTEN", kind: configAddress},
+		{env: "PROMETHEUS_PATH"},
+		{env: "PPROF_LISTEN", kind: configAddress},
+		{env: "HAPROXY_PROXY_PROTOCOL", kind: configBool},
+		{env: "TRUSTED_PROXIES"},
+		{env: "SMPP_RESPONSE_TIMEOUT", kind: configDuration},
+		{env: "SMPP_CONGESTION_BACKOFF", kind: configDuration},
+		{env: "SMPP_DELIVER_RATE", kind: configFloat},
+		{env: "SMPP_DELIVER_BURST", kind: configInt},
+		{env: "SMPP_TRACE_BUFFER", kind: configInt},
+		{env: "SMPP_TRACE_MAX_CAPTURES", kind: configInt},
+		{env: "SMPP_TRACE_MAX_DURATION", kind: configDuration},
+		{env: "SMPP_TRACE_REDACT", kind: configBool},
+		{env: "MM4_ORIGINATOR_SYSTEM"},
+		{env: "MM4_MSG_ID_HOST"},
+		{env: "MM4_DEBUG", kind: configBool},
+		{env: "MM4_TRACE_TRANSACTIONS", kind: configInt},
+		{env: "MM4_TRACE_MAX_CAPTURES", kind: configInt},
+		{env: "MM4_TRACE_MAX_DURATION", kind: configDuration},
+		{env: "MM4_TRACE_BODY_BYTES", kind: configInt},
+		{env: "MM4_POOL_MAX_CONNS", kind: configInt},
+		{env: "MM4_POOL_IDLE_TIMEOUT", kind: configDuration},
+		{env: "MM4_POOL_MAX_TRANSACTIONS", kind: configInt},
+	}},
+	{name: "tls", keys: []configKey{
+		{env: "WEB_TLS_CERT", kind: configFile},
+		{env: "WEB_TLS_KEY", kind: configFile},
+		{env: "SMPP_TLS_CERT", kind: configFile},
+		{env: "SMPP_TLS_KEY", kind: configFile},
+	}},
+	{name: "postgres", prefix: "POSTGRES_", keys: []configKey{
+		{env: "POSTGRES_HOST"},
+		{env: "POSTGRES_PORT", kind: configInt},
+		{env: "POSTGRES_USER"},
+		{env: "POSTGRES_PASSWORD"},
+		{env: "POSTGRES_DB"},
+		{env: "POSTGRES_SSLMODE", options: []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}},
+		{env: "POSTGRES_TIMEZONE"},
+		{env: "POSTGRES_MAX_OPEN_CONNS", kind: configInt},
+		{env: "POSTGRES_MAX_IDLE_CONNS", kind: configInt},
+		{env: "POSTGRES_CONN_MAX_LIFETIME", kind: configDuration},
+		{env: "POSTGRES_CONN_MAX_IDLE_TIME", kind: configDuration},
+		{env: "POSTGRES_STATEMENT_TIMEOUT", kind: configDuration},
+		{env: "POSTGRES_STARTUP_TIMEOUT", kind: configDuration},
+		{env: "POSTGRES_HEALTH_INTERVAL", kind: configDuration},
+	}},
+	{name: "storage", prefix: "STORAGE_", keys: []configKey{
+		{env: "STORAGE_BACKEND", options: []string{"postgres", "file"}},
+		{env: "STORAGE_FILE", kind: configFile},
+	}},
+	{name: "archive", prefix: "ARCHIVE_", keys: []configKey{
+		{env: "ARCHIVE_BACKEND", options: []string{"mongodb"}},
+		{env: "ARCHIVE_MONGODB_URI"},
+		{env: "ARCHIVE_MONGODB_DATABASE"},
+		{env: "ARCHIVE_DUAL_WRITE", kind: configBool},
+		{env: "ARCHIVE_RECORD_TTL", kind: configDuration},
+		{env: "ARCHIVE_CDR_TTL", kind: configDuration},
+		{env: "ARCHIVE_TIMEOUT", kind: configDuration},
+	}},
+	{name: "amqp", prefix: "AMQP_", keys: []configKey{
+		{env: "QUEUE_BACKEND", options: []string{"amqp", "rabbitmq", "nats", "redis", "memory"}},
+		{env: "QUEUE_MEMORY_SIZE", kind: configInt},
+		{env: "QUEUE_NATS_URL"},
+		{env: "QUEUE_NATS_STREAM"},
+		{env: "QUEUE_NATS_ACK_WAIT", kind: configDuration},
+		{env: "QUEUE_REDIS_URL", kind: configURL},
+		{env: "QUEUE_REDIS_PREFIX"},
+		{env: "QUEUE_REDIS_TIMEOUT", kind: configDuration},
+		{env: "QUEUE_REDIS_CLAIM_IDLE", kind: configDuration},
+		{env: "AMQP_SERVER_URL", kind: configURL},
+		{env: "AMQP_BUFFER_SIZE", kind: configInt},
+	}},
+	{name: "carriers", keys: []configKey{
+		{env: "TELNYX_MESSAGING_PROFILE_ID"},
+		{env: "TELNYX_PUBLIC_KEY"},
+		{env: "TELNYX_VALIDATE_SIGNATURE", kind: configBool},
+		{env: "TWILIO_VALIDATE_SIGNATURE", kind: configBool},
+		{env: "BANDWIDTH_VALIDATE_CALLBACKS", kind: configBool},
+		{env: "BANDWIDTH_ACCOUNT_ID"},
+		{env: "BANDWIDTH_APPLICATION_ID"},
+		{env: "VONAGE_VALIDATE_SIGNATURE", kind: configBool},
+		{env: "VONAGE_SIGNATURE_SECRET"},
+		{env: "WEBHOOK_IP_ALLOWLIST"},
+		{env: "WEBHOOK_TOLERANCE", kind: configDuration},
+		{env: "CARRIER_MESSAGE_RETENTION", kind: configDuration},
+		{env: "DLR_AGGREGATION_TIMEOUT", kind: configDuration},
+		{env: "MMS_UPGRADE_SEGMENTS", kind: configInt},
+		{env: "SMS_TRANSLITERATE", kind: configBool},
+		{env: "CARRIER_IDEMPOTENCY", kind: configBool},
+		{env: "CARRIER_SEND_LEASE", kind: configDuration},
+		{env: "INVALID_DESTINATION_TTL", kind: configDuration},
+	}},
+	{name: "lookup", prefix: "CARRIER_LOOKUP_", keys: []configKey{
+		{env: "CARRIER_LOOKUP", options: []string{"twilio", "http"}},
+		{env: "CARRIER_LOOKUP_URL"},
+		{env: "CARRIER_LOOKUP_USERNAME"},
+		{env: "CARRIER_LOOKUP_PASSWORD"},
+		{env: "CARRIER_LOOKUP_MAP"},
+		{env: "CARRIER_LOOKUP_TTL", kind: configDuration},
+		{env: "CARRIER_LOOKUP_TIMEOUT", kind: configDuration},
+		{env: "CARRIER_LOOKUP_RECONCILE_INTERVAL", kind: configDuration},
+		{env: "CARRIER_LOOKUP_UPDATE", kind: configBool},
+		{env: "NUMBER_SYNC_INTERVAL", kind: configDuration},
+		{env: "NUMBER_SYNC_TIMEOUT", kind: configDuration},
+		{env: "NUMBER_SYNC_IMPORT_CLIENT"},
+		{env: "NUMBER_VERIFICATION", kind: configBool},
+		{env: "NUMBER_VERIFICATION_TO"},
+		{env: "NUMBER_VERIFICATION_TIMEOUT", kind: configDuration},
+	}},
+	{name: "limits", keys: []configKey{
+		{env: "CARRIER_RATE", kind: configFloat},
+		{env: "CARRIER_NUMBER_RATE", kind: configFloat},
+		{env: "CARRIER_CONCURRENCY", kind: configInt},
+		{env: "CARRIER_RATE_MAX_WAIT", kind: configDuration},
+		{env: "CARRIER_RATE_SHARED", kind: configBool},
+		{env: "SUBMIT_DEDUP", kind: configBool},
+		{env: "SUBMIT_DEDUP_WINDOW", kind: configDuration},
+		{env: "ROUTER_QUEUE_SIZE", kind: configInt},
+	}},
+	{name: "retry", prefix: "RETRY_", keys: []configKey{
+		{env: "RETRY_INITIAL_DELAY", kind: configDuration},
+		{env: "RETRY_MULTIPLIER", kind: configFloat},
+		{env: "RETRY_JITTER", kind: configFloat},
+		{env: "RETRY_MAX_DELAY", kind: configDuration},
+		{env: "RETRY_MAX_ATTEMPTS", kind: configInt},
+		{env: "RETRY_CLASS_OVERRIDES", kind: configJSON},
+		{env: "DEAD_LETTER_MAX_ATTEMPTS", kind: configInt},
+	}},
+	{name: "routing", keys: []configKey{
+		{env: "ROUTER_LANES", kind: configInt},
+		{env: "ROUTER_LANE_BUFFER", kind: configInt},
+		{env: "ROUTER_CONVERSATION_ORDERING", kind: configBool},
+		{env: "ROUTER_MAX_HOPS", kind: configInt},
+		{env: "ROUTER_LOOP_WINDOW", kind: configDuration},
+		{env: "ROUTING_RULES_RELOAD_INTERVAL", kind: configDuration},
+		{env: "PROVISIONING_CHECK", options: []string{"warn", "strict", "off"}},
+		{env: "ROUTING_AUDIT", kind: configBool},
+		{env: "ROUTING_AUDIT_RETENTION", kind: configDuration},
+		{env: "SOURCE_MASK_RETENTION", kind: configDuration},
+		{env: "ROUTE_FAILURE_THRESHOLD", kind: configInt},
+		{env: "ROUTE_FAILURE_COOLDOWN", kind: configDuration},
+		{env: "ROUTE_ERROR_WINDOW", kind: configDuration},
+		{env: "ROUTE_ERROR_BUDGET", kind: configFloat},
+		{env: "ROUTE_ERROR_MIN_SAMPLES", kind: configInt},
+		{env: "ROUTE_HEALTH_INTERVAL", kind: configDuration},
+		{env: "STORE_FORWARD_INTERVAL", kind: configDuration},
+		{env: "MAINTENANCE_INTERVAL", kind: configDuration},
+		{env: "MESSAGE_TTL", kind: configDuration},
+		{env: "EXPIRY_SWEEP_INTERVAL", kind: configDuration},
+		{env: "SEND_TIMEOUT", kind: configDuration},
+		{env: "SCHEDULER_INTERVAL", kind: configDuration},
+	}},
+	{name: "cluster", prefix: "CLUSTER_", keys: []configKey{
+		{env: "CLUSTER_ENABLED", kind: configBool},
+		{env: "CLUSTER_HEARTBEAT", kind: configDuration},
+		{env: "CLUSTER_SESSION_TTL", kind: configDuration},
+	}},
+	{name: "cache", prefix: "CACHE_", keys: []configKey{
+		{env: "CACHE_BACKEND", options: []string{"local", "redis"}},
+		{env: "CACHE_SIZE", kind: configInt},
+		{env: "CACHE_TTL", kind: configDuration},
+		{env: "CACHE_REDIS_URL", kind: configURL},
+		{env: "CACHE_REDIS_PREFIX"},
+		{env: "CACHE_REDIS_TIMEOUT", kind: configDuration},
+	}},
+	{name: "ha", prefix: "HA_", keys: []configKey{
+		{env: "HA_ENABLED", kind: configBool},
+		{env: "HA_LEASE_TTL", kind: configDuration},
+		{env: "HA_LEASE_RENEW", kind: configDuration},
+	}},
+	{name: "upgrade", prefix: "UPGRADE_", keys: []configKey{
+		{env: "UPGRADE_TIMEOUT", kind: configDuration},
+		{env: "UPGRADE_DRAIN_TIMEOUT", kind: configDuration},
+		{env: "UPGRADE_PID_FILE"},
+	}},
+	{name: "mqtt", prefix: "MQTT_", keys: []configKey{
+		{env: "MQTT_BROKER", kind: configURL},
+		{env: "MQTT_USERNAME"},
+		{env: "MQTT_PASSWORD"},
+		{env: "MQTT_CLIENT_ID"},
+		{env: "MQTT_TOPIC_PREFIX"},
+		{env: "MQTT_QOS", options: []string{"0", "1", "2"}},
+		{env: "MQTT_TIMEOUT", kind: configDuration},
+	}},
+	{name: "logging", keys: []configKey{
+		{env: "LOG_FORMAT", options: []string{"json", "text"}},
+		{env: "LOKI_URL", kind: configURL},
+		{env: "LOKI_USERNAME"},
+		{env: "LOKI_PASSWORD"},
+	}},
+	{name: "telemetry", keys: []configKey{
+		{env: "HEALTH_CHECK_TIMEOUT", kind: configDuration},
+		{env: "OTEL_EXPORTER_OTLP_ENDPOINT", kind: configURL},
+		{env: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", kind: configURL},
+		{env: "OTEL_EXPORTER_OTLP_HEADERS"},
+		{env: "OTEL_SERVICE_NAME"},
+		{env: "OTEL_TRACES_SAMPLER_ARG", kind: configFloat},
+	}},
+	{name: "records", keys: []configKey{
+		{env: "CDR", kind: configBool},
+		{env: "CDR_RETENTION", kind: configDuration},
+		{env: "CDR_FILE"},
+		{env: "CDR_AMQP_EXCHANGE"},
+		{env: "CDR_AMQP_URL", kind: configURL},
+		{env: "CDR_KAFKA_REST_URL", kind: configURL},
+		{env: "CDR_KAFKA_TOPIC"},
+		{env: "USAGE_ROLLUP_INTERVAL", kind: configDuration},
+		{env: "USAGE_ROLLUP_LOOKBACK", kind: configDuration},
+		{env: "USAGE_CURRENCY"},
+		{env: "MESSAGE_ENVELOPES", kind: configBool},
+		{env: "MESSAGE_CONTENT", options: []string{"none", "redacted", "full"}},
+		{env: "MESSAGE_RETENTION", kind: configDuration},
+		{env: "AUDIT_LOG", kind: configBool},
+		{env: "AUDIT_RETENTION", kind: configDuration},
+		{env: "MESSAGE_BODY_RETENTION", kind: configDuration},
+		{env: "MESSAGE_RECORD_RETENTION", kind: configDuration},
+		{env: "MEDIA_RETENTION", kind: configDuration},
+		{env: "MEDIA_LINK_TTL", kind: configDuration},
+		{env: "MEDIA_LINK_SECRET"},
+		{env: "RETENTION_INTERVAL", kind: configDuration},
+	}},
+	{name: "policy", keys: []configKey{
+		{env: "INTERNATIONAL_POLICY", options: []string{"allow", "block", "flag"}},
+		{env: "EMERGENCY_BLOCK", kind: configBool},
+		{env: "EMERGENCY_NUMBERS"},
+		{env: "SPECIAL_SERVICE_NUMBERS"},
+		{env: "EMERGENCY_BOUNCE_REPLY"},
+	}},
+	{name: "content", prefix: "CONTENT_", keys: []configKey{
+		{env: "CONTENT_CLASSIFIER_URL", kind: configURL},
+		{env: "CONTENT_CLASSIFIER_SECRET"},
+		{env: "CONTENT_CLASSIFIER_TIMEOUT", kind: configDuration},
+		{env: "CONTENT_CLASSIFIER_FAILURE", options: []string{"flag", "quarantine", "block"}},
+	}},
+	{name: "keywords", keys: []configKey{
+		{env: "OPT_OUT_KEYWORDS", kind: configBool},
+		{env: "STOP_KEYWORDS"},
+		{env: "START_KEYWORDS"},
+		{env: "HELP_KEYWORDS"},
+		{env: "STOP_REPLY"},
+		{env: "START_REPLY"},
+		{env: "HELP_REPLY"},
+		{env: "AUTO_REPLY_INTERVAL", kind: configDuration},
+	}},
+	{name: "events", prefix: "EVENT_WEBHOOK_", keys: []configKey{
+		{env: "EVENT_WEBHOOK_INTERVAL", kind: configDuration},
+		{env: "EVENT_WEBHOOK_TIMEOUT", kind: configDuration},
+		{env: "EVENT_WEBHOOK_MAX_ATTEMPTS", kind: configInt},
+		{env: "EVENT_WEBHOOK_INITIAL_DELAY", kind: configDuration},
+		{env: "EVENT_WEBHOOK_MAX_DELAY", kind: configDuration},
+		{env: "EVENT_WEBHOOK_RETENTION", kind: configDuration},
+	}},
+	{name: "secrets", keys: []configKey{
+		{env: "SECRETS_REFRESH_INTERVAL", kind: configDuration},
+		{env: "VAULT_ADDR", kind: configURL},
+		{env: "VAULT_TOKEN"},
+		{env: "VAULT_TOKEN_FILE", kind: configFile},
+		{env: "VAULT_NAMESPACE"},
+		{env: "VAULT_KV_MOUNT"},
+		{env: "AWS_REGION"},
+		{env: "KMS_PROVIDER", options: []string{"local", "awskms"}},
+		{env: "KMS_KEY_ID"},
+		{env: "BODY_ENCRYPTION", kind: configBool},
+		{env: "BODY_DECRYPT_ROLES"},
+	}},
+	{name: "lockout", prefix: "BIND_LOCKOUT_", keys: []configKey{
+		{env: "BIND_LOCKOUT", kind: configBool},
+		{env: "BIND_LOCKOUT_FAILURES", kind: configInt},
+		{env: "BIND_LOCKOUT_IP_FAILURES", kind: configInt},
+		{env: "BIND_LOCKOUT_DURATION", kind: configDuration},
+		{env: "BIND_LOCKOUT_MAX", kind: configDuration},
+		{env: "BIND_LOCKOUT_RESET", kind: configDuration},
+	}},
+	{name: "radius", prefix: "RADIUS_", keys: []configKey{
+		{env: "RADIUS_SERVER", kind: configAddress},
+		{env: "RADIUS_SECRET"},
+		{env: "RADIUS_NAS_IDENTIFIER"},
+		{env: "RADIUS_TIMEOUT", kind: configDuration},
+		{env: "RADIUS_ATTEMPTS", kind: configInt},
+	}},
+	{name: "ldap", prefix: "LDAP_", keys: []configKey{
+		{env: "LDAP_URL", kind: configURL},
+		{env: "LDAP_BIND_DN"},
+		{env: "LDAP_START_TLS", kind: configBool},
+		{env: "LDAP_TIMEOUT", kind: configDuration},
+	}},
+	{name: "alerting", prefix: "ALERT_", keys: []configKey{
+		{env: "ALERT_INTERVAL", kind: configDuration},
+		{env: "ALERT_FOR", kind: configDuration},
+		{env: "ALERT_QUEUE_DEPTH", kind: configFloat},
+		{env: "ALERT_CARRIER_ERROR_RATE", kind: configFloat},
+		{env: "ALERT_DLR_FAILURE_RATE", kind: configFloat},
+		{env: "ALERT_DLR_WINDOW", kind: configDuration},
+		{env: "ALERT_DLR_MIN_MESSAGES", kind: configInt},
+		{env: "ALERT_BIND_LOSS", kind: configDuration},
+		{env: "ALERT_EMERGENCY_WINDOW", kind: configDuration},
+		{env: "ALERT_SMTP_ADDR", kind: configAddress},
+		{env: "ALERT_SMTP_USERNAME"},
+		{env: "ALERT_SMTP_PASSWORD"},
+		{env: "ALERT_EMAIL_FROM"},
+		{env: "ALERT_EMAIL_TO"},
+		{env: "ALERT_SLACK_WEBHOOK_URL", kind: configURL},
+		{env: "ALERT_PAGERDUTY_ROUTING_KEY"},
+		{env: "ALERT_PAGERDUTY_SEVERITY", options: []string{"critical", "error", "warning", "info"}},
+	}},
+	{name: "anomaly", prefix: "ANOMALY_", keys: []configKey{
+		{env: "ANOMALY_WINDOW", kind: configDuration},
+		{env: "ANOMALY_BASELINE_WINDOWS", kind: configInt},
+		{env: "ANOMALY_MIN_MESSAGES", kind: configInt},
+		{env: "ANOMALY_SPIKE_FACTOR", kind: configFloat},
+		{env: "ANOMALY_DESTINATION_SHARE", kind: configFloat},
+		{env: "ANOMALY_DUPLICATE_RECIPIENTS", kind: configFloat},
+		{env: "ANOMALY_ACTION", options: []string{"alert", "throttle"}},
+		{env: "ANOMALY_THROTTLE_RATE", kind: configFloat},
+	}},
+}
+
+// Config is the settings of a gateway by variable, see LoadConfig.
+type Config struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// LoadConfig reads the settings from the environment, .env and CONFIG_FILE, neither file overrides
+// a variable that is already set, and replaces secret references with their secrets. It checks
+// every setting and reports all that are missing or invalid at once.
+func LoadConfig() (*Config, error) {
+	cfg := &Config{values: make(map[string]string)}
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		cfg.values[key] = value
+	}
+	if dotenv, err := godotenv.Read(); err == nil {
+		for key, value := range dotenv {
+			if _, ok := cfg.values[key]; !ok {
+				cfg.values[key] = value
+			}
+		}
+	}
+
+	var errs []error
+	if path := cfg.values["CONFIG_FILE"]; path != "" {
+		values, fileErrs := readConfigFile(path)
+		errs = append(errs, fileErrs...)
+		for key, value := range values {
+			// empty counts as unset, like everywhere the settings are read
+			if cfg.values[key] == "" {
+				cfg.values[key] = value
+			}
+		}
+	}
+	errs = append(errs, cfg.resolveSecrets()...)
+
+	if err := cfg.validate(errs); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Getenv returns the setting of a variable, empty when it isn't set.
+func (cfg *Config) Getenv(key string) string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.values[key]
+}
+
+func (cfg *Config) set(key string, value string) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.values[key] = value
+}
+
+// String returns the setting of a variable, def when it isn't set.
+func (cfg *Config) String(key string, def string) string {
+	if value := cfg.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// Int returns the setting of a variable as a positive number, def when it isn't one.
+func (cfg *Config) Int(key string, def int) int {
+	if v, err := strconv.Atoi(cfg.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// Duration returns the setting of a variable as a positive duration, def when it isn't one.
+func (cfg *Config) Duration(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(cfg.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// Float returns the setting of a variable as a positive number, def when it isn't one.
+func (cfg *Config) Float(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(cfg.Getenv(key), 64); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+var (
+	// settings is the config the gateway runs with, see Configure.
+	settings = &Config{}
+	// configurers set the settings of the packages, see OnConfigure.
+	configurers []func(cfg *Config)
+)
+
+// OnConfigure registers a function that sets the settings of a package from the config, packages
+// register from init. Nothing reads the settings before Configure.
+func OnConfigure(configure func(cfg *Config)) {
+	configurers = append(configurers, configure)
+}
+
+// Configure makes cfg the config the gateway runs with, and sets the settings of every package
+// from it.
+func Configure(cfg *Config) {
+	settings = cfg
+	for _, configure := range configurers {
+		configure(cfg)
+	}
+}
+
+// Getenv reads a setting of the config the gateway runs with.
+func Getenv(key string) string {
+	return settings.Getenv(key)
+}
+
+func EnvString(key string, def string) string {
+	return settings.String(key, def)
+}
+
+func EnvInt(key string, def int) int {
+	return settings.Int(key, def)
+}
+
+func EnvDuration(key string, def time.Duration) time.Duration {
+	return settings.Duration(key, def)
+}
+
+func EnvFloat(key string, def float64) float64 {
+	return settings.Float(key, def)
+}
+
+// readConfigFile reads the variables set by a config file, as far as they are valid keys.
+func readConfigFile(path string) (map[string]string, []error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []error{fmt.Errorf("config file: %w", err)}
+	}
+
+	var sections map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &sections)
+	case ".toml":
+		err = toml.Unmarshal(data, &sections)
+	default:
+		return nil, []error{fmt.Errorf("config file %s: unknown format, use .yaml, .yml or .toml", path)}
+	}
+	if err != nil {
+		return nil, []error{fmt.Errorf("config file %s: %w", path, err)}
+	}
+
+	values := make(map[string]string)
+	var errs []error
+	for name, raw := range sections {
+		section := configSectionNamed(name)
+		if section == nil {
+			errs = append(errs, fmt.Errorf("config file: unknown section %s", name))
+			continue
+		}
+		keys, ok := raw.(map[string]interface{})
+		if !ok && raw != nil {
+			errs = append(errs, fmt.Errorf("config file: section %s is not a table of keys", name))
+			continue
+		}
+		for fileKey, value := range keys {
+			key := section.keyNamed(fileKey)
+			if key == nil {
+				errs = append(errs, fmt.Errorf("config file: unknown key %s.%s", name, fileKey))
+				continue
+			}
+			switch value.(type) {
+			case map[string]interface{}, []interface{}:
+				if key.kind != configJSON {
+					errs = append(errs, fmt.Errorf("config file: %s.%s must be a single value", name, fileKey))
+					continue
+				}
+				encoded, _ := json.Marshal(value)
+				values[key.env] = string(encoded)
+			case nil:
+			default:
+				values[key.env] = fmt.Sprint(value)
+			}
+		}
+	}
+	return values, errs
+}
+
+func configSectionNamed(name string) *configSection {
+	for i := range configSchema {
+		if configSchema[i].name == name {
+			return &configSchema[i]
+		}
+	}
+	return nil
+}
+
+func (section *configSection) keyNamed(fileKey string) *configKey {
+	for i, key := range section.keys {
+		if strings.ToLower(strings.TrimPrefix(key.env, section.prefix)) == fileKey {
+			return &section.keys[i]
+		}
+	}
+	return nil
+}
+
+// validate checks every setting, errs are the errors found reading them.
+func (cfg *Config) validate(errs []error) error {
+	for _, section := range configSchema {
+		for _, key := range section.keys {
+			value := cfg.Getenv(key.env)
+			if value == "" {
+				if key.required {
+					errs = append(errs, fmt.Errorf("%s is required", key.env))
+				}
+				continue
+			}
+			if err := key.check(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key.env, err))
+			}
+		}
+	}
+
+	if cfg.Getenv("CLUSTER_ENABLED") == "true" {
+		if cfg.Getenv("SERVER_ID") == "" {
+			errs = append(errs, fmt.Errorf("CLUSTER_ENABLED needs a SERVER_ID unique to the instance"))
+		}
+		if cfg.Getenv("QUEUE_BACKEND") == "memory" {
+			errs = append(errs, fmt.Errorf("CLUSTER_ENABLED needs a shared queue, QUEUE_BACKEND can't be memory"))
+		}
+	}
+
+	if cfg.Getenv("HA_ENABLED") == "true" {
+		if cfg.Getenv("SERVER_ID") == "" {
+			errs = append(errs, fmt.Errorf("HA_ENABLED needs a SERVER_ID unique to the instance"))
+		}
+		if cfg.Getenv("CLUSTER_ENABLED") == "true" {
+			errs = append(errs, fmt.Errorf("HA_ENABLED and CLUSTER_ENABLED can't be set together"))
+		}
+		if ttl, renew := haLease(cfg); renew >= ttl {
+			errs = append(errs, fmt.Errorf("HA_LEASE_RENEW must be shorter than HA_LEASE_TTL"))
+		}
+	}
+
+	if cfg.Getenv("STORAGE_BACKEND") == "file" {
+		if cfg.Getenv("STORAGE_FILE") == "" {
+			errs = append(errs, fmt.Errorf("STORAGE_BACKEND file needs a STORAGE_FILE"))
+		}
+		for _, env := range []string{"CLUSTER_ENABLED", "HA_ENABLED", "BODY_ENCRYPTION", "CARRIER_IDEMPOTENCY"} {
+			if cfg.Getenv(env) == "true" {
+				errs = append(errs, fmt.Errorf("%s needs the postgres storage backend", env))
+			}
+		}
+	}
+
+	if cfg.Getenv("ARCHIVE_BACKEND") == "mongodb" && cfg.Getenv("ARCHIVE_MONGODB_URI") == "" {
+		errs = append(errs, fmt.Errorf("ARCHIVE_BACKEND mongodb needs an ARCHIVE_MONGODB_URI"))
+	}
+
+	if cfg.Getenv("QUEUE_BACKEND") == "redis" && cfg.Getenv("QUEUE_REDIS_URL") == "" {
+		errs = append(errs, fmt.Errorf("QUEUE_BACKEND redis needs a QUEUE_REDIS_URL"))
+	}
+
+	if cfg.Getenv("CACHE_BACKEND") == "redis" && cfg.Getenv("CACHE_REDIS_URL") == "" {
+		errs = append(errs, fmt.Errorf("CACHE_BACKEND redis needs a CACHE_REDIS_URL"))
+	}
+
+	for _, pair := range [][2]string{{"WEB_TLS_CERT", "WEB_TLS_KEY"}, {"SMPP_TLS_CERT", "SMPP_TLS_KEY"}} {
+		if (cfg.Getenv(pair[0]) == "") != (cfg.Getenv(pair[1]) == "") {
+			errs = append(errs, fmt.Errorf("%s and %s must be set together", pair[0], pair[1]))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = "  " + err.Error()
+	}
+	sort.Strings(messages)
+	return fmt.Errorf("invalid configuration:\n%s", strings.Join(messages, "\n"))
+}
+
+func (key configKey) check(value string) error {
+	if len(key.options) > 0 && !StringInArray(value, key.options) {
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(key.options, ", "))
+	}
+
+	var err error
+	switch key.kind {
+	case configInt:
+		_, err = strconv.Atoi(value)
+	case configFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case configDuration:
+		_, err = time.ParseDuration(value)
+	case configBool:
+		if value != "true" && value != "false" {
+			err = fmt.Errorf("%q is not true or false", value)
+		}
+	case configAddress:
+		_, _, err = net.SplitHostPort(value)
+	case configURL:
+		var u *url.URL
+		if u, err = url.Parse(value); err == nil && (u.Scheme == "" || u.Host == "") {
+			err = fmt.Errorf("%q is not an absolute URL", value)
+		}
+	case configFile:
+		_, err = os.Stat(value)
+	case configJSON:
+		if !json.Valid([]byte(value)) {
+			err = fmt.Errorf("not valid JSON")
+		}
+	}
+	return err
+}
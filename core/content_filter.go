@@ -0,0 +1,177 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ContentRule screens the text of outbound messages before they are queued for a carrier, so
+// content the carriers forbid (SHAFT: sex, hate, alcohol, firearms, tobacco) doesn't get the
+// numbers suspended. Rules of a tenant only screen the messages of its clients.
+type ContentRule struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	Name     string `json:"name"`
+	Position int    `gorm:"index" json:"position"`
+	Disabled bool   `json:"disabled"`
+	TenantID uint   `gorm:"index" json:"tenant_id"`
+	ClientID uint   `json:"client_id"` // 0 screens the messages of every client
+
+	Kind     string `json:"kind"`     // keywords, regex or url_shortener
+	Pattern  string `json:"pattern"`  // comma separated keywords, a regular expression, or shortener domains
+	Action   string `json:"action"`   // block, quarantine or flag
+	Category string `json:"category"` // e.g. sex, hate, alcohol, firearms, tobacco, reported with the verdict
+
+	Version uint `gorm:"not null;default:1" json:"version"`
+
+	regex   *regexp.Regexp
+	domains []string
+}
+
+var ContentRuleKinds = struct {
+	Keywords     string
+	Regex        string
+	URLShortener string
+}{
+	Keywords:     "keywords",
+	Regex:        "regex",
+	URLShortener: "url_shortener",
+}
+
+// What happens to a message a rule or the classifier matches, the most severe verdict wins.
+var ContentActions = struct {
+	Allow      string
+	Flag       string
+	Quarantine string
+	Block      string
+}{
+	Allow:      "",
+	Flag:       "flag",       // sent, and logged, counted and reported as an event
+	Quarantine: "quarantine", // held until it is released or rejected through the API
+	Block:      "block",      // dead-lettered, the client gets a REJECTD receipt
+}
+
+var ContentActionSeverity = map[string]int{
+	ContentActions.Allow:      0,
+	ContentActions.Flag:       1,
+	ContentActions.Quarantine: 2,
+	ContentActions.Block:      3,
+}
+
+// defaultShortenerDomains are checked by url_shortener rules without a pattern, carriers treat
+// public shorteners as a spam signal.
+var defaultShortenerDomains = []string{
+	"bit.ly", "tinyurl.com", "goo.gl", "t.co", "ow.ly", "is.gd", "buff.ly", "rebrand.ly", "cutt.ly",
+	"shorturl.at", "tiny.cc", "rb.gy", "t.ly", "bl.ink", "short.io", "s.id",
+}
+
+// urlPattern finds the links of a message, with or without a scheme, the host is the first group.
+var urlPattern = regexp.MustCompile(`(?i)(?:https?://)?((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,})(?:[/?#][^\s]*)?`)
+
+// MessageHosts returns the lower case hosts of the links of a message.
+func MessageHosts(text string) []string {
+	var hosts []string
+	for _, match := range urlPattern.FindAllStringSubmatch(text, -1) {
+		hosts = append(hosts, strings.ToLower(match[1]))
+	}
+	return hosts
+}
+
+// Compile validates the rule and prepares its expression or domains.
+func (rule *ContentRule) Compile() error {
+	if _, ok := ContentActionSeverity[rule.Action]; !ok || rule.Action == ContentActions.Allow {
+		return fmt.Errorf("invalid action %q, must be block, quarantine or flag", rule.Action)
+	}
+	var err error
+	switch rule.Kind {
+	case ContentRuleKinds.Keywords:
+		var words []string
+		for _, word := range strings.Split(rule.Pattern, ",") {
+			if word = strings.TrimSpace(word); word != "" {
+				words = append(words, regexp.QuoteMeta(word))
+			}
+		}
+		if len(words) == 0 {
+			return fmt.Errorf("keywords rules need a pattern")
+		}
+		// whole words or phrases, ignoring case
+		rule.regex = regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+	case ContentRuleKinds.Regex:
+		if rule.Pattern == "" {
+			return fmt.Errorf("regex rules need a pattern")
+		}
+		if rule.regex, err = regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+	case ContentRuleKinds.URLShortener:
+		rule.domains = nil
+		for _, domain := range strings.Split(rule.Pattern, ",") {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				rule.domains = append(rule.domains, domain)
+			}
+		}
+		if len(rule.domains) == 0 {
+			rule.domains = defaultShortenerDomains
+		}
+	default:
+		return fmt.Errorf("invalid kind %q, must be keywords, regex or url_shortener", rule.Kind)
+	}
+	return nil
+}
+
+// Match returns what of the text the rule matched, or an empty string.
+func (rule *ContentRule) Match(text string) string {
+	if rule.Kind == ContentRuleKinds.URLShortener {
+		for _, host := range MessageHosts(text) {
+			for _, domain := range rule.domains {
+				if host == domain || strings.HasSuffix(host, "."+domain) {
+					return host
+				}
+			}
+		}
+		return ""
+	}
+	return rule.regex.FindString(text)
+}
+
+// AppliesTo reports whether the rule screens the messages of the client.
+func (rule *ContentRule) AppliesTo(client *Client) bool {
+	if rule.Disabled {
+		return false
+	}
+	if rule.TenantID != 0 && rule.TenantID != ClientTenantID(client) {
+		return false
+	}
+	return rule.ClientID == 0 || (client != nil && rule.ClientID == client.ID)
+}
+
+// QuarantinedMessage is an outbound message held by a quarantine verdict until it is released to
+// its carrier or rejected.
+type QuarantinedMessage struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	MessageID  string     `gorm:"index" json:"message_id"` // the LogID of the message
+	ClientID   uint       `gorm:"index" json:"client_id"`
+	TenantID   uint       `gorm:"index" json:"tenant_id"`
+	From       string     `json:"from_number"`
+	To         string     `json:"to_number"`
+	Type       string     `json:"type"`
+	Message    string     `json:"message"`
+	Rule       string     `json:"rule"`
+	Category   string     `json:"category"`
+	Reason     string     `json:"reason"`
+	Status     string     `gorm:"index" json:"status"`
+	Payload    string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+}
+
+var QuarantineStatuses = struct {
+	Held     string
+	Released string
+	Rejected string
+}{
+	Held:     "held",
+	Released: "released",
+	Rejected: "rejected",
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+)
+
+// reencrypt encrypts a stored credential again when it predates envelope encryption or was
+// encrypted by another key manager than the current one, changed is false when it is current.
+func (gateway *Gateway) reencrypt(stored string) (value string, changed bool, err error) {
+	if gateway.Keys.isCurrent(stored) {
+		return stored, false, nil
+	}
+	plaintext, err := gateway.decryptSecret(stored)
+	if err != nil {
+		return "", false, err
+	}
+	value, err = gateway.encryptSecret(plaintext)
+	return value, err == nil, err
+}
+
+// MigrateCredentials moves the stored credentials to their current format: client passwords are
+// hashed, the other credentials encrypted with the key manager of KMS_PROVIDER. Rows already in
+// that format are left alone, so it runs on every start.
+func (gateway *Gateway) MigrateCredentials() error {
+	migrated := 0
+
+	var clients []Client
+	if err := gateway.DB.Find(&clients).Error; err != nil {
+		return err
+	}
+	for _, client := range clients {
+		updates := make(map[string]interface{})
+		username, changed, err := gateway.reencrypt(client.Username)
+		if err != nil {
+			return fmt.Errorf("failed to migrate username of client %d: %w", client.ID, err)
+		}
+		if changed {
+			updates["username"] = username
+		}
+		// passwords that are secret references stay encrypted, they are resolved again on rotation
+		if !isPasswordHash(client.Password) && !gateway.Keys.isCurrent(client.Password) {
+			password, err := gateway.decryptSecret(client.Password)
+			if err != nil {
+				return fmt.Errorf("failed to migrate password of client %d: %w", client.ID, err)
+			}
+			if updates["password"], err = gateway.storedPassword(password); err != nil {
+				return err
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		if err := gateway.DB.Model(&Client{}).Where("id = ?", client.ID).UpdateColumns(updates).Error; err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	var carriers []Carrier
+	if err := gateway.DB.Find(&carriers).Error; err != nil {
+		return err
+	}
+	for _, carrier := range carriers {
+		updates := make(map[string]interface{})
+		for column, stored := range map[string]string{"username": carrier.Username, "password": carrier.Password} {
+			value, changed, err := gateway.reencrypt(stored)
+			if err != nil {
+				return fmt.Errorf("failed to migrate %s of carrier %s: %w", column, carrier.Name, err)
+			}
+			if changed {
+				updates[column] = value
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		if err := gateway.DB.Model(&Carrier{}).Where("id = ?", carrier.ID).UpdateColumns(updates).Error; err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	var subs []EventSubscription
+	if err := gateway.DB.Find(&subs).Error; err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		secret, changed, err := gateway.reencrypt(sub.Secret)
+		if err != nil {
+			return fmt.Errorf("failed to migrate the secret of event subscription %d: %w", sub.ID, err)
+		}
+		if !changed {
+			continue
+		}
+		if err := gateway.DB.Model(&EventSubscription{}).Where("id = ?", sub.ID).UpdateColumn("secret", secret).Error; err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"System.Migration",
+			"CredentialsMigrated",
+			logrus.InfoLevel,
+			nil, migrated,
+		))
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"time"
+)
+
+const (
+	DeadLetterQueue    = "dead_letter"
+	deadLetterExchange = "dead_letter"
+
+	DefaultMaxAttempts = 10
+)
+
+// DeadLetter is a message that could not be delivered and was parked for an operator to
+// inspect, edit, re-queue or purge.
+type DeadLetter struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	LogID     string    `gorm:"index" json:"log_id"`
+	Queue     string    `json:"queue"` // the queue the message was consumed from, "client" or "carrier"
+	Type      string    `json:"type"`  // "mms" or "sms"
+	From      string    `json:"from_number"`
+	To        string    `json:"to_number"`
+	Reason    string    `json:"reason"`
+	Attempts  int       `json:"attempts"`
+	Payload   string    `json:"payload"` // raw MsgQueueItem JSON as it was published
+	ServerID  string    `json:"server_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NewDeadLetterFromDelivery builds a DeadLetter from a delivery on the dead letter queue. The raw
+// body is always kept, even if it can't be decoded as a MsgQueueItem.
+func NewDeadLetterFromDelivery(delivery QueueDelivery) *DeadLetter {
+	deadLetter := &DeadLetter{
+		Payload: string(delivery.Body),
+	}
+
+	if msg, err := DecodeMsgQueueItem(delivery.Body); err == nil {
+		deadLetter.LogID = msg.LogID
+		deadLetter.Type = string(msg.Type)
+		deadLetter.From = msg.From
+		deadLetter.To = msg.To
+		deadLetter.Attempts = msg.Attempts
+	} else {
+		deadLetter.LogID = LogIDFromHeaders(delivery.Headers)
+		deadLetter.Reason = fmt.Sprintf("undecodable payload: %v", err)
+	}
+
+	if queue, ok := delivery.Headers["x-origin-queue"].(string); ok {
+		deadLetter.Queue = queue
+	}
+	if reason, ok := delivery.Headers["x-dead-letter-reason"].(string); ok {
+		deadLetter.Reason = reason
+	}
+
+	// messages routed through the exchange by RabbitMQ carry the x-death header instead
+	if deaths, ok := delivery.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(map[string]interface{}); ok {
+			if queue, ok := death["queue"].(string); ok && deadLetter.Queue == "" {
+				deadLetter.Queue = queue
+			}
+			if reason, ok := death["reason"].(string); ok && deadLetter.Reason == "" {
+				deadLetter.Reason = reason
+			}
+		}
+	}
+
+	return deadLetter
+}
+
+// DeadLetterUpdate holds the editable fields of a dead-lettered message.
+type DeadLetterUpdate struct {
+	To      *string `json:"to_number"`
+	From    *string `json:"from_number"`
+	Message *string `json:"message"`
+	Queue   *string `json:"queue"`
+}
+
+// ListDeadLetters returns dead letters, newest first, optionally filtered by queue and type.
+func (gateway *Gateway) ListDeadLetters(queue string, msgType string, limit int) ([]DeadLetter, error) {
+	var deadLetters []DeadLetter
+
+	query := gateway.DB.Order("id desc")
+	if queue != "" {
+		query = query.Where("queue = ?", queue)
+	}
+	if msgType != "" {
+		query = query.Where("type = ?", msgType)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	if err := query.Find(&deadLetters).Error; err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+func (gateway *Gateway) GetDeadLetter(id uint) (*DeadLetter, error) {
+	var deadLetter DeadLetter
+	if err := gateway.DB.First(&deadLetter, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("dead letter not found: %d", id)
+		}
+		return nil, fmt.Errorf("failed to retrieve dead letter: %v", err)
+	}
+	return &deadLetter, nil
+}
+
+// UpdateDeadLetter applies the edits to the stored payload so a re-queue picks them up.
+func (gateway *Gateway) UpdateDeadLetter(id uint, update DeadLetterUpdate) (*DeadLetter, error) {
+	deadLetter, err := gateway.GetDeadLetter(id)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := gateway.DecodePayload(deadLetter.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode dead letter payload: %v", err)
+	}
+
+	if update.To != nil {
+		msg.To = *update.To
+		deadLetter.To = *update.To
+	}
+	if update.From != nil {
+		msg.From = *update.From
+		deadLetter.From = *update.From
+	}
+	if update.Message != nil {
+		msg.Message = *update.Message
+	}
+	if update.Queue != nil {
+		deadLetter.Queue = *update.Queue
+	}
+
+	payload, err := EncodeMsgQueueItem(msg)
+	if err != nil {
+		return nil, err
+	}
+	if deadLetter.Payload, err = gateway.SealPayload(&msg, payload); err != nil {
+		return nil, err
+	}
+
+	if err := gateway.DB.Save(deadLetter).Error; err != nil {
+		return nil, err
+	}
+	return deadLetter, nil
+}
+
+// RequeueDeadLetter publishes the dead-lettered message back onto its origin queue with a fresh
+// attempt count and removes it from the dead letter table.
+func (gateway *Gateway) RequeueDeadLetter(id uint) error {
+	deadLetter, err := gateway.GetDeadLetter(id)
+	if err != nil {
+		return err
+	}
+
+	if deadLetter.Queue != "client" && deadLetter.Queue != "carrier" {
+		return fmt.Errorf("dead letter %d has no valid origin queue: %q", id, deadLetter.Queue)
+	}
+
+	msg, err := gateway.DecodePayload(deadLetter.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to decode dead letter payload: %v", err)
+	}
+	msg.Attempts = 0
+	msg.QueuedTimestamp = time.Now()
+
+	payload, err := EncodeMsgQueueItem(msg)
+	if err != nil {
+		return err
+	}
+
+	if err := gateway.Queue.PublishWithHeaders(context.Background(), deadLetter.Queue, payload, MessageHeaders(msg, nil)); err != nil {
+		return err
+	}
+
+	gateway.LogManager.SendLog(gateway.LogManager.BuildLog(
+		"DeadLetter.Requeue",
+		fmt.Sprintf("Re-queued dead letter %d to %s", id, deadLetter.Queue),
+		logrus.InfoLevel,
+		map[string]interface{}{
+			"logID": deadLetter.LogID,
+		},
+	))
+
+	return gateway.DB.Delete(&DeadLetter{}, id).Error
+}
+
+// PurgeDeadLetters deletes dead letters matching the filter and returns the number removed.
+func (gateway *Gateway) PurgeDeadLetters(queue string, msgType string) (int64, error) {
+	query := gateway.DB.Where("1 = 1")
+	if queue != "" {
+		query = query.Where("queue = ?", queue)
+	}
+	if msgType != "" {
+		query = query.Where("type = ?", msgType)
+	}
+
+	result := query.Delete(&DeadLetter{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// CarrierMessage maps the ID a carrier assigned to a message it accepted back to the message, so
+// status callbacks can be reported to the client that submitted it.
+type CarrierMessage struct {
+	ID                uint      `gorm:"primaryKey" json:"id"`
+	Carrier           string    `gorm:"uniqueIndex:idx_carrier_message" json:"carrier"`
+	CarrierMessageID  string    `gorm:"uniqueIndex:idx_carrier_message" json:"carrier_message_id"`
+	LogID             string    `gorm:"index" json:"log_id"`
+	Type              string    `json:"type"`
+	From              string    `json:"from_number"`
+	To                string    `json:"to_number"`
+	Status            string    `json:"status"`
+	ErrorCode         string    `json:"error_code,omitempty"`
+	ErrorClass        string    `json:"error_class,omitempty"`
+	ReceivedTimestamp time.Time `json:"received_timestamp"`
+	SkipReceipt       bool      `json:"skip_receipt,omitempty"` // see MsgQueueItem.SkipReceipt
+	Mirror            bool      `json:"mirror,omitempty"`       // a copy sent to a mirror route, its status is only recorded
+	// Segments is the number of parts of a message sent as concatenated SMS, every part has a
+	// record with the carrier ID of the first part as MultipartID and the client gets one receipt
+	// for all of them. Aggregated is set on the parts once it was sent.
+	Segments    int       `json:"segments,omitempty"`
+	MultipartID string    `gorm:"index" json:"multipart_id,omitempty"`
+	Aggregated  bool      `json:"aggregated,omitempty"`
+	CreatedAt   time.Time `gorm:"index" json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Delivery statuses reported by carriers, each carrier maps its own statuses onto these.
+var DeliveryStatuses = struct {
+	Queued      string
+	Sent        string
+	Delivered   string
+	Failed      string
+	Undelivered string
+}{
+	Queued:      "queued",
+	Sent:        "sent",
+	Delivered:   "delivered",
+	Failed:      "failed",
+	Undelivered: "undelivered",
+}
+
+var carrierMessageRetention time.Duration
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		carrierMessageRetention = cfg.Duration("CARRIER_MESSAGE_RETENTION", 7*24*time.Hour)
+	})
+}
+
+// FinalDeliveryStatuses are reported to the client, earlier statuses are only recorded. A final
+// status is never replaced.
+var FinalDeliveryStatuses = []string{DeliveryStatuses.Delivered, DeliveryStatuses.Failed, DeliveryStatuses.Undelivered}
+
+// FinalDeliveryStatus reports whether the status is one of finalDeliveryStatuses.
+func FinalDeliveryStatus(status string) bool {
+	return StringInArray(status, FinalDeliveryStatuses)
+}
+
+// TrackCarrierMessage records the carrier ID of a message that was sent, failures are only
+// logged since the message itself was delivered to the carrier.
+func (gateway *Gateway) TrackCarrierMessage(carrier string, carrierMessageID string, msg *MsgQueueItem) {
+	gateway.TrackCarrierSegment(carrier, carrierMessageID, msg, 1, "")
+}
+
+// TrackCarrierSegment records the carrier ID of a part of a message sent in segments, multipartID
+// is the carrier ID of its first part.
+func (gateway *Gateway) TrackCarrierSegment(carrier string, carrierMessageID string, msg *MsgQueueItem, segments int, multipartID string) {
+	if carrierMessageID == "" {
+		return
+	}
+	if msg.CarrierMessageID == "" {
+		msg.CarrierMessageID = carrierMessageID
+	}
+	record := &CarrierMessage{
+		Carrier:           carrier,
+		CarrierMessageID:  carrierMessageID,
+		LogID:             msg.LogID,
+		Type:              string(msg.Type),
+		From:              msg.From,
+		To:                msg.To,
+		Status:            DeliveryStatuses.Queued,
+		ReceivedTimestamp: msg.ReceivedTimestamp,
+		SkipReceipt:       msg.SkipReceipt,
+	}
+	if segments > 1 {
+		record.Segments, record.MultipartID = segments, multipartID
+	}
+	record.Mirror = msg.Mirrored
+	if msg.SubmittedAs != "" {
+		// the receipt goes back the way the message came
+		record.Type = string(msg.SubmittedAs)
+	}
+	err := gateway.DB.Create(record).Error
+	if err != nil {
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Track",
+			"GenericError",
+			logrus.ErrorLevel,
+			gateway.MsgFields(msg, map[string]interface{}{
+				"carrier": carrier,
+			}), err,
+		))
+	}
+}
+
+// PurgeCarrierMessages removes carrier message mappings and carrier sends older than
+// CARRIER_MESSAGE_RETENTION.
+func (gateway *Gateway) PurgeCarrierMessages() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		gateway.DB.Where("created_at < ?", time.Now().Add(-carrierMessageRetention)).Delete(&CarrierMessage{})
+		gateway.DB.Where("created_at < ?", time.Now().Add(-carrierMessageRetention)).Delete(&CarrierSend{})
+	}
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Emergency and special service numbers can't be texted through the gateway, the carriers reject
+// such messages or deliver them nowhere. Messages to them are rejected before they reach a
+// carrier, the sender gets a bounce-back message telling it to call instead.
+var (
+	emergencyBlockEnabled bool
+
+	emergencyNumbers      map[string]bool
+	specialServiceNumbers map[string]bool
+
+	EmergencyBounceReply string
+
+	// a blocked message keeps the alert of its client firing this long
+	alertEmergencyWindow time.Duration
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		emergencyBlockEnabled = cfg.Getenv("EMERGENCY_BLOCK") != "false"
+		emergencyNumbers = numberSet(cfg.String("EMERGENCY_NUMBERS", "911,112,999,000,988"))
+		specialServiceNumbers = numberSet(cfg.String("SPECIAL_SERVICE_NUMBERS", "211,311,411,511,611,711,811"))
+		EmergencyBounceReply = cfg.String("EMERGENCY_BOUNCE_REPLY", "Texting {number} is not supported. Please make a voice call to {number}.")
+		alertEmergencyWindow = alertDuration(cfg, "ALERT_EMERGENCY_WINDOW", time.Hour)
+	})
+}
+
+// emergencyBlocks are the messages to emergency numbers blocked per client, for its alert.
+var emergencyBlocks = struct {
+	mu      sync.Mutex
+	clients map[string]*emergencyBlock
+}{
+	clients: make(map[string]*emergencyBlock),
+}
+
+type emergencyBlock struct {
+	count  int
+	number string
+	last   time.Time
+}
+
+// BlockEmergency records a message of a client to an emergency number that was blocked.
+func BlockEmergency(client string, number string) {
+	emergencyBlocks.mu.Lock()
+	defer emergencyBlocks.mu.Unlock()
+	block, ok := emergencyBlocks.clients[client]
+	if !ok {
+		block = &emergencyBlock{}
+		emergencyBlocks.clients[client] = block
+	}
+	block.count++
+	block.number, block.last = number, time.Now()
+}
+
+func numberSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, number := range strings.Split(list, ",") {
+		if number = strings.TrimPrefix(strings.TrimSpace(number), "+"); number != "" {
+			set[number] = true
+		}
+	}
+	return set
+}
+
+// EmergencyService names the service of a number messages can't go to, "emergency" or "special
+// service", empty for other numbers.
+func EmergencyService(number string) string {
+	if !emergencyBlockEnabled {
+		return ""
+	}
+	key := NumberKey(number)
+	switch {
+	case emergencyNumbers[key]:
+		return "emergency"
+	case specialServiceNumbers[key]:
+		return "special service"
+	}
+	return ""
+}
+
+// emergencyConditions are the clients that sent to an emergency number in the last
+// ALERT_EMERGENCY_WINDOW. They fire at the first evaluation, someone may be trying to reach help.
+func emergencyConditions(now time.Time) []alertCondition {
+	var conditions []alertCondition
+	emergencyBlocks.mu.Lock()
+	defer emergencyBlocks.mu.Unlock()
+	for username, block := range emergencyBlocks.clients {
+		if now.Sub(block.last) > alertEmergencyWindow {
+			delete(emergencyBlocks.clients, username)
+			continue
+		}
+		conditions = append(conditions, alertCondition{
+			rule: AlertRules.EmergencyBlocked, subject: username, value: float64(block.count), threshold: 1,
+			summary: fmt.Sprintf("Client %s sent %d messages to emergency or special service numbers, the last to %s at %s",
+				username, block.count, block.number, block.last.UTC().Format(time.RFC3339)),
+		})
+	}
+	return conditions
+}
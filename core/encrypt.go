@@ -1,16 +1,58 @@
 // encrypt.go
-package main
+
+package core
 
 import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
+	"golang.org/x/crypto/bcrypt"
 	"io"
+	"strings"
 )
 
-// EncryptPassword encrypts a plaintext password using AES-256 with the provided PSK.
+// encryptSecret encrypts a credential for the database with envelope encryption, see keyRing.
+func (gateway *Gateway) encryptSecret(plaintext string) (string, error) {
+	return gateway.Keys.encrypt(plaintext)
+}
+
+// decryptSecret decrypts a credential read from the database, values stored before envelope
+// encryption are decrypted with the legacy PSK until migrateCredentials encrypts them again.
+func (gateway *Gateway) decryptSecret(stored string) (string, error) {
+	if strings.HasPrefix(stored, envelopePrefix) {
+		return gateway.Keys.decrypt(stored)
+	}
+	return DecryptPassword(stored, gateway.EncryptionKey)
+}
+
+// HashPassword hashes a client password with bcrypt and a random salt.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// isPasswordHash reports whether a stored client password is a bcrypt hash.
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// checkPassword compares a password with a bcrypt hash, or in constant time with a password kept
+// in the clear because it is a secret reference.
+func checkPassword(expected string, password string) bool {
+	if isPasswordHash(expected) {
+		return bcrypt.CompareHashAndPassword([]byte(expected), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// EncryptPassword encrypts a plaintext password using AES-256 with the provided PSK. It is the
+// format credentials were stored in before envelope encryption, only kept to read them.
 func EncryptPassword(password, psk string) (string, error) {
 	// Convert PSK to 32 bytes (AES-256 key size)
 	key := []byte(psk)
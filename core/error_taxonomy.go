@@ -0,0 +1,268 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+// ErrorClass is the normalized kind of a delivery failure, carrier error codes, SMPP
+// command_status values and SMTP replies all map onto these so the router decides between
+// retrying, dead-lettering and the delivery status reported to the client by class.
+type ErrorClass string
+
+var ErrorClasses = struct {
+	Unknown            ErrorClass
+	InvalidDestination ErrorClass // the number doesn't exist or can't receive messages
+	OptOut             ErrorClass // the recipient unsubscribed (STOP) or blocked the sender
+	SpamBlock          ErrorClass // the carrier filtered the message or sender as spam
+	Congestion         ErrorClass // throttling or a full queue, worth retrying later
+	AuthFailure        ErrorClass // credentials the carrier or client doesn't accept
+	PolicyBlock        ErrorClass // the client's policy doesn't allow the destination, see countries.go
+	EmergencyBlock     ErrorClass // emergency and special service numbers can't be texted, see emergency.go
+	QuotaExceeded      ErrorClass // the client or its tenant sent its monthly quota, see monthly_quota.go
+}{
+	Unknown:            "",
+	InvalidDestination: "invalid_destination",
+	OptOut:             "opt_out",
+	SpamBlock:          "spam_block",
+	Congestion:         "congestion",
+	AuthFailure:        "auth_failure",
+	PolicyBlock:        "policy_block",
+	EmergencyBlock:     "emergency_block",
+	QuotaExceeded:      "quota_exceeded",
+}
+
+// Permanent reports whether messages failing with the class fail the same way on every attempt.
+// Auth failures aren't, they are fixed on the gateway side and other routes may still work.
+func (class ErrorClass) Permanent() bool {
+	return class == ErrorClasses.InvalidDestination || class == ErrorClasses.OptOut || class == ErrorClasses.SpamBlock ||
+		class == ErrorClasses.PolicyBlock || class == ErrorClasses.EmergencyBlock || class == ErrorClasses.QuotaExceeded
+}
+
+// RetryClass is the retry policy class of the error class, RETRY_CLASS_OVERRIDES takes the same
+// names.
+func (class ErrorClass) RetryClass() RetryClass {
+	return RetryClass(class)
+}
+
+// DeliveryStatus is the final status reported to the client for a message failing with the
+// class: UNDELIV / Rejected for destinations that can't receive, REJECTD / Rejected otherwise.
+func (class ErrorClass) DeliveryStatus() string {
+	if class == ErrorClasses.InvalidDestination {
+		return DeliveryStatuses.Undelivered
+	}
+	return DeliveryStatuses.Failed
+}
+
+// ReceiptError is the err value of the SMPP delivery receipts of messages failing with the class,
+// so clients can tell opt-outs and emergency numbers from other rejections.
+func (class ErrorClass) ReceiptError() string {
+	switch class {
+	case ErrorClasses.OptOut:
+		return "021"
+	case ErrorClasses.EmergencyBlock:
+		return "074"
+	case ErrorClasses.QuotaExceeded:
+		return "088"
+	}
+	return "000"
+}
+
+// classifiedError is a failure with its error class and the code it was derived from.
+type classifiedError struct {
+	class ErrorClass
+	code  string
+	err   error
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+
+func (e *classifiedError) Unwrap() []error {
+	if e.class.Permanent() {
+		return []error{e.err, ErrPermanentFailure}
+	}
+	return []error{e.err}
+}
+
+// ClassifyError attaches the class to err, permanent classes also make it a permanent failure.
+func ClassifyError(class ErrorClass, code string, err error) error {
+	if class == ErrorClasses.Unknown || err == nil {
+		return err
+	}
+	return &classifiedError{class: class, code: code, err: err}
+}
+
+// ErrorClassOf returns the class attached to err by classifyError.
+func ErrorClassOf(err error) ErrorClass {
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.class
+	}
+	return ErrorClasses.Unknown
+}
+
+// errorCodeOf returns the code the class of err was derived from, e.g. a carrier error code or an
+// SMPP command_status.
+func errorCodeOf(err error) string {
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.code
+	}
+	return ""
+}
+
+// TwilioErrorClasses maps Twilio error codes, see https://www.twilio.com/docs/api/errors.
+var TwilioErrorClasses = map[int]ErrorClass{
+	20003: ErrorClasses.AuthFailure,        // authentication error
+	20429: ErrorClasses.Congestion,         // too many requests
+	21211: ErrorClasses.InvalidDestination, // invalid 'To' phone number
+	21408: ErrorClasses.InvalidDestination, // region not enabled
+	21610: ErrorClasses.OptOut,             // recipient replied STOP
+	21612: ErrorClasses.InvalidDestination, // 'To' not reachable via this route
+	21614: ErrorClasses.InvalidDestination, // 'To' isn't a mobile number
+	30001: ErrorClasses.Congestion,         // queue overflow
+	30003: ErrorClasses.InvalidDestination, // unreachable destination handset
+	30004: ErrorClasses.OptOut,             // message blocked by the recipient
+	30005: ErrorClasses.InvalidDestination, // unknown destination handset
+	30006: ErrorClasses.InvalidDestination, // landline or unreachable carrier
+	30007: ErrorClasses.SpamBlock,          // carrier filtering
+	30022: ErrorClasses.Congestion,         // US A2P 10DLC throughput exceeded
+	30034: ErrorClasses.SpamBlock,          // US A2P 10DLC unregistered number
+}
+
+// telnyxErrorClasses maps Telnyx messaging error codes.
+var telnyxErrorClasses = map[int]ErrorClass{
+	10009: ErrorClasses.AuthFailure,        // authentication failed
+	40001: ErrorClasses.InvalidDestination, // not routable
+	40002: ErrorClasses.SpamBlock,          // blocked as spam, temporary
+	40003: ErrorClasses.SpamBlock,          // blocked as spam, permanent
+	40006: ErrorClasses.Congestion,         // recipient server unavailable
+	40008: ErrorClasses.InvalidDestination, // undeliverable
+	40014: ErrorClasses.Congestion,         // message expired during transmission
+	40300: ErrorClasses.OptOut,             // blocked due to STOP message
+	40310: ErrorClasses.InvalidDestination, // invalid 'to' address
+}
+
+// CarrierErrorClass maps an error code reported by a carrier of the given type, only the
+// numeric codes of the carriers above are known.
+func CarrierErrorClass(carrierType string, code string) ErrorClass {
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return ErrorClasses.Unknown
+	}
+	switch carrierType {
+	case "twilio":
+		return TwilioErrorClasses[n]
+	case "telnyx":
+		return telnyxErrorClasses[n]
+	}
+	return ErrorClasses.Unknown
+}
+
+// HTTPErrorClass maps the status of a carrier API response.
+func HTTPErrorClass(status int) ErrorClass {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrorClasses.AuthFailure
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return ErrorClasses.Congestion
+	}
+	return ErrorClasses.Unknown
+}
+
+// SMPP command_status values, see SMPP v5 section 4.7.6.
+const (
+	smppStatusInvalidDestAddr pdu.CommandStatus = 0x00B
+	smppStatusBindFailed      pdu.CommandStatus = 0x00D
+	smppStatusInvalidPassword pdu.CommandStatus = 0x00E
+	smppStatusInvalidSystemID pdu.CommandStatus = 0x00F
+	smppStatusInvalidDestTON  pdu.CommandStatus = 0x050
+	smppStatusInvalidDestNPI  pdu.CommandStatus = 0x051
+	smppStatusThrottled       pdu.CommandStatus = 0x058
+	smppStatusTempAppError    pdu.CommandStatus = 0x064
+	smppStatusPermAppError    pdu.CommandStatus = 0x065
+	smppStatusRejectAppError  pdu.CommandStatus = 0x066
+)
+
+// SMPPErrorClass maps the command_status of an SMPP response.
+func SMPPErrorClass(status pdu.CommandStatus) ErrorClass {
+	switch status {
+	case smppStatusInvalidDestAddr, smppStatusInvalidDestTON, smppStatusInvalidDestNPI:
+		return ErrorClasses.InvalidDestination
+	case smppStatusBindFailed, smppStatusInvalidPassword, smppStatusInvalidSystemID:
+		return ErrorClasses.AuthFailure
+	case pdu.ErrMessageQueueFull, smppStatusThrottled, smppStatusTempAppError:
+		return ErrorClasses.Congestion
+	case smppStatusPermAppError, smppStatusRejectAppError:
+		return ErrorClasses.SpamBlock // the receiving application refused the message
+	}
+	return ErrorClasses.Unknown
+}
+
+// SMPPError is a non-zero command_status answered by an SMPP peer.
+type SMPPError struct {
+	Status pdu.CommandStatus
+}
+
+func (e *SMPPError) Error() string {
+	return fmt.Sprintf("smpp peer responded with command_status 0x%08X", uint32(e.Status))
+}
+
+var smtpEnhancedCode = regexp.MustCompile(`\b([245])\.(\d{1,3})\.(\d{1,3})\b`)
+
+// smtpErrorClass maps an SMTP reply code and the enhanced status code in its text (RFC 3463).
+func smtpErrorClass(code int, response string) ErrorClass {
+	if code == 530 || code == 535 {
+		return ErrorClasses.AuthFailure
+	}
+	if m := smtpEnhancedCode.FindStringSubmatch(response); m != nil {
+		switch {
+		case m[2] == "1" && (m[3] == "1" || m[3] == "2" || m[3] == "10"):
+			return ErrorClasses.InvalidDestination // bad mailbox, system or recipient address
+		case m[2] == "7" && m[3] == "8":
+			return ErrorClasses.AuthFailure
+		case m[2] == "7" && m[1] == "5":
+			return ErrorClasses.SpamBlock // delivery refused by policy
+		}
+	}
+	switch code {
+	case 550, 553:
+		return ErrorClasses.InvalidDestination
+	case 421, 450, 451, 452:
+		return ErrorClasses.Congestion
+	}
+	return ErrorClasses.Unknown
+}
+
+// SMTPError is a 4xx or 5xx reply of an MM4 peer.
+type SMTPError struct {
+	Code     int
+	Response string
+}
+
+func (e *SMTPError) Error() string {
+	return fmt.Sprintf("server responded with error: %s", e.Response)
+}
+
+// ClientRetryClass returns the retry class for a failed delivery to a client, classifying SMPP
+// and SMTP errors and falling back to fallback.
+func ClientRetryClass(err error, fallback RetryClass) RetryClass {
+	var smppErr *SMPPError
+	var smtpErr *SMTPError
+	class := ErrorClassOf(err)
+	switch {
+	case class != ErrorClasses.Unknown:
+	case errors.As(err, &smppErr):
+		class = SMPPErrorClass(smppErr.Status)
+	case errors.As(err, &smtpErr):
+		class = smtpErrorClass(smtpErr.Code, smtpErr.Response)
+	}
+	if class == ErrorClasses.Unknown {
+		return fallback
+	}
+	return class.RetryClass()
+}
@@ -0,0 +1,623 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types posted to event subscriptions.
+var EventTypes = struct {
+	MessageDelivered   string
+	MessageFailed      string
+	ClientBound        string
+	ClientUnbound      string
+	CarrierUnhealthy   string
+	CarrierHealthy     string
+	DeadLetterCreated  string
+	MessageFlagged     string
+	MessageQuarantined string
+	MessageBlocked     string
+	QuotaSoftLimit     string
+	QuotaExceeded      string
+	BindFailed         string
+	BindLockedOut      string
+	BindUnlocked       string
+}{
+	MessageDelivered:   "message.delivered",
+	MessageFailed:      "message.failed",
+	ClientBound:        "client.bound",
+	ClientUnbound:      "client.unbound",
+	CarrierUnhealthy:   "carrier.unhealthy",
+	CarrierHealthy:     "carrier.healthy",
+	DeadLetterCreated:  "dead_letter.created",
+	MessageFlagged:     "message.flagged",
+	MessageQuarantined: "message.quarantined",
+	MessageBlocked:     "message.blocked",
+	QuotaSoftLimit:     "quota.soft_limit",
+	QuotaExceeded:      "quota.exceeded",
+	BindFailed:         "security.bind_failed",
+	BindLockedOut:      "security.locked_out",
+	BindUnlocked:       "security.unlocked",
+}
+
+var EventTypeNames = []string{
+	EventTypes.MessageDelivered, EventTypes.MessageFailed, EventTypes.ClientBound, EventTypes.ClientUnbound,
+	EventTypes.CarrierUnhealthy, EventTypes.CarrierHealthy, EventTypes.DeadLetterCreated,
+	EventTypes.MessageFlagged, EventTypes.MessageQuarantined, EventTypes.MessageBlocked,
+	EventTypes.QuotaSoftLimit, EventTypes.QuotaExceeded, EventTypes.BindFailed, EventTypes.BindLockedOut,
+	EventTypes.BindUnlocked,
+}
+
+// Event is the body posted to a subscription.
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	CreatedAt time.Time              `json:"created_at"`
+	ServerID  string                 `json:"server_id"`
+	Client    string                 `json:"client,omitempty"` // client the event is about, empty for carrier events
+	Tenant    uint                   `json:"tenant_id,omitempty"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// EventSubscription posts the events it subscribes to to a URL. Subscriptions of a client only
+// get the events of that client, global ones get every event of their tenant, or every event at
+// all for the operator's.
+type EventSubscription struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	Client   string `gorm:"index" json:"client"`    // username, empty for a global subscription
+	TenantID uint   `gorm:"index" json:"tenant_id"` // global subscriptions of a tenant only get its events
+	URL      string `json:"url"`
+	Secret   string `json:"secret,omitempty"` // HMAC key, encrypted at rest and only shown when created
+	Events   string `json:"events"`           // comma separated event types, empty or * for all
+	Disabled bool   `json:"disabled"`
+	Version  uint   `gorm:"not null;default:1" json:"version"`
+}
+
+// Event delivery statuses.
+var EventDeliveryStatuses = struct {
+	Pending   string
+	Delivered string
+	Failed    string
+}{
+	Pending:   "pending",
+	Delivered: "delivered",
+	Failed:    "failed",
+}
+
+// EventDelivery is an event queued for a subscription, until it was posted or ran out of attempts.
+type EventDelivery struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	SubscriptionID uint      `gorm:"index" json:"subscription_id"`
+	EventID        string    `json:"event_id"`
+	Type           string    `json:"type"`
+	Payload        string    `json:"payload"`
+	Status         string    `gorm:"index" json:"status"`
+	Attempts       int       `json:"attempts"`
+	NextAttemptAt  time.Time `gorm:"index" json:"next_attempt_at"`
+	ResponseStatus int       `json:"response_status,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+var (
+	eventWebhookInterval  time.Duration
+	eventWebhookTimeout   time.Duration
+	eventWebhookRetention time.Duration
+	eventWebhookRetry     RetryPolicy
+)
+
+// EventSignatureHeader carries t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">.
+const EventSignatureHeader = "X-Gateway-Signature"
+
+// eventSubscriptions are the enabled subscriptions with their secrets decrypted.
+var eventSubscriptions struct {
+	mu   sync.RWMutex
+	list []EventSubscription
+}
+
+var events = make(chan Event, 1000)
+
+// subscribes reports whether the subscription gets the event.
+func (sub *EventSubscription) subscribes(event Event) bool {
+	if sub.Client != "" && sub.Client != event.Client {
+		return false
+	}
+	if sub.TenantID != 0 && sub.TenantID != event.Tenant {
+		return false
+	}
+	if sub.Events == "" || sub.Events == "*" {
+		return true
+	}
+	for _, eventType := range strings.Split(sub.Events, ",") {
+		if strings.TrimSpace(eventType) == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// OnEvent calls hook with every event as it is emitted, before the subscriptions get it. Hooks
+// are added while the gateway is set up, they must not block.
+func (gateway *Gateway) OnEvent(hook func(Event)) {
+	gateway.eventHooks = append(gateway.eventHooks, hook)
+}
+
+// EmitEvent queues an event about a client for the subscriptions, events are dropped rather than
+// holding up the caller when the dispatcher can't keep up.
+func (gateway *Gateway) EmitEvent(eventType string, client string, data map[string]interface{}) {
+	gateway.EmitTenantEvent(eventType, client, gateway.clientTenant(client), data)
+}
+
+// EmitTenantEvent queues an event of a tenant, e.g. about one of its carriers.
+func (gateway *Gateway) EmitTenantEvent(eventType string, client string, tenant uint, data map[string]interface{}) {
+	event := Event{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		ServerID:  gateway.ServerID,
+		Client:    client,
+		Tenant:    tenant,
+		Data:      data,
+	}
+	for _, hook := range gateway.eventHooks {
+		hook(event)
+	}
+	select {
+	case events <- event:
+	default:
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"System.Events",
+			"GenericError",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"client": client,
+			}, fmt.Sprintf("event queue full, dropped %s", eventType),
+		))
+	}
+}
+
+// EmitMessageEvent queues an event about a message, the client is the sender or the recipient of
+// an inbound message.
+func (gateway *Gateway) EmitMessageEvent(eventType string, msg *MsgQueueItem, data map[string]interface{}) {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["log_id"] = msg.LogID
+	data["trace_id"] = msg.TraceID
+	data["type"] = string(msg.Type)
+	data["from_number"] = msg.From
+	data["to_number"] = msg.To
+	gateway.EmitEvent(eventType, gateway.messageClient(msg), data)
+}
+
+// loadEventSubscriptions loads the enabled subscriptions.
+func (gateway *Gateway) loadEventSubscriptions() error {
+	var subs []EventSubscription
+	if err := gateway.DB.Where("disabled = ?", false).Find(&subs).Error; err != nil {
+		return err
+	}
+	for i := range subs {
+		secret, err := gateway.decryptSecret(subs[i].Secret)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt the secret of event subscription %d: %w", subs[i].ID, err)
+		}
+		subs[i].Secret = secret
+	}
+
+	eventSubscriptions.mu.Lock()
+	eventSubscriptions.list = subs
+	eventSubscriptions.mu.Unlock()
+	return nil
+}
+
+func subscriptionByID(id uint) (EventSubscription, bool) {
+	eventSubscriptions.mu.RLock()
+	defer eventSubscriptions.mu.RUnlock()
+	for _, sub := range eventSubscriptions.list {
+		if sub.ID == id {
+			return sub, true
+		}
+	}
+	return EventSubscription{}, false
+}
+
+// queueEvent stores a delivery of the event for every subscription that gets it.
+func (gateway *Gateway) queueEvent(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	var deliveries []EventDelivery
+	eventSubscriptions.mu.RLock()
+	for _, sub := range eventSubscriptions.list {
+		if sub.subscribes(event) {
+			deliveries = append(deliveries, EventDelivery{
+				SubscriptionID: sub.ID,
+				EventID:        event.ID,
+				Type:           event.Type,
+				Payload:        string(payload),
+				Status:         EventDeliveryStatuses.Pending,
+				NextAttemptAt:  event.CreatedAt,
+			})
+		}
+	}
+	eventSubscriptions.mu.RUnlock()
+
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return gateway.DB.Create(&deliveries).Error
+}
+
+// SignEvent is the signature header of a body posted at t.
+func SignEvent(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var eventClient http.Client
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		eventWebhookInterval = cfg.Duration("EVENT_WEBHOOK_INTERVAL", time.Second)
+		eventWebhookTimeout = cfg.Duration("EVENT_WEBHOOK_TIMEOUT", 10*time.Second)
+		eventWebhookRetention = cfg.Duration("EVENT_WEBHOOK_RETENTION", 7*24*time.Hour)
+		eventWebhookRetry = RetryPolicy{
+			InitialDelay: cfg.Duration("EVENT_WEBHOOK_INITIAL_DELAY", 10*time.Second),
+			Multiplier:   2,
+			Jitter:       0.2,
+			MaxDelay:     cfg.Duration("EVENT_WEBHOOK_MAX_DELAY", time.Hour),
+			MaxAttempts:  cfg.Int("EVENT_WEBHOOK_MAX_ATTEMPTS", 10),
+		}
+		eventClient = http.Client{Timeout: eventWebhookTimeout}
+	})
+}
+
+// postEvent posts the delivery to the subscription, any 2xx answer delivers it.
+func postEvent(sub EventSubscription, delivery *EventDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "zultys-smpp-mm4")
+	req.Header.Set("X-Gateway-Event", delivery.Type)
+	req.Header.Set("X-Gateway-Event-ID", delivery.EventID)
+	req.Header.Set(EventSignatureHeader, SignEvent(sub.Secret, time.Now(), body))
+
+	resp, err := eventClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("subscriber answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// attemptDelivery claims the delivery by counting the attempt, so only one gateway instance posts
+// it, and records the outcome. A claim that is never completed is retried after the timeout.
+func (gateway *Gateway) attemptDelivery(delivery EventDelivery) {
+	var lm = gateway.LogManager
+
+	claimed := gateway.DB.Model(&EventDelivery{}).
+		Where("id = ? AND status = ? AND attempts = ?", delivery.ID, EventDeliveryStatuses.Pending, delivery.Attempts).
+		Updates(map[string]interface{}{
+			"attempts":        delivery.Attempts + 1,
+			"next_attempt_at": time.Now().Add(2 * eventWebhookTimeout),
+		})
+	if claimed.Error != nil || claimed.RowsAffected == 0 {
+		return
+	}
+	delivery.Attempts++
+
+	update := map[string]interface{}{}
+	sub, ok := subscriptionByID(delivery.SubscriptionID)
+	if !ok {
+		update["status"] = EventDeliveryStatuses.Failed
+		update["last_error"] = "subscription removed or disabled"
+	} else if status, err := postEvent(sub, &delivery); err == nil {
+		update["status"] = EventDeliveryStatuses.Delivered
+		update["response_status"] = status
+		update["last_error"] = ""
+	} else {
+		update["response_status"] = status
+		update["last_error"] = err.Error()
+		if eventWebhookRetry.ShouldRetry(delivery.Attempts) {
+			update["next_attempt_at"] = time.Now().Add(eventWebhookRetry.Delay(delivery.Attempts))
+		} else {
+			update["status"] = EventDeliveryStatuses.Failed
+			lm.SendLog(lm.BuildLog(
+				"System.Events",
+				"GenericError",
+				logrus.WarnLevel,
+				map[string]interface{}{
+					"subscription": sub.ID,
+					"event":        delivery.Type,
+					"attempts":     delivery.Attempts,
+				}, err,
+			))
+		}
+	}
+	gateway.DB.Model(&EventDelivery{}).Where("id = ?", delivery.ID).Updates(update)
+}
+
+// EventDispatcher stores the emitted events for their subscriptions and posts the due
+// deliveries, retrying failures with backoff until EVENT_WEBHOOK_MAX_ATTEMPTS.
+func (gateway *Gateway) EventDispatcher() {
+	var lm = gateway.LogManager
+	logErr := func(err error) {
+		lm.SendLog(lm.BuildLog(
+			"System.Events",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil, err,
+		))
+	}
+	if err := gateway.loadEventSubscriptions(); err != nil {
+		logErr(err)
+	}
+
+	// posting never holds up storing new events
+	go func() {
+		for event := range events {
+			if err := gateway.queueEvent(event); err != nil {
+				logErr(err)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(eventWebhookInterval)
+	defer ticker.Stop()
+	reload := time.NewTicker(time.Minute)
+	defer reload.Stop()
+	purge := time.NewTicker(time.Hour)
+	defer purge.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var due []EventDelivery
+			err := gateway.DB.
+				Where("status = ? AND next_attempt_at <= ?", EventDeliveryStatuses.Pending, time.Now()).
+				Order("next_attempt_at asc").
+				Limit(100).
+				Find(&due).Error
+			if err != nil {
+				logErr(err)
+				continue
+			}
+			var wg sync.WaitGroup
+			for _, delivery := range due {
+				wg.Add(1)
+				go func(delivery EventDelivery) {
+					defer wg.Done()
+					gateway.attemptDelivery(delivery)
+				}(delivery)
+			}
+			wg.Wait()
+		case <-reload.C:
+			// picks up subscriptions changed through another gateway instance
+			if err := gateway.loadEventSubscriptions(); err != nil {
+				logErr(err)
+			}
+		case <-purge.C:
+			gateway.DB.Where("status <> ? AND created_at < ?", EventDeliveryStatuses.Pending, time.Now().Add(-eventWebhookRetention)).
+				Delete(&EventDelivery{})
+		}
+	}
+}
+
+// validateEventSubscription checks the subscription and sets a random secret when it has none.
+func (gateway *Gateway) validateEventSubscription(sub *EventSubscription) error {
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Invalid("url must be an http or https URL")
+	}
+	if sub.Client != "" {
+		gateway.Mu.RLock()
+		_, ok := gateway.Clients[sub.Client]
+		gateway.Mu.RUnlock()
+		if !ok {
+			return Invalid("unknown client: %s", sub.Client)
+		}
+	}
+	if sub.Events != "" && sub.Events != "*" {
+		for _, eventType := range strings.Split(sub.Events, ",") {
+			if !StringInArray(strings.TrimSpace(eventType), EventTypeNames) {
+				return Invalid("unknown event type: %s", eventType)
+			}
+		}
+	}
+	if sub.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		sub.Secret = hex.EncodeToString(secret)
+	}
+	return nil
+}
+
+// checkSubscriptionScope gives a subscription to the tenant of its client, or to the tenant of the
+// key of a request for a global one, and checks that the key may manage it.
+func (gateway *Gateway) checkSubscriptionScope(ctx iris.Context, sub *EventSubscription) error {
+	if sub.Client != "" {
+		sub.TenantID = gateway.clientTenant(sub.Client)
+		return gateway.CheckClientScope(ctx, sub.Client)
+	}
+	AssignTenant(ctx, &sub.TenantID)
+	if err := ValidateTenantID(sub.TenantID); err != nil {
+		return err
+	}
+	return CheckTenantScope(ctx, sub.TenantID)
+}
+
+// saveEventSubscription creates the subscription, or updates it when it has an ID, and answers
+// with its secret in the clear.
+func (gateway *Gateway) saveEventSubscription(sub EventSubscription) (EventSubscription, error) {
+	if err := gateway.validateEventSubscription(&sub); err != nil {
+		return sub, err
+	}
+	secret := sub.Secret
+	encrypted, err := gateway.encryptSecret(secret)
+	if err != nil {
+		return sub, fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+	sub.Secret = encrypted
+
+	if sub.ID != 0 {
+		err = UpdateVersioned(gateway.DB, &sub, sub.ID, &sub.Version, "client", "tenant_id", "url", "secret", "events", "disabled")
+	} else {
+		sub.Version = 0
+		err = gateway.DB.Create(&sub).Error
+	}
+	if err != nil {
+		return sub, err
+	}
+	if err := gateway.loadEventSubscriptions(); err != nil {
+		return sub, err
+	}
+	sub.Secret = secret
+	return sub, nil
+}
+
+// SetupEventRoutes sets up the event subscriptions and their deliveries.
+func SetupEventRoutes(app *iris.Application, gateway *Gateway) {
+	eventsParty := app.Party("/events", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// List subscriptions, without their secrets
+		eventsParty.Get("/subscriptions", func(ctx iris.Context) {
+			var list []EventSubscription
+			if err := gateway.DB.Order("id asc").Find(&list).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			visible := make([]EventSubscription, 0, len(list))
+			for _, sub := range list {
+				// global subscriptions are only seen by keys not limited to some clients, and to
+				// another tenant
+				if sub.Client == "" && CheckTenantScope(ctx, sub.TenantID) != nil || sub.Client != "" && gateway.CheckClientScope(ctx, sub.Client) != nil {
+					continue
+				}
+				sub.Secret = ""
+				visible = append(visible, sub)
+			}
+			ctx.JSON(visible)
+		})
+
+		// Add a subscription, a secret is generated unless one is given
+		eventsParty.Post("/subscriptions", func(ctx iris.Context) {
+			var sub EventSubscription
+			if err := ctx.ReadJSON(&sub); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			sub.ID = 0
+			if err := gateway.checkSubscriptionScope(ctx, &sub); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			sub, err := gateway.saveEventSubscription(sub)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(sub)
+		})
+
+		// Replace a subscription, the body carries the version it was read with. Leaving out the
+		// secret rotates it.
+		eventsParty.Put("/subscriptions/{id:uint}", func(ctx iris.Context) {
+			var sub EventSubscription
+			if err := ctx.ReadJSON(&sub); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			sub.ID = ctx.Params().GetUintDefault("id", 0)
+			if err := gateway.checkSubscriptionScope(ctx, &sub); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			sub, err := gateway.saveEventSubscription(sub)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(sub)
+		})
+
+		// Delete a subscription, its pending deliveries fail
+		eventsParty.Delete("/subscriptions/{id:uint}", func(ctx iris.Context) {
+			if err := DeleteVersioned(gateway.DB, &EventSubscription{}, ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.loadEventSubscriptions(); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Subscription deleted"})
+		})
+
+		// List deliveries, newest first
+		eventsParty.Get("/deliveries", func(ctx iris.Context) {
+			query := gateway.DB.Order("id desc")
+			if status := ctx.URLParam("status"); status != "" {
+				query = query.Where("status = ?", status)
+			}
+			if id := ctx.URLParamIntDefault("subscription_id", 0); id != 0 {
+				query = query.Where("subscription_id = ?", id)
+			}
+			var list []EventDelivery
+			if err := query.Limit(ctx.URLParamIntDefault("limit", 100)).Find(&list).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(list)
+		})
+
+		// Post a failed delivery again, with a fresh set of attempts
+		eventsParty.Post("/deliveries/{id:uint}/retry", func(ctx iris.Context) {
+			result := gateway.DB.Model(&EventDelivery{}).
+				Where("id = ? AND status = ?", ctx.Params().GetUintDefault("id", 0), EventDeliveryStatuses.Failed).
+				Updates(map[string]interface{}{
+					"status":          EventDeliveryStatuses.Pending,
+					"attempts":        0,
+					"next_attempt_at": time.Now(),
+				})
+			err := result.Error
+			if err == nil && result.RowsAffected == 0 {
+				err = fmt.Errorf("%w: no failed delivery with this id", ErrNotFound)
+			}
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Delivery queued"})
+		})
+	}
+}
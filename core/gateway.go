@@ -0,0 +1,201 @@
+// Package core holds the state every part of the gateway shares: the core.Gateway with the
+// clients, carriers and numbers, the message queue, the storage interface, the message records
+// and the settings. The servers, the router and the carrier handlers are built around it.
+package core
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net"
+	"sync"
+)
+
+// Gateway handles SMS processing for different carriers
+type Gateway struct {
+	Carriers      map[string]CarrierHandler
+	CarrierUUIDs  map[string]Carrier
+	DB            *gorm.DB
+	Storage       Storage // the provisioning, see storage.Open
+	Router        MessageRouter
+	Queue         MessageQueue
+	Clients       map[string]*Client
+	Numbers       map[string]*ClientNumber
+	NumberIndex   *NumberIndex
+	Cache         LookupCache
+	CarrierLookup CarrierLookup  // nil without CARRIER_LOOKUP
+	lookupCache   LookupCache    // of the carrier lookups
+	invalidCache  LookupCache    // of the destinations carriers rejected as invalid
+	WebhookNonces LookupCache    // of the carrier webhooks handled, see inbound_webhook.go
+	bindLockouts  LookupCache    // of the failed SMPP binds, see bind_lockout.go
+	Archive       MessageArchive // nil without ARCHIVE_BACKEND
+	Limits        *CarrierLimits
+	LogManager    *LogManager
+	Mu            sync.RWMutex
+	MsgRecordChan chan MsgRecord
+	ServerID      string
+	EncryptionKey string    // PSK of the credentials stored before envelope encryption
+	Keys          *keyRing  // envelope encryption of the stored credentials
+	Listeners     Listeners // of the servers, see upgrade.go
+	eventHooks    []func(Event)
+	reloadHooks   []func()
+}
+
+// MessageRouter is the part of the router the gateway and the carriers hand messages to, see
+// router.Router.
+type MessageRouter interface {
+	OfferClientMessage(msg MsgQueueItem) error
+	OfferCarrierMessage(msg MsgQueueItem) error
+	// CarrierDeliveryStatus updates the status of a message sent to a carrier.
+	CarrierDeliveryStatus(carrier string, carrierMessageID string, status string, errorCode string) error
+	// SyncCarrierRoutes makes the carrier routes match the loaded carriers.
+	SyncCarrierRoutes()
+	RouteHealth() []RouteHealthStatus
+	QueueDepths() map[string]int
+}
+
+// OnReload calls hook whenever the carriers, clients and numbers or routing rules were reloaded.
+// Hooks are added while the gateway is set up.
+func (gateway *Gateway) OnReload(hook func()) {
+	gateway.reloadHooks = append(gateway.reloadHooks, hook)
+}
+
+// Reloaded runs the reload hooks.
+func (gateway *Gateway) Reloaded() {
+	for _, hook := range gateway.reloadHooks {
+		hook()
+	}
+}
+
+// Listeners opens the listening sockets of the servers, name is the server: smpp, mm4, web,
+// metrics or grpc. The gateway hands them to the new process of an upgrade.
+type Listeners interface {
+	Listen(name string, address string) (net.Listener, error)
+	// HandedOver reports whether the listeners were handed to a new process, or closed to stop
+	// the gateway. The servers return from accepting then, without it being an error.
+	HandedOver() bool
+}
+
+// Listen opens the listener of a server, with net.Listen when the gateway has no Listeners.
+func (gateway *Gateway) Listen(name string, address string) (net.Listener, error) {
+	if gateway.Listeners == nil {
+		return net.Listen("tcp", address)
+	}
+	return gateway.Listeners.Listen(name, address)
+}
+
+// HandedOver reports whether the listeners of the servers were handed over or closed.
+func (gateway *Gateway) HandedOver() bool {
+	return gateway.Listeners != nil && gateway.Listeners.HandedOver()
+}
+
+type MsgRecord struct {
+	MsgQueueItem MsgQueueItem
+	ClientID     uint
+	Carrier      string
+	Internal     bool
+}
+
+// New creates the gateway on its storage and database, Load loads the provisioning.
+func New(storage Storage, db *gorm.DB) (*Gateway, error) {
+	gateway := &Gateway{
+		Carriers:      make(map[string]CarrierHandler),
+		CarrierUUIDs:  make(map[string]Carrier),
+		MsgRecordChan: make(chan MsgRecord),
+		Clients:       make(map[string]*Client),
+		Numbers:       make(map[string]*ClientNumber),
+		NumberIndex:   NewNumberIndex(),
+		ServerID:      Getenv("SERVER_ID"),
+		EncryptionKey: Getenv("LEGACY_ENCRYPTION_KEY"),
+		DB:            db,
+		Storage:       storage,
+	}
+
+	var err error
+	if gateway.Keys, err = newKeyRing(); err != nil {
+		return nil, err
+	}
+	if gateway.Cache, err = NewLookupCache(); err != nil {
+		return nil, err
+	}
+	if gateway.Archive, err = NewMessageArchive(); err != nil {
+		return nil, err
+	}
+	if gateway.CarrierLookup, err = NewCarrierLookup(); err != nil {
+		return nil, err
+	}
+	gateway.lookupCache = CacheWithTTL(gateway.Cache, carrierLookupTTL)
+	gateway.invalidCache = CacheWithTTL(gateway.Cache, invalidDestinationTTL)
+	gateway.WebhookNonces = CacheWithTTL(gateway.Cache, 2*webhookTolerance)
+	gateway.bindLockouts = CacheWithTTL(gateway.Cache, bindLockoutReset+bindLockoutMax)
+	gateway.Limits = newCarrierLimits(gateway)
+
+	// Initialize Loki Client and Log Manager
+	lokiClient := NewLokiClient(Getenv("LOKI_URL"), Getenv("LOKI_USERNAME"), Getenv("LOKI_PASSWORD"))
+	logManager := NewLogManager(lokiClient)
+	// Define Templates
+	logManager.LoadTemplates()
+	gateway.LogManager = logManager
+	return gateway, nil
+}
+
+// Load loads the clients, numbers, tenants and API keys from the storage.
+func (gateway *Gateway) Load() error {
+	// Load clients and numbers from the database
+	if err := gateway.loadClients(); err != nil {
+		return fmt.Errorf("failed to load clients: %v", err)
+	}
+
+	if err := gateway.loadNumbers(); err != nil {
+		return fmt.Errorf("failed to load numbers: %v", err)
+	}
+
+	if err := gateway.LoadTenants(); err != nil {
+		return fmt.Errorf("failed to load tenants: %v", err)
+	}
+
+	if err := gateway.loadAPIKeys(); err != nil {
+		return fmt.Errorf("failed to load API keys: %v", err)
+	}
+	return nil
+}
+
+func (gateway *Gateway) getCarrier(number string) (string, error) {
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+
+	num, exists := gateway.Numbers[NumberKey(number)]
+	if !exists {
+		return "", fmt.Errorf("no carrier found for number: %s", number)
+	}
+	return num.Carrier, nil
+}
+
+// GetClient returns the client associated with a phone number.
+func (gateway *Gateway) GetClient(number string) *Client {
+	client, _, _ := gateway.LookupNumber(number)
+	return client
+}
+
+// SendingNumber returns the client number a message is sent from, or an empty number when the
+// source isn't assigned to a client.
+func (gateway *Gateway) SendingNumber(from string) *ClientNumber {
+	if _, num, ok := gateway.LookupNumber(from); ok {
+		return num
+	}
+	return &ClientNumber{}
+}
+
+// FindClientByNumber searches for a client using an E.164 number.
+func (gateway *Gateway) FindClientByNumber(number string) (*Client, error) {
+	if client, _, ok := gateway.LookupNumber(number); ok {
+		return client, nil
+	}
+	return nil, fmt.Errorf("unable to find client for number: %s", number)
+}
+
+func (gateway *Gateway) GetClientCarrier(number string) (string, error) {
+	if _, num, ok := gateway.LookupNumber(number); ok {
+		return num.Carrier, nil
+	}
+	return "", nil
+}
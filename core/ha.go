@@ -0,0 +1,23 @@
+package core
+
+import (
+	"time"
+)
+
+var (
+	HAEnabled    bool
+	HALeaseTTL   time.Duration
+	HALeaseRenew time.Duration
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		HAEnabled = cfg.Getenv("HA_ENABLED") == "true"
+		HALeaseTTL, HALeaseRenew = haLease(cfg)
+	})
+}
+
+// haLease returns HA_LEASE_TTL and HA_LEASE_RENEW.
+func haLease(cfg *Config) (ttl time.Duration, renew time.Duration) {
+	return cfg.Duration("HA_LEASE_TTL", 15*time.Second), cfg.Duration("HA_LEASE_RENEW", 5*time.Second)
+}
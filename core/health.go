@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HealthCheckTimeout bounds the checks that call out to a dependency.
+var HealthCheckTimeout time.Duration
+
+// Statuses of a health check. Degraded dependencies are reported without failing readiness.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthFail     = "fail"
+)
+
+// HealthCheck is the result of checking one dependency.
+type HealthCheck struct {
+	Status string              `json:"status"`
+	Detail string              `json:"detail,omitempty"`
+	Error  string              `json:"error,omitempty"`
+	Routes []RouteHealthStatus `json:"routes,omitempty"`
+}
+
+// HealthReport is the body of /healthz and /readyz.
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// ListenerStatus tracks whether a server accepts connections.
+type ListenerStatus struct {
+	mu   sync.RWMutex
+	addr string
+	err  error
+}
+
+func (l *ListenerStatus) Listening(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.addr, l.err = addr, nil
+}
+
+func (l *ListenerStatus) Failed(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.addr, l.err = "", err
+}
+
+// Check reports the listener, failed until it listens.
+func (l *ListenerStatus) Check() HealthCheck {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	switch {
+	case l.err != nil:
+		return HealthCheck{Status: HealthFail, Error: l.err.Error()}
+	case l.addr == "":
+		return HealthCheck{Status: HealthFail, Detail: "not listening yet"}
+	}
+	return HealthCheck{Status: HealthOK, Detail: "listening on " + l.addr}
+}
+
+func (gateway *Gateway) CheckPostgres() HealthCheck {
+	if StorageBackend == "file" {
+		return HealthCheck{Status: HealthOK, Detail: "not used, the provisioning comes from STORAGE_FILE"}
+	}
+	db, err := gateway.DB.DB()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeout)
+		defer cancel()
+		started := time.Now()
+		if err = db.PingContext(ctx); err == nil {
+			stats := db.Stats()
+			return HealthCheck{Status: HealthOK, Detail: fmt.Sprintf("ping %s, %d connections open, %d in use",
+				time.Since(started).Round(time.Millisecond), stats.OpenConnections, stats.InUse)}
+		}
+	}
+	return HealthCheck{Status: HealthFail, Error: err.Error()}
+}
+
+// CheckQueue reports the queue backend. Publishes are buffered while RabbitMQ is unreachable, so
+// an outage only fails the check once the buffer is full.
+func (gateway *Gateway) CheckQueue() HealthCheck {
+	switch {
+	case gateway.Queue == nil:
+		return HealthCheck{Status: HealthFail, Detail: "not connected yet"}
+	case gateway.Queue.Ready():
+		return HealthCheck{Status: HealthOK, Detail: "connected"}
+	case gateway.Queue.Accepting():
+		return HealthCheck{Status: HealthDegraded, Detail: "disconnected, buffering publishes"}
+	}
+	return HealthCheck{Status: HealthFail, Error: "disconnected and the publish buffer is full"}
+}
+
+// RouteErrorMinSamples is the number of sends in the error window before a route is judged by its
+// error rate.
+var RouteErrorMinSamples int
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		HealthCheckTimeout = cfg.Duration("HEALTH_CHECK_TIMEOUT", 2*time.Second)
+		RouteErrorMinSamples = cfg.Int("ROUTE_ERROR_MIN_SAMPLES", 20)
+	})
+}
+
+// RouteHealthStatus is the health of a route as exposed by the API.
+type RouteHealthStatus struct {
+	Route               string     `json:"route"`
+	Healthy             bool       `json:"healthy"`
+	Reason              string     `json:"reason,omitempty"`
+	DownUntil           *time.Time `json:"down_until,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	ErrorRate           float64    `json:"error_rate"`
+	Samples             int        `json:"samples"`
+	LastError           string     `json:"last_error,omitempty"`
+	Probed              bool       `json:"probed"`
+	LastProbe           *time.Time `json:"last_probe,omitempty"`
+	ProbeError          string     `json:"probe_error,omitempty"`
+}
@@ -0,0 +1,37 @@
+package core
+
+import (
+	"time"
+)
+
+// CarrierSend records the send of a message to a carrier before the carrier API is called. A
+// worker that gets the message again, e.g. redelivered after the worker before it crashed between
+// the send and the ack, finds the record and doesn't send the message twice.
+type CarrierSend struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	IdempotencyKey   string    `gorm:"uniqueIndex;not null" json:"idempotency_key"` // see idempotencyKey
+	Route            string    `json:"route"`
+	Status           string    `gorm:"index" json:"status"`
+	CarrierMessageID string    `json:"carrier_message_id,omitempty"`
+	ServerID         string    `json:"server_id"` // of the instance that sends or sent it
+	CreatedAt        time.Time `gorm:"index" json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// Carrier send statuses.
+var CarrierSendStatuses = struct {
+	Pending string
+	Sent    string
+	Failed  string
+	Unknown string
+}{
+	Pending: "pending", // the carrier API is being called
+	Sent:    "sent",
+	Failed:  "failed",  // sent again by the next attempt
+	Unknown: "unknown", // the sender died during the call, counted as sent
+}
+
+// IdempotencyKey identifies the sends of a message, every attempt and route of it has the same key.
+func IdempotencyKey(msg *MsgQueueItem) string {
+	return msg.LogID
+}
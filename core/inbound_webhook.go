@@ -0,0 +1,234 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookTolerance is how far the timestamp of a signed webhook may be from now, and how long its
+// nonce is remembered.
+var webhookTolerance time.Duration
+
+// Reasons a webhook is rejected for, the reason label of webhook_rejections_total.
+const (
+	webhookRejectedIP        = "ip"
+	webhookRejectedSignature = "signature"
+	webhookRejectedTimestamp = "timestamp"
+	webhookRejectedReplay    = "replay"
+)
+
+var webhookRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "webhook_rejections_total",
+	Help: "Inbound carrier webhooks rejected by carrier, signature algorithm and reason",
+}, []string{"carrier", "algorithm", "reason"})
+
+func init() {
+	prometheus.MustRegister(webhookRejections)
+	OnConfigure(func(cfg *Config) {
+		webhookTolerance = cfg.Duration("WEBHOOK_TOLERANCE", 5*time.Minute)
+	})
+}
+
+// WebhookPolicy is how a carrier signs its webhooks. webInboundCarrier checks the webhooks of the
+// carriers implementing webhookSigner against their policy before calling Inbound.
+type WebhookPolicy struct {
+	Algorithm string // in logs and metrics, e.g. "hmac-sha256"
+	Status    int    // answered to rejected webhooks, 401 unless set
+	// Verify checks the signature, nil when the carrier doesn't sign its webhooks or the check
+	// is turned off, which skips the timestamp and nonce checks as well.
+	Verify func(w *InboundWebhook) error
+	// Timestamp is when the webhook was signed, nil for carriers that don't sign one.
+	Timestamp func(w *InboundWebhook) (time.Time, error)
+	// Nonce identifies the webhook, a nonce handled within WEBHOOK_TOLERANCE is a replay. Nil
+	// or empty skips the check.
+	Nonce func(w *InboundWebhook) string
+}
+
+// webhookSigner is implemented by the carriers whose webhooks are signed.
+type webhookSigner interface {
+	webhookPolicy() WebhookPolicy
+}
+
+// InboundWebhook is a webhook being checked, its body stays readable for Inbound.
+type InboundWebhook struct {
+	Context iris.Context
+	Body    []byte
+	form    url.Values
+}
+
+// Header returns a header of the webhook.
+func (w *InboundWebhook) Header(name string) string {
+	return w.Context.GetHeader(name)
+}
+
+// Form returns the parameters of a form encoded webhook.
+func (w *InboundWebhook) Form() url.Values {
+	if w.form == nil {
+		w.form, _ = url.ParseQuery(string(w.Body))
+	}
+	return w.form
+}
+
+// WebhookNonce is the cache key of a nonce, hashed since some carriers use the signature.
+func WebhookNonce(carrier *Carrier, nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return webhookNonceCacheKey + carrier.UUID + ":" + hex.EncodeToString(sum[:16])
+}
+
+// UnixTimestamp parses a timestamp header in seconds since the epoch.
+func UnixTimestamp(header string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("missing or invalid timestamp")
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// webhookPeer returns the address a webhook came from for the allowlist: the remote address, or
+// behind trusted proxies the rightmost X-Forwarded-For hop that isn't one of them. The entries
+// left of it are written by the caller and can't be trusted, unlike the client_ip of
+// ProxyIPMiddleware.
+func webhookPeer(c iris.Context) string {
+	remote := c.RemoteAddr()
+	if addr := net.ParseIP(remote); addr == nil || !IsPrivateIP(addr) {
+		return remote
+	}
+	hops := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr := net.ParseIP(strings.TrimSpace(hops[i]))
+		if addr == nil {
+			// unparseable, nothing left of it can be attributed
+			break
+		}
+		if !IsPrivateIP(addr) {
+			return addr.String()
+		}
+	}
+	return remote
+}
+
+// webhookAllowed reports whether the webhook comes from an address of the webhook_allowlist of
+// the carrier, or of WEBHOOK_IP_ALLOWLIST, IPs and CIDRs separated by commas. Carriers without
+// either take webhooks from anywhere.
+func webhookAllowed(carrier *Carrier, ip string) bool {
+	allowlist := carrier.Setting("webhook_allowlist", "WEBHOOK_IP_ALLOWLIST")
+	if strings.TrimSpace(allowlist) == "" {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range strings.Split(allowlist, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(addr) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckWebhook checks a webhook of a carrier before its handler parses it, answering the ones it
+// rejects. The nonce is claimed before the webhook is handled, so of concurrent deliveries of a
+// webhook only one passes. The nonce it returns is released with releaseWebhook when Inbound
+// failed, so a carrier retrying the webhook isn't taken for a replay.
+func (gateway *Gateway) CheckWebhook(c iris.Context, carrier *Carrier, handler CarrierHandler) (string, bool) {
+	ip := webhookPeer(c)
+	signer, signed := handler.(webhookSigner)
+	var policy WebhookPolicy
+	if signed {
+		policy = signer.webhookPolicy()
+	}
+	if policy.Algorithm == "" {
+		policy.Algorithm = "none"
+	}
+	if policy.Status == 0 {
+		policy.Status = http.StatusUnauthorized
+	}
+	reject := func(reason string, err error) (string, bool) {
+		webhookRejections.WithLabelValues(carrier.Name, policy.Algorithm, reason).Inc()
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Carrier.Inbound.Webhook",
+			"CarrierWebhookRejected",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"carrier":   carrier.Name,
+				"ip":        ip,
+				"algorithm": policy.Algorithm,
+				"reason":    reason,
+			}, err,
+		))
+		c.StatusCode(policy.Status)
+		return "", false
+	}
+
+	if !webhookAllowed(carrier, ip) {
+		return reject(webhookRejectedIP, fmt.Errorf("%s is not in the allowlist", ip))
+	}
+	if policy.Verify == nil {
+		return "", true
+	}
+
+	c.RecordRequestBody(true)
+	body, err := c.GetBody()
+	if err != nil {
+		c.StatusCode(http.StatusBadRequest)
+		return "", false
+	}
+	w := &InboundWebhook{Context: c, Body: body}
+	if err := policy.Verify(w); err != nil {
+		return reject(webhookRejectedSignature, err)
+	}
+	if policy.Timestamp != nil {
+		signedAt, err := policy.Timestamp(w)
+		if err != nil {
+			return reject(webhookRejectedTimestamp, err)
+		}
+		if age := time.Since(signedAt); age.Abs() > webhookTolerance {
+			return reject(webhookRejectedTimestamp, fmt.Errorf("timestamp outside tolerance: %v", age.Round(time.Second)))
+		}
+	}
+	if policy.Nonce == nil {
+		return "", true
+	}
+	nonce := policy.Nonce(w)
+	if nonce == "" {
+		return "", true
+	}
+	key := WebhookNonce(carrier, nonce)
+	claimed, err := gateway.WebhookNonces.SetNX(key, "1")
+	if err != nil {
+		// a failing cache doesn't refuse webhooks, nor does it hold a claim to release
+		return "", true
+	}
+	if !claimed {
+		return reject(webhookRejectedReplay, errors.New("nonce already handled"))
+	}
+	return key, true
+}
+
+// ReleaseWebhook forgets the nonce of a webhook Inbound failed to handle, the nonces are shared by
+// the instances with CACHE_BACKEND=redis.
+func (gateway *Gateway) ReleaseWebhook(key string) {
+	if key != "" {
+		_ = gateway.WebhookNonces.Delete(key)
+	}
+}
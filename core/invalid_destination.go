@@ -0,0 +1,80 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// invalidDestinationTTL is how long a destination a carrier rejected as invalid fails without
+// being sent again, 0 sends every message.
+var invalidDestinationTTL time.Duration
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		invalidDestinationTTL = alertDuration(cfg, "INVALID_DESTINATION_TTL", 24*time.Hour)
+	})
+}
+
+// InvalidDestination is the cached verdict of a carrier on a destination.
+type InvalidDestination struct {
+	Number   string    `json:"number"`
+	Route    string    `json:"route"`
+	Code     string    `json:"code,omitempty"`
+	Reason   string    `json:"reason"`
+	CachedAt time.Time `json:"cached_at"`
+}
+
+// CachedInvalidDestination is the verdict cached for a number, false when it has none.
+func (gateway *Gateway) CachedInvalidDestination(number string) (InvalidDestination, bool) {
+	var verdict InvalidDestination
+	if invalidDestinationTTL == 0 {
+		return verdict, false
+	}
+	value, ok, err := gateway.invalidCache.Get(invalidDestinationCacheKey + NumberKey(number))
+	if err != nil || !ok || json.Unmarshal([]byte(value), &verdict) != nil {
+		cacheLookups.WithLabelValues("invalid_destination", "miss").Inc()
+		return verdict, false
+	}
+	cacheLookups.WithLabelValues("invalid_destination", "hit").Inc()
+	return verdict, true
+}
+
+// InvalidDestinationError fails a message to a destination with its cached verdict, with the class
+// and code of the error the carrier returned.
+func InvalidDestinationError(verdict InvalidDestination) error {
+	return ClassifyError(ErrorClasses.InvalidDestination, verdict.Code,
+		fmt.Errorf("%s: %s (cached %s)", verdict.Route, verdict.Reason, verdict.CachedAt.UTC().Format(time.RFC3339)))
+}
+
+// CacheInvalidDestination caches the verdict of a route that rejected the destination of a message
+// as invalid.
+func (gateway *Gateway) CacheInvalidDestination(msg *MsgQueueItem, route string, err error) {
+	if invalidDestinationTTL == 0 {
+		return
+	}
+	verdict := InvalidDestination{
+		Number:   NumberKey(msg.To),
+		Route:    route,
+		Code:     errorCodeOf(err),
+		Reason:   err.Error(),
+		CachedAt: time.Now(),
+	}
+	encoded, _ := json.Marshal(verdict)
+	if err := gateway.invalidCache.Set(invalidDestinationCacheKey+verdict.Number, string(encoded)); err != nil {
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier.InvalidDestination",
+			"GenericError",
+			logrus.ErrorLevel,
+			gateway.MsgFields(msg, nil), err,
+		))
+	}
+}
+
+// ForgetInvalidDestination deletes the cached verdict of a number, e.g. once it was ported to a
+// carrier that can reach it.
+func (gateway *Gateway) ForgetInvalidDestination(number string) error {
+	return gateway.invalidCache.Delete(invalidDestinationCacheKey + NumberKey(number))
+}
@@ -0,0 +1,286 @@
+package core
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Carrier credentials, client usernames and webhook secrets are stored with envelope encryption:
+// every value is encrypted with AES-GCM under its own data key, and the data key is stored with it
+// wrapped by the key manager, e.g. "enc1:awskms:<wrapped data key>:<nonce and ciphertext>".
+const envelopePrefix = "enc1:"
+
+// KeyManager wraps and unwraps the data keys of the stored secrets.
+type KeyManager interface {
+	// Name is stored with every value, so a value is unwrapped by the manager that wrapped it.
+	Name() string
+	// GenerateDataKey returns a new AES-256 key, in the clear and wrapped.
+	GenerateDataKey(ctx context.Context) (key []byte, wrapped []byte, err error)
+	// DecryptDataKey unwraps a data key.
+	DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+var keyManagers = map[string]func() (KeyManager, error){
+	"local":  newLocalKeyManager,
+	"awskms": newAWSKeyManager,
+}
+
+// keyRing encrypts with the KMS_PROVIDER key manager, and decrypts with whichever manager wrapped
+// a value, so the stored values can be moved from one manager to another.
+type keyRing struct {
+	mu       sync.Mutex
+	current  KeyManager
+	managers map[string]KeyManager
+	dataKeys map[string][]byte // wrapped data key: data key
+}
+
+func newKeyRing() (*keyRing, error) {
+	ring := &keyRing{
+		managers: make(map[string]KeyManager),
+		dataKeys: make(map[string][]byte),
+	}
+	var err error
+	if ring.current, err = ring.manager(EnvString("KMS_PROVIDER", "local")); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// manager returns the key manager of a name, ring.mu must be held or the ring not shared yet.
+func (ring *keyRing) manager(name string) (KeyManager, error) {
+	if manager, ok := ring.managers[name]; ok {
+		return manager, nil
+	}
+	newManager, ok := keyManagers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown key manager: %s", name)
+	}
+	manager, err := newManager()
+	if err != nil {
+		return nil, fmt.Errorf("key manager %s: %w", name, err)
+	}
+	ring.managers[name] = manager
+	return manager, nil
+}
+
+// encrypt encrypts a value under a new data key.
+func (ring *keyRing) encrypt(plaintext string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key, wrapped, err := ring.current.GenerateDataKey(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+	sealed, err := sealGCM(key, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return envelopePrefix + ring.current.Name() + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// newDataKey generates a data key with the current key manager, with the wrapped key as it is
+// stored: the name of the manager and the base64 wrapped key.
+func (ring *keyRing) newDataKey() ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key, wrapped, err := ring.current.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+	encoded := base64.RawStdEncoding.EncodeToString(wrapped)
+	ring.mu.Lock()
+	ring.dataKeys[encoded] = key
+	ring.mu.Unlock()
+	return key, ring.current.Name() + ":" + encoded, nil
+}
+
+// decrypt decrypts a value encrypted by encrypt, the data keys are unwrapped once.
+func (ring *keyRing) decrypt(stored string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, envelopePrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("failed to decode data key: %w", err)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+
+	key, err := ring.dataKey(parts[0], parts[1], wrapped)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openGCM(key, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// dataKey unwraps a data key with the manager that wrapped it, once, encoded is the wrapped key as
+// it is stored. The key manager is called without ring.mu held, so a slow KMS doesn't hold up the
+// decrypts of keys already unwrapped; of concurrent unwraps of a key the first one stored is kept.
+func (ring *keyRing) dataKey(name string, encoded string, wrapped []byte) ([]byte, error) {
+	ring.mu.Lock()
+	if key, ok := ring.dataKeys[encoded]; ok {
+		ring.mu.Unlock()
+		return key, nil
+	}
+	manager, err := ring.manager(name)
+	ring.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key, err := manager.DecryptDataKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	if cached, ok := ring.dataKeys[encoded]; ok {
+		return cached, nil
+	}
+	ring.dataKeys[encoded] = key
+	return key, nil
+}
+
+func (ring *keyRing) isCurrent(stored string) bool {
+	return strings.HasPrefix(stored, envelopePrefix+ring.current.Name()+":")
+}
+
+// sealGCM encrypts with AES-GCM, the nonce is prepended to the ciphertext.
+func sealGCM(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openGCM(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// localKeyManager wraps the data keys with a key derived from ENCRYPTION_KEY.
+type localKeyManager struct {
+	key []byte
+}
+
+func newLocalKeyManager() (KeyManager, error) {
+	psk := Getenv("ENCRYPTION_KEY")
+	if psk == "" {
+		return nil, fmt.Errorf("ENCRYPTION_KEY is not set")
+	}
+	key := sha256.Sum256([]byte(psk))
+	return &localKeyManager{key: key[:]}, nil
+}
+
+func (m *localKeyManager) Name() string { return "local" }
+
+func (m *localKeyManager) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := sealGCM(m.key, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, wrapped, nil
+}
+
+func (m *localKeyManager) DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return openGCM(m.key, wrapped)
+}
+
+// awsKeyManager generates the data keys with the AWS KMS key KMS_KEY_ID, the gateway never sees
+// the key itself.
+type awsKeyManager struct {
+	client *kms.KMS
+	keyID  string
+}
+
+func newAWSKeyManager() (KeyManager, error) {
+	keyID := Getenv("KMS_KEY_ID")
+	if keyID == "" {
+		return nil, fmt.Errorf("KMS_KEY_ID is not set")
+	}
+	// AWS_REGION may come from .env or CONFIG_FILE, which the AWS chain doesn't read
+	options := session.Options{SharedConfigState: session.SharedConfigEnable}
+	if region := Getenv("AWS_REGION"); region != "" {
+		options.Config.Region = aws.String(region)
+	}
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		return nil, fmt.Errorf("AWS_REGION is not set")
+	}
+	return &awsKeyManager{client: kms.New(sess), keyID: keyID}, nil
+}
+
+func (m *awsKeyManager) Name() string { return "awskms" }
+
+func (m *awsKeyManager) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	out, err := m.client.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(m.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+func (m *awsKeyManager) DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	// symmetric KMS ciphertexts name their key, any key the gateway may use decrypts its own
+	out, err := m.client.DecryptWithContext(ctx, &kms.DecryptInput{CiphertextBlob: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,17 @@
+package core
+
+// LCRRoute is a least-cost routing entry, any number of carrier routes can serve the same
+// destination prefix. Candidates are tried by ascending priority, then ascending cost, with equal
+// cost routes shuffled by weight.
+type LCRRoute struct {
+	ID         uint    `gorm:"primaryKey" json:"id"`
+	Prefix     string  `gorm:"index" json:"prefix"` // destination prefix without "+", empty matches everything
+	NumberType string  `json:"number_type"`         // destinations of this type, see NumberTypes, empty for E.164 destinations
+	Route      string  `json:"route"`               // carrier route name
+	Cost       float64 `json:"cost"`
+	Weight     int     `json:"weight"`
+	Priority   int     `json:"priority"`
+	Disabled   bool    `json:"disabled"`
+	TenantID   uint    `gorm:"index" json:"tenant_id"` // entries of a tenant only route the messages of its clients
+	Version    uint    `gorm:"not null;default:1" json:"version"`
+}
@@ -0,0 +1,417 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (lm *LogManager) LoadTemplates() {
+	templates := map[string]string{
+		"GenericError":            "An error occurred: %v",
+		"UnexpectedError":         "Unexpected error: %v",
+		"UnhandledException":      "Unhandled exception: %v",
+		"CarrierNoDestinations":   "No destination numbers were included.",
+		"CarrierResponseUnparsed": "Carrier accepted the message, its response did not parse: %v",
+		"CarrierFetchMediaError":  "Unable to fetch media from: %v",
+		"CarrierWebhookRejected":  "Webhook rejected: %v",
+		"CarrierStatusCallback":   "Delivery status: %v",
+		"CarrierStatusIgnored":    "Status after the final status %v ignored",
+		"GRPCStream":              "gRPC stream %v",
+		"MQTTBridge":              "MQTT bridge: %v",
+		"QuietHours":              "Message held back: %v",
+		"QuotaExceeded":           "Message rejected: %v",
+		"MirrorSent":              "Copy sent to mirror route, error: %v",
+		"MirrorRefused":           "Mirror route %v delivers messages, no copy sent",
+		"MMSUpgrade":              "SMS of %v segments sent as MMS",
+		"MediaFallback":           "MMS delivered as SMS with media links expiring in %v",
+		"ReceiptsAggregated":      "Delivery receipts of the segments aggregated: %v",
+		"SaveMediaError":          "Unable to save media to DB: %v",
+		"MM4RemoveInactiveClient": "Removed inactive from MM4 server.",
+		"ParseAddressError":       "Failed to parse address: %v",
+		"AuthFailed":              "Authentication failed",
+		"AuthSuccess":             "Authentication success",
+		"BindLockedOut":           "Binds locked out after failures until %v",
+		"BindRefused":             "Bind refused, locked out until %v",
+		"MM4ReconnectInactivity":  "Reconnecting client after inactivity of >2 minutes.",
+		"MM4Reconnect":            "Reconnecting client",
+		"MM4SessionError":         "Session error: %v",
+		"RouterSendSMPP":          "Failed to send SMPP to client: %v",
+		"MM4HandleData":           "Handle data cmd.",
+		"RouterSendMM4":           "Failed to send MM4 to client: %v",
+		"RouterSendCarrier":       "Failed to send carrier: %v",
+		"NoFiles":                 "No files were included.",
+		"RouterSendFailed":        "Failed to send.",
+		"RouterFindSMPP":          "Failed to find SMPP client.",
+		"RouterFindCarrier":       "Failed to find carrier.",
+		"SMPPEnquireLinkError":    "Error enquiring link: %v",
+		"SMPPUnhandledPDU":        "Unhandled PDU: %v",
+		"SMPPLateResponse":        "Response arrived after the wait ended, sequence %v",
+		"SMPPResponsableError":    "Responsable Error: %v",
+		"SMPPPDUError":            "Error sending PDU: %v",
+		"SMPPFindSession":         "Failed to find SMPP session.",
+		"RouterDeadLetter":        "Message dead-lettered: %v",
+		"DeadLetterStoreError":    "Failed to store dead letter: %v",
+		"DeadLetterDropped":       "Dead letter dropped, the file storage backend can't keep it: %v",
+		"RoutingRuleInvalid":      "Skipping invalid routing rule: %v",
+		"RouterFailover":          "Carrier route failed, failing over: %v",
+		"DestinationCached":       "Destination rejected as invalid before, not sending: %v",
+		"RouteHealthChanged":      "Carrier route health changed: %v",
+		"RouterLoopDetected":      "Message loop detected: %v",
+		"ScheduledRelease":        "Releasing scheduled message due at %v",
+		"RouterQueueFull":         "Router queue full, rejecting message: %v",
+		"StoreForwardHeld":        "Client offline, holding message: %v",
+		"StoreForwardFlushed":     "Delivered held message after %v",
+		"MaintenanceRequeued":     "Destination in maintenance, queueing message: %v",
+		"MaintenanceChanged":      "Maintenance %v",
+		"RouteInMaintenance":      "Carrier route in maintenance, failing over: %v",
+		"RouterMessageExpired":    "Message expired at %v",
+		"SMPPDuplicateSubmit":     "Duplicate submit_sm suppressed, sequence %v",
+		"SMPPSubmitRejected":      "Rejected submit_sm: %v",
+		"SMPPCarrierBound":        "Bound to SMPP carrier at %v",
+		"SMPPCarrierBindFailed":   "Failed to bind to SMPP carrier: %v",
+		"SMPPCarrierUnbound":      "Lost bind to SMPP carrier at %v, rebinding",
+		"MM4ProxyConnection":      "Proxy connection from %v",
+		"MM4MessageReceived":      "Received MM4 message %v",
+		"SMPPSessionKicked":       "Session closed from the dashboard",
+		"AlertFiring":             "Alert firing: %v",
+		"AlertResolved":           "Alert resolved: %v",
+		"SecretsRotated":          "Secrets rotated, reloading %v",
+		"CredentialsMigrated":     "Migrated the stored credentials of %d rows",
+		"SchemaMigrated":          "Applied %d schema migrations",
+		"PostgresDown":            "PostgreSQL is unreachable: %v",
+		"PostgresRecovered":       "PostgreSQL is reachable again after %v",
+		"ProvisioningIssue":       "Provisioning issue: %v",
+		"UpgradeStarted":          "Upgrading, started the new process %v",
+		"UpgradeHandedOver":       "Handed the listeners over to process %v, draining",
+		"UpgradeDrained":          "Drained with %d SMPP sessions left, exiting",
+		"UpgradeFailed":           "Upgrade failed: %v",
+		"TenantRejected":          "Message rejected for its tenant: %v",
+		"OptOutKeyword":           "Processed opt-out keyword %s",
+		"OptOutRejected":          "Message rejected: %v",
+		"ContentScreened":         "Message content screened: %s",
+		"DestinationRejected":     "Message rejected: %v",
+		"AutoReplied":             "Answered the message with auto-reply %v",
+		"SourceRewritten":         "Rewrote the source address %v for the route",
+		"SourceUnmasked":          "Delivering the reply to the original source address %v",
+		"EmergencyBlocked":        "Blocked a message to emergency or special service number %v, texting it isn't supported",
+		"SMPPTraceStarted":        "Started capturing SMPP PDUs until %v",
+		"MM4TraceStarted":         "Started capturing MM4 transcripts until %v",
+		"TrafficThrottled":        "Client throttled after a traffic anomaly: %s",
+		"TrafficThrottleLifted":   "Client no longer throttled, its traffic is back to normal",
+		"NumberErased":            "Erased the messages and records of a number",
+		"CarrierSendSkipped":      "Message not sent again, an earlier attempt sent it",
+		"SessionForwarded":        "Client bound to instance %v, forwarding message",
+		"SMPPSessionTakenOver":    "Client bound to instance %v, closing the session here",
+		"HAPrimaryAcquired":       "Instance %v is now the primary",
+		"HATakeOver":              "Took over the in-flight work of the previous primary %v",
+		"HAPrimaryLost":           "Stepping down as the primary: %v",
+		"SMPPBindTypeRefused":     "Bind refused: %v",
+		"SMPPSegmentsCut":         "Message cut to the segment limit of the client, dropped %d segments",
+		"NumberPorted":            "Number served by another carrier than stored, it maps to carrier %q",
+		"NumberSyncIssue":         "Carrier account and stored numbers disagree: %v",
+		"NumberInactive":          "Message not routed: %v",
+		"NumberStateChanged":      "Number state changed to %v",
+		"MM4GroupRefused":         "Refused a group message to %d recipients, the client takes no group messages",
+	}
+
+	for name, template := range templates {
+		lm.AddTemplate(name, template)
+	}
+}
+
+// LogManager manages log templates and handles dispatching logs to Loki.
+type LogManager struct {
+	Templates  map[string]string
+	LokiClient *LokiClient
+	LogChannel chan *LoggingFormat
+	wg         sync.WaitGroup
+}
+
+// LoggingFormat represents the structure of a log message. LogID, Client and Route correlate
+// the log lines of a message across the servers, routers and carriers.
+type LoggingFormat struct {
+	Message        string                 `json:"message,omitempty"`
+	Error          error                  `json:"error,omitempty"`
+	Type           string                 `json:"type,omitempty"`
+	Subsystem      string                 `json:"subsystem,omitempty"`
+	LogID          string                 `json:"log_id,omitempty"`
+	Client         string                 `json:"client,omitempty"`
+	Route          string                 `json:"route,omitempty"`
+	Level          logrus.Level           `json:"level,omitempty"`
+	AdditionalData map[string]interface{} `json:"additional_data,omitempty"`
+	Timestamp      time.Time              `json:"timestamp,omitempty"`
+}
+
+// correlationFields maps the field names logs use for the correlation IDs onto the LogID, Client
+// and Route of the log.
+var correlationFields = map[string]string{
+	"logID":    "log_id",
+	"client":   "client",
+	"toClient": "client",
+	"systemID": "client",
+	"username": "client",
+	"route":    "route",
+	"carrier":  "route",
+}
+
+// logFormatter is the formatter of the local log output, JSON unless LOG_FORMAT is text.
+func logFormatter() logrus.Formatter {
+	if strings.ToLower(Getenv("LOG_FORMAT")) == "text" {
+		return &logrus.TextFormatter{FullTimestamp: true}
+	}
+	return &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+}
+
+// logSubsystem is the subsystem of a log type: the server for Server.* types, e.g. smpp for
+// Server.SMPP.HandleBind, otherwise the first part, e.g. router for Router.Carrier.Failover.
+func logSubsystem(logType string) string {
+	parts := strings.Split(strings.ToLower(logType), ".")
+	if len(parts) > 1 && parts[0] == "server" {
+		return parts[1]
+	}
+	return parts[0]
+}
+
+// IngressLogID is the log ID of a message received from a carrier: the carrier's message ID, so
+// the logs can be matched to the carrier's records, or a new ID when the carrier sent none.
+func IngressLogID(carrierMessageID string) string {
+	if carrierMessageID != "" {
+		return carrierMessageID
+	}
+	return primitive.NewObjectID().Hex()
+}
+
+// MsgFields adds the correlation fields of a message to the fields of a log about it: its log
+// ID, the client it belongs to unless fields name one, and the route once routing picked one.
+func (gateway *Gateway) MsgFields(msg *MsgQueueItem, fields map[string]interface{}) map[string]interface{} {
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["logID"] = msg.LogID
+	named := map[string]bool{}
+	for key := range fields {
+		named[correlationFields[key]] = true
+	}
+	if !named["client"] {
+		fields["client"] = gateway.ClientLabel(msg.From, msg.To)
+	}
+	if !named["route"] && msg.Decision != nil && msg.Decision.Route != "" {
+		fields["route"] = msg.Decision.Route
+	}
+	return fields
+}
+
+// LogEntry represents a log entry for Loki.
+type LogEntry struct {
+	Timestamp time.Time
+	Line      string
+}
+
+// LokiPushData represents the data structure required by Loki's push API.
+type LokiPushData struct {
+	Streams []LokiStream `json:"streams"`
+}
+
+// LokiStream represents a stream of logs with the same labels in Loki.
+type LokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"` // Array of [timestamp, line] tuples
+}
+
+// LokiClient handles interactions with the Loki service.
+type LokiClient struct {
+	PushURL  string
+	Username string
+	Password string
+}
+
+// NewLokiClient initializes a new Loki client.
+func NewLokiClient(pushURL, username, password string) *LokiClient {
+	return &LokiClient{
+		PushURL:  pushURL,
+		Username: username,
+		Password: password,
+	}
+}
+
+// PushLog sends a log entry to Loki.
+func (c *LokiClient) PushLog(labels map[string]string, entry LogEntry) error {
+	payload := LokiPushData{
+		Streams: []LokiStream{
+			{
+				Stream: labels,
+				Values: [][2]string{
+					{strconv.FormatInt(entry.Timestamp.UnixNano(), 10), entry.Line},
+				},
+			},
+		},
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON payload: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", c.PushURL, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.Username != "" && c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request to Loki: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from Loki: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// NewLogManager initializes a new LogManager.
+func NewLogManager(lokiClient *LokiClient) *LogManager {
+	lm := &LogManager{
+		Templates:  make(map[string]string),
+		LokiClient: lokiClient,
+		LogChannel: make(chan *LoggingFormat),
+	}
+	logrus.SetFormatter(logFormatter())
+	lm.wg.Add(1)
+	go lm.processLogChannel()
+	return lm
+}
+
+// AddTemplate adds a new log template to the manager.
+func (lm *LogManager) AddTemplate(name, template string) {
+	lm.Templates[strings.ToUpper(name)] = template
+}
+
+// BuildLog creates and formats a log message dynamically.
+func (lm *LogManager) BuildLog(logType string, templateName string, level logrus.Level, fields map[string]interface{}, args ...interface{}) *LoggingFormat {
+	message := lm.formatTemplate(templateName, args...)
+	lf := &LoggingFormat{
+		Message:   message,
+		Type:      strings.ToUpper(logType),
+		Subsystem: logSubsystem(logType),
+		Level:     level,
+		Timestamp: time.Now(),
+	}
+	for key, value := range fields {
+		switch correlationFields[key] {
+		case "log_id":
+			lf.LogID = fmt.Sprint(value)
+		case "client":
+			lf.Client = fmt.Sprint(value)
+		case "route":
+			lf.Route = fmt.Sprint(value)
+		default:
+			lf.AddField(key, value)
+		}
+	}
+	return lf
+}
+
+// AddField adds a new field to an already built log.
+func (lf *LoggingFormat) AddField(key string, value interface{}) {
+	if lf.AdditionalData == nil {
+		lf.AdditionalData = make(map[string]interface{})
+	}
+	lf.AdditionalData[key] = value
+}
+
+// formatTemplate formats a template with provided arguments.
+func (lm *LogManager) formatTemplate(templateName string, args ...interface{}) string {
+	template, exists := lm.Templates[strings.ToUpper(templateName)]
+	if !exists {
+		return fmt.Sprintf(templateName, args...)
+	}
+	return fmt.Sprintf(template, args...)
+}
+
+// SendLog sends a log to Loki asynchronously via the log channel.
+func (lm *LogManager) SendLog(log *LoggingFormat) {
+	log.Print()
+	lm.LogChannel <- log
+}
+
+// processLogChannel processes logs from the channel and sends them to Loki.
+func (lm *LogManager) processLogChannel() {
+	defer lm.wg.Done()
+	for log := range lm.LogChannel {
+		labels := map[string]string{
+			"job":       "sms-mms-gateway",
+			"server_id": Getenv("SERVER_ID"),
+			"type":      log.Type,
+			"subsystem": log.Subsystem,
+		}
+		logLine := log.String()
+		entry := LogEntry{
+			Timestamp: log.Timestamp,
+			Line:      logLine,
+		}
+		if err := lm.LokiClient.PushLog(labels, entry); err != nil {
+			logrus.Error("Failed to send log to Loki:", err)
+		}
+	}
+}
+
+// Print outputs the log locally (stdout or logrus).
+func (lf *LoggingFormat) Print() {
+	// the correlation fields are on every line, empty when the log isn't about a message
+	logEntry := logrus.WithTime(lf.Timestamp).WithFields(logrus.Fields{
+		"type":      lf.Type,
+		"subsystem": lf.Subsystem,
+		"log_id":    lf.LogID,
+		"client":    lf.Client,
+		"route":     lf.Route,
+	})
+	if lf.Error != nil {
+		logEntry = logEntry.WithError(lf.Error)
+	}
+
+	for key, value := range lf.AdditionalData {
+		logEntry = logEntry.WithField(key, value)
+	}
+
+	switch lf.Level {
+	case logrus.ErrorLevel:
+		logEntry.Error(lf.Message)
+	case logrus.WarnLevel:
+		logEntry.Warn(lf.Message)
+	case logrus.DebugLevel:
+		logEntry.Debug(lf.Message)
+	default:
+		logEntry.Info(lf.Message)
+	}
+}
+
+// String serializes the LoggingFormat into JSON for Loki.
+func (lf *LoggingFormat) String() string {
+	data, err := json.Marshal(lf)
+	if err != nil {
+		return fmt.Sprintf("Error serializing log: %v", err)
+	}
+	return string(data)
+}
+
+// CloseLogManager gracefully shuts down the log manager and waits for the log channel to empty.
+func (lm *LogManager) CloseLogManager() {
+	close(lm.LogChannel)
+	lm.wg.Wait()
+}
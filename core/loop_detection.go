@@ -0,0 +1,18 @@
+package core
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// Fingerprint identifies a message by its addresses and content, it survives the trip through a
+// carrier where the hop count and trace are lost.
+func (msg *MsgQueueItem) Fingerprint() string {
+	hash := sha1.New()
+	hash.Write([]byte(NumberKey(msg.From) + "|" + NumberKey(msg.To) + "|" + string(msg.Type) + "|" + msg.Message))
+	for _, file := range msg.Files {
+		hash.Write([]byte(file.Filename))
+		hash.Write(file.Content)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,29 @@
+package core
+
+import (
+	"time"
+)
+
+// MaintenanceKinds are what can be put into maintenance.
+var MaintenanceKinds = struct {
+	Client string
+	Route  string
+}{
+	Client: "client", // messages to the client are queued until the maintenance ends
+	Route:  "route",  // outbound messages fail over to the next route of their plan
+}
+
+// Maintenance puts a client or a carrier route into maintenance until it is ended, or until Until.
+type Maintenance struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Kind      string     `gorm:"uniqueIndex:idx_maintenance_target;not null" json:"kind"`
+	Name      string     `gorm:"uniqueIndex:idx_maintenance_target;not null" json:"name"` // client username or route name
+	Reason    string     `json:"reason"`
+	Until     *time.Time `json:"until,omitempty"` // nil until it is ended
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Active reports whether the maintenance is still on at now.
+func (m Maintenance) Active(now time.Time) bool {
+	return m.Until == nil || now.Before(*m.Until)
+}
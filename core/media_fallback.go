@@ -0,0 +1,93 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mediaLinkTTL is how long the links of an MMS delivered as SMS work, unless the profile of the
+// client sets its own. Links never outlive MEDIA_RETENTION.
+var mediaLinkTTL time.Duration
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		mediaLinkTTL = cfg.Duration("MEDIA_LINK_TTL", 72*time.Hour)
+	})
+}
+
+// mediaLinkSecret keys the signatures of media links, the ENCRYPTION_KEY when not set.
+var mediaLinkSecret = func() string {
+	if secret := Getenv("MEDIA_LINK_SECRET"); secret != "" {
+		return secret
+	}
+	return Getenv("ENCRYPTION_KEY")
+}()
+
+// MediaFallback reports whether MMS to the number are delivered as SMS with links to their media:
+// the profile of its client takes no MMS and falls back, or the number itself can't receive MMS.
+func MediaFallback(client *Client, number *ClientNumber) bool {
+	if client == nil {
+		return false
+	}
+	return (number != nil && number.MMSFallback) || (client.Profile.NoMMS && client.Profile.MMSFallback)
+}
+
+// LinkLifetime is how long the media links of messages for the client work.
+func (profile ClientProfile) LinkLifetime() time.Duration {
+	ttl := mediaLinkTTL
+	if profile.MediaLinkTTL > 0 {
+		ttl = time.Duration(profile.MediaLinkTTL) * time.Second
+	}
+	if ttl > mediaRetention {
+		ttl = mediaRetention
+	}
+	return ttl
+}
+
+// mediaLinkSignature signs the file and expiry of a media link.
+func mediaLinkSignature(id uint, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(mediaLinkSecret))
+	fmt.Fprintf(mac, "%d.%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// mediaLinkURL is the link to a file that works until it expires.
+func mediaLinkURL(id uint, expires time.Time) string {
+	return fmt.Sprintf("%s/media/%d?expires=%d&sig=%s", Getenv("SERVER_ADDRESS"), id, expires.Unix(), mediaLinkSignature(id, expires.Unix()))
+}
+
+// ValidMediaLink checks the signature and expiry of a link to a file.
+func ValidMediaLink(id uint, expires string, signature string) bool {
+	at, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > at {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(mediaLinkSignature(id, at)))
+}
+
+// FallbackToSMS turns an MMS into an SMS with its text and a link per file, the files are stored
+// until the links expire and are only served with their signature.
+func (gateway *Gateway) FallbackToSMS(msg *MsgQueueItem, client *Client) error {
+	expires := time.Now().Add(client.Profile.LinkLifetime())
+	var urls []string
+	for _, file := range msg.Files {
+		if strings.Contains(file.ContentType, "application/smil") {
+			continue
+		}
+		id, err := gateway.saveMediaFile(file, msg.LogID, expires, true)
+		if err != nil {
+			return err
+		}
+		urls = append(urls, mediaLinkURL(id, expires))
+	}
+
+	msg.Type = MsgQueueItemType.SMS
+	msg.Message = strings.TrimSpace(strings.Join(append([]string{msg.Message}, urls...), "\n"))
+	msg.Files = nil
+	return nil
+}
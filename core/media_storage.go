@@ -1,19 +1,14 @@
-package main
+package core
 
 import (
 	"errors"
 	"fmt"
 	"gorm.io/gorm"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
-const (
-	TTLDuration = 7 * 24 * time.Hour // 7-day expiration
-)
-
 func (gateway *Gateway) uploadMediaGetUrls(mms *MsgQueueItem) ([]string, error) {
 	var mediaUrls []string
 
@@ -23,12 +18,12 @@ func (gateway *Gateway) uploadMediaGetUrls(mms *MsgQueueItem) ([]string, error)
 				continue
 			}
 
-			id, err := gateway.saveMsgFileMedia(i)
+			id, err := gateway.SaveMsgFileMedia(i, mms.LogID)
 			if err != nil {
 				return mediaUrls, err
 			}
 
-			mediaUrls = append(mediaUrls, os.Getenv("SERVER_ADDRESS")+"/media/"+strconv.Itoa(int(id)))
+			mediaUrls = append(mediaUrls, Getenv("SERVER_ADDRESS")+"/media/"+strconv.Itoa(int(id)))
 		}
 		return mediaUrls, nil
 	}
@@ -40,33 +35,27 @@ type MediaFile struct {
 	FileName    string    `json:"file_name"`
 	ContentType string    `json:"content_type"`
 	Base64Data  string    `json:"base64_data"`
+	LogID       string    `gorm:"index" json:"log_id"` // of the message the file was sent with
 	UploadAt    time.Time `json:"upload_at"`
 	ExpiresAt   time.Time `gorm:"index" json:"expires_at"`
+	Signed      bool      `json:"signed"` // served only with a valid media link, see mediaLinkURL
 }
 
-func (gateway *Gateway) cleanUpExpiredMediaFiles() {
-	ticker := time.NewTicker(24 * time.Hour) // Adjust the interval as needed
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			err := gateway.DB.Where("expires_at < ?", time.Now()).Delete(&MediaFile{}).Error
-			if err != nil {
-				// Log the error
-				fmt.Printf("Failed to clean up expired media files: %v\n", err)
-			}
-		}
-	}
+// SaveMsgFileMedia stores a file of a message until MEDIA_RETENTION has passed.
+func (gateway *Gateway) SaveMsgFileMedia(file MsgFile, logID string) (uint, error) {
+	return gateway.saveMediaFile(file, logID, time.Now().Add(mediaRetention), false)
 }
 
-func (gateway *Gateway) saveMsgFileMedia(file MsgFile) (uint, error) {
+// saveMediaFile stores a file of a message until it expires, signed files only for media links.
+func (gateway *Gateway) saveMediaFile(file MsgFile, logID string, expiresAt time.Time, signed bool) (uint, error) {
 	mediaFile := MediaFile{
 		FileName:    file.Filename,
 		ContentType: file.ContentType,
 		Base64Data:  string(file.Content),
+		LogID:       logID,
 		UploadAt:    time.Now(),
-		ExpiresAt:   time.Now().Add(TTLDuration),
+		ExpiresAt:   expiresAt,
+		Signed:      signed,
 	}
 
 	if err := gateway.DB.Create(&mediaFile).Error; err != nil {
@@ -76,7 +65,7 @@ func (gateway *Gateway) saveMsgFileMedia(file MsgFile) (uint, error) {
 	return mediaFile.ID, nil
 }
 
-func (gateway *Gateway) getMediaFile(fileID uint) (*MediaFile, error) {
+func (gateway *Gateway) GetMediaFile(fileID uint) (*MediaFile, error) {
 	var mediaFile MediaFile
 	if err := gateway.DB.First(&mediaFile, fileID).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
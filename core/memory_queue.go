@@ -0,0 +1,159 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrMemoryQueueFull is returned when an in-process queue has no room left.
+var ErrMemoryQueueFull = errors.New("memory queue full")
+
+var memoryQueueSize int
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		memoryQueueSize = cfg.Int("QUEUE_MEMORY_SIZE", 10000)
+	})
+}
+
+// MemoryQueue is an in-process MessageQueue for single node installs without a broker. Messages
+// don't survive a restart. Rejected messages are moved to the dead letter queue like the
+// gateway-dlx policy does in RabbitMQ.
+type MemoryQueue struct {
+	mu     sync.Mutex
+	queues map[string]chan QueueDelivery
+	done   chan struct{}
+	closed bool
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{
+		queues: make(map[string]chan QueueDelivery),
+		done:   make(chan struct{}),
+	}
+}
+
+// QueueDepths reports the messages waiting in each queue.
+func (queue *MemoryQueue) QueueDepths() map[string]int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	depths := make(map[string]int, len(queue.queues))
+	for name, ch := range queue.queues {
+		depths[name] = len(ch)
+	}
+	return depths
+}
+
+func (queue *MemoryQueue) channel(queueName string) chan QueueDelivery {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	ch, ok := queue.queues[queueName]
+	if !ok {
+		ch = make(chan QueueDelivery, memoryQueueSize)
+		queue.queues[queueName] = ch
+	}
+	return ch
+}
+
+func (queue *MemoryQueue) Publish(ctx context.Context, queueName string, data []byte) error {
+	return queue.PublishWithHeaders(ctx, queueName, data, nil)
+}
+
+func (queue *MemoryQueue) PublishWithHeaders(ctx context.Context, queueName string, data []byte, headers map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return queue.publish(queueName, data, headers)
+}
+
+// publish hands the message to the consumers of the queue, it never blocks.
+func (queue *MemoryQueue) publish(queueName string, data []byte, headers map[string]interface{}) error {
+	if !queue.Ready() {
+		return errors.New("memory queue closed")
+	}
+
+	delivery := QueueDelivery{
+		Queue:   queueName,
+		Body:    data,
+		Headers: headers,
+	}
+	delivery.nack = func(requeue bool) error {
+		if requeue {
+			return queue.publish(queueName, data, headers)
+		}
+		if queueName == DeadLetterQueue {
+			return nil
+		}
+		return queue.publish(DeadLetterQueue, data, map[string]interface{}{
+			"x-origin-queue":       queueName,
+			"x-dead-letter-reason": "rejected",
+		})
+	}
+
+	select {
+	case queue.channel(queueName) <- delivery:
+		return nil
+	default:
+		return ErrMemoryQueueFull
+	}
+}
+
+func (queue *MemoryQueue) PublishDelayed(ctx context.Context, queueName string, data []byte, headers map[string]interface{}, delay time.Duration) error {
+	if delay <= 0 {
+		return queue.PublishWithHeaders(ctx, queueName, data, headers)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	time.AfterFunc(delay, func() {
+		_ = queue.publish(queueName, data, headers)
+	})
+	return nil
+}
+
+func (queue *MemoryQueue) Consume(queueName string) <-chan QueueDelivery {
+	out := make(chan QueueDelivery)
+	in := queue.channel(queueName)
+
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-queue.done:
+				return
+			case delivery := <-in:
+				select {
+				case out <- delivery:
+				case <-queue.done:
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+func (queue *MemoryQueue) Ready() bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return !queue.closed
+}
+
+func (queue *MemoryQueue) Accepting() bool {
+	return queue.Ready()
+}
+
+func (queue *MemoryQueue) Close() error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.closed {
+		return errors.New("memory queue already closed")
+	}
+	queue.closed = true
+	close(queue.done)
+	return nil
+}
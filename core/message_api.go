@@ -0,0 +1,360 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIMediaMaxSize bounds the media of a message submitted through the API, in bytes.
+var APIMediaMaxSize int
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		APIMediaMaxSize = cfg.Int("API_MEDIA_MAX_SIZE", 5*1024*1024)
+	})
+}
+
+// MessageRequest is the body of POST /messages. Multipart requests carry the same fields as form
+// values and the media as "media" file parts, JSON requests carry the media base64 encoded. With
+// a template, or variables, the message text is rendered from its {{placeholders}}.
+type MessageRequest struct {
+	Client    string            `json:"client"` // username, defaults to the client owning the from number
+	From      string            `json:"from"`
+	To        string            `json:"to"`
+	Message   string            `json:"message"`
+	Template  string            `json:"template,omitempty"` // name of a message template replacing the message
+	Variables map[string]string `json:"variables,omitempty"`
+	Media     []MessageMedia    `json:"media,omitempty"`
+	// AllowInternational sends the message abroad for clients with the flag international policy
+	AllowInternational bool `json:"allow_international,omitempty"`
+}
+
+type MessageMedia struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+}
+
+// MessageAccepted is the response to a message queued through the API, the message ID is the
+// LogID used by GET /messages/{id}, the routing audit and the logs.
+type MessageAccepted struct {
+	MessageID string       `json:"message_id"`
+	Client    string       `json:"client"`
+	From      string       `json:"from_number"`
+	To        string       `json:"to_number"`
+	Type      MsgQueueType `json:"type"`
+	Segments  int          `json:"segments,omitempty"` // estimated SMS segments
+}
+
+// MessageHistory is everything recorded about a message: the routing decisions of every router
+// it passed through, the carrier sends and their delivery statuses, and where it ended up.
+type MessageHistory struct {
+	MessageID       string            `json:"message_id"`
+	Status          string            `json:"status"`
+	Routing         []RoutingDecision `json:"routing"`
+	CarrierMessages []CarrierMessage  `json:"carrier_messages"`
+	Records         []MsgRecordDBItem `json:"records"`
+	DeadLetters     []DeadLetter      `json:"dead_letters,omitempty"`
+	Scheduled       *ScheduledMessage `json:"scheduled,omitempty"`
+}
+
+// readMessageRequest reads a JSON or multipart message request.
+func readMessageRequest(ctx iris.Context) (MessageRequest, error) {
+	var req MessageRequest
+	if !strings.HasPrefix(ctx.GetContentTypeRequested(), "multipart/") {
+		if err := ctx.ReadJSON(&req); err != nil {
+			return req, Invalid("invalid request data")
+		}
+		return req, nil
+	}
+
+	r := ctx.Request()
+	r.Body = http.MaxBytesReader(ctx.ResponseWriter(), r.Body, int64(APIMediaMaxSize)+1<<20)
+	if err := r.ParseMultipartForm(int64(APIMediaMaxSize)); err != nil {
+		return req, Invalid("invalid multipart request: %v", err)
+	}
+	req.Client = r.FormValue("client")
+	req.From = r.FormValue("from")
+	req.To = r.FormValue("to")
+	req.Message = r.FormValue("message")
+	req.Template = r.FormValue("template")
+
+	for _, header := range r.MultipartForm.File["media"] {
+		f, err := header.Open()
+		if err != nil {
+			return req, err
+		}
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return req, err
+		}
+		req.Media = append(req.Media, MessageMedia{
+			Filename:    header.Filename,
+			ContentType: header.Header.Get("Content-Type"),
+			Content:     content,
+		})
+	}
+	return req, nil
+}
+
+// SubmitMessage queues a message into the client router as if the client had sent it over SMPP
+// or MM4, messages with media are sent as MMS.
+func (gateway *Gateway) SubmitMessage(req MessageRequest) (MessageAccepted, error) {
+	msg, client, err := gateway.NewAPIMessage(req)
+	if err != nil {
+		return MessageAccepted{}, err
+	}
+	if err := gateway.Router.OfferClientMessage(msg); err != nil {
+		return MessageAccepted{}, err
+	}
+	return AcceptedMessage(&msg, client), nil
+}
+
+// AcceptedMessage is the response to a message queued for the client.
+func AcceptedMessage(msg *MsgQueueItem, client *Client) MessageAccepted {
+	accepted := MessageAccepted{
+		MessageID: msg.LogID,
+		Client:    client.Username,
+		From:      msg.From,
+		To:        msg.To,
+		Type:      msg.Type,
+	}
+	if msg.Type == MsgQueueItemType.SMS {
+		accepted.Segments = EstimateSegments(msg.Message).Segments
+	}
+	return accepted
+}
+
+// NewAPIMessage builds the message of a request and resolves the client it is sent for.
+func (gateway *Gateway) NewAPIMessage(req MessageRequest) (MsgQueueItem, *Client, error) {
+	if req.From == "" || req.To == "" {
+		return MsgQueueItem{}, nil, Invalid("from and to are required")
+	}
+	client, err := gateway.apiClient(req.Client, req.From)
+	if err != nil {
+		return MsgQueueItem{}, nil, err
+	}
+	text := req.Message
+	if req.Template != "" {
+		template, err := gateway.findMessageTemplate(req.Template, client)
+		if err != nil {
+			return MsgQueueItem{}, nil, err
+		}
+		text = template.Body
+	}
+	if req.Template != "" || len(req.Variables) > 0 {
+		if text, err = renderTemplate(text, req.Variables); err != nil {
+			return MsgQueueItem{}, nil, err
+		}
+	}
+	if text == "" && len(req.Media) == 0 {
+		return MsgQueueItem{}, nil, Invalid("message or media is required")
+	}
+
+	msg := MsgQueueItem{
+		To:                 req.To,
+		From:               req.From,
+		ReceivedTimestamp:  time.Now(),
+		Type:               MsgQueueItemType.SMS,
+		Message:            text,
+		LogID:              primitive.NewObjectID().Hex(),
+		AllowInternational: req.AllowInternational,
+	}
+	msg.TraceID = msg.LogID
+	NormalizeAddresses(&msg, client)
+
+	if len(req.Media) > 0 {
+		msg.Type = MsgQueueItemType.MMS
+		size := 0
+		for _, media := range req.Media {
+			size += len(media.Content)
+			if len(media.Content) == 0 {
+				return MsgQueueItem{}, nil, Invalid("media %s is empty", media.Filename)
+			}
+			contentType := media.ContentType
+			if contentType == "" || contentType == "application/octet-stream" {
+				contentType = http.DetectContentType(media.Content)
+			}
+			msg.Files = append(msg.Files, MsgFile{
+				Filename:    media.Filename,
+				ContentType: contentType,
+				Content:     media.Content,
+				Size:        len(media.Content),
+			})
+		}
+		if size > APIMediaMaxSize {
+			return MsgQueueItem{}, nil, Invalid("media exceeds %d bytes", APIMediaMaxSize)
+		}
+	}
+	return msg, client, nil
+}
+
+// apiClient is the client a message from the number is sent for: the named client, which must
+// own the number, else the client owning it.
+func (gateway *Gateway) apiClient(username string, from string) (*Client, error) {
+	if username == "" {
+		owner, err := gateway.FindClientByNumber(from)
+		if err != nil {
+			return nil, Invalid("%v", err)
+		}
+		return owner, nil
+	}
+
+	gateway.Mu.RLock()
+	client := gateway.Clients[username]
+	gateway.Mu.RUnlock()
+	if client == nil {
+		return nil, Invalid("client %s does not exist", username)
+	}
+	probe := MsgQueueItem{From: from}
+	NormalizeAddresses(&probe, client)
+	if owner, err := gateway.FindClientByNumber(probe.From); err != nil || owner.ID != client.ID {
+		return nil, Invalid("number %s does not belong to client %s", probe.From, client.Username)
+	}
+	return client, nil
+}
+
+// messageHistory collects the records of a message by its message ID.
+func (gateway *Gateway) messageHistory(id string) (MessageHistory, error) {
+	history := MessageHistory{MessageID: id}
+	if err := gateway.DB.Where("log_id = ? OR trace_id = ?", id, id).Order("id asc").Find(&history.Routing).Error; err != nil {
+		return history, err
+	}
+	for _, dest := range []interface{}{&history.CarrierMessages, &history.Records, &history.DeadLetters} {
+		if err := gateway.DB.Where("log_id = ?", id).Order("id asc").Find(dest).Error; err != nil {
+			return history, err
+		}
+	}
+	// the payload duplicates the message, including its content
+	for i := range history.DeadLetters {
+		history.DeadLetters[i].Payload = ""
+	}
+	if scheduled, err := gateway.GetScheduledMessage(id); err == nil {
+		scheduled.Payload = ""
+		history.Scheduled = scheduled
+	}
+
+	history.Status = history.status()
+	if history.Status == "" {
+		return history, fmt.Errorf("%w: no records of message %s", ErrNotFound, id)
+	}
+	return history, nil
+}
+
+// status is the latest known state of the message: the delivery status reported by the carrier,
+// else where routing left it. A message spends a moment in the router queue before anything is
+// recorded, its status is empty until then.
+func (history *MessageHistory) status() string {
+	if len(history.CarrierMessages) > 0 {
+		latest := history.CarrierMessages[0]
+		for _, m := range history.CarrierMessages[1:] {
+			if m.UpdatedAt.After(latest.UpdatedAt) {
+				latest = m
+			}
+		}
+		return latest.Status
+	}
+	if len(history.DeadLetters) > 0 {
+		return DeliveryStatuses.Failed
+	}
+	if n := len(history.Routing); n > 0 {
+		switch history.Routing[n-1].Outcome {
+		case RoutingOutcomes.Delivered:
+			return DeliveryStatuses.Sent
+		case RoutingOutcomes.DeadLetter:
+			return DeliveryStatuses.Failed
+		case RoutingOutcomes.Quarantined:
+			return "quarantined"
+		}
+		return DeliveryStatuses.Queued
+	}
+	if history.Scheduled != nil {
+		if history.Scheduled.Status == ScheduledStatuses.Pending {
+			return "scheduled"
+		}
+		return string(history.Scheduled.Status)
+	}
+	if len(history.Records) > 0 {
+		return DeliveryStatuses.Sent
+	}
+	return ""
+}
+
+// RequestClient is the username of the client a message is sent for, empty when no client owns
+// the from number.
+func (gateway *Gateway) RequestClient(req MessageRequest) string {
+	if req.Client != "" {
+		return req.Client
+	}
+	if owner, err := gateway.FindClientByNumber(req.From); err == nil {
+		return owner.Username
+	}
+	return ""
+}
+
+// SetupMessageRoutes sets up the endpoints sending messages on behalf of clients and reporting
+// their status.
+func SetupMessageRoutes(app *iris.Application, gateway *Gateway) {
+	messages := app.Party("/messages", gateway.BasicAuthMiddleware)
+	{
+		// Send an SMS, or an MMS when media is attached
+		messages.Post("/", func(ctx iris.Context) {
+			req, err := readMessageRequest(ctx)
+			if err == nil {
+				err = gateway.CheckClientScope(ctx, gateway.RequestClient(req))
+			}
+			if err == nil {
+				var accepted MessageAccepted
+				if accepted, err = gateway.SubmitMessage(req); err == nil {
+					ctx.StatusCode(iris.StatusAccepted)
+					ctx.JSON(accepted)
+					return
+				}
+			}
+			if errors.Is(err, ErrQueueFull) {
+				ctx.StatusCode(iris.StatusServiceUnavailable)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+			WriteProvisioningError(ctx, err)
+		})
+
+		// Send a template, or a message with placeholders, to a list of recipients
+		messages.Post("/bulk", func(ctx iris.Context) {
+			var req BulkRequest
+			if err := ctx.ReadJSON(&req); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			if err := gateway.CheckClientScope(ctx, gateway.RequestClient(MessageRequest{Client: req.Client, From: req.From})); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			result, err := gateway.sendBulk(req)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.StatusCode(iris.StatusAccepted)
+			ctx.JSON(result)
+		})
+
+		// Status and history of a message
+		messages.Get("/{id:string}", func(ctx iris.Context) {
+			history, err := gateway.messageHistory(ctx.Params().Get("id"))
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			gateway.RevealRecords(ctx, history.Records)
+			ctx.JSON(history)
+		})
+	}
+}
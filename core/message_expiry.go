@@ -0,0 +1,53 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrMessageExpired is returned by sendCarrier when the message expires between attempts.
+var ErrMessageExpired = errors.New("message expired")
+
+var (
+	DefaultMessageTTL   time.Duration
+	ExpirySweepInterval time.Duration
+	sendTimeout         time.Duration
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		DefaultMessageTTL = cfg.Duration("MESSAGE_TTL", 24*time.Hour)
+		ExpirySweepInterval = cfg.Duration("EXPIRY_SWEEP_INTERVAL", time.Minute)
+		sendTimeout = cfg.Duration("SEND_TIMEOUT", 2*time.Minute)
+	})
+}
+
+// StampExpiry sets the expiry of a message that doesn't have one yet, counting from when it was
+// received.
+func StampExpiry(msg *MsgQueueItem, ttl time.Duration) {
+	if !msg.ExpiresAt.IsZero() || ttl <= 0 {
+		return
+	}
+	received := msg.ReceivedTimestamp
+	if received.IsZero() {
+		received = time.Now()
+	}
+	msg.ExpiresAt = received.Add(ttl)
+}
+
+// Expired reports whether the message is past its time-to-live.
+func (msg *MsgQueueItem) Expired(now time.Time) bool {
+	return !msg.ExpiresAt.IsZero() && now.After(msg.ExpiresAt)
+}
+
+// SendContext returns the context a router delivers the message under. It is cancelled after
+// SEND_TIMEOUT, or when the message expires if that is sooner, so a hung carrier API call or a
+// stuck SMTP session is abandoned and the message retried or expired.
+func (msg *MsgQueueItem) SendContext(parent context.Context) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(sendTimeout)
+	if !msg.ExpiresAt.IsZero() && msg.ExpiresAt.Before(deadline) {
+		deadline = msg.ExpiresAt
+	}
+	return context.WithDeadline(parent, deadline)
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// MessageQueue is the queue backend between the ingress servers and the routers. The router only
+// talks to this interface, so the broker can be swapped through QUEUE_BACKEND.
+type MessageQueue interface {
+	// Publish sends a message to the queue, giving up when ctx is done.
+	Publish(ctx context.Context, queueName string, data []byte) error
+	// PublishWithHeaders sends a message with headers to the queue, giving up when ctx is done.
+	PublishWithHeaders(ctx context.Context, queueName string, data []byte, headers map[string]interface{}) error
+	// PublishDelayed sends a message that only becomes visible to consumers after the delay.
+	PublishDelayed(ctx context.Context, queueName string, data []byte, headers map[string]interface{}, delay time.Duration) error
+	// Consume returns the deliveries of a queue, the channel is closed when the backend closes.
+	Consume(queueName string) <-chan QueueDelivery
+	// Ready reports whether the backend is currently connected.
+	Ready() bool
+	// Accepting reports whether a publish would currently succeed or be buffered.
+	Accepting() bool
+	Close() error
+}
+
+// QueueDelivery is a message received from a MessageQueue. It has to be acked once handled, or
+// nacked to either requeue it or move it to the dead letter queue.
+type QueueDelivery struct {
+	Queue   string
+	Body    []byte
+	Headers map[string]interface{}
+
+	ack  func() error
+	nack func(requeue bool) error
+}
+
+// NewQueueDelivery creates the delivery of a MessageQueue implemented outside this package, ack
+// and nack settle the message.
+func NewQueueDelivery(queue string, body []byte, headers map[string]interface{}, ack func() error, nack func(requeue bool) error) QueueDelivery {
+	return QueueDelivery{Queue: queue, Body: body, Headers: headers, ack: ack, nack: nack}
+}
+
+func (delivery *QueueDelivery) Ack() error {
+	if delivery.ack == nil {
+		return nil
+	}
+	return delivery.ack()
+}
+
+func (delivery *QueueDelivery) Nack(requeue bool) error {
+	if delivery.nack == nil {
+		return nil
+	}
+	return delivery.nack(requeue)
+}
+
+// queueNames are the queues the gateway consumes, the retry queues are derived from them.
+var queueNames = []string{"carrier", "client", DeadLetterQueue}
+
+// NewMessageQueue creates the backend selected by QUEUE_BACKEND, amqp (the default), nats, redis
+// or memory.
+func NewMessageQueue(gateway *Gateway) (MessageQueue, error) {
+	switch backend := Getenv("QUEUE_BACKEND"); backend {
+	case "", "amqp", "rabbitmq":
+		queues := queueNames
+		if ClusterEnabled {
+			queues = append(append([]string{}, queueNames...), InstanceQueueName(gateway.ServerID))
+		}
+		client := NewMsgQueueClient(Getenv("AMQP_SERVER_URL"), queues)
+		if StorageBackend == "postgres" {
+			client.UseOutbox(gateway.DB, gateway.ServerID)
+		}
+		return client, nil
+	case "nats":
+		return NewNATSQueue(natsQueueURL, natsQueueStream)
+	case "redis":
+		consumer := gateway.ServerID
+		if consumer == "" {
+			// an instance keeps its consumer across restarts to read its unacked entries again
+			consumer, _ = os.Hostname()
+		}
+		return NewRedisQueue(Getenv("QUEUE_REDIS_URL"), redisQueuePrefix, consumer)
+	case "memory":
+		return NewMemoryQueue(), nil
+	default:
+		return nil, fmt.Errorf("unknown QUEUE_BACKEND: %s", backend)
+	}
+}
@@ -0,0 +1,331 @@
+package core
+
+import (
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MessageEnvelope is the latest state of a message, one row per message. It is kept for search
+// and conversations, the content only as far as MESSAGE_CONTENT allows.
+type MessageEnvelope struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	LogID      string    `gorm:"uniqueIndex" json:"log_id"`
+	TraceID    string    `json:"trace_id"`
+	ServerID   string    `json:"server_id"`
+	Client     string    `gorm:"index" json:"client"` // the sender, or the recipient of inbound messages
+	Direction  string    `json:"direction"`
+	Type       string    `json:"type"`
+	From       string    `gorm:"index" json:"from_number"`
+	To         string    `gorm:"index" json:"to_number"`
+	Content    string    `json:"content,omitempty"`
+	Segments   int       `json:"segments"`
+	MediaCount int       `json:"media_count"`
+	Route      string    `json:"route"`
+	Status     string    `gorm:"index" json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Attempts   int       `json:"attempts"`
+	ReceivedAt time.Time `gorm:"index" json:"received_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// MessageSearchResult is a page of envelopes, Next is the cursor of the following page.
+type MessageSearchResult struct {
+	Messages []MessageEnvelope `json:"messages"`
+	Next     string            `json:"next,omitempty"`
+}
+
+// How much of the content is kept on the envelopes.
+var MessageContentModes = struct {
+	None     string
+	Redacted string
+	Full     string
+}{
+	None:     "none",
+	Redacted: "redacted",
+	Full:     "full",
+}
+
+var (
+	envelopesEnabled  bool
+	envelopeContent   string
+	envelopeRetention time.Duration // zero keeps envelopes forever
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		envelopesEnabled = cfg.Getenv("MESSAGE_ENVELOPES") != "false"
+		envelopeContent = cfg.String("MESSAGE_CONTENT", MessageContentModes.Redacted)
+		envelopeRetention = cfg.Duration("MESSAGE_RETENTION", 0)
+	})
+}
+
+// envelopeEvent is a new state of a message, or the final status a carrier reported for it.
+type envelopeEvent struct {
+	envelope *MessageEnvelope
+	status   *envelopeStatus
+}
+
+type envelopeStatus struct {
+	logID  string
+	status string
+	error  string
+}
+
+var envelopeEvents = make(chan envelopeEvent, 1000)
+
+// messageDirection tells from the numbers whether a message is sent by a client, to a client or
+// between two clients.
+func (gateway *Gateway) messageDirection(msg *MsgQueueItem) string {
+	switch {
+	case gateway.GetClient(msg.From) == nil:
+		return CDRDirections.Inbound
+	case gateway.GetClient(msg.To) != nil:
+		return CDRDirections.Internal
+	default:
+		return CDRDirections.Outbound
+	}
+}
+
+// envelopeContentOf is the content of the message kept on its envelope.
+func envelopeContentOf(msg *MsgQueueItem) string {
+	switch envelopeContent {
+	case MessageContentModes.Full:
+		return msg.Message
+	case MessageContentModes.Redacted:
+		if msg.Message == "" {
+			return ""
+		}
+		return PartiallyRedactMessage(msg.Message)
+	default:
+		return ""
+	}
+}
+
+// recordEnvelope records the state of a message after an attempt to deliver it, as its CDR has it.
+func (gateway *Gateway) recordEnvelope(msg *MsgQueueItem, record *CDR) {
+	if !envelopesEnabled {
+		return
+	}
+	gateway.offerEnvelope(&MessageEnvelope{
+		LogID:      msg.LogID,
+		TraceID:    msg.TraceID,
+		ServerID:   gateway.ServerID,
+		Client:     record.Client,
+		Direction:  record.Direction,
+		Type:       record.Type,
+		From:       msg.From,
+		To:         msg.To,
+		Content:    envelopeContentOf(msg),
+		Segments:   record.Segments,
+		MediaCount: record.MediaCount,
+		Route:      record.Route,
+		Status:     record.Status,
+		Error:      record.Error,
+		Attempts:   record.Attempt,
+		ReceivedAt: msg.ReceivedTimestamp,
+	})
+}
+
+// FailEnvelope records a message that was given up on, it may never have been attempted.
+func (gateway *Gateway) FailEnvelope(msg *MsgQueueItem, reason string) {
+	if !envelopesEnabled {
+		return
+	}
+	envelope := &MessageEnvelope{
+		LogID:      msg.LogID,
+		TraceID:    msg.TraceID,
+		ServerID:   gateway.ServerID,
+		Client:     gateway.messageClient(msg),
+		Direction:  gateway.messageDirection(msg),
+		Type:       string(msg.Type),
+		From:       msg.From,
+		To:         msg.To,
+		Content:    envelopeContentOf(msg),
+		Status:     DeliveryStatuses.Failed,
+		Error:      reason,
+		Attempts:   msg.Attempts,
+		ReceivedAt: msg.ReceivedTimestamp,
+	}
+	envelope.Segments, envelope.MediaCount, _ = messageUsage(msg)
+	gateway.offerEnvelope(envelope)
+}
+
+// CompleteEnvelope records the final status a carrier reported for a message.
+func (gateway *Gateway) CompleteEnvelope(logID string, status string, errorCode string) {
+	if !envelopesEnabled || logID == "" {
+		return
+	}
+	envelopeEvents <- envelopeEvent{status: &envelopeStatus{logID: logID, status: status, error: errorCode}}
+}
+
+func (gateway *Gateway) offerEnvelope(envelope *MessageEnvelope) {
+	if envelope.LogID == "" {
+		return
+	}
+	select {
+	case envelopeEvents <- envelopeEvent{envelope: envelope}:
+	default:
+		// never hold up delivery for the envelopes
+	}
+}
+
+// EnvelopeWriter applies the states of the messages to their envelopes in the order they were
+// recorded, the RetentionPurger purges envelopes older than MESSAGE_RETENTION.
+func (gateway *Gateway) EnvelopeWriter() {
+	var lm = gateway.LogManager
+
+	for event := range envelopeEvents {
+		var err error
+		var logID string
+		if event.envelope != nil {
+			logID = event.envelope.LogID
+			event.envelope.Content, err = gateway.SealBody(gateway.clientTenant(event.envelope.Client), event.envelope.Content)
+			if err == nil {
+				err = gateway.upsertEnvelope(event.envelope)
+			}
+		} else {
+			logID = event.status.logID
+			err = gateway.DB.Model(&MessageEnvelope{}).Where("log_id = ?", logID).Updates(map[string]interface{}{
+				"status": event.status.status,
+				"error":  event.status.error,
+			}).Error
+		}
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.MessageEnvelope",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": logID,
+				}, err,
+			))
+		}
+	}
+}
+
+// upsertEnvelope creates the envelope of a message or moves it to its new state, keeping the
+// route of the last attempt when the message failed without one.
+func (gateway *Gateway) upsertEnvelope(envelope *MessageEnvelope) error {
+	return gateway.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "log_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"server_id":  gorm.Expr("EXCLUDED.server_id"),
+			"route":      gorm.Expr("COALESCE(NULLIF(EXCLUDED.route, ''), message_envelopes.route)"),
+			"status":     gorm.Expr("EXCLUDED.status"),
+			"error":      gorm.Expr("EXCLUDED.error"),
+			"attempts":   gorm.Expr("GREATEST(EXCLUDED.attempts, message_envelopes.attempts)"),
+			"updated_at": gorm.Expr("EXCLUDED.updated_at"),
+		}),
+	}).Create(envelope).Error
+}
+
+// numberVariants are the forms a number may be stored in, with and without the leading plus.
+func numberVariants(number string) []string {
+	trimmed := strings.TrimPrefix(number, "+")
+	return []string{trimmed, "+" + trimmed}
+}
+
+// pageEnvelopes reads a page of envelopes newest first below the cursor, the cursor of the next
+// page is set when there may be more.
+func pageEnvelopes(query *gorm.DB, cursor string, limit int) (MessageSearchResult, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	if cursor != "" {
+		id, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return MessageSearchResult{}, Invalid("cursor %q is not valid", cursor)
+		}
+		query = query.Where("id < ?", id)
+	}
+
+	result := MessageSearchResult{Messages: []MessageEnvelope{}}
+	if err := query.Order("id desc").Limit(limit).Find(&result.Messages).Error; err != nil {
+		return result, err
+	}
+	if len(result.Messages) == limit {
+		result.Next = strconv.FormatUint(uint64(result.Messages[limit-1].ID), 10)
+	}
+	return result, nil
+}
+
+// timeRange applies the since and until parameters, RFC 3339 times, to the received time.
+func timeRange(ctx iris.Context, query *gorm.DB) (*gorm.DB, error) {
+	for param, op := range map[string]string{"since": ">=", "until": "<"} {
+		value := ctx.URLParam(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return query, Invalid("%s must be an RFC 3339 time", param)
+		}
+		query = query.Where("received_at "+op+" ?", t)
+	}
+	return query, nil
+}
+
+// SetupMessageSearchRoutes sets up the search of the message envelopes and the conversations
+// between two numbers.
+func SetupMessageSearchRoutes(app *iris.Application, gateway *Gateway) {
+	search := app.Party("/messages", gateway.BasicAuthMiddleware)
+	{
+		// Search messages, newest first
+		search.Get("/", func(ctx iris.Context) {
+			query := gateway.DB.Model(&MessageEnvelope{})
+			for _, param := range []string{"client", "direction", "status", "type", "route"} {
+				if value := ctx.URLParam(param); value != "" {
+					query = query.Where(param+" = ?", value)
+				}
+			}
+			if number := ctx.URLParam("number"); number != "" {
+				variants := numberVariants(number)
+				query = query.Where("\"from\" IN ? OR \"to\" IN ?", variants, variants)
+			}
+			query, err := timeRange(ctx, query)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+
+			result, err := pageEnvelopes(query, ctx.URLParam("cursor"), ctx.URLParamIntDefault("limit", 100))
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			gateway.revealEnvelopes(ctx, result.Messages)
+			ctx.JSON(result)
+		})
+
+		// Messages in both directions between two numbers, newest first
+		search.Get("/conversation", func(ctx iris.Context) {
+			number, peer := ctx.URLParam("number"), ctx.URLParam("with")
+			if number == "" || peer == "" {
+				WriteProvisioningError(ctx, Invalid("number and with are required"))
+				return
+			}
+			a, b := numberVariants(number), numberVariants(peer)
+			query := gateway.DB.Model(&MessageEnvelope{}).
+				Where("(\"from\" IN ? AND \"to\" IN ?) OR (\"from\" IN ? AND \"to\" IN ?)", a, b, b, a)
+			query, err := timeRange(ctx, query)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+
+			result, err := pageEnvelopes(query, ctx.URLParam("cursor"), ctx.URLParamIntDefault("limit", 100))
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			gateway.revealEnvelopes(ctx, result.Messages)
+			ctx.JSON(result)
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package core
+
+import (
+	"errors"
+	"github.com/kataras/iris/v12"
+	"gorm.io/gorm"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/smpp/coding"
+)
+
+// MessageTemplate is a named message text of a tenant with {{placeholders}}, the API fills them in
+// from the variables of a message, e.g. "Hi {{name}}, your appointment is on {{date}}". Templates
+// of tenant 0 are shared by every tenant, a tenant's own template of the same name comes first.
+type MessageTemplate struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	TenantID    uint      `gorm:"uniqueIndex:idx_message_template_name" json:"tenant_id"`
+	Name        string    `gorm:"uniqueIndex:idx_message_template_name;not null" json:"name"`
+	Body        string    `gorm:"not null" json:"body"`
+	Description string    `json:"description"`
+	Version     uint      `gorm:"not null;default:1" json:"version"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// bulkMaxRecipients bounds the recipients of a bulk send request.
+var bulkMaxRecipients int
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		bulkMaxRecipients = cfg.Int("BULK_MAX_RECIPIENTS", 1000)
+	})
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// placeholders are the names of the placeholders of a template body, sorted.
+func placeholders(body string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, match := range templatePlaceholder.FindAllStringSubmatch(body, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderTemplate fills in the placeholders of a body, every placeholder needs a variable.
+func renderTemplate(body string, variables map[string]string) (string, error) {
+	var missing []string
+	for _, name := range placeholders(body) {
+		if _, ok := variables[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", Invalid("missing template variables: %s", strings.Join(missing, ", "))
+	}
+	return templatePlaceholder.ReplaceAllStringFunc(body, func(placeholder string) string {
+		return variables[templatePlaceholder.FindStringSubmatch(placeholder)[1]]
+	}), nil
+}
+
+// validateMessageTemplate checks the name, body and tenant of a template.
+func validateMessageTemplate(template *MessageTemplate) error {
+	template.Name = strings.TrimSpace(template.Name)
+	if template.Name == "" {
+		return Invalid("name is required")
+	}
+	if strings.TrimSpace(template.Body) == "" {
+		return Invalid("body is required")
+	}
+	return ValidateTenantID(template.TenantID)
+}
+
+// findMessageTemplate finds the template of the name for a client, its tenant's own before a
+// shared one.
+func (gateway *Gateway) findMessageTemplate(name string, client *Client) (MessageTemplate, error) {
+	var list []MessageTemplate
+	tenant := ClientTenantID(client)
+	if err := gateway.DB.Where("name = ? AND tenant_id IN ?", name, []uint{0, tenant}).Order("tenant_id desc").Limit(1).Find(&list).Error; err != nil {
+		return MessageTemplate{}, err
+	}
+	if len(list) == 0 {
+		return MessageTemplate{}, Invalid("template %s does not exist", name)
+	}
+	return list[0], nil
+}
+
+// SegmentEstimate is what a text costs as SMS: its segments and the encoding they use, gsm7 or
+// ucs2 for text outside GSM 03.38.
+type SegmentEstimate struct {
+	Segments   int    `json:"segments"`
+	Encoding   string `json:"encoding"`
+	Characters int    `json:"characters"`
+}
+
+// EstimateSegments estimates the segments of a text the way its usage is counted.
+func EstimateSegments(text string) SegmentEstimate {
+	segments, _, _ := messageUsage(&MsgQueueItem{Type: MsgQueueItemType.SMS, Message: text})
+	estimate := SegmentEstimate{Segments: segments, Encoding: "gsm7", Characters: len([]rune(text))}
+	if !coding.GSM7BitCoding.Validate(text) {
+		estimate.Encoding = "ucs2"
+	}
+	return estimate
+}
+
+// BulkRecipient is a recipient of a bulk send, with the variables of its message.
+type BulkRecipient struct {
+	To        string            `json:"to"`
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// BulkRequest is the body of POST /messages/bulk: one template, or a message with
+// {{placeholders}}, sent from one number to every recipient. Variables of a recipient override the
+// shared ones. With deliver_at the messages are scheduled.
+type BulkRequest struct {
+	Client     string            `json:"client"`
+	From       string            `json:"from"`
+	Template   string            `json:"template"` // name of a template, or else the message is the body
+	Message    string            `json:"message"`
+	Variables  map[string]string `json:"variables,omitempty"`
+	Recipients []BulkRecipient   `json:"recipients"`
+	DeliverAt  *time.Time        `json:"deliver_at,omitempty"`
+	DryRun     bool              `json:"dry_run,omitempty"` // render and estimate without sending
+	// AllowInternational sends the messages abroad for clients with the flag international policy
+	AllowInternational bool `json:"allow_international,omitempty"`
+}
+
+// BulkResult is the outcome of a bulk send, messages are accepted or rejected per recipient.
+type BulkResult struct {
+	Accepted []BulkMessage `json:"accepted"`
+	Rejected []BulkMessage `json:"rejected"`
+	Segments int           `json:"segments"` // of the accepted messages
+}
+
+type BulkMessage struct {
+	To        string `json:"to"`
+	MessageID string `json:"message_id,omitempty"`
+	Message   string `json:"message,omitempty"` // the rendered text, on dry runs
+	SegmentEstimate
+	Error string `json:"error,omitempty"`
+}
+
+// sendBulk renders the message of every recipient and queues, or schedules, it. Recipients whose
+// message can't be sent are rejected without stopping the others.
+func (gateway *Gateway) sendBulk(req BulkRequest) (BulkResult, error) {
+	result := BulkResult{Accepted: []BulkMessage{}, Rejected: []BulkMessage{}}
+	if len(req.Recipients) == 0 {
+		return result, Invalid("recipients are required")
+	}
+	if len(req.Recipients) > bulkMaxRecipients {
+		return result, Invalid("at most %d recipients per request", bulkMaxRecipients)
+	}
+	if req.DeliverAt != nil && req.DeliverAt.Before(time.Now()) {
+		return result, Invalid("deliver_at must be in the future")
+	}
+
+	client, err := gateway.apiClient(req.Client, req.From)
+	if err != nil {
+		return result, err
+	}
+	body := req.Message
+	if req.Template != "" {
+		template, err := gateway.findMessageTemplate(req.Template, client)
+		if err != nil {
+			return result, err
+		}
+		body = template.Body
+	}
+	if body == "" {
+		return result, Invalid("template or message is required")
+	}
+
+	for _, recipient := range req.Recipients {
+		variables := make(map[string]string, len(req.Variables)+len(recipient.Variables))
+		for name, value := range req.Variables {
+			variables[name] = value
+		}
+		for name, value := range recipient.Variables {
+			variables[name] = value
+		}
+
+		outcome := BulkMessage{To: recipient.To}
+		text, err := renderTemplate(body, variables)
+		if err == nil {
+			outcome.SegmentEstimate = EstimateSegments(text)
+			message := MessageRequest{Client: client.Username, From: req.From, To: recipient.To, Message: text, AllowInternational: req.AllowInternational}
+			var msg MsgQueueItem
+			if msg, _, err = gateway.NewAPIMessage(message); err == nil {
+				outcome.To, outcome.MessageID = msg.To, msg.LogID
+				switch {
+				case req.DryRun:
+					outcome.MessageID, outcome.Message = "", text
+				case req.DeliverAt != nil:
+					_, err = gateway.ScheduleMessage(msg, client, *req.DeliverAt)
+				default:
+					err = gateway.Router.OfferClientMessage(msg)
+				}
+			}
+		}
+		if err != nil {
+			outcome.MessageID, outcome.Error = "", err.Error()
+			result.Rejected = append(result.Rejected, outcome)
+			continue
+		}
+		result.Segments += outcome.Segments
+		result.Accepted = append(result.Accepted, outcome)
+	}
+	return result, nil
+}
+
+// SetupTemplateRoutes sets up the management of the message templates.
+func SetupTemplateRoutes(app *iris.Application, gateway *Gateway) {
+	templates := app.Party("/templates", gateway.BasicAuthMiddleware)
+	{
+		// List templates, of the tenant of the key with the shared ones
+		templates.Get("/", func(ctx iris.Context) {
+			query := gateway.DB.Order("name asc, tenant_id asc")
+			if tenant := RequestTenant(ctx); tenant != 0 {
+				query = query.Where("tenant_id IN ?", []uint{0, tenant})
+			}
+			list := []MessageTemplate{}
+			if err := query.Find(&list).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(list)
+		})
+
+		// Add a template
+		templates.Post("/", func(ctx iris.Context) {
+			var template MessageTemplate
+			if err := ctx.ReadJSON(&template); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			template.ID = 0
+			template.Version = 0
+			AssignTenant(ctx, &template.TenantID)
+			if err := validateMessageTemplate(&template); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.DB.Create(&template).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(template)
+		})
+
+		// Get a template with its placeholders
+		templates.Get("/{id:uint}", func(ctx iris.Context) {
+			var template MessageTemplate
+			if err := gateway.DB.First(&template, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					err = ErrNotFound
+				}
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"template": template, "placeholders": placeholders(template.Body)})
+		})
+
+		// Replace a template, the body carries the version it was read with
+		templates.Put("/{id:uint}", func(ctx iris.Context) {
+			var template MessageTemplate
+			if err := ctx.ReadJSON(&template); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			template.ID = ctx.Params().GetUintDefault("id", 0)
+			AssignTenant(ctx, &template.TenantID)
+			if err := validateMessageTemplate(&template); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := UpdateVersioned(gateway.DB, &template, template.ID, &template.Version, "tenant_id", "name", "body", "description"); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(template)
+		})
+
+		// Delete a template
+		templates.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := DeleteVersioned(gateway.DB, &MessageTemplate{}, ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Template deleted"})
+		})
+
+		// Render a template with variables and estimate its segments, without sending it
+		templates.Post("/{id:uint}/preview", func(ctx iris.Context) {
+			var req struct {
+				Variables map[string]string `json:"variables"`
+			}
+			if err := ctx.ReadJSON(&req); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			var template MessageTemplate
+			if err := gateway.DB.First(&template, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					err = ErrNotFound
+				}
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			text, err := renderTemplate(template.Body, req.Variables)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"message": text, "estimate": EstimateSegments(text)})
+		})
+	}
+}
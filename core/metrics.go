@@ -0,0 +1,140 @@
+package core
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Event metrics of the servers and routers. Gauges read from gateway state, like queue depths
+// and route health, are collected by MetricExporter in prometheus.go.
+var (
+	SMPPBinds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smpp_binds_total",
+		Help: "SMPP bind attempts of clients by result",
+	}, []string{"client", "result"})
+	SMPPSubmits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smpp_submits_total",
+		Help: "submit_sm received from clients by result",
+	}, []string{"client", "result"})
+	SMPPDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smpp_deliveries_total",
+		Help: "deliver_sm segments sent to clients by result",
+	}, []string{"client", "result"})
+	SMPPDeliverLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "smpp_deliver_seconds",
+		Help:    "Time until a client answered deliver_sm",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"client"})
+	smppBindLockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smpp_bind_lockouts_total",
+		Help: "Lockouts after failed SMPP binds by what was locked out, system_id or ip",
+	}, []string{"kind"})
+
+	MM4Sessions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mm4_sessions_total",
+		Help: "MM4 connections of clients by result",
+	}, []string{"client", "result"})
+	MM4ActiveSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mm4_sessions_active",
+		Help: "MM4 sessions currently open by clients",
+	})
+	MM4Forwards = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mm4_forwards_total",
+		Help: "MM4_forward.REQ sent to clients by result",
+	}, []string{"client", "result"})
+	MM4ForwardLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mm4_forward_seconds",
+		Help:    "Time to forward an MMS to a client over MM4",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"client"})
+
+	carrierSends = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "carrier_sends_total",
+		Help: "Messages sent to carrier routes by result, failures by error class",
+	}, []string{"route", "client", "type", "result"})
+	carrierSendLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "carrier_send_seconds",
+		Help:    "Time a carrier took to accept or refuse a message",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	MessageRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "message_retries_total",
+		Help: "Messages scheduled for another delivery attempt",
+	}, []string{"queue", "class", "client"})
+	DeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dead_letters_total",
+		Help: "Messages moved to the dead letter queue",
+	}, []string{"queue", "client"})
+	ContentScreens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "content_screened_total",
+		Help: "Outbound messages a content rule or the classifier flagged, quarantined or blocked",
+	}, []string{"action", "category", "client"})
+)
+
+func init() {
+	prometheus.MustRegister(SMPPBinds, SMPPSubmits, SMPPDeliveries, SMPPDeliverLatency, smppBindLockouts,
+		MM4Sessions, MM4ActiveSessions, MM4Forwards, MM4ForwardLatency,
+		carrierSends, carrierSendLatency, MessageRetries, DeadLetters, ContentScreens)
+}
+
+// Results of the event metrics.
+const (
+	MetricSuccess = "success"
+	MetricError   = "error"
+)
+
+// QueueDepther is implemented by queue backends that can report the messages they hold, by
+// queue name.
+type QueueDepther interface {
+	QueueDepths() map[string]int
+}
+
+// QueueDepths returns the depth of the in-memory router queues and of the queue backend when it
+// can report them. RabbitMQ exports the depth of its own queues.
+func (gateway *Gateway) QueueDepths() map[string]int {
+	depths := gateway.Router.QueueDepths()
+	if depther, ok := gateway.Queue.(QueueDepther); ok {
+		for queue, depth := range depther.QueueDepths() {
+			depths[queue] = depth
+		}
+	}
+	return depths
+}
+
+// ClientLabel is the client label for the first of the numbers assigned to a client, numbers of
+// no client are labelled unknown.
+func (gateway *Gateway) ClientLabel(numbers ...string) string {
+	for _, number := range numbers {
+		if client := gateway.GetClient(number); client != nil {
+			return client.Username
+		}
+	}
+	return "unknown"
+}
+
+// messageClient is the client a message belongs to, the sender or the recipient of a message
+// from a carrier.
+func (gateway *Gateway) messageClient(msg *MsgQueueItem) string {
+	if sender := gateway.GetClient(msg.From); sender != nil {
+		return sender.Username
+	}
+	return gateway.ClientLabel(msg.To)
+}
+
+// ObserveCarrierSend records the outcome of a send to a carrier route.
+func (gateway *Gateway) ObserveCarrierSend(route string, msg *MsgQueueItem, started time.Time, err error) {
+	carrierSendLatency.WithLabelValues(route).Observe(time.Since(started).Seconds())
+
+	result := MetricSuccess
+	if err != nil {
+		result = MetricError
+		if errors.Is(err, ErrCarrierThrottled) {
+			result = "throttled"
+		} else if class := ErrorClassOf(err); class != ErrorClasses.Unknown {
+			result = string(class)
+		}
+	}
+	carrierSends.WithLabelValues(route, gateway.ClientLabel(msg.From, msg.To), string(msg.Type), result).Inc()
+}
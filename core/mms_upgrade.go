@@ -0,0 +1,8 @@
+package core
+
+// RevertUpgrade makes an upgraded message an SMS again, for the next route.
+func (msg *MsgQueueItem) RevertUpgrade() {
+	if msg.SubmittedAs != "" {
+		msg.Type, msg.SubmittedAs = msg.SubmittedAs, ""
+	}
+}
@@ -0,0 +1,242 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// MonthlyQuota limits what a client, or the clients of a tenant together, send to carriers in a
+// billing cycle. SMS count their segments and MMS count one each, a limit of zero is no limit.
+type MonthlyQuota struct {
+	SMSSoft     int    `json:"sms_soft"` // segments after which the soft limit is notified
+	SMSHard     int    `json:"sms_hard"` // segments after which SMS are rejected
+	MMSSoft     int    `json:"mms_soft"`
+	MMSHard     int    `json:"mms_hard"`
+	CycleDay    int    `json:"cycle_day"`    // day of the month the cycle starts on in UTC, 1 to 28, the 1st when zero
+	NotifyEmail string `json:"notify_email"` // mailed when a limit is crossed, besides the events
+}
+
+// monthlyQuotaColumns are the columns of the quotas in the clients and tenants tables.
+var monthlyQuotaColumns = []string{"quota_sms_soft", "quota_sms_hard", "quota_mms_soft", "quota_mms_hard", "quota_cycle_day", "quota_notify_email"}
+
+// Owners of quota counters.
+var QuotaScopes = struct {
+	Client string
+	Tenant string
+}{
+	Client: "client",
+	Tenant: "tenant",
+}
+
+// QuotaCounter counts what a client or tenant sent in a billing cycle, every instance counts into
+// the same row. A new cycle starts a new row.
+type QuotaCounter struct {
+	ID         uint      `gorm:"primaryKey" json:"-"`
+	Scope      string    `gorm:"uniqueIndex:idx_quota_counter;not null" json:"scope"`
+	OwnerID    uint      `gorm:"uniqueIndex:idx_quota_counter;not null" json:"owner_id"`
+	CycleStart time.Time `gorm:"uniqueIndex:idx_quota_counter;not null" json:"cycle_start"`
+	Segments   int       `json:"segments"`
+	MMS        int       `json:"mms"`
+	SMSBlocked bool      `json:"sms_blocked"` // the hard limit was notified
+	MMSBlocked bool      `json:"mms_blocked"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func (quota *MonthlyQuota) Validate() error {
+	if quota.SMSSoft < 0 || quota.SMSHard < 0 || quota.MMSSoft < 0 || quota.MMSHard < 0 {
+		return Invalid("monthly_quota limits can't be negative")
+	}
+	if quota.CycleDay < 0 || quota.CycleDay > 28 {
+		return Invalid("monthly_quota.cycle_day must be 1 to 28")
+	}
+	if quota.NotifyEmail != "" && !strings.Contains(quota.NotifyEmail, "@") {
+		return Invalid("monthly_quota.notify_email is not an email address")
+	}
+	return nil
+}
+
+func (quota MonthlyQuota) limited() bool {
+	return quota.SMSSoft > 0 || quota.SMSHard > 0 || quota.MMSSoft > 0 || quota.MMSHard > 0
+}
+
+// cycleStart is the start of the billing cycle now is in.
+func (quota MonthlyQuota) cycleStart(now time.Time) time.Time {
+	day := quota.CycleDay
+	if day == 0 {
+		day = 1
+	}
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, time.UTC)
+	if start.After(now) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// Limits are the soft and hard limit of a message type and the counter column it counts in.
+func (quota MonthlyQuota) Limits(msgType MsgQueueType) (soft int, hard int, column string) {
+	if msgType == MsgQueueItemType.MMS {
+		return quota.MMSSoft, quota.MMSHard, "mms"
+	}
+	return quota.SMSSoft, quota.SMSHard, "segments"
+}
+
+// QuotaUse is a limit a message counted against.
+type QuotaUse struct {
+	Scope string
+	Owner uint
+	Quota MonthlyQuota
+	Start time.Time
+	Used  int // after the message
+}
+
+// CountQuota counts the units of a message against a quota, ok is false when they would exceed
+// the hard limit and nothing was counted.
+func CountQuota(tx *gorm.DB, use *QuotaUse, msgType MsgQueueType, units int, now time.Time) (bool, error) {
+	_, hard, column := use.Quota.Limits(msgType)
+	if hard > 0 && units > hard {
+		return false, nil
+	}
+	segments, mms := units, 0
+	if column == "mms" {
+		segments, mms = 0, units
+	}
+	var counter QuotaCounter
+	result := tx.Raw(`INSERT INTO quota_counters (scope, owner_id, cycle_start, segments, mms, sms_blocked, mms_blocked, updated_at)
+		VALUES (?, ?, ?, ?, ?, false, false, ?)
+		ON CONFLICT (scope, owner_id, cycle_start) DO UPDATE SET
+			segments = quota_counters.segments + EXCLUDED.segments, mms = quota_counters.mms + EXCLUDED.mms,
+			updated_at = EXCLUDED.updated_at
+		WHERE ? = 0 OR quota_counters.`+column+` + ? <= ?
+		RETURNING *`, use.Scope, use.Owner, use.Start, segments, mms, now, hard, units, hard).Scan(&counter)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	use.Used = counter.Segments
+	if column == "mms" {
+		use.Used = counter.MMS
+	}
+	return true, nil
+}
+
+// QuotaUses are the quotas a message of the client counts against: its own and its tenant's.
+func QuotaUses(client *Client, now time.Time) []QuotaUse {
+	var uses []QuotaUse
+	if client.MonthlyQuota.limited() {
+		uses = append(uses, QuotaUse{Scope: QuotaScopes.Client, Owner: client.ID, Quota: client.MonthlyQuota, Start: client.MonthlyQuota.cycleStart(now)})
+	}
+	if tenant, ok := tenantByID(client.TenantID); ok && client.TenantID != 0 && tenant.MonthlyQuota.limited() {
+		uses = append(uses, QuotaUse{Scope: QuotaScopes.Tenant, Owner: tenant.ID, Quota: tenant.MonthlyQuota, Start: tenant.MonthlyQuota.cycleStart(now)})
+	}
+	return uses
+}
+
+// ErrQuotaExceeded rolls back the quotas a message was counted against before one refused it.
+var ErrQuotaExceeded = errors.New("monthly quota exceeded")
+
+// NotifyQuota emits the event of a limit crossed and mails the address of the quota.
+func (gateway *Gateway) NotifyQuota(eventType string, use QuotaUse, client *Client, msgType MsgQueueType, limit int) {
+	data := map[string]interface{}{
+		"scope":       use.Scope,
+		"type":        string(msgType),
+		"used":        use.Used,
+		"limit":       limit,
+		"cycle_start": use.Start,
+	}
+	subject := "client " + client.Username
+	if use.Scope == QuotaScopes.Tenant {
+		subject = fmt.Sprintf("tenant %d", use.Owner)
+		gateway.EmitTenantEvent(eventType, "", use.Owner, data)
+	} else {
+		gateway.EmitEvent(eventType, client.Username, data)
+	}
+
+	if use.Quota.NotifyEmail == "" || Getenv("ALERT_SMTP_ADDR") == "" {
+		return
+	}
+	unit := "SMS segments"
+	if msgType == MsgQueueItemType.MMS {
+		unit = "MMS"
+	}
+	summary := fmt.Sprintf("%s sent %d of its %d %s this cycle", subject, use.Used, limit, unit)
+	if eventType == EventTypes.QuotaExceeded {
+		summary = fmt.Sprintf("%s reached its monthly limit of %d %s, further messages are rejected", subject, limit, unit)
+	}
+	alert := Alert{
+		Key:       eventType + ":" + subject,
+		Rule:      eventType,
+		Subject:   subject,
+		Value:     float64(use.Used),
+		Threshold: float64(limit),
+		Summary:   summary,
+		State:     AlertStates.Firing,
+		Since:     time.Now(),
+	}
+	notifier := &emailNotifier{
+		addr:     Getenv("ALERT_SMTP_ADDR"),
+		username: Getenv("ALERT_SMTP_USERNAME"),
+		password: Getenv("ALERT_SMTP_PASSWORD"),
+		from:     EnvString("ALERT_EMAIL_FROM", "gateway@localhost"),
+		to:       []string{use.Quota.NotifyEmail},
+	}
+	go func() {
+		if err := notifier.notify(alert, gateway.ServerID); err != nil {
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"Router.Client.Quota",
+				"GenericError",
+				logrus.WarnLevel,
+				map[string]interface{}{
+					"client": client.Username,
+					"scope":  use.Scope,
+				}, err,
+			))
+		}
+	}()
+}
+
+// quotaStatus is a quota with what was counted against it in the current cycle.
+type quotaStatus struct {
+	Scope   string `json:"scope"`
+	OwnerID uint   `json:"owner_id"`
+	MonthlyQuota
+	CycleStart time.Time `json:"cycle_start"`
+	Segments   int       `json:"segments"`
+	MMS        int       `json:"mms"`
+}
+
+func (gateway *Gateway) quotaStatus(scope string, owner uint, quota MonthlyQuota) (quotaStatus, error) {
+	status := quotaStatus{Scope: scope, OwnerID: owner, MonthlyQuota: quota, CycleStart: quota.cycleStart(time.Now())}
+	var counter QuotaCounter
+	err := gateway.DB.Where("scope = ? AND owner_id = ? AND cycle_start = ?", scope, owner, status.CycleStart).Limit(1).Find(&counter).Error
+	status.Segments = counter.Segments
+	status.MMS = counter.MMS
+	return status, err
+}
+
+// clientQuotas are the quotas of a client and its tenant with their use in the current cycles.
+func (gateway *Gateway) clientQuotas(username string) ([]quotaStatus, error) {
+	gateway.Mu.RLock()
+	client := gateway.Clients[username]
+	gateway.Mu.RUnlock()
+	if client == nil {
+		return nil, fmt.Errorf("%w: client %s", ErrNotFound, username)
+	}
+	statuses := make([]quotaStatus, 0, 2)
+	status, err := gateway.quotaStatus(QuotaScopes.Client, client.ID, client.MonthlyQuota)
+	if err != nil {
+		return nil, err
+	}
+	statuses = append(statuses, status)
+	if tenant, ok := tenantByID(client.TenantID); ok && client.TenantID != 0 {
+		if status, err = gateway.quotaStatus(QuotaScopes.Tenant, tenant.ID, tenant.MonthlyQuota); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
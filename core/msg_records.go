@@ -1,4 +1,4 @@
-package main
+package core
 
 import (
 	"crypto/sha256"
@@ -6,7 +6,7 @@ import (
 	"time"
 )
 
-func (gateway *Gateway) processMsgRecords() {
+func (gateway *Gateway) ProcessMsgRecords() {
 	for {
 		msg := <-gateway.MsgRecordChan
 		if msg.ClientID == 0 {
@@ -56,6 +56,15 @@ func (gateway *Gateway) InsertMsgQueueItem(item MsgQueueItem, clientID uint, car
 		msgData = PartiallyRedactMessage(item.Message)
 	}
 
+	var tenantID uint
+	if client, ok := gateway.ClientByID(clientID); ok {
+		tenantID = client.TenantID
+	}
+	msgData, err := gateway.SealBody(tenantID, msgData)
+	if err != nil {
+		return err
+	}
+
 	dbItem := &MsgRecordDBItem{
 		To:                item.To,
 		From:              item.From,
@@ -70,8 +79,13 @@ func (gateway *Gateway) InsertMsgQueueItem(item MsgQueueItem, clientID uint, car
 		ServerID: gateway.ServerID,
 	}
 
-	if err := gateway.DB.Create(dbItem).Error; err != nil {
-		return err
+	if gateway.usePostgres() {
+		if err := gateway.DB.Create(dbItem).Error; err != nil {
+			return err
+		}
+	}
+	if gateway.Archive != nil {
+		gateway.archived("record", gateway.Archive.SaveRecord(dbItem))
 	}
 
 	// Insert into the database using InsertStruct.
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"zultys-smpp-mm4/smpp/coding"
+)
+
+// MsgQueueSchemaVersion is the wire version of MsgQueueItem written by this gateway. Bump it
+// whenever a field changes meaning or is renamed and add a step to msgQueueMigrations, so
+// payloads already sitting in RabbitMQ, the dead letter table or the scheduler survive upgrades.
+//
+// Version history:
+//
+//	0  unversioned payloads, SkipNumberCheck was serialized as "SkipNumberCheck" and there was
+//	   no trace_id, encoding or schema_version
+//	1  schema_version, trace_id, encoding, skip_number_check and media references (url/size on files)
+const MsgQueueSchemaVersion = 1
+
+// msgQueueMigrations upgrade a raw payload of version i to version i+1.
+var msgQueueMigrations = []func(raw map[string]json.RawMessage) error{
+	migrateMsgQueueV0,
+}
+
+// EncodeMsgQueueItem serializes a message for a queue or table at the current schema version.
+func EncodeMsgQueueItem(msg MsgQueueItem) ([]byte, error) {
+	msg.SchemaVersion = MsgQueueSchemaVersion
+	if msg.TraceID == "" {
+		msg.TraceID = msg.LogID
+	}
+	return json.Marshal(msg)
+}
+
+// AMQP headers carrying the correlation IDs of a message, so a delivery can be correlated even
+// when its payload can't be decoded.
+const (
+	logIDHeader   = "x-log-id"
+	traceIDHeader = "x-trace-id"
+)
+
+// MessageHeaders adds the correlation IDs of the message to the headers of its publish.
+func MessageHeaders(msg MsgQueueItem, headers map[string]interface{}) map[string]interface{} {
+	if headers == nil {
+		headers = make(map[string]interface{}, 2)
+	}
+	headers[logIDHeader] = msg.LogID
+	if msg.TraceID != "" {
+		headers[traceIDHeader] = msg.TraceID
+	} else {
+		headers[traceIDHeader] = msg.LogID
+	}
+	if msg.TraceParent != "" {
+		headers[traceParentHeader] = msg.TraceParent
+	}
+	return headers
+}
+
+// LogIDFromHeaders returns the log ID carried in the headers of a delivery.
+func LogIDFromHeaders(headers map[string]interface{}) string {
+	logID, _ := headers[logIDHeader].(string)
+	return logID
+}
+
+// DecodeMsgQueueItem reads a message written by this or any older gateway version.
+func DecodeMsgQueueItem(data []byte) (MsgQueueItem, error) {
+	var msg MsgQueueItem
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return msg, err
+	}
+
+	version := 0
+	if v, ok := raw["schema_version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return msg, fmt.Errorf("invalid schema_version: %w", err)
+		}
+	}
+	if version > MsgQueueSchemaVersion {
+		return msg, fmt.Errorf("unsupported message schema version %d (newest known is %d)", version, MsgQueueSchemaVersion)
+	}
+
+	if version < MsgQueueSchemaVersion {
+		for ; version < MsgQueueSchemaVersion; version++ {
+			if err := msgQueueMigrations[version](raw); err != nil {
+				return msg, fmt.Errorf("failed to migrate message from schema version %d: %w", version, err)
+			}
+		}
+		migrated, err := json.Marshal(raw)
+		if err != nil {
+			return msg, err
+		}
+		data = migrated
+	}
+
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, err
+	}
+	msg.SchemaVersion = MsgQueueSchemaVersion
+	return msg, nil
+}
+
+func migrateMsgQueueV0(raw map[string]json.RawMessage) error {
+	if v, ok := raw["SkipNumberCheck"]; ok {
+		raw["skip_number_check"] = v
+		delete(raw, "SkipNumberCheck")
+	}
+	if _, ok := raw["trace_id"]; !ok {
+		if logID, ok := raw["log_id"]; ok {
+			raw["trace_id"] = logID
+		}
+	}
+	raw["schema_version"] = json.RawMessage("1")
+	return nil
+}
+
+// EncodingName is the schema name of an SMPP data coding.
+func EncodingName(dataCoding coding.DataCoding) string {
+	switch dataCoding {
+	case coding.GSM7BitCoding:
+		return "gsm7"
+	case coding.ASCIICoding:
+		return "ascii"
+	case coding.Latin1Coding:
+		return "latin1"
+	case coding.UCS2Coding:
+		return "ucs2"
+	case coding.ShiftJISCoding:
+		return "shift_jis"
+	case coding.CyrillicCoding:
+		return "cyrillic"
+	case coding.HebrewCoding:
+		return "hebrew"
+	case coding.ISO2022JPCoding:
+		return "iso2022jp"
+	case coding.EUCJPCoding:
+		return "eucjp"
+	case coding.EUCKRCoding:
+		return "euckr"
+	}
+	return ""
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	natsQueueURL     string
+	natsQueueStream  string
+	natsQueueAckWait time.Duration
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		natsQueueURL = cfg.String("QUEUE_NATS_URL", nats.DefaultURL)
+		natsQueueStream = cfg.String("QUEUE_NATS_STREAM", "GATEWAY")
+		natsQueueAckWait = cfg.Duration("QUEUE_NATS_ACK_WAIT", 5*time.Minute)
+	})
+}
+
+// Headers of the NATS messages, the headers of a QueueDelivery travel as JSON since NATS headers
+// are strings.
+const (
+	natsHeadersHeader   = "Gateway-Headers"
+	natsNotBeforeHeader = "Gateway-Not-Before" // Unix milliseconds a delayed message is due at
+)
+
+// NATSQueue is a MessageQueue on NATS JetStream. The queues are subjects of one work queue stream,
+// each consumed through a durable pull consumer the instances share. JetStream has no delayed
+// delivery, so a delayed message is published right away with the time it is due and handed back
+// with NakWithDelay until then. Rejected messages are moved to the dead letter queue like the
+// gateway-dlx policy does in RabbitMQ.
+type NATSQueue struct {
+	conn   *nats.Conn
+	js     jetstream.JetStream
+	stream string
+	prefix string // of the subjects, the stream name in lower case
+	logger *log.Entry
+
+	mu     sync.Mutex
+	ready  bool // the stream exists
+	closed bool
+	done   chan struct{}
+}
+
+// NewNATSQueue connects to NATS and sets up the stream in the background, like the AMQP client
+// the gateway starts while the server is unreachable.
+func NewNATSQueue(url string, stream string) (*NATSQueue, error) {
+	logger := log.New()
+	logger.SetFormatter(logFormatter())
+	logger.SetLevel(log.InfoLevel)
+
+	queue := &NATSQueue{
+		stream: stream,
+		prefix: strings.ToLower(stream) + ".",
+		logger: logger.WithField("subsystem", "nats"),
+		done:   make(chan struct{}),
+	}
+	conn, err := nats.Connect(url,
+		nats.Name("zultys-smpp-mm4"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			queue.logger.Printf("Disconnected: %v", err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			queue.logger.Println("Reconnected!")
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	queue.conn, queue.js = conn, js
+
+	go queue.setup()
+	return queue, nil
+}
+
+// setup creates or updates the stream until it succeeds.
+func (queue *NATSQueue) setup() {
+	delay := ReconnectDelay
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), publishConfirmTimeout)
+		_, err := queue.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:      queue.stream,
+			Subjects:  []string{queue.prefix + ">"},
+			Retention: jetstream.WorkQueuePolicy,
+			Storage:   jetstream.FileStorage,
+		})
+		cancel()
+		if err == nil {
+			queue.mu.Lock()
+			queue.ready = true
+			queue.mu.Unlock()
+			queue.logger.Println("Stream ready")
+			return
+		}
+
+		queue.logger.Printf("Failed to set up stream %s: %v. Retrying in %s...", queue.stream, err, delay)
+		select {
+		case <-queue.done:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, MaxReconnectDelay)
+	}
+}
+
+// subject is the subject of a queue.
+func (queue *NATSQueue) subject(queueName string) string {
+	return queue.prefix + queueName
+}
+
+func (queue *NATSQueue) Publish(ctx context.Context, queueName string, data []byte) error {
+	return queue.PublishWithHeaders(ctx, queueName, data, nil)
+}
+
+func (queue *NATSQueue) PublishWithHeaders(ctx context.Context, queueName string, data []byte, headers map[string]interface{}) error {
+	return queue.publish(ctx, queueName, data, headers, time.Time{})
+}
+
+func (queue *NATSQueue) PublishDelayed(ctx context.Context, queueName string, data []byte, headers map[string]interface{}, delay time.Duration) error {
+	if delay <= 0 {
+		return queue.PublishWithHeaders(ctx, queueName, data, headers)
+	}
+	return queue.publish(ctx, queueName, data, headers, time.Now().Add(delay))
+}
+
+// publish waits for the stream to store the message, due is zero unless it is delayed.
+func (queue *NATSQueue) publish(ctx context.Context, queueName string, data []byte, headers map[string]interface{}, due time.Time) error {
+	if !queue.Ready() {
+		return errors.New("nats queue not ready")
+	}
+
+	msg := nats.NewMsg(queue.subject(queueName))
+	msg.Data = data
+	if len(headers) > 0 {
+		encoded, err := json.Marshal(headers)
+		if err != nil {
+			return err
+		}
+		msg.Header.Set(natsHeadersHeader, string(encoded))
+	}
+	if !due.IsZero() {
+		msg.Header.Set(natsNotBeforeHeader, strconv.FormatInt(due.UnixMilli(), 10))
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, publishConfirmTimeout)
+		defer cancel()
+	}
+	_, err := queue.js.PublishMsg(ctx, msg)
+	return err
+}
+
+// Consume reads the queue through its durable consumer, one message at a time like the AMQP
+// consumers with a prefetch of 1. A message not acked within QUEUE_NATS_ACK_WAIT is redelivered.
+func (queue *NATSQueue) Consume(queueName string) <-chan QueueDelivery {
+	out := make(chan QueueDelivery)
+
+	go func() {
+		defer close(out)
+		for {
+			err := queue.consume(queueName, out)
+			select {
+			case <-queue.done:
+				return
+			default:
+			}
+			queue.logger.Printf("Consumer of %s stopped: %v. Retrying...", queueName, err)
+			select {
+			case <-queue.done:
+				return
+			case <-time.After(ReInitDelay):
+			}
+		}
+	}()
+	return out
+}
+
+// consume hands the messages of a queue to out until the queue closes or the consumer fails.
+func (queue *NATSQueue) consume(queueName string, out chan<- QueueDelivery) error {
+	if !queue.Ready() {
+		return errors.New("stream not ready")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishConfirmTimeout)
+	consumer, err := queue.js.CreateOrUpdateConsumer(ctx, queue.stream, jetstream.ConsumerConfig{
+		// durable names can't have dots, instance queues do
+		Durable:       strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(queueName),
+		FilterSubject: queue.subject(queueName),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       natsQueueAckWait,
+		MaxDeliver:    -1,
+	})
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	messages, err := consumer.Messages(jetstream.PullMaxMessages(1))
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-queue.done:
+		case <-stop:
+		}
+		messages.Stop()
+	}()
+
+	for {
+		msg, err := messages.Next()
+		if err != nil {
+			return err
+		}
+		if due := natsDue(msg.Headers()); time.Until(due) > 0 {
+			_ = msg.NakWithDelay(time.Until(due))
+			continue
+		}
+
+		delivery := queue.delivery(queueName, msg)
+		select {
+		case out <- delivery:
+		case <-queue.done:
+			// redelivered once the ack wait passed
+			return nil
+		}
+	}
+}
+
+// delivery wraps a message, a rejected one is moved to the dead letter queue.
+func (queue *NATSQueue) delivery(queueName string, msg jetstream.Msg) QueueDelivery {
+	var headers map[string]interface{}
+	if encoded := msg.Headers().Get(natsHeadersHeader); encoded != "" {
+		_ = json.Unmarshal([]byte(encoded), &headers)
+	}
+	return QueueDelivery{
+		Queue:   queueName,
+		Body:    msg.Data(),
+		Headers: headers,
+		ack:     msg.Ack,
+		nack: func(requeue bool) error {
+			if requeue {
+				return msg.Nak()
+			}
+			if queueName != DeadLetterQueue {
+				err := queue.PublishWithHeaders(context.Background(), DeadLetterQueue, msg.Data(), map[string]interface{}{
+					"x-origin-queue":       queueName,
+					"x-dead-letter-reason": "rejected",
+				})
+				if err != nil {
+					// redelivered rather than lost
+					_ = msg.Nak()
+					return err
+				}
+			}
+			return msg.Term()
+		},
+	}
+}
+
+// natsDue returns when a delayed message is due, zero for the others.
+func natsDue(header nats.Header) time.Time {
+	millis, err := strconv.ParseInt(header.Get(natsNotBeforeHeader), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(millis)
+}
+
+func (queue *NATSQueue) Ready() bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.ready && !queue.closed && queue.conn.IsConnected()
+}
+
+func (queue *NATSQueue) Accepting() bool {
+	return queue.Ready()
+}
+
+func (queue *NATSQueue) Close() error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.closed {
+		return errors.New("nats queue already closed")
+	}
+	queue.closed = true
+	close(queue.done)
+	queue.conn.Close()
+	return nil
+}
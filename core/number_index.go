@@ -0,0 +1,76 @@
+package core
+
+import (
+	"sync"
+)
+
+// numberIndexEntry is the client owning a number, together with the number itself.
+type numberIndexEntry struct {
+	client *Client
+	number *ClientNumber
+}
+
+// NumberIndex maps normalized numbers (numberKey, digits without "+") to their client. It is
+// rebuilt whenever clients are loaded and updated when numbers are added. With prefix matching
+// enabled a number that isn't assigned exactly falls back to the longest assigned prefix, which
+// lets a client own a whole number block.
+type NumberIndex struct {
+	mu          sync.RWMutex
+	numbers     map[string]numberIndexEntry
+	PrefixMatch bool
+}
+
+func NewNumberIndex() *NumberIndex {
+	return &NumberIndex{
+		numbers:     make(map[string]numberIndexEntry),
+		PrefixMatch: Getenv("NUMBER_PREFIX_MATCH") == "true",
+	}
+}
+
+// Rebuild replaces the index with the numbers of the given clients.
+func (index *NumberIndex) Rebuild(clients map[string]*Client) {
+	numbers := make(map[string]numberIndexEntry)
+	for _, client := range clients {
+		for i := range client.Numbers {
+			number := &client.Numbers[i]
+			numbers[NumberKey(number.Number)] = numberIndexEntry{client: client, number: number}
+		}
+	}
+
+	index.mu.Lock()
+	index.numbers = numbers
+	index.mu.Unlock()
+}
+
+// Add indexes a single number of the client.
+func (index *NumberIndex) Add(client *Client, number *ClientNumber) {
+	index.mu.Lock()
+	index.numbers[NumberKey(number.Number)] = numberIndexEntry{client: client, number: number}
+	index.mu.Unlock()
+}
+
+// Lookup returns the client and number for an exact match, or the longest prefix match when
+// prefix matching is enabled.
+func (index *NumberIndex) Lookup(number string) (*Client, *ClientNumber, bool) {
+	key := NumberKey(number)
+	if key == "" {
+		return nil, nil, false
+	}
+
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	if entry, ok := index.numbers[key]; ok {
+		return entry.client, entry.number, true
+	}
+	// a short code is no number of an assigned block
+	if !index.PrefixMatch || IsShortCode(key) {
+		return nil, nil, false
+	}
+	for i := len(key) - 1; i > 0; i-- {
+		if entry, ok := index.numbers[key[:i]]; ok {
+			return entry.client, entry.number, true
+		}
+	}
+	return nil, nil, false
+}
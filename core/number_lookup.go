@@ -0,0 +1,370 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CarrierLookup finds the carrier currently serving a number. A number ported to another carrier
+// keeps the Carrier stored for it until someone edits it, the lookup tells the routers and the
+// reconciliation where it went.
+type CarrierLookup interface {
+	Name() string
+	Lookup(ctx context.Context, number string) (NumberCarrier, error)
+}
+
+// NumberCarrier is the answer of a carrier lookup. Route is the configured carrier the operator
+// maps to, empty when none does.
+type NumberCarrier struct {
+	Number   string `json:"number"`
+	Operator string `json:"operator"`       // carrier name reported by the provider
+	SPID     string `json:"spid,omitempty"` // service provider ID of the number
+	LRN      string `json:"lrn,omitempty"`  // location routing number of a ported number
+	Route    string `json:"route,omitempty"`
+}
+
+var (
+	carrierLookupProvider string
+	carrierLookupTTL      time.Duration
+	carrierLookupTimeout  time.Duration
+	// carrierLookupReconcile is how often the stored carriers of the numbers are compared with
+	// the lookup, 0 never
+	carrierLookupReconcile time.Duration
+	// carrierLookupUpdate has the reconciliation change the stored carrier of a ported number
+	// instead of only reporting it
+	carrierLookupUpdate bool
+)
+
+var ErrNoCarrierLookup = fmt.Errorf("%w: no CARRIER_LOOKUP configured", ErrNotFound)
+
+var carrierLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "carrier_lookups_total",
+	Help: "Carrier lookups of numbers by provider and result",
+}, []string{"provider", "result"})
+
+func init() {
+	prometheus.MustRegister(carrierLookups)
+	OnConfigure(func(cfg *Config) {
+		carrierLookupProvider = cfg.String("CARRIER_LOOKUP", "")
+		carrierLookupTTL = cfg.Duration("CARRIER_LOOKUP_TTL", 24*time.Hour)
+		carrierLookupTimeout = cfg.Duration("CARRIER_LOOKUP_TIMEOUT", 2*time.Second)
+		carrierLookupReconcile = cfg.Duration("CARRIER_LOOKUP_RECONCILE_INTERVAL", 0)
+		carrierLookupUpdate = cfg.Getenv("CARRIER_LOOKUP_UPDATE") == "true"
+	})
+}
+
+// NewCarrierLookup creates the provider selected by CARRIER_LOOKUP, nil when there is none.
+func NewCarrierLookup() (CarrierLookup, error) {
+	username, password := Getenv("CARRIER_LOOKUP_USERNAME"), Getenv("CARRIER_LOOKUP_PASSWORD")
+	switch carrierLookupProvider {
+	case "":
+		return nil, nil
+	case "twilio":
+		return &twilioLookup{username: username, password: password, client: &http.Client{}}, nil
+	case "http":
+		lookupURL := Getenv("CARRIER_LOOKUP_URL")
+		if !strings.Contains(lookupURL, "{number}") {
+			return nil, fmt.Errorf("CARRIER_LOOKUP_URL must contain {number}")
+		}
+		return &httpLookup{url: lookupURL, username: username, password: password, client: &http.Client{}}, nil
+	}
+	return nil, fmt.Errorf("unknown CARRIER_LOOKUP: %s", carrierLookupProvider)
+}
+
+// twilioLookup asks Twilio Lookup v2 for the line type intelligence of the number, with the
+// Account SID and Auth Token as CARRIER_LOOKUP_USERNAME and CARRIER_LOOKUP_PASSWORD.
+type twilioLookup struct {
+	username string
+	password string
+	client   *http.Client
+}
+
+func (l *twilioLookup) Name() string { return "twilio" }
+
+func (l *twilioLookup) Lookup(ctx context.Context, number string) (NumberCarrier, error) {
+	var answer struct {
+		LineTypeIntelligence struct {
+			CarrierName       string `json:"carrier_name"`
+			MobileCountryCode string `json:"mobile_country_code"`
+			MobileNetworkCode string `json:"mobile_network_code"`
+		} `json:"line_type_intelligence"`
+	}
+	lookupURL := "https://lookups.twilio.com/v2/PhoneNumbers/" + url.PathEscape(number) + "?Fields=line_type_intelligence"
+	if err := getLookup(ctx, l.client, lookupURL, l.username, l.password, &answer); err != nil {
+		return NumberCarrier{}, err
+	}
+	result := NumberCarrier{Number: number, Operator: answer.LineTypeIntelligence.CarrierName}
+	if code := answer.LineTypeIntelligence.MobileNetworkCode; code != "" {
+		result.SPID = answer.LineTypeIntelligence.MobileCountryCode + code
+	}
+	return result, nil
+}
+
+// httpLookup asks an LRN service at CARRIER_LOOKUP_URL, {number} is replaced by the number. It
+// answers {"operator": "...", "spid": "...", "lrn": "..."}, services answering otherwise, like
+// Telique, are put behind a small adapter.
+type httpLookup struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+}
+
+func (l *httpLookup) Name() string { return "http" }
+
+func (l *httpLookup) Lookup(ctx context.Context, number string) (NumberCarrier, error) {
+	var answer NumberCarrier
+	if err := getLookup(ctx, l.client, strings.ReplaceAll(l.url, "{number}", url.PathEscape(number)), l.username, l.password, &answer); err != nil {
+		return NumberCarrier{}, err
+	}
+	answer.Number = number
+	answer.Route = ""
+	return answer, nil
+}
+
+// getLookup gets a lookup answer, with basic auth when a username is set.
+func getLookup(ctx context.Context, client *http.Client, lookupURL string, username string, password string, answer interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", lookupURL, nil)
+	if err != nil {
+		return err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "zultys-smpp-mm4")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("carrier lookup answered %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(answer); err != nil {
+		return fmt.Errorf("failed to decode the carrier lookup: %w", err)
+	}
+	return nil
+}
+
+// carrierLookupMap maps operators to configured carriers, from CARRIER_LOOKUP_MAP, e.g.
+// "Bandwidth=bw-main,6529=twilio-us". A key matches the SPID of the lookup, or is contained
+// in its operator name ignoring case.
+func carrierLookupMap() map[string]string {
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(Getenv("CARRIER_LOOKUP_MAP"), ",") {
+		key, carrier, ok := strings.Cut(pair, "=")
+		if key, carrier = strings.TrimSpace(key), strings.TrimSpace(carrier); ok && key != "" && carrier != "" {
+			mapping[strings.ToLower(key)] = carrier
+		}
+	}
+	return mapping
+}
+
+// lookupRoute is the configured carrier a lookup maps to: the carrier of CARRIER_LOOKUP_MAP, or
+// else the only carrier whose type is named in the operator, e.g. a bandwidth carrier for
+// "Bandwidth CLEC".
+func (gateway *Gateway) lookupRoute(result NumberCarrier) string {
+	operator := strings.ToLower(result.Operator)
+	mapping := carrierLookupMap()
+	keys := make([]string, 0, len(mapping))
+	for key := range mapping {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == strings.ToLower(result.SPID) || (operator != "" && strings.Contains(operator, key)) {
+			return mapping[key]
+		}
+	}
+	if operator == "" {
+		return ""
+	}
+
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+	var matches []string
+	for _, carrier := range gateway.CarrierUUIDs {
+		if carrierType := strings.ToLower(carrier.Type); carrierType != "" && strings.Contains(operator, carrierType) {
+			matches = append(matches, carrier.Name)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0]
+	}
+	return ""
+}
+
+// LookupCarrier looks the number up, through the cache unless refresh is set. A failed lookup is
+// cached as unknown, an outage of the provider only slows down one message per number.
+func (gateway *Gateway) LookupCarrier(number string, refresh bool) (NumberCarrier, error) {
+	if gateway.CarrierLookup == nil {
+		return NumberCarrier{}, ErrNoCarrierLookup
+	}
+	key := carrierLookupCacheKey + NumberKey(number)
+	if !refresh {
+		if value, ok, err := gateway.lookupCache.Get(key); err == nil && ok {
+			cacheLookups.WithLabelValues("carrier_lookup", "hit").Inc()
+			var result NumberCarrier
+			if value != "" && json.Unmarshal([]byte(value), &result) == nil {
+				return result, nil
+			}
+			return NumberCarrier{Number: number}, nil
+		}
+		cacheLookups.WithLabelValues("carrier_lookup", "miss").Inc()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), carrierLookupTimeout)
+	defer cancel()
+	result, err := gateway.CarrierLookup.Lookup(ctx, number)
+	if err != nil {
+		carrierLookups.WithLabelValues(gateway.CarrierLookup.Name(), MetricError).Inc()
+		_ = gateway.lookupCache.Set(key, "")
+		return NumberCarrier{}, err
+	}
+	carrierLookups.WithLabelValues(gateway.CarrierLookup.Name(), MetricSuccess).Inc()
+	result.Route = gateway.lookupRoute(result)
+	if encoded, err := json.Marshal(result); err == nil {
+		_ = gateway.lookupCache.Set(key, string(encoded))
+	}
+	return result, nil
+}
+
+// PortedCarrier returns the carrier the lookup found for a number of a client when it differs from
+// the stored one, for the routers to fall back to. It is empty without a lookup, when the lookup
+// failed, or when the number wasn't ported.
+func (gateway *Gateway) PortedCarrier(number string) string {
+	if gateway.CarrierLookup == nil {
+		return ""
+	}
+	stored, _ := gateway.GetClientCarrier(number)
+	result, err := gateway.LookupCarrier(number, false)
+	if err != nil {
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.CarrierLookup",
+			"GenericError",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"number": number,
+			}, err,
+		))
+		return ""
+	}
+	if result.Route == stored {
+		return ""
+	}
+	return result.Route
+}
+
+// NumberReconciliation is the outcome of a comparison of the stored carriers with the lookup.
+type NumberReconciliation struct {
+	RunAt   time.Time            `json:"run_at"`
+	Checked int                  `json:"checked"`
+	Failed  int                  `json:"failed"` // lookups that failed
+	Ported  []NumberPortedReport `json:"ported"`
+}
+
+// NumberPortedReport is a number whose lookup maps to another carrier than the stored one.
+type NumberPortedReport struct {
+	Number   string `json:"number"`
+	Stored   string `json:"stored_carrier"`
+	Operator string `json:"operator"`
+	Route    string `json:"route"`             // the configured carrier of the operator, empty for none
+	Updated  bool   `json:"updated,omitempty"` // the stored carrier was changed to the route
+	Error    string `json:"error,omitempty"`   // why the update failed
+}
+
+var lastReconciliation struct {
+	mu     sync.Mutex
+	report *NumberReconciliation
+}
+
+// LastReconciliation returns the last reconciliation of the numbers, nil before the first.
+func LastReconciliation() *NumberReconciliation {
+	lastReconciliation.mu.Lock()
+	defer lastReconciliation.mu.Unlock()
+	return lastReconciliation.report
+}
+
+// ReconcileNumbers looks up every number and reports the ones whose carrier changed. With
+// CARRIER_LOOKUP_UPDATE the stored carrier is changed to the configured carrier of the new
+// operator, numbers of operators without one are only reported.
+func (gateway *Gateway) ReconcileNumbers() (*NumberReconciliation, error) {
+	numbers, err := gateway.Storage.Numbers()
+	if err != nil {
+		return nil, err
+	}
+	var lm = gateway.LogManager
+	report := &NumberReconciliation{RunAt: time.Now(), Ported: []NumberPortedReport{}}
+	for _, number := range numbers {
+		report.Checked++
+		result, err := gateway.LookupCarrier(number.Number, true)
+		if err != nil {
+			report.Failed++
+			continue
+		}
+		if result.Operator == "" || result.Route == number.Carrier {
+			continue
+		}
+		ported := NumberPortedReport{Number: number.Number, Stored: number.Carrier, Operator: result.Operator, Route: result.Route}
+		if carrierLookupUpdate && result.Route != "" && StorageBackend == "postgres" {
+			update := number
+			update.Carrier = result.Route
+			if _, err := gateway.UpdateNumber(number.ID, update); err != nil {
+				ported.Error = err.Error()
+			} else {
+				ported.Updated = true
+			}
+		}
+		lm.SendLog(lm.BuildLog(
+			"System.CarrierLookup",
+			"NumberPorted",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"number":   number.Number,
+				"carrier":  number.Carrier,
+				"operator": result.Operator,
+				"updated":  ported.Updated,
+			}, result.Route,
+		))
+		report.Ported = append(report.Ported, ported)
+	}
+
+	lastReconciliation.mu.Lock()
+	lastReconciliation.report = report
+	lastReconciliation.mu.Unlock()
+	return report, nil
+}
+
+// NumberReconciler reconciles the stored carriers of the numbers every
+// CARRIER_LOOKUP_RECONCILE_INTERVAL.
+func (gateway *Gateway) NumberReconciler() {
+	if gateway.CarrierLookup == nil || carrierLookupReconcile <= 0 {
+		return
+	}
+	ticker := time.NewTicker(carrierLookupReconcile)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := gateway.ReconcileNumbers(); err != nil {
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"System.CarrierLookup",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+	}
+}
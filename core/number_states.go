@@ -0,0 +1,324 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gorm.io/gorm"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// NumberStates are the states of the activation of a number. Messages are only routed for active
+// numbers, so a number mistyped while provisioning fails visibly instead of losing its traffic.
+var NumberStates = struct {
+	Pending   string
+	Verifying string
+	Active    string
+	Suspended string
+}{
+	Pending:   "pending",   // provisioned, not verified yet
+	Verifying: "verifying", // a test message was sent from it
+	Active:    "active",
+	Suspended: "suspended", // taken out of service by an operator
+}
+
+// numberTransitions are the states a number may move to from each state.
+var numberTransitions = map[string][]string{
+	NumberStates.Pending:   {NumberStates.Verifying, NumberStates.Active, NumberStates.Suspended},
+	NumberStates.Verifying: {NumberStates.Verifying, NumberStates.Pending, NumberStates.Active, NumberStates.Suspended},
+	NumberStates.Active:    {NumberStates.Suspended},
+	NumberStates.Suspended: {NumberStates.Active, NumberStates.Pending},
+}
+
+var (
+	// numberVerification has new numbers start pending until they are verified or activated,
+	// else they are active right away
+	numberVerification bool
+	// numberVerificationTo is where test messages go when the request names no destination
+	numberVerificationTo      string
+	numberVerificationTimeout time.Duration
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		numberVerification = cfg.Getenv("NUMBER_VERIFICATION") == "true"
+		numberVerificationTo = cfg.String("NUMBER_VERIFICATION_TO", "")
+		numberVerificationTimeout = cfg.Duration("NUMBER_VERIFICATION_TIMEOUT", 30*time.Second)
+	})
+}
+
+// VerificationLogPrefix marks the log IDs of test messages, their delivery statuses verify the
+// number instead of being reported to a client.
+const VerificationLogPrefix = "verify-"
+
+// NumberVerification is the test message a number was last sent for its verification.
+type NumberVerification struct {
+	ID       uint      `gorm:"primaryKey" json:"id"`
+	NumberID uint      `gorm:"uniqueIndex;not null" json:"number_id"`
+	LogID    string    `gorm:"index" json:"log_id"`
+	To       string    `json:"to"`
+	Code     string    `json:"-"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+// initialNumberState is the state new numbers start in.
+func initialNumberState() string {
+	if numberVerification {
+		return NumberStates.Pending
+	}
+	return NumberStates.Active
+}
+
+// active reports whether messages of the number are routed, numbers of the file storage have no
+// state and are active.
+func (number *ClientNumber) active() bool {
+	return number.State == "" || number.State == NumberStates.Active
+}
+
+// InactiveNumber returns why the messages of a client number aren't routed, empty when they are or
+// the number isn't a client number.
+func (gateway *Gateway) InactiveNumber(number string) string {
+	_, num, ok := gateway.LookupNumber(number)
+	if !ok || num.active() {
+		return ""
+	}
+	reason := fmt.Sprintf("number %s is %s", num.Number, num.State)
+	if num.StateReason != "" {
+		reason += ": " + num.StateReason
+	}
+	return reason
+}
+
+// transitionNumber moves a number to another state, reason says why for suspended numbers and
+// failed verifications.
+func (gateway *Gateway) transitionNumber(id uint, state string, reason string) (ClientNumber, error) {
+	var number ClientNumber
+	if err := gateway.DB.First(&number, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ClientNumber{}, ErrNotFound
+		}
+		return ClientNumber{}, err
+	}
+	current := number.State
+	if current == "" {
+		current = NumberStates.Active
+	}
+	if !slices.Contains(numberTransitions[current], state) {
+		return ClientNumber{}, Invalid("number %s is %s, it can't become %s", number.Number, current, state)
+	}
+	number.State, number.StateReason = state, reason
+	if err := UpdateVersioned(gateway.DB, &number, id, &number.Version, "state", "state_reason"); err != nil {
+		return ClientNumber{}, err
+	}
+	if err := gateway.ProvisioningChanged(); err != nil {
+		return ClientNumber{}, err
+	}
+
+	var lm = gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"System.NumberState",
+		"NumberStateChanged",
+		logrus.InfoLevel,
+		map[string]interface{}{
+			"number": number.Number,
+			"from":   current,
+			"reason": reason,
+		}, state,
+	))
+	return number, nil
+}
+
+// verifyNumber sends a test message with a code from the number through its carrier. The number
+// is active once the carrier reports the message delivered, or the code is confirmed; a message
+// the carrier refuses leaves the number pending with the error.
+func (gateway *Gateway) verifyNumber(id uint, to string) (ClientNumber, error) {
+	if to == "" {
+		to = numberVerificationTo
+	}
+	if to == "" {
+		return ClientNumber{}, Invalid("to is required without NUMBER_VERIFICATION_TO")
+	}
+	var number ClientNumber
+	if err := gateway.DB.First(&number, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ClientNumber{}, ErrNotFound
+		}
+		return ClientNumber{}, err
+	}
+	gateway.Mu.RLock()
+	handler, ok := gateway.Carriers[number.Carrier]
+	gateway.Mu.RUnlock()
+	if !ok {
+		return ClientNumber{}, Invalid("carrier %q of number %s isn't loaded", number.Carrier, number.Number)
+	}
+	number, err := gateway.transitionNumber(id, NumberStates.Verifying, "")
+	if err != nil {
+		return ClientNumber{}, err
+	}
+
+	code, err := verificationCode()
+	if err != nil {
+		return ClientNumber{}, err
+	}
+	from, _ := NormalizeNumber(number.Number, "")
+	destination, _ := NormalizeNumber(to, "")
+	msg := &MsgQueueItem{
+		LogID:             VerificationLogPrefix + primitive.NewObjectID().Hex(),
+		Type:              MsgQueueItemType.SMS,
+		From:              from,
+		To:                destination,
+		Message:           fmt.Sprintf("Verification code for %s: %s", from, code),
+		ReceivedTimestamp: time.Now(),
+		SkipReceipt:       true,
+	}
+	verification := NumberVerification{NumberID: id, LogID: msg.LogID, To: destination, Code: code, SentAt: msg.ReceivedTimestamp}
+	err = gateway.DB.Where("number_id = ?", id).Assign(verification).FirstOrCreate(&NumberVerification{}).Error
+	if err != nil {
+		return ClientNumber{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), numberVerificationTimeout)
+	defer cancel()
+	if err := handler.SendSMS(ctx, msg); err != nil {
+		reason := "verification message refused: " + err.Error()
+		if _, terr := gateway.transitionNumber(id, NumberStates.Pending, reason); terr != nil {
+			return ClientNumber{}, terr
+		}
+		return ClientNumber{}, Invalid("%s", reason)
+	}
+	return number, nil
+}
+
+// confirmNumber activates a number being verified with the code of its test message, for carriers
+// that don't report the delivery.
+func (gateway *Gateway) confirmNumber(id uint, code string) (ClientNumber, error) {
+	var verification NumberVerification
+	if err := gateway.DB.Where("number_id = ?", id).First(&verification).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ClientNumber{}, Invalid("number %d has no verification", id)
+		}
+		return ClientNumber{}, err
+	}
+	if code == "" || strings.TrimSpace(code) != verification.Code {
+		return ClientNumber{}, Invalid("wrong verification code")
+	}
+	if number, ok := gateway.numberByID(id); ok && number.State != NumberStates.Verifying {
+		return ClientNumber{}, Invalid("number %s is %s, not verifying", number.Number, number.State)
+	}
+	return gateway.transitionNumber(id, NumberStates.Active, "")
+}
+
+// VerificationStatus verifies a number by the final status of its test message.
+func (gateway *Gateway) VerificationStatus(record CarrierMessage, status string, errorCode string) error {
+	var verification NumberVerification
+	if err := gateway.DB.Where("log_id = ?", record.LogID).First(&verification).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil // a newer test message was sent meanwhile
+		}
+		return err
+	}
+	if number, ok := gateway.numberByID(verification.NumberID); !ok || number.State != NumberStates.Verifying {
+		return nil
+	}
+	state, reason := NumberStates.Active, ""
+	if status != DeliveryStatuses.Delivered {
+		state, reason = NumberStates.Pending, "verification message "+status
+		if errorCode != "" {
+			reason += " with error " + errorCode
+		}
+	}
+	_, err := gateway.transitionNumber(verification.NumberID, state, reason)
+	return err
+}
+
+// numberByID returns a stored number.
+func (gateway *Gateway) numberByID(id uint) (ClientNumber, bool) {
+	var number ClientNumber
+	if err := gateway.DB.First(&number, id).Error; err != nil {
+		return ClientNumber{}, false
+	}
+	return number, true
+}
+
+// verificationCode is a random 6 digit code.
+func verificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// SetupNumberStateRoutes sets up the verification, activation and suspension of numbers.
+func SetupNumberStateRoutes(app *iris.Application, gateway *Gateway) {
+	numbers := app.Party("/numbers", gateway.BasicAuthMiddleware)
+	{
+		// Send a test message from the number, it is active once the carrier delivered it
+		numbers.Post("/{id:uint}/verify", func(ctx iris.Context) {
+			var request struct {
+				To string `json:"to"`
+			}
+			if err := ctx.ReadJSON(&request); err != nil && !iris.IsErrEmptyJSON(err) {
+				WriteProvisioningError(ctx, Invalid("invalid verification data"))
+				return
+			}
+			number, err := gateway.verifyNumber(ctx.Params().GetUintDefault("id", 0), request.To)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(number)
+		})
+
+		// Activate a number being verified with the code of its test message
+		numbers.Post("/{id:uint}/confirm", func(ctx iris.Context) {
+			var request struct {
+				Code string `json:"code"`
+			}
+			if err := ctx.ReadJSON(&request); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid confirmation data"))
+				return
+			}
+			number, err := gateway.confirmNumber(ctx.Params().GetUintDefault("id", 0), request.Code)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(number)
+		})
+
+		// Activate a number without verifying it, or a suspended number again
+		numbers.Post("/{id:uint}/activate", func(ctx iris.Context) {
+			number, err := gateway.transitionNumber(ctx.Params().GetUintDefault("id", 0), NumberStates.Active, "")
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(number)
+		})
+
+		// Take a number out of service
+		numbers.Post("/{id:uint}/suspend", func(ctx iris.Context) {
+			var request struct {
+				Reason string `json:"reason"`
+			}
+			if err := ctx.ReadJSON(&request); err != nil && !iris.IsErrEmptyJSON(err) {
+				WriteProvisioningError(ctx, Invalid("invalid suspension data"))
+				return
+			}
+			number, err := gateway.transitionNumber(ctx.Params().GetUintDefault("id", 0), NumberStates.Suspended, request.Reason)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(number)
+		})
+	}
+}
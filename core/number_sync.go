@@ -0,0 +1,223 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// numberInventory is implemented by the carriers whose accounts can list the numbers they hold.
+type numberInventory interface {
+	listNumbers(ctx context.Context) ([]string, error)
+}
+
+var (
+	// numberSyncInterval is how often the numbers of the carrier accounts are compared with the
+	// stored numbers, 0 never
+	numberSyncInterval time.Duration
+	numberSyncTimeout  time.Duration
+	// numberSyncImportClient is the client numbers found on a carrier account without a client
+	// are added to, e.g. a placeholder client of a holding tenant, empty to only report them
+	numberSyncImportClient string
+)
+
+// errNoNumberSync fails a sync while no loaded carrier can list its numbers.
+var errNoNumberSync = fmt.Errorf("%w: no carrier lists its numbers", ErrNotFound)
+
+// Kinds of the differences a sync finds.
+const (
+	numberSyncUnassigned = "unassigned"       // on a carrier account, stored for no client
+	numberSyncMissing    = "missing"          // stored with the carrier, not on its account
+	numberSyncMismatch   = "carrier_mismatch" // stored with another carrier than the account holding it
+)
+
+var numberSyncIssues = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "number_sync_issues",
+	Help: "Differences between the carrier accounts and the stored numbers found by the last sync, by carrier and kind",
+}, []string{"carrier", "kind"})
+
+func init() {
+	prometheus.MustRegister(numberSyncIssues)
+	OnConfigure(func(cfg *Config) {
+		numberSyncInterval = cfg.Duration("NUMBER_SYNC_INTERVAL", 0)
+		numberSyncTimeout = cfg.Duration("NUMBER_SYNC_TIMEOUT", time.Minute)
+		numberSyncImportClient = cfg.String("NUMBER_SYNC_IMPORT_CLIENT", "")
+	})
+}
+
+// NumberSync is the outcome of a comparison of the carrier accounts with the stored numbers.
+type NumberSync struct {
+	RunAt    time.Time           `json:"run_at"`
+	Carriers []NumberSyncCarrier `json:"carriers"`
+	Issues   []NumberSyncIssue   `json:"issues"`
+}
+
+// NumberSyncCarrier is what a carrier account listed.
+type NumberSyncCarrier struct {
+	Carrier string `json:"carrier"`
+	Numbers int    `json:"numbers"`
+	Error   string `json:"error,omitempty"` // why the listing failed, its numbers weren't compared
+}
+
+// NumberSyncIssue is a number the carrier accounts and the stored numbers disagree about.
+type NumberSyncIssue struct {
+	Kind     string `json:"kind"`
+	Number   string `json:"number"`
+	Carrier  string `json:"carrier,omitempty"`        // the account holding the number
+	Stored   string `json:"stored_carrier,omitempty"` // the carrier stored for the number
+	Client   string `json:"client,omitempty"`
+	Imported bool   `json:"imported,omitempty"` // added to NUMBER_SYNC_IMPORT_CLIENT
+	Error    string `json:"error,omitempty"`    // why the import failed
+}
+
+var lastNumberSync struct {
+	mu     sync.Mutex
+	report *NumberSync
+}
+
+// LastNumberSync returns the last sync of the numbers, nil before the first.
+func LastNumberSync() *NumberSync {
+	lastNumberSync.mu.Lock()
+	defer lastNumberSync.mu.Unlock()
+	return lastNumberSync.report
+}
+
+// SyncNumbers lists the numbers of the carrier accounts that support it and compares them with
+// the stored numbers. Only carriers whose listing succeeded are compared, a number stored with a
+// carrier whose listing failed isn't reported missing. With NUMBER_SYNC_IMPORT_CLIENT the
+// unassigned numbers are added to that client.
+func (gateway *Gateway) SyncNumbers() (*NumberSync, error) {
+	stored, err := gateway.Storage.Numbers()
+	if err != nil {
+		return nil, err
+	}
+
+	gateway.Mu.RLock()
+	names := make([]string, 0, len(gateway.Carriers))
+	inventories := make(map[string]numberInventory)
+	for name, handler := range gateway.Carriers {
+		if inventory, ok := handler.(numberInventory); ok {
+			names = append(names, name)
+			inventories[name] = inventory
+		}
+	}
+	gateway.Mu.RUnlock()
+	if len(names) == 0 {
+		return nil, errNoNumberSync
+	}
+	sort.Strings(names)
+
+	report := &NumberSync{RunAt: time.Now(), Carriers: []NumberSyncCarrier{}, Issues: []NumberSyncIssue{}}
+	held := make(map[string]string) // carrier holding each number, by numberKey
+	listed := make(map[string]bool)
+	for _, name := range names {
+		ctx, cancel := context.WithTimeout(context.Background(), numberSyncTimeout)
+		numbers, err := inventories[name].listNumbers(ctx)
+		cancel()
+		result := NumberSyncCarrier{Carrier: name, Numbers: len(numbers)}
+		if err != nil {
+			result.Error = err.Error()
+			report.Carriers = append(report.Carriers, result)
+			continue
+		}
+		listed[name] = true
+		for _, number := range numbers {
+			held[NumberKey(number)] = name
+		}
+		report.Carriers = append(report.Carriers, result)
+	}
+
+	storedByKey := make(map[string]ClientNumber, len(stored))
+	for _, number := range stored {
+		storedByKey[NumberKey(number.Number)] = number
+		carrier, ok := held[NumberKey(number.Number)]
+		switch {
+		case ok && carrier != number.Carrier:
+			report.Issues = append(report.Issues, NumberSyncIssue{Kind: numberSyncMismatch, Number: number.Number, Carrier: carrier, Stored: number.Carrier})
+		case !ok && listed[number.Carrier]:
+			report.Issues = append(report.Issues, NumberSyncIssue{Kind: numberSyncMissing, Number: number.Number, Stored: number.Carrier})
+		}
+	}
+	keys := make([]string, 0, len(held))
+	for key := range held {
+		if _, ok := storedByKey[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		issue := NumberSyncIssue{Kind: numberSyncUnassigned, Number: key, Carrier: held[key]}
+		if numberSyncImportClient != "" && StorageBackend == "postgres" {
+			number := ClientNumber{Number: key, Carrier: held[key]}
+			if err := gateway.AddNumber(numberSyncImportClient, &number); err != nil {
+				issue.Error = err.Error()
+			} else {
+				issue.Imported = true
+			}
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	var lm = gateway.LogManager
+	counts := make(map[[2]string]int)
+	for i, issue := range report.Issues {
+		if number, ok := storedByKey[NumberKey(issue.Number)]; ok {
+			if client, ok := gateway.ClientByID(number.ClientID); ok {
+				report.Issues[i].Client = client.Username
+			}
+		} else if issue.Imported {
+			report.Issues[i].Client = numberSyncImportClient
+		}
+		carrier := issue.Carrier
+		if carrier == "" {
+			carrier = issue.Stored
+		}
+		counts[[2]string{carrier, issue.Kind}]++
+		lm.SendLog(lm.BuildLog(
+			"System.NumberSync",
+			"NumberSyncIssue",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"number":         issue.Number,
+				"carrier":        issue.Carrier,
+				"stored_carrier": issue.Stored,
+				"client":         report.Issues[i].Client,
+				"imported":       issue.Imported,
+			}, issue.Kind,
+		))
+	}
+	numberSyncIssues.Reset()
+	for key, count := range counts {
+		numberSyncIssues.WithLabelValues(key[0], key[1]).Set(float64(count))
+	}
+
+	lastNumberSync.mu.Lock()
+	lastNumberSync.report = report
+	lastNumberSync.mu.Unlock()
+	return report, nil
+}
+
+// NumberSyncer compares the carrier accounts with the stored numbers every NUMBER_SYNC_INTERVAL.
+func (gateway *Gateway) NumberSyncer() {
+	if numberSyncInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(numberSyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := gateway.SyncNumbers(); err != nil {
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"System.NumberSync",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+	}
+}
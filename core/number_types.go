@@ -0,0 +1,112 @@
+package core
+
+import (
+	"strings"
+)
+
+// Number types of ClientNumber.Type and of the source_type and dest_type of routing rules and LCR
+// entries. Short codes are 5 to 6 digit codes of a national network and are kept as they are,
+// they aren't E.164 and have no country.
+var NumberTypes = struct {
+	Long      string
+	ShortCode string
+	TollFree  string
+}{
+	Long:      "long",
+	ShortCode: "short_code",
+	TollFree:  "toll_free",
+}
+
+var (
+	shortCodeMinDigits int
+	shortCodeMaxDigits int
+
+	// tollFreePrefixes are the E.164 prefixes, without "+", of toll-free numbers, the NANP ones
+	// unless TOLL_FREE_PREFIXES lists others.
+	tollFreePrefixes []string
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		shortCodeMinDigits = cfg.Int("SHORT_CODE_MIN_DIGITS", 5)
+		shortCodeMaxDigits = cfg.Int("SHORT_CODE_MAX_DIGITS", 6)
+		tollFreePrefixes = tollFreePrefixList(cfg.String("TOLL_FREE_PREFIXES", "1800,1833,1844,1855,1866,1877,1888"))
+	})
+}
+
+func tollFreePrefixList(list string) []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(list, ",") {
+		if prefix = strings.TrimPrefix(strings.TrimSpace(prefix), "+"); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// shortCode returns the digits of a number written as a short code: no "+" and only digits, as
+// many as a short code has.
+func shortCode(number string) (string, bool) {
+	number = strings.TrimSpace(number)
+	if strings.HasPrefix(number, "+") || len(number) < shortCodeMinDigits || len(number) > shortCodeMaxDigits {
+		return "", false
+	}
+	for _, r := range number {
+		if r < '0' || r > '9' {
+			return "", false
+		}
+	}
+	return number, true
+}
+
+// IsShortCode reports whether the number is a short code.
+func IsShortCode(number string) bool {
+	_, ok := shortCode(number)
+	return ok
+}
+
+// ClassifyNumber is the type of a number by its form.
+func ClassifyNumber(number string) string {
+	if IsShortCode(number) {
+		return NumberTypes.ShortCode
+	}
+	digits := strings.TrimPrefix(number, "+")
+	for _, prefix := range tollFreePrefixes {
+		if strings.HasPrefix(digits, prefix) {
+			return NumberTypes.TollFree
+		}
+	}
+	return NumberTypes.Long
+}
+
+// ValidNumberType reports whether the type is one of NumberTypes, empty is valid.
+func ValidNumberType(numberType string) bool {
+	switch numberType {
+	case "", NumberTypes.Long, NumberTypes.ShortCode, NumberTypes.TollFree:
+		return true
+	}
+	return false
+}
+
+// numberType is the type of a number of a message: the type set on the number of the client when
+// it has one, else the type by its form.
+func numberType(number string, client *Client) string {
+	if client != nil {
+		key := NumberKey(number)
+		for i := range client.Numbers {
+			if client.Numbers[i].Type != "" && NumberKey(client.Numbers[i].Number) == key {
+				return client.Numbers[i].Type
+			}
+		}
+	}
+	return ClassifyNumber(number)
+}
+
+// MatchesNumberType reports whether a number of the type may be matched by a criterion: a prefix
+// criterion is an E.164 prefix, it only matches short codes when the criterion is for short codes.
+func MatchesNumberType(want string, numberType string) bool {
+	if want == "" {
+		return numberType != NumberTypes.ShortCode
+	}
+	return want == numberType
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DialPlanRule is a per-client translation applied to addresses received from that client
+// before they are normalized, e.g. expanding a 4 digit extension or stripping an access code.
+type DialPlanRule struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	ClientID uint   `gorm:"index;not null" json:"client_id"`
+	Position int    `json:"position"` // rules are applied in ascending position
+	Pattern  string `gorm:"not null" json:"pattern"`
+	Replace  string `json:"replace"`
+
+	pattern *regexp.Regexp
+}
+
+var (
+	// extension markers like ";ext=123", " x123", "ext.123" and "#123"
+	extensionRegex = regexp.MustCompile(`(?i)(;ext=|\s*(ext\.?|x)\s*\d+$|#).*$`)
+	nonDigitRegex  = regexp.MustCompile(`\D`)
+	e164Regex      = regexp.MustCompile(`^[1-9]\d{7,14}$`)
+)
+
+// defaultCountryCode is the calling code assumed for national numbers when the client has none set.
+func defaultCountryCode() string {
+	if code := strings.TrimPrefix(Getenv("DEFAULT_COUNTRY_CODE"), "+"); code != "" {
+		return code
+	}
+	return "1"
+}
+
+// NormalizeNumber converts a number in any of the formats seen on the wire (10 digit national,
+// 1+10, +E.164, "00"/"011" international prefixes, "/TYPE=PLMN" suffixes, extensions) to E.164
+// with a leading "+". National numbers are assumed to be in countryCode. Short codes aren't E.164,
+// they are returned as their digits.
+func NormalizeNumber(number string, countryCode string) (string, error) {
+	original := number
+	if code, ok := shortCode(number); ok {
+		return code, nil
+	}
+
+	number = strings.Split(strings.TrimSpace(number), "/")[0]
+	number = extensionRegex.ReplaceAllString(number, "")
+
+	international := strings.HasPrefix(number, "+")
+	digits := nonDigitRegex.ReplaceAllString(number, "")
+
+	if countryCode == "" {
+		countryCode = defaultCountryCode()
+	}
+	countryCode = strings.TrimPrefix(countryCode, "+")
+
+	if !international {
+		switch {
+		case strings.HasPrefix(digits, "00"):
+			digits = digits[2:]
+		case countryCode == "1" && strings.HasPrefix(digits, "011"):
+			digits = digits[3:]
+		case strings.HasPrefix(digits, "0"):
+			// national trunk prefix
+			digits = countryCode + digits[1:]
+		case countryCode == "1" && len(digits) == 10:
+			digits = countryCode + digits
+		case countryCode != "1" && !strings.HasPrefix(digits, countryCode):
+			digits = countryCode + digits
+		}
+	}
+
+	if !e164Regex.MatchString(digits) {
+		return original, fmt.Errorf("unable to normalize number to E.164: %s", original)
+	}
+	return "+" + digits, nil
+}
+
+// NumberKey is the normalized form numbers are compared by, E.164 without the "+" as the
+// client numbers are stored, or the digits of a short code. Numbers that can't be normalized are compared by their digits.
+func NumberKey(number string) string {
+	normalized, err := NormalizeNumber(number, "")
+	if err != nil {
+		return nonDigitRegex.ReplaceAllString(number, "")
+	}
+	return strings.TrimPrefix(normalized, "+")
+}
+
+// compileDialPlan sorts and compiles the client's dial plan, invalid patterns are returned as an error.
+func (client *Client) compileDialPlan() error {
+	sort.SliceStable(client.DialPlan, func(i, j int) bool {
+		return client.DialPlan[i].Position < client.DialPlan[j].Position
+	})
+	for i := range client.DialPlan {
+		rule := &client.DialPlan[i]
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid dial plan pattern %q for client %s: %w", rule.Pattern, client.Name, err)
+		}
+		rule.pattern = pattern
+	}
+	return nil
+}
+
+// translate applies the client's dial plan to a number, the first matching rule wins.
+func (client *Client) translate(number string) string {
+	for _, rule := range client.DialPlan {
+		if rule.pattern != nil && rule.pattern.MatchString(number) {
+			return rule.pattern.ReplaceAllString(number, rule.Replace)
+		}
+	}
+	return number
+}
+
+// NormalizeAddresses runs the addresses of a message received at an ingress through the dial
+// plan of the client it came from (nil for carriers) and normalizes them to E.164. Addresses that
+// can't be normalized are left as they are so routing can still report them.
+func NormalizeAddresses(msg *MsgQueueItem, client *Client) {
+	countryCode := ""
+	if client != nil {
+		countryCode = client.DefaultCountryCode
+	}
+
+	for _, address := range []*string{&msg.To, &msg.From} {
+		number := *address
+		if client != nil {
+			number = client.translate(number)
+		}
+		if normalized, err := NormalizeNumber(number, countryCode); err == nil {
+			*address = normalized
+		}
+	}
+}
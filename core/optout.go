@@ -0,0 +1,219 @@
+package core
+
+import (
+	"errors"
+	"github.com/kataras/iris/v12"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+// OptOut records a sender that replied STOP to a client number. Messages from the number to the
+// sender are rejected until the sender replies START.
+type OptOut struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ClientID  uint      `gorm:"index" json:"client_id"`
+	Number    string    `gorm:"uniqueIndex:idx_opt_out_pair;not null" json:"number"` // the client number
+	Sender    string    `gorm:"uniqueIndex:idx_opt_out_pair;not null" json:"sender"` // who opted out
+	Keyword   string    `json:"keyword"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	OptOutKeywordsEnabled bool
+
+	StopKeywords  map[string]bool
+	StartKeywords map[string]bool
+	HelpKeywords  map[string]bool
+
+	DefaultStopReply  string
+	DefaultStartReply string
+	DefaultHelpReply  string
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		OptOutKeywordsEnabled = cfg.Getenv("OPT_OUT_KEYWORDS") != "false"
+		StopKeywords = keywordSet(cfg.String("STOP_KEYWORDS", "STOP,STOPALL,UNSUBSCRIBE,CANCEL,END,QUIT"))
+		StartKeywords = keywordSet(cfg.String("START_KEYWORDS", "START,UNSTOP,YES"))
+		HelpKeywords = keywordSet(cfg.String("HELP_KEYWORDS", "HELP,INFO"))
+		DefaultStopReply = cfg.String("STOP_REPLY", "{name}: You have been unsubscribed and will receive no further messages. Reply START to resubscribe.")
+		DefaultStartReply = cfg.String("START_REPLY", "{name}: You have been resubscribed. Reply STOP to unsubscribe.")
+		DefaultHelpReply = cfg.String("HELP_REPLY", "{name}: Reply STOP to unsubscribe. Msg & data rates may apply.")
+	})
+}
+
+func keywordSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, keyword := range strings.Split(list, ",") {
+		if keyword = strings.ToUpper(strings.TrimSpace(keyword)); keyword != "" {
+			set[keyword] = true
+		}
+	}
+	return set
+}
+
+// MessageKeyword is the keyword a message consists of, ignoring case, surrounding whitespace and
+// punctuation, e.g. "Stop." is STOP.
+func MessageKeyword(text string) string {
+	return strings.ToUpper(strings.Trim(text, " \t\r\n.!?"))
+}
+
+// KeywordReply fills in the reply template of a client, or the default, {name} is the name of the
+// client and {number} the client number.
+func KeywordReply(template string, fallback string, client *Client, number string) string {
+	if template == "" {
+		template = fallback
+	}
+	name := client.Name
+	if name == "" {
+		name = client.Username
+	}
+	return strings.NewReplacer("{name}", name, "{number}", number).Replace(template)
+}
+
+// IsOptedOut reports whether the recipient of a message opted out of the number it is sent from.
+// The opt-outs are read from the database through the cache, changes invalidate their entry. A
+// cluster only caches them with the redis backend, so STOP replies received by other gateway
+// instances count at once.
+func (gateway *Gateway) IsOptedOut(number string, recipient string) (bool, error) {
+	load := func() (string, error) {
+		var count int64
+		err := gateway.DB.Model(&OptOut{}).Where("number = ? AND sender = ?", number, recipient).Count(&count).Error
+		if err != nil || count == 0 {
+			return "", err
+		}
+		return "1", nil
+	}
+	if ClusterEnabled && cacheBackend != "redis" {
+		optedOut, err := load()
+		return optedOut != "", err
+	}
+	optedOut, err := gateway.cached("optout", optOutKey(number, recipient), load)
+	return optedOut != "", err
+}
+
+func optOutKey(number string, sender string) string {
+	return optOutCacheKey + number + ":" + sender
+}
+
+// RecordOptOut stores the opt-out of a sender, again opting out keeps the first record.
+func (gateway *Gateway) RecordOptOut(optOut *OptOut) error {
+	if err := gateway.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(optOut).Error; err != nil {
+		return err
+	}
+	return gateway.Cache.Delete(optOutKey(optOut.Number, optOut.Sender))
+}
+
+// RemoveOptOut deletes the opt-out of a sender, and reports whether there was one.
+func (gateway *Gateway) RemoveOptOut(number string, sender string) (bool, error) {
+	result := gateway.DB.Where("number = ? AND sender = ?", number, sender).Delete(&OptOut{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, gateway.Cache.Delete(optOutKey(number, sender))
+}
+
+// SetupOptOutRoutes sets up the management of the opt-outs.
+func SetupOptOutRoutes(app *iris.Application, gateway *Gateway) {
+	optOuts := app.Party("/optouts", gateway.BasicAuthMiddleware)
+	{
+		// List opt-outs, optionally of a number or a sender
+		optOuts.Get("/", func(ctx iris.Context) {
+			query := gateway.DB.Order("id desc")
+			for _, param := range []string{"number", "sender"} {
+				if value := ctx.URLParam(param); value != "" {
+					formatted, _ := FormatToE164(value)
+					query = query.Where(param+" = ?", formatted)
+				}
+			}
+			var list []OptOut
+			if err := query.Find(&list).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			visible := make([]OptOut, 0, len(list))
+			for _, optOut := range list {
+				client, _ := gateway.ClientByID(optOut.ClientID)
+				if KeyAllowsClient(ctx, client) {
+					visible = append(visible, optOut)
+				}
+			}
+			ctx.JSON(visible)
+		})
+
+		// Opt a sender out of a client number, e.g. to import opt-outs
+		optOuts.Post("/", func(ctx iris.Context) {
+			var optOut OptOut
+			if err := ctx.ReadJSON(&optOut); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid opt-out data"))
+				return
+			}
+			optOut.Number, _ = FormatToE164(optOut.Number)
+			optOut.Sender, _ = FormatToE164(optOut.Sender)
+			if optOut.Sender == "" {
+				WriteProvisioningError(ctx, Invalid("sender is required"))
+				return
+			}
+			client := gateway.GetClient(optOut.Number)
+			if client == nil {
+				WriteProvisioningError(ctx, Invalid("number %s does not belong to a client", optOut.Number))
+				return
+			}
+			if err := gateway.CheckClientScope(ctx, client.Username); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			optOut.ID = 0
+			optOut.ClientID = client.ID
+			if optOut.Keyword == "" {
+				optOut.Keyword = "API"
+			}
+			if err := gateway.RecordOptOut(&optOut); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(optOut)
+		})
+
+		// Remove an opt-out, the sender receives messages from the number again
+		optOuts.Delete("/{id:uint}", func(ctx iris.Context) {
+			var optOut OptOut
+			if err := gateway.DB.First(&optOut, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					err = ErrNotFound
+				}
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			removed, err := gateway.RemoveOptOut(optOut.Number, optOut.Sender)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if !removed {
+				WriteProvisioningError(ctx, ErrNotFound)
+				return
+			}
+			ctx.StatusCode(iris.StatusNoContent)
+		})
+	}
+}
+
+// optOutIDScope checks the client of an opt-out.
+func optOutIDScope(ctx iris.Context, gateway *Gateway) error {
+	var optOut OptOut
+	if err := gateway.DB.First(&optOut, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	client, ok := gateway.ClientByID(optOut.ClientID)
+	if !ok {
+		return ErrNotFound
+	}
+	return gateway.CheckClientScope(ctx, client.Username)
+}
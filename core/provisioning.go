@@ -0,0 +1,416 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"gorm.io/gorm"
+	"net/url"
+	"regexp"
+)
+
+// Errors of the management API, writeProvisioningError answers them with 400, 403, 404 and 409.
+var (
+	ErrInvalid         = errors.New("invalid request")
+	ErrForbidden       = errors.New("forbidden")
+	ErrNotFound        = errors.New("not found")
+	ErrVersionConflict = errors.New("version conflict, reload the record and retry")
+	errInUse           = errors.New("still in use")
+)
+
+func Invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...))
+}
+
+// WriteProvisioningError answers a failed management request with the status of its error.
+func WriteProvisioningError(ctx iris.Context, err error) {
+	status := iris.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrInvalid):
+		status = iris.StatusBadRequest
+	case errors.Is(err, ErrForbidden):
+		status = iris.StatusForbidden
+	case errors.Is(err, ErrNotFound):
+		status = iris.StatusNotFound
+	case errors.Is(err, ErrVersionConflict), errors.Is(err, errInUse), errors.Is(err, errReadOnly):
+		status = iris.StatusConflict
+	}
+	ctx.StatusCode(status)
+	ctx.JSON(iris.Map{"error": err.Error()})
+}
+
+// UpdateVersioned writes the columns of row when the stored row still has the version the caller
+// read, and bumps the version. Concurrent writers get errVersionConflict instead of silently
+// overwriting each other. row is a pointer to the model with its ID set.
+func UpdateVersioned(db *gorm.DB, row interface{}, id uint, version *uint, columns ...string) error {
+	if *version == 0 {
+		return Invalid("version is required")
+	}
+	read := *version
+	*version = read + 1
+
+	result := db.Model(row).Where("id = ? AND version = ?", id, read).Select(append(columns, "version")).Updates(row)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result.Error = versionMismatch(db, row, id)
+	}
+	if result.Error != nil {
+		*version = read
+	}
+	return result.Error
+}
+
+// DeleteVersioned deletes the row with the id, checking the version unless it is zero.
+func DeleteVersioned(db *gorm.DB, row interface{}, id uint, version uint) error {
+	query := db.Where("id = ?", id)
+	if version != 0 {
+		query = query.Where("version = ?", version)
+	}
+	result := query.Delete(row)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return versionMismatch(db, row, id)
+	}
+	return nil
+}
+
+// versionMismatch tells apart a missing row from one changed by another writer.
+func versionMismatch(db *gorm.DB, row interface{}, id uint) error {
+	var count int64
+	if err := db.Model(row).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrVersionConflict
+}
+
+// PublicClient is the client without its credentials.
+func PublicClient(client *Client) Client {
+	return Client{
+		ID:                  client.ID,
+		TenantID:            client.TenantID,
+		Username:            client.Username,
+		Name:                client.Name,
+		Address:             client.Address,
+		LogPrivacy:          client.LogPrivacy,
+		Numbers:             client.Numbers,
+		DefaultCountryCode:  client.DefaultCountryCode,
+		DialPlan:            client.DialPlan,
+		StopReply:           client.StopReply,
+		StartReply:          client.StartReply,
+		HelpReply:           client.HelpReply,
+		InternationalPolicy: client.InternationalPolicy,
+		AllowedCountries:    client.AllowedCountries,
+		Profile:             client.Profile,
+		Auth:                client.Auth,
+		Version:             client.Version,
+	}
+}
+
+// PublicCarrier is the carrier without its encrypted credentials.
+func PublicCarrier(carrier Carrier) Carrier {
+	return Carrier{
+		ID:       carrier.ID,
+		Name:     carrier.Name,
+		Type:     carrier.Type,
+		UUID:     carrier.UUID,
+		TenantID: carrier.TenantID,
+		Config:   carrier.Config,
+		Version:  carrier.Version,
+	}
+}
+
+// ClientByID returns the loaded client with the id.
+func (gateway *Gateway) ClientByID(id uint) (*Client, bool) {
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+	for _, client := range gateway.Clients {
+		if client.ID == id {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
+var countryCodeRegex = regexp.MustCompile(`^[1-9]\d{0,2}$`)
+
+// clientColumns are the columns of the clients table an update writes.
+var clientColumns = []string{
+	"tenant_id", "username", "name", "address", "log_privacy", "default_country_code",
+	"stop_reply", "start_reply", "help_reply", "international_policy", "allowed_countries", "auth",
+	// the profile, see client_profile.go
+	"profile_no_mms", "profile_no_ucs2", "profile_max_segments", "profile_receipts_on_request",
+	"profile_bind_types", "profile_no_group_messages", "profile_mms_fallback", "profile_media_link_ttl",
+	"profile_deliver_rate", "profile_deliver_burst", "profile_transliterate",
+	// see quiet_hours.go and monthly_quota.go
+	"quiet_start", "quiet_end", "quiet_action", "quiet_time_zone",
+	"quota_sms_soft", "quota_sms_hard", "quota_mms_soft", "quota_mms_hard", "quota_cycle_day", "quota_notify_email",
+}
+
+// UpdateClient replaces the settings and the tenant of a client, the password is changed
+// separately.
+func (gateway *Gateway) UpdateClient(id uint, update Client) (Client, error) {
+	if update.Username == "" {
+		return Client{}, Invalid("username is required")
+	}
+	if err := ValidateTenantID(update.TenantID); err != nil {
+		return Client{}, err
+	}
+	if current, ok := gateway.ClientByID(id); ok && current.TenantID != update.TenantID {
+		if err := gateway.CheckClientQuota(update.TenantID); err != nil {
+			return Client{}, err
+		}
+	}
+	if update.DefaultCountryCode != "" && !countryCodeRegex.MatchString(update.DefaultCountryCode) {
+		return Client{}, Invalid("default_country_code must be a calling code, e.g. 1")
+	}
+	if err := ValidateCountryPolicy(&update); err != nil {
+		return Client{}, err
+	}
+	if err := update.Profile.Validate(); err != nil {
+		return Client{}, err
+	}
+	if err := update.QuietHours.Validate(); err != nil {
+		return Client{}, err
+	}
+	if err := update.MonthlyQuota.Validate(); err != nil {
+		return Client{}, err
+	}
+	if err := ValidateClientAuth(update.Auth); err != nil {
+		return Client{}, err
+	}
+	gateway.Mu.RLock()
+	other, taken := gateway.Clients[update.Username]
+	gateway.Mu.RUnlock()
+	if taken && other.ID != id {
+		return Client{}, Invalid("username %s is already in use", update.Username)
+	}
+
+	encryptedUsername, err := gateway.encryptSecret(update.Username)
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to encrypt username: %w", err)
+	}
+	row := Client{
+		ID:                  id,
+		TenantID:            update.TenantID,
+		Username:            encryptedUsername,
+		Name:                update.Name,
+		Address:             update.Address,
+		LogPrivacy:          update.LogPrivacy,
+		DefaultCountryCode:  update.DefaultCountryCode,
+		StopReply:           update.StopReply,
+		StartReply:          update.StartReply,
+		HelpReply:           update.HelpReply,
+		InternationalPolicy: update.InternationalPolicy,
+		AllowedCountries:    update.AllowedCountries,
+		Profile:             update.Profile,
+		QuietHours:          update.QuietHours,
+		MonthlyQuota:        update.MonthlyQuota,
+		Auth:                update.Auth,
+		Version:             update.Version,
+	}
+	if err := UpdateVersioned(gateway.DB, &row, id, &row.Version, clientColumns...); err != nil {
+		return Client{}, err
+	}
+
+	if err := gateway.ProvisioningChanged(); err != nil {
+		return Client{}, err
+	}
+	client, ok := gateway.ClientByID(id)
+	if !ok {
+		return Client{}, ErrNotFound
+	}
+	return PublicClient(client), nil
+}
+
+// DeleteClient deletes a client with its numbers, auto-replies and dial plan.
+func (gateway *Gateway) DeleteClient(id uint, version uint) error {
+	err := gateway.DB.Transaction(func(tx *gorm.DB) error {
+		if err := DeleteVersioned(tx, &Client{}, id, version); err != nil {
+			return err
+		}
+		if err := tx.Where("client_id = ?", id).Delete(&ClientNumber{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("client_id = ?", id).Delete(&AutoReply{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("client_id = ?", id).Delete(&SourceRewrite{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("client_id = ?", id).Delete(&DialPlanRule{}).Error
+	})
+	if err != nil {
+		return err
+	}
+	return gateway.ProvisioningChanged()
+}
+
+// ValidateNumber checks the client, carrier and webhook of a number, that no other number has the
+// same normalized form, and the quota of the tenant the number is new to.
+func (gateway *Gateway) ValidateNumber(id uint, number *ClientNumber) error {
+	number.Number = NumberKey(number.Number)
+	if number.Number == "" {
+		return Invalid("number is required")
+	}
+	if !ValidNumberType(number.Type) {
+		return Invalid("type must be long, short_code or toll_free")
+	}
+	client, ok := gateway.ClientByID(number.ClientID)
+	if !ok {
+		return Invalid("client %d does not exist", number.ClientID)
+	}
+	added := id == 0
+	if !added {
+		var existing ClientNumber
+		if err := gateway.DB.First(&existing, id).Error; err == nil {
+			previous, _ := gateway.ClientByID(existing.ClientID)
+			added = ClientTenantID(previous) != client.TenantID
+		}
+	}
+	if err := gateway.checkTenantNumber(client, number.Carrier, added); err != nil {
+		return err
+	}
+	if number.WebHook != "" {
+		if u, err := url.Parse(number.WebHook); err != nil || u.Host == "" {
+			return Invalid("webhook must be an absolute URL")
+		}
+	}
+
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+	if _, ok := gateway.Carriers[number.Carrier]; !ok {
+		return Invalid("carrier %q does not exist", number.Carrier)
+	}
+	if existing, ok := gateway.Numbers[number.Number]; ok && existing.ID != id {
+		return Invalid("number %s already exists", number.Number)
+	}
+	return nil
+}
+
+// UpdateNumber replaces a number, moving it to another client when client_id changes.
+func (gateway *Gateway) UpdateNumber(id uint, number ClientNumber) (ClientNumber, error) {
+	number.ID = id
+	if err := gateway.ValidateNumber(id, &number); err != nil {
+		return ClientNumber{}, err
+	}
+	if err := UpdateVersioned(gateway.DB, &number, id, &number.Version,
+		"client_id", "number", "carrier", "web_hook", "type", "messaging_service_sid", "messaging_profile_id", "application_id", "campaign_id", "mms_fallback", "mqtt"); err != nil {
+		return ClientNumber{}, err
+	}
+	if err := gateway.ProvisioningChanged(); err != nil {
+		return ClientNumber{}, err
+	}
+	return number, nil
+}
+
+// DeleteNumber deletes a number, messages to it no longer reach its client.
+func (gateway *Gateway) DeleteNumber(id uint, version uint) error {
+	if err := DeleteVersioned(gateway.DB, &ClientNumber{}, id, version); err != nil {
+		return err
+	}
+	return gateway.ProvisioningChanged()
+}
+
+// ValidateCarrierConfig checks that a carrier config is empty or a JSON object.
+func ValidateCarrierConfig(config string) error {
+	if config == "" {
+		return nil
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal([]byte(config), &settings); err != nil {
+		return Invalid("config must be a JSON object")
+	}
+	return nil
+}
+
+// UpdateCarrier replaces the type, tenant, config and, when given, the credentials of a carrier.
+// The name can't change since numbers, rules and LCR entries refer to it.
+func (gateway *Gateway) UpdateCarrier(id uint, update Carrier) (Carrier, error) {
+	var existing Carrier
+	if err := gateway.DB.First(&existing, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return Carrier{}, ErrNotFound
+		}
+		return Carrier{}, err
+	}
+	if update.Name != "" && update.Name != existing.Name {
+		return Carrier{}, Invalid("a carrier can't be renamed, routes refer to it by name")
+	}
+	if !KnownCarrierType(update.Type) {
+		return Carrier{}, Invalid("unknown carrier type: %s", update.Type)
+	}
+	if err := ValidateCarrierConfig(update.Config); err != nil {
+		return Carrier{}, err
+	}
+	if err := ValidateTenantID(update.TenantID); err != nil {
+		return Carrier{}, err
+	}
+
+	row := Carrier{ID: id, Type: update.Type, TenantID: update.TenantID, Config: update.Config, Version: update.Version}
+	columns := []string{"type", "tenant_id", "config"}
+	if update.Username != "" {
+		encrypted, err := gateway.encryptSecret(update.Username)
+		if err != nil {
+			return Carrier{}, fmt.Errorf("failed to encrypt username: %w", err)
+		}
+		row.Username = encrypted
+		columns = append(columns, "username")
+	}
+	if update.Password != "" {
+		encrypted, err := gateway.encryptSecret(update.Password)
+		if err != nil {
+			return Carrier{}, fmt.Errorf("failed to encrypt password: %w", err)
+		}
+		row.Password = encrypted
+		columns = append(columns, "password")
+	}
+	if err := UpdateVersioned(gateway.DB, &row, id, &row.Version, columns...); err != nil {
+		return Carrier{}, err
+	}
+
+	if err := gateway.ReloadCarriers(); err != nil {
+		return Carrier{}, err
+	}
+	existing.Type, existing.TenantID, existing.Config, existing.Version = row.Type, row.TenantID, row.Config, row.Version
+	return PublicCarrier(existing), nil
+}
+
+// DeleteCarrier deletes a carrier no number, routing rule or LCR entry refers to.
+func (gateway *Gateway) DeleteCarrier(id uint, version uint) error {
+	var carrier Carrier
+	if err := gateway.DB.First(&carrier, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	references := []struct {
+		model interface{}
+		query string
+		name  string
+	}{
+		{&ClientNumber{}, "carrier = ?", "numbers"},
+		{&RoutingRule{}, "? IN (route, canary_route, mirror_route)", "routing rules"},
+		{&LCRRoute{}, "route = ?", "LCR routes"},
+	}
+	for _, ref := range references {
+		var count int64
+		if err := gateway.DB.Model(ref.model).Where(ref.query, carrier.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("%w: %d %s use carrier %s", errInUse, count, ref.name, carrier.Name)
+		}
+	}
+
+	if err := DeleteVersioned(gateway.DB, &Carrier{}, id, version); err != nil {
+		return err
+	}
+	return gateway.ReloadCarriers()
+}
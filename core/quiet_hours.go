@@ -0,0 +1,157 @@
+package core
+
+import (
+	"strings"
+	"time"
+)
+
+// QuietHours is a window of the recipient's local time in which the messages of a client aren't
+// sent to carriers, e.g. 21:00-08:00 for marketing senders bound by the TCPA. A client without quiet
+// hours uses those of its tenant.
+type QuietHours struct {
+	Start    string `json:"start"`     // "HH:MM" the quiet hours begin, the window may wrap past midnight
+	End      string `json:"end"`       // "HH:MM" they end
+	Action   string `json:"action"`    // see QuietActions, queue when empty
+	TimeZone string `json:"time_zone"` // IANA zone of recipients whose zone isn't told by their number, UTC when empty
+}
+
+// quietHoursColumns are the columns of the quiet hours in the clients and tenants tables.
+var quietHoursColumns = []string{"quiet_start", "quiet_end", "quiet_action", "quiet_time_zone"}
+
+// Actions on a message that would be sent in quiet hours.
+var QuietActions = struct {
+	Queue  string
+	Reject string
+}{
+	Queue:  "queue",  // scheduled for the end of the quiet hours
+	Reject: "reject", // rejected, the client gets a REJECTD receipt with a policy error
+}
+
+// Validate checks the window, action and time zone of the quiet hours.
+func (quiet *QuietHours) Validate() error {
+	if quiet.Start == "" && quiet.End == "" {
+		return nil
+	}
+	if _, err := parseClock(quiet.Start); err != nil {
+		return Invalid("quiet_hours.start must be HH:MM")
+	}
+	if _, err := parseClock(quiet.End); err != nil {
+		return Invalid("quiet_hours.end must be HH:MM")
+	}
+	switch quiet.Action {
+	case "", QuietActions.Queue, QuietActions.Reject:
+	default:
+		return Invalid("quiet_hours.action must be queue or reject")
+	}
+	if _, err := time.LoadLocation(quiet.TimeZone); err != nil {
+		return Invalid("quiet_hours.time_zone: %v", err)
+	}
+	return nil
+}
+
+// QuietHoursOf returns the quiet hours of the client, or of its tenant when it has none.
+func QuietHoursOf(client *Client) (QuietHours, bool) {
+	if client.QuietHours.Start != "" {
+		return client.QuietHours, true
+	}
+	if tenant, ok := tenantByID(client.TenantID); ok && tenant.QuietHours.Start != "" {
+		return tenant.QuietHours, true
+	}
+	return QuietHours{}, false
+}
+
+// QuietUntil returns when the quiet hours end that the recipient is in, false when it isn't in
+// them.
+func (quiet QuietHours) QuietUntil(to string, now time.Time) (time.Time, bool) {
+	start, err := parseClock(quiet.Start)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := parseClock(quiet.End)
+	if err != nil {
+		return time.Time{}, false
+	}
+	fallback, err := time.LoadLocation(quiet.TimeZone)
+	if err != nil {
+		fallback = time.UTC
+	}
+	local := now.In(recipientLocation(to, fallback))
+	if !inClockWindow(start, end, local) {
+		return time.Time{}, false
+	}
+	until := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, local.Location())
+	if !until.After(local) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return until, true
+}
+
+// recipientLocation is the time zone of a number: by area code for North American numbers, by
+// country for countries with one zone, and the fallback for the others.
+func recipientLocation(number string, fallback *time.Location) *time.Location {
+	digits := strings.TrimPrefix(number, "+")
+	zone := ""
+	if strings.HasPrefix(digits, "1") && len(digits) >= 4 {
+		zone = areaCodeZones[digits[1:4]]
+	} else {
+		zone = countryZones[CountryOf(number)]
+	}
+	if zone == "" {
+		return fallback
+	}
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return fallback
+	}
+	return location
+}
+
+// areaCodeZones maps North American area codes to the zone most of their numbers are in, area
+// codes spanning two zones take the larger one.
+var areaCodeZones = zoneTable(map[string]string{
+	"America/New_York": "201 202 203 207 212 215 216 220 223 226 227 229 231 234 239 240 248 249 252 260 263 267 269 272 276 289 301 302 " +
+		"304 305 313 315 317 321 326 330 332 336 339 343 347 351 352 354 365 367 380 382 386 401 404 407 410 412 413 416 418 419 423 " +
+		"434 437 438 440 443 445 448 450 463 468 470 475 478 484 502 508 513 514 516 517 518 519 540 548 551 561 567 570 571 574 579 581 " +
+		"582 585 586 603 606 607 609 610 613 614 616 617 631 640 645 646 647 656 667 678 679 680 681 683 689 703 704 705 706 716 717 " +
+		"718 724 727 728 732 734 740 742 743 753 754 757 762 765 770 771 772 774 781 786 802 803 804 807 810 812 813 814 819 826 828 835 " +
+		"838 839 843 845 848 854 856 857 859 860 862 863 864 865 873 878 904 905 906 908 910 912 914 917 919 929 930 934 937 941 943 947 " +
+		"948 954 959 973 978 980 984 989",
+	"America/Chicago": "204 205 210 214 217 218 219 224 225 228 251 254 256 262 270 274 281 308 309 312 314 316 318 319 320 325 331 334 337 " +
+		"346 361 364 402 405 409 414 417 430 431 432 447 464 469 479 501 504 507 512 515 531 534 539 557 563 572 573 580 584 601 605 608 612 615 " +
+		"618 620 629 630 636 641 651 659 660 662 682 701 708 712 713 715 726 731 737 763 769 773 779 785 806 815 816 817 830 832 847 850 " +
+		"870 872 901 903 913 918 920 931 936 938 940 945 952 956 972 975 979 985",
+	"America/Regina":      "306 474 639",
+	"America/Denver":      "303 307 368 385 403 406 435 505 575 587 719 720 780 801 825 915 970 983",
+	"America/Boise":       "208 986",
+	"America/Phoenix":     "480 520 602 623 928",
+	"America/Los_Angeles": "206 209 213 236 250 253 257 279 310 323 341 350 360 369 408 415 424 425 442 458 503 509 510 530 541 559 562 564 604 619 626 628 650 657 661 669 672 702 707 714 725 747 760 775 778 805 818 820 831 840 858 909 916 925 949 951 971",
+	"America/Anchorage":   "907",
+	"Pacific/Honolulu":    "808",
+	"America/Halifax":     "428 506 782 902",
+	"America/St_Johns":    "709",
+	"America/Puerto_Rico": "787 939",
+})
+
+// countryZones maps countries with a single time zone to it.
+var countryZones = map[string]string{
+	"GB": "Europe/London", "IE": "Europe/Dublin", "PT": "Europe/Lisbon", "ES": "Europe/Madrid", "FR": "Europe/Paris",
+	"BE": "Europe/Brussels", "NL": "Europe/Amsterdam", "LU": "Europe/Luxembourg", "DE": "Europe/Berlin", "CH": "Europe/Zurich",
+	"AT": "Europe/Vienna", "IT": "Europe/Rome", "DK": "Europe/Copenhagen", "NO": "Europe/Oslo", "SE": "Europe/Stockholm",
+	"FI": "Europe/Helsinki", "PL": "Europe/Warsaw", "CZ": "Europe/Prague", "SK": "Europe/Bratislava", "HU": "Europe/Budapest",
+	"GR": "Europe/Athens", "RO": "Europe/Bucharest", "BG": "Europe/Sofia", "IL": "Asia/Jerusalem", "AE": "Asia/Dubai",
+	"IN": "Asia/Kolkata", "PK": "Asia/Karachi", "PH": "Asia/Manila", "SG": "Asia/Singapore", "JP": "Asia/Tokyo",
+	"KR": "Asia/Seoul", "CN": "Asia/Shanghai", "HK": "Asia/Hong_Kong", "NZ": "Pacific/Auckland", "ZA": "Africa/Johannesburg",
+	"NG": "Africa/Lagos", "KE": "Africa/Nairobi", "EG": "Africa/Cairo", "CO": "America/Bogota", "PE": "America/Lima",
+	"AR": "America/Argentina/Buenos_Aires", "CL": "America/Santiago", "JM": "America/Jamaica", "DO": "America/Santo_Domingo",
+}
+
+// zoneTable inverts lists of area codes by zone.
+func zoneTable(lists map[string]string) map[string]string {
+	table := make(map[string]string)
+	for zone, list := range lists {
+		for _, code := range strings.Fields(list) {
+			table[code] = zone
+		}
+	}
+	return table
+}
@@ -0,0 +1,247 @@
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisClient is a minimal client of the Redis protocol (RESP2) for the commands the cache uses,
+// with a small pool of connections. A URL is redis://[user:password@]host:port/db, or rediss://
+// for TLS.
+type redisClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      bool
+	timeout  time.Duration
+	pool     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+var redisTimeout time.Duration
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		redisTimeout = cfg.Duration("CACHE_REDIS_TIMEOUT", time.Second)
+	})
+}
+
+func newRedisClient(rawURL string, poolSize int) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("redis URL must start with redis:// or rediss://")
+	}
+	client := &redisClient{
+		addr:    u.Host,
+		tls:     u.Scheme == "rediss",
+		timeout: redisTimeout,
+		pool:    make(chan *redisConn, poolSize),
+	}
+	if u.Port() == "" {
+		client.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		client.password, _ = u.User.Password()
+		client.username = u.User.Username()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if client.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis URL: invalid database %q", db)
+		}
+	}
+	return client, nil
+}
+
+// dial opens a connection, authenticated and on the database of the URL.
+func (client *redisClient) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: client.timeout}
+	var conn net.Conn
+	var err error
+	if client.tls {
+		host, _, _ := net.SplitHostPort(client.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", client.addr, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", client.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	var setup [][]string
+	switch {
+	case client.username != "" && client.password != "":
+		setup = append(setup, []string{"AUTH", client.username, client.password})
+	case client.password != "":
+		setup = append(setup, []string{"AUTH", client.password})
+	case client.username != "":
+		setup = append(setup, []string{"AUTH", client.username})
+	}
+	if client.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(client.db)})
+	}
+	for _, args := range setup {
+		if _, err := rc.do(client.timeout, args...); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs a command on a pooled connection. A connection that failed is closed rather than
+// returned to the pool, an error reply leaves it usable.
+func (client *redisClient) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-client.pool:
+	default:
+		var err error
+		if rc, err = client.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(client.timeout, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		_ = rc.conn.Close()
+		return nil, err
+	}
+	select {
+	case client.pool <- rc:
+	default:
+		_ = rc.conn.Close()
+	}
+	return reply, err
+}
+
+func (rc *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := rc.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if err := rc.write(args...); err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+// write sends a command as an array of bulk strings.
+func (rc *redisConn) write(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(rc.conn, b.String())
+	return err
+}
+
+// read reads a reply: a string, an int64, nil for a null reply, or a []interface{} of replies.
+func (rc *redisConn) read() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = rc.read(); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+				items[i] = err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// subscribe calls handle with every message published on the channel until the client is
+// closed, it reconnects after a failure.
+func (client *redisClient) subscribe(channel string, handle func(payload string), failed func(err error)) {
+	for {
+		rc, err := client.dial()
+		if err == nil {
+			err = rc.listen(channel, handle)
+			_ = rc.conn.Close()
+		}
+		failed(err)
+		time.Sleep(ReInitDelay)
+	}
+}
+
+// listen subscribes the connection to the channel and reads its messages.
+func (rc *redisConn) listen(channel string, handle func(payload string)) error {
+	if err := rc.conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if err := rc.write("SUBSCRIBE", channel); err != nil {
+		return err
+	}
+	for {
+		reply, err := rc.read()
+		if err != nil {
+			return err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 {
+			continue
+		}
+		if kind, _ := items[0].(string); kind == "message" {
+			payload, _ := items[2].(string)
+			handle(payload)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	redisQueuePrefix    string
+	redisQueueTimeout   time.Duration
+	redisQueueClaimIdle time.Duration
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		redisQueuePrefix = cfg.String("QUEUE_REDIS_PREFIX", "gateway:queue:")
+		redisQueueTimeout = cfg.Duration("QUEUE_REDIS_TIMEOUT", 5*time.Second)
+		redisQueueClaimIdle = cfg.Duration("QUEUE_REDIS_CLAIM_IDLE", 5*time.Minute)
+	})
+}
+
+const (
+	redisQueueGroup   = "gateway"       // consumer group of the instances on every stream
+	redisQueueBlock   = 5 * time.Second // how long a read waits for new entries
+	redisQueueDelayed = "delayed"       // sorted set of the delayed messages, by the time they are due
+)
+
+// redisQueueMove moves the delayed messages that are due to their streams. A member is
+// "id\nqueue\nheaders\nbody", the id keeps equal messages apart.
+const redisQueueMove = `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, member in ipairs(due) do
+  local a = string.find(member, '\n', 1, true)
+  local b = string.find(member, '\n', a + 1, true)
+  local c = string.find(member, '\n', b + 1, true)
+  local key = ARGV[2] .. string.sub(member, a + 1, b - 1)
+  local headers = string.sub(member, b + 1, c - 1)
+  if headers == '' then
+    redis.call('XADD', key, '*', 'body', string.sub(member, c + 1))
+  else
+    redis.call('XADD', key, '*', 'body', string.sub(member, c + 1), 'headers', headers)
+  end
+  redis.call('ZREM', KEYS[1], member)
+end
+return #due`
+
+// RedisQueue is a MessageQueue on Redis Streams, a stream per queue read by the instances through
+// one consumer group. An entry is acked and deleted once handled. The entries an instance read
+// and didn't ack are read again when it restarts, and claimed by another instance once idle for
+// QUEUE_REDIS_CLAIM_IDLE. Delayed messages wait in a sorted set until they are due. Rejected
+// messages are moved to the dead letter queue like the gateway-dlx policy does in RabbitMQ.
+type RedisQueue struct {
+	client   *redisClient
+	prefix   string
+	consumer string // name of this instance in the consumer groups
+	logger   *log.Entry
+
+	mu     sync.Mutex
+	ready  bool // the last PING was answered
+	closed bool
+	done   chan struct{}
+}
+
+// NewRedisQueue creates the queue on the Redis of the URL, consumer names this instance.
+func NewRedisQueue(url string, prefix string, consumer string) (*RedisQueue, error) {
+	client, err := newRedisClient(url, 8)
+	if err != nil {
+		return nil, err
+	}
+	client.timeout = redisQueueTimeout
+
+	logger := log.New()
+	logger.SetFormatter(logFormatter())
+	logger.SetLevel(log.InfoLevel)
+
+	queue := &RedisQueue{
+		client:   client,
+		prefix:   prefix,
+		consumer: consumer,
+		logger:   logger.WithField("subsystem", "redis"),
+		done:     make(chan struct{}),
+	}
+	go queue.monitor()
+	go queue.moveDelayed()
+	return queue, nil
+}
+
+// monitor pings Redis to keep Ready current.
+func (queue *RedisQueue) monitor() {
+	ticker := time.NewTicker(ReInitDelay)
+	defer ticker.Stop()
+	for {
+		_, err := queue.client.do("PING")
+		queue.mu.Lock()
+		if (err == nil) != queue.ready {
+			queue.logger.Printf("Ready: %t %v", err == nil, err)
+		}
+		queue.ready = err == nil
+		queue.mu.Unlock()
+
+		select {
+		case <-queue.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// moveDelayed moves the delayed messages to their streams once they are due, every instance does
+// and the script keeps a message from being moved twice.
+func (queue *RedisQueue) moveDelayed() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-queue.done:
+			return
+		case <-ticker.C:
+		}
+		for {
+			moved, err := queue.client.do("EVAL", redisQueueMove, "1", queue.prefix+redisQueueDelayed,
+				strconv.FormatInt(time.Now().UnixMilli(), 10), queue.prefix)
+			if err != nil {
+				queue.logger.Printf("Failed to move delayed messages: %v", err)
+			}
+			if count, _ := moved.(int64); count < 100 {
+				break
+			}
+		}
+	}
+}
+
+func (queue *RedisQueue) Publish(ctx context.Context, queueName string, data []byte) error {
+	return queue.PublishWithHeaders(ctx, queueName, data, nil)
+}
+
+func (queue *RedisQueue) PublishWithHeaders(ctx context.Context, queueName string, data []byte, headers map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	encoded, err := redisQueueHeaders(headers)
+	if err != nil {
+		return err
+	}
+	return queue.add(queueName, data, encoded)
+}
+
+func (queue *RedisQueue) PublishDelayed(ctx context.Context, queueName string, data []byte, headers map[string]interface{}, delay time.Duration) error {
+	if delay <= 0 {
+		return queue.PublishWithHeaders(ctx, queueName, data, headers)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	encoded, err := redisQueueHeaders(headers)
+	if err != nil {
+		return err
+	}
+	member := uuid.NewString() + "\n" + queueName + "\n" + encoded + "\n" + string(data)
+	due := strconv.FormatInt(time.Now().Add(delay).UnixMilli(), 10)
+	_, err = queue.client.do("ZADD", queue.prefix+redisQueueDelayed, due, member)
+	return err
+}
+
+// redisQueueHeaders encodes the headers of a message as JSON, empty without headers.
+func redisQueueHeaders(headers map[string]interface{}) (string, error) {
+	if len(headers) == 0 {
+		return "", nil
+	}
+	encoded, err := json.Marshal(headers)
+	return string(encoded), err
+}
+
+// add appends a message to the stream of a queue.
+func (queue *RedisQueue) add(queueName string, data []byte, headers string) error {
+	args := []string{"XADD", queue.prefix + queueName, "*", "body", string(data)}
+	if headers != "" {
+		args = append(args, "headers", headers)
+	}
+	_, err := queue.client.do(args...)
+	return err
+}
+
+// Consume reads the stream of a queue, one entry at a time like the AMQP consumers with a
+// prefetch of 1. It reads its own entries left unacked first, then claims idle ones of other
+// instances before it waits for new ones.
+func (queue *RedisQueue) Consume(queueName string) <-chan QueueDelivery {
+	out := make(chan QueueDelivery)
+
+	go func() {
+		defer close(out)
+		for {
+			err := queue.consume(queueName, out)
+			select {
+			case <-queue.done:
+				return
+			default:
+			}
+			queue.logger.Printf("Consumer of %s stopped: %v. Retrying...", queueName, err)
+			select {
+			case <-queue.done:
+				return
+			case <-time.After(ReInitDelay):
+			}
+		}
+	}()
+	return out
+}
+
+// consume hands the entries of a queue to out on a connection of its own, the reads block.
+func (queue *RedisQueue) consume(queueName string, out chan<- QueueDelivery) error {
+	key := queue.prefix + queueName
+	rc, err := queue.client.dial()
+	if err != nil {
+		return err
+	}
+	defer rc.conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-queue.done:
+			// ends a blocked read
+			_ = rc.conn.Close()
+		case <-stop:
+		}
+	}()
+
+	_, err = rc.do(queue.client.timeout, "XGROUP", "CREATE", key, redisQueueGroup, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "redis: BUSYGROUP") {
+		return err
+	}
+
+	pending := "0" // the last entry left unacked that was read again, "" once there are none
+	for {
+		var entries []redisStreamEntry
+		switch {
+		case pending != "":
+			// entries read before a restart and never acked
+			reply, err := rc.do(queue.client.timeout, "XREADGROUP", "GROUP", redisQueueGroup, queue.consumer, "COUNT", "1", "STREAMS", key, pending)
+			if err != nil {
+				return err
+			}
+			entries = redisStreamEntries(reply)
+			pending = ""
+			if len(entries) > 0 {
+				pending = entries[len(entries)-1].id
+			}
+		default:
+			reply, err := rc.do(queue.client.timeout, "XAUTOCLAIM", key, redisQueueGroup, queue.consumer,
+				strconv.FormatInt(redisQueueClaimIdle.Milliseconds(), 10), "0-0", "COUNT", "1")
+			if err != nil {
+				return err
+			}
+			if items, ok := reply.([]interface{}); ok && len(items) > 1 {
+				entries = redisEntryList(items[1])
+			}
+			if len(entries) > 0 {
+				break
+			}
+			reply, err = rc.do(redisQueueBlock+queue.client.timeout, "XREADGROUP", "GROUP", redisQueueGroup, queue.consumer,
+				"COUNT", "1", "BLOCK", strconv.FormatInt(redisQueueBlock.Milliseconds(), 10), "STREAMS", key, ">")
+			if err != nil {
+				return err
+			}
+			entries = redisStreamEntries(reply)
+		}
+
+		for _, entry := range entries {
+			if entry.fields == nil {
+				// deleted while it was pending
+				_ = queue.ack(key, entry.id)
+				continue
+			}
+			select {
+			case out <- queue.delivery(queueName, entry):
+			case <-queue.done:
+				// read again when the instance restarts, or claimed by another one
+				return nil
+			}
+		}
+	}
+}
+
+// redisStreamEntry is an entry of a stream, fields is nil for an entry deleted since it was read.
+type redisStreamEntry struct {
+	id     string
+	fields map[string]string
+}
+
+// redisStreamEntries returns the entries of an XREADGROUP reply of a single stream, none when the
+// read timed out.
+func redisStreamEntries(reply interface{}) []redisStreamEntry {
+	streams, _ := reply.([]interface{})
+	if len(streams) == 0 {
+		return nil
+	}
+	stream, _ := streams[0].([]interface{})
+	if len(stream) < 2 {
+		return nil
+	}
+	return redisEntryList(stream[1])
+}
+
+// redisEntryList reads a list of [id, [field, value, ...]] entries.
+func redisEntryList(reply interface{}) []redisStreamEntry {
+	items, _ := reply.([]interface{})
+	entries := make([]redisStreamEntry, 0, len(items))
+	for _, item := range items {
+		pair, _ := item.([]interface{})
+		if len(pair) < 2 {
+			continue
+		}
+		id, _ := pair[0].(string)
+		entry := redisStreamEntry{id: id}
+		if values, ok := pair[1].([]interface{}); ok {
+			entry.fields = make(map[string]string, len(values)/2)
+			for i := 0; i+1 < len(values); i += 2 {
+				field, _ := values[i].(string)
+				entry.fields[field], _ = values[i+1].(string)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// delivery wraps an entry, a rejected one is moved to the dead letter queue.
+func (queue *RedisQueue) delivery(queueName string, entry redisStreamEntry) QueueDelivery {
+	key := queue.prefix + queueName
+	body := []byte(entry.fields["body"])
+	var headers map[string]interface{}
+	if encoded := entry.fields["headers"]; encoded != "" {
+		_ = json.Unmarshal([]byte(encoded), &headers)
+	}
+	return QueueDelivery{
+		Queue:   queueName,
+		Body:    body,
+		Headers: headers,
+		ack: func() error {
+			return queue.ack(key, entry.id)
+		},
+		nack: func(requeue bool) error {
+			var err error
+			switch {
+			case requeue:
+				err = queue.add(queueName, body, entry.fields["headers"])
+			case queueName != DeadLetterQueue:
+				err = queue.PublishWithHeaders(context.Background(), DeadLetterQueue, body, map[string]interface{}{
+					"x-origin-queue":       queueName,
+					"x-dead-letter-reason": "rejected",
+				})
+			}
+			if err != nil {
+				// left pending, read again or claimed rather than lost
+				return err
+			}
+			return queue.ack(key, entry.id)
+		},
+	}
+}
+
+// ack acks an entry and deletes it, the group is the only reader of the stream.
+func (queue *RedisQueue) ack(key string, id string) error {
+	if _, err := queue.client.do("XACK", key, redisQueueGroup, id); err != nil {
+		return err
+	}
+	_, err := queue.client.do("XDEL", key, id)
+	return err
+}
+
+func (queue *RedisQueue) Ready() bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.ready && !queue.closed
+}
+
+func (queue *RedisQueue) Accepting() bool {
+	return queue.Ready()
+}
+
+func (queue *RedisQueue) Close() error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.closed {
+		return errors.New("redis queue already closed")
+	}
+	queue.closed = true
+	close(queue.done)
+	return nil
+}
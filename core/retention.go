@@ -0,0 +1,266 @@
+package core
+
+import (
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+var (
+	retentionInterval      time.Duration
+	messageBodyRetention   time.Duration // zero keeps the bodies forever
+	messageRecordRetention time.Duration // zero keeps the records forever
+	mediaRetention         time.Duration
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		retentionInterval = cfg.Duration("RETENTION_INTERVAL", time.Hour)
+		messageBodyRetention = cfg.Duration("MESSAGE_BODY_RETENTION", 0)
+		messageRecordRetention = cfg.Duration("MESSAGE_RECORD_RETENTION", 0)
+		mediaRetention = cfg.Duration("MEDIA_RETENTION", 7*24*time.Hour)
+	})
+}
+
+// retentionClass is a class of stored data, how long it is kept and how it is purged.
+type retentionClass struct {
+	name    string
+	setting string
+	period  time.Duration // zero keeps the data forever
+	purge   func(db *gorm.DB, before time.Time) (int64, error)
+}
+
+// RetentionStatus is a data class with its retention and the outcome of its last purge on this
+// instance.
+type RetentionStatus struct {
+	Class   string     `json:"class"`
+	Setting string     `json:"setting"`
+	Period  string     `json:"period"` // 0 keeps the data forever
+	LastRun *time.Time `json:"last_run,omitempty"`
+	Purged  int64      `json:"purged"` // rows purged or blanked by the last run
+	Error   string     `json:"error,omitempty"`
+}
+
+var retentionRuns = struct {
+	mu   sync.RWMutex
+	runs map[string]RetentionStatus
+}{runs: make(map[string]RetentionStatus)}
+
+// retentionClasses are the data classes in the order they are purged.
+func retentionClasses() []retentionClass {
+	return []retentionClass{
+		{name: "message_bodies", setting: "MESSAGE_BODY_RETENTION", period: messageBodyRetention, purge: purgeMessageBodies},
+		{name: "media", setting: "MEDIA_RETENTION", period: mediaRetention, purge: func(db *gorm.DB, before time.Time) (int64, error) {
+			result := db.Where("expires_at < ? OR upload_at < ?", time.Now(), before).Delete(&MediaFile{})
+			return result.RowsAffected, result.Error
+		}},
+		{name: "envelopes", setting: "MESSAGE_RETENTION", period: envelopeRetention, purge: purgeBefore(&MessageEnvelope{}, "received_at")},
+		{name: "message_records", setting: "MESSAGE_RECORD_RETENTION", period: messageRecordRetention, purge: purgeBefore(&MsgRecordDBItem{}, "received_timestamp")},
+		{name: "cdrs", setting: "CDR_RETENTION", period: cdrRetention, purge: purgeBefore(&CDR{}, "created_at")},
+		{name: "routing_decisions", setting: "ROUTING_AUDIT_RETENTION", period: routingAuditRetention, purge: purgeBefore(&RoutingDecision{}, "created_at")},
+		{name: "audit", setting: "AUDIT_RETENTION", period: auditRetention, purge: purgeBefore(&AuditEntry{}, "created_at")},
+		{name: "source_masks", setting: "SOURCE_MASK_RETENTION", period: SourceMaskRetention, purge: purgeBefore(&SourceMask{}, "updated_at")},
+	}
+}
+
+// purgeBefore deletes the rows of a model older than the cutoff by a time column.
+func purgeBefore(model interface{}, column string) func(db *gorm.DB, before time.Time) (int64, error) {
+	return func(db *gorm.DB, before time.Time) (int64, error) {
+		result := db.Where(column+" < ?", before).Delete(model)
+		return result.RowsAffected, result.Error
+	}
+}
+
+// purgeMessageBodies blanks the content of older envelopes and message records, their metadata
+// stays for its own retention. Dead letters and reviewed quarantined messages are the message
+// itself and are deleted, held ones still wait for a review.
+func purgeMessageBodies(db *gorm.DB, before time.Time) (int64, error) {
+	var purged int64
+	steps := []*gorm.DB{
+		db.Model(&MessageEnvelope{}).Where("received_at < ? AND content <> ''", before).Update("content", ""),
+		db.Model(&MsgRecordDBItem{}).Where("received_timestamp < ? AND msg_data <> ''", before).Update("msg_data", ""),
+		db.Where("created_at < ?", before).Delete(&DeadLetter{}),
+		db.Where("created_at < ? AND status <> ?", before, QuarantineStatuses.Held).Delete(&QuarantinedMessage{}),
+	}
+	for _, step := range steps {
+		if step.Error != nil {
+			return purged, step.Error
+		}
+		purged += step.RowsAffected
+	}
+	return purged, nil
+}
+
+// RetentionPurger purges every data class past its retention every RETENTION_INTERVAL.
+func (gateway *Gateway) RetentionPurger() {
+	var lm = gateway.LogManager
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, class := range retentionClasses() {
+			if class.period == 0 {
+				continue
+			}
+			now := time.Now()
+			purged, err := class.purge(gateway.DB, now.Add(-class.period))
+			status := RetentionStatus{Class: class.name, LastRun: &now, Purged: purged}
+			if err != nil {
+				status.Error = err.Error()
+				lm.SendLog(lm.BuildLog(
+					"System.Retention",
+					"GenericError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"class": class.name,
+					}, err,
+				))
+			}
+			retentionRuns.mu.Lock()
+			retentionRuns.runs[class.name] = status
+			retentionRuns.mu.Unlock()
+		}
+	}
+}
+
+// retentionStatuses is every data class with its last purge.
+func retentionStatuses() []RetentionStatus {
+	retentionRuns.mu.RLock()
+	defer retentionRuns.mu.RUnlock()
+
+	var statuses []RetentionStatus
+	for _, class := range retentionClasses() {
+		status := retentionRuns.runs[class.name]
+		status.Class, status.Setting, status.Period = class.name, class.setting, class.period.String()
+		if class.period == 0 {
+			status.Period = "0"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// NumberErasure is what an erasure of a number deleted, rows per table.
+type NumberErasure struct {
+	Number string           `json:"number"`
+	Erased map[string]int64 `json:"erased"`
+}
+
+// eraseNumber deletes every message, record and file sent from or to a number, e.g. for a deletion
+// request of its owner. Provisioning, opt-outs and the audit log are kept, an opt-out has to
+// survive the erasure so the number isn't messaged again.
+func (gateway *Gateway) eraseNumber(number string) (*NumberErasure, error) {
+	variants := numberVariants(number)
+	erasure := &NumberErasure{Number: number, Erased: make(map[string]int64)}
+
+	err := gateway.DB.Transaction(func(tx *gorm.DB) error {
+		// the media files are found by the messages they were sent with
+		var logIDs []string
+		for _, model := range []interface{}{&MessageEnvelope{}, &CDR{}, &MsgRecordDBItem{}} {
+			var ids []string
+			if err := tx.Model(model).Where("\"from\" IN ? OR \"to\" IN ?", variants, variants).Distinct().Pluck("log_id", &ids).Error; err != nil {
+				return err
+			}
+			logIDs = append(logIDs, ids...)
+		}
+		for start := 0; start < len(logIDs); start += 1000 {
+			result := tx.Where("log_id IN ?", logIDs[start:min(start+1000, len(logIDs))]).Delete(&MediaFile{})
+			if result.Error != nil {
+				return result.Error
+			}
+			erasure.Erased["media"] += result.RowsAffected
+		}
+
+		tables := []struct {
+			name  string
+			model interface{}
+		}{
+			{"envelopes", &MessageEnvelope{}},
+			{"message_records", &MsgRecordDBItem{}},
+			{"cdrs", &CDR{}},
+			{"dead_letters", &DeadLetter{}},
+			{"quarantined", &QuarantinedMessage{}},
+			{"scheduled", &ScheduledMessage{}},
+			{"held", &HeldMessage{}},
+			{"carrier_messages", &CarrierMessage{}},
+		}
+		for _, table := range tables {
+			result := tx.Where("\"from\" IN ? OR \"to\" IN ?", variants, variants).Delete(table.model)
+			if result.Error != nil {
+				return result.Error
+			}
+			erasure.Erased[table.name] = result.RowsAffected
+		}
+
+		result := tx.Where("\"from\" IN ? OR \"to\" IN ? OR rewritten_from IN ? OR rewritten_to IN ?", variants, variants, variants, variants).
+			Delete(&RoutingDecision{})
+		if result.Error != nil {
+			return result.Error
+		}
+		erasure.Erased["routing_decisions"] = result.RowsAffected
+
+		// event payloads carry the number as JSON strings
+		deliveries := tx.Where("payload LIKE ?", `%"`+variants[0]+`"%`)
+		for _, variant := range variants[1:] {
+			deliveries = deliveries.Or("payload LIKE ?", `%"`+variant+`"%`)
+		}
+		result = deliveries.Delete(&EventDelivery{})
+		if result.Error != nil {
+			return result.Error
+		}
+		erasure.Erased["event_deliveries"] = result.RowsAffected
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var lm = gateway.LogManager
+	fields := map[string]interface{}{"number": number}
+	for table, count := range erasure.Erased {
+		fields[table] = count
+	}
+	lm.SendLog(lm.BuildLog(
+		"System.Retention",
+		"NumberErased",
+		logrus.InfoLevel,
+		fields,
+	))
+	return erasure, nil
+}
+
+// SetupRetentionRoutes sets up the retention overview and the erasure of a number.
+func SetupRetentionRoutes(app *iris.Application, gateway *Gateway) {
+	retention := app.Party("/retention", gateway.BasicAuthMiddleware)
+	{
+		// List the data classes with their retention and last purge
+		retention.Get("/", func(ctx iris.Context) {
+			ctx.JSON(retentionStatuses())
+		})
+
+		// Erase every message, record and file of a number
+		retention.Post("/erase", func(ctx iris.Context) {
+			var request struct {
+				Number string `json:"number"`
+			}
+			if err := ctx.ReadJSON(&request); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid erase request"))
+				return
+			}
+			number, err := FormatToE164(request.Number)
+			if err != nil || number == "" {
+				WriteProvisioningError(ctx, Invalid("a valid number is required"))
+				return
+			}
+			erasure, err := gateway.eraseNumber(number)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(erasure)
+		})
+	}
+}
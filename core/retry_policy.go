@@ -0,0 +1,250 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// AttemptsHeader carries the attempt count of a MsgQueueItem on the AMQP message.
+const AttemptsHeader = "x-attempts"
+
+type RetryClass string
+
+// RetryClasses groups router failures so each kind can retry on its own schedule.
+var RetryClasses = struct {
+	Default         RetryClass
+	ClientOffline   RetryClass // destination client has no SMPP session or MM4 server reachable
+	ClientSend      RetryClass // delivering to a connected client failed
+	CarrierSend     RetryClass // the carrier API rejected or failed the send
+	CarrierRejected RetryClass // the carrier rejected the message permanently, not retried by default
+
+	// failures classified by the error taxonomy, see ErrorClasses
+	InvalidDestination RetryClass
+	OptOut             RetryClass
+	SpamBlock          RetryClass
+	Congestion         RetryClass
+	AuthFailure        RetryClass
+}{
+	Default:            "default",
+	ClientOffline:      "client_offline",
+	ClientSend:         "client_send",
+	CarrierSend:        "carrier_send",
+	CarrierRejected:    "carrier_rejected",
+	InvalidDestination: ErrorClasses.InvalidDestination.RetryClass(),
+	OptOut:             ErrorClasses.OptOut.RetryClass(),
+	SpamBlock:          ErrorClasses.SpamBlock.RetryClass(),
+	Congestion:         ErrorClasses.Congestion.RetryClass(),
+	AuthFailure:        ErrorClasses.AuthFailure.RetryClass(),
+}
+
+// ErrPermanentFailure marks carrier errors that fail the same way on every attempt, such as an
+// invalid destination or bad credentials.
+var ErrPermanentFailure = errors.New("permanent failure")
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() []error { return []error{e.err, ErrPermanentFailure} }
+
+// PermanentFailure wraps a carrier error so the router dead-letters the message under the
+// carrier_rejected class instead of retrying it.
+func PermanentFailure(err error) error {
+	return &permanentError{err: err}
+}
+
+// CarrierRetryClass returns the retry class for a failed carrier send, the error class when the
+// carrier error was classified.
+func CarrierRetryClass(err error) RetryClass {
+	if class := ErrorClassOf(err); class != ErrorClasses.Unknown {
+		return class.RetryClass()
+	}
+	if errors.Is(err, ErrPermanentFailure) {
+		return RetryClasses.CarrierRejected
+	}
+	return RetryClasses.CarrierSend
+}
+
+// RetryPolicy describes how often and how quickly a failed message is retried before it is
+// dead-lettered.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	Jitter       float64 // fraction of the delay to randomize, 0.2 = +/-20%
+	MaxDelay     time.Duration
+	MaxAttempts  int
+	Overrides    map[RetryClass]RetryPolicy
+}
+
+// retryPolicyOverride is the JSON form of a per-class override in RETRY_CLASS_OVERRIDES,
+// unset fields inherit the default policy.
+type retryPolicyOverride struct {
+	InitialDelay string   `json:"initial_delay"`
+	Multiplier   *float64 `json:"multiplier"`
+	Jitter       *float64 `json:"jitter"`
+	MaxDelay     string   `json:"max_delay"`
+	MaxAttempts  *int     `json:"max_attempts"`
+}
+
+// DefaultRetryPolicy retries for a little over an hour before giving up.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialDelay: 5 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.2,
+		MaxDelay:     10 * time.Minute,
+		MaxAttempts:  DefaultMaxAttempts,
+		Overrides:    make(map[RetryClass]RetryPolicy),
+	}
+}
+
+// LoadRetryPolicy builds the retry policy from the RETRY_* environment variables.
+func LoadRetryPolicy() (RetryPolicy, error) {
+	policy := DefaultRetryPolicy()
+
+	var err error
+	if v := Getenv("RETRY_INITIAL_DELAY"); v != "" {
+		if policy.InitialDelay, err = time.ParseDuration(v); err != nil {
+			return policy, fmt.Errorf("invalid RETRY_INITIAL_DELAY: %w", err)
+		}
+	}
+	if v := Getenv("RETRY_MULTIPLIER"); v != "" {
+		if policy.Multiplier, err = strconv.ParseFloat(v, 64); err != nil {
+			return policy, fmt.Errorf("invalid RETRY_MULTIPLIER: %w", err)
+		}
+	}
+	if v := Getenv("RETRY_JITTER"); v != "" {
+		if policy.Jitter, err = strconv.ParseFloat(v, 64); err != nil {
+			return policy, fmt.Errorf("invalid RETRY_JITTER: %w", err)
+		}
+	}
+	if v := Getenv("RETRY_MAX_DELAY"); v != "" {
+		if policy.MaxDelay, err = time.ParseDuration(v); err != nil {
+			return policy, fmt.Errorf("invalid RETRY_MAX_DELAY: %w", err)
+		}
+	}
+
+	// DEAD_LETTER_MAX_ATTEMPTS predates the retry policy and is still honoured
+	maxAttempts := Getenv("RETRY_MAX_ATTEMPTS")
+	if maxAttempts == "" {
+		maxAttempts = Getenv("DEAD_LETTER_MAX_ATTEMPTS")
+	}
+	if maxAttempts != "" {
+		if policy.MaxAttempts, err = strconv.Atoi(maxAttempts); err != nil {
+			return policy, fmt.Errorf("invalid RETRY_MAX_ATTEMPTS: %w", err)
+		}
+	}
+
+	// permanent carrier rejections are dead-lettered on the first attempt unless overridden
+	rejected := policy
+	rejected.Overrides = nil
+	rejected.MaxAttempts = 1
+	for _, class := range []RetryClass{RetryClasses.CarrierRejected, RetryClasses.InvalidDestination, RetryClasses.OptOut, RetryClasses.SpamBlock} {
+		policy.Overrides[class] = rejected
+	}
+
+	// congestion backs off for longer before the first retry
+	congestion := policy
+	congestion.Overrides = nil
+	congestion.InitialDelay = max(policy.InitialDelay, 30*time.Second)
+	congestion.MaxDelay = max(policy.MaxDelay, congestion.InitialDelay)
+	policy.Overrides[RetryClasses.Congestion] = congestion
+
+	if v := Getenv("RETRY_CLASS_OVERRIDES"); v != "" {
+		var overrides map[RetryClass]retryPolicyOverride
+		if err := json.Unmarshal([]byte(v), &overrides); err != nil {
+			return policy, fmt.Errorf("invalid RETRY_CLASS_OVERRIDES: %w", err)
+		}
+		for class, override := range overrides {
+			classPolicy, err := override.apply(policy)
+			if err != nil {
+				return policy, fmt.Errorf("invalid RETRY_CLASS_OVERRIDES for %s: %w", class, err)
+			}
+			policy.Overrides[class] = classPolicy
+		}
+	}
+
+	return policy, nil
+}
+
+func (o retryPolicyOverride) apply(base RetryPolicy) (RetryPolicy, error) {
+	policy := base
+	policy.Overrides = nil
+
+	var err error
+	if o.InitialDelay != "" {
+		if policy.InitialDelay, err = time.ParseDuration(o.InitialDelay); err != nil {
+			return policy, err
+		}
+	}
+	if o.MaxDelay != "" {
+		if policy.MaxDelay, err = time.ParseDuration(o.MaxDelay); err != nil {
+			return policy, err
+		}
+	}
+	if o.Multiplier != nil {
+		policy.Multiplier = *o.Multiplier
+	}
+	if o.Jitter != nil {
+		policy.Jitter = *o.Jitter
+	}
+	if o.MaxAttempts != nil {
+		policy.MaxAttempts = *o.MaxAttempts
+	}
+	return policy, nil
+}
+
+// ForClass returns the policy used for a retry class.
+func (p RetryPolicy) ForClass(class RetryClass) RetryPolicy {
+	if override, ok := p.Overrides[class]; ok {
+		return override
+	}
+	return p
+}
+
+// ShouldRetry reports whether another attempt is allowed after the given number of attempts.
+func (p RetryPolicy) ShouldRetry(attempts int) bool {
+	return attempts < p.MaxAttempts
+}
+
+// Delay returns how long to wait before the next attempt, attempts being the number of
+// attempts made so far.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempts-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
+
+// AttemptsFromHeaders reads the attempt count carried in the headers of a delivery.
+func AttemptsFromHeaders(headers map[string]interface{}) int {
+	switch v := headers[AttemptsHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	case float64: // headers replayed from the outbox went through JSON
+		return int(v)
+	}
+	return 0
+}
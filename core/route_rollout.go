@@ -0,0 +1,45 @@
+package core
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// compileRollout checks the canary and mirror routes of the rule.
+func (rule *RoutingRule) compileRollout() error {
+	if rule.CanaryPercent < 0 || rule.CanaryPercent > 100 {
+		return fmt.Errorf("canary_percent must be between 0 and 100")
+	}
+	if rule.CanaryRoute != "" && rule.Route == "" {
+		return fmt.Errorf("canary_route needs a route for the other messages")
+	}
+	if rule.CanaryRoute != "" && rule.CanaryRoute == rule.Route {
+		return fmt.Errorf("canary_route must differ from route")
+	}
+	if rule.MirrorRoute != "" && (rule.MirrorRoute == rule.Route || rule.MirrorRoute == rule.CanaryRoute) {
+		return fmt.Errorf("mirror_route must differ from route and canary_route")
+	}
+	return nil
+}
+
+// Routes are the carrier routes the rule names.
+func (rule *RoutingRule) Routes() []string {
+	var routes []string
+	for _, route := range []string{rule.Route, rule.CanaryRoute, rule.MirrorRoute} {
+		if route != "" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// Canary reports whether the message goes to the canary route of the rule. The share is taken by
+// a hash of the destination, so the messages of a conversation stay on one route.
+func (rule *RoutingRule) Canary(msg *MsgQueueItem) bool {
+	if rule.CanaryRoute == "" || rule.CanaryPercent <= 0 {
+		return false
+	}
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%d:%s", rule.ID, msg.To)
+	return int(hash.Sum32()%100) < rule.CanaryPercent
+}
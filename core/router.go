@@ -0,0 +1,41 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+func FormatToE164(number string) (string, error) {
+	// Preserve the original number
+	originalNumber := number
+
+	// Remove any metadata like "/TYPE=PLMN"
+	number = strings.Split(number, "/")[0]
+
+	// Short codes have no country code to add
+	if code, ok := shortCode(number); ok {
+		return code, nil
+	}
+
+	// Regex to match a valid E.164 number
+	e164Regex := regexp.MustCompile(`^\+?[1-9]\d{1,14}$`)
+
+	// Remove any non-digit characters except the leading '+'
+	cleaned := strings.TrimLeft(number, "+")
+	cleaned = regexp.MustCompile(`\D`).ReplaceAllString(cleaned, "")
+
+	// Re-add the leading '+' if it was stripped
+	if strings.HasPrefix(number, "+") {
+		cleaned = "+" + cleaned
+	} else {
+		cleaned = "+" + cleaned // Add '+' if not already present
+	}
+
+	// Validate the cleaned number against E.164 format
+	if !e164Regex.MatchString(cleaned) {
+		return originalNumber, fmt.Errorf("unable to format to E.164: %s", originalNumber)
+	}
+
+	return cleaned, nil
+}
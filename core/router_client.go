@@ -0,0 +1,55 @@
+package core
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+)
+
+// UpdateClientPassword updates both the hashed database password and the in-memory password
+func (gateway *Gateway) UpdateClientPassword(clientID uint, newPassword string) error {
+	// First hash the new password
+	storedPassword, err := gateway.storedPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	password, err := gateway.clientPassword(storedPassword)
+	if err != nil {
+		return err
+	}
+
+	// Update the hashed password in the database
+	if err := gateway.DB.Model(&Client{}).Where("id = ?", clientID).Update("password", storedPassword).Error; err != nil {
+		return fmt.Errorf("failed to update password in database: %w", err)
+	}
+
+	// Update the decrypted password in memory
+	gateway.Mu.Lock()
+	defer gateway.Mu.Unlock()
+
+	// Find the client by ID in the in-memory map
+	var targetClient *Client
+	for _, client := range gateway.Clients {
+		if client.ID == clientID {
+			targetClient = client
+			break
+		}
+	}
+
+	if targetClient == nil {
+		return fmt.Errorf("client not found in memory")
+	}
+
+	// Update the in-memory password as authClient compares it
+	targetClient.Password = password
+
+	gateway.LogManager.SendLog(gateway.LogManager.BuildLog(
+		"Client.UpdatePassword",
+		fmt.Sprintf("Updated password for client %s", targetClient.Username),
+		logrus.InfoLevel,
+		map[string]interface{}{
+			"client_id": clientID,
+		},
+	))
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// RoutingDecision is the audit record of one routing decision, a message has one per router it
+// passes through (client, then carrier for outbound traffic).
+type RoutingDecision struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	LogID         string    `gorm:"index" json:"log_id"`
+	TraceID       string    `gorm:"index" json:"trace_id"`
+	ServerID      string    `json:"server_id"`
+	Queue         string    `json:"queue"` // router that decided, client or carrier
+	Type          string    `json:"type"`
+	From          string    `json:"from_number"` // addresses as received by the router
+	To            string    `json:"to_number"`
+	RewrittenFrom string    `json:"rewritten_from,omitempty"` // addresses after rule rewrites, if changed
+	RewrittenTo   string    `json:"rewritten_to,omitempty"`
+	RuleID        uint      `json:"rule_id,omitempty"`
+	RuleName      string    `json:"rule_name,omitempty"`
+	Source        string    `json:"source,omitempty"`     // where the routes came from: rule, lcr or number
+	Candidates    string    `json:"candidates,omitempty"` // comma separated routes in the order they were tried
+	Failures      string    `json:"failures,omitempty"`   // routes that failed and why, "; " separated
+	Route         string    `json:"route,omitempty"`      // where the message went
+	Outcome       string    `json:"outcome"`
+	Reason        string    `json:"reason,omitempty"`
+	CreatedAt     time.Time `gorm:"index" json:"created_at"`
+}
+
+// Routing decision outcomes.
+var RoutingOutcomes = struct {
+	Delivered   string
+	Queued      string
+	Retry       string
+	Held        string
+	Quarantined string
+	DeadLetter  string
+	Forwarded   string
+}{
+	Delivered:   "delivered",
+	Queued:      "queued",
+	Retry:       "retry",
+	Held:        "held",
+	Quarantined: "quarantined",
+	DeadLetter:  "dead_letter",
+	Forwarded:   "forwarded", // to the instance the client is bound to
+}
+
+var (
+	RoutingAuditEnabled   bool
+	routingAuditRetention time.Duration
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		RoutingAuditEnabled = cfg.Getenv("ROUTING_AUDIT") != "false"
+		routingAuditRetention = cfg.Duration("ROUTING_AUDIT_RETENTION", 7*24*time.Hour)
+	})
+}
+
+// RouteFailed records a route that was tried and failed.
+func (decision *RoutingDecision) RouteFailed(route string, err error) {
+	if decision == nil {
+		return
+	}
+	failure := fmt.Sprintf("%s: %v", route, err)
+	if decision.Failures == "" {
+		decision.Failures = failure
+	} else {
+		decision.Failures += "; " + failure
+	}
+}
@@ -0,0 +1,194 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RoutingRule is an ordered routing rule, the first enabled rule whose criteria all match an
+// outbound message decides its route. Empty criteria match anything.
+type RoutingRule struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	Name     string `json:"name"`
+	Position int    `gorm:"index" json:"position"` // rules are evaluated in ascending position
+	Disabled bool   `json:"disabled"`
+	TenantID uint   `gorm:"index" json:"tenant_id"` // rules of a tenant only match the messages of its clients
+
+	// Match criteria
+	ClientID     uint   `json:"client_id"`
+	MsgType      string `json:"type"` // "sms" or "mms"
+	SourcePrefix string `json:"source_prefix"`
+	SourceRegex  string `json:"source_regex"`
+	DestPrefix   string `json:"dest_prefix"`
+	DestRegex    string `json:"dest_regex"`
+	SourceType   string `json:"source_type"` // see NumberTypes
+	DestType     string `json:"dest_type"`
+	TimeStart    string `json:"time_start"` // "HH:MM", the window may wrap past midnight
+	TimeEnd      string `json:"time_end"`   // "HH:MM"
+	TimeZone     string `json:"time_zone"`  // IANA zone for the time window, defaults to UTC
+	MinLength    int    `json:"min_length"` // message length in characters
+	MaxLength    int    `json:"max_length"`
+
+	// Actions
+	Route         string `json:"route"`          // carrier route name
+	SourceRewrite string `json:"source_rewrite"` // regex applied to the source address
+	SourceReplace string `json:"source_replace"`
+	DestRewrite   string `json:"dest_rewrite"` // regex applied to the destination address
+	DestReplace   string `json:"dest_replace"`
+	Priority      int    `json:"priority"` // set on the message when non-zero
+	TTL           int    `json:"ttl"`      // seconds, replaces the message's expiry when non-zero
+
+	// Rollouts of a new route: CanaryPercent of the matching messages go to CanaryRoute and the
+	// others to Route, and MirrorRoute gets a copy of every matching message that was sent, its
+	// outcome never reaches the client. See route_rollout.go.
+	CanaryRoute   string `json:"canary_route"`
+	CanaryPercent int    `json:"canary_percent"` // 0-100
+	MirrorRoute   string `json:"mirror_route"`
+
+	Version uint `gorm:"not null;default:1" json:"version"`
+
+	sourceRegex   *regexp.Regexp
+	destRegex     *regexp.Regexp
+	sourceRewrite *regexp.Regexp
+	destRewrite   *regexp.Regexp
+	location      *time.Location
+	start, end    int // minutes since midnight, -1 when there is no window
+}
+
+// Compile validates the rule and prepares its regular expressions and time window.
+func (rule *RoutingRule) Compile() error {
+	if !ValidNumberType(rule.SourceType) || !ValidNumberType(rule.DestType) {
+		return fmt.Errorf("source_type and dest_type must be long, short_code or toll_free")
+	}
+
+	var err error
+	if rule.SourceRegex != "" {
+		if rule.sourceRegex, err = regexp.Compile(rule.SourceRegex); err != nil {
+			return fmt.Errorf("invalid source_regex: %w", err)
+		}
+	}
+	if rule.DestRegex != "" {
+		if rule.destRegex, err = regexp.Compile(rule.DestRegex); err != nil {
+			return fmt.Errorf("invalid dest_regex: %w", err)
+		}
+	}
+	if rule.SourceRewrite != "" {
+		if rule.sourceRewrite, err = regexp.Compile(rule.SourceRewrite); err != nil {
+			return fmt.Errorf("invalid source_rewrite: %w", err)
+		}
+	}
+	if rule.DestRewrite != "" {
+		if rule.destRewrite, err = regexp.Compile(rule.DestRewrite); err != nil {
+			return fmt.Errorf("invalid dest_rewrite: %w", err)
+		}
+	}
+
+	if err := rule.compileRollout(); err != nil {
+		return err
+	}
+
+	rule.location = time.UTC
+	if rule.TimeZone != "" {
+		if rule.location, err = time.LoadLocation(rule.TimeZone); err != nil {
+			return fmt.Errorf("invalid time_zone: %w", err)
+		}
+	}
+
+	rule.start, rule.end = -1, -1
+	if rule.TimeStart != "" || rule.TimeEnd != "" {
+		if rule.start, err = parseClock(rule.TimeStart); err != nil {
+			return fmt.Errorf("invalid time_start: %w", err)
+		}
+		if rule.end, err = parseClock(rule.TimeEnd); err != nil {
+			return fmt.Errorf("invalid time_end: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight.
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Matches reports whether the rule applies to the message sent by client at the given time.
+func (rule *RoutingRule) Matches(msg *MsgQueueItem, client *Client, now time.Time) bool {
+	if rule.Disabled {
+		return false
+	}
+	if rule.ClientID != 0 && (client == nil || client.ID != rule.ClientID) {
+		return false
+	}
+	if rule.TenantID != 0 && ClientTenantID(client) != rule.TenantID {
+		return false
+	}
+	if rule.MsgType != "" && !strings.EqualFold(rule.MsgType, string(msg.Type)) {
+		return false
+	}
+
+	// prefixes are E.164 prefixes, they don't match short codes unless the rule is for short codes
+	sourceType, destType := numberType(msg.From, client), ClassifyNumber(msg.To)
+	if rule.SourceType != "" && rule.SourceType != sourceType || rule.DestType != "" && rule.DestType != destType {
+		return false
+	}
+	from := strings.TrimPrefix(msg.From, "+")
+	to := strings.TrimPrefix(msg.To, "+")
+	if rule.SourcePrefix != "" && (!MatchesNumberType(rule.SourceType, sourceType) || !strings.HasPrefix(from, strings.TrimPrefix(rule.SourcePrefix, "+"))) {
+		return false
+	}
+	if rule.DestPrefix != "" && (!MatchesNumberType(rule.DestType, destType) || !strings.HasPrefix(to, strings.TrimPrefix(rule.DestPrefix, "+"))) {
+		return false
+	}
+	if rule.sourceRegex != nil && !rule.sourceRegex.MatchString(msg.From) {
+		return false
+	}
+	if rule.destRegex != nil && !rule.destRegex.MatchString(msg.To) {
+		return false
+	}
+
+	length := len([]rune(msg.Message))
+	if rule.MinLength > 0 && length < rule.MinLength {
+		return false
+	}
+	if rule.MaxLength > 0 && length > rule.MaxLength {
+		return false
+	}
+
+	if rule.start >= 0 && !inClockWindow(rule.start, rule.end, now.In(rule.location)) {
+		return false
+	}
+	return true
+}
+
+// inClockWindow reports whether the local time is in the window between start and end, minutes
+// since midnight. The window may wrap past midnight, e.g. 22:00-06:00.
+func inClockWindow(start int, end int, local time.Time) bool {
+	minute := local.Hour()*60 + local.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// Apply performs the rule's rewrite and priority actions on the message.
+func (rule *RoutingRule) Apply(msg *MsgQueueItem) {
+	if rule.sourceRewrite != nil {
+		msg.From = rule.sourceRewrite.ReplaceAllString(msg.From, rule.SourceReplace)
+	}
+	if rule.destRewrite != nil {
+		msg.To = rule.destRewrite.ReplaceAllString(msg.To, rule.DestReplace)
+	}
+	if rule.Priority != 0 {
+		msg.Priority = rule.Priority
+	}
+	if rule.TTL > 0 {
+		msg.ExpiresAt = time.Time{}
+		StampExpiry(msg, time.Duration(rule.TTL)*time.Second)
+	}
+}
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+// ScheduledStatus is the state of a scheduled message.
+type ScheduledStatus string
+
+var ScheduledStatuses = struct {
+	Pending   ScheduledStatus
+	Releasing ScheduledStatus // claimed by a dispatcher, not queued yet
+	Released  ScheduledStatus
+	Cancelled ScheduledStatus
+	Expired   ScheduledStatus // past its time-to-live before it was released
+}{
+	Pending:   "pending",
+	Releasing: "releasing",
+	Released:  "released",
+	Cancelled: "cancelled",
+	Expired:   "expired",
+}
+
+// ScheduledMessage is a client message held back until DeliverAt, the payload is the
+// MsgQueueItem that gets released into the router.
+type ScheduledMessage struct {
+	ID        uint            `gorm:"primaryKey" json:"id"`
+	MessageID string          `gorm:"uniqueIndex;not null" json:"message_id"` // the LogID of the message
+	ClientID  uint            `gorm:"index" json:"client_id"`
+	From      string          `json:"from_number"`
+	To        string          `json:"to_number"`
+	DeliverAt time.Time       `gorm:"index" json:"deliver_at"`
+	Status    ScheduledStatus `gorm:"index" json:"status"`
+	Payload   string          `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+var schedulerInterval time.Duration
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		schedulerInterval = cfg.Duration("SCHEDULER_INTERVAL", 5*time.Second)
+	})
+}
+
+// schedulerReleaseTimeout is how long a claimed message may take to be queued before another
+// dispatcher takes it over, the instance that claimed it may have died.
+var schedulerReleaseTimeout = time.Minute
+
+// ScheduleMessage stores the message for delivery at the given time.
+func (gateway *Gateway) ScheduleMessage(msg MsgQueueItem, client *Client, deliverAt time.Time) (*ScheduledMessage, error) {
+	payload, err := EncodeMsgQueueItem(msg)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := gateway.SealPayload(&msg, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduled := &ScheduledMessage{
+		MessageID: msg.LogID,
+		From:      msg.From,
+		To:        msg.To,
+		DeliverAt: deliverAt.UTC(),
+		Status:    ScheduledStatuses.Pending,
+		Payload:   sealed,
+	}
+	if client != nil {
+		scheduled.ClientID = client.ID
+	}
+
+	if err := gateway.DB.Create(scheduled).Error; err != nil {
+		return nil, fmt.Errorf("failed to schedule message: %v", err)
+	}
+	return scheduled, nil
+}
+
+func (gateway *Gateway) GetScheduledMessage(messageID string) (*ScheduledMessage, error) {
+	var scheduled ScheduledMessage
+	if err := gateway.DB.Where("message_id = ?", messageID).First(&scheduled).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("scheduled message not found: %s", messageID)
+		}
+		return nil, err
+	}
+	return &scheduled, nil
+}
+
+// CancelScheduledMessage cancels a message that hasn't been released yet.
+func (gateway *Gateway) CancelScheduledMessage(messageID string) error {
+	result := gateway.DB.Model(&ScheduledMessage{}).
+		Where("message_id = ? AND status = ?", messageID, ScheduledStatuses.Pending).
+		Update("status", ScheduledStatuses.Cancelled)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no pending scheduled message: %s", messageID)
+	}
+	return nil
+}
+
+// RescheduleMessage moves the delivery time of a message that hasn't been released yet.
+func (gateway *Gateway) RescheduleMessage(messageID string, deliverAt time.Time) error {
+	result := gateway.DB.Model(&ScheduledMessage{}).
+		Where("message_id = ? AND status = ?", messageID, ScheduledStatuses.Pending).
+		Update("deliver_at", deliverAt.UTC())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no pending scheduled message: %s", messageID)
+	}
+	return nil
+}
+
+// ScheduleDispatcher releases due scheduled messages into the router. Each message is claimed
+// with a conditional update so only one gateway instance releases it, and only marked released
+// once it is queued.
+func (gateway *Gateway) ScheduleDispatcher() {
+	var lm = gateway.LogManager
+
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// claims of an instance that died before queueing the messages
+		err := gateway.DB.Model(&ScheduledMessage{}).
+			Where("status = ? AND updated_at < ?", ScheduledStatuses.Releasing, time.Now().Add(-schedulerReleaseTimeout)).
+			Update("status", ScheduledStatuses.Pending).Error
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Scheduler.Dispatch",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+
+		var due []ScheduledMessage
+		err = gateway.DB.
+			Where("status = ? AND deliver_at <= ?", ScheduledStatuses.Pending, time.Now().UTC()).
+			Order("deliver_at asc").
+			Limit(500).
+			Find(&due).Error
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Scheduler.Dispatch",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+			continue
+		}
+
+		for _, scheduled := range due {
+			if !gateway.SetScheduledStatus(scheduled.ID, ScheduledStatuses.Pending, ScheduledStatuses.Releasing) {
+				continue
+			}
+
+			msg, err := gateway.DecodePayload(scheduled.Payload)
+			if err != nil {
+				// left claimed, it is tried again once the claim times out
+				lm.SendLog(lm.BuildLog(
+					"Scheduler.Dispatch",
+					"GenericError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"logID": scheduled.MessageID,
+					}, err,
+				))
+				continue
+			}
+			msg.QueuedTimestamp = time.Now()
+			// the time-to-live counts from the scheduled delivery time
+			if msg.ExpiresAt.IsZero() {
+				msg.ExpiresAt = scheduled.DeliverAt.Add(DefaultMessageTTL)
+			}
+
+			if err := gateway.Router.OfferClientMessage(msg); err != nil {
+				// the router is full, the rest of the due messages wait for the next tick
+				gateway.SetScheduledStatus(scheduled.ID, ScheduledStatuses.Releasing, ScheduledStatuses.Pending)
+				lm.SendLog(lm.BuildLog(
+					"Scheduler.Dispatch",
+					"GenericError",
+					logrus.WarnLevel,
+					map[string]interface{}{
+						"logID": scheduled.MessageID,
+					}, err,
+				))
+				break
+			}
+			gateway.SetScheduledStatus(scheduled.ID, ScheduledStatuses.Releasing, ScheduledStatuses.Released)
+
+			lm.SendLog(lm.BuildLog(
+				"Scheduler.Dispatch",
+				"ScheduledRelease",
+				logrus.InfoLevel,
+				map[string]interface{}{
+					"logID": scheduled.MessageID,
+				}, scheduled.DeliverAt,
+			))
+		}
+	}
+}
+
+// SetScheduledStatus moves a scheduled message from one status to another and reports whether it
+// was in the first one.
+func (gateway *Gateway) SetScheduledStatus(id uint, from ScheduledStatus, to ScheduledStatus) bool {
+	result := gateway.DB.Model(&ScheduledMessage{}).
+		Where("id = ? AND status = ?", id, from).
+		Update("status", to)
+	return result.Error == nil && result.RowsAffected > 0
+}
+
+// ParseSMPPTime parses an SMPP time field, either absolute or relative to now.
+func ParseSMPPTime(value string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(value, "R") {
+		var relative pdu.Duration
+		if err := relative.From(value); err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(relative.Duration), nil
+	}
+
+	var absolute pdu.Time
+	if err := absolute.From(value); err != nil {
+		return time.Time{}, err
+	}
+	return absolute.Time, nil
+}
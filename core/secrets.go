@@ -0,0 +1,340 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A setting or a credential may be a reference to a secret instead of the secret itself:
+// vault:<path>#<field> reads a HashiCorp Vault KV v2 secret, awssm:<secret id>#<field> an AWS
+// Secrets Manager secret. Without a field, the "value" field or a secret that isn't JSON is used.
+
+var secretsRefreshInterval time.Duration
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		secretsRefreshInterval = cfg.Duration("SECRETS_REFRESH_INTERVAL", 5*time.Minute)
+	})
+}
+
+// SecretProvider reads secrets from a secrets manager.
+type SecretProvider interface {
+	// Fetch returns the fields of the secret at path.
+	Fetch(ctx context.Context, path string) (map[string]string, error)
+}
+
+var secretProviders = map[string]func(cfg *Config) (SecretProvider, error){
+	"vault": newVaultProvider,
+	"awssm": newAWSSecretsProvider,
+}
+
+// secrets caches the fetched secrets and remembers the references resolved, so a rotation can be
+// detected and applied.
+var secrets = struct {
+	mu        sync.Mutex
+	providers map[string]SecretProvider
+	fetched   map[string]map[string]string // scheme:path: fields
+	resolved  map[string]string            // reference: value
+	env       map[string]string            // setting: reference
+}{
+	providers: make(map[string]SecretProvider),
+	fetched:   make(map[string]map[string]string),
+	resolved:  make(map[string]string),
+	env:       make(map[string]string),
+}
+
+// secretRef splits a reference into its provider, path and field, ok is false for values that
+// aren't references.
+func secretRef(value string) (scheme string, path string, field string, ok bool) {
+	scheme, rest, found := strings.Cut(value, ":")
+	if !found || secretProviders[scheme] == nil || rest == "" {
+		return "", "", "", false
+	}
+	path, field, _ = strings.Cut(rest, "#")
+	if field == "" {
+		field = "value"
+	}
+	return scheme, path, field, path != ""
+}
+
+// resolveSecret returns the secret a reference points to, any other value is returned as is.
+func (cfg *Config) resolveSecret(value string) (string, error) {
+	scheme, path, field, ok := secretRef(value)
+	if !ok {
+		return value, nil
+	}
+
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+
+	fields, cached := secrets.fetched[scheme+":"+path]
+	if !cached {
+		var err error
+		if fields, err = fetchSecret(cfg, scheme, path); err != nil {
+			return "", fmt.Errorf("secret %s: %w", value, err)
+		}
+		secrets.fetched[scheme+":"+path] = fields
+	}
+	secret, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("secret %s: no field %s", value, field)
+	}
+	secrets.resolved[value] = secret
+	return secret, nil
+}
+
+// fetchSecret reads a secret from its provider, created from cfg the first time. secrets.mu must be
+// held.
+func fetchSecret(cfg *Config, scheme string, path string) (map[string]string, error) {
+	provider, ok := secrets.providers[scheme]
+	if !ok {
+		var err error
+		if provider, err = secretProviders[scheme](cfg); err != nil {
+			return nil, err
+		}
+		secrets.providers[scheme] = provider
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return provider.Fetch(ctx, path)
+}
+
+// resolveSecrets replaces the settings that are secret references with their secrets.
+func (cfg *Config) resolveSecrets() []error {
+	var errs []error
+	for key, value := range cfg.values {
+		if _, _, _, ok := secretRef(value); !ok {
+			continue
+		}
+		secret, err := cfg.resolveSecret(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+		secrets.mu.Lock()
+		secrets.env[key] = value
+		secrets.mu.Unlock()
+		cfg.values[key] = secret
+	}
+	return errs
+}
+
+// refreshSecrets fetches every secret used again and reports whether any of them changed.
+func refreshSecrets() (bool, error) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+
+	paths := make([]string, 0, len(secrets.fetched))
+	for key := range secrets.fetched {
+		paths = append(paths, key)
+	}
+	sort.Strings(paths)
+
+	var firstErr error
+	for _, key := range paths {
+		scheme, path, _ := strings.Cut(key, ":")
+		fields, err := fetchSecret(settings, scheme, path)
+		if err != nil {
+			// keep the secrets we have until the provider answers again
+			if firstErr == nil {
+				firstErr = fmt.Errorf("secret %s: %w", key, err)
+			}
+			continue
+		}
+		secrets.fetched[key] = fields
+	}
+
+	changed := false
+	for ref, previous := range secrets.resolved {
+		scheme, path, field, _ := secretRef(ref)
+		if secret, ok := secrets.fetched[scheme+":"+path][field]; ok && secret != previous {
+			secrets.resolved[ref] = secret
+			changed = true
+		}
+	}
+	for key, ref := range secrets.env {
+		settings.set(key, secrets.resolved[ref])
+	}
+	return changed, firstErr
+}
+
+// SecretRefresher fetches the secrets every SECRETS_REFRESH_INTERVAL, and reloads the carriers and
+// clients when one was rotated. Settings read at startup keep the secret they started with.
+func (gateway *Gateway) SecretRefresher() {
+	var lm = gateway.LogManager
+
+	ticker := time.NewTicker(secretsRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		changed, err := refreshSecrets()
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.Secrets",
+				"GenericError",
+				logrus.WarnLevel,
+				nil, err,
+			))
+		}
+		if !changed {
+			continue
+		}
+
+		lm.SendLog(lm.BuildLog(
+			"System.Secrets",
+			"SecretsRotated",
+			logrus.InfoLevel,
+			nil, "carriers and clients",
+		))
+		if err := gateway.ReloadCarriers(); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.Secrets",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+		if err := gateway.reloadClientsAndNumbers(); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.Secrets",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+	}
+}
+
+// vaultProvider reads KV version 2 secrets over the Vault HTTP API. The token is read from
+// VAULT_TOKEN_FILE on every request when set, so a Vault Agent can renew it.
+type vaultProvider struct {
+	addr      string
+	mount     string
+	namespace string
+	token     string
+	tokenFile string
+	client    *http.Client
+}
+
+// newVaultProvider reads the VAULT_ settings of cfg, providers are created while the settings are
+// still being loaded.
+func newVaultProvider(cfg *Config) (SecretProvider, error) {
+	addr := cfg.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	mount := cfg.Getenv("VAULT_KV_MOUNT")
+	if mount == "" {
+		mount = "secret"
+	}
+	return &vaultProvider{
+		addr:      strings.TrimRight(addr, "/"),
+		mount:     mount,
+		namespace: cfg.Getenv("VAULT_NAMESPACE"),
+		token:     cfg.Getenv("VAULT_TOKEN"),
+		tokenFile: cfg.Getenv("VAULT_TOKEN_FILE"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *vaultProvider) Fetch(ctx context.Context, path string) (map[string]string, error) {
+	token := p.token
+	if p.tokenFile != "" {
+		data, err := os.ReadFile(p.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.addr+"/v1/"+p.mount+"/data/"+strings.Join(segments, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault answered %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(body.Data.Data))
+	for field, value := range body.Data.Data {
+		fields[field] = fmt.Sprint(value)
+	}
+	return fields, nil
+}
+
+// awsSecretsProvider reads secrets from AWS Secrets Manager, with the credentials and region of
+// the default AWS chain (environment, shared config, instance or task role).
+type awsSecretsProvider struct {
+	client *secretsmanager.SecretsManager
+}
+
+func newAWSSecretsProvider(cfg *Config) (SecretProvider, error) {
+	// AWS_REGION may come from .env or CONFIG_FILE, which the AWS chain doesn't read
+	options := session.Options{SharedConfigState: session.SharedConfigEnable}
+	if region := cfg.Getenv("AWS_REGION"); region != "" {
+		options.Config.Region = aws.String(region)
+	}
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		return nil, fmt.Errorf("AWS_REGION is not set")
+	}
+	return &awsSecretsProvider{client: secretsmanager.New(sess)}, nil
+}
+
+func (p *awsSecretsProvider) Fetch(ctx context.Context, path string) (map[string]string, error) {
+	out, err := p.client.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(path)})
+	if err != nil {
+		return nil, err
+	}
+	secret := aws.StringValue(out.SecretString)
+	if out.SecretString == nil {
+		secret = string(out.SecretBinary)
+	}
+
+	var object map[string]interface{}
+	if json.Unmarshal([]byte(secret), &object) != nil {
+		return map[string]string{"value": secret}, nil
+	}
+	fields := make(map[string]string, len(object))
+	for field, value := range object {
+		fields[field] = fmt.Sprint(value)
+	}
+	return fields, nil
+}
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"time"
+	"zultys-smpp-mm4/smpp/coding"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+// SMPPSegments encodes text for short_message fields, split into segments of up to 134 octets.
+func SMPPSegments(text string) ([][]byte, coding.DataCoding) {
+	limit := 134
+	bestCoding := coding.BestSafeCoding(text)
+	if bestCoding == coding.GSM7BitCoding {
+		bestCoding = coding.ASCIICoding
+	}
+
+	segments := []string{text}
+	if splitter := bestCoding.Splitter(); splitter != nil {
+		segments = splitter.Split(text, limit)
+	}
+
+	encoder := bestCoding.Encoding().NewEncoder()
+	encoded := make([][]byte, 0, len(segments))
+	for _, segment := range segments {
+		b, _ := encoder.Bytes([]byte(segment))
+		encoded = append(encoded, b)
+	}
+	return encoded, bestCoding
+}
+
+// SMPPResponseTimeout bounds the wait for a client's deliver_sm_resp.
+var SMPPResponseTimeout time.Duration
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		SMPPResponseTimeout = cfg.Duration("SMPP_RESPONSE_TIMEOUT", 10*time.Second)
+	})
+}
+
+// Delivery receipt TLVs and message states, see SMPP v5 sections 4.8.4.50, 4.8.4.37 and 4.7.15.
+const (
+	TagReceiptedMessageID uint16 = 0x001E
+	TagMessageState       uint16 = 0x0427
+
+	MessageStateDelivered     pdu.MessageState = 2
+	MessageStateExpired       pdu.MessageState = 3
+	MessageStateUndeliverable pdu.MessageState = 5
+	MessageStateRejected      pdu.MessageState = 8
+)
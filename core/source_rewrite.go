@@ -0,0 +1,76 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// SourceRewrite rewrites the source address of a client's messages sent through a carrier route,
+// e.g. to always send from the client's main number, or to strip a suffix the carrier doesn't take.
+// The first enabled rewrite of the client matching the route and the source applies. Replies to
+// a rewritten source are delivered to the original one, see SourceMask.
+type SourceRewrite struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	ClientID uint   `gorm:"index;not null" json:"client_id"`
+	Route    string `json:"route"`    // carrier route, empty for every route
+	Position int    `json:"position"` // rewrites are evaluated in ascending position
+	Disabled bool   `json:"disabled"`
+
+	Match   string `json:"match"`   // regular expression the E.164 source must match, empty matches every source
+	Replace string `json:"replace"` // replacement of the match, may refer to its groups with $1
+	Number  string `json:"number"`  // client number to send from instead, takes the place of replace
+
+	Description string `json:"description"`
+	Version     uint   `gorm:"not null;default:1" json:"version"`
+
+	regex *regexp.Regexp
+}
+
+// SourceMask maps a rewritten source and a recipient back to the source the client sent from, so
+// the recipient's replies thread with the conversation on the PBX. It is refreshed on every send
+// and expires after SOURCE_MASK_RETENTION.
+type SourceMask struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Masked    string    `gorm:"uniqueIndex:idx_source_mask;not null" json:"masked"`
+	Peer      string    `gorm:"uniqueIndex:idx_source_mask;not null" json:"peer"`
+	Source    string    `gorm:"not null" json:"source"`
+	ClientID  uint      `gorm:"index" json:"client_id"`
+	Route     string    `json:"route"`
+	UpdatedAt time.Time `gorm:"index" json:"updated_at"`
+}
+
+var SourceMaskRetention time.Duration
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		SourceMaskRetention = cfg.Duration("SOURCE_MASK_RETENTION", 30*24*time.Hour)
+	})
+}
+
+// Compile validates the rewrite and prepares its expression.
+func (rewrite *SourceRewrite) Compile() error {
+	if rewrite.Number == "" && rewrite.Match == "" {
+		return fmt.Errorf("match or number is required")
+	}
+	rewrite.regex = nil
+	if rewrite.Match != "" {
+		regex, err := regexp.Compile(rewrite.Match)
+		if err != nil {
+			return fmt.Errorf("invalid match: %w", err)
+		}
+		rewrite.regex = regex
+	}
+	return nil
+}
+
+// Apply returns the rewritten source, or the source when the rewrite doesn't match it.
+func (rewrite *SourceRewrite) Apply(source string) (string, bool) {
+	if rewrite.regex != nil && !rewrite.regex.MatchString(source) {
+		return source, false
+	}
+	if rewrite.Number != "" {
+		return rewrite.Number, true
+	}
+	return rewrite.regex.ReplaceAllString(source, rewrite.Replace), true
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"errors"
+	"github.com/kataras/iris/v12"
+	"strings"
+)
+
+// Storage is where the gateway reads the provisioning it routes by: the clients with their numbers
+// and dial plans, the carriers and the routing rules. The postgres backend reads the database the
+// management API writes, the file backend a YAML file for deployments without Postgres.
+type Storage interface {
+	Clients() ([]Client, error)
+	Numbers() ([]ClientNumber, error)
+	Carriers() ([]Carrier, error)
+	RoutingRules() ([]RoutingRule, error)
+	// Encrypted reports whether the credentials are stored encrypted, see storedSecret.
+	Encrypted() bool
+}
+
+var StorageBackend string
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		StorageBackend = cfg.String("STORAGE_BACKEND", "postgres")
+	})
+}
+
+// ErrNeedsPostgres fails the writes of the file backend that would drop a message or key the
+// gateway relies on finding again: scheduled, held, quarantined and dead-lettered messages, carrier
+// send claims and data keys.
+var ErrNeedsPostgres = errors.New("needs the postgres storage backend")
+
+// errReadOnly answers the management requests that would change the provisioning of the file
+// backend.
+var errReadOnly = errors.New("read-only, the provisioning comes from STORAGE_FILE")
+
+// storedSecret returns a credential as the storage keeps it, decrypted when it is encrypted.
+func (gateway *Gateway) storedSecret(stored string) (string, error) {
+	if !gateway.Storage.Encrypted() {
+		return stored, nil
+	}
+	return gateway.decryptSecret(stored)
+}
+
+// ProvisioningWritable refuses the management requests that change the provisioning when it comes
+// from the file backend, reloads re-read the file.
+func (gateway *Gateway) ProvisioningWritable(ctx iris.Context) {
+	method := ctx.Method()
+	if StorageBackend == "file" && method != iris.MethodGet && method != iris.MethodHead && !strings.HasSuffix(ctx.Path(), "/reload") {
+		WriteProvisioningError(ctx, errReadOnly)
+		return
+	}
+	ctx.Next()
+}
@@ -0,0 +1,17 @@
+package core
+
+import (
+	"time"
+)
+
+// HeldMessage is an inbound carrier message for a client that had no SMPP session bound, it is
+// delivered in arrival order as soon as the client binds again.
+type HeldMessage struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ClientID  uint      `gorm:"index;not null" json:"client_id"`
+	MessageID string    `gorm:"index" json:"message_id"` // the LogID of the message
+	From      string    `json:"from_number"`
+	To        string    `json:"to_number"`
+	Payload   string    `json:"payload"`
+	CreatedAt time.Time `json:"created_at"`
+}
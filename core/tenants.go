@@ -0,0 +1,412 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+// Tenant owns clients, carrier accounts, routing rules, LCR routes, event subscriptions and API
+// keys, numbers belong to the tenant of their client. Resources of tenant 0 belong to the operator
+// and are shared: shared carriers serve the clients of every tenant, while a tenant's carriers,
+// rules and LCR routes are only used for the messages of its own clients.
+type Tenant struct {
+	ID            uint   `gorm:"primaryKey" json:"id"`
+	Name          string `gorm:"unique;not null" json:"name"`
+	MaxClients    int    `json:"max_clients"`    // zero for no limit
+	MaxNumbers    int    `json:"max_numbers"`    // zero for no limit
+	DailyMessages int    `json:"daily_messages"` // messages the clients may send per UTC day, zero for no limit
+	// QuietHours of the clients that have none of their own
+	QuietHours QuietHours `gorm:"embedded;embeddedPrefix:quiet_" json:"quiet_hours"`
+	// MonthlyQuota of the clients together, besides the quotas of each
+	MonthlyQuota MonthlyQuota `gorm:"embedded;embeddedPrefix:quota_" json:"monthly_quota"`
+	Version      uint         `gorm:"not null;default:1" json:"version"`
+}
+
+// tenants caches the tenants and counts the messages sent by their clients today. The count is
+// kept by every gateway instance on its own.
+var tenants = struct {
+	mu   sync.Mutex
+	byID map[uint]Tenant
+	day  string
+	sent map[uint]int
+}{
+	byID: make(map[uint]Tenant),
+	sent: make(map[uint]int),
+}
+
+// LoadTenants loads the tenants and their quotas.
+func (gateway *Gateway) LoadTenants() error {
+	var list []Tenant
+	if err := gateway.DB.Find(&list).Error; err != nil {
+		return err
+	}
+	byID := make(map[uint]Tenant, len(list))
+	for _, tenant := range list {
+		byID[tenant.ID] = tenant
+	}
+
+	tenants.mu.Lock()
+	tenants.byID = byID
+	tenants.mu.Unlock()
+	return nil
+}
+
+func tenantByID(id uint) (Tenant, bool) {
+	tenants.mu.Lock()
+	defer tenants.mu.Unlock()
+	tenant, ok := tenants.byID[id]
+	return tenant, ok
+}
+
+// CountTenantMessage counts a message sent by a client of the tenant, ok is false when the
+// tenant already sent its daily messages.
+func CountTenantMessage(id uint, now time.Time) bool {
+	if id == 0 {
+		return true
+	}
+	tenants.mu.Lock()
+	defer tenants.mu.Unlock()
+
+	if day := now.UTC().Format("2006-01-02"); day != tenants.day {
+		tenants.day = day
+		tenants.sent = make(map[uint]int)
+	}
+	if tenant := tenants.byID[id]; tenant.DailyMessages > 0 && tenants.sent[id] >= tenant.DailyMessages {
+		return false
+	}
+	tenants.sent[id]++
+	return true
+}
+
+// tenantMessagesToday is the number of messages the clients of a tenant sent today.
+func tenantMessagesToday(id uint) int {
+	tenants.mu.Lock()
+	defer tenants.mu.Unlock()
+	if tenants.day != time.Now().UTC().Format("2006-01-02") {
+		return 0
+	}
+	return tenants.sent[id]
+}
+
+// ClientTenantID is the tenant of a client, 0 for the operator and no client.
+func ClientTenantID(client *Client) uint {
+	if client == nil {
+		return 0
+	}
+	return client.TenantID
+}
+
+// CarrierTenant returns the tenant of the named carrier, 0 for shared and unknown carriers.
+func (gateway *Gateway) CarrierTenant(name string) uint {
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+	for _, carrier := range gateway.CarrierUUIDs {
+		if carrier.Name == name {
+			return carrier.TenantID
+		}
+	}
+	return 0
+}
+
+// clientTenant returns the tenant of the client with the username.
+func (gateway *Gateway) clientTenant(username string) uint {
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+	if client, ok := gateway.Clients[username]; ok {
+		return client.TenantID
+	}
+	return 0
+}
+
+// CarrierAllowed reports whether the messages of a client may use the named carrier, the
+// carriers of a tenant only carry the messages of its own clients.
+func (gateway *Gateway) CarrierAllowed(name string, client *Client) bool {
+	owner := gateway.CarrierTenant(name)
+	return owner == 0 || client != nil && client.TenantID == owner
+}
+
+// ValidateTenantID checks that a resource is given to a tenant that exists.
+func ValidateTenantID(id uint) error {
+	if id == 0 {
+		return nil
+	}
+	if _, ok := tenantByID(id); !ok {
+		return Invalid("tenant %d does not exist", id)
+	}
+	return nil
+}
+
+// CheckClientQuota answers errForbidden when the tenant has all the clients it may have.
+func (gateway *Gateway) CheckClientQuota(id uint) error {
+	tenant, ok := tenantByID(id)
+	if !ok || tenant.MaxClients == 0 {
+		return nil
+	}
+	if count := gateway.tenantClients(id); count >= tenant.MaxClients {
+		return fmt.Errorf("%w: tenant %s has reached its limit of %d clients", ErrForbidden, tenant.Name, tenant.MaxClients)
+	}
+	return nil
+}
+
+// checkNumberQuota answers errForbidden when the tenant has all the numbers it may have.
+func (gateway *Gateway) checkNumberQuota(id uint) error {
+	tenant, ok := tenantByID(id)
+	if !ok || tenant.MaxNumbers == 0 {
+		return nil
+	}
+	if count := gateway.tenantNumbers(id); count >= tenant.MaxNumbers {
+		return fmt.Errorf("%w: tenant %s has reached its limit of %d numbers", ErrForbidden, tenant.Name, tenant.MaxNumbers)
+	}
+	return nil
+}
+
+func (gateway *Gateway) tenantClients(id uint) int {
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+	count := 0
+	for _, client := range gateway.Clients {
+		if client.TenantID == id {
+			count++
+		}
+	}
+	return count
+}
+
+func (gateway *Gateway) tenantNumbers(id uint) int {
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+	count := 0
+	for _, client := range gateway.Clients {
+		if client.TenantID == id {
+			count += len(client.Numbers)
+		}
+	}
+	return count
+}
+
+// checkTenantNumber checks that a number given to a client uses a carrier the client's tenant
+// may use, and, for a number new to the tenant, that the tenant may have another number.
+func (gateway *Gateway) checkTenantNumber(client *Client, carrier string, added bool) error {
+	if !gateway.CarrierAllowed(carrier, client) {
+		return Invalid("carrier %s belongs to another tenant", carrier)
+	}
+	if added {
+		return gateway.checkNumberQuota(client.TenantID)
+	}
+	return nil
+}
+
+// RequestTenant is the tenant the key of a request is limited to, 0 for operator keys.
+func RequestTenant(ctx iris.Context) uint {
+	return requestKey(ctx).TenantID
+}
+
+// AssignTenant gives a resource created or replaced with a key limited to a tenant to that tenant.
+func AssignTenant(ctx iris.Context, tenant *uint) {
+	if id := RequestTenant(ctx); id != 0 {
+		*tenant = id
+	}
+}
+
+// CheckTenantScope answers errForbidden when the key of a request may not manage the resources of
+// a whole tenant. Keys limited to some clients never may, keys limited to a tenant only for their
+// own tenant.
+func CheckTenantScope(ctx iris.Context, tenant uint) error {
+	key := requestKey(ctx)
+	if len(key.ClientList()) > 0 {
+		return fmt.Errorf("%w: the API key is limited to some clients", ErrForbidden)
+	}
+	if key.TenantID != 0 && key.TenantID != tenant {
+		return fmt.Errorf("%w: the API key is limited to another tenant", ErrForbidden)
+	}
+	return nil
+}
+
+// OwnerTenant returns the tenant of the row of a model with a tenant_id column.
+func OwnerTenant(db *gorm.DB, model interface{}, id uint) (uint, error) {
+	var owner struct{ TenantID uint }
+	if err := db.Model(model).Select("tenant_id").Where("id = ?", id).Take(&owner).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	return owner.TenantID, nil
+}
+
+// tenantRowScope checks the tenant of the row of a model the id parameter names.
+func tenantRowScope(model interface{}) scopeResolver {
+	return func(ctx iris.Context, gateway *Gateway) error {
+		owner, err := OwnerTenant(gateway.DB, model, ctx.Params().GetUintDefault("id", 0))
+		if err != nil {
+			return err
+		}
+		return CheckTenantScope(ctx, owner)
+	}
+}
+
+func tenantIDScope(ctx iris.Context, gateway *Gateway) error {
+	return CheckTenantScope(ctx, ctx.Params().GetUintDefault("id", 0))
+}
+
+// validateTenant checks the name and the quotas of a tenant.
+func validateTenant(tenant *Tenant) error {
+	if tenant.Name == "" {
+		return Invalid("name is required")
+	}
+	if tenant.MaxClients < 0 || tenant.MaxNumbers < 0 || tenant.DailyMessages < 0 {
+		return Invalid("max_clients, max_numbers and daily_messages can't be negative")
+	}
+	if err := tenant.QuietHours.Validate(); err != nil {
+		return err
+	}
+	return tenant.MonthlyQuota.Validate()
+}
+
+// deleteTenant deletes a tenant that owns nothing anymore.
+func (gateway *Gateway) deleteTenant(id uint, version uint) error {
+	references := []struct {
+		model interface{}
+		name  string
+	}{
+		{&Client{}, "clients"},
+		{&Carrier{}, "carriers"},
+		{&RoutingRule{}, "routing rules"},
+		{&LCRRoute{}, "LCR routes"},
+		{&EventSubscription{}, "event subscriptions"},
+		{&APIKey{}, "API keys"},
+	}
+	for _, ref := range references {
+		var count int64
+		if err := gateway.DB.Model(ref.model).Where("tenant_id = ?", id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("%w: the tenant still has %d %s", errInUse, count, ref.name)
+		}
+	}
+
+	if err := DeleteVersioned(gateway.DB, &Tenant{}, id, version); err != nil {
+		return err
+	}
+	return gateway.LoadTenants()
+}
+
+// tenantUsage is a tenant with what it uses of its quotas.
+type tenantUsage struct {
+	Tenant
+	Clients       int `json:"clients"`
+	Numbers       int `json:"numbers"`
+	MessagesToday int `json:"messages_today"` // sent through this gateway instance
+	// Quota is the monthly quota with its use in the current cycle
+	Quota *quotaStatus `json:"quota,omitempty"`
+}
+
+func (gateway *Gateway) tenantUsage(tenant Tenant) tenantUsage {
+	usage := tenantUsage{
+		Tenant:        tenant,
+		Clients:       gateway.tenantClients(tenant.ID),
+		Numbers:       gateway.tenantNumbers(tenant.ID),
+		MessagesToday: tenantMessagesToday(tenant.ID),
+	}
+	if tenant.MonthlyQuota.limited() {
+		if status, err := gateway.quotaStatus(QuotaScopes.Tenant, tenant.ID, tenant.MonthlyQuota); err == nil {
+			usage.Quota = &status
+		}
+	}
+	return usage
+}
+
+// SetupTenantRoutes sets up the management of the tenants.
+func SetupTenantRoutes(app *iris.Application, gateway *Gateway) {
+	tenantsParty := app.Party("/tenants", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// List tenants with their usage, a key limited to a tenant only sees its own
+		tenantsParty.Get("/", func(ctx iris.Context) {
+			var list []Tenant
+			if err := gateway.DB.Order("id asc").Find(&list).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			result := make([]tenantUsage, 0, len(list))
+			for _, tenant := range list {
+				if CheckTenantScope(ctx, tenant.ID) != nil {
+					continue
+				}
+				result = append(result, gateway.tenantUsage(tenant))
+			}
+			ctx.JSON(result)
+		})
+
+		// Add a tenant
+		tenantsParty.Post("/", func(ctx iris.Context) {
+			var tenant Tenant
+			if err := ctx.ReadJSON(&tenant); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			tenant.ID = 0
+			tenant.Version = 0
+			if err := validateTenant(&tenant); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.DB.Create(&tenant).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.LoadTenants(); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(tenant)
+		})
+
+		// Get a tenant with its usage
+		tenantsParty.Get("/{id:uint}", func(ctx iris.Context) {
+			var tenant Tenant
+			if err := gateway.DB.First(&tenant, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+				WriteProvisioningError(ctx, ErrNotFound)
+				return
+			}
+			ctx.JSON(gateway.tenantUsage(tenant))
+		})
+
+		// Replace the name and quotas of a tenant, the body carries the version it was read with
+		tenantsParty.Put("/{id:uint}", func(ctx iris.Context) {
+			var tenant Tenant
+			if err := ctx.ReadJSON(&tenant); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			tenant.ID = ctx.Params().GetUintDefault("id", 0)
+			if err := validateTenant(&tenant); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := UpdateVersioned(gateway.DB, &tenant, tenant.ID, &tenant.Version, append(append([]string{"name", "max_clients", "max_numbers", "daily_messages"}, quietHoursColumns...), monthlyQuotaColumns...)...); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.LoadTenants(); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(tenant)
+		})
+
+		// Delete a tenant that owns no clients, carriers, rules, routes, subscriptions or keys
+		tenantsParty.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := gateway.deleteTenant(ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Tenant deleted"})
+		})
+	}
+}
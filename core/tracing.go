@@ -0,0 +1,349 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spans are exported as OTLP/HTTP JSON to any OpenTelemetry collector, and their context travels
+// as a W3C traceparent in MsgQueueItem.TraceParent and the AMQP headers, so a trace follows a
+// message from the SMPP, MM4 or carrier ingress through the routers and queues to its delivery.
+var (
+	tracesEndpoint    string
+	tracesServiceName string
+	tracesSampleRatio float64
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		tracesEndpoint = otlpTracesEndpoint(cfg)
+		tracesServiceName = cfg.String("OTEL_SERVICE_NAME", "zultys-smpp-mm4")
+		tracesSampleRatio = cfg.Float("OTEL_TRACES_SAMPLER_ARG", 1)
+	})
+}
+
+// Spans are exported in batches of up to tracesBatchSize, at least every tracesInterval.
+const (
+	tracesBatchSize = 512
+	tracesInterval  = 5 * time.Second
+)
+
+// traceParentHeader is the AMQP header carrying the span context of the publish.
+const traceParentHeader = "traceparent"
+
+type spanKind int
+
+// Span kinds of the OTLP protocol.
+const (
+	SpanKindInternal spanKind = 1
+	SpanKindServer   spanKind = 2
+	SpanKindClient   spanKind = 3
+	SpanKindProducer spanKind = 4
+	SpanKindConsumer spanKind = 5
+)
+
+// Span is a timed operation of a trace. Spans are never nil, unsampled spans only propagate their
+// context and aren't exported.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     spanKind
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	end   time.Time
+	err   string
+}
+
+// tracer batches ended spans and exports them, it is disabled when no endpoint is configured.
+var tracer = &spanExporter{
+	spans: make(chan *Span, 4*tracesBatchSize),
+}
+
+type spanExporter struct {
+	spans   chan *Span
+	headers map[string]string
+	client  http.Client
+}
+
+// StartSpan starts a span as the child of the span context in traceParent, an empty or invalid
+// traceParent starts a new trace.
+func StartSpan(name string, kind spanKind, traceParent string) *Span {
+	span := &Span{name: name, kind: kind, start: time.Now()}
+	_, _ = rand.Read(span.spanID[:])
+	if traceID, parentID, sampled, ok := parseTraceParent(traceParent); ok {
+		span.traceID, span.parentID, span.sampled = traceID, parentID, sampled
+	} else {
+		_, _ = rand.Read(span.traceID[:])
+		span.sampled = tracesEndpoint != "" && sampleTrace(span.traceID)
+	}
+	return span
+}
+
+// StartMsgSpan starts a span of the message and makes it the parent of the message's next spans.
+func StartMsgSpan(name string, kind spanKind, msg *MsgQueueItem) *Span {
+	span := StartSpan(name, kind, msg.TraceParent)
+	span.SetAttributes(map[string]interface{}{
+		"message.log_id": msg.LogID,
+		"message.type":   string(msg.Type),
+	})
+	msg.TraceParent = span.TraceParent()
+	return span
+}
+
+// SetAttributes adds attributes to the span.
+func (span *Span) SetAttributes(attrs map[string]interface{}) {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	if span.attrs == nil {
+		span.attrs = make(map[string]interface{}, len(attrs))
+	}
+	for key, value := range attrs {
+		span.attrs[key] = value
+	}
+}
+
+// TraceParent is the W3C traceparent of the span, for the spans started from it.
+func (span *Span) TraceParent() string {
+	flags := "00"
+	if span.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(span.traceID[:]) + "-" + hex.EncodeToString(span.spanID[:]) + "-" + flags
+}
+
+// End ends the span, failed when err is set, and queues it for export. Spans are dropped rather
+// than blocking the caller when the collector can't keep up.
+func (span *Span) End(err error) {
+	span.mu.Lock()
+	ended := !span.end.IsZero()
+	if !ended {
+		span.end = time.Now()
+		if err != nil {
+			span.err = err.Error()
+		}
+	}
+	span.mu.Unlock()
+
+	if ended || !span.sampled || tracesEndpoint == "" {
+		return
+	}
+	select {
+	case tracer.spans <- span:
+	default:
+	}
+}
+
+// parseTraceParent reads a W3C traceparent header.
+func parseTraceParent(traceParent string) (traceID [16]byte, spanID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return traceID, spanID, false, false
+	}
+	t, err := hex.DecodeString(parts[1])
+	if err != nil || len(t) != len(traceID) {
+		return traceID, spanID, false, false
+	}
+	s, err := hex.DecodeString(parts[2])
+	if err != nil || len(s) != len(spanID) {
+		return traceID, spanID, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return traceID, spanID, false, false
+	}
+	copy(traceID[:], t)
+	copy(spanID[:], s)
+	if traceID == [16]byte{} || spanID == [8]byte{} {
+		return traceID, spanID, false, false
+	}
+	return traceID, spanID, flags[0]&1 == 1, true
+}
+
+// TraceParentFromHeaders returns the span context carried in the headers of a delivery.
+func TraceParentFromHeaders(headers map[string]interface{}) string {
+	traceParent, _ := headers[traceParentHeader].(string)
+	return traceParent
+}
+
+// sampleTrace samples the ratio of new traces set by OTEL_TRACES_SAMPLER_ARG, deciding on the
+// trace ID like the OpenTelemetry TraceIdRatioBased sampler.
+func sampleTrace(traceID [16]byte) bool {
+	if tracesSampleRatio >= 1 {
+		return true
+	}
+	var n uint64
+	for _, b := range traceID[8:] {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n>>1) < tracesSampleRatio*float64(uint64(1)<<63)
+}
+
+// otlpTracesEndpoint is the URL traces are posted to, following the OpenTelemetry exporter
+// variables.
+func otlpTracesEndpoint(cfg *Config) string {
+	if endpoint := cfg.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	if endpoint := cfg.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return strings.TrimRight(endpoint, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// StartTracing exports the ended spans until the process exits.
+func (gateway *Gateway) StartTracing() {
+	if tracesEndpoint == "" {
+		return
+	}
+	tracer.headers = make(map[string]string)
+	for _, pair := range strings.Split(Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			tracer.headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	tracer.client.Timeout = 10 * time.Second
+
+	var lm = gateway.LogManager
+	ticker := time.NewTicker(tracesInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, tracesBatchSize)
+	for {
+		select {
+		case span := <-tracer.spans:
+			if batch = append(batch, span); len(batch) < tracesBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := tracer.export(batch); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.Tracing",
+				"GenericError",
+				logrus.WarnLevel,
+				map[string]interface{}{
+					"spans": len(batch),
+				}, err,
+			))
+		}
+		batch = batch[:0]
+	}
+}
+
+// OTLP/HTTP JSON encoding of spans, IDs are hex and timestamps are strings of nanoseconds.
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              spanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case uint:
+		return map[string]interface{}{"intValue": strconv.FormatUint(uint64(v), 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(value)}
+}
+
+func (span *Span) otlp() otlpSpan {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(span.traceID[:]),
+		SpanID:            hex.EncodeToString(span.spanID[:]),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+	}
+	if span.err != "" {
+		out.Status.Code = 2 // error
+		out.Status.Message = span.err
+	}
+	if span.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(span.parentID[:])
+	}
+	for key, value := range span.attrs {
+		out.Attributes = append(out.Attributes, otlpKeyValue{Key: key, Value: otlpValue(value)})
+	}
+	return out
+}
+
+func (exporter *spanExporter) export(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, span.otlp())
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpValue(tracesServiceName)}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "zultys-smpp-mm4"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", tracesEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range exporter.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := exporter.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export spans: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response from trace collector: %d", resp.StatusCode)
+	}
+	return nil
+}
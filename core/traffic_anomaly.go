@@ -0,0 +1,381 @@
+package core
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"hash/fnv"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions on a traffic anomaly of a client, besides its alert.
+var AnomalyActions = struct {
+	Alert    string
+	Throttle string
+}{
+	Alert:    "alert",    // only alert
+	Throttle: "throttle", // also hold the client to ANOMALY_THROTTLE_RATE while the anomaly lasts
+}
+
+// Thresholds of the anomaly rules, a threshold of 0 disables its rule.
+var (
+	anomalyWindow              time.Duration
+	anomalyBaselineWindows     int
+	anomalyMinMessages         int
+	anomalySpikeFactor         float64
+	anomalyDestinationShare    float64
+	anomalyDuplicateRecipients float64
+	anomalyAction              string
+	anomalyThrottleRate        float64
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		anomalyWindow = cfg.Duration("ANOMALY_WINDOW", 5*time.Minute)
+		anomalyBaselineWindows = cfg.Int("ANOMALY_BASELINE_WINDOWS", 12)
+		anomalyMinMessages = cfg.Int("ANOMALY_MIN_MESSAGES", 50)
+		anomalySpikeFactor = alertThreshold(cfg, "ANOMALY_SPIKE_FACTOR", 5)
+		anomalyDestinationShare = alertThreshold(cfg, "ANOMALY_DESTINATION_SHARE", 0.5)
+		anomalyDuplicateRecipients = alertThreshold(cfg, "ANOMALY_DUPLICATE_RECIPIENTS", 100)
+		anomalyAction = cfg.String("ANOMALY_ACTION", AnomalyActions.Alert)
+		anomalyThrottleRate = alertThreshold(cfg, "ANOMALY_THROTTLE_RATE", 1)
+	})
+}
+
+const (
+	// a destination country below this share of the baseline is one the sender rarely uses
+	anomalyRareCountryShare = 0.01
+	// distinct texts tracked per client and window, a spam run repeats a few of them
+	anomalyMaxTexts = 10000
+)
+
+// trafficBaseline is the outbound traffic of a client or a sending number, in the current and the
+// last window, and as moving averages over the windows before.
+type trafficBaseline struct {
+	client    string         // the client, for the baselines of numbers
+	start     time.Time      // of the current window
+	count     int            // messages in the current window
+	countries map[string]int // destination countries in the current window
+	texts     map[uint64]map[string]bool
+
+	last          int // the same of the last window
+	lastCountries map[string]int
+	lastTexts     map[uint64]map[string]bool
+
+	average  float64            // messages per window
+	mix      map[string]float64 // share of each destination country
+	prior    float64            // the average and the mix before the last window
+	priorMix map[string]float64
+	windows  int // windows in the averages
+}
+
+func newTrafficBaseline(client string, now time.Time) *trafficBaseline {
+	return &trafficBaseline{
+		client:    client,
+		start:     now,
+		countries: make(map[string]int),
+		texts:     make(map[uint64]map[string]bool),
+		mix:       make(map[string]float64),
+	}
+}
+
+// roll folds the windows that ended into the averages, idle windows count as windows without
+// messages.
+func (b *trafficBaseline) roll(now time.Time) {
+	ended := int(now.Sub(b.start) / anomalyWindow)
+	if ended == 0 {
+		return
+	}
+	alpha := 2 / float64(anomalyBaselineWindows+1)
+	b.prior, b.priorMix = b.average, maps.Clone(b.mix)
+	b.last, b.lastCountries, b.lastTexts = b.count, b.countries, b.texts
+	b.fold(alpha)
+	if ended > 1 {
+		// after three baselines of silence there is nothing left of the average
+		for i := 1; i < min(ended, 3*anomalyBaselineWindows); i++ {
+			b.average *= 1 - alpha
+			b.windows++
+		}
+		b.prior, b.priorMix = b.average, maps.Clone(b.mix)
+		b.last, b.lastCountries, b.lastTexts = 0, nil, nil
+	}
+	b.start = b.start.Add(time.Duration(ended) * anomalyWindow)
+	b.count = 0
+	b.countries = make(map[string]int)
+	b.texts = make(map[uint64]map[string]bool)
+}
+
+func (b *trafficBaseline) fold(alpha float64) {
+	if b.windows == 0 {
+		b.average = float64(b.count)
+	} else {
+		b.average = alpha*float64(b.count) + (1-alpha)*b.average
+	}
+	b.windows++
+	if b.count == 0 {
+		return
+	}
+
+	// a first window with traffic is the mix, later ones move it
+	weight := alpha
+	if len(b.mix) == 0 {
+		weight = 1
+	}
+	shares := make(map[string]float64, len(b.mix))
+	for country, share := range b.mix {
+		shares[country] = (1 - weight) * share
+	}
+	for country, count := range b.countries {
+		shares[country] += weight * float64(count) / float64(b.count)
+	}
+	for country, share := range shares {
+		if share < anomalyRareCountryShare/10 {
+			delete(b.mix, country)
+			continue
+		}
+		b.mix[country] = share
+	}
+}
+
+// recent estimates the messages and destination countries of the last window up to now, from the
+// current window and the part of the last one it doesn't cover yet.
+func (b *trafficBaseline) recent(now time.Time) (float64, map[string]float64) {
+	weight := max(0, 1-float64(now.Sub(b.start))/float64(anomalyWindow))
+	count := float64(b.count) + weight*float64(b.last)
+	countries := make(map[string]float64, len(b.countries))
+	for country, n := range b.countries {
+		countries[country] += float64(n)
+	}
+	for country, n := range b.lastCountries {
+		countries[country] += weight * float64(n)
+	}
+	return count, countries
+}
+
+// rareShare is the share of recent messages sent to countries the baseline rarely sends to, and
+// the most frequent of them.
+func (b *trafficBaseline) rareShare(count float64, countries map[string]float64) (float64, string) {
+	rare, top, topCount := 0.0, "", 0.0
+	for country, n := range countries {
+		if b.priorMix[country] >= anomalyRareCountryShare {
+			continue
+		}
+		rare += n
+		if n > topCount || (n == topCount && country < top) {
+			top, topCount = country, n
+		}
+	}
+	return rare / count, top
+}
+
+// mostRepeated is the most recipients a text was sent to in the current or the last window.
+func (b *trafficBaseline) mostRepeated() int {
+	most := 0
+	for _, texts := range []map[uint64]map[string]bool{b.texts, b.lastTexts} {
+		for _, recipients := range texts {
+			most = max(most, len(recipients))
+		}
+	}
+	return most
+}
+
+// trafficAnomalies tracks the outbound traffic of this instance.
+var trafficAnomalies = struct {
+	mu        sync.Mutex
+	clients   map[string]*trafficBaseline
+	numbers   map[string]*trafficBaseline
+	throttled map[string]*rate.Limiter // client: its limit while an anomaly lasts
+}{
+	clients:   make(map[string]*trafficBaseline),
+	numbers:   make(map[string]*trafficBaseline),
+	throttled: make(map[string]*rate.Limiter),
+}
+
+// TrafficThrottled reports whether a client is throttled for a traffic anomaly and over its limit.
+func TrafficThrottled(client string) bool {
+	trafficAnomalies.mu.Lock()
+	limiter, throttled := trafficAnomalies.throttled[client]
+	trafficAnomalies.mu.Unlock()
+	return throttled && !limiter.Allow()
+}
+
+// textHash identifies a text regardless of case and spacing.
+func textHash(text string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(strings.Fields(strings.ToLower(text)), " ")))
+	return h.Sum64()
+}
+
+// ObserveTraffic adds a message a client sends towards a carrier to the baselines of the client and
+// of the sending number.
+func ObserveTraffic(msg *MsgQueueItem, client *Client, now time.Time) {
+	country := CountryOf(msg.To)
+	if country == "" {
+		country = "unknown"
+	}
+
+	trafficAnomalies.mu.Lock()
+	defer trafficAnomalies.mu.Unlock()
+
+	byClient, ok := trafficAnomalies.clients[client.Username]
+	if !ok {
+		byClient = newTrafficBaseline(client.Username, now)
+		trafficAnomalies.clients[client.Username] = byClient
+	}
+	byNumber, ok := trafficAnomalies.numbers[msg.From]
+	if !ok {
+		byNumber = newTrafficBaseline(client.Username, now)
+		trafficAnomalies.numbers[msg.From] = byNumber
+	}
+	for _, baseline := range []*trafficBaseline{byClient, byNumber} {
+		baseline.roll(now)
+		baseline.count++
+		baseline.countries[country]++
+	}
+
+	// repeated texts are only tracked per client, a spam run spreads over its numbers
+	if anomalyDuplicateRecipients == 0 || strings.TrimSpace(msg.Message) == "" {
+		return
+	}
+	hash := textHash(msg.Message)
+	recipients, ok := byClient.texts[hash]
+	if !ok {
+		if len(byClient.texts) >= anomalyMaxTexts {
+			return
+		}
+		recipients = make(map[string]bool)
+		byClient.texts[hash] = recipients
+	}
+	if float64(len(recipients)) < anomalyDuplicateRecipients {
+		recipients[msg.To] = true
+	}
+}
+
+// baselineConditions evaluates the traffic spike and destination rules of one baseline.
+func baselineConditions(kind string, subject string, b *trafficBaseline, now time.Time) []alertCondition {
+	var conditions []alertCondition
+	// the baseline needs a window before the last one, e.g. after a restart
+	if b.windows < 2 {
+		return conditions
+	}
+	count, countries := b.recent(now)
+	if count < float64(anomalyMinMessages) {
+		return conditions
+	}
+
+	if anomalySpikeFactor > 0 {
+		if factor := count / max(b.prior, 1); factor >= anomalySpikeFactor {
+			conditions = append(conditions, alertCondition{
+				rule: AlertRules.TrafficSpike, subject: subject, value: factor, threshold: anomalySpikeFactor,
+				summary: fmt.Sprintf("%s %s sent %.0f messages in the last %s, %.1f times its baseline of %.1f",
+					kind, subject, count, anomalyWindow, factor, b.prior),
+			})
+		}
+	}
+
+	if anomalyDestinationShare > 0 && len(b.priorMix) > 0 {
+		if share, top := b.rareShare(count, countries); share >= anomalyDestinationShare {
+			conditions = append(conditions, alertCondition{
+				rule: AlertRules.DestinationAnomaly, subject: subject, value: share, threshold: anomalyDestinationShare,
+				summary: fmt.Sprintf("%s %s sent %.0f%% of %.0f messages to countries it rarely sends to, most to %s",
+					kind, subject, share*100, count, top),
+			})
+		}
+	}
+	return conditions
+}
+
+// anomalyConditions evaluates the anomaly rules of every client and sending number, and throttles
+// the clients with an anomaly when ANOMALY_ACTION is throttle. The rules compare the current window
+// with the baseline, so they fire at once rather than after ALERT_FOR.
+func (gateway *Gateway) anomalyConditions(now time.Time) []alertCondition {
+	var conditions []alertCondition
+	anomalous := make(map[string]string) // client: summary of its first anomaly
+
+	trafficAnomalies.mu.Lock()
+	for username, b := range trafficAnomalies.clients {
+		b.roll(now)
+		if b.windows > 3*anomalyBaselineWindows && b.average < 0.01 && b.count == 0 {
+			delete(trafficAnomalies.clients, username)
+			continue
+		}
+		found := baselineConditions("Client", username, b, now)
+
+		if anomalyDuplicateRecipients > 0 {
+			if most := b.mostRepeated(); float64(most) >= anomalyDuplicateRecipients {
+				found = append(found, alertCondition{
+					rule: AlertRules.DuplicateContent, subject: username, value: float64(most), threshold: anomalyDuplicateRecipients,
+					summary: fmt.Sprintf("Client %s sent the same text to %d recipients in the last %s", username, most, anomalyWindow),
+				})
+			}
+		}
+		for _, condition := range found {
+			if _, ok := anomalous[username]; !ok {
+				anomalous[username] = condition.summary
+			}
+		}
+		conditions = append(conditions, found...)
+	}
+	for number, b := range trafficAnomalies.numbers {
+		b.roll(now)
+		if b.windows > 3*anomalyBaselineWindows && b.average < 0.01 && b.count == 0 {
+			delete(trafficAnomalies.numbers, number)
+			continue
+		}
+		found := baselineConditions("Number", number, b, now)
+		for _, condition := range found {
+			if _, ok := anomalous[b.client]; !ok {
+				anomalous[b.client] = condition.summary
+			}
+		}
+		conditions = append(conditions, found...)
+	}
+	trafficAnomalies.mu.Unlock()
+
+	if anomalyAction == AnomalyActions.Throttle {
+		gateway.updateThrottles(anomalous)
+	}
+	sort.Slice(conditions, func(i, j int) bool { return conditions[i].key() < conditions[j].key() })
+	return conditions
+}
+
+// updateThrottles throttles the clients with an anomaly and lifts the throttle of the others.
+func (gateway *Gateway) updateThrottles(anomalous map[string]string) {
+	var lm = gateway.LogManager
+
+	trafficAnomalies.mu.Lock()
+	defer trafficAnomalies.mu.Unlock()
+	for username, summary := range anomalous {
+		if _, ok := trafficAnomalies.throttled[username]; ok {
+			continue
+		}
+		trafficAnomalies.throttled[username] = newTokenBucket(anomalyThrottleRate)
+		lm.SendLog(lm.BuildLog(
+			"System.Anomaly",
+			"TrafficThrottled",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"client": username,
+				"rate":   anomalyThrottleRate,
+			}, summary,
+		))
+	}
+	for username := range trafficAnomalies.throttled {
+		if _, ok := anomalous[username]; ok {
+			continue
+		}
+		delete(trafficAnomalies.throttled, username)
+		lm.SendLog(lm.BuildLog(
+			"System.Anomaly",
+			"TrafficThrottleLifted",
+			logrus.InfoLevel,
+			map[string]interface{}{
+				"client": username,
+			},
+		))
+	}
+}
@@ -0,0 +1,387 @@
+package core
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// UsageRollup is the usage of a client on one UTC day, rolled up from the CDRs so invoices
+// outlive CDR_RETENTION. Only accepted attempts are billed, failed attempts are counted apart.
+type UsageRollup struct {
+	ID         uint      `gorm:"primaryKey" json:"-"`
+	Day        time.Time `gorm:"type:date;uniqueIndex:idx_usage_rollup" json:"day"`
+	Client     string    `gorm:"uniqueIndex:idx_usage_rollup" json:"client"`
+	Direction  string    `gorm:"uniqueIndex:idx_usage_rollup" json:"direction"`
+	Route      string    `gorm:"uniqueIndex:idx_usage_rollup" json:"route"`
+	Type       string    `gorm:"uniqueIndex:idx_usage_rollup" json:"type"`
+	Messages   int64     `json:"messages"`
+	Segments   int64     `json:"segments"`
+	MediaCount int64     `json:"media_count"`
+	MediaBytes int64     `json:"media_bytes"`
+	Failed     int64     `json:"failed"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// UsageRate prices the usage of a type of message, per SMS segment or per MMS. Empty fields match
+// everything, the most specific rate applies: client over route over direction.
+type UsageRate struct {
+	ID        uint    `gorm:"primaryKey" json:"id"`
+	Client    string  `json:"client"`
+	Route     string  `json:"route"`
+	Direction string  `json:"direction"`
+	Type      string  `json:"type"` // sms or mms
+	Price     float64 `json:"price"`
+	Version   uint    `gorm:"not null;default:1" json:"version"`
+}
+
+// UsageLine is the rated usage of a client on a route in a billing period.
+type UsageLine struct {
+	Period     string  `json:"period"` // 2006-01-02 for daily, 2006-01 for monthly usage
+	Client     string  `json:"client"`
+	Direction  string  `json:"direction"`
+	Route      string  `json:"route"`
+	Type       string  `json:"type"`
+	Messages   int64   `json:"messages"`
+	Segments   int64   `json:"segments"`
+	MediaCount int64   `json:"media_count"`
+	MediaBytes int64   `json:"media_bytes"`
+	Failed     int64   `json:"failed"`
+	Quantity   int64   `json:"quantity"` // billed units: segments of SMS, messages of MMS
+	Price      float64 `json:"price"`
+	Amount     float64 `json:"amount"`
+	Currency   string  `json:"currency"`
+}
+
+var (
+	usageRollupInterval time.Duration
+	usageRollupLookback time.Duration
+	usageCurrency       string
+)
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		usageRollupInterval = cfg.Duration("USAGE_ROLLUP_INTERVAL", 15*time.Minute)
+		usageRollupLookback = cfg.Duration("USAGE_ROLLUP_LOOKBACK", 48*time.Hour)
+		usageCurrency = cfg.String("USAGE_CURRENCY", "USD")
+	})
+}
+
+// rollupUsage recomputes the usage of every UTC day since the day of from. Days are recomputed
+// whole, so rolling up again is always safe.
+func (gateway *Gateway) rollupUsage(from time.Time) error {
+	from = from.UTC().Truncate(24 * time.Hour)
+	if cdrRetention > 0 {
+		// a day partly purged would roll up short
+		if oldest := time.Now().Add(-cdrRetention).UTC().Truncate(24 * time.Hour).Add(24 * time.Hour); from.Before(oldest) {
+			from = oldest
+		}
+	}
+
+	return gateway.DB.Exec(`INSERT INTO usage_rollups
+		(day, client, direction, route, type, messages, segments, media_count, media_bytes, failed, updated_at)
+		SELECT (attempted_at AT TIME ZONE 'UTC')::date, client, direction, route, type,
+			count(*) FILTER (WHERE error = ''),
+			coalesce(sum(segments) FILTER (WHERE error = ''), 0),
+			coalesce(sum(media_count) FILTER (WHERE error = ''), 0),
+			coalesce(sum(media_size) FILTER (WHERE error = ''), 0),
+			count(*) FILTER (WHERE error <> ''),
+			now()
+		FROM cdrs WHERE attempted_at >= ?
+		GROUP BY 1, client, direction, route, type
+		ON CONFLICT (day, client, direction, route, type) DO UPDATE SET
+			messages = excluded.messages, segments = excluded.segments, media_count = excluded.media_count,
+			media_bytes = excluded.media_bytes, failed = excluded.failed, updated_at = excluded.updated_at`,
+		from,
+	).Error
+}
+
+// UsageRollups rolls up the recent CDRs every USAGE_ROLLUP_INTERVAL, late delivery statuses are
+// picked up for USAGE_ROLLUP_LOOKBACK.
+func (gateway *Gateway) UsageRollups() {
+	var lm = gateway.LogManager
+	ticker := time.NewTicker(usageRollupInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := gateway.rollupUsage(time.Now().Add(-usageRollupLookback)); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.Usage",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+		<-ticker.C
+	}
+}
+
+// rateFor returns the most specific rate of the usage, nil when none matches.
+func rateFor(rates []UsageRate, row UsageRollup) *UsageRate {
+	var best *UsageRate
+	bestScore := -1
+	for i := range rates {
+		rate := &rates[i]
+		if rate.Type != row.Type ||
+			rate.Client != "" && rate.Client != row.Client ||
+			rate.Route != "" && rate.Route != row.Route ||
+			rate.Direction != "" && rate.Direction != row.Direction {
+			continue
+		}
+		score := 0
+		if rate.Client != "" {
+			score += 4
+		}
+		if rate.Route != "" {
+			score += 2
+		}
+		if rate.Direction != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = rate, score
+		}
+	}
+	return best
+}
+
+// usageReport rates the usage of the days in [since, until) by day or by month, of one client or
+// all when client is empty.
+func (gateway *Gateway) usageReport(client string, monthly bool, since time.Time, until time.Time) ([]UsageLine, error) {
+	query := gateway.DB.Where("day >= ? AND day < ?", since, until)
+	if client != "" {
+		query = query.Where("client = ?", client)
+	}
+	var rows []UsageRollup
+	if err := query.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	var rates []UsageRate
+	if err := gateway.DB.Order("id asc").Find(&rates).Error; err != nil {
+		return nil, err
+	}
+
+	lines := make(map[string]*UsageLine)
+	for _, row := range rows {
+		period := row.Day.UTC().Format("2006-01-02")
+		if monthly {
+			period = row.Day.UTC().Format("2006-01")
+		}
+		key := period + "|" + row.Client + "|" + row.Direction + "|" + row.Route + "|" + row.Type
+		line, ok := lines[key]
+		if !ok {
+			line = &UsageLine{Period: period, Client: row.Client, Direction: row.Direction, Route: row.Route, Type: row.Type, Currency: usageCurrency}
+			if rate := rateFor(rates, row); rate != nil {
+				line.Price = rate.Price
+			}
+			lines[key] = line
+		}
+		line.Messages += row.Messages
+		line.Segments += row.Segments
+		line.MediaCount += row.MediaCount
+		line.MediaBytes += row.MediaBytes
+		line.Failed += row.Failed
+	}
+
+	report := make([]UsageLine, 0, len(lines))
+	for _, line := range lines {
+		line.Quantity = line.Segments
+		if line.Type == string(MsgQueueItemType.MMS) {
+			line.Quantity = line.Messages
+		}
+		line.Amount = math.Round(float64(line.Quantity)*line.Price*1e6) / 1e6
+		report = append(report, *line)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		a, b := report[i], report[j]
+		if a.Period != b.Period {
+			return a.Period < b.Period
+		}
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		return a.Type < b.Type
+	})
+	return report, nil
+}
+
+// writeUsageCSV answers with the report as a CSV attachment.
+func writeUsageCSV(ctx iris.Context, report []UsageLine, filename string) {
+	ctx.ContentType("text/csv; charset=utf-8")
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	w := csv.NewWriter(ctx.ResponseWriter())
+	_ = w.Write([]string{"period", "client", "direction", "route", "type", "messages", "segments", "media_count",
+		"media_bytes", "failed", "quantity", "price", "amount", "currency"})
+	for _, line := range report {
+		_ = w.Write([]string{
+			line.Period, line.Client, line.Direction, line.Route, line.Type,
+			strconv.FormatInt(line.Messages, 10),
+			strconv.FormatInt(line.Segments, 10),
+			strconv.FormatInt(line.MediaCount, 10),
+			strconv.FormatInt(line.MediaBytes, 10),
+			strconv.FormatInt(line.Failed, 10),
+			strconv.FormatInt(line.Quantity, 10),
+			strconv.FormatFloat(line.Price, 'f', -1, 64),
+			strconv.FormatFloat(line.Amount, 'f', -1, 64),
+			line.Currency,
+		})
+	}
+	w.Flush()
+}
+
+func validateUsageRate(rate *UsageRate) error {
+	if rate.Type != string(MsgQueueItemType.SMS) && rate.Type != string(MsgQueueItemType.MMS) {
+		return Invalid("type must be sms or mms")
+	}
+	switch rate.Direction {
+	case "", CDRDirections.Outbound, CDRDirections.Inbound, CDRDirections.Internal:
+	default:
+		return Invalid("direction must be outbound, inbound or internal")
+	}
+	if rate.Price < 0 {
+		return Invalid("price must not be negative")
+	}
+	return nil
+}
+
+// usagePeriod reads the since and until dates of a usage request, by default the current month.
+func usagePeriod(ctx iris.Context) (time.Time, time.Time, error) {
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	until := since.AddDate(0, 1, 0)
+	for param, value := range map[string]*time.Time{"since": &since, "until": &until} {
+		if s := ctx.URLParam(param); s != "" {
+			t, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return since, until, Invalid("%s must be a date like 2006-01-02", param)
+			}
+			*value = t
+		}
+	}
+	return since, until, nil
+}
+
+// SetupUsageRoutes sets up the usage export and the rates it is priced with.
+func SetupUsageRoutes(app *iris.Application, gateway *Gateway) {
+	usage := app.Party("/usage", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// Rated usage by day or month, as JSON or CSV
+		usage.Get("/", func(ctx iris.Context) {
+			since, until, err := usagePeriod(ctx)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			period := ctx.URLParamDefault("period", "month")
+			if period != "day" && period != "month" {
+				WriteProvisioningError(ctx, Invalid("period must be day or month"))
+				return
+			}
+
+			report, err := gateway.usageReport(ctx.URLParam("client"), period == "month", since, until)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if ctx.URLParam("format") == "csv" {
+				writeUsageCSV(ctx, report, fmt.Sprintf("usage-%s-%s.csv", since.Format("2006-01-02"), until.Format("2006-01-02")))
+				return
+			}
+			ctx.JSON(report)
+		})
+
+		// Monthly quotas of a client and its tenant with their use in the current cycles
+		usage.Get("/quota", func(ctx iris.Context) {
+			statuses, err := gateway.clientQuotas(ctx.URLParam("client"))
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(statuses)
+		})
+
+		// Roll up the CDRs since a date again, e.g. after changing CDRs or restoring them
+		usage.Post("/rollup", func(ctx iris.Context) {
+			since, _, err := usagePeriod(ctx)
+			if err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.rollupUsage(since); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Usage rolled up", "since": since.Format("2006-01-02")})
+		})
+
+		// List rates
+		usage.Get("/rates", func(ctx iris.Context) {
+			var list []UsageRate
+			if err := gateway.DB.Order("id asc").Find(&list).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(list)
+		})
+
+		// Add a rate
+		usage.Post("/rates", func(ctx iris.Context) {
+			var rate UsageRate
+			if err := ctx.ReadJSON(&rate); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			if err := validateUsageRate(&rate); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			rate.ID, rate.Version = 0, 0
+			if err := gateway.DB.Create(&rate).Error; err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(rate)
+		})
+
+		// Replace a rate, the body carries the version it was read with
+		usage.Put("/rates/{id:uint}", func(ctx iris.Context) {
+			var rate UsageRate
+			if err := ctx.ReadJSON(&rate); err != nil {
+				WriteProvisioningError(ctx, Invalid("invalid request data"))
+				return
+			}
+			rate.ID = ctx.Params().GetUintDefault("id", 0)
+			if err := validateUsageRate(&rate); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := UpdateVersioned(gateway.DB, &rate, rate.ID, &rate.Version, "*"); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(rate)
+		})
+
+		// Delete a rate
+		usage.Delete("/rates/{id:uint}", func(ctx iris.Context) {
+			if err := DeleteVersioned(gateway.DB, &UsageRate{}, ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Rate deleted"})
+		})
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package core
 
 // StringInArray checks if a string exists in an array of strings
 func StringInArray(target string, list []string) bool {
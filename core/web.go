@@ -0,0 +1,155 @@
+package core
+
+import (
+	"encoding/base64"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the addresses of the proxies whose PROXY headers and forwarded addresses are
+// trusted, from TRUSTED_PROXIES.
+var TrustedProxies []string
+
+func init() {
+	OnConfigure(func(cfg *Config) {
+		if cfg.Getenv("TRUSTED_PROXIES") == "" {
+			TrustedProxies = []string{"10.0.0.0/8",
+				"172.16.0.0/12",
+				"192.168.0.0/16",
+				"fc00::/7"}
+		} else {
+			TrustedProxies = strings.Split(cfg.Getenv("TRUSTED_PROXIES"), ",")
+		}
+	})
+}
+
+// IsTrustedProxy checks if an IP address is in any of the trusted subnets or IPs
+func IsTrustedProxy(ip string, trustedProxies []string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false // Invalid IP
+	}
+
+	for _, cidr := range trustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false // Invalid CIDR
+		}
+
+		if network.Contains(parsedIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BasicAuthMiddleware authenticates management requests with API_KEY or an API key, as the
+// password of Basic Authentication or as a Bearer token, checks the role and clients of the key
+// and records the requests that change something in the audit log.
+func (gateway *Gateway) BasicAuthMiddleware(ctx iris.Context) {
+	// Get the Authorization header
+	authHeader := ctx.GetHeader("Authorization")
+	if authHeader == "" {
+		// Missing Authorization header
+		unauthorized(ctx, gateway, "Authorization header missing")
+		return
+	}
+
+	var token string
+	switch {
+	case strings.HasPrefix(authHeader, "Bearer "):
+		token = strings.TrimSpace(authHeader[len("Bearer "):])
+	case strings.HasPrefix(authHeader, "Basic "):
+		// Decode the Base64 encoded credentials
+		decodedBytes, err := base64.StdEncoding.DecodeString(authHeader[len("Basic "):])
+		if err != nil {
+			// Failed to decode credentials
+			unauthorized(ctx, gateway, "Failed to decode credentials")
+			return
+		}
+		credentials := string(decodedBytes)
+
+		// In Basic Auth, credentials are in the format "username:password", the key is the password
+		colonIndex := indexOf(credentials, ':')
+		if colonIndex < 0 {
+			// Invalid credentials format
+			unauthorized(ctx, gateway, "Invalid credentials format")
+			return
+		}
+		token = credentials[colonIndex+1:]
+	default:
+		// Invalid Authorization header format
+		unauthorized(ctx, gateway, "Invalid Authorization header format")
+		return
+	}
+
+	key, ok := authenticate(token)
+	if !ok {
+		// Invalid API key
+		unauthorized(ctx, gateway, "Invalid API key")
+		return
+	}
+	ctx.Values().Set("apiKey", key)
+
+	changes := ctx.Method() != iris.MethodGet && ctx.Method() != iris.MethodHead
+	var body string
+	if changes {
+		body = auditBody(ctx)
+	}
+
+	if err := gateway.authorize(ctx, key); err != nil {
+		WriteProvisioningError(ctx, err)
+	} else {
+		// Authentication successful, proceed to the handler
+		ctx.Next()
+	}
+
+	if changes {
+		gateway.recordAudit(ctx, key, body)
+	}
+}
+
+// indexOf finds the index of the first occurrence of sep in s
+func indexOf(s string, sep byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == sep {
+			return i
+		}
+	}
+	return -1
+}
+
+// unauthorized responds with a 401 status and a WWW-Authenticate header
+func unauthorized(ctx iris.Context, gateway *Gateway, message string) {
+	// Log the unauthorized access attempt
+	var lm = gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Server.Web.AuthMiddleware",
+		"Unauthorized web client",
+		logrus.ErrorLevel,
+		map[string]interface{}{
+			"ip": ctx.Values().GetString("client_ip"),
+		},
+	))
+
+	// Set the WWW-Authenticate header to indicate Basic Auth is required
+	ctx.Header("WWW-Authenticate", `Basic realm="Restricted"`)
+
+	// Respond with 401 Unauthorized
+	ctx.StatusCode(http.StatusUnauthorized)
+	ctx.WriteString(message)
+}
+
+func IsPrivateIP(ip net.IP) bool {
+	for _, cidr := range TrustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
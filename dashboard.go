@@ -0,0 +1,207 @@
+package gateway
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"sort"
+	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/mm4"
+	"zultys-smpp-mm4/smppserver"
+)
+
+// dashboardHTML is the admin dashboard, a single page on top of the /admin and management APIs.
+//
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+// dashboardFlowWindow is the window of the per-client message counts on the dashboard.
+const dashboardFlowWindow = time.Hour
+
+// DashboardOverview is everything the dashboard refreshes periodically.
+type DashboardOverview struct {
+	ServerID     string                      `json:"server_id"`
+	Health       core.HealthReport           `json:"health"`
+	SMPPSessions []smppserver.SMPPClientInfo `json:"smpp_sessions"`
+	MM4Peers     []mm4.MM4PeerInfo           `json:"mm4_peers"`
+	QueueDepths  map[string]int              `json:"queue_depths"`
+	DeadLetters  map[string]int64            `json:"dead_letters"` // by origin queue
+	Carriers     []core.RouteHealthStatus    `json:"carriers"`
+	ClientFlow   []ClientFlow                `json:"client_flow"`
+}
+
+// ClientFlow counts the messages of a client in the last dashboardFlowWindow.
+type ClientFlow struct {
+	Client   string `json:"client"`
+	Sent     int64  `json:"sent"`     // received from the client
+	Received int64  `json:"received"` // delivered to the client
+}
+
+// clientFlow counts the message records of each client since the start of the window.
+func (gateway *Gateway) clientFlow(since time.Time) ([]ClientFlow, error) {
+	var rows []struct {
+		ClientID uint
+		Carrier  string
+		Count    int64
+	}
+	err := gateway.DB.Model(&core.MsgRecordDBItem{}).
+		Select("client_id, carrier, count(*) AS count").
+		Where("received_timestamp >= ?", since).
+		Group("client_id, carrier").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	flows := make(map[uint]*ClientFlow)
+	for _, row := range rows {
+		flow, ok := flows[row.ClientID]
+		if !ok {
+			flow = &ClientFlow{Client: fmt.Sprintf("#%d", row.ClientID)}
+			if client, found := gateway.ClientByID(row.ClientID); found {
+				flow.Client = client.Username
+			}
+			flows[row.ClientID] = flow
+		}
+		// records of messages sent carry the carrier they were sent to, or from_client when
+		// delivered to another client
+		switch row.Carrier {
+		case "to_client", "inbound":
+			flow.Received += row.Count
+		default:
+			flow.Sent += row.Count
+		}
+	}
+
+	list := make([]ClientFlow, 0, len(flows))
+	for _, flow := range flows {
+		list = append(list, *flow)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Sent+list[i].Received > list[j].Sent+list[j].Received })
+	return list, nil
+}
+
+// deadLetterCounts counts the dead letters by origin queue.
+func (gateway *Gateway) deadLetterCounts() (map[string]int64, error) {
+	var rows []struct {
+		Queue string
+		Count int64
+	}
+	if err := gateway.DB.Model(&core.DeadLetter{}).Select("queue, count(*) AS count").Group("queue").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Queue] = row.Count
+	}
+	return counts, nil
+}
+
+func (gateway *Gateway) dashboardOverview() (DashboardOverview, error) {
+	overview := DashboardOverview{
+		ServerID:     gateway.ServerID,
+		Health:       gateway.healthReport(),
+		SMPPSessions: []smppserver.SMPPClientInfo{},
+		MM4Peers:     []mm4.MM4PeerInfo{},
+		QueueDepths:  gateway.QueueDepths(),
+		Carriers:     gateway.Router.RouteHealth(),
+	}
+	if gateway.SMPPServer != nil {
+		overview.SMPPSessions = gateway.SMPPServer.Sessions()
+	}
+	if gateway.MM4Server != nil {
+		overview.MM4Peers = gateway.MM4Server.MM4Peers()
+	}
+
+	var err error
+	if overview.DeadLetters, err = gateway.deadLetterCounts(); err != nil {
+		return overview, err
+	}
+	overview.ClientFlow, err = gateway.clientFlow(time.Now().Add(-dashboardFlowWindow))
+	return overview, err
+}
+
+// SetupDashboardRoutes sets up the admin dashboard and the endpoints only it needs, dead letters,
+// carriers and message history come from their own APIs.
+func SetupDashboardRoutes(app *iris.Application, gateway *Gateway) {
+	admin := app.Party("/admin", gateway.BasicAuthMiddleware)
+	{
+		admin.Get("/", func(ctx iris.Context) {
+			ctx.ContentType("text/html; charset=utf-8")
+			ctx.Write(dashboardHTML)
+		})
+
+		// Sessions, queues, dead letters, carrier health and message flow at a glance
+		admin.Get("/overview", func(ctx iris.Context) {
+			overview, err := gateway.dashboardOverview()
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(overview)
+		})
+
+		// Issues of the last provisioning check
+		admin.Get("/provisioning/check", func(ctx iris.Context) {
+			ctx.JSON(iris.Map{"mode": provisioningCheckMode, "issues": currentProvisioningIssues()})
+		})
+
+		// Recent messages of a client, newest first
+		admin.Get("/clients/{username:string}/messages", func(ctx iris.Context) {
+			gateway.Mu.RLock()
+			client, ok := gateway.Clients[ctx.Params().Get("username")]
+			gateway.Mu.RUnlock()
+			if !ok {
+				core.WriteProvisioningError(ctx, core.ErrNotFound)
+				return
+			}
+
+			var records []core.MsgRecordDBItem
+			err := gateway.DB.Where("client_id = ?", client.ID).Order("id desc").
+				Limit(ctx.URLParamIntDefault("limit", 50)).Find(&records).Error
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			gateway.RevealRecords(ctx, records)
+			ctx.JSON(records)
+		})
+
+		// Bound SMPP sessions
+		admin.Get("/sessions/smpp", func(ctx iris.Context) {
+			if gateway.SMPPServer == nil {
+				ctx.JSON([]smppserver.SMPPClientInfo{})
+				return
+			}
+			ctx.JSON(gateway.SMPPServer.Sessions())
+		})
+
+		// SMPP sessions of every instance of the cluster
+		admin.Get("/sessions/cluster", func(ctx iris.Context) {
+			registrations := []core.SessionRegistration{}
+			if core.ClusterEnabled {
+				err := gateway.DB.Where("seen_at > ?", time.Now().Add(-core.ClusterSessionTTL)).
+					Order("username asc").Find(&registrations).Error
+				if err != nil {
+					core.WriteProvisioningError(ctx, err)
+					return
+				}
+			}
+			ctx.JSON(registrations)
+		})
+
+		// Close the SMPP session of a client
+		admin.Post("/sessions/smpp/{username:string}/kick", func(ctx iris.Context) {
+			if gateway.SMPPServer == nil {
+				core.WriteProvisioningError(ctx, core.ErrNotFound)
+				return
+			}
+			if err := gateway.SMPPServer.KickSession(ctx.Params().Get("username")); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Session closed"})
+		})
+	}
+}
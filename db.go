@@ -1,23 +1,27 @@
-package main
+package gateway
 
-import "fmt"
-
-func (gateway *Gateway) createIndexes() error {
-	// Create index on expires_at column
-	err := gateway.DB.Migrator().CreateIndex(&MediaFile{}, "ExpiresAt")
-	if err != nil {
-		return fmt.Errorf("failed to create index on expires_at: %v", err)
-	}
-	return nil
-}
+import (
+	"github.com/sirupsen/logrus"
+	"zultys-smpp-mm4/storage"
+)
 
+// migrateSchema applies the pending schema migrations, see schemaMigrations, and moves the stored
+// credentials to their current format.
 func (gateway *Gateway) migrateSchema() error {
-	if err := gateway.DB.AutoMigrate(&Client{}, &ClientNumber{}, &Carrier{}, &MediaFile{}, &MsgRecordDBItem{}); err != nil {
-		return err
-	}
-	err := gateway.createIndexes()
+	ran, err := storage.MigrateUp(gateway.DB)
 	if err != nil {
 		return err
 	}
-	return nil
+	if len(ran) > 0 {
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"System.Migration",
+			"SchemaMigrated",
+			logrus.InfoLevel,
+			map[string]interface{}{
+				"migrations": ran,
+			}, len(ran),
+		))
+	}
+	return gateway.MigrateCredentials()
 }
@@ -0,0 +1,450 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/carriers"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/proto/carrierplugin"
+	"zultys-smpp-mm4/proto/messaging"
+	"zultys-smpp-mm4/router"
+)
+
+// grpcStreamBuffer bounds the frames waiting to be written to a stream, events are dropped and
+// inbound messages go to SMPP or MM4 while it is full.
+var grpcStreamBuffer int
+
+// grpcInboundAckTimeout is how long a stream has to ack an inbound message written to it before
+// the message goes to SMPP or MM4.
+var grpcInboundAckTimeout time.Duration
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		grpcStreamBuffer = cfg.Int("GRPC_STREAM_BUFFER", 1000)
+		grpcInboundAckTimeout = cfg.Duration("GRPC_INBOUND_ACK_TIMEOUT", 10*time.Second)
+	})
+}
+
+// GRPCServer serves the messaging API of proto/messaging.proto, and the registration of carrier
+// plugins of proto/carrier_plugin.proto.
+type GRPCServer struct {
+	messaging.UnimplementedMessagingServer
+	gateway *Gateway
+	server  *grpc.Server
+}
+
+// apiStream is an open Messaging.Stream, it sees what its API key may see.
+type apiStream struct {
+	key  *core.APIKey
+	out  chan streamFrame
+	done <-chan struct{}
+
+	mu      sync.RWMutex
+	clients []string
+	events  []string
+	inbound bool
+	// pending are the inbound messages written and not acked yet, by message ID
+	pending map[string]chan struct{}
+}
+
+// streamFrame is a frame waiting to be written, sent gets the result of writing it when set.
+type streamFrame struct {
+	frame *messaging.ServerFrame
+	sent  chan error
+}
+
+// apiStreams are the streams open on this instance.
+var apiStreams struct {
+	mu   sync.RWMutex
+	list []*apiStream
+}
+
+// NewGRPCServer creates the gRPC server, with the certificate of the web server when
+// WEB_TLS_CERT is set.
+func NewGRPCServer(gateway *Gateway) (*GRPCServer, error) {
+	var opts []grpc.ServerOption
+	if cert := core.Getenv("WEB_TLS_CERT"); cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, core.Getenv("WEB_TLS_KEY"))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12})))
+	}
+	srv := &GRPCServer{gateway: gateway, server: grpc.NewServer(opts...)}
+	messaging.RegisterMessagingServer(srv.server, srv)
+	carrierplugin.RegisterGatewayServer(srv.server, carriers.NewPluginRegistrar(gateway.Gateway))
+	return srv, nil
+}
+
+// Start serves GRPC_LISTEN until the listener is handed to a new process.
+func (srv *GRPCServer) Start(address string) error {
+	listener, err := upgrades.Listen("grpc", address)
+	if err != nil {
+		return err
+	}
+	return srv.server.Serve(listener)
+}
+
+// streamKey authenticates the API key of a Messaging call, it needs the access of POST /messages.
+func streamKey(ctx context.Context) (*core.APIKey, error) {
+	return core.GRPCKey(ctx, "POST", "/messages")
+}
+
+// Stream submits the messages the integration sends and writes it the results, its events and
+// the inbound messages it subscribed to.
+func (srv *GRPCServer) Stream(stream messaging.Messaging_StreamServer) error {
+	key, err := streamKey(stream.Context())
+	if err != nil {
+		srv.logStream(stream.Context(), nil, logrus.WarnLevel, err)
+		return err
+	}
+
+	s := &apiStream{
+		key:     key,
+		out:     make(chan streamFrame, grpcStreamBuffer),
+		done:    stream.Context().Done(),
+		pending: make(map[string]chan struct{}),
+	}
+	apiStreams.mu.Lock()
+	apiStreams.list = append(apiStreams.list, s)
+	apiStreams.mu.Unlock()
+	defer removeStream(s)
+	srv.logStream(stream.Context(), key, logrus.InfoLevel, "opened")
+
+	written := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case frame := <-s.out:
+				err := stream.Send(frame.frame)
+				if frame.sent != nil {
+					frame.sent <- err
+				}
+				if err != nil {
+					written <- err
+					return
+				}
+			case <-s.done:
+				written <- nil
+				return
+			}
+		}
+	}()
+
+	received := make(chan error, 1)
+	go func() {
+		for {
+			frame, err := stream.Recv()
+			if err != nil {
+				received <- err
+				return
+			}
+			switch f := frame.Frame.(type) {
+			case *messaging.ClientFrame_Subscribe:
+				err = srv.subscribe(s, f.Subscribe)
+			case *messaging.ClientFrame_Submit:
+				result := srv.submit(key, f.Submit)
+				select {
+				case s.out <- streamFrame{frame: &messaging.ServerFrame{Frame: &messaging.ServerFrame_Result{Result: result}}}:
+				case <-s.done:
+				}
+			case *messaging.ClientFrame_InboundAck:
+				s.acked(f.InboundAck.MessageId)
+			}
+			if err != nil {
+				received <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err = <-written:
+	case err = <-received:
+	}
+	// the integration closing its side ends the stream
+	if errors.Is(err, io.EOF) || status.Code(err) == codes.Canceled {
+		err = nil
+	}
+	srv.logStream(stream.Context(), key, logrus.InfoLevel, "closed")
+	return err
+}
+
+func removeStream(s *apiStream) {
+	apiStreams.mu.Lock()
+	defer apiStreams.mu.Unlock()
+	for i, open := range apiStreams.list {
+		if open == s {
+			apiStreams.list = append(apiStreams.list[:i], apiStreams.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// subscribe replaces what a stream gets, the key has to be allowed to act for the clients.
+func (srv *GRPCServer) subscribe(s *apiStream, sub *messaging.Subscribe) error {
+	if sub.Inbound && len(sub.Clients) == 0 {
+		return status.Error(codes.InvalidArgument, "inbound messages need the clients listed")
+	}
+	for _, username := range sub.Clients {
+		if err := srv.gateway.CheckKeyScope(s.key, username); err != nil {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+	}
+	for _, eventType := range sub.Events {
+		if !core.StringInArray(eventType, core.EventTypeNames) {
+			return status.Errorf(codes.InvalidArgument, "unknown event type %s", eventType)
+		}
+	}
+	s.mu.Lock()
+	s.clients = sub.Clients
+	s.events = sub.Events
+	s.inbound = sub.Inbound
+	s.mu.Unlock()
+	return nil
+}
+
+// submit queues a message like POST /messages does.
+func (srv *GRPCServer) submit(key *core.APIKey, req *messaging.SubmitRequest) *messaging.SubmitResult {
+	message := core.MessageRequest{
+		Client:             req.Client,
+		From:               req.From,
+		To:                 req.To,
+		Message:            req.Message,
+		Template:           req.Template,
+		Variables:          req.Variables,
+		AllowInternational: req.AllowInternational,
+	}
+	for _, media := range req.Media {
+		message.Media = append(message.Media, core.MessageMedia{
+			Filename:    media.Filename,
+			ContentType: media.ContentType,
+			Content:     media.Content,
+		})
+	}
+
+	result := &messaging.SubmitResult{RequestId: req.RequestId, From: req.From, To: req.To}
+	err := srv.gateway.CheckKeyScope(key, srv.gateway.RequestClient(message))
+	var accepted core.MessageAccepted
+	if err == nil {
+		accepted, err = srv.gateway.SubmitMessage(message)
+	}
+	switch {
+	case err == nil:
+		result.MessageId = accepted.MessageID
+		result.Client = accepted.Client
+		result.From = accepted.From
+		result.To = accepted.To
+		result.Type = string(accepted.Type)
+		result.Segments = int32(accepted.Segments)
+		return result
+	case errors.Is(err, core.ErrInvalid):
+		result.ErrorCode = "invalid"
+	case errors.Is(err, core.ErrForbidden):
+		result.ErrorCode = "forbidden"
+	case errors.Is(err, core.ErrQueueFull):
+		result.ErrorCode = "queue_full"
+	default:
+		result.ErrorCode = "internal"
+	}
+	result.Error = err.Error()
+	return result
+}
+
+// sees reports whether the key of a stream may see an event.
+func (s *apiStream) sees(event core.Event) bool {
+	if !s.key.Scoped() {
+		return true
+	}
+	if event.Client == "" {
+		return s.key.TenantID != 0 && event.Tenant == s.key.TenantID && len(s.key.ClientList()) == 0
+	}
+	if s.key.TenantID != 0 && event.Tenant != s.key.TenantID {
+		return false
+	}
+	clients := s.key.ClientList()
+	return len(clients) == 0 || core.StringInArray(event.Client, clients)
+}
+
+// wants reports whether a stream subscribed to an event.
+func (s *apiStream) wants(event core.Event) bool {
+	if !s.sees(event) {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.clients) > 0 && !core.StringInArray(event.Client, s.clients) {
+		return false
+	}
+	return len(s.events) == 0 || core.StringInArray(event.Type, s.events)
+}
+
+// publishStreamEvent writes an event to the streams that want it, streams that can't keep up
+// miss it.
+func publishStreamEvent(event core.Event) {
+	apiStreams.mu.RLock()
+	defer apiStreams.mu.RUnlock()
+	if len(apiStreams.list) == 0 {
+		return
+	}
+	data, _ := json.Marshal(event.Data)
+	frame := streamFrame{frame: &messaging.ServerFrame{Frame: &messaging.ServerFrame_Event{Event: &messaging.Event{
+		Id:        event.ID,
+		Type:      event.Type,
+		CreatedAt: event.CreatedAt.UnixMilli(),
+		ServerId:  event.ServerID,
+		Client:    event.Client,
+		TenantId:  uint32(event.Tenant),
+		DataJson:  string(data),
+	}}}}
+	for _, s := range apiStreams.list {
+		if !s.wants(event) {
+			continue
+		}
+		select {
+		case s.out <- frame:
+		default:
+		}
+	}
+}
+
+// inboundStream is a stream of this instance subscribed to the inbound messages of a client.
+func inboundStream(client *core.Client) *apiStream {
+	apiStreams.mu.RLock()
+	defer apiStreams.mu.RUnlock()
+	for _, s := range apiStreams.list {
+		s.mu.RLock()
+		subscribed := s.inbound && core.StringInArray(client.Username, s.clients)
+		s.mu.RUnlock()
+		if subscribed {
+			return s
+		}
+	}
+	return nil
+}
+
+// awaitAck registers an inbound message written to the stream, the channel is closed when the
+// integration acks it.
+func (s *apiStream) awaitAck(messageID string) chan struct{} {
+	acked := make(chan struct{})
+	s.mu.Lock()
+	s.pending[messageID] = acked
+	s.mu.Unlock()
+	return acked
+}
+
+// acked marks an inbound message received by the integration, acks of messages not pending are
+// ignored.
+func (s *apiStream) acked(messageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if acked, ok := s.pending[messageID]; ok {
+		close(acked)
+		delete(s.pending, messageID)
+	}
+}
+
+// forget stops waiting for the ack of an inbound message.
+func (s *apiStream) forget(messageID string) {
+	s.mu.Lock()
+	delete(s.pending, messageID)
+	s.mu.Unlock()
+}
+
+// streamDecision delivers a message to a stream subscribed to the inbound messages of the client,
+// false when streamInbound leaves it to SMPP or MM4.
+func (gateway *Gateway) streamDecision(msg *core.MsgQueueItem, fromClient *core.Client, toClient *core.Client) (router.Decision, bool) {
+	if !gateway.streamInbound(msg, toClient) {
+		return router.Decision{}, false
+	}
+	return router.AckDecision(core.RoutingOutcomes.Delivered, "grpc:"+toClient.Username, router.ClientRecords(fromClient, toClient)...), true
+}
+
+// streamInbound delivers a message to a stream subscribed to the inbound messages of the
+// client and waits for the integration to ack it. It is false when there is no stream, it can't
+// keep up, or it closed or didn't ack the message within GRPC_INBOUND_ACK_TIMEOUT; the message then
+// goes to SMPP or MM4, so an integration that received it without acking may get it twice.
+func (gateway *Gateway) streamInbound(msg *core.MsgQueueItem, client *core.Client) bool {
+	s := inboundStream(client)
+	if s == nil {
+		return false
+	}
+	inbound := &messaging.InboundMessage{
+		MessageId:  msg.LogID,
+		Client:     client.Username,
+		Type:       string(msg.Type),
+		From:       msg.From,
+		To:         msg.To,
+		Message:    msg.Message,
+		ReceivedAt: msg.ReceivedTimestamp.UnixMilli(),
+	}
+	for _, file := range msg.Files {
+		content := file.Content
+		if len(content) == 0 && file.Base64Data != "" {
+			content, _ = base64.StdEncoding.DecodeString(file.Base64Data)
+		}
+		inbound.Media = append(inbound.Media, &messaging.Media{
+			Filename:    file.Filename,
+			ContentType: file.ContentType,
+			Content:     content,
+		})
+	}
+	acked := s.awaitAck(inbound.MessageId)
+	defer s.forget(inbound.MessageId)
+	sent := make(chan error, 1)
+	select {
+	case s.out <- streamFrame{frame: &messaging.ServerFrame{Frame: &messaging.ServerFrame_Inbound{Inbound: inbound}}, sent: sent}:
+	default:
+		return false
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			return false
+		}
+	case <-s.done:
+		return false
+	}
+	timeout := time.NewTimer(grpcInboundAckTimeout)
+	defer timeout.Stop()
+	select {
+	case <-acked:
+		return true
+	case <-timeout.C:
+		return false
+	case <-s.done:
+		return false
+	}
+}
+
+func (srv *GRPCServer) logStream(ctx context.Context, key *core.APIKey, level logrus.Level, event interface{}) {
+	fields := map[string]interface{}{}
+	if key != nil {
+		fields["apiKey"] = key.Name
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if agent := md.Get("user-agent"); len(agent) > 0 {
+			fields["userAgent"] = agent[0]
+		}
+	}
+	var lm = srv.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Server.GRPC.Stream",
+		"GRPCStream",
+		level,
+		fields, fmt.Sprint(event),
+	))
+}
@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/router"
+)
+
+// GatewayLease is a lease held by one instance at a time, the holder renews it and another
+// instance may take it once it expired.
+type GatewayLease struct {
+	Name       string    `gorm:"primaryKey" json:"name"`
+	Holder     string    `gorm:"not null" json:"holder"` // server ID
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// primaryLease is the lease of the active instance of an active/standby pair.
+const primaryLease = "primary"
+
+// haState is the role of this instance, primary when it holds the lease.
+var haState = struct {
+	mu      sync.RWMutex
+	primary bool
+	holder  string // of the lease, as last seen
+}{}
+
+// acquireLease takes the primary lease if nobody holds it, it expired or this instance held it
+// before a restart. It returns the previous holder, or the current one if the lease wasn't taken.
+func (gateway *Gateway) acquireLease() (string, bool, error) {
+	now := time.Now()
+	lease := &GatewayLease{Name: primaryLease, Holder: gateway.ServerID, AcquiredAt: now, ExpiresAt: now.Add(core.HALeaseTTL)}
+	result := gateway.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(lease)
+	if result.Error != nil || result.RowsAffected == 1 {
+		return "", result.Error == nil, result.Error
+	}
+
+	var current GatewayLease
+	if err := gateway.DB.Where("name = ?", primaryLease).First(&current).Error; err != nil {
+		return "", false, err
+	}
+	if current.Holder != gateway.ServerID && current.ExpiresAt.After(now) {
+		return current.Holder, false, nil
+	}
+	// taken unless another standby was faster
+	result = gateway.DB.Model(&GatewayLease{}).
+		Where("name = ? AND holder = ? AND expires_at = ?", primaryLease, current.Holder, current.ExpiresAt).
+		Updates(map[string]interface{}{"holder": gateway.ServerID, "acquired_at": now, "expires_at": now.Add(core.HALeaseTTL)})
+	if result.Error != nil {
+		return "", false, result.Error
+	}
+	return current.Holder, result.RowsAffected == 1, nil
+}
+
+// renewLease extends the primary lease, it fails with an error if another instance took it. A
+// renewal taking longer than HA_LEASE_RENEW is given up, the lease may expire in the meantime.
+func (gateway *Gateway) renewLease() error {
+	ctx, cancel := context.WithTimeout(context.Background(), core.HALeaseRenew)
+	defer cancel()
+	result := gateway.DB.WithContext(ctx).Model(&GatewayLease{}).
+		Where("name = ? AND holder = ?", primaryLease, gateway.ServerID).
+		Update("expires_at", time.Now().Add(core.HALeaseTTL))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+var errLeaseLost = fmt.Errorf("another instance took the primary lease")
+
+// awaitPrimary waits as the standby until this instance holds the primary lease, takes over the
+// work the previous primary left behind and keeps renewing the lease.
+func (gateway *Gateway) awaitPrimary() {
+	var lm = gateway.LogManager
+
+	ticker := time.NewTicker(core.HALeaseRenew)
+	defer ticker.Stop()
+
+	for {
+		previous, acquired, err := gateway.acquireLease()
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.HA",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+		haState.mu.Lock()
+		haState.primary, haState.holder = acquired, previous
+		if acquired {
+			haState.holder = gateway.ServerID
+		}
+		haState.mu.Unlock()
+
+		if acquired {
+			lm.SendLog(lm.BuildLog(
+				"System.HA",
+				"HAPrimaryAcquired",
+				logrus.WarnLevel,
+				map[string]interface{}{
+					"previous": previous,
+				}, gateway.ServerID,
+			))
+			if previous != "" && previous != gateway.ServerID {
+				gateway.takeOver(previous)
+			}
+			go gateway.LeaseKeeper()
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// takeOver re-drives what the failed primary persisted but didn't finish: its outbox is replayed
+// by this instance, its sends to carriers are given up so their messages are sent again when
+// RabbitMQ redelivers them, and the messages it held are flushed to the clients binding here.
+func (gateway *Gateway) takeOver(previous string) {
+	var lm = gateway.LogManager
+
+	steps := []struct {
+		name string
+		run  func() (int64, error)
+	}{
+		{"outbox", func() (int64, error) {
+			result := gateway.DB.Model(&core.OutboxMessage{}).Where("owner = ?", previous).Update("owner", gateway.ServerID)
+			return result.RowsAffected, result.Error
+		}},
+		{"carrier_sends", func() (int64, error) {
+			// the claims treat the sends as stale, see claimCarrierSend
+			result := gateway.DB.Model(&core.CarrierSend{}).
+				Where("server_id = ? AND status = ?", previous, core.CarrierSendStatuses.Pending).
+				Update("updated_at", time.Now().Add(-router.CarrierSendLease))
+			return result.RowsAffected, result.Error
+		}},
+		{"held_messages", func() (int64, error) {
+			return 0, gateway.Router.LoadHeldClients()
+		}},
+	}
+
+	fields := map[string]interface{}{"previous": previous}
+	for _, step := range steps {
+		count, err := step.run()
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.HA",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"step": step.name,
+				}, err,
+			))
+			continue
+		}
+		if step.name != "held_messages" {
+			fields[step.name] = count
+		}
+	}
+	lm.SendLog(lm.BuildLog(
+		"System.HA",
+		"HATakeOver",
+		logrus.WarnLevel,
+		fields, previous,
+	))
+}
+
+// LeaseKeeper renews the primary lease of this instance. It steps down once another instance took
+// the lease, or when the lease wasn't renewed for HA_LEASE_TTL minus HA_LEASE_RENEW, before a
+// standby may take it, so two instances never serve at the same time. Stepping down stops the
+// gateway and Run returns the error, restarted the instance comes back as the standby.
+func (gateway *Gateway) LeaseKeeper() {
+	var lm = gateway.LogManager
+
+	ticker := time.NewTicker(core.HALeaseRenew)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for range ticker.C {
+		err := gateway.renewLease()
+		if err == nil {
+			renewed = time.Now()
+			continue
+		}
+		lm.SendLog(lm.BuildLog(
+			"System.HA",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil, err,
+		))
+		if err == errLeaseLost || time.Since(renewed) >= core.HALeaseTTL-core.HALeaseRenew {
+			gateway.stepDown(err)
+			return
+		}
+	}
+}
+
+// stepDown gives up the primary role: the instance reports itself as the standby and stops, see
+// Gateway.Stop.
+func (gateway *Gateway) stepDown(err error) {
+	haState.mu.Lock()
+	haState.primary = false
+	haState.mu.Unlock()
+
+	var lm = gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"System.HA",
+		"HAPrimaryLost",
+		logrus.ErrorLevel,
+		nil, err,
+	))
+	gateway.Stop(fmt.Errorf("lost the primary lease: %w", err))
+}
+
+// checkHA reports the role of this instance, a standby isn't ready for traffic.
+func checkHA() core.HealthCheck {
+	haState.mu.RLock()
+	defer haState.mu.RUnlock()
+	if haState.primary {
+		return core.HealthCheck{Status: core.HealthOK, Detail: "primary"}
+	}
+	if haState.holder == "" {
+		return core.HealthCheck{Status: core.HealthFail, Detail: "standby"}
+	}
+	return core.HealthCheck{Status: core.HealthFail, Detail: "standby, the primary is " + haState.holder}
+}
@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"zultys-smpp-mm4/core"
+)
+
+// checkCarriers reports the health of the carrier routes, including the last health probe of
+// their API and credentials. A failed carrier is failed over to the other routes, so it only
+// degrades the gateway.
+func (gateway *Gateway) checkCarriers() core.HealthCheck {
+	check := core.HealthCheck{Status: core.HealthOK, Routes: gateway.Router.RouteHealth()}
+	down := 0
+	for _, route := range check.Routes {
+		if !route.Healthy || route.ProbeError != "" {
+			down++
+		}
+	}
+	if down > 0 {
+		check.Status = core.HealthDegraded
+		check.Detail = fmt.Sprintf("%d of %d carrier routes failing", down, len(check.Routes))
+	}
+	return check
+}
+
+// healthReport runs every check.
+func (gateway *Gateway) healthReport() core.HealthReport {
+	report := core.HealthReport{Status: core.HealthOK, Checks: make(map[string]core.HealthCheck)}
+	report.Checks["postgres"] = gateway.CheckPostgres()
+	report.Checks["amqp"] = gateway.CheckQueue()
+	report.Checks["carriers"] = gateway.checkCarriers()
+
+	report.Checks["smpp"] = core.HealthCheck{Status: core.HealthFail, Detail: "not started yet"}
+	if gateway.SMPPServer != nil {
+		report.Checks["smpp"] = gateway.SMPPServer.Status.Check()
+	}
+	report.Checks["mm4"] = core.HealthCheck{Status: core.HealthFail, Detail: "not started yet"}
+	if gateway.MM4Server != nil {
+		report.Checks["mm4"] = gateway.MM4Server.Status.Check()
+	}
+	if core.HAEnabled {
+		report.Checks["ha"] = checkHA()
+	}
+	if gateway.Archive != nil {
+		report.Checks["archive"] = gateway.CheckArchive()
+	}
+
+	for _, check := range report.Checks {
+		if check.Status == core.HealthFail {
+			report.Status = core.HealthFail
+			break
+		}
+		if check.Status == core.HealthDegraded {
+			report.Status = core.HealthDegraded
+		}
+	}
+	return report
+}
+
+// SetupHealthRoutes sets up the unauthenticated probes, both report every dependency check.
+// /healthz is the liveness probe and answers 200 as long as the gateway serves HTTP: the gateway
+// exits when the SMPP or MM4 listener fails, and Postgres and RabbitMQ outages are waited out
+// rather than fixed by a restart. /readyz answers 503 while a dependency check fails.
+func SetupHealthRoutes(app *iris.Application, gateway *Gateway) {
+	app.Get("/healthz", func(ctx iris.Context) {
+		report := gateway.healthReport()
+		if report.Status == core.HealthFail {
+			// alive, the failing dependencies are only a reason to stop sending traffic
+			report.Status = core.HealthDegraded
+		}
+		ctx.JSON(report)
+	})
+
+	app.Get("/readyz", func(ctx iris.Context) {
+		report := gateway.healthReport()
+		if report.Status == core.HealthFail {
+			ctx.StatusCode(iris.StatusServiceUnavailable)
+		}
+		ctx.JSON(report)
+	})
+}
@@ -0,0 +1,46 @@
+package mm4
+
+import (
+	"sort"
+	"time"
+)
+
+// MM4PeerInfo is the last MM4 activity of a client, peers are tracked by the hash of their IP.
+type MM4PeerInfo struct {
+	Client       string    `json:"client"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// Peers returns when the MM4 peers were last active, by their hashed IP.
+func (s *Server) Peers() map[string]time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	peers := make(map[string]time.Time, len(s.connectedClients))
+	for hashedIP, lastActivity := range s.connectedClients {
+		peers[hashedIP] = lastActivity
+	}
+	return peers
+}
+
+// MM4Peers lists the last MM4 activity of each client.
+func (s *Server) MM4Peers() []MM4PeerInfo {
+	s.gateway.Mu.RLock()
+	clients := make(map[string]string, len(s.gateway.Clients))
+	for _, client := range s.gateway.Clients {
+		clients[hashIP(client.Address)] = client.Username
+	}
+	s.gateway.Mu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	peers := make([]MM4PeerInfo, 0, len(s.connectedClients))
+	for hashedIP, lastActivity := range s.connectedClients {
+		client, ok := clients[hashedIP]
+		if !ok {
+			client = "unknown"
+		}
+		peers = append(peers, MM4PeerInfo{Client: client, LastActivity: lastActivity})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].LastActivity.After(peers[j].LastActivity) })
+	return peers
+}
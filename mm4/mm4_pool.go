@@ -0,0 +1,298 @@
+package mm4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// The outbound MM4 connections kept per peer: open at most, how long one may sit idle before it is
+// closed, and the transactions sent over one before it is closed and the next one dialed.
+var (
+	mm4PoolMaxConns        int
+	mm4PoolIdleTimeout     time.Duration
+	mm4PoolMaxTransactions int
+)
+
+// Events of the pooled connections, the event label of mm4_pool_connections_total.
+const (
+	mm4PoolDialed  = "dialed"
+	mm4PoolReused  = "reused"
+	mm4PoolStale   = "stale"   // the peer closed the idle connection, or didn't answer RSET
+	mm4PoolIdle    = "idle"    // closed after MM4_POOL_IDLE_TIMEOUT unused
+	mm4PoolRetired = "retired" // closed after MM4_POOL_MAX_TRANSACTIONS
+	mm4PoolBroken  = "broken"  // closed after an error left it in an unknown state
+)
+
+var mm4PoolConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mm4_pool_connections_total",
+	Help: "Outbound MM4 connections dialed, reused and closed by client and event",
+}, []string{"client", "event"})
+
+func init() {
+	prometheus.MustRegister(mm4PoolConnections)
+	core.OnConfigure(func(cfg *core.Config) {
+		mm4PoolMaxConns = cfg.Int("MM4_POOL_MAX_CONNS", 4)
+		mm4PoolIdleTimeout = cfg.Duration("MM4_POOL_IDLE_TIMEOUT", 30*time.Second)
+		mm4PoolMaxTransactions = cfg.Int("MM4_POOL_MAX_TRANSACTIONS", 100)
+	})
+}
+
+// mm4Pool holds the outbound connections to the MM4 servers of the clients, by peer. A peer is a
+// client at an address, a client whose address changed dials afresh.
+type mm4Pool struct {
+	mu    sync.Mutex
+	peers map[string]*mm4Peer
+}
+
+type mm4Peer struct {
+	slots chan struct{} // taken by the connections open, idle or busy
+	idle  []*mm4Conn    // most recently used last
+}
+
+// mm4Conn is a session the pool keeps open between transactions.
+type mm4Conn struct {
+	session      *Session
+	peer         *mm4Peer
+	transactions int
+	idleSince    time.Time
+}
+
+func newMM4Pool() *mm4Pool {
+	return &mm4Pool{peers: make(map[string]*mm4Peer)}
+}
+
+func (pool *mm4Pool) peer(client *core.Client) *mm4Peer {
+	key := client.Username + "@" + client.Address
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	peer, ok := pool.peers[key]
+	if !ok {
+		peer = &mm4Peer{slots: make(chan struct{}, mm4PoolMaxConns)}
+		pool.peers[key] = peer
+	}
+	return peer
+}
+
+// getMM4Conn returns a session to the client for one transaction, an idle one when there is one
+// and it still answers RSET, a new one otherwise. It waits for a connection to be released when
+// MM4_POOL_MAX_CONNS are open, failing with a congestion error once ctx ends. The session is
+// handed back with pool.put.
+func (s *Server) getMM4Conn(ctx context.Context, client *core.Client) (*mm4Conn, error) {
+	pool := s.pool
+	peer := pool.peer(client)
+
+	for {
+		pool.mu.Lock()
+		n := len(peer.idle)
+		if n == 0 {
+			pool.mu.Unlock()
+			break
+		}
+		conn := peer.idle[n-1]
+		peer.idle = peer.idle[:n-1]
+		pool.mu.Unlock()
+
+		if time.Since(conn.idleSince) > mm4PoolIdleTimeout {
+			conn.close(mm4PoolIdle, true)
+			continue
+		}
+		conn.session.setDeadline(ctx)
+		conn.session.transcript.transaction()
+		if err := conn.session.reset(); err != nil {
+			conn.close(mm4PoolStale, false)
+			continue
+		}
+		mm4PoolConnections.WithLabelValues(client.Username, mm4PoolReused).Inc()
+		return conn, nil
+	}
+
+	select {
+	case peer.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, core.ClassifyError(core.ErrorClasses.Congestion, "", fmt.Errorf("all %d MM4 connections to %s busy: %w", mm4PoolMaxConns, client.Username, ctx.Err()))
+	}
+	session, err := s.dialClient(ctx, client)
+	if err != nil {
+		<-peer.slots
+		return nil, err
+	}
+	mm4PoolConnections.WithLabelValues(client.Username, mm4PoolDialed).Inc()
+	return &mm4Conn{session: session, peer: peer}, nil
+}
+
+// put hands a session back after its transaction, err is how the transaction ended. Sessions
+// left in an unknown state are closed, a rejected message leaves the session usable.
+func (pool *mm4Pool) put(conn *mm4Conn, err error) {
+	var smtpErr *core.SMTPError
+	if err != nil && (!errors.As(err, &smtpErr) || smtpErr.Code == 421) {
+		conn.close(mm4PoolBroken, false)
+		return
+	}
+	conn.transactions++
+	if conn.transactions >= mm4PoolMaxTransactions {
+		conn.close(mm4PoolRetired, true)
+		return
+	}
+	conn.idleSince = time.Now()
+	pool.mu.Lock()
+	conn.peer.idle = append(conn.peer.idle, conn)
+	pool.mu.Unlock()
+}
+
+// close closes the connection and frees its slot, with QUIT when the session is still usable.
+func (conn *mm4Conn) close(event string, quit bool) {
+	if quit {
+		conn.session.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_ = conn.session.quit()
+	}
+	_ = conn.session.Conn.Close()
+	<-conn.peer.slots
+	mm4PoolConnections.WithLabelValues(conn.session.Client.Username, event).Inc()
+}
+
+// sweepPool closes the connections idle for longer than MM4_POOL_IDLE_TIMEOUT, before the peers
+// drop them on their side.
+func (s *Server) sweepPool() {
+	pool := s.pool
+	ticker := time.NewTicker(mm4PoolIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []*mm4Conn
+		pool.mu.Lock()
+		for _, peer := range pool.peers {
+			kept := peer.idle[:0]
+			for _, conn := range peer.idle {
+				if time.Since(conn.idleSince) > mm4PoolIdleTimeout {
+					expired = append(expired, conn)
+				} else {
+					kept = append(kept, conn)
+				}
+			}
+			peer.idle = kept
+		}
+		pool.mu.Unlock()
+		for _, conn := range expired {
+			conn.close(mm4PoolIdle, true)
+		}
+	}
+}
+
+// setDeadline bounds the next transaction of the session to 30s, or to the deadline of ctx if it
+// is sooner.
+func (s *Session) setDeadline(ctx context.Context) {
+	deadline := time.Now().Add(30 * time.Second)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	s.Conn.SetDeadline(deadline)
+}
+
+// reset clears the state of a reused session, and checks that the peer still answers.
+func (s *Session) reset() error {
+	if err := s.sendCommand("RSET"); err != nil {
+		return err
+	}
+	response, err := s.readResponse()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(response, "250") {
+		return fmt.Errorf("RSET command failed: %s", response)
+	}
+	return nil
+}
+
+// readReply reads a reply of the peer to its last line, the lines of a multiline reply (RFC 5321
+// 4.2.1) have a "-" after the code.
+func (s *Session) readReply() ([]string, error) {
+	var lines []string
+	for {
+		line, err := s.readResponse()
+		lines = append(lines, line)
+		if err != nil || len(line) < 4 || line[3] != '-' {
+			return lines, err
+		}
+	}
+}
+
+// startTransaction sends MAIL FROM, a RCPT TO for each recipient and DATA, and checks their
+// responses. When the peer supports PIPELINING (RFC 2920) the commands go out in one write and
+// the responses are read after, else one at a time.
+func (s *Session) startTransaction(from string, to []string) error {
+	type command struct {
+		command string
+		expect  string
+	}
+	commands := []command{{fmt.Sprintf("MAIL FROM:<%s>", from), "250"}}
+	for _, recipient := range to {
+		commands = append(commands, command{fmt.Sprintf("RCPT TO:<%s>", recipient), "250"})
+	}
+	commands = append(commands, command{"DATA", "354"})
+
+	if !s.pipelining {
+		for _, c := range commands {
+			if err := s.sendCommand(c.command); err != nil {
+				return err
+			}
+			response, err := s.readResponse()
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(response, c.expect) {
+				return fmt.Errorf("%s command failed: %s", c.command, response)
+			}
+		}
+		return nil
+	}
+
+	for _, c := range commands {
+		s.transcript.record(true, c.command)
+		if _, err := s.Writer.WriteString(c.command + "\r\n"); err != nil {
+			return fmt.Errorf("failed to send command '%s'", c.command)
+		}
+	}
+	if err := s.Writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush commands: %v", err)
+	}
+	var failed error
+	var response string
+	for _, c := range commands {
+		var err error
+		response, err = s.readResponse()
+		var smtpErr *core.SMTPError
+		if err != nil && !errors.As(err, &smtpErr) {
+			return err
+		}
+		if failed == nil && err != nil {
+			failed = err
+		} else if failed == nil && !strings.HasPrefix(response, c.expect) {
+			failed = fmt.Errorf("%s command failed: %s", c.command, response)
+		}
+	}
+	if failed != nil && strings.HasPrefix(response, "354") {
+		// the peer took DATA after refusing the sender or a recipient, the session is closed
+		// rather than ending an empty message, the pool drops it as stale
+		_ = s.Conn.Close()
+	}
+	return failed
+}
+
+// hasExtension reports whether an EHLO reply advertises the extension.
+func hasExtension(lines []string, extension string) bool {
+	for _, line := range lines[min(1, len(lines)):] {
+		if len(line) < 4 {
+			continue
+		}
+		if fields := strings.Fields(line[4:]); len(fields) > 0 && strings.EqualFold(fields[0], extension) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,412 @@
+package mm4
+
+import (
+	"bufio"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// MM4 transcript captures record the SMTP conversations with a peer, the connections it opens to
+// the MM4 server and the deliveries the gateway makes to it, a transaction per MAIL FROM. Message
+// bodies are reduced to their size unless MM4_TRACE_BODY_BYTES keeps their start, the headers are
+// kept. Captures are kept in memory by the instance that had the conversations.
+var (
+	mm4TraceTransactions int
+	mm4TraceMaxCaptures  int
+	mm4TraceMaxDuration  time.Duration
+	mm4TraceBodyBytes    int
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		mm4TraceTransactions = cfg.Int("MM4_TRACE_TRANSACTIONS", 50)
+		mm4TraceMaxCaptures = cfg.Int("MM4_TRACE_MAX_CAPTURES", 10)
+		mm4TraceMaxDuration = cfg.Duration("MM4_TRACE_MAX_DURATION", time.Hour)
+		mm4TraceBodyBytes = cfg.Int("MM4_TRACE_BODY_BYTES", 0)
+	})
+}
+
+// mm4TranscriptMaxLines bounds the lines of a transaction, a peer looping on NOOP would otherwise
+// grow it without end.
+const mm4TranscriptMaxLines = 500
+
+// MM4Capture is a capture of the conversations with a client, or with any peer connecting from an
+// IP, including ones denied access. It records until it is stopped or Until passes and keeps the
+// last MM4_TRACE_TRANSACTIONS transactions.
+type MM4Capture struct {
+	ID           uint             `json:"id"`
+	Client       string           `json:"client,omitempty"`
+	IP           string           `json:"ip,omitempty"`
+	StartedAt    time.Time        `json:"started_at"`
+	Until        time.Time        `json:"until"`
+	Stopped      bool             `json:"stopped"`
+	Captured     int              `json:"captured"`
+	Transactions []MM4Transaction `json:"transactions,omitempty"`
+
+	recorded []*MM4Transaction
+	next     int
+}
+
+// MM4Transaction is an SMTP transaction: inbound ones the peer opened, outbound ones are deliveries
+// of the gateway. Lines sent by the gateway are "out".
+type MM4Transaction struct {
+	StartedAt time.Time        `json:"started_at"`
+	Direction string           `json:"direction"` // "inbound" or "outbound"
+	Client    string           `json:"client,omitempty"`
+	Remote    string           `json:"remote"`
+	Lines     []TranscriptLine `json:"lines"`
+	Truncated bool             `json:"truncated,omitempty"` // lines past mm4TranscriptMaxLines were dropped
+}
+
+// TranscriptLine is a command or response, or a message sent with DATA summarized by its headers.
+type TranscriptLine struct {
+	Time      time.Time            `json:"time"`
+	Direction string               `json:"direction"` // "in" or "out"
+	Line      string               `json:"line,omitempty"`
+	Headers   textproto.MIMEHeader `json:"headers,omitempty"`
+	BodySize  int                  `json:"body_size,omitempty"`
+	Body      string               `json:"body,omitempty"` // the first MM4_TRACE_BODY_BYTES of the body
+}
+
+// mm4Tracer holds the captures of the MM4 server.
+type mm4Tracer struct {
+	mu       sync.Mutex
+	captures map[uint]*MM4Capture
+	nextID   uint
+	active   atomic.Int32 // captures recording, conversations aren't recorded without any
+}
+
+func newMM4Tracer() *mm4Tracer {
+	return &mm4Tracer{captures: make(map[uint]*MM4Capture)}
+}
+
+// mm4Transcript records the conversation of a session into the captures matching its peer.
+type mm4Transcript struct {
+	tracer    *mm4Tracer
+	direction string
+	client    string
+	ip        string
+	remote    string
+	tx        *MM4Transaction // nil while no capture matches
+	mailSeen  bool
+}
+
+// open starts the transcript of a session with the peer, outbound for deliveries of the gateway.
+func (t *mm4Tracer) open(outbound bool, client *core.Client, ip string, remote string) *mm4Transcript {
+	transcript := &mm4Transcript{tracer: t, direction: "inbound", ip: ip, remote: remote}
+	if outbound {
+		transcript.direction = "outbound"
+	}
+	if client != nil {
+		transcript.client = client.Username
+	}
+	transcript.transaction()
+	return transcript
+}
+
+// transaction starts the next transaction, in the captures matching the peer at that time.
+func (transcript *mm4Transcript) transaction() {
+	transcript.tx, transcript.mailSeen = nil, false
+	t := transcript.tracer
+	if t.active.Load() == 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, capture := range t.captures {
+		if capture.Stopped {
+			continue
+		}
+		if now.After(capture.Until) {
+			t.stop(capture)
+			continue
+		}
+		if (capture.Client == "" || capture.Client != transcript.client) && (capture.IP == "" || capture.IP != transcript.ip) {
+			continue
+		}
+		if transcript.tx == nil {
+			transcript.tx = &MM4Transaction{
+				StartedAt: now,
+				Direction: transcript.direction,
+				Client:    transcript.client,
+				Remote:    transcript.remote,
+				Lines:     []TranscriptLine{},
+			}
+		}
+		capture.add(transcript.tx)
+	}
+}
+
+// record records a command or response, outbound when the gateway sent it. A MAIL FROM after one
+// was seen starts the next transaction.
+func (transcript *mm4Transcript) record(outbound bool, line string) {
+	if transcript == nil {
+		return
+	}
+	if strings.HasPrefix(strings.ToUpper(line), "MAIL ") {
+		if transcript.mailSeen {
+			transcript.transaction()
+		}
+		transcript.mailSeen = true
+	}
+	transcript.append(TranscriptLine{Direction: traceDirection(outbound), Line: line})
+}
+
+// message records the message of a DATA command by its headers and body.
+func (transcript *mm4Transcript) message(outbound bool, headers textproto.MIMEHeader, body []byte) {
+	if transcript == nil || transcript.tx == nil {
+		return
+	}
+	entry := TranscriptLine{Direction: traceDirection(outbound), Headers: headers, BodySize: len(body)}
+	if mm4TraceBodyBytes > 0 {
+		entry.Body = string(body[:min(len(body), mm4TraceBodyBytes)])
+	}
+	transcript.append(entry)
+}
+
+// messageData records a message written with DATA, headers and body as they go on the wire.
+func (transcript *mm4Transcript) messageData(outbound bool, data string) {
+	if transcript == nil || transcript.tx == nil {
+		return
+	}
+	reader := bufio.NewReader(strings.NewReader(data))
+	headers, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil && headers == nil {
+		headers = textproto.MIMEHeader{}
+	}
+	body, _ := io.ReadAll(reader)
+	transcript.message(outbound, headers, body)
+}
+
+func (transcript *mm4Transcript) append(entry TranscriptLine) {
+	if transcript == nil || transcript.tx == nil {
+		return
+	}
+	entry.Time = time.Now()
+	transcript.tracer.mu.Lock()
+	defer transcript.tracer.mu.Unlock()
+	if len(transcript.tx.Lines) >= mm4TranscriptMaxLines {
+		transcript.tx.Truncated = true
+		return
+	}
+	transcript.tx.Lines = append(transcript.tx.Lines, entry)
+}
+
+func traceDirection(outbound bool) string {
+	if outbound {
+		return "out"
+	}
+	return "in"
+}
+
+func (t *mm4Tracer) stop(capture *MM4Capture) {
+	if !capture.Stopped {
+		capture.Stopped = true
+		t.active.Add(-1)
+	}
+}
+
+func (capture *MM4Capture) add(tx *MM4Transaction) {
+	capture.Captured++
+	if len(capture.recorded) < mm4TraceTransactions {
+		capture.recorded = append(capture.recorded, tx)
+		return
+	}
+	capture.recorded[capture.next] = tx
+	capture.next = (capture.next + 1) % len(capture.recorded)
+}
+
+// snapshot copies a capture with its transactions oldest first, or without them.
+func (capture *MM4Capture) snapshot(withTransactions bool) MM4Capture {
+	snapshot := *capture
+	snapshot.recorded, snapshot.Transactions = nil, nil
+	if withTransactions {
+		snapshot.Transactions = []MM4Transaction{}
+		for _, tx := range append(append([]*MM4Transaction{}, capture.recorded[capture.next:]...), capture.recorded[:capture.next]...) {
+			copied := *tx
+			copied.Lines = append([]TranscriptLine{}, tx.Lines...)
+			snapshot.Transactions = append(snapshot.Transactions, copied)
+		}
+	}
+	return snapshot
+}
+
+// start starts a capture, for at most MM4_TRACE_MAX_DURATION.
+func (t *mm4Tracer) start(capture MM4Capture, duration time.Duration) (MM4Capture, error) {
+	if capture.Client == "" && capture.IP == "" {
+		return MM4Capture{}, core.Invalid("client or ip is required")
+	}
+	if duration <= 0 || duration > mm4TraceMaxDuration {
+		duration = mm4TraceMaxDuration
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.captures) >= mm4TraceMaxCaptures {
+		return MM4Capture{}, core.Invalid("at most %d captures, delete one first", mm4TraceMaxCaptures)
+	}
+	t.nextID++
+	capture.ID = t.nextID
+	capture.StartedAt = time.Now()
+	capture.Until = capture.StartedAt.Add(duration)
+	capture.Stopped, capture.Captured, capture.recorded = false, 0, nil
+	t.captures[capture.ID] = &capture
+	t.active.Add(1)
+	return capture.snapshot(false), nil
+}
+
+func (t *mm4Tracer) list() []MM4Capture {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]MM4Capture, 0, len(t.captures))
+	for _, capture := range t.captures {
+		if !capture.Stopped && time.Now().After(capture.Until) {
+			t.stop(capture)
+		}
+		list = append(list, capture.snapshot(false))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (t *mm4Tracer) get(id uint) (MM4Capture, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	capture, ok := t.captures[id]
+	if !ok {
+		return MM4Capture{}, core.ErrNotFound
+	}
+	if !capture.Stopped && time.Now().After(capture.Until) {
+		t.stop(capture)
+	}
+	return capture.snapshot(true), nil
+}
+
+// end stops a capture, and deletes it when remove is set.
+func (t *mm4Tracer) end(id uint, remove bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	capture, ok := t.captures[id]
+	if !ok {
+		return core.ErrNotFound
+	}
+	t.stop(capture)
+	if remove {
+		delete(t.captures, id)
+	}
+	return nil
+}
+
+// SetupTraceRoutes sets up the transcript captures of the MM4 conversations, server returns
+// nil until the MM4 server runs.
+func SetupTraceRoutes(app *iris.Application, gateway *core.Gateway, server func() *Server) {
+	traces := app.Party("/admin/traces/mm4", gateway.BasicAuthMiddleware)
+	{
+		tracer := func(ctx iris.Context) *mm4Tracer {
+			srv := server()
+			if srv == nil {
+				core.WriteProvisioningError(ctx, core.ErrNotFound)
+				return nil
+			}
+			return srv.traces
+		}
+
+		// List the captures, without their transactions
+		traces.Get("/", func(ctx iris.Context) {
+			if t := tracer(ctx); t != nil {
+				ctx.JSON(t.list())
+			}
+		})
+
+		// Start a capture of the conversations with a client or an IP
+		traces.Post("/", func(ctx iris.Context) {
+			var req struct {
+				Client   string `json:"client"`
+				IP       string `json:"ip"`
+				Duration string `json:"duration"`
+			}
+			if err := ctx.ReadJSON(&req); err != nil {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid request data"))
+				return
+			}
+			t := tracer(ctx)
+			if t == nil {
+				return
+			}
+			var duration time.Duration
+			if req.Duration != "" {
+				var err error
+				if duration, err = time.ParseDuration(req.Duration); err != nil {
+					core.WriteProvisioningError(ctx, core.Invalid("invalid duration %s", req.Duration))
+					return
+				}
+			}
+			capture, err := t.start(MM4Capture{Client: req.Client, IP: req.IP}, duration)
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"Server.MM4.Trace",
+				"MM4TraceStarted",
+				logrus.InfoLevel,
+				map[string]interface{}{
+					"client": capture.Client,
+					"ip":     capture.IP,
+				}, capture.Until.UTC().Format(time.RFC3339),
+			))
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(capture)
+		})
+
+		// A capture with its transcripts
+		traces.Get("/{id:uint}", func(ctx iris.Context) {
+			t := tracer(ctx)
+			if t == nil {
+				return
+			}
+			capture, err := t.get(ctx.Params().GetUintDefault("id", 0))
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(capture)
+		})
+
+		// Stop a capture, keeping its transcripts
+		traces.Post("/{id:uint}/stop", func(ctx iris.Context) {
+			t := tracer(ctx)
+			if t == nil {
+				return
+			}
+			if err := t.end(ctx.Params().GetUintDefault("id", 0), false); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Capture stopped"})
+		})
+
+		// Delete a capture
+		traces.Delete("/{id:uint}", func(ctx iris.Context) {
+			t := tracer(ctx)
+			if t == nil {
+				return
+			}
+			if err := t.end(ctx.Params().GetUintDefault("id", 0), true); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Capture deleted"})
+		})
+	}
+}
@@ -1,28 +1,31 @@
-package main
+// Package mm4 is the MM4 server the MX systems connect to for MMS, and the MM4 client that
+// delivers MMS to them.
+package mm4
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/pires/go-proxyproto"
 	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-
 	"io"
-	"log"
 	"math/rand"
 	"mime"
 	"mime/multipart"
 	"net"
 	"net/textproto"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/router"
 )
 
 type MM4Message struct {
@@ -30,33 +33,53 @@ type MM4Message struct {
 	To            string
 	Content       []byte
 	Headers       textproto.MIMEHeader
-	Client        *Client
-	Route         *Route
+	Client        *core.Client
+	Route         *router.Route
 	MessageID     string
-	Files         []MsgFile
+	Files         []core.MsgFile
 	TransactionID string
+	LogID         string // assigned on DATA, becomes the LogID of the queued message
+	TraceParent   string // span context of the DATA transaction
 }
 
-// MM4Server represents the SMTP server.
-type MM4Server struct {
+// Server represents the SMTP server.
+type Server struct {
 	Addr               string
-	routing            *Router
+	routing            *router.Router
 	mu                 sync.RWMutex
 	listener           net.Listener
 	mongo              *mongo.Client
 	connectedClients   map[string]time.Time
-	gateway            *Gateway
+	gateway            *core.Gateway
 	MediaTranscodeChan chan *MM4Message
+	traces             *mm4Tracer
+	pool               *mm4Pool
+	Status             core.ListenerStatus
+}
+
+// New creates the MM4 server of the gateway listening on addr, Start binds it. The
+// messages it receives go to routing.
+func New(gateway *core.Gateway, routing *router.Router, addr string) *Server {
+	return &Server{
+		Addr:    addr,
+		routing: routing,
+		gateway: gateway,
+		traces:  newMM4Tracer(),
+		pool:    newMM4Pool(),
+	}
 }
 
 // Start begins listening for incoming SMTP connections.
-func (s *MM4Server) Start() error {
+func (s *Server) Start() (err error) {
+	defer func() { s.Status.Failed(err) }() // Start only returns on failure
+
 	s.connectedClients = make(map[string]time.Time)
 	s.MediaTranscodeChan = make(chan *MM4Message)
 
 	go s.transcodeMedia()
+	go s.sweepPool()
 
-	listen, err := net.Listen("tcp", s.Addr)
+	listen, err := s.gateway.Listen("mm4", s.Addr)
 	if err != nil {
 		return err
 	}
@@ -65,7 +88,7 @@ func (s *MM4Server) Start() error {
 
 	var proxyListener net.Listener
 
-	if os.Getenv("HAPROXY_PROXY_PROTOCOL") == "true" {
+	if core.Getenv("HAPROXY_PROXY_PROTOCOL") == "true" {
 		proxyListener = &proxyproto.Listener{Listener: listen}
 		defer proxyListener.Close()
 
@@ -75,28 +98,27 @@ func (s *MM4Server) Start() error {
 			return err
 		}
 
-		defer func(conn net.Conn) {
-			err := conn.Close()
-			if err != nil {
-				log.Fatal("couldn't close proxy connection")
-			}
-		}(conn)
+		defer conn.Close()
 
 		// Print connection details
-		if conn.LocalAddr() == nil {
-			log.Fatal("couldn't retrieve local address")
+		if conn.LocalAddr() == nil || conn.RemoteAddr() == nil {
+			return fmt.Errorf("couldn't retrieve the addresses of the proxy connection")
 		}
-		log.Printf("local address: %q", conn.LocalAddr().String())
-
-		if conn.RemoteAddr() == nil {
-			log.Fatal("couldn't retrieve remote address")
-		}
-		log.Printf("remote address: %q", conn.RemoteAddr().String())
+		var lm = s.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Server.MM4.Start",
+			"MM4ProxyConnection",
+			logrus.DebugLevel,
+			map[string]interface{}{
+				"local": conn.LocalAddr().String(),
+			}, conn.RemoteAddr().String(),
+		))
 	} else {
 		proxyListener = listen
 	}
 
 	s.listener = proxyListener
+	s.Status.Listening(listen.Addr().String())
 
 	// Start the cleanup goroutine
 	/*go s.cleanupInactiveClients(2*time.Minute, 1*time.Minute)*/
@@ -111,7 +133,7 @@ func (s *MM4Server) Start() error {
 }
 
 /*// cleanupInactiveClients periodically removes inactive clients.
-func (s *MM4Server) cleanupInactiveClients(timeout time.Duration, interval time.Duration) {
+func (s *Server) cleanupInactiveClients(timeout time.Duration, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
@@ -141,7 +163,7 @@ func (s *MM4Server) cleanupInactiveClients(timeout time.Duration, interval time.
 }*/
 
 // handleConnection manages an individual SMTP session.
-func (s *MM4Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	var lm = s.gateway.LogManager
 
@@ -164,15 +186,20 @@ func (s *MM4Server) handleConnection(conn net.Conn) {
 	reader := bufio.NewReaderSize(conn, 65536) // 64 KB buffer
 	writer := bufio.NewWriter(conn)
 
+	// Identify the client based on the IP address
+	client := s.getClientByIP(ip)
+	transcript := s.traces.open(false, client, ip, remoteAddr)
+
 	// Send initial greeting
 	writeResponse(writer, "220 localhost SMTP server ready")
+	transcript.record(true, "220 localhost SMTP server ready")
 
-	// Identify the client based on the IP address
-	client := s.getClientByIP(ip)
 	if client == nil {
 		writeResponse(writer, "550 Access denied")
+		transcript.record(true, "550 Access denied")
+		core.MM4Sessions.WithLabelValues("unknown", "denied").Inc()
 
-		if isTrustedProxy(ip, trustedProxies) {
+		if core.IsTrustedProxy(ip, core.TrustedProxies) {
 			return
 		} else {
 			lm.SendLog(lm.BuildLog(
@@ -250,10 +277,14 @@ func (s *MM4Server) handleConnection(conn net.Conn) {
 		ClientIP:   ip,
 		RemoteAddr: remoteAddr,
 		mongo:      s.mongo,
+		transcript: transcript,
 	}
 
 	// Handle the session
+	core.MM4ActiveSessions.Inc()
+	defer core.MM4ActiveSessions.Dec()
 	if err := session.handleSession(s); err != nil {
+		core.MM4Sessions.WithLabelValues(client.Username, core.MetricError).Inc()
 		lm.SendLog(lm.BuildLog(
 			"Server.MM4.HandleConnection",
 			"MM4SessionError",
@@ -263,12 +294,14 @@ func (s *MM4Server) handleConnection(conn net.Conn) {
 				"ip":     ip,
 			}, err,
 		))
-		writeResponse(writer, "451 Internal server error")
+		session.reply("451 Internal server error")
+		return
 	}
+	core.MM4Sessions.WithLabelValues(client.Username, core.MetricSuccess).Inc()
 }
 
 // getClientByIP returns the client associated with the given IP address.
-func (s *MM4Server) getClientByIP(ip string) *Client {
+func (s *Server) getClientByIP(ip string) *core.Client {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -299,17 +332,19 @@ type Session struct {
 	To         []string
 	Data       []byte
 	Headers    textproto.MIMEHeader
-	Server     *MM4Server
-	Client     *Client
+	Server     *Server
+	Client     *core.Client
 	IPHash     string
 	ClientIP   string
 	RemoteAddr string
-	Files      []MsgFile
+	Files      []core.MsgFile
 	mongo      *mongo.Client
+	transcript *mm4Transcript // nil for sessions that aren't captured
+	pipelining bool           // the peer of an outbound session advertised PIPELINING
 }
 
 // handleSession processes SMTP commands from the client.
-func (s *Session) handleSession(srv *MM4Server) error {
+func (s *Session) handleSession(srv *Server) error {
 	for {
 		// Read client input
 		line, err := s.Reader.ReadString('\n')
@@ -320,8 +355,9 @@ func (s *Session) handleSession(srv *MM4Server) error {
 			return err
 		}
 		line = strings.TrimSpace(line)
+		s.transcript.record(false, line)
 		/*
-			if strings.ToLower(os.Getenv("MM4_DEBUG")) == "true" {
+			if strings.ToLower(core.Getenv("MM4_DEBUG")) == "true" {
 				logf := LoggingFormat{Type: LogType.MM4 + "_" + LogType.DEBUG}
 				logf.Level = logrus.DebugLevel
 				logf.Message = fmt.Sprintf("IP: %s - C: %s", s.ClientIP, line)
@@ -336,7 +372,7 @@ func (s *Session) handleSession(srv *MM4Server) error {
 }
 
 // handleCommand processes a single SMTP command.
-func (s *Session) handleCommand(line string, srv *MM4Server) error {
+func (s *Session) handleCommand(line string, srv *Server) error {
 	// Split command and arguments
 	parts := strings.SplitN(line, " ", 2)
 	cmd := strings.ToUpper(parts[0])
@@ -353,21 +389,21 @@ func (s *Session) handleCommand(line string, srv *MM4Server) error {
 	// Handle commands
 	switch cmd {
 	case "HELO", "EHLO":
-		writeResponse(s.Writer, "250 Hello")
+		s.reply("250 Hello")
 	case "MAIL":
 		if err := s.handleMail(arg); err != nil {
-			writeResponse(s.Writer, fmt.Sprintf("550 %v", err))
+			s.reply(fmt.Sprintf("550 %v", err))
 		} else {
-			writeResponse(s.Writer, "250 OK")
+			s.reply("250 OK")
 		}
 	case "RCPT":
 		if err := s.handleRcpt(arg); err != nil {
-			writeResponse(s.Writer, fmt.Sprintf("550 %v", err))
+			s.reply(fmt.Sprintf("550 %v", err))
 		} else {
-			writeResponse(s.Writer, "250 OK")
+			s.reply("250 OK")
 		}
 	case "DATA":
-		writeResponse(s.Writer, "354 End data with <CR><LF>.<CR><LF>")
+		s.reply("354 End data with <CR><LF>.<CR><LF>")
 		if err := s.handleData(); err != nil {
 			var lm = s.Server.gateway.LogManager
 			lm.SendLog(lm.BuildLog(
@@ -379,17 +415,17 @@ func (s *Session) handleCommand(line string, srv *MM4Server) error {
 					"ip":     s.ClientIP,
 				},
 			))
-			writeResponse(s.Writer, fmt.Sprintf("554 %v", err))
+			s.reply(fmt.Sprintf("554 %v", err))
 		} else {
-			writeResponse(s.Writer, "250 OK")
+			s.reply("250 OK")
 		}
 	case "NOOP":
-		writeResponse(s.Writer, "250 OK")
+		s.reply("250 OK")
 	case "QUIT":
-		writeResponse(s.Writer, "221 Bye")
+		s.reply("221 Bye")
 		return errors.New("client disconnected")
 	default:
-		writeResponse(s.Writer, fmt.Sprintf("502 Command not implemented: %s", cmd))
+		s.reply(fmt.Sprintf("502 Command not implemented: %s", cmd))
 	}
 	return nil
 }
@@ -431,13 +467,18 @@ func (s *Session) handleData() error {
 		return err
 	}
 	s.Data = []byte(bodyBuilder.String())
+	s.transcript.message(false, headers, s.Data)
 
 	// Handle MM4 message
 	return s.handleMM4Message()
 }
 
 // handleMM4Message processes the MM4 message based on its type.
-func (s *Session) handleMM4Message() error {
+func (s *Session) handleMM4Message() (err error) {
+	span := core.StartSpan("mm4 DATA", core.SpanKindServer, "")
+	span.SetAttributes(map[string]interface{}{"mm4.client": s.Client.Username})
+	defer func() { span.End(err) }()
+
 	// Check required MM4 headers
 	requiredHeaders := []string{
 		"X-Mms-3GPP-MMS-Version",
@@ -454,6 +495,26 @@ func (s *Session) handleMM4Message() error {
 		}
 	}
 
+	// push back while the router can't take more messages, the client retries later
+	if s.Server.routing.ClientSaturated() {
+		s.reply("452 4.3.1 Insufficient system storage, try again later")
+		return nil
+	}
+
+	if recipients := core.GroupRecipients(s.Headers.Get("To")); s.Client.Profile.NoGroupMessages && len(recipients) > 1 {
+		var lm = s.Server.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Server.MM4.HandleData",
+			"MM4GroupRefused",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"client": s.Client.Username,
+			}, len(recipients),
+		))
+		s.reply("554 5.5.3 Group messages are not accepted for this client")
+		return nil
+	}
+
 	//_ := s.Headers.Get("X-Mms-Message-Type")
 	transactionID := s.Headers.Get("X-Mms-Transaction-ID")
 	messageID := s.Headers.Get("X-Mms-Message-ID")
@@ -466,7 +527,24 @@ func (s *Session) handleMM4Message() error {
 		Client:        s.Client,
 		TransactionID: transactionID,
 		MessageID:     messageID,
-	}
+		LogID:         primitive.NewObjectID().Hex(),
+		TraceParent:   span.TraceParent(),
+	}
+	span.SetAttributes(map[string]interface{}{
+		"message.log_id":     mm4Message.LogID,
+		"mm4.message_id":     messageID,
+		"mm4.transaction_id": transactionID,
+	})
+	var lm = s.Server.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Server.MM4.HandleData",
+		"MM4MessageReceived",
+		logrus.DebugLevel,
+		map[string]interface{}{
+			"logID":  mm4Message.LogID,
+			"client": s.Client.Username,
+		}, messageID,
+	))
 	// Existing header checks..
 
 	// todo IMPORTANT convert octet stream to other file?? uerm
@@ -489,9 +567,9 @@ func (s *Session) handleMM4Message() error {
 		LogID:             transId,
 	}
 
-	s.Server.gateway.Router.ClientMsgChan <- msgItem*/
+	s.Server.routing.ClientMsgChan <- msgItem*/
 
-	writeResponse(s.Writer, "250 Message queued for processing")
+	s.reply("250 Message queued for processing")
 
 	/*switch msgType {
 	case "MM4_forward.REQ":
@@ -548,7 +626,7 @@ func (m *MM4Message) parseMIMEParts() (*MM4Message, error) {
 			}
 
 			// Create a MsgFile struct
-			file := MsgFile{
+			file := core.MsgFile{
 				Filename:    part.FileName(),
 				ContentType: part.Header.Get("Content-Type"),
 				Content:     buf.Bytes(),
@@ -558,7 +636,7 @@ func (m *MM4Message) parseMIMEParts() (*MM4Message, error) {
 	} else {
 		// Not a multipart message
 		// Handle as a single part
-		file := MsgFile{
+		file := core.MsgFile{
 			Filename:    "",
 			ContentType: mediaType,
 			Content:     m.Content,
@@ -569,8 +647,17 @@ func (m *MM4Message) parseMIMEParts() (*MM4Message, error) {
 	return m, nil
 }
 
-// sendMM4 sends an MM4 message to a client over plain TCP with base64-encoded media.
-func (s *MM4Server) sendMM4(item MsgQueueItem) error {
+// SendMM4 sends an MM4 message to a client over plain TCP with base64-encoded media.
+func (s *Server) SendMM4(ctx context.Context, item core.MsgQueueItem) (err error) {
+	attempted := time.Now()
+	defer func() {
+		route := "mm4:" + s.gateway.ClientLabel(item.To)
+		s.gateway.RecordCDR(&item, route, false, attempted, err)
+		if err == nil {
+			s.gateway.EmitMessageEvent(core.EventTypes.MessageDelivered, &item, map[string]interface{}{"route": route})
+		}
+	}()
+
 	if item.Files == nil {
 		return fmt.Errorf("files are nil")
 	}
@@ -581,12 +668,57 @@ func (s *MM4Server) sendMM4(item MsgQueueItem) error {
 	newStr := strings.Replace(item.To, "+", "", -1)
 
 	// Find the client by destination IP
-	client := s.gateway.getClient(newStr)
+	client := s.gateway.GetClient(newStr)
 
 	if client == nil {
 		return fmt.Errorf("no client found for destination number: %s", item.To)
 	}
 
+	mm4Message := s.createMM4Message(item)
+
+	span := core.StartMsgSpan("mm4 forward", core.SpanKindClient, &item)
+	span.SetAttributes(map[string]interface{}{"mm4.client": client.Username})
+	defer func() { span.End(err) }()
+
+	started := time.Now()
+	conn, err := s.getMM4Conn(ctx, client)
+	if err != nil {
+		core.MM4Forwards.WithLabelValues(client.Username, "connect_failed").Inc()
+		return err
+	}
+	session := conn.session
+	// a stuck session is closed once the message runs out of time
+	stop := context.AfterFunc(ctx, func() { _ = session.Conn.Close() })
+	defer func() {
+		if !stop() && err == nil {
+			err = fmt.Errorf("send MM4 cancelled: %w", ctx.Err())
+		}
+		s.pool.put(conn, err)
+	}()
+
+	session.Headers = mm4Message.Headers
+	session.From = mm4Message.From
+	session.To = []string{mm4Message.To}
+	session.Data = mm4Message.Content
+	session.Files = mm4Message.Files // Include media file (only 1)
+
+	// Proceed to send the MM4 message
+	if err := session.sendMM4Message(); err != nil {
+		core.MM4Forwards.WithLabelValues(client.Username, core.MetricError).Inc()
+		if ctx.Err() != nil {
+			return fmt.Errorf("send MM4 cancelled: %w", ctx.Err())
+		}
+		return fmt.Errorf("send MM4 failed: %w", err)
+	}
+	core.MM4Forwards.WithLabelValues(client.Username, core.MetricSuccess).Inc()
+	core.MM4ForwardLatency.WithLabelValues(client.Username).Observe(time.Since(started).Seconds())
+
+	return nil
+}
+
+// dialClient connects to the client's MM4 server and completes the greeting and EHLO, within the
+// deadline of ctx if it is sooner than the 30s of the session.
+func (s *Server) dialClient(ctx context.Context, client *core.Client) (*Session, error) {
 	// Use default MM4 port if not specified
 	port := "25" // Default SMTP port todo
 
@@ -594,87 +726,135 @@ func (s *MM4Server) sendMM4(item MsgQueueItem) error {
 	address := net.JoinHostPort(client.Address, port)
 
 	// Establish a plain TCP connection to the client's MM4 server with a timeout
-	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
-		return fmt.Errorf("failed to connect to client's MM4 server at %s", address)
+		return nil, fmt.Errorf("failed to connect to client's MM4 server at %s", address)
 	}
-	defer conn.Close()
-
-	// Set read and write deadlines to prevent hanging
-	conn.SetDeadline(time.Now().Add(30 * time.Second))
-
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-
-	mm4Message := s.createMM4Message(item)
 
 	session := &Session{
-		Conn:    conn,
-		Reader:  reader,
-		Writer:  writer,
-		Server:  s,
-		Client:  client,
-		Headers: mm4Message.Headers,
-		From:    mm4Message.From,
-		To:      []string{mm4Message.To},
-		Data:    mm4Message.Content,
-		Files:   mm4Message.Files, // Include media file (only 1)
+		Conn:   conn,
+		Reader: bufio.NewReader(conn),
+		Writer: bufio.NewWriter(conn),
+		Server: s,
+		Client: client,
 	}
+	session.setDeadline(ctx)
+	session.transcript = s.traces.open(true, client, client.Address, address)
 
 	// Read server's initial response
-	response, err := session.readResponse()
+	greeting, err := session.readReply()
 	if err != nil {
-		return fmt.Errorf("failed to read server greeting: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("failed to read server greeting: %v", err)
 	}
-	if !strings.HasPrefix(response, "220") {
-		return fmt.Errorf("unexpected server greeting: %s", response)
+	if response := greeting[len(greeting)-1]; !strings.HasPrefix(response, "220") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected server greeting: %s", response)
 	}
 
-	// Send EHLO command
+	// Send EHLO command, its reply lists the extensions of the server
 	if err := session.sendCommand("EHLO localhost"); err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
-	response, err = session.readResponse()
+	ehlo, err := session.readReply()
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
-	if !strings.HasPrefix(response, "250") {
-		return fmt.Errorf("EHLO command failed: %s", response)
+	if response := ehlo[len(ehlo)-1]; !strings.HasPrefix(response, "250") {
+		conn.Close()
+		return nil, fmt.Errorf("EHLO command failed: %s", response)
 	}
+	session.pipelining = hasExtension(ehlo, "PIPELINING")
 
-	// Proceed to send the MM4 message
-	if err := session.sendMM4Message(); err != nil {
-		return fmt.Errorf("send MM4 failed: %s", response)
-	}
+	return session, nil
+}
 
-	// Send QUIT command to terminate the session gracefully
-	if err := session.sendCommand("QUIT"); err != nil {
-		return fmt.Errorf("send QUIT failed: %s", response)
+// quit terminates an outbound session gracefully.
+func (s *Session) quit() error {
+	if err := s.sendCommand("QUIT"); err != nil {
+		return fmt.Errorf("send QUIT failed: %v", err)
 	}
-	response, err = session.readResponse()
+	response, err := s.readResponse()
 	if err != nil {
 		return err
 	}
 	if !strings.HasPrefix(response, "221") {
 		return fmt.Errorf("QUIT command failed: %s", response)
 	}
+	return nil
+}
+
+// SendMM4DeliveryReport sends an MM4_delivery_report.REQ for a message the client submitted,
+// status is the X-Mms-MM-Status-Code, e.g. Expired or Retrieved.
+func (s *Server) SendMM4DeliveryReport(item core.MsgQueueItem, client *core.Client, status string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := s.getMM4Conn(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer func() { s.pool.put(conn, err) }()
+	session := conn.session
+
+	// the report travels back to the original sender
+	from := fmt.Sprintf("%s/TYPE=PLMN", item.To)
+	to := fmt.Sprintf("%s/TYPE=PLMN", item.From)
+
+	if err := session.startTransaction(from, []string{to}); err != nil {
+		return err
+	}
+
+	originatorSystem := core.Getenv("MM4_ORIGINATOR_SYSTEM")
+	if originatorSystem == "" {
+		originatorSystem = "system@yourdomain.com"
+	}
+
+	var report bytes.Buffer
+	report.WriteString(fmt.Sprintf("To: %s\r\n", to))
+	report.WriteString(fmt.Sprintf("From: %s\r\n", from))
+	report.WriteString("X-Mms-3GPP-Mms-Version: 6.10.0\r\n")
+	report.WriteString("X-Mms-Message-Type: MM4_delivery_report.REQ\r\n")
+	report.WriteString(fmt.Sprintf("X-Mms-Message-Id: <%s@%s>\r\n", item.LogID, core.Getenv("MM4_MSG_ID_HOST")))
+	report.WriteString(fmt.Sprintf("X-Mms-Transaction-Id: %s\r\n", item.LogID))
+	report.WriteString(fmt.Sprintf("X-Mms-MM-Status-Code: %s\r\n", status))
+	report.WriteString(fmt.Sprintf("X-Mms-Originator-System: %s\r\n", originatorSystem))
+	report.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z)))
+	report.WriteString("\r\n.\r\n")
+
+	session.transcript.messageData(true, report.String())
+	if _, err := session.Writer.WriteString(report.String()); err != nil {
+		return err
+	}
+	if err := session.Writer.Flush(); err != nil {
+		return err
+	}
+	response, err := session.readResponse()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(response, "250") {
+		return fmt.Errorf("delivery report rejected: %s", response)
+	}
 
 	return nil
 }
 
 // createMM4Message constructs an MM4Message with the provided media files.
-func (s *MM4Server) createMM4Message(msgItem MsgQueueItem) *MM4Message {
+func (s *Server) createMM4Message(msgItem core.MsgQueueItem) *MM4Message {
 	headers := textproto.MIMEHeader{}
 	headers.Set("To", fmt.Sprintf("%s/TYPE=PLMN", msgItem.To))
 	headers.Set("From", fmt.Sprintf("%s/TYPE=PLMN", msgItem.From))
 	headers.Set("MIME-Version", "1.0")
 	headers.Set("X-Mms-3GPP-Mms-Version", "6.10.0")
 	headers.Set("X-Mms-Message-Type", "MM4_forward.REQ")
-	headers.Set("X-Mms-Message-Id", fmt.Sprintf("<%s@%s>", msgItem.LogID, os.Getenv("MM4_MSG_ID_HOST"))) // todo Replace 'yourdomain.com' appropriately
+	headers.Set("X-Mms-Message-Id", fmt.Sprintf("<%s@%s>", msgItem.LogID, core.Getenv("MM4_MSG_ID_HOST"))) // todo Replace 'yourdomain.com' appropriately
 	headers.Set("X-Mms-Transaction-Id", msgItem.LogID)
 	headers.Set("X-Mms-Ack-Request", "Yes")
 
-	originatorSystem := os.Getenv("MM4_ORIGINATOR_SYSTEM") // e.g., "system@108.165.150.61"
+	originatorSystem := core.Getenv("MM4_ORIGINATOR_SYSTEM") // e.g., "system@108.165.150.61"
 	if originatorSystem == "" {
 		originatorSystem = "system@yourdomain.com" // Fallback or default value
 	}
@@ -682,10 +862,10 @@ func (s *MM4Server) createMM4Message(msgItem MsgQueueItem) *MM4Message {
 	headers.Set("Date", time.Now().UTC().Format(time.RFC1123Z))
 	// Msg-Type will be set in sendMM4Message based on whether SMIL is included or not
 
-	files := make([]MsgFile, 0)
+	files := make([]core.MsgFile, 0)
 
 	for _, f := range msgItem.Files {
-		files = append(files, MsgFile{
+		files = append(files, core.MsgFile{
 			Filename:    f.Filename,
 			ContentType: f.ContentType,
 			Content:     f.Content,
@@ -707,7 +887,7 @@ func (s *MM4Server) createMM4Message(msgItem MsgQueueItem) *MM4Message {
 func (s *Session) sendCommand(cmd string) error {
 	/*logf := LoggingFormat{Type: LogType.MM4}
 
-	if strings.ToLower(os.Getenv("MM4_DEBUG")) == "true" {
+	if strings.ToLower(core.Getenv("MM4_DEBUG")) == "true" {
 		line := strings.TrimSpace(cmd)
 		logf.Type = LogType.MM4 + "_" + LogType.DEBUG
 		logf.Level = logrus.InfoLevel
@@ -715,6 +895,7 @@ func (s *Session) sendCommand(cmd string) error {
 		logf.Print()
 	}*/
 
+	s.transcript.record(true, cmd)
 	_, err := s.Writer.WriteString(cmd + "\r\n")
 	if err != nil {
 		return fmt.Errorf("failed to send command '%s'", cmd)
@@ -735,8 +916,9 @@ func (s *Session) readResponse() (string, error) {
 		return "", fmt.Errorf("failed to read server response: %v", err)
 	}
 	response = strings.TrimSpace(response)
+	s.transcript.record(false, response)
 
-	/*if strings.ToLower(os.Getenv("MM4_DEBUG")) == "true" {
+	/*if strings.ToLower(core.Getenv("MM4_DEBUG")) == "true" {
 		logf.Type = LogType.MM4 + "_" + LogType.DEBUG
 		logf.Level = logrus.InfoLevel
 		logf.Message = fmt.Sprintf("IP: %s - S: %s", s.ClientIP, response)
@@ -753,7 +935,7 @@ func (s *Session) readResponse() (string, error) {
 		return response, nil
 	}
 	if code >= 400 {
-		return response, fmt.Errorf("server responded with error: %s", response)
+		return response, &core.SMTPError{Code: code, Response: response}
 	}
 	return response, nil
 }
@@ -770,7 +952,7 @@ func generateContentID() string {
 }
 
 // generateSMIL generates a SMIL content that references the provided media files.
-func generateSMIL(files []MsgFile) ([]byte, error) {
+func generateSMIL(files []core.MsgFile) ([]byte, error) {
 	if len(files) == 0 {
 		return nil, fmt.Errorf("no media files to include in SMIL")
 	}
@@ -804,43 +986,8 @@ func (s *Session) sendMM4Message() error {
 		return fmt.Errorf("no files found")
 	}
 
-	// Step 1: MAIL FROM Command
-	mailFromCmd := fmt.Sprintf("MAIL FROM:<%s>", s.From)
-	if err := s.sendCommand(mailFromCmd); err != nil {
-		return err
-	}
-	response, err := s.readResponse()
-	if err != nil {
-		return err
-	}
-	if !strings.HasPrefix(response, "250") {
-		return fmt.Errorf("MAIL FROM command failed: %s", response)
-	}
-
-	// Step 2: RCPT TO Commands
-	for _, recipient := range s.To {
-		rcptToCmd := fmt.Sprintf("RCPT TO:<%s>", recipient)
-		if err := s.sendCommand(rcptToCmd); err != nil {
-			return err
-		}
-		response, err := s.readResponse()
-		if err != nil {
-			return err
-		}
-		if !strings.HasPrefix(response, "250") {
-			return err
-		}
-	}
-
-	// Step 3: DATA Command
-	if err := s.sendCommand("DATA"); err != nil {
-		return err
-	}
-	response, err = s.readResponse()
-	if err != nil {
-		return err
-	}
-	if !strings.HasPrefix(response, "354") {
+	// Steps 1-3: MAIL FROM, RCPT TO and DATA, pipelined when the peer supports it
+	if err := s.startTransaction(s.From, s.To); err != nil {
 		return err
 	}
 
@@ -927,7 +1074,8 @@ func (s *Session) sendMM4Message() error {
 
 	// Step 5: Send the message data
 	msgData := messageBuffer.String()
-	_, err = s.Writer.WriteString(msgData)
+	s.transcript.messageData(true, msgData)
+	_, err := s.Writer.WriteString(msgData)
 	if err != nil {
 		return err
 	}
@@ -937,12 +1085,12 @@ func (s *Session) sendMM4Message() error {
 	}
 
 	// Step 6: Read server's response after sending data
-	response, err = s.readResponse()
+	response, err := s.readResponse()
 	if err != nil {
 		return err
 	}
 	if !strings.HasPrefix(response, "250") {
-		return err
+		return fmt.Errorf("message rejected: %s", response)
 	}
 
 	return nil
@@ -963,6 +1111,12 @@ func generateBoundary() string {
 	return fmt.Sprintf("===============%s", randomString(16))
 }
 
+// reply sends a response to the client of the session.
+func (s *Session) reply(response string) {
+	writeResponse(s.Writer, response)
+	s.transcript.record(true, response)
+}
+
 // writeResponse sends a response to the client.
 func writeResponse(writer *bufio.Writer, response string) {
 	/*log.Printf("S: %s", response)*/
@@ -1,4 +1,4 @@
-package main
+package mm4
 
 import (
 	"bytes"
@@ -19,6 +19,7 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+	"zultys-smpp-mm4/core"
 
 	_ "image/gif"
 	_ "image/jpeg"
@@ -30,45 +31,47 @@ const (
 	maxFileSize  = 0.5 * 1024 * 1024 // 5 MB
 )
 
-func (s *MM4Server) transcodeMedia() {
+func (s *Server) transcodeMedia() {
 	for {
 		mm4Message := <-s.MediaTranscodeChan
 
-		transId := primitive.NewObjectID().Hex()
-
+		span := core.StartSpan("mm4 transcode", core.SpanKindInternal, mm4Message.TraceParent)
+		span.SetAttributes(map[string]interface{}{"message.log_id": mm4Message.LogID, "mm4.files": len(mm4Message.Files)})
 		ff, err := mm4Message.processAndConvertFiles()
+		span.End(err)
 		if err != nil {
 			mm4Message.Files = nil
 			mm4Message.Content = nil // remove content to be safe
 
-			mm4Message.Client.Password = "***"
-
-			// todo add log privacy
-
 			var lm = s.gateway.LogManager
 			lm.SendLog(lm.BuildLog(
 				"Server.MM4.TranscodeMedia",
 				"Failed to transcode media. %s",
 				logrus.ErrorLevel,
 				map[string]interface{}{
-					"mm4Message": mm4Message,
-					"logID":      transId,
+					"logID":     mm4Message.LogID,
+					"client":    mm4Message.Client.Username,
+					"messageID": mm4Message.MessageID,
 				}, err,
 			))
 			continue
 		}
 		mm4Message.Files = ff
 
-		msgItem := MsgQueueItem{
+		msgItem := core.MsgQueueItem{
 			To:                mm4Message.To,
 			From:              mm4Message.From,
 			ReceivedTimestamp: time.Now(),
-			Type:              MsgQueueItemType.MMS,
+			Type:              core.MsgQueueItemType.MMS,
 			Files:             mm4Message.Files,
-			LogID:             transId,
+			LogID:             mm4Message.LogID,
+			TraceParent:       span.TraceParent(),
+			// X-Allow-International: yes, for the flag international policy
+			AllowInternational: core.HeaderFlag(mm4Message.Headers.Get("X-Allow-International")),
 		}
+		core.NormalizeAddresses(&msgItem, mm4Message.Client)
 
-		s.gateway.Router.ClientMsgChan <- msgItem
+		s.routing.ClientMsgChan <- msgItem
 	}
 }
 
@@ -88,8 +91,8 @@ var compatibleTypes = map[string]bool{
 	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
 }
 
-func (m *MM4Message) processAndConvertFiles() ([]MsgFile, error) {
-	var processedFiles []MsgFile
+func (m *MM4Message) processAndConvertFiles() ([]core.MsgFile, error) {
+	var processedFiles []core.MsgFile
 
 	for _, file := range m.Files {
 		if strings.Contains(file.ContentType, "application/smil") {
@@ -171,7 +174,7 @@ func (m *MM4Message) processAndConvertFiles() ([]MsgFile, error) {
 // convertTo3GPP compresses and converts video content to 3GPP format suitable for MMS transmission.
 func convertTo3GPP(content []byte, transcodeVideo, transcodeAudio bool) ([]byte, error) {
 	// Determine temporary file path
-	tempPath := os.Getenv("TRANSCODE_TEMP_PATH")
+	tempPath := core.Getenv("TRANSCODE_TEMP_PATH")
 	if tempPath == "" {
 		tempPath = os.TempDir() // Use OS temp directory as fallback
 	}
@@ -494,12 +497,16 @@ func convertToMP3(content []byte) ([]byte, string, error) {
 			OverWriteOutput().
 			Run()
 		if err != nil {
-			fmt.Printf("FFmpeg error: %v\n", err)
+			// surfaces in io.Copy below, the caller logs it with the message
+			_ = pwOut.CloseWithError(fmt.Errorf("ffmpeg error: %w", err))
+			return
 		}
 		_ = pwOut.Close()
 	}()
 
-	_, _ = io.Copy(&outputBuffer, prOut)
+	if _, err := io.Copy(&outputBuffer, prOut); err != nil {
+		return nil, "", err
+	}
 
 	// Check if the output is larger than the allowed limit (5MB)
 	if outputBuffer.Len() > maxFileSize {
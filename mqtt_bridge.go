@@ -0,0 +1,210 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/router"
+)
+
+var (
+	mqttTopicPrefix string
+	mqttTimeout     time.Duration
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		mqttTopicPrefix = strings.Trim(cfg.String("MQTT_TOPIC_PREFIX", "gateway"), "/")
+		mqttTimeout = cfg.Duration("MQTT_TIMEOUT", 10*time.Second)
+	})
+}
+
+// MQTTBridge publishes the messages to the numbers with mqtt set to {prefix}/inbound/{number},
+// and sends the messages published to {prefix}/outbound from those numbers, answering them on
+// {prefix}/results.
+type MQTTBridge struct {
+	gateway *Gateway
+	client  mqtt.Client
+	qos     byte
+}
+
+// mqttOutbound is a message published to the outbound topic, the body of POST /messages.
+type mqttOutbound struct {
+	core.MessageRequest
+	RequestID string `json:"request_id,omitempty"` // echoed in the result
+}
+
+// mqttResult answers an outbound message on the results topic.
+type mqttResult struct {
+	RequestID string `json:"request_id,omitempty"`
+	*core.MessageAccepted
+	Error string `json:"error,omitempty"`
+}
+
+// mqttInbound is published for a message to a bridged number.
+type mqttInbound struct {
+	MessageID  string              `json:"message_id"`
+	Client     string              `json:"client"`
+	Type       core.MsgQueueType   `json:"type"`
+	From       string              `json:"from_number"`
+	To         string              `json:"to_number"`
+	Message    string              `json:"message"`
+	Media      []core.MessageMedia `json:"media,omitempty"`
+	ReceivedAt time.Time           `json:"received_at"`
+}
+
+// NewMQTTBridge connects to MQTT_BROKER in the background, reconnecting and subscribing again
+// whenever the connection is lost. In a cluster the instances share the outbound subscription.
+func NewMQTTBridge(gateway *Gateway, broker string) (*MQTTBridge, error) {
+	qos, err := strconv.Atoi(core.EnvString("MQTT_QOS", "1"))
+	if err != nil || qos < 0 || qos > 2 {
+		return nil, fmt.Errorf("MQTT_QOS must be 0, 1 or 2")
+	}
+	bridge := &MQTTBridge{gateway: gateway, qos: byte(qos)}
+
+	outbound := mqttTopicPrefix + "/outbound"
+	if core.ClusterEnabled {
+		outbound = "$share/" + strings.ReplaceAll(mqttTopicPrefix, "/", "_") + "/" + outbound
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(core.EnvString("MQTT_CLIENT_ID", "zultys-gateway-"+gateway.ServerID)).
+		SetUsername(core.Getenv("MQTT_USERNAME")).
+		SetPassword(core.Getenv("MQTT_PASSWORD")).
+		SetConnectTimeout(mqttTimeout).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		// outbound messages publish their result, which would block the handler of the next
+		SetOrderMatters(false).
+		// shared subscriptions arrive with the topic they were published to, which the filter
+		// doesn't match, so they are all handled here
+		SetDefaultPublishHandler(func(_ mqtt.Client, message mqtt.Message) {
+			bridge.handleOutbound(message.Payload())
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			token := client.Subscribe(outbound, bridge.qos, nil)
+			if token.WaitTimeout(mqttTimeout) && token.Error() == nil {
+				bridge.log(logrus.InfoLevel, nil, "subscribed to "+outbound)
+				return
+			}
+			err := token.Error()
+			if err == nil {
+				err = errors.New("subscribe timed out")
+			}
+			bridge.log(logrus.ErrorLevel, nil, err)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			bridge.log(logrus.WarnLevel, nil, fmt.Errorf("connection lost: %w", err))
+		})
+	bridge.client = mqtt.NewClient(opts)
+	bridge.client.Connect()
+	return bridge, nil
+}
+
+// numberTopic is the inbound topic of a number, without the + MQTT reserves for wildcards.
+func numberTopic(number string) string {
+	return mqttTopicPrefix + "/inbound/" + strings.TrimPrefix(number, "+")
+}
+
+// publish waits for the broker to take a message, up to MQTT_TIMEOUT.
+func (bridge *MQTTBridge) publish(topic string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	token := bridge.client.Publish(topic, bridge.qos, false, body)
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("publish to %s timed out", topic)
+	}
+	return token.Error()
+}
+
+// inboundDecision delivers a message to a bridged number by publishing it, false for numbers that
+// aren't bridged.
+func (bridge *MQTTBridge) inboundDecision(msg *core.MsgQueueItem, fromClient *core.Client, toClient *core.Client) (router.Decision, bool) {
+	if _, number, ok := bridge.gateway.LookupNumber(msg.To); !ok || number == nil || !number.MQTT {
+		return router.Decision{}, false
+	}
+
+	inbound := mqttInbound{
+		MessageID:  msg.LogID,
+		Client:     toClient.Username,
+		Type:       msg.Type,
+		From:       msg.From,
+		To:         msg.To,
+		Message:    msg.Message,
+		ReceivedAt: msg.ReceivedTimestamp,
+	}
+	for _, file := range msg.Files {
+		content := file.Content
+		if len(content) == 0 && file.Base64Data != "" {
+			content, _ = base64.StdEncoding.DecodeString(file.Base64Data)
+		}
+		inbound.Media = append(inbound.Media, core.MessageMedia{
+			Filename:    file.Filename,
+			ContentType: file.ContentType,
+			Content:     content,
+		})
+	}
+	if err := bridge.publish(numberTopic(msg.To), inbound); err != nil {
+		bridge.log(logrus.ErrorLevel, msg, err)
+		return router.RetryDecision(core.RetryClasses.ClientSend, err.Error()), true
+	}
+	return router.AckDecision(core.RoutingOutcomes.Delivered, "mqtt:"+toClient.Username, router.ClientRecords(fromClient, toClient)...), true
+}
+
+// handleOutbound sends a message published to the outbound topic, from bridged numbers only.
+func (bridge *MQTTBridge) handleOutbound(payload []byte) {
+	var req mqttOutbound
+	result := mqttResult{}
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		err = core.Invalid("invalid message: %v", err)
+	}
+	result.RequestID = req.RequestID
+
+	var msg core.MsgQueueItem
+	var client *core.Client
+	if err == nil {
+		msg, client, err = bridge.gateway.NewAPIMessage(req.MessageRequest)
+	}
+	if err == nil {
+		if _, number, ok := bridge.gateway.LookupNumber(msg.From); !ok || number == nil || !number.MQTT {
+			err = core.Invalid("number %s is not bridged to MQTT", msg.From)
+		}
+	}
+	if err == nil {
+		err = bridge.gateway.Router.OfferClientMessage(msg)
+	}
+	if err == nil {
+		accepted := core.AcceptedMessage(&msg, client)
+		result.MessageAccepted = &accepted
+	} else {
+		result.Error = err.Error()
+		bridge.log(logrus.WarnLevel, nil, fmt.Errorf("outbound message %q rejected: %w", req.RequestID, err))
+	}
+	if err := bridge.publish(mqttTopicPrefix+"/results", result); err != nil {
+		bridge.log(logrus.ErrorLevel, nil, err)
+	}
+}
+
+func (bridge *MQTTBridge) log(level logrus.Level, msg *core.MsgQueueItem, event interface{}) {
+	var fields map[string]interface{}
+	if msg != nil {
+		fields = bridge.gateway.MsgFields(msg, nil)
+	}
+	var lm = bridge.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Server.MQTT",
+		"MQTTBridge",
+		level,
+		fields, event,
+	))
+}
@@ -1,4 +1,4 @@
-package main
+package gateway
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,10 +14,21 @@ type PrometheusExporter struct {
 	startTime time.Time
 }
 
-// Start begins the HTTP server to serve Prometheus metrics.
+// Start begins the HTTP server to serve Prometheus metrics, without PROMETHEUS_LISTEN they are
+// only served on /metrics of the web server.
 func (e *PrometheusExporter) Start() error {
+	if e.Listen == "" {
+		return nil
+	}
+	if e.Path == "" {
+		e.Path = "/metrics"
+	}
 	http.Handle(e.Path, promhttp.Handler())
-	return http.ListenAndServe(e.Listen, nil)
+	listener, err := upgrades.Listen("metrics", e.Listen)
+	if err != nil {
+		return err
+	}
+	return http.Serve(listener, nil)
 }
 
 // MetricExporter for managing and exposing Prometheus metrics.
@@ -32,10 +43,11 @@ func NewMetricExporter(id string, gateway *Gateway) *MetricExporter {
 	metricDesc := map[string]*prometheus.Desc{
 		"connected_clients": prometheus.NewDesc("connected_clients", "Number of connected clients", []string{"protocol"}, nil),
 		"total_clients":     prometheus.NewDesc("total_clients", "Total number of clients", []string{"protocol"}, nil),
-		"message_retries":   prometheus.NewDesc("message_retries", "Count of message retries", []string{"protocol"}, nil),
-		"messages_sent":     prometheus.NewDesc("messages_sent", "Messages sent in the last minute", []string{"protocol", "direction"}, nil),
 		"server_status":     prometheus.NewDesc("server_status", "General OK status of the server", []string{"service"}, nil),
 		"client_stats":      prometheus.NewDesc("client_stats", "Total clients and numbers", []string{"protocol", "stat"}, nil),
+		"route_healthy":     prometheus.NewDesc("carrier_route_healthy", "Whether the carrier route is in rotation", []string{"route"}, nil),
+		"route_error_rate":  prometheus.NewDesc("carrier_route_error_rate", "Failed sends in the error window of the carrier route", []string{"route"}, nil),
+		"queue_depth":       prometheus.NewDesc("queue_depth", "Messages waiting in the router and queue backend queues", []string{"queue"}, nil),
 	}
 
 	return &MetricExporter{
@@ -56,13 +68,33 @@ func (e *MetricExporter) Describe(ch chan<- *prometheus.Desc) {
 func (e *MetricExporter) Collect(ch chan<- prometheus.Metric) {
 	e.collectConnectedClients(ch)
 	e.collectClientStats(ch)
-	e.collectMessageMetrics(ch)
 	e.collectServerStatus(ch)
+	e.collectRouteHealth(ch)
+	e.collectQueueDepths(ch)
+}
+
+// collectQueueDepths exports the depths reported by queueDepths.
+func (e *MetricExporter) collectQueueDepths(ch chan<- prometheus.Metric) {
+	for queue, depth := range e.gateway.QueueDepths() {
+		ch <- prometheus.MustNewConstMetric(e.desc["queue_depth"], prometheus.GaugeValue, float64(depth), queue)
+	}
+}
+
+// collectRouteHealth exports the health state and error rate of each carrier route.
+func (e *MetricExporter) collectRouteHealth(ch chan<- prometheus.Metric) {
+	for _, status := range e.gateway.Router.RouteHealth() {
+		healthy := 0
+		if status.Healthy {
+			healthy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(e.desc["route_healthy"], prometheus.GaugeValue, float64(healthy), status.Route)
+		ch <- prometheus.MustNewConstMetric(e.desc["route_error_rate"], prometheus.GaugeValue, status.ErrorRate, status.Route)
+	}
 }
 
 // collectConnectedClients collects the count of connected clients for both SMPP and MM4.
 func (e *MetricExporter) collectConnectedClients(ch chan<- prometheus.Metric) {
-	connectedClientsSMPP := len(e.gateway.SMPPServer.conns)
+	connectedClientsSMPP := len(e.gateway.SMPPServer.BoundClients())
 
 	ch <- prometheus.MustNewConstMetric(e.desc["connected_clients"], prometheus.GaugeValue, float64(connectedClientsSMPP), "SMPP")
 	/*ch <- prometheus.MustNewConstMetric(e.desc["connected_clients"], prometheus.GaugeValue, float64(connectedClientsMM4), "MM4")*/
@@ -70,7 +102,7 @@ func (e *MetricExporter) collectConnectedClients(ch chan<- prometheus.Metric) {
 
 // collectClientStats collects stats related to the clients and numbers for both SMPP and MM4.
 func (e *MetricExporter) collectClientStats(ch chan<- prometheus.Metric) {
-	totalClientsSMPP := len(e.gateway.SMPPServer.conns)
+	totalClientsSMPP := len(e.gateway.SMPPServer.BoundClients())
 	totalNumbersSMPP := 0
 	for _, client := range e.gateway.Clients {
 		totalNumbersSMPP += len(client.Numbers)
@@ -89,27 +121,6 @@ func (e *MetricExporter) collectClientStats(ch chan<- prometheus.Metric) {
 	*/
 }
 
-// collectMessageMetrics gathers retry and message sent metrics for both SMPP and MM4.
-func (e *MetricExporter) collectMessageMetrics(ch chan<- prometheus.Metric) {
-	// Placeholder message retries for SMPP and MM4
-	messageRetriesSMPP := 10 // Example value for SMS retries
-	messageRetriesMM4 := 5   // Example value for MMS retries
-
-	ch <- prometheus.MustNewConstMetric(e.desc["message_retries"], prometheus.CounterValue, float64(messageRetriesSMPP), "SMPP")
-	ch <- prometheus.MustNewConstMetric(e.desc["message_retries"], prometheus.CounterValue, float64(messageRetriesMM4), "MM4")
-
-	// Placeholder messages sent counts for SMPP and MM4 (inbound and outbound)
-	messagesSentInboundSMPP := 100 // Example count
-	messagesSentOutboundSMPP := 80 // Example count
-	messagesSentInboundMM4 := 60   // Example count
-	messagesSentOutboundMM4 := 50  // Example count
-
-	ch <- prometheus.MustNewConstMetric(e.desc["messages_sent"], prometheus.CounterValue, float64(messagesSentInboundSMPP), "SMPP", "inbound")
-	ch <- prometheus.MustNewConstMetric(e.desc["messages_sent"], prometheus.CounterValue, float64(messagesSentOutboundSMPP), "SMPP", "outbound")
-	ch <- prometheus.MustNewConstMetric(e.desc["messages_sent"], prometheus.CounterValue, float64(messagesSentInboundMM4), "MM4", "inbound")
-	ch <- prometheus.MustNewConstMetric(e.desc["messages_sent"], prometheus.CounterValue, float64(messagesSentOutboundMM4), "MM4", "outbound")
-}
-
 // collectServerStatus checks health of each server (SMPP and MM4).
 func (e *MetricExporter) collectServerStatus(ch chan<- prometheus.Metric) {
 	// Placeholder health status: 1 indicates OK
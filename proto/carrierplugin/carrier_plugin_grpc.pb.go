@@ -0,0 +1,299 @@
+// Contract between the gateway and carrier plugins, sidecar processes that implement a carrier
+// outside of this repository. The gateway calls CarrierPlugin over gRPC at the address the plugin
+// registered, with "Bearer <secret>" in the "authorization" metadata when the plugin has a secret.
+// Plugins register through Gateway.Register, served on GRPC_LISTEN and exposed as
+// POST /plugins/register.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v5.27.3
+// source: carrier_plugin.proto
+
+package carrierplugin
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	CarrierPlugin_Send_FullMethodName    = "/carrierplugin.v1.CarrierPlugin/Send"
+	CarrierPlugin_Inbound_FullMethodName = "/carrierplugin.v1.CarrierPlugin/Inbound"
+	CarrierPlugin_Health_FullMethodName  = "/carrierplugin.v1.CarrierPlugin/Health"
+)
+
+// CarrierPluginClient is the client API for CarrierPlugin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// CarrierPlugin is implemented by the plugin.
+type CarrierPluginClient interface {
+	// Send delivers an outbound SMS or MMS to the carrier.
+	Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendResponse, error)
+	// Inbound parses a webhook the carrier posted to /inbound/{uuid} of the gateway.
+	Inbound(ctx context.Context, in *InboundRequest, opts ...grpc.CallOption) (*InboundResponse, error)
+	// Health is called when the plugin registers.
+	Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthResponse, error)
+}
+
+type carrierPluginClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCarrierPluginClient(cc grpc.ClientConnInterface) CarrierPluginClient {
+	return &carrierPluginClient{cc}
+}
+
+func (c *carrierPluginClient) Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SendResponse)
+	err := c.cc.Invoke(ctx, CarrierPlugin_Send_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *carrierPluginClient) Inbound(ctx context.Context, in *InboundRequest, opts ...grpc.CallOption) (*InboundResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(InboundResponse)
+	err := c.cc.Invoke(ctx, CarrierPlugin_Inbound_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *carrierPluginClient) Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HealthResponse)
+	err := c.cc.Invoke(ctx, CarrierPlugin_Health_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CarrierPluginServer is the server API for CarrierPlugin service.
+// All implementations must embed UnimplementedCarrierPluginServer
+// for forward compatibility
+//
+// CarrierPlugin is implemented by the plugin.
+type CarrierPluginServer interface {
+	// Send delivers an outbound SMS or MMS to the carrier.
+	Send(context.Context, *SendRequest) (*SendResponse, error)
+	// Inbound parses a webhook the carrier posted to /inbound/{uuid} of the gateway.
+	Inbound(context.Context, *InboundRequest) (*InboundResponse, error)
+	// Health is called when the plugin registers.
+	Health(context.Context, *HealthRequest) (*HealthResponse, error)
+	mustEmbedUnimplementedCarrierPluginServer()
+}
+
+// UnimplementedCarrierPluginServer must be embedded to have forward compatible implementations.
+type UnimplementedCarrierPluginServer struct {
+}
+
+func (UnimplementedCarrierPluginServer) Send(context.Context, *SendRequest) (*SendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
+}
+func (UnimplementedCarrierPluginServer) Inbound(context.Context, *InboundRequest) (*InboundResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Inbound not implemented")
+}
+func (UnimplementedCarrierPluginServer) Health(context.Context, *HealthRequest) (*HealthResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Health not implemented")
+}
+func (UnimplementedCarrierPluginServer) mustEmbedUnimplementedCarrierPluginServer() {}
+
+// UnsafeCarrierPluginServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CarrierPluginServer will
+// result in compilation errors.
+type UnsafeCarrierPluginServer interface {
+	mustEmbedUnimplementedCarrierPluginServer()
+}
+
+func RegisterCarrierPluginServer(s grpc.ServiceRegistrar, srv CarrierPluginServer) {
+	s.RegisterService(&CarrierPlugin_ServiceDesc, srv)
+}
+
+func _CarrierPlugin_Send_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CarrierPluginServer).Send(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CarrierPlugin_Send_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CarrierPluginServer).Send(ctx, req.(*SendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CarrierPlugin_Inbound_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InboundRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CarrierPluginServer).Inbound(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CarrierPlugin_Inbound_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CarrierPluginServer).Inbound(ctx, req.(*InboundRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CarrierPlugin_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CarrierPluginServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CarrierPlugin_Health_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CarrierPluginServer).Health(ctx, req.(*HealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// CarrierPlugin_ServiceDesc is the grpc.ServiceDesc for CarrierPlugin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var CarrierPlugin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "carrierplugin.v1.CarrierPlugin",
+	HandlerType: (*CarrierPluginServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Send",
+			Handler:    _CarrierPlugin_Send_Handler,
+		},
+		{
+			MethodName: "Inbound",
+			Handler:    _CarrierPlugin_Inbound_Handler,
+		},
+		{
+			MethodName: "Health",
+			Handler:    _CarrierPlugin_Health_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "carrier_plugin.proto",
+}
+
+const (
+	Gateway_Register_FullMethodName = "/carrierplugin.v1.Gateway/Register"
+)
+
+// GatewayClient is the client API for Gateway service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Gateway is implemented by the gateway, calls authenticate with an API key in the
+// "authorization" metadata, "Bearer <key>", that may register plugins.
+type GatewayClient interface {
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
+}
+
+type gatewayClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGatewayClient(cc grpc.ClientConnInterface) GatewayClient {
+	return &gatewayClient{cc}
+}
+
+func (c *gatewayClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RegisterResponse)
+	err := c.cc.Invoke(ctx, Gateway_Register_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GatewayServer is the server API for Gateway service.
+// All implementations must embed UnimplementedGatewayServer
+// for forward compatibility
+//
+// Gateway is implemented by the gateway, calls authenticate with an API key in the
+// "authorization" metadata, "Bearer <key>", that may register plugins.
+type GatewayServer interface {
+	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	mustEmbedUnimplementedGatewayServer()
+}
+
+// UnimplementedGatewayServer must be embedded to have forward compatible implementations.
+type UnimplementedGatewayServer struct {
+}
+
+func (UnimplementedGatewayServer) Register(context.Context, *RegisterRequest) (*RegisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedGatewayServer) mustEmbedUnimplementedGatewayServer() {}
+
+// UnsafeGatewayServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GatewayServer will
+// result in compilation errors.
+type UnsafeGatewayServer interface {
+	mustEmbedUnimplementedGatewayServer()
+}
+
+func RegisterGatewayServer(s grpc.ServiceRegistrar, srv GatewayServer) {
+	s.RegisterService(&Gateway_ServiceDesc, srv)
+}
+
+func _Gateway_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GatewayServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gateway_Register_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GatewayServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Gateway_ServiceDesc is the grpc.ServiceDesc for Gateway service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Gateway_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "carrierplugin.v1.Gateway",
+	HandlerType: (*GatewayServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    _Gateway_Register_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "carrier_plugin.proto",
+}
@@ -0,0 +1,154 @@
+// Streaming messaging API of the gateway, served over gRPC on GRPC_LISTEN next to the REST API.
+// Calls authenticate with an API key in the "authorization" metadata, "Bearer <key>", and the
+// key needs the operate access of POST /messages.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v5.27.3
+// source: messaging.proto
+
+package messaging
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Messaging_Stream_FullMethodName = "/messaging.v1.Messaging/Stream"
+)
+
+// MessagingClient is the client API for Messaging service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Messaging is implemented by the gateway.
+type MessagingClient interface {
+	// Stream carries the messages an integration submits one way and the results of the
+	// submissions, the events of its clients and the inbound messages to its numbers the other.
+	Stream(ctx context.Context, opts ...grpc.CallOption) (Messaging_StreamClient, error)
+}
+
+type messagingClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMessagingClient(cc grpc.ClientConnInterface) MessagingClient {
+	return &messagingClient{cc}
+}
+
+func (c *messagingClient) Stream(ctx context.Context, opts ...grpc.CallOption) (Messaging_StreamClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Messaging_ServiceDesc.Streams[0], Messaging_Stream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &messagingStreamClient{ClientStream: stream}
+	return x, nil
+}
+
+type Messaging_StreamClient interface {
+	Send(*ClientFrame) error
+	Recv() (*ServerFrame, error)
+	grpc.ClientStream
+}
+
+type messagingStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *messagingStreamClient) Send(m *ClientFrame) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *messagingStreamClient) Recv() (*ServerFrame, error) {
+	m := new(ServerFrame)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MessagingServer is the server API for Messaging service.
+// All implementations must embed UnimplementedMessagingServer
+// for forward compatibility
+//
+// Messaging is implemented by the gateway.
+type MessagingServer interface {
+	// Stream carries the messages an integration submits one way and the results of the
+	// submissions, the events of its clients and the inbound messages to its numbers the other.
+	Stream(Messaging_StreamServer) error
+	mustEmbedUnimplementedMessagingServer()
+}
+
+// UnimplementedMessagingServer must be embedded to have forward compatible implementations.
+type UnimplementedMessagingServer struct {
+}
+
+func (UnimplementedMessagingServer) Stream(Messaging_StreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
+}
+func (UnimplementedMessagingServer) mustEmbedUnimplementedMessagingServer() {}
+
+// UnsafeMessagingServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MessagingServer will
+// result in compilation errors.
+type UnsafeMessagingServer interface {
+	mustEmbedUnimplementedMessagingServer()
+}
+
+func RegisterMessagingServer(s grpc.ServiceRegistrar, srv MessagingServer) {
+	s.RegisterService(&Messaging_ServiceDesc, srv)
+}
+
+func _Messaging_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MessagingServer).Stream(&messagingStreamServer{ServerStream: stream})
+}
+
+type Messaging_StreamServer interface {
+	Send(*ServerFrame) error
+	Recv() (*ClientFrame, error)
+	grpc.ServerStream
+}
+
+type messagingStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *messagingStreamServer) Send(m *ServerFrame) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *messagingStreamServer) Recv() (*ClientFrame, error) {
+	m := new(ClientFrame)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Messaging_ServiceDesc is the grpc.ServiceDesc for Messaging service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Messaging_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "messaging.v1.Messaging",
+	HandlerType: (*MessagingServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _Messaging_Stream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "messaging.proto",
+}
@@ -0,0 +1,227 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"zultys-smpp-mm4/core"
+)
+
+// ProvisioningIssue is a problem of the provisioning that would otherwise only show when a message
+// can't be routed, with what to change to fix it.
+type ProvisioningIssue struct {
+	Kind    string `json:"kind"`
+	Subject string `json:"subject"` // the number, rule, LCR entry or client concerned
+	Detail  string `json:"detail"`
+}
+
+const (
+	issueNumberOverlap        = "number_overlap"
+	issueNumberCarrier        = "number_carrier"
+	issueUnknownRoute         = "unknown_route"
+	issueClientWithoutNumbers = "client_without_numbers"
+)
+
+// provisioningCheckMode is warn to log the issues, strict to also refuse to start with any, or off.
+var provisioningCheckMode string
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		provisioningCheckMode = cfg.String("PROVISIONING_CHECK", "warn")
+	})
+}
+
+// provisioningReport is the outcome of the last check. Issues are logged when they first show up,
+// not on every reload while they remain.
+var provisioningReport struct {
+	mu      sync.RWMutex
+	checked bool
+	issues  []ProvisioningIssue
+}
+
+// checkProvisioning checks the loaded clients, numbers, carriers, routing rules and LCR entries
+// against each other and logs the issues found since the last check. It returns all current issues.
+func (gateway *Gateway) checkProvisioning() []ProvisioningIssue {
+	if provisioningCheckMode == "off" {
+		return nil
+	}
+	issues := gateway.provisioningIssues()
+
+	provisioningReport.mu.Lock()
+	known := make(map[ProvisioningIssue]bool, len(provisioningReport.issues))
+	for _, issue := range provisioningReport.issues {
+		known[issue] = true
+	}
+	provisioningReport.checked = true
+	provisioningReport.issues = issues
+	provisioningReport.mu.Unlock()
+
+	var lm = gateway.LogManager
+	for _, issue := range issues {
+		if known[issue] {
+			continue
+		}
+		lm.SendLog(lm.BuildLog(
+			"System.Provisioning",
+			"ProvisioningIssue",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"kind":    issue.Kind,
+				"subject": issue.Subject,
+			}, issue.Detail,
+		))
+	}
+	return issues
+}
+
+// recheckProvisioning checks the provisioning after a reload. The startup check runs once the
+// carriers are loaded, reloads before it would report every route as unknown.
+func (gateway *Gateway) recheckProvisioning() {
+	provisioningReport.mu.RLock()
+	checked := provisioningReport.checked
+	provisioningReport.mu.RUnlock()
+	if checked {
+		gateway.checkProvisioning()
+	}
+}
+
+// currentProvisioningIssues returns the issues of the last check.
+func currentProvisioningIssues() []ProvisioningIssue {
+	provisioningReport.mu.RLock()
+	defer provisioningReport.mu.RUnlock()
+	return append([]ProvisioningIssue{}, provisioningReport.issues...)
+}
+
+type numberOwner struct {
+	client string
+	number string
+}
+
+func (gateway *Gateway) provisioningIssues() []ProvisioningIssue {
+	var issues []ProvisioningIssue
+	owners := make(map[string][]numberOwner) // by numberKey
+
+	// copied first, the carrier lookups take the lock of the gateway themselves
+	gateway.Mu.RLock()
+	usernames := make([]string, 0, len(gateway.Clients))
+	numbers := make(map[string][]core.ClientNumber, len(gateway.Clients))
+	for username, client := range gateway.Clients {
+		usernames = append(usernames, username)
+		numbers[username] = client.Numbers
+	}
+	gateway.Mu.RUnlock()
+
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		if len(numbers[username]) == 0 {
+			issues = append(issues, ProvisioningIssue{
+				Kind:    issueClientWithoutNumbers,
+				Subject: username,
+				Detail:  fmt.Sprintf("client %s has no numbers, it can't send or receive messages; assign it a number or remove it", username),
+			})
+		}
+		for _, number := range numbers[username] {
+			key := core.NumberKey(number.Number)
+			owners[key] = append(owners[key], numberOwner{client: username, number: number.Number})
+			switch {
+			case number.Carrier == "":
+				issues = append(issues, ProvisioningIssue{
+					Kind:    issueNumberCarrier,
+					Subject: number.Number,
+					Detail: fmt.Sprintf("number %s of client %s has no carrier, messages from it are only routed when a routing rule or LCR entry matches; set its carrier",
+						number.Number, username),
+				})
+			case gateway.Router.FindCarrierRoute(number.Carrier) == nil:
+				issues = append(issues, ProvisioningIssue{
+					Kind:    issueNumberCarrier,
+					Subject: number.Number,
+					Detail: fmt.Sprintf("number %s of client %s uses the unknown carrier %s; set it to a loaded carrier or add the carrier",
+						number.Number, username, number.Carrier),
+				})
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(owners))
+	for key := range owners {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if clients := distinctClients(owners[key]); len(clients) > 1 {
+			issues = append(issues, ProvisioningIssue{
+				Kind:    issueNumberOverlap,
+				Subject: owners[key][0].number,
+				Detail: fmt.Sprintf("number %s is assigned to the clients %s, its messages go to only one of them; keep it on one client",
+					owners[key][0].number, strings.Join(clients, ", ")),
+			})
+		}
+		if !gateway.NumberIndex.PrefixMatch {
+			continue
+		}
+		// an assigned prefix of the number is a block of another client that excludes it
+		for i := len(key) - 1; i > 0; i-- {
+			blocks, ok := owners[key[:i]]
+			if !ok {
+				continue
+			}
+			for _, owner := range owners[key] {
+				if blocks[0].client == owner.client {
+					continue
+				}
+				issues = append(issues, ProvisioningIssue{
+					Kind:    issueNumberOverlap,
+					Subject: owner.number,
+					Detail: fmt.Sprintf("number %s of client %s lies in the block %s of client %s, with NUMBER_PREFIX_MATCH its messages go to %s; move the number or the block to one client",
+						owner.number, owner.client, blocks[0].number, blocks[0].client, owner.client),
+				})
+			}
+		}
+	}
+
+	for _, rule := range gateway.Router.Rules.Rules() {
+		if rule.Disabled {
+			continue
+		}
+		for _, route := range rule.Routes() {
+			if gateway.Router.FindCarrierRoute(route) != nil {
+				continue
+			}
+			issues = append(issues, ProvisioningIssue{
+				Kind:    issueUnknownRoute,
+				Subject: fmt.Sprintf("routing rule %d", rule.ID),
+				Detail: fmt.Sprintf("routing rule %d (%s) routes to the unknown carrier %s, the messages it matches can't be sent; fix the route or disable the rule",
+					rule.ID, rule.Name, route),
+			})
+		}
+	}
+	for _, entry := range gateway.Router.LCR.Entries() {
+		if entry.Disabled || gateway.Router.FindCarrierRoute(entry.Route) != nil {
+			continue
+		}
+		issues = append(issues, ProvisioningIssue{
+			Kind:    issueUnknownRoute,
+			Subject: fmt.Sprintf("lcr entry %d", entry.ID),
+			Detail: fmt.Sprintf("LCR entry %d for prefix %q routes to the unknown carrier %s, the messages it is chosen for can't be sent on it; fix the route or disable the entry",
+				entry.ID, entry.Prefix, entry.Route),
+		})
+	}
+	return issues
+}
+
+// distinctClients returns the clients of the owners in order, each once.
+func distinctClients(owners []numberOwner) []string {
+	var clients []string
+	for _, owner := range owners {
+		found := false
+		for _, client := range clients {
+			found = found || client == owner.client
+		}
+		if !found {
+			clients = append(clients, owner.client)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,270 @@
+package router
+
+import (
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+var autoReplyInterval time.Duration
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		autoReplyInterval = cfg.Duration("AUTO_REPLY_INTERVAL", time.Hour)
+	})
+}
+
+// validateAutoReply compiles the reply and checks that its number belongs to its client.
+func (router *Router) validateAutoReply(reply *core.AutoReply) error {
+	gateway := router.gateway
+	if err := reply.Compile(); err != nil {
+		return core.Invalid("%v", err)
+	}
+	client, ok := gateway.ClientByID(reply.ClientID)
+	if !ok {
+		return core.Invalid("client %d does not exist", reply.ClientID)
+	}
+	if reply.Number != "" {
+		reply.Number = core.NumberKey(reply.Number)
+		if owner := gateway.GetClient(reply.Number); owner == nil || owner.ID != client.ID {
+			return core.Invalid("number %s does not belong to client %d", reply.Number, client.ID)
+		}
+	}
+	return nil
+}
+
+// AutoResponder holds the compiled auto-replies, it is safe to swap them while answering.
+type AutoResponder struct {
+	mu       sync.RWMutex
+	replies  []*core.AutoReply
+	answered core.LookupCache // auto-reply and sender pairs answered in the last AUTO_REPLY_INTERVAL
+}
+
+func NewAutoResponder() *AutoResponder {
+	return &AutoResponder{answered: core.NewLocalCache(core.CacheSize, autoReplyInterval)}
+}
+
+// SetReplies compiles and swaps in a new set of replies, invalid replies are skipped and reported.
+func (responder *AutoResponder) SetReplies(replies []core.AutoReply) []error {
+	var errs []error
+	compiled := make([]*core.AutoReply, 0, len(replies))
+	for i := range replies {
+		reply := replies[i]
+		if err := reply.Compile(); err != nil {
+			errs = append(errs, fmt.Errorf("auto-reply %d: %w", reply.ID, err))
+			continue
+		}
+		compiled = append(compiled, &reply)
+	}
+
+	sort.SliceStable(compiled, func(i, j int) bool {
+		if compiled[i].Position == compiled[j].Position {
+			return compiled[i].ID < compiled[j].ID
+		}
+		return compiled[i].Position < compiled[j].Position
+	})
+
+	responder.mu.Lock()
+	responder.replies = compiled
+	responder.mu.Unlock()
+	return errs
+}
+
+// Match returns the reply answering a message to the client, or nil.
+func (responder *AutoResponder) Match(msg *core.MsgQueueItem, client *core.Client, now time.Time) *core.AutoReply {
+	responder.mu.RLock()
+	defer responder.mu.RUnlock()
+	for _, reply := range responder.replies {
+		if reply.Matches(msg, client, now) {
+			return reply
+		}
+	}
+	return nil
+}
+
+// loadAutoReplies loads the auto-replies from the database.
+func (router *Router) loadAutoReplies() error {
+	gateway := router.gateway
+	var replies []core.AutoReply
+	if err := gateway.DB.Order("position asc, id asc").Find(&replies).Error; err != nil {
+		return err
+	}
+	var lm = gateway.LogManager
+	for _, err := range router.AutoReplies.SetReplies(replies) {
+		lm.SendLog(lm.BuildLog(
+			"Router.AutoReply.Load",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil, err,
+		))
+	}
+	return nil
+}
+
+// autoReply answers an inbound message to a client number when one of its auto-replies matches
+// and the sender wasn't answered by it within AUTO_REPLY_INTERVAL. Opt-out keywords are answered
+// by handleKeyword instead.
+func (router *Router) autoReply(msg *core.MsgQueueItem, client *core.Client) {
+	if core.OptOutKeywordsEnabled {
+		keyword := core.MessageKeyword(msg.Message)
+		if core.StopKeywords[keyword] || core.StartKeywords[keyword] || core.HelpKeywords[keyword] {
+			return
+		}
+	}
+	reply := router.AutoReplies.Match(msg, client, time.Now())
+	if reply == nil {
+		return
+	}
+
+	var lm = router.gateway.LogManager
+	key := core.AutoReplyCacheKey + strconv.FormatUint(uint64(reply.ID), 10) + ":" + core.NumberKey(msg.From)
+	if _, answered, err := router.AutoReplies.answered.Get(key); err == nil && answered {
+		return
+	}
+	if err := router.AutoReplies.answered.Set(key, "1"); err != nil {
+		// a cache outage answers the sender again rather than not at all
+		lm.SendLog(lm.BuildLog(
+			"Router.AutoReply",
+			"GenericError",
+			logrus.WarnLevel,
+			router.gateway.MsgFields(msg, nil), err,
+		))
+	}
+
+	text := strings.ReplaceAll(core.KeywordReply(reply.Reply, "", client, msg.To), "{sender}", msg.From)
+	answer := core.MsgQueueItem{
+		To:                msg.From,
+		From:              msg.To,
+		ReceivedTimestamp: time.Now(),
+		Type:              core.MsgQueueItemType.SMS,
+		Message:           text,
+		LogID:             primitive.NewObjectID().Hex(),
+		SkipOptOut:        true,
+	}
+	answer.TraceID = answer.LogID
+	lm.SendLog(lm.BuildLog(
+		"Router.AutoReply",
+		"AutoReplied",
+		logrus.InfoLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client":    client.Username,
+			"autoReply": reply.ID,
+		}), reply.ID,
+	))
+	if err := router.OfferClientMessage(answer); err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.AutoReply",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&answer, map[string]interface{}{
+				"client": client.Username,
+			}), err,
+		))
+	}
+}
+
+// SetupAutoReplyRoutes sets up the management of the auto-replies.
+func SetupAutoReplyRoutes(app *iris.Application, router *Router) {
+	gateway := router.gateway
+	replies := app.Party("/autoreplies", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// List auto-replies in evaluation order, optionally of a client
+		replies.Get("/", func(ctx iris.Context) {
+			query := gateway.DB.Order("position asc, id asc")
+			if client := ctx.URLParamIntDefault("client_id", 0); client > 0 {
+				query = query.Where("client_id = ?", client)
+			}
+			var list []core.AutoReply
+			if err := query.Find(&list).Error; err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			visible := make([]core.AutoReply, 0, len(list))
+			for _, reply := range list {
+				client, _ := gateway.ClientByID(reply.ClientID)
+				if core.KeyAllowsClient(ctx, client) {
+					visible = append(visible, reply)
+				}
+			}
+			ctx.JSON(visible)
+		})
+
+		// Add an auto-reply
+		replies.Post("/", func(ctx iris.Context) {
+			var reply core.AutoReply
+			if err := ctx.ReadJSON(&reply); err != nil {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid request data"))
+				return
+			}
+			reply.ID = 0
+			reply.Version = 0
+			if err := router.validateAutoReply(&reply); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			client, _ := gateway.ClientByID(reply.ClientID)
+			if err := gateway.CheckClientScope(ctx, client.Username); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.DB.Create(&reply).Error; err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := router.loadAutoReplies(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(reply)
+		})
+
+		// Replace an auto-reply, the body carries the version it was read with
+		replies.Put("/{id:uint}", func(ctx iris.Context) {
+			var reply core.AutoReply
+			if err := ctx.ReadJSON(&reply); err != nil {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid request data"))
+				return
+			}
+			reply.ID = ctx.Params().GetUintDefault("id", 0)
+			if err := router.validateAutoReply(&reply); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			client, _ := gateway.ClientByID(reply.ClientID)
+			if err := gateway.CheckClientScope(ctx, client.Username); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := core.UpdateVersioned(gateway.DB, &reply, reply.ID, &reply.Version, "*"); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := router.loadAutoReplies(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(reply)
+		})
+
+		// Delete an auto-reply
+		replies.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := core.DeleteVersioned(gateway.DB, &core.AutoReply{}, ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := router.loadAutoReplies(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Auto-reply deleted"})
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"context"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// OfferClientMessage queues a message received from a client without blocking the ingress.
+func (router *Router) OfferClientMessage(msg core.MsgQueueItem) error {
+	return router.offer(router.ClientMsgChan, "client", msg)
+}
+
+// OfferCarrierMessage queues a message received from a carrier without blocking the ingress.
+func (router *Router) OfferCarrierMessage(msg core.MsgQueueItem) error {
+	return router.offer(router.CarrierMsgChan, "carrier", msg)
+}
+
+// offer puts the message on the in-memory queue, or publishes it to the AMQP queue feeding the
+// same router when the in-memory queue is full. Messages of ingress without a span of their own,
+// like carrier webhooks, start their trace here.
+func (router *Router) offer(ch chan core.MsgQueueItem, queue string, msg core.MsgQueueItem) (err error) {
+	core.StampExpiry(&msg, core.DefaultMessageTTL)
+	span := core.StartMsgSpan(queue+" publish", core.SpanKindProducer, &msg)
+	span.SetAttributes(map[string]interface{}{"messaging.destination.name": queue})
+	defer func() { span.End(err) }()
+
+	select {
+	case ch <- msg:
+		return nil
+	default:
+	}
+
+	if router.gateway.Queue == nil || !router.gateway.Queue.Accepting() {
+		return core.ErrQueueFull
+	}
+
+	msg.QueuedTimestamp = time.Now()
+	marshal, err := core.EncodeMsgQueueItem(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := msg.SendContext(context.Background())
+	defer cancel()
+	if err := router.gateway.Queue.PublishWithHeaders(ctx, queue, marshal, core.MessageHeaders(msg, nil)); err != nil {
+		return core.ErrQueueFull
+	}
+	return nil
+}
+
+// ClientSaturated reports whether the client router can't take more messages in memory, ingress
+// that can't be answered asynchronously uses it to push back before accepting a message.
+func (router *Router) ClientSaturated() bool {
+	return len(router.ClientMsgChan) >= cap(router.ClientMsgChan) &&
+		(router.gateway.Queue == nil || !router.gateway.Queue.Accepting())
+}
@@ -0,0 +1,30 @@
+package router
+
+import (
+	"strconv"
+	"zultys-smpp-mm4/core"
+)
+
+// transliterateMessage transliterates an SMS for a carrier route when the profile of the client
+// that sent it, or the carrier's transliterate config (SMS_TRANSLITERATE when it doesn't set it),
+// asks for it. The text as submitted is restored by revertTransliteration for the next route.
+func (router *Router) transliterateMessage(msg *core.MsgQueueItem, client *core.Client, route string) {
+	if msg.Type != core.MsgQueueItemType.SMS || msg.SubmittedText != "" {
+		return
+	}
+	enabled := client != nil && client.Profile.Transliterate
+	if !enabled {
+		setting, err := strconv.ParseBool(router.gateway.CarrierSetting(route, "transliterate", ""))
+		enabled = (err == nil && setting) || (err != nil && core.SMSTransliterate)
+	}
+	if !enabled {
+		return
+	}
+	username := ""
+	if client != nil {
+		username = client.Username
+	}
+	if text := core.TransliterateText(username, route, msg.Message); text != msg.Message {
+		msg.SubmittedText, msg.Message = msg.Message, text
+	}
+}
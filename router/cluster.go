@@ -0,0 +1,200 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+// forwardToSession publishes a message for a client bound to another instance to the queue of that
+// instance, it reports whether the message was forwarded. The other instance only delivers it,
+// the routing done here isn't repeated.
+func (router *Router) forwardToSession(ctx context.Context, msg core.MsgQueueItem, client *core.Client, queue string) bool {
+	decision, ok := router.sessionForward(&msg, client, queue)
+	if ok {
+		router.settle(ctx, msg, queue, decision)
+	}
+	return ok
+}
+
+// sessionForward returns the decision rerouting a message to the instance the client is bound
+// to, if it is bound to another one.
+func (router *Router) sessionForward(msg *core.MsgQueueItem, client *core.Client, queue string) (Decision, bool) {
+	var lm = router.gateway.LogManager
+	if !core.ClusterEnabled {
+		return Decision{}, false
+	}
+
+	serverID, err := router.gateway.SessionInstance(client.Username)
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.Cluster",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"client": client.Username,
+			}), err,
+		))
+		return Decision{}, false
+	}
+	if serverID == "" {
+		return Decision{}, false
+	}
+
+	lm.SendLog(lm.BuildLog(
+		"Router.Cluster",
+		"SessionForwarded",
+		logrus.DebugLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client": client.Username,
+		}), serverID,
+	))
+	decision := rerouteDecision(core.InstanceQueueName(serverID), core.RoutingOutcomes.Forwarded, "instance:"+serverID)
+	decision.Reason = "client bound to " + serverID
+	decision.Class = core.RetryClasses.ClientOffline
+	decision.Headers = map[string]interface{}{
+		core.AttemptsHeader:     int32(msg.Attempts),
+		core.ForwardKindHeader:  core.ForwardKinds.Message,
+		core.ForwardQueueHeader: queue,
+	}
+	return decision, true
+}
+
+// InstanceMsgConsumer delivers the messages and receipts other instances forwarded to the clients
+// bound to this one. A message whose client is gone by now goes back to the queue it was routed
+// from, to be routed again.
+func (router *Router) InstanceMsgConsumer() {
+	var lm = router.gateway.LogManager
+	queue := core.InstanceQueueName(router.gateway.ServerID)
+
+	for delivery := range router.gateway.Queue.Consume(queue) {
+		msg, err := core.DecodeMsgQueueItem(delivery.Body)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Router.Consume",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"queue": queue,
+					"logID": core.LogIDFromHeaders(delivery.Headers),
+				}, err,
+			))
+			_ = delivery.Nack(false)
+			continue
+		}
+		if msg.LogID == "" {
+			msg.LogID = core.LogIDFromHeaders(delivery.Headers)
+		}
+		if traceParent := core.TraceParentFromHeaders(delivery.Headers); traceParent != "" {
+			msg.TraceParent = traceParent
+		}
+		delivery := delivery
+		msg.Delivery = &delivery
+		if attempts := core.AttemptsFromHeaders(delivery.Headers); attempts > msg.Attempts {
+			msg.Attempts = attempts
+		}
+
+		if kind, _ := delivery.Headers[core.ForwardKindHeader].(string); kind == core.ForwardKinds.Receipt {
+			router.deliverForwardedReceipt(msg)
+			continue
+		}
+		origin, _ := delivery.Headers[core.ForwardQueueHeader].(string)
+		if origin != "client" {
+			origin = "carrier"
+		}
+		router.deliverForwarded(msg, origin)
+	}
+}
+
+// deliverForwarded delivers a forwarded message to the local session of its client.
+func (router *Router) deliverForwarded(msg core.MsgQueueItem, queue string) {
+	var lm = router.gateway.LogManager
+	router.beginDecision(&msg, queue)
+
+	if msg.Expired(time.Now()) {
+		router.expireMessage(msg, queue)
+		return
+	}
+
+	toClient, _ := router.gateway.FindClientByNumber(msg.To)
+	if toClient == nil {
+		router.retry(msg, queue, core.RetryClasses.ClientOffline, "no client found for destination")
+		return
+	}
+	session, err := router.SMPP.FindSession(msg.To)
+	if err == nil {
+		ctx, cancel := msg.SendContext(context.Background())
+		err = router.SMPP.SendSMPP(ctx, msg, session)
+		cancel()
+	}
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.Cluster",
+			"RouterSendSMPP",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, map[string]interface{}{
+				"toClient": toClient.Username,
+			}), err,
+		))
+		router.retry(msg, queue, core.ClientRetryClass(err, core.RetryClasses.ClientOffline), err.Error())
+		return
+	}
+
+	router.recordDecision(&msg, core.RoutingOutcomes.Delivered, "smpp:"+toClient.Username, "forwarded")
+	if queue == "carrier" {
+		router.gateway.MsgRecordChan <- core.MsgRecord{
+			MsgQueueItem: msg,
+			Carrier:      "inbound",
+			ClientID:     toClient.ID,
+			Internal:     false,
+		}
+	} else {
+		fromClient, _ := router.gateway.FindClientByNumber(msg.From)
+		if fromClient != nil {
+			router.gateway.MsgRecordChan <- core.MsgRecord{
+				MsgQueueItem: msg,
+				Carrier:      "from_client",
+				ClientID:     fromClient.ID,
+				Internal:     true,
+			}
+		}
+		router.gateway.MsgRecordChan <- core.MsgRecord{
+			MsgQueueItem: msg,
+			Carrier:      "to_client",
+			ClientID:     toClient.ID,
+			Internal:     fromClient != nil,
+		}
+	}
+	if msg.Delivery != nil {
+		_ = msg.Delivery.Ack()
+	}
+}
+
+// deliverForwardedReceipt sends a forwarded delivery receipt to the local session of its client.
+// Receipts aren't retried, as receipts of this instance aren't either.
+func (router *Router) deliverForwardedReceipt(msg core.MsgQueueItem) {
+	var lm = router.gateway.LogManager
+
+	state, _ := msg.Delivery.Headers[core.ReceiptStateHeader].(int32)
+	if value, ok := msg.Delivery.Headers[core.ReceiptStateHeader].(float64); ok { // replayed from the outbox
+		state = int32(value)
+	}
+	errCode, _ := msg.Delivery.Headers[core.ReceiptErrorHeader].(string)
+
+	session, err := router.SMPP.FindSession(msg.From)
+	if err == nil {
+		err = router.SMPP.WriteDeliveryReceipt(session, msg, pdu.MessageState(state), errCode)
+	}
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.Cluster",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, nil), fmt.Errorf("forwarded delivery receipt: %w", err),
+		))
+	}
+	_ = msg.Delivery.Ack()
+}
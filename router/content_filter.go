@@ -0,0 +1,546 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// validateContentRule compiles the rule and checks that its client belongs to its tenant.
+func (router *Router) validateContentRule(rule *core.ContentRule) error {
+	gateway := router.gateway
+	if err := rule.Compile(); err != nil {
+		return core.Invalid("%v", err)
+	}
+	if err := core.ValidateTenantID(rule.TenantID); err != nil {
+		return err
+	}
+	if rule.ClientID != 0 {
+		client, ok := gateway.ClientByID(rule.ClientID)
+		if !ok {
+			return core.Invalid("client %d does not exist", rule.ClientID)
+		}
+		if rule.TenantID != 0 && client.TenantID != rule.TenantID {
+			return core.Invalid("client %d does not belong to tenant %d", rule.ClientID, rule.TenantID)
+		}
+	}
+	return nil
+}
+
+// ContentVerdict is the outcome of screening a message.
+type ContentVerdict struct {
+	Action   string `json:"action"`
+	Rule     string `json:"rule,omitempty"` // name of the rule or classifier
+	Category string `json:"category,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// worse returns the more severe of two verdicts, the first on a tie.
+func (verdict ContentVerdict) worse(other ContentVerdict) ContentVerdict {
+	if core.ContentActionSeverity[other.Action] > core.ContentActionSeverity[verdict.Action] {
+		return other
+	}
+	return verdict
+}
+
+// ContentClassifier screens outbound messages besides the content rules, e.g. an external
+// classification service. An empty action lets the message through.
+type ContentClassifier interface {
+	Name() string
+	Classify(ctx context.Context, msg *core.MsgQueueItem, client *core.Client) (ContentVerdict, error)
+}
+
+// ContentFilter holds the compiled content rules and the classifiers, it is safe to swap the rules
+// while screening.
+type ContentFilter struct {
+	mu          sync.RWMutex
+	rules       []*core.ContentRule
+	classifiers []ContentClassifier
+}
+
+func NewContentFilter() *ContentFilter {
+	filter := &ContentFilter{}
+	if url := core.Getenv("CONTENT_CLASSIFIER_URL"); url != "" {
+		filter.classifiers = append(filter.classifiers, newHTTPClassifier(url))
+	}
+	return filter
+}
+
+// Rules returns the loaded rules in evaluation order.
+func (filter *ContentFilter) Rules() []*core.ContentRule {
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+	return append([]*core.ContentRule(nil), filter.rules...)
+}
+
+// SetRules compiles and swaps in a new rule set, invalid rules are skipped and reported.
+func (filter *ContentFilter) SetRules(rules []core.ContentRule) []error {
+	var errs []error
+	compiled := make([]*core.ContentRule, 0, len(rules))
+	for i := range rules {
+		rule := rules[i]
+		if err := rule.Compile(); err != nil {
+			errs = append(errs, fmt.Errorf("content rule %d (%s): %w", rule.ID, rule.Name, err))
+			continue
+		}
+		compiled = append(compiled, &rule)
+	}
+
+	sort.SliceStable(compiled, func(i, j int) bool {
+		if compiled[i].Position == compiled[j].Position {
+			return compiled[i].ID < compiled[j].ID
+		}
+		return compiled[i].Position < compiled[j].Position
+	})
+
+	filter.mu.Lock()
+	filter.rules = compiled
+	filter.mu.Unlock()
+	return errs
+}
+
+// Screen returns the most severe verdict of the rules and, unless a rule already blocks the
+// message, the classifiers. Classifiers that fail are reported in errs and don't decide anything.
+func (filter *ContentFilter) Screen(msg *core.MsgQueueItem, client *core.Client) (verdict ContentVerdict, errs []error) {
+	filter.mu.RLock()
+	for _, rule := range filter.rules {
+		if !rule.AppliesTo(client) {
+			continue
+		}
+		if matched := rule.Match(msg.Message); matched != "" {
+			verdict = verdict.worse(ContentVerdict{
+				Action:   rule.Action,
+				Rule:     rule.Name,
+				Category: rule.Category,
+				Reason:   fmt.Sprintf("matched %q", matched),
+			})
+		}
+	}
+	classifiers := filter.classifiers
+	filter.mu.RUnlock()
+
+	if verdict.Action == core.ContentActions.Block || msg.Message == "" {
+		return verdict, nil
+	}
+	for _, classifier := range classifiers {
+		ctx, cancel := context.WithTimeout(context.Background(), contentClassifierTimeout)
+		result, err := classifier.Classify(ctx, msg, client)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("content classifier %s: %w", classifier.Name(), err))
+			result = ContentVerdict{Action: contentClassifierFailure, Reason: err.Error()}
+		}
+		if result.Rule == "" {
+			result.Rule = classifier.Name()
+		}
+		verdict = verdict.worse(result)
+	}
+	return verdict, errs
+}
+
+var (
+	contentClassifierTimeout time.Duration
+	// contentClassifierFailure is the action for messages the classifier couldn't screen, allow by
+	// default so an outage of the service doesn't stop the traffic
+	contentClassifierFailure string
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		contentClassifierTimeout = cfg.Duration("CONTENT_CLASSIFIER_TIMEOUT", 2*time.Second)
+		contentClassifierFailure = cfg.Getenv("CONTENT_CLASSIFIER_FAILURE")
+	})
+}
+
+// httpClassifier posts the messages to CONTENT_CLASSIFIER_URL, signed like the event webhooks
+// with CONTENT_CLASSIFIER_SECRET. The service answers with a verdict, e.g.
+// {"action": "quarantine", "category": "cannabis", "reason": "dispensary offer"}.
+type httpClassifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newHTTPClassifier(url string) *httpClassifier {
+	return &httpClassifier{
+		url:    url,
+		secret: core.Getenv("CONTENT_CLASSIFIER_SECRET"),
+		client: &http.Client{},
+	}
+}
+
+func (c *httpClassifier) Name() string { return "classifier" }
+
+func (c *httpClassifier) Classify(ctx context.Context, msg *core.MsgQueueItem, client *core.Client) (ContentVerdict, error) {
+	var verdict ContentVerdict
+	body, err := json.Marshal(map[string]interface{}{
+		"log_id":      msg.LogID,
+		"client":      client.Username,
+		"tenant_id":   client.TenantID,
+		"from_number": msg.From,
+		"to_number":   msg.To,
+		"type":        string(msg.Type),
+		"message":     msg.Message,
+		"hosts":       core.MessageHosts(msg.Message),
+	})
+	if err != nil {
+		return verdict, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return verdict, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "zultys-smpp-mm4")
+	if c.secret != "" {
+		req.Header.Set(core.EventSignatureHeader, core.SignEvent(c.secret, time.Now(), body))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return verdict, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return verdict, fmt.Errorf("classifier answered %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return verdict, fmt.Errorf("failed to decode the verdict: %w", err)
+	}
+	if verdict.Action == "allow" {
+		verdict.Action = core.ContentActions.Allow
+	}
+	if _, ok := core.ContentActionSeverity[verdict.Action]; !ok {
+		return ContentVerdict{}, fmt.Errorf("unknown action %q", verdict.Action)
+	}
+	verdict.Rule = ""
+	return verdict, nil
+}
+
+// screenContent screens a message of a client before it is queued for a carrier, and reports
+// whether it may be sent, or else the decision for it. Blocked messages are dead-lettered,
+// quarantined ones held for review.
+func (router *Router) screenContent(msg *core.MsgQueueItem, client *core.Client) (Decision, bool) {
+	var lm = router.gateway.LogManager
+	verdict, errs := router.Content.Screen(msg, client)
+	for _, err := range errs {
+		lm.SendLog(lm.BuildLog(
+			"Router.Content",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"client": client.Username,
+			}), err,
+		))
+	}
+	msg.Screened = true
+	if verdict.Action == core.ContentActions.Allow {
+		return Decision{}, true
+	}
+
+	core.ContentScreens.WithLabelValues(verdict.Action, verdict.Category, client.Username).Inc()
+	lm.SendLog(lm.BuildLog(
+		"Router.Content",
+		"ContentScreened",
+		logrus.WarnLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client":   client.Username,
+			"rule":     verdict.Rule,
+			"category": verdict.Category,
+			"reason":   verdict.Reason,
+		}), verdict.Action,
+	))
+
+	switch verdict.Action {
+	case core.ContentActions.Flag:
+		router.gateway.EmitMessageEvent(core.EventTypes.MessageFlagged, msg, verdict.eventData())
+		return Decision{}, true
+	case core.ContentActions.Quarantine:
+		return router.quarantineMessage(msg, client, verdict), false
+	}
+	router.gateway.EmitMessageEvent(core.EventTypes.MessageBlocked, msg, verdict.eventData())
+	return rejectDecision(core.ErrorClasses.SpamBlock, "content blocked by "+verdict.Rule+": "+verdict.Reason), false
+}
+
+func (verdict ContentVerdict) eventData() map[string]interface{} {
+	return map[string]interface{}{
+		"rule":     verdict.Rule,
+		"category": verdict.Category,
+		"reason":   verdict.Reason,
+	}
+}
+
+// quarantineMessage stores a message for review, the message is retried when it can't be stored.
+func (router *Router) quarantineMessage(msg *core.MsgQueueItem, client *core.Client, verdict ContentVerdict) Decision {
+	payload, err := core.EncodeMsgQueueItem(*msg)
+	if err != nil {
+		return deadLetterDecision(err.Error())
+	}
+	sealed, err := router.gateway.SealPayload(msg, payload)
+	if err != nil {
+		return RetryDecision(core.RetryClasses.ClientSend, err.Error())
+	}
+	message, err := router.gateway.SealBody(client.TenantID, msg.Message)
+	if err != nil {
+		return RetryDecision(core.RetryClasses.ClientSend, err.Error())
+	}
+	err = router.gateway.DB.Create(&core.QuarantinedMessage{
+		MessageID: msg.LogID,
+		ClientID:  client.ID,
+		TenantID:  client.TenantID,
+		From:      msg.From,
+		To:        msg.To,
+		Type:      string(msg.Type),
+		Message:   message,
+		Rule:      verdict.Rule,
+		Category:  verdict.Category,
+		Reason:    verdict.Reason,
+		Status:    core.QuarantineStatuses.Held,
+		Payload:   sealed,
+	}).Error
+	if err != nil {
+		msg.Screened = false
+		return RetryDecision(core.RetryClasses.ClientSend, err.Error())
+	}
+	router.gateway.EmitMessageEvent(core.EventTypes.MessageQuarantined, msg, verdict.eventData())
+	decision := AckDecision(core.RoutingOutcomes.Quarantined, "quarantine")
+	decision.Reason = verdict.Rule + ": " + verdict.Reason
+	return decision
+}
+
+// reviewQuarantined releases a held message to its carrier or rejects it. The status is claimed
+// first, so a message is only released or rejected once across the gateway instances.
+func (router *Router) reviewQuarantined(id uint, status string) (core.QuarantinedMessage, error) {
+	gateway := router.gateway
+	var held core.QuarantinedMessage
+	if err := gateway.DB.First(&held, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return held, core.ErrNotFound
+		}
+		return held, err
+	}
+	now := time.Now()
+	claimed := gateway.DB.Model(&core.QuarantinedMessage{}).
+		Where("id = ? AND status = ?", id, core.QuarantineStatuses.Held).
+		Updates(map[string]interface{}{"status": status, "reviewed_at": now})
+	if claimed.Error != nil {
+		return held, claimed.Error
+	}
+	if claimed.RowsAffected == 0 {
+		return held, fmt.Errorf("%w: message is already %s", core.ErrVersionConflict, held.Status)
+	}
+	held.Status = status
+	held.ReviewedAt = &now
+
+	msg, err := gateway.DecodePayload(held.Payload)
+	if err != nil {
+		return held, fmt.Errorf("failed to decode the quarantined message: %v", err)
+	}
+	if status == core.QuarantineStatuses.Released {
+		msg.Attempts = 0
+		return held, router.OfferClientMessage(msg)
+	}
+	go router.reportFailure(msg, core.ErrorClasses.SpamBlock)
+	router.deadLetter(msg, "client", "content rejected from quarantine: "+held.Reason)
+	return held, nil
+}
+
+// loadContentRules loads the content rules from the database.
+func (router *Router) loadContentRules() error {
+	gateway := router.gateway
+	var rules []core.ContentRule
+	if err := gateway.DB.Order("position asc, id asc").Find(&rules).Error; err != nil {
+		return err
+	}
+	var lm = gateway.LogManager
+	for _, err := range router.Content.SetRules(rules) {
+		lm.SendLog(lm.BuildLog(
+			"Router.Content.Load",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil, err,
+		))
+	}
+	return nil
+}
+
+// SetupContentRoutes sets up the content rules and the review of quarantined messages.
+func SetupContentRoutes(app *iris.Application, router *Router) {
+	gateway := router.gateway
+	rules := app.Party("/content/rules", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// List content rules in evaluation order
+		rules.Get("/", func(ctx iris.Context) {
+			var list []core.ContentRule
+			query := gateway.DB.Order("position asc, id asc")
+			if tenant := core.RequestTenant(ctx); tenant != 0 {
+				query = query.Where("tenant_id = ?", tenant)
+			}
+			if err := query.Find(&list).Error; err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(list)
+		})
+
+		// Add a content rule
+		rules.Post("/", func(ctx iris.Context) {
+			var rule core.ContentRule
+			if err := ctx.ReadJSON(&rule); err != nil {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid request data"))
+				return
+			}
+			rule.ID = 0
+			rule.Version = 0
+			core.AssignTenant(ctx, &rule.TenantID)
+
+			if err := router.validateContentRule(&rule); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.DB.Create(&rule).Error; err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := router.loadContentRules(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(rule)
+		})
+
+		// Replace a content rule, the body carries the version it was read with
+		rules.Put("/{id:uint}", func(ctx iris.Context) {
+			var existing core.ContentRule
+			if err := gateway.DB.First(&existing, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+				core.WriteProvisioningError(ctx, core.ErrNotFound)
+				return
+			}
+			var rule core.ContentRule
+			if err := ctx.ReadJSON(&rule); err != nil {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid request data"))
+				return
+			}
+			rule.ID = existing.ID
+			core.AssignTenant(ctx, &rule.TenantID)
+
+			if err := router.validateContentRule(&rule); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := core.UpdateVersioned(gateway.DB, &rule, rule.ID, &rule.Version, "*"); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := router.loadContentRules(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(rule)
+		})
+
+		// Delete a content rule
+		rules.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := core.DeleteVersioned(gateway.DB, &core.ContentRule{}, ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := router.loadContentRules(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Content rule deleted"})
+		})
+
+		// Screen a text against the rules and the classifier without sending it
+		rules.Post("/test", func(ctx iris.Context) {
+			var req struct {
+				Client  string `json:"client"`
+				Message string `json:"message"`
+			}
+			if err := ctx.ReadJSON(&req); err != nil {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid request data"))
+				return
+			}
+			gateway.Mu.RLock()
+			client := gateway.Clients[req.Client]
+			gateway.Mu.RUnlock()
+			if client == nil {
+				core.WriteProvisioningError(ctx, core.Invalid("client %s does not exist", req.Client))
+				return
+			}
+			if err := gateway.CheckClientScope(ctx, client.Username); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			verdict, errs := router.Content.Screen(&core.MsgQueueItem{Type: core.MsgQueueItemType.SMS, Message: req.Message}, client)
+			if verdict.Action == core.ContentActions.Allow {
+				verdict.Action = "allow"
+			}
+			result := iris.Map{"verdict": verdict}
+			if len(errs) > 0 {
+				result["errors"] = fmt.Sprint(errs)
+			}
+			ctx.JSON(result)
+		})
+	}
+
+	quarantine := app.Party("/content/quarantine", gateway.BasicAuthMiddleware)
+	{
+		// List quarantined messages, newest first, by status (default held) and client id
+		quarantine.Get("/", func(ctx iris.Context) {
+			query := gateway.DB.Order("id desc").Where("status = ?", ctx.URLParamDefault("status", core.QuarantineStatuses.Held))
+			if tenant := core.RequestTenant(ctx); tenant != 0 {
+				query = query.Where("tenant_id = ?", tenant)
+			}
+			if client := ctx.URLParamIntDefault("client_id", 0); client > 0 {
+				query = query.Where("client_id = ?", client)
+			}
+			limit := ctx.URLParamIntDefault("limit", 100)
+			if limit <= 0 || limit > 1000 {
+				limit = 100
+			}
+			list := []core.QuarantinedMessage{}
+			if err := query.Limit(limit).Find(&list).Error; err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			for i := range list {
+				list[i].Message = gateway.RevealBody(ctx, list[i].Message)
+			}
+			ctx.JSON(list)
+		})
+
+		// Release a quarantined message to its carrier
+		quarantine.Post("/{id:uint}/release", func(ctx iris.Context) {
+			held, err := router.reviewQuarantined(ctx.Params().GetUintDefault("id", 0), core.QuarantineStatuses.Released)
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			held.Message = gateway.RevealBody(ctx, held.Message)
+			ctx.JSON(held)
+		})
+
+		// Reject a quarantined message, it is dead-lettered and reported to the client
+		quarantine.Post("/{id:uint}/reject", func(ctx iris.Context) {
+			held, err := router.reviewQuarantined(ctx.Params().GetUintDefault("id", 0), core.QuarantineStatuses.Rejected)
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			held.Message = gateway.RevealBody(ctx, held.Message)
+			ctx.JSON(held)
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package router
+
+import (
+	"github.com/sirupsen/logrus"
+	"zultys-smpp-mm4/core"
+)
+
+// rejectDestination dead-letters a message the country policy of its client doesn't allow.
+func (router *Router) rejectDestination(msg *core.MsgQueueItem, client *core.Client, reason string) Decision {
+	var lm = router.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Router.Client",
+		"DestinationRejected",
+		logrus.WarnLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client":  client.Username,
+			"country": core.CountryOf(msg.To),
+		}), reason,
+	))
+	return rejectDecision(core.ErrorClasses.PolicyBlock, reason)
+}
@@ -0,0 +1,113 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// deadLetter publishes the message to the dead letter queue with the failure reason and acks
+// the original delivery, which goes back to its queue when the publish fails.
+func (router *Router) deadLetter(msg core.MsgQueueItem, queue string, reason string) {
+	var lm = router.gateway.LogManager
+	router.recordDecision(&msg, core.RoutingOutcomes.DeadLetter, core.DeadLetterQueue, reason)
+
+	marshal, err := core.EncodeMsgQueueItem(msg)
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.DeadLetter",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, nil), err,
+		))
+		return
+	}
+
+	err = router.gateway.Queue.PublishWithHeaders(context.Background(), core.DeadLetterQueue, marshal, core.MessageHeaders(msg, map[string]interface{}{
+		"x-origin-queue":       queue,
+		"x-dead-letter-reason": reason,
+		core.AttemptsHeader:    int32(msg.Attempts),
+	}))
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.DeadLetter",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, nil), err,
+		))
+		if msg.Delivery != nil {
+			_ = msg.Delivery.Nack(true)
+		}
+		return
+	}
+
+	if msg.Delivery != nil {
+		_ = msg.Delivery.Ack()
+	}
+	core.DeadLetters.WithLabelValues(queue, router.gateway.ClientLabel(msg.From, msg.To)).Inc()
+	router.gateway.FailEnvelope(&msg, reason)
+	router.gateway.EmitMessageEvent(core.EventTypes.DeadLetterCreated, &msg, map[string]interface{}{
+		"queue":    queue,
+		"reason":   reason,
+		"attempts": msg.Attempts,
+	})
+	router.gateway.EmitMessageEvent(core.EventTypes.MessageFailed, &msg, map[string]interface{}{"reason": reason})
+
+	lm.SendLog(lm.BuildLog(
+		"Router.DeadLetter",
+		"RouterDeadLetter",
+		logrus.WarnLevel,
+		router.gateway.MsgFields(&msg, map[string]interface{}{
+			"queue":    queue,
+			"attempts": msg.Attempts,
+		}), reason,
+	))
+}
+
+// DeadLetterConsumer drains the dead letter queue into Postgres, this covers both messages the
+// router parked explicitly and messages RabbitMQ dead-lettered through the exchange.
+func (router *Router) DeadLetterConsumer() {
+	for delivery := range router.gateway.Queue.Consume(core.DeadLetterQueue) {
+		deadLetter := core.NewDeadLetterFromDelivery(delivery)
+		deadLetter.ServerID = router.gateway.ServerID
+
+		err := router.gateway.SealDeadLetter(deadLetter)
+		if err == nil {
+			err = router.gateway.DB.Create(deadLetter).Error
+		}
+		if errors.Is(err, core.ErrNeedsPostgres) {
+			// nowhere to keep it, the log is all that is left of it
+			var lm = router.gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"Router.DeadLetter",
+				"DeadLetterDropped",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": deadLetter.LogID,
+					"queue": deadLetter.Queue,
+					"from":  deadLetter.From,
+					"to":    deadLetter.To,
+				}, deadLetter.Reason,
+			))
+			_ = delivery.Ack()
+			continue
+		}
+		if err != nil {
+			var lm = router.gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"Router.DeadLetter",
+				"DeadLetterStoreError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"logID": deadLetter.LogID,
+				}, err,
+			))
+			_ = delivery.Nack(true)
+			time.Sleep(core.ReInitDelay)
+			continue
+		}
+		_ = delivery.Ack()
+	}
+}
@@ -0,0 +1,142 @@
+package router
+
+import (
+	"github.com/sirupsen/logrus"
+	"strings"
+	"zultys-smpp-mm4/core"
+)
+
+// CarrierDeliveryStatus updates the status of a message sent to a carrier. The first final status
+// is reported to the client as an SMPP delivery receipt or an MM4 delivery report, the parts of a
+// segmented message once for all of them. A status arriving after the final one is ignored, so a
+// late "sent" doesn't replace "delivered" and a retried callback isn't reported twice.
+func (router *Router) CarrierDeliveryStatus(carrier string, carrierMessageID string, status string, errorCode string) error {
+	var lm = router.gateway.LogManager
+
+	var record core.CarrierMessage
+	if err := router.gateway.DB.Where("carrier = ? AND carrier_message_id = ?", carrier, carrierMessageID).First(&record).Error; err != nil {
+		return err
+	}
+
+	// the error class decides the failure reported, e.g. an opt-out is rejected even when the
+	// carrier calls it undelivered
+	class := core.CarrierErrorClass(router.gateway.CarrierType(carrier), errorCode)
+	if class != core.ErrorClasses.Unknown && (status == core.DeliveryStatuses.Failed || status == core.DeliveryStatuses.Undelivered) {
+		status = class.DeliveryStatus()
+	}
+
+	// conditional, of concurrent callbacks only the one that set the final status reports it
+	result := router.gateway.DB.Model(&core.CarrierMessage{}).
+		Where("id = ? AND status NOT IN ?", record.ID, core.FinalDeliveryStatuses).
+		Updates(map[string]interface{}{
+			"status":      status,
+			"error_code":  errorCode,
+			"error_class": string(class),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		lm.SendLog(lm.BuildLog(
+			"Carrier.DeliveryStatus",
+			"CarrierStatusIgnored",
+			logrus.DebugLevel,
+			map[string]interface{}{
+				"logID":   record.LogID,
+				"carrier": carrier,
+				"status":  status,
+			}, record.Status,
+		))
+		return nil
+	}
+	record.Status, record.ErrorCode, record.ErrorClass = status, errorCode, string(class)
+
+	lm.SendLog(lm.BuildLog(
+		"Carrier.DeliveryStatus",
+		"CarrierStatusCallback",
+		logrus.InfoLevel,
+		map[string]interface{}{
+			"logID":     record.LogID,
+			"carrier":   carrier,
+			"errorCode": errorCode,
+			"class":     string(class),
+		}, status,
+	))
+
+	if !core.FinalDeliveryStatus(status) || record.Mirror {
+		return nil
+	}
+	if strings.HasPrefix(record.LogID, core.VerificationLogPrefix) {
+		return router.gateway.VerificationStatus(record, status, errorCode)
+	}
+	router.gateway.CompleteCDRs(record, status, errorCode, class)
+	if record.Segments > 1 {
+		return router.aggregateReceipts(carrier, record.MultipartID, false)
+	}
+	return router.reportCarrierStatus(record, status, errorCode, class)
+}
+
+// reportCarrierStatus completes the envelope of a message with the final status a carrier reported
+// and reports it to the client that submitted the message.
+func (router *Router) reportCarrierStatus(record core.CarrierMessage, status string, errorCode string, class core.ErrorClass) error {
+	router.gateway.CompleteEnvelope(record.LogID, status, errorCode)
+
+	eventType := core.EventTypes.MessageFailed
+	if status == core.DeliveryStatuses.Delivered {
+		eventType = core.EventTypes.MessageDelivered
+	}
+	router.gateway.EmitMessageEvent(eventType, &core.MsgQueueItem{
+		LogID: record.LogID,
+		Type:  core.MsgQueueType(record.Type),
+		From:  record.From,
+		To:    record.To,
+	}, map[string]interface{}{
+		"route":       record.Carrier,
+		"status":      status,
+		"error_code":  errorCode,
+		"error_class": string(class),
+	})
+
+	msg := core.MsgQueueItem{
+		LogID:             record.LogID,
+		Type:              core.MsgQueueType(record.Type),
+		From:              record.From,
+		To:                record.To,
+		ReceivedTimestamp: record.ReceivedTimestamp,
+		SkipReceipt:       record.SkipReceipt,
+	}
+	client, _ := router.gateway.FindClientByNumber(msg.From)
+	if client == nil {
+		return nil
+	}
+	return router.reportDeliveryStatus(msg, client, status, class)
+}
+
+// reportDeliveryStatus sends a final delivery status to the client that submitted the message, as
+// an SMPP delivery receipt or an MM4 delivery report. class is the error class of a failure.
+func (router *Router) reportDeliveryStatus(msg core.MsgQueueItem, client *core.Client, status string, class core.ErrorClass) error {
+	switch msg.Type {
+	case core.MsgQueueItemType.SMS:
+		if router.SMPP == nil || msg.SkipReceipt {
+			return nil
+		}
+		state := core.MessageStateDelivered
+		switch status {
+		case core.DeliveryStatuses.Failed:
+			state = core.MessageStateRejected
+		case core.DeliveryStatuses.Undelivered:
+			state = core.MessageStateUndeliverable
+		}
+		return router.SMPP.SendDeliveryReceipt(msg, state, class.ReceiptError())
+	case core.MsgQueueItemType.MMS:
+		if router.MM4 == nil {
+			return nil
+		}
+		mmStatus := "Retrieved"
+		if status != core.DeliveryStatuses.Delivered {
+			mmStatus = "Rejected"
+		}
+		return router.MM4.SendMM4DeliveryReport(msg, client, mmStatus)
+	}
+	return nil
+}
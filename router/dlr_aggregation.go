@@ -0,0 +1,127 @@
+package router
+
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// receiptAggregationTimeout is how long the receipts of the other parts of a segmented message are
+// waited for after the first one, the client then gets the status of the parts that reported.
+var receiptAggregationTimeout time.Duration
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		receiptAggregationTimeout = cfg.Duration("DLR_AGGREGATION_TIMEOUT", 10*time.Minute)
+	})
+}
+
+// receiptSeverity orders final statuses by how bad they are, the worst part decides the status of
+// a segmented message.
+func receiptSeverity(status string) int {
+	switch status {
+	case core.DeliveryStatuses.Delivered:
+		return 0
+	case core.DeliveryStatuses.Undelivered:
+		return 1
+	}
+	return 2
+}
+
+// aggregateReceipts reports the combined status of the parts of a segmented message once all of
+// them reported a final status, or with timedOut once those that reported. A message is delivered
+// when every part is, otherwise it has the status and error of its worst part.
+func (router *Router) aggregateReceipts(carrier string, multipartID string, timedOut bool) error {
+	var lm = router.gateway.LogManager
+
+	var parts []core.CarrierMessage
+	if err := router.gateway.DB.Where("carrier = ? AND multipart_id = ?", carrier, multipartID).Find(&parts).Error; err != nil {
+		return err
+	}
+
+	var worst *core.CarrierMessage
+	final := 0
+	for i := range parts {
+		if parts[i].Aggregated {
+			return nil
+		}
+		if !core.FinalDeliveryStatus(parts[i].Status) {
+			continue
+		}
+		final++
+		if worst == nil || receiptSeverity(parts[i].Status) > receiptSeverity(worst.Status) {
+			worst = &parts[i]
+		}
+	}
+	if worst == nil || (!timedOut && final < worst.Segments) {
+		return nil
+	}
+
+	// the instance that marks the parts reports them, a receipt of another part or the sweeper of
+	// another instance may have come first
+	result := router.gateway.DB.Model(&core.CarrierMessage{}).
+		Where("carrier = ? AND multipart_id = ? AND aggregated = ?", carrier, multipartID, false).
+		Update("aggregated", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	level := logrus.InfoLevel
+	if final < worst.Segments {
+		level = logrus.WarnLevel
+	}
+	lm.SendLog(lm.BuildLog(
+		"Carrier.DeliveryStatus",
+		"ReceiptsAggregated",
+		level,
+		map[string]interface{}{
+			"logID":    worst.LogID,
+			"carrier":  carrier,
+			"segments": worst.Segments,
+			"received": final,
+		}, worst.Status,
+	))
+	return router.reportCarrierStatus(*worst, worst.Status, worst.ErrorCode, core.ErrorClass(worst.ErrorClass))
+}
+
+// ReceiptAggregationSweeper reports the segmented messages whose parts didn't all report within
+// DLR_AGGREGATION_TIMEOUT of the first receipt.
+func (router *Router) ReceiptAggregationSweeper() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var pending []struct {
+			Carrier     string
+			MultipartID string
+		}
+		err := router.gateway.DB.Model(&core.CarrierMessage{}).
+			Distinct("carrier", "multipart_id").
+			Where("segments > 1 AND aggregated = ? AND status IN ? AND updated_at < ?", false,
+				[]string{core.DeliveryStatuses.Delivered, core.DeliveryStatuses.Failed, core.DeliveryStatuses.Undelivered},
+				time.Now().Add(-receiptAggregationTimeout)).
+			Scan(&pending).Error
+		if err != nil {
+			router.logAggregationError(err)
+			continue
+		}
+		for _, message := range pending {
+			if err := router.aggregateReceipts(message.Carrier, message.MultipartID, true); err != nil {
+				router.logAggregationError(err)
+			}
+		}
+	}
+}
+
+func (router *Router) logAggregationError(err error) {
+	var lm = router.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Carrier.DeliveryStatus",
+		"GenericError",
+		logrus.ErrorLevel,
+		nil, err,
+	))
+}
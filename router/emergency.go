@@ -0,0 +1,61 @@
+package router
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// rejectEmergency rejects a message to an emergency or special service number. The client gets a
+// REJECTD receipt with err:074, or a Rejected MM4 report, and the bounce-back message, and the
+// block raises the emergency_blocked alert.
+func (router *Router) rejectEmergency(msg *core.MsgQueueItem, client *core.Client, service string) Decision {
+	var lm = router.gateway.LogManager
+	number := core.NumberKey(msg.To)
+	reason := fmt.Sprintf("messages to %s number %s are not supported", service, number)
+	lm.SendLog(lm.BuildLog(
+		"Router.Client",
+		"EmergencyBlocked",
+		logrus.ErrorLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client":  client.Username,
+			"service": service,
+		}), number,
+	))
+
+	core.BlockEmergency(client.Username, number)
+
+	if core.EmergencyBounceReply != "" {
+		router.bounceEmergency(msg, client, number)
+	}
+	return rejectDecision(core.ErrorClasses.EmergencyBlock, reason)
+}
+
+// bounceEmergency answers the sender from the emergency number, the way carriers answer a text to
+// 911 where text-to-911 isn't available.
+func (router *Router) bounceEmergency(msg *core.MsgQueueItem, client *core.Client, number string) {
+	bounce := core.MsgQueueItem{
+		To:                msg.From,
+		From:              number,
+		ReceivedTimestamp: time.Now(),
+		Type:              core.MsgQueueItemType.SMS,
+		Message:           strings.ReplaceAll(core.EmergencyBounceReply, "{number}", number),
+		LogID:             primitive.NewObjectID().Hex(),
+		SkipOptOut:        true,
+	}
+	bounce.TraceID = bounce.LogID
+	if err := router.OfferClientMessage(bounce); err != nil {
+		var lm = router.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.Client",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&bounce, map[string]interface{}{
+				"client": client.Username,
+			}), err,
+		))
+	}
+}
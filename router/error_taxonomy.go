@@ -0,0 +1,27 @@
+package router
+
+import (
+	"github.com/sirupsen/logrus"
+	"zultys-smpp-mm4/core"
+)
+
+// reportFailure sends the final failure status of a dead-lettered message to the client that
+// submitted it, messages from carriers aren't reported.
+func (router *Router) reportFailure(msg core.MsgQueueItem, class core.ErrorClass) {
+	client, _ := router.gateway.FindClientByNumber(msg.From)
+	if client == nil {
+		return
+	}
+	if err := router.reportDeliveryStatus(msg, client, class.DeliveryStatus(), class); err != nil {
+		var lm = router.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.DeadLetter",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, map[string]interface{}{
+				"client": client.Username,
+				"class":  string(class),
+			}), err,
+		))
+	}
+}
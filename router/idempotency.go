@@ -0,0 +1,117 @@
+package router
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+var (
+	// the claims are kept in Postgres, the file backend sends without them
+	carrierIdempotency bool
+	// a pending send older than this lost its sender
+	CarrierSendLease time.Duration
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		carrierIdempotency = cfg.Getenv("CARRIER_IDEMPOTENCY") == "true" || (cfg.Getenv("CARRIER_IDEMPOTENCY") != "false" && core.StorageBackend == "postgres")
+		CarrierSendLease = cfg.Duration("CARRIER_SEND_LEASE", 5*time.Minute)
+	})
+}
+
+// errSendInProgress is returned by sendCarrier when another worker is sending the message.
+var errSendInProgress = errors.New("the message is being sent by another worker")
+
+// idempotentCarrier is a carrier handler that passes the idempotency key of a send to the carrier
+// API, so the carrier drops a repeated send itself.
+type idempotentCarrier interface {
+	idempotent() bool
+}
+
+// claimCarrierSend records that the message is about to be sent on a route. It returns the record
+// to complete after the send and whether the message was sent before, then the record is the
+// earlier send. A send whose sender died while calling the carrier may or may not have reached
+// it, it is sent again only through a carrier that drops repeated sends by their key, and counted
+// as sent otherwise.
+func (router *Router) claimCarrierSend(msg *core.MsgQueueItem, route *Route) (*core.CarrierSend, bool, error) {
+	gateway := router.gateway
+	send := &core.CarrierSend{
+		IdempotencyKey: core.IdempotencyKey(msg),
+		Route:          route.Endpoint,
+		Status:         core.CarrierSendStatuses.Pending,
+		ServerID:       gateway.ServerID,
+	}
+	result := gateway.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(send)
+	if result.Error != nil || result.RowsAffected == 1 {
+		return send, false, result.Error
+	}
+
+	var earlier core.CarrierSend
+	if err := gateway.DB.Where("idempotency_key = ?", send.IdempotencyKey).First(&earlier).Error; err != nil {
+		return nil, false, err
+	}
+	switch earlier.Status {
+	case core.CarrierSendStatuses.Sent, core.CarrierSendStatuses.Unknown:
+		return &earlier, true, nil
+	case core.CarrierSendStatuses.Pending:
+		if time.Since(earlier.UpdatedAt) < CarrierSendLease {
+			return nil, false, errSendInProgress
+		}
+		if handler, ok := route.Handler.(idempotentCarrier); !ok || !handler.idempotent() {
+			if err := router.updateCarrierSend(&earlier, map[string]interface{}{"status": core.CarrierSendStatuses.Unknown}); err != nil {
+				return nil, false, err
+			}
+			return &earlier, true, nil
+		}
+	}
+
+	// the earlier send failed or the carrier drops it if it did go through
+	err := router.updateCarrierSend(&earlier, map[string]interface{}{
+		"status":    core.CarrierSendStatuses.Pending,
+		"route":     route.Endpoint,
+		"server_id": gateway.ServerID,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &earlier, false, nil
+}
+
+// updateCarrierSend changes a send that nobody changed since it was read, another worker that did
+// claimed the send.
+func (router *Router) updateCarrierSend(send *core.CarrierSend, updates map[string]interface{}) error {
+	gateway := router.gateway
+	result := gateway.DB.Model(&core.CarrierSend{}).
+		Where("id = ? AND status = ? AND updated_at = ?", send.ID, send.Status, send.UpdatedAt).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errSendInProgress
+	}
+	return gateway.DB.First(send, send.ID).Error
+}
+
+// completeCarrierSend records the outcome of a claimed send.
+func (router *Router) completeCarrierSend(send *core.CarrierSend, msg *core.MsgQueueItem, sendErr error) {
+	gateway := router.gateway
+	updates := map[string]interface{}{"status": core.CarrierSendStatuses.Sent, "carrier_message_id": msg.CarrierMessageID}
+	if sendErr != nil {
+		updates = map[string]interface{}{"status": core.CarrierSendStatuses.Failed}
+	}
+	if err := gateway.DB.Model(&core.CarrierSend{}).Where("id = ?", send.ID).Updates(updates).Error; err != nil {
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier.Idempotency",
+			"GenericError",
+			logrus.ErrorLevel,
+			gateway.MsgFields(msg, map[string]interface{}{
+				"route": send.Route,
+			}), err,
+		))
+	}
+}
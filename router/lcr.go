@@ -0,0 +1,387 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// LCRTable holds the least-cost routing entries currently in use.
+type LCRTable struct {
+	mu      sync.RWMutex
+	entries []core.LCRRoute
+}
+
+func NewLCRTable() *LCRTable {
+	return &LCRTable{}
+}
+
+func (table *LCRTable) SetEntries(entries []core.LCRRoute) {
+	table.mu.Lock()
+	table.entries = entries
+	table.mu.Unlock()
+}
+
+// Entries returns the loaded entries.
+func (table *LCRTable) Entries() []core.LCRRoute {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	return append([]core.LCRRoute(nil), table.entries...)
+}
+
+// Candidates returns the entries for the destination in the order they should be tried, for a
+// client of the tenant. Only the longest matching prefix is used per route, the tenant's own entry
+// taking precedence over a shared one for the same prefix. Entries of other tenants are left out,
+// and so are entries of another number type, short codes only match short code entries.
+func (table *LCRTable) Candidates(destination string, tenant uint) []core.LCRRoute {
+	destinationType := core.ClassifyNumber(destination)
+	destination = strings.TrimPrefix(destination, "+")
+
+	table.mu.RLock()
+	best := make(map[string]core.LCRRoute)
+	for _, entry := range table.entries {
+		if entry.Disabled || entry.TenantID != 0 && entry.TenantID != tenant ||
+			!core.MatchesNumberType(entry.NumberType, destinationType) ||
+			!strings.HasPrefix(destination, strings.TrimPrefix(entry.Prefix, "+")) {
+			continue
+		}
+		current, ok := best[entry.Route]
+		if !ok || len(entry.Prefix) > len(current.Prefix) ||
+			len(entry.Prefix) == len(current.Prefix) && entry.TenantID != 0 && current.TenantID == 0 {
+			best[entry.Route] = entry
+		}
+	}
+	table.mu.RUnlock()
+
+	candidates := make([]core.LCRRoute, 0, len(best))
+	for _, entry := range best {
+		candidates = append(candidates, entry)
+	}
+
+	// weighted shuffle first so the stable sort keeps the random order among equal cost routes
+	weightedShuffle(candidates)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority < candidates[j].Priority
+		}
+		return candidates[i].Cost < candidates[j].Cost
+	})
+	return candidates
+}
+
+// weightedShuffle orders entries randomly, entries with a higher weight are more likely to come first.
+func weightedShuffle(entries []core.LCRRoute) {
+	for i := range entries {
+		total := 0
+		for _, entry := range entries[i:] {
+			total += max(entry.Weight, 1)
+		}
+
+		pick := rand.Intn(total)
+		for j := i; j < len(entries); j++ {
+			pick -= max(entries[j].Weight, 1)
+			if pick < 0 {
+				entries[i], entries[j] = entries[j], entries[i]
+				break
+			}
+		}
+	}
+}
+
+// ValidateLCRTenant checks that the entry's tenant exists and may use its route, and its number type.
+func (router *Router) ValidateLCRTenant(entry *core.LCRRoute) error {
+	if !core.ValidNumberType(entry.NumberType) {
+		return core.Invalid("number_type must be long, short_code or toll_free")
+	}
+	if err := core.ValidateTenantID(entry.TenantID); err != nil {
+		return err
+	}
+	return router.checkTenantCarrier(entry.TenantID, entry.Route)
+}
+
+func (router *Router) LoadLCRRoutes() error {
+	gateway := router.gateway
+	var entries []core.LCRRoute
+	if err := gateway.DB.Find(&entries).Error; err != nil {
+		return err
+	}
+	router.LCR.SetEntries(entries)
+	return nil
+}
+
+// routePlan is the outcome of the route selection for an outbound message.
+type routePlan struct {
+	rule   *core.RoutingRule // matched rule, nil if none
+	source string            // where the routes came from: rule, canary, lcr or number
+	routes []*Route
+	mirror string // route that gets a copy once the message was sent, see RoutingRule.MirrorRoute
+}
+
+// planRoutes selects the carrier routes to try for an outbound message, in order. A matching
+// routing rule with a route takes precedence, then the least-cost routes for the destination and
+// then the carrier assigned to the sending number, and finally the carrier a lookup finds the
+// sending number was ported to. Carriers of another tenant than the client's
+// are never used. Unhealthy routes are moved to the end so they are only used when nothing else is
+// left. The rule's rewrites and priority are applied to msg.
+func (router *Router) planRoutes(msg *core.MsgQueueItem, client *core.Client) routePlan {
+	var plan routePlan
+	var names []string
+
+	plan.rule = router.Rules.Match(msg, client)
+	if plan.rule != nil {
+		plan.rule.Apply(msg)
+		if plan.rule.Route != "" {
+			plan.source = "rule"
+			// the route stays the failover of the canary
+			if plan.rule.Canary(msg) {
+				names = append(names, plan.rule.CanaryRoute)
+				plan.source = "canary"
+			}
+			names = append(names, plan.rule.Route)
+		}
+		plan.mirror = plan.rule.MirrorRoute
+	}
+
+	if len(names) == 0 {
+		for _, candidate := range router.LCR.Candidates(msg.To, core.ClientTenantID(client)) {
+			names = append(names, candidate.Route)
+		}
+		if len(names) > 0 {
+			plan.source = "lcr"
+		}
+	}
+
+	if len(names) == 0 {
+		if carrier, _ := router.gateway.GetClientCarrier(msg.From); carrier != "" {
+			names = append(names, carrier)
+			plan.source = "number"
+		}
+	}
+	if plan.source == "" || plan.source == "number" {
+		if carrier := router.gateway.PortedCarrier(msg.From); carrier != "" {
+			names = append(names, carrier)
+			if plan.source == "" {
+				plan.source = "lookup"
+			}
+		}
+	}
+
+	var healthy, unhealthy []*Route
+	for _, name := range names {
+		route := router.FindCarrierRoute(name)
+		if route == nil || !router.gateway.CarrierAllowed(route.Endpoint, client) {
+			continue
+		}
+		if route.Healthy() {
+			healthy = append(healthy, route)
+		} else {
+			unhealthy = append(unhealthy, route)
+		}
+	}
+	plan.routes = append(healthy, unhealthy...)
+	return plan
+}
+
+// outboundRoutes returns the carrier routes to try for an outbound message and notes the
+// selection on the message's routing decision.
+func (router *Router) outboundRoutes(msg *core.MsgQueueItem, client *core.Client) []*Route {
+	plan := router.planRoutes(msg, client)
+
+	if decision := msg.Decision; decision != nil {
+		if plan.rule != nil {
+			decision.RuleID = plan.rule.ID
+			decision.RuleName = plan.rule.Name
+		}
+		decision.Source = plan.source
+		names := make([]string, len(plan.routes))
+		for i, route := range plan.routes {
+			names[i] = route.Endpoint
+		}
+		decision.Candidates = strings.Join(names, ",")
+	}
+	msg.MirrorRoute = plan.mirror
+	return plan.routes
+}
+
+// hasOutboundRoute reports whether the message can be handed to the carrier queue, without
+// applying any rule actions.
+func (router *Router) hasOutboundRoute(msg *core.MsgQueueItem, client *core.Client) bool {
+	if rule := router.Rules.Match(msg, client); rule != nil && rule.Route != "" && router.routeAllowed(rule.Route, client) {
+		return true
+	}
+	for _, candidate := range router.LCR.Candidates(msg.To, core.ClientTenantID(client)) {
+		if router.routeAllowed(candidate.Route, client) {
+			return true
+		}
+	}
+	if carrier, _ := router.gateway.GetClientCarrier(msg.From); carrier != "" && router.routeAllowed(carrier, client) {
+		return true
+	}
+	carrier := router.gateway.PortedCarrier(msg.From)
+	return carrier != "" && router.routeAllowed(carrier, client)
+}
+
+// sendCarrier sends the message on the first route that accepts it, failing over to the next
+// route on error until ctx is done. It returns the name of the route used.
+func (router *Router) sendCarrier(ctx context.Context, msg *core.MsgQueueItem, routes []*Route) (string, error) {
+	var lm = router.gateway.LogManager
+
+	// the source may be rewritten per route, a failed attempt leaves the message as it came
+	source := msg.From
+	client, _ := router.gateway.FindClientByNumber(source)
+	sent := false
+	defer func() {
+		if !sent {
+			msg.From = source
+			msg.RevertTransliteration()
+		}
+	}()
+
+	if verdict, ok := router.gateway.CachedInvalidDestination(msg.To); ok {
+		err := core.InvalidDestinationError(verdict)
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier.InvalidDestination",
+			"DestinationCached",
+			logrus.WarnLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"route": verdict.Route,
+			}), err,
+		))
+		return "", err
+	}
+
+	var lastErr, invalidErr error
+	var invalidRoute string
+	for _, route := range routes {
+		if msg.Expired(time.Now()) {
+			return "", core.ErrMessageExpired
+		}
+		if _, ok := router.Maintenance.active(core.MaintenanceKinds.Route, route.Endpoint); ok {
+			msg.Decision.RouteFailed(route.Endpoint, errRouteMaintenance)
+			lastErr = fmt.Errorf("%s: %w", route.Endpoint, errRouteMaintenance)
+			lm.SendLog(lm.BuildLog(
+				"Router.Carrier.Failover",
+				"RouteInMaintenance",
+				logrus.InfoLevel,
+				router.gateway.MsgFields(msg, map[string]interface{}{
+					"route": route.Endpoint,
+				}), route.Endpoint,
+			))
+			continue
+		}
+		router.rewriteSource(msg, source, client, route.Endpoint)
+		router.transliterateMessage(msg, client, route.Endpoint)
+		if err := ctx.Err(); err != nil {
+			return "", fmt.Errorf("carrier send abandoned: %w", err)
+		}
+
+		started := time.Now()
+		span := core.StartSpan("carrier send", core.SpanKindClient, msg.TraceParent)
+		span.SetAttributes(map[string]interface{}{
+			"carrier.route":  route.Endpoint,
+			"carrier.type":   router.gateway.CarrierType(route.Endpoint),
+			"message.log_id": msg.LogID,
+			"message.type":   string(msg.Type),
+		})
+		msg.CarrierMessageID = ""
+
+		var claim *core.CarrierSend
+		if carrierIdempotency {
+			var done bool
+			var err error
+			claim, done, err = router.claimCarrierSend(msg, route)
+			if done {
+				span.End(nil)
+				lm.SendLog(lm.BuildLog(
+					"Router.Carrier.Idempotency",
+					"CarrierSendSkipped",
+					logrus.WarnLevel,
+					router.gateway.MsgFields(msg, map[string]interface{}{
+						"route":  claim.Route,
+						"status": claim.Status,
+					}),
+				))
+				msg.CarrierMessageID = claim.CarrierMessageID
+				sent = true
+				return claim.Route, nil
+			}
+			if errors.Is(err, errSendInProgress) {
+				span.End(err)
+				return "", err
+			}
+			if err != nil {
+				// without the record the message is sent as before, at least once
+				lm.SendLog(lm.BuildLog(
+					"Router.Carrier.Idempotency",
+					"GenericError",
+					logrus.ErrorLevel,
+					router.gateway.MsgFields(msg, map[string]interface{}{
+						"route": route.Endpoint,
+					}), err,
+				))
+				claim = nil
+			}
+		}
+
+		release, err := router.gateway.Limits.Acquire(route.Endpoint, msg.From)
+		if err == nil {
+			if router.upgradeToMMS(msg, route.Endpoint) || msg.Type == core.MsgQueueItemType.MMS {
+				err = route.Handler.SendMMS(ctx, msg)
+			} else {
+				err = route.Handler.SendSMS(ctx, msg)
+			}
+			release()
+		}
+		span.End(err)
+		if claim != nil {
+			router.completeCarrierSend(claim, msg, err)
+		}
+		router.gateway.ObserveCarrierSend(route.Endpoint, msg, started, err)
+		router.gateway.RecordCDR(msg, route.Endpoint, true, started, err)
+		if err == nil {
+			route.reportSuccess()
+			router.Loops.sent(msg)
+			router.recordSourceMask(msg, source, client, route.Endpoint)
+			router.mirrorSend(*msg, source, client)
+			sent = true
+			return route.Endpoint, nil
+		}
+
+		msg.RevertUpgrade()
+		msg.RevertTransliteration()
+		if !errors.Is(err, core.ErrPermanentFailure) && !errors.Is(err, core.ErrCarrierThrottled) {
+			// a rejected or throttled message says nothing about the health of the route
+			route.reportFailure(err)
+		}
+		msg.Decision.RouteFailed(route.Endpoint, err)
+		lastErr = fmt.Errorf("%s: %w", route.Endpoint, err)
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier.Failover",
+			"RouterFailover",
+			logrus.WarnLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"route": route.Endpoint,
+			}), err,
+		))
+
+		// an opt-out holds on every route, the recipient asked not to be messaged
+		if core.ErrorClassOf(err) == core.ErrorClasses.OptOut {
+			break
+		}
+		if core.ErrorClassOf(err) == core.ErrorClasses.InvalidDestination {
+			invalidRoute, invalidErr = route.Endpoint, err
+		}
+	}
+	// the verdict is cached once no other route could reach the destination either
+	if invalidErr != nil {
+		router.gateway.CacheInvalidDestination(msg, invalidRoute, invalidErr)
+	}
+	return "", lastErr
+}
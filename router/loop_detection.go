@@ -0,0 +1,108 @@
+package router
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+var (
+	routerMaxHops    int
+	routerLoopWindow time.Duration
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		routerMaxHops = cfg.Int("ROUTER_MAX_HOPS", 10)
+		routerLoopWindow = cfg.Duration("ROUTER_LOOP_WINDOW", 5*time.Minute)
+	})
+}
+
+// loopTracker remembers messages recently handed to a carrier, a message that keeps coming back
+// inbound from a carrier unchanged is bouncing between a carrier and the gateway.
+type loopTracker struct {
+	mu   sync.Mutex
+	seen map[string]*loopEntry
+	// nextPrune is when the expired entries are dropped next, so a send doesn't walk the map.
+	nextPrune time.Time
+}
+
+type loopEntry struct {
+	bounces int
+	expires time.Time
+}
+
+func newLoopTracker() *loopTracker {
+	return &loopTracker{seen: make(map[string]*loopEntry)}
+}
+
+// sent records a message that was handed to a carrier.
+func (tracker *loopTracker) sent(msg *core.MsgQueueItem) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	now := time.Now()
+	if now.After(tracker.nextPrune) {
+		tracker.prune(now)
+	}
+
+	key := msg.Fingerprint()
+	if entry, ok := tracker.seen[key]; ok && !now.After(entry.expires) {
+		entry.expires = now.Add(routerLoopWindow)
+		return
+	}
+	tracker.seen[key] = &loopEntry{expires: now.Add(routerLoopWindow)}
+}
+
+// prune drops the expired entries. It runs at most once per tenth of the loop window, expired
+// entries left until then are treated as missing.
+func (tracker *loopTracker) prune(now time.Time) {
+	for key, entry := range tracker.seen {
+		if now.After(entry.expires) {
+			delete(tracker.seen, key)
+		}
+	}
+	tracker.nextPrune = now.Add(routerLoopWindow / 10)
+}
+
+// bounced counts a message re-entering the router that matches one recently sent to a carrier
+// and returns how many times it has come back.
+func (tracker *loopTracker) bounced(msg *core.MsgQueueItem) int {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	entry, ok := tracker.seen[msg.Fingerprint()]
+	if !ok || time.Now().After(entry.expires) {
+		return 0
+	}
+	entry.bounces++
+	return entry.bounces
+}
+
+// detectLoop records the router queue on the message trace and returns a reason when the
+// message is looping, or an empty string. Retries re-entering the same queue are not hops.
+func (router *Router) detectLoop(msg *core.MsgQueueItem, queue string) string {
+	stage := fmt.Sprintf("%s@%s", queue, router.gateway.ServerID)
+	if len(msg.Trace) == 0 || msg.Trace[len(msg.Trace)-1] != stage {
+		msg.Trace = append(msg.Trace, stage)
+		msg.Hops++
+	}
+
+	if msg.Hops > routerMaxHops {
+		return fmt.Sprintf("loop detected: exceeded %d hops (%v)", routerMaxHops, msg.Trace)
+	}
+
+	// a message starting its trace in the carrier router came in from a carrier webhook
+	if queue == "carrier" && len(msg.Trace) == 1 && msg.Attempts == 0 {
+		if bounces := router.Loops.bounced(msg); bounces >= routerMaxHops {
+			return fmt.Sprintf("loop detected: returned from carrier %d times within %s", bounces, routerLoopWindow)
+		}
+	}
+	return ""
+}
+
+// isSelfAddressed reports whether a message would be routed back to its own source.
+func isSelfAddressed(msg *core.MsgQueueItem) bool {
+	return msg.From != "" && core.NumberKey(msg.From) == core.NumberKey(msg.To)
+}
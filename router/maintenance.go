@@ -0,0 +1,302 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+	"sort"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// maintenanceInterval is how long a message for a client in maintenance waits before it is routed
+// again, and how often ended maintenance windows are swept.
+var maintenanceInterval time.Duration
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		maintenanceInterval = cfg.Duration("MAINTENANCE_INTERVAL", 30*time.Second)
+	})
+}
+
+// errRouteMaintenance is recorded for the routes sendCarrier skips because they are in maintenance.
+var errRouteMaintenance = errors.New("route in maintenance")
+
+// maintenanceSet is the maintenance windows on, by kind and name.
+type maintenanceSet struct {
+	mu      sync.RWMutex
+	windows map[string]core.Maintenance
+}
+
+func newMaintenanceSet() *maintenanceSet {
+	return &maintenanceSet{windows: make(map[string]core.Maintenance)}
+}
+
+func maintenanceKey(kind string, name string) string {
+	return kind + ":" + name
+}
+
+// active returns the maintenance of a client or a route, false when it has none or it expired.
+func (set *maintenanceSet) active(kind string, name string) (core.Maintenance, bool) {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	m, ok := set.windows[maintenanceKey(kind, name)]
+	if !ok || !m.Active(time.Now()) {
+		return core.Maintenance{}, false
+	}
+	return m, true
+}
+
+func (set *maintenanceSet) list() []core.Maintenance {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	list := make([]core.Maintenance, 0, len(set.windows))
+	for _, m := range set.windows {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (set *maintenanceSet) replace(list []core.Maintenance) {
+	windows := make(map[string]core.Maintenance, len(list))
+	for _, m := range list {
+		windows[maintenanceKey(m.Kind, m.Name)] = m
+	}
+	set.mu.Lock()
+	set.windows = windows
+	set.mu.Unlock()
+}
+
+// loadMaintenance reads the maintenance windows, in a cluster they are set on any instance so they
+// are reloaded on every sweep.
+func (router *Router) loadMaintenance() error {
+	gateway := router.gateway
+	var list []core.Maintenance
+	if err := gateway.DB.Find(&list).Error; err != nil {
+		return err
+	}
+	router.Maintenance.replace(list)
+	return nil
+}
+
+// startMaintenance puts a client or a route into maintenance, or updates its maintenance.
+func (router *Router) startMaintenance(m *core.Maintenance) error {
+	gateway := router.gateway
+	switch m.Kind {
+	case core.MaintenanceKinds.Client:
+		gateway.Mu.RLock()
+		_, ok := gateway.Clients[m.Name]
+		gateway.Mu.RUnlock()
+		if !ok {
+			return fmt.Errorf("%w: client %q", core.ErrNotFound, m.Name)
+		}
+	case core.MaintenanceKinds.Route:
+		if router.findRouteByName("carrier", m.Name) == nil {
+			return fmt.Errorf("%w: route %q", core.ErrNotFound, m.Name)
+		}
+	default:
+		return core.Invalid("kind must be %q or %q", core.MaintenanceKinds.Client, core.MaintenanceKinds.Route)
+	}
+	if m.Until != nil && !m.Until.After(time.Now()) {
+		return core.Invalid("until must be in the future")
+	}
+
+	m.ID = 0
+	err := gateway.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "kind"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason", "until"}),
+	}).Create(m).Error
+	if err != nil {
+		return err
+	}
+	set := router.Maintenance
+	set.mu.Lock()
+	set.windows[maintenanceKey(m.Kind, m.Name)] = *m
+	set.mu.Unlock()
+	router.logMaintenance(*m, "started")
+	return nil
+}
+
+// endMaintenance takes a client or a route out of maintenance, and reports whether it was in
+// maintenance. The messages queued for a client are routed again within MAINTENANCE_INTERVAL.
+func (router *Router) endMaintenance(kind string, name string) (bool, error) {
+	gateway := router.gateway
+	result := gateway.DB.Where("kind = ? AND name = ?", kind, name).Delete(&core.Maintenance{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	set := router.Maintenance
+	set.mu.Lock()
+	m, ok := set.windows[maintenanceKey(kind, name)]
+	delete(set.windows, maintenanceKey(kind, name))
+	set.mu.Unlock()
+	if ok {
+		router.logMaintenance(m, "ended")
+	}
+	return ok || result.RowsAffected > 0, nil
+}
+
+func (router *Router) logMaintenance(m core.Maintenance, change string) {
+	gateway := router.gateway
+	var lm = gateway.LogManager
+	fields := map[string]interface{}{
+		"kind":   m.Kind,
+		"name":   m.Name,
+		"reason": m.Reason,
+	}
+	if m.Until != nil {
+		fields["until"] = m.Until.UTC().Format(time.RFC3339)
+	}
+	lm.SendLog(lm.BuildLog(
+		"Router.Maintenance",
+		"MaintenanceChanged",
+		logrus.InfoLevel,
+		fields, change,
+	))
+}
+
+// MaintenanceSweeper ends the maintenance windows that expired, and reloads the windows other
+// instances of a cluster set.
+func (router *Router) MaintenanceSweeper() {
+	gateway := router.gateway
+	var lm = gateway.LogManager
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		for _, m := range router.Maintenance.list() {
+			if m.Active(now) {
+				continue
+			}
+			if _, err := router.endMaintenance(m.Kind, m.Name); err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Router.Maintenance",
+					"GenericError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"kind": m.Kind,
+						"name": m.Name,
+					}, err,
+				))
+			}
+		}
+		if !core.ClusterEnabled {
+			continue
+		}
+		if err := router.loadMaintenance(); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Router.Maintenance",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+	}
+}
+
+// maintenanceDecision queues a message for a client in maintenance again, it is routed once the
+// maintenance ended. The attempts aren't counted, only the expiry of the message ends the wait.
+func (router *Router) maintenanceDecision(msg *core.MsgQueueItem, client *core.Client, queue string) (Decision, bool) {
+	m, ok := router.Maintenance.active(core.MaintenanceKinds.Client, client.Username)
+	if !ok {
+		return Decision{}, false
+	}
+	delay := maintenanceInterval
+	if m.Until != nil && time.Until(*m.Until) < delay {
+		delay = time.Until(*m.Until)
+	}
+	reason := "client in maintenance"
+	if m.Reason != "" {
+		reason += ": " + m.Reason
+	}
+
+	var lm = router.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Router.Maintenance",
+		"MaintenanceRequeued",
+		logrus.InfoLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client": client.Username,
+		}), reason,
+	))
+	return Decision{
+		Kind:    DecisionReroute,
+		Queue:   queue,
+		Outcome: core.RoutingOutcomes.Held,
+		Route:   "maintenance:" + client.Username,
+		Reason:  reason,
+		Class:   core.RetryClasses.ClientOffline,
+		Delay:   delay,
+	}, true
+}
+
+// SetupMaintenanceRoutes sets up putting clients and routes into maintenance and taking them out.
+func SetupMaintenanceRoutes(app *iris.Application, router *Router) {
+	gateway := router.gateway
+	maintenance := app.Party("/maintenance", gateway.BasicAuthMiddleware)
+	{
+		// List the clients and routes in maintenance
+		maintenance.Get("/", func(ctx iris.Context) {
+			now := time.Now()
+			list := make([]core.Maintenance, 0)
+			for _, m := range router.Maintenance.list() {
+				if m.Active(now) {
+					list = append(list, m)
+				}
+			}
+			ctx.JSON(list)
+		})
+
+		// Put a client or a route into maintenance, until it is ended or for a duration
+		maintenance.Put("/{kind:string}/{name:string}", func(ctx iris.Context) {
+			var request struct {
+				Reason   string     `json:"reason"`
+				Until    *time.Time `json:"until"`
+				Duration string     `json:"duration"` // e.g. "2h", instead of until
+			}
+			if err := ctx.ReadJSON(&request); err != nil && !iris.IsErrEmptyJSON(err) {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid maintenance data"))
+				return
+			}
+			m := core.Maintenance{
+				Kind:   ctx.Params().Get("kind"),
+				Name:   ctx.Params().Get("name"),
+				Reason: request.Reason,
+				Until:  request.Until,
+			}
+			if request.Duration != "" {
+				duration, err := time.ParseDuration(request.Duration)
+				if err != nil || duration <= 0 {
+					core.WriteProvisioningError(ctx, core.Invalid("invalid duration %q", request.Duration))
+					return
+				}
+				until := time.Now().Add(duration)
+				m.Until = &until
+			}
+			if err := router.startMaintenance(&m); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(m)
+		})
+
+		// End the maintenance of a client or a route
+		maintenance.Delete("/{kind:string}/{name:string}", func(ctx iris.Context) {
+			ended, err := router.endMaintenance(ctx.Params().Get("kind"), ctx.Params().Get("name"))
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if !ended {
+				core.WriteProvisioningError(ctx, core.ErrNotFound)
+				return
+			}
+			ctx.StatusCode(iris.StatusNoContent)
+		})
+	}
+}
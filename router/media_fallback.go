@@ -0,0 +1,18 @@
+package router
+
+import (
+	"github.com/sirupsen/logrus"
+	"zultys-smpp-mm4/core"
+)
+
+func (router *Router) logMediaFallback(msg *core.MsgQueueItem, client *core.Client) {
+	var lm = router.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Router.MediaFallback",
+		"MediaFallback",
+		logrus.InfoLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client": client.Username,
+		}), client.Profile.LinkLifetime(),
+	))
+}
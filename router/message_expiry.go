@@ -0,0 +1,152 @@
+package router
+
+import (
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// expireMessage reports the message as expired to the client that sent it and moves it to the
+// dead letter queue instead of delivering it.
+func (router *Router) expireMessage(msg core.MsgQueueItem, queue string) {
+	var lm = router.gateway.LogManager
+
+	lm.SendLog(lm.BuildLog(
+		"Router.Expiry",
+		"RouterMessageExpired",
+		logrus.WarnLevel,
+		router.gateway.MsgFields(&msg, map[string]interface{}{
+			"queue": queue,
+		}), msg.ExpiresAt,
+	))
+
+	go router.reportExpired(msg)
+	router.deadLetter(msg, queue, "expired")
+}
+
+// reportExpired sends an EXPIRED delivery receipt (SMPP) or delivery report (MM4) to the client
+// that submitted the message. Messages from carriers aren't reported.
+func (router *Router) reportExpired(msg core.MsgQueueItem) {
+	var lm = router.gateway.LogManager
+
+	client, _ := router.gateway.FindClientByNumber(msg.From)
+	if client == nil {
+		return
+	}
+
+	var err error
+	switch msg.Type {
+	case core.MsgQueueItemType.SMS:
+		if router.SMPP != nil && !msg.SkipReceipt {
+			err = router.SMPP.SendDeliveryReceipt(msg, core.MessageStateExpired, core.ErrorClasses.Unknown.ReceiptError())
+		}
+	case core.MsgQueueItemType.MMS:
+		if router.MM4 != nil {
+			err = router.MM4.SendMM4DeliveryReport(msg, client, "Expired")
+		}
+	}
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.Expiry",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, map[string]interface{}{
+				"client": client.Username,
+			}), err,
+		))
+	}
+}
+
+// ExpirySweeper expires messages waiting in Postgres: the held messages of offline clients,
+// the scheduled messages not released yet and the publishes in the AMQP outbox, so they are
+// reported instead of delivered hours late once the client binds or the broker is back.
+func (router *Router) ExpirySweeper() {
+	var lm = router.gateway.LogManager
+
+	ticker := time.NewTicker(core.ExpirySweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		for _, sweep := range []func(time.Time) error{router.sweepHeld, router.sweepScheduled, router.sweepOutbox} {
+			if err := sweep(now); err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Router.Expiry",
+					"GenericError",
+					logrus.ErrorLevel,
+					nil, err,
+				))
+			}
+		}
+	}
+}
+
+// sweepHeld expires the held messages past their time-to-live.
+func (router *Router) sweepHeld(now time.Time) error {
+	var held []core.HeldMessage
+	return router.gateway.DB.FindInBatches(&held, 500, func(tx *gorm.DB, batch int) error {
+		for _, message := range held {
+			msg, err := router.gateway.DecodePayload(message.Payload)
+			if err != nil || !msg.Expired(now) {
+				continue
+			}
+			result := router.gateway.DB.Delete(&core.HeldMessage{}, message.ID)
+			if result.Error != nil || result.RowsAffected == 0 {
+				// already flushed or expired by another instance
+				continue
+			}
+			router.beginDecision(&msg, "carrier")
+			router.expireMessage(msg, "carrier")
+		}
+		return nil
+	}).Error
+}
+
+// sweepScheduled expires the pending scheduled messages past their time-to-live, e.g. with a
+// validity period ending before the delivery time.
+func (router *Router) sweepScheduled(now time.Time) error {
+	var pending []core.ScheduledMessage
+	return router.gateway.DB.Where("status = ?", core.ScheduledStatuses.Pending).FindInBatches(&pending, 500, func(tx *gorm.DB, batch int) error {
+		for _, scheduled := range pending {
+			msg, err := router.gateway.DecodePayload(scheduled.Payload)
+			if err != nil {
+				continue
+			}
+			// the time-to-live counts from the scheduled delivery time, as when it is released
+			if msg.ExpiresAt.IsZero() {
+				msg.ExpiresAt = scheduled.DeliverAt.Add(core.DefaultMessageTTL)
+			}
+			if !msg.Expired(now) || !router.gateway.SetScheduledStatus(scheduled.ID, core.ScheduledStatuses.Pending, core.ScheduledStatuses.Expired) {
+				continue
+			}
+			router.beginDecision(&msg, "client")
+			router.expireMessage(msg, "client")
+		}
+		return nil
+	}).Error
+}
+
+// sweepOutbox expires the messages in the AMQP outbox past their time-to-live, dead letters in it
+// are left to be replayed.
+func (router *Router) sweepOutbox(now time.Time) error {
+	var outbox []core.OutboxMessage
+	return router.gateway.DB.Where("queue <> ?", core.DeadLetterQueue).FindInBatches(&outbox, 500, func(tx *gorm.DB, batch int) error {
+		for _, message := range outbox {
+			msg, err := core.DecodeMsgQueueItem(message.Body)
+			if err != nil || !msg.Expired(now) {
+				continue
+			}
+			result := router.gateway.DB.Delete(&core.OutboxMessage{}, message.ID)
+			if result.Error != nil || result.RowsAffected == 0 {
+				// already replayed or expired by another instance
+				continue
+			}
+			queue := strings.TrimSuffix(message.Queue, core.RetryQueueName(""))
+			router.beginDecision(&msg, queue)
+			router.expireMessage(msg, queue)
+		}
+		return nil
+	}).Error
+}
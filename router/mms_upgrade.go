@@ -0,0 +1,38 @@
+package router
+
+import (
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"zultys-smpp-mm4/core"
+)
+
+// upgradeToMMS sends an SMS of more segments than the carrier's mms_upgrade_segments, or
+// MMS_UPGRADE_SEGMENTS when the carrier doesn't set it, as an MMS on that carrier instead of a long
+// concatenated SMS. SMPP carriers have no MMS and 0 keeps the SMS. The client that submitted the
+// message still gets its receipt as SMS.
+func (router *Router) upgradeToMMS(msg *core.MsgQueueItem, route string) bool {
+	if msg.Type != core.MsgQueueItemType.SMS || router.gateway.CarrierType(route) == "smpp" {
+		return false
+	}
+	threshold, _ := strconv.Atoi(router.gateway.CarrierSetting(route, "mms_upgrade_segments", "MMS_UPGRADE_SEGMENTS"))
+	if threshold <= 0 {
+		return false
+	}
+	segments, _ := core.SMPPSegments(msg.Message)
+	if len(segments) <= threshold {
+		return false
+	}
+
+	msg.Type = core.MsgQueueItemType.MMS
+	msg.SubmittedAs = core.MsgQueueItemType.SMS
+	var lm = router.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Router.Carrier.MMSUpgrade",
+		"MMSUpgrade",
+		logrus.InfoLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"route": route,
+		}), len(segments),
+	))
+	return true
+}
@@ -0,0 +1,88 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// enforceMonthlyQuota counts a message for a carrier against the monthly quotas of the client and
+// its tenant, and rejects it when it would exceed a hard limit. Crossing a soft limit and first
+// reaching a hard one are notified. Quotas the database can't count are not enforced.
+func (router *Router) enforceMonthlyQuota(msg *core.MsgQueueItem, client *core.Client) (Decision, bool) {
+	now := time.Now()
+	uses := core.QuotaUses(client, now)
+	if len(uses) == 0 || msg.SkipOptOut {
+		return Decision{}, false
+	}
+	units := 1
+	if msg.Type == core.MsgQueueItemType.SMS {
+		units = core.EstimateSegments(msg.Message).Segments
+	}
+
+	var refused *core.QuotaUse
+	err := router.gateway.DB.Transaction(func(tx *gorm.DB) error {
+		for i := range uses {
+			ok, err := core.CountQuota(tx, &uses[i], msg.Type, units, now)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				refused = &uses[i]
+				return core.ErrQuotaExceeded
+			}
+		}
+		return nil
+	})
+
+	var lm = router.gateway.LogManager
+	if err != nil && !errors.Is(err, core.ErrQuotaExceeded) {
+		lm.SendLog(lm.BuildLog(
+			"Router.Client.Quota",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"client": client.Username,
+			}), err,
+		))
+		return Decision{}, false
+	}
+
+	if refused == nil {
+		for _, use := range uses {
+			if soft, _, _ := use.Quota.Limits(msg.Type); soft > 0 && use.Used >= soft && use.Used-units < soft {
+				router.gateway.NotifyQuota(core.EventTypes.QuotaSoftLimit, use, client, msg.Type, soft)
+			}
+		}
+		return Decision{}, false
+	}
+
+	_, hard, column := refused.Quota.Limits(msg.Type)
+	reason := fmt.Sprintf("%s monthly %s quota of %d exceeded", refused.Scope, msg.Type, hard)
+	lm.SendLog(lm.BuildLog(
+		"Router.Client.Quota",
+		"QuotaExceeded",
+		logrus.WarnLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client": client.Username,
+			"scope":  refused.Scope,
+		}), reason,
+	))
+
+	// only the first refused message of the cycle is notified
+	blocked := "sms_blocked"
+	if column == "mms" {
+		blocked = "mms_blocked"
+	}
+	result := router.gateway.DB.Model(&core.QuotaCounter{}).
+		Where("scope = ? AND owner_id = ? AND cycle_start = ? AND "+blocked+" = ?", refused.Scope, refused.Owner, refused.Start, false).
+		Update(blocked, true)
+	if result.Error == nil && result.RowsAffected > 0 {
+		refused.Used = hard
+		router.gateway.NotifyQuota(core.EventTypes.QuotaExceeded, *refused, client, msg.Type, hard)
+	}
+	return rejectDecision(core.ErrorClasses.QuotaExceeded, reason), true
+}
@@ -0,0 +1,20 @@
+package router
+
+import (
+	"github.com/sirupsen/logrus"
+	"zultys-smpp-mm4/core"
+)
+
+// rejectInactiveNumber refuses a message from or to a number that isn't active.
+func (router *Router) rejectInactiveNumber(msg *core.MsgQueueItem, queue string, reason string) Decision {
+	var lm = router.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Router.NumberState",
+		"NumberInactive",
+		logrus.WarnLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"queue": queue,
+		}), reason,
+	))
+	return rejectDecision(core.ErrorClasses.PolicyBlock, reason)
+}
@@ -0,0 +1,105 @@
+package router
+
+import (
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// handleKeyword processes a STOP, START or HELP message a carrier delivers to a client number and
+// answers it for the client. The message itself is still delivered to the client. START and the
+// other opt-in keywords are only answered when the sender had opted out, they are common words.
+func (router *Router) handleKeyword(msg *core.MsgQueueItem, client *core.Client) {
+	// retries were handled when the message was first routed
+	if !core.OptOutKeywordsEnabled || msg.InboundCarrier == "" || msg.Attempts > 0 {
+		return
+	}
+	keyword := core.MessageKeyword(msg.Message)
+
+	var reply string
+	var err error
+	switch {
+	case core.StopKeywords[keyword]:
+		err = router.gateway.RecordOptOut(&core.OptOut{
+			ClientID: client.ID,
+			Number:   msg.To,
+			Sender:   msg.From,
+			Keyword:  keyword,
+		})
+		reply = core.KeywordReply(client.StopReply, core.DefaultStopReply, client, msg.To)
+	case core.StartKeywords[keyword]:
+		var removed bool
+		if removed, err = router.gateway.RemoveOptOut(msg.To, msg.From); !removed {
+			break
+		}
+		reply = core.KeywordReply(client.StartReply, core.DefaultStartReply, client, msg.To)
+	case core.HelpKeywords[keyword]:
+		reply = core.KeywordReply(client.HelpReply, core.DefaultHelpReply, client, msg.To)
+	default:
+		return
+	}
+
+	var lm = router.gateway.LogManager
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier.OptOut",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"client":  client.Username,
+				"keyword": keyword,
+			}), err,
+		))
+		// without the record the confirmation would be a lie
+		return
+	}
+	lm.SendLog(lm.BuildLog(
+		"Router.Carrier.OptOut",
+		"OptOutKeyword",
+		logrus.InfoLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client": client.Username,
+		}), keyword,
+	))
+	if reply == "" {
+		return
+	}
+
+	answer := core.MsgQueueItem{
+		To:                msg.From,
+		From:              msg.To,
+		ReceivedTimestamp: time.Now(),
+		Type:              core.MsgQueueItemType.SMS,
+		Message:           reply,
+		LogID:             primitive.NewObjectID().Hex(),
+		SkipOptOut:        true,
+	}
+	answer.TraceID = answer.LogID
+	if err := router.OfferClientMessage(answer); err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier.OptOut",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&answer, map[string]interface{}{
+				"client": client.Username,
+			}), err,
+		))
+	}
+}
+
+// rejectOptedOut dead-letters a message to a recipient that opted out of the sending number, the
+// client gets a REJECTD receipt with err:021, or a Rejected MM4 report.
+func (router *Router) rejectOptedOut(msg *core.MsgQueueItem, client *core.Client) Decision {
+	var lm = router.gateway.LogManager
+	reason := "recipient opted out"
+	lm.SendLog(lm.BuildLog(
+		"Router.Client",
+		"OptOutRejected",
+		logrus.WarnLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client": client.Username,
+		}), reason,
+	))
+	return rejectDecision(core.ErrorClasses.OptOut, reason)
+}
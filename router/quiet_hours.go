@@ -0,0 +1,49 @@
+package router
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// enforceQuietHours queues or rejects a message for a carrier that would reach its recipient in
+// the quiet hours of the client, ok is false when the message may be sent now. Messages the
+// gateway sends itself, e.g. STOP confirmations and auto-replies, are sent anyway.
+func (router *Router) enforceQuietHours(msg *core.MsgQueueItem, client *core.Client) (Decision, bool) {
+	quiet, ok := core.QuietHoursOf(client)
+	if !ok || msg.SkipOptOut {
+		return Decision{}, false
+	}
+	now := time.Now()
+	until, quietNow := quiet.QuietUntil(msg.To, now)
+	if !quietNow {
+		return Decision{}, false
+	}
+
+	var lm = router.gateway.LogManager
+	reason := fmt.Sprintf("quiet hours of the recipient until %s", until.Format("15:04 MST"))
+	lm.SendLog(lm.BuildLog(
+		"Router.Client.QuietHours",
+		"QuietHours",
+		logrus.InfoLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"client": client.Username,
+			"action": quiet.Action,
+		}), reason,
+	))
+	if quiet.Action == core.QuietActions.Reject {
+		return rejectDecision(core.ErrorClasses.PolicyBlock, reason), true
+	}
+
+	// the time-to-live counts from the end of the quiet hours
+	if !msg.ExpiresAt.IsZero() {
+		msg.ExpiresAt = msg.ExpiresAt.Add(until.Sub(now))
+	}
+	if _, err := router.gateway.ScheduleMessage(*msg, client, until); err != nil {
+		return RetryDecision(core.RetryClasses.ClientSend, err.Error()), true
+	}
+	decision := AckDecision(core.RoutingOutcomes.Held, "quiet_hours")
+	decision.Reason = reason
+	return decision, true
+}
@@ -0,0 +1,70 @@
+package router
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// retry acks the current delivery (if any) and schedules the message back onto the queue after
+// the backoff delay of its retry class, or dead-letters it once the attempts are exhausted.
+func (router *Router) retry(msg core.MsgQueueItem, queue string, class core.RetryClass, reason string) {
+	policy := router.RetryPolicy.ForClass(class)
+
+	// no point in retrying a message that would only be delivered after its expiry
+	if msg.Expired(time.Now()) {
+		router.expireMessage(msg, queue)
+		return
+	}
+
+	msg.Attempts++
+	if !policy.ShouldRetry(msg.Attempts) {
+		// rejections are final, the client gets a failure status instead of waiting on the message
+		if errorClass := core.ErrorClass(class); errorClass.Permanent() || class == core.RetryClasses.CarrierRejected {
+			go router.reportFailure(msg, errorClass)
+		}
+		router.deadLetter(msg, queue, reason)
+		return
+	}
+	router.recordDecision(&msg, core.RoutingOutcomes.Retry, core.RetryQueueName(queue), reason)
+
+	msg.QueuedTimestamp = time.Now()
+	span := core.StartMsgSpan(queue+" publish", core.SpanKindProducer, &msg)
+	span.SetAttributes(map[string]interface{}{
+		"messaging.destination.name": queue,
+		"retry.attempt":              msg.Attempts,
+		"retry.class":                string(class),
+	})
+	marshal, err := core.EncodeMsgQueueItem(msg)
+	if err != nil {
+		span.End(err)
+		router.deadLetter(msg, queue, err.Error())
+		return
+	}
+
+	err = router.gateway.Queue.PublishDelayed(context.Background(), queue, marshal, core.MessageHeaders(msg, map[string]interface{}{
+		core.AttemptsHeader: int32(msg.Attempts),
+		"x-retry-class":     string(class),
+	}), policy.Delay(msg.Attempts))
+	span.End(err)
+	if err != nil {
+		// the delivery goes back to the queue, the retry is not lost with the publish
+		var lm = router.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.Retry",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, nil), err,
+		))
+		if msg.Delivery != nil {
+			_ = msg.Delivery.Nack(true)
+		}
+		return
+	}
+	core.MessageRetries.WithLabelValues(queue, string(class), router.gateway.ClientLabel(msg.From, msg.To)).Inc()
+
+	if msg.Delivery != nil {
+		_ = msg.Delivery.Ack()
+	}
+}
@@ -0,0 +1,279 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+var (
+	routeFailureThreshold int
+	routeFailureCooldown  time.Duration
+	// routeErrorWindow and routeErrorBudget mark a route down when more than the budget of its
+	// sends in the window failed, once it has seen core.RouteErrorMinSamples sends.
+	routeErrorWindow time.Duration
+	routeErrorBudget float64
+	// routeHealthInterval is how often carriers that support it are probed.
+	routeHealthInterval time.Duration
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		routeFailureThreshold = cfg.Int("ROUTE_FAILURE_THRESHOLD", 3)
+		routeFailureCooldown = cfg.Duration("ROUTE_FAILURE_COOLDOWN", time.Minute)
+		routeErrorWindow = cfg.Duration("ROUTE_ERROR_WINDOW", 5*time.Minute)
+		routeErrorBudget = cfg.Float("ROUTE_ERROR_BUDGET", 0.5)
+		routeHealthInterval = cfg.Duration("ROUTE_HEALTH_INTERVAL", 30*time.Second)
+	})
+}
+
+// HealthChecker is implemented by carrier handlers that can check the reachability of their API
+// and credentials without sending a message.
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+// routeHealth is the circuit breaker of a route. Passively a route is marked down after
+// routeFailureThreshold consecutive failures or when its errors exceed the error budget, actively
+// when a health probe fails. A down route is skipped for routeFailureCooldown, routes with a
+// health check only come back once a probe succeeds.
+type routeHealth struct {
+	mu        sync.Mutex
+	failures  int
+	downUntil time.Time
+	reason    string
+	lastError string
+	lastProbe time.Time
+	probeErr  error
+
+	// outcomes of the sends in the error window, one bucket per tenth of the window
+	buckets [10]healthBucket
+}
+
+type healthBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// bucket returns the bucket for now, resetting it when it belongs to an older slot.
+func (h *routeHealth) bucket(now time.Time) *healthBucket {
+	width := routeErrorWindow / time.Duration(len(h.buckets))
+	start := now.Truncate(width)
+	b := &h.buckets[int(start.UnixNano()/int64(width))%len(h.buckets)]
+	if !b.start.Equal(start) {
+		*b = healthBucket{start: start}
+	}
+	return b
+}
+
+// errorRate returns the failure rate and number of sends within the error window.
+func (h *routeHealth) errorRate(now time.Time) (float64, int) {
+	var successes, failures int
+	for _, b := range h.buckets {
+		if now.Sub(b.start) < routeErrorWindow {
+			successes += b.successes
+			failures += b.failures
+		}
+	}
+	total := successes + failures
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(failures) / float64(total), total
+}
+
+// Healthy reports whether the route is currently accepting traffic.
+func (route *Route) Healthy() bool {
+	route.health.mu.Lock()
+	defer route.health.mu.Unlock()
+	return route.healthy(time.Now())
+}
+
+// healthy is Healthy for callers holding the health lock.
+func (route *Route) healthy(now time.Time) bool {
+	if route.health.downUntil.IsZero() {
+		return true
+	}
+	if _, probed := route.Handler.(HealthChecker); probed {
+		return false
+	}
+	return now.After(route.health.downUntil)
+}
+
+func (route *Route) reportSuccess() {
+	route.health.mu.Lock()
+	defer route.health.mu.Unlock()
+	route.health.failures = 0
+	route.health.bucket(time.Now()).successes++
+	if route.health.downUntil.IsZero() {
+		return
+	}
+	// a probed route stays down until its probe recovers, a live send may have been lucky
+	if _, probed := route.Handler.(HealthChecker); !probed {
+		route.health.downUntil = time.Time{}
+		route.health.reason = ""
+		go route.logHealthChange(true, "send succeeded")
+	}
+}
+
+func (route *Route) reportFailure(err error) {
+	now := time.Now()
+	route.health.mu.Lock()
+	defer route.health.mu.Unlock()
+	route.health.failures++
+	route.health.bucket(now).failures++
+	route.health.lastError = err.Error()
+
+	if route.health.failures >= routeFailureThreshold {
+		route.markDown(now, "consecutive failures")
+		return
+	}
+	if rate, samples := route.health.errorRate(now); samples >= core.RouteErrorMinSamples && rate > routeErrorBudget {
+		route.markDown(now, "error budget exceeded")
+	}
+}
+
+// markDown takes the route out of rotation for the cooldown, the caller holds the health lock.
+func (route *Route) markDown(now time.Time, reason string) {
+	wasHealthy := route.healthy(now)
+	route.health.downUntil = now.Add(routeFailureCooldown)
+	route.health.reason = reason
+	if wasHealthy {
+		go route.logHealthChange(false, reason)
+	}
+}
+
+// probe runs the active health check of a route. A failed probe keeps or takes the route down,
+// a successful one brings a down route back once its cooldown passed.
+func (route *Route) probe(checker HealthChecker) {
+	err := checker.CheckHealth()
+	now := time.Now()
+
+	route.health.mu.Lock()
+	defer route.health.mu.Unlock()
+	route.health.lastProbe = now
+	route.health.probeErr = err
+
+	if err != nil {
+		// a healthy route gets the same threshold as live sends, a down one stays down
+		route.health.failures++
+		if route.health.failures >= routeFailureThreshold || !route.health.downUntil.IsZero() {
+			route.markDown(now, "health check failed: "+err.Error())
+		}
+		return
+	}
+	if !route.health.downUntil.IsZero() && now.After(route.health.downUntil) {
+		route.health.downUntil = time.Time{}
+		route.health.reason = ""
+		route.health.failures = 0
+		route.health.buckets = [10]healthBucket{}
+		go route.logHealthChange(true, "health check recovered")
+	}
+}
+
+// HealthStatus returns a snapshot of the route's health.
+func (route *Route) HealthStatus() core.RouteHealthStatus {
+	now := time.Now()
+	route.health.mu.Lock()
+	defer route.health.mu.Unlock()
+
+	rate, samples := route.health.errorRate(now)
+	status := core.RouteHealthStatus{
+		Route:               route.Endpoint,
+		Healthy:             route.healthy(now),
+		ConsecutiveFailures: route.health.failures,
+		ErrorRate:           rate,
+		Samples:             samples,
+		LastError:           route.health.lastError,
+	}
+	if !status.Healthy {
+		downUntil := route.health.downUntil
+		status.DownUntil = &downUntil
+		status.Reason = route.health.reason
+	}
+	if _, ok := route.Handler.(HealthChecker); ok {
+		status.Probed = true
+		if !route.health.lastProbe.IsZero() {
+			lastProbe := route.health.lastProbe
+			status.LastProbe = &lastProbe
+		}
+		if route.health.probeErr != nil {
+			status.ProbeError = route.health.probeErr.Error()
+		}
+	}
+	return status
+}
+
+func (route *Route) logHealthChange(healthy bool, reason string) {
+	if route.gateway == nil {
+		return
+	}
+	var lm = route.gateway.LogManager
+	level := logrus.WarnLevel
+	if healthy {
+		level = logrus.InfoLevel
+	}
+	lm.SendLog(lm.BuildLog(
+		"Router.Carrier.Health",
+		"RouteHealthChanged",
+		level,
+		map[string]interface{}{
+			"route":   route.Endpoint,
+			"healthy": healthy,
+		}, reason,
+	))
+
+	eventType := core.EventTypes.CarrierUnhealthy
+	if healthy {
+		eventType = core.EventTypes.CarrierHealthy
+	}
+	route.gateway.EmitTenantEvent(eventType, "", route.gateway.CarrierTenant(route.Endpoint), map[string]interface{}{
+		"route":  route.Endpoint,
+		"reason": reason,
+	})
+}
+
+// RouteHealthChecker probes the carrier routes whose handlers implement HealthChecker every
+// ROUTE_HEALTH_INTERVAL.
+func (router *Router) RouteHealthChecker() {
+	ticker := time.NewTicker(routeHealthInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, route := range router.routesOfType("carrier") {
+			if checker, ok := route.Handler.(HealthChecker); ok {
+				go route.probe(checker)
+			}
+		}
+	}
+}
+
+// RouteHealth returns the health of every carrier route.
+func (router *Router) RouteHealth() []core.RouteHealthStatus {
+	var statuses []core.RouteHealthStatus
+	for _, route := range router.routesOfType("carrier") {
+		statuses = append(statuses, route.HealthStatus())
+	}
+	return statuses
+}
+
+// ErrHealthCheckUnsupported is returned when a probe is requested for a carrier without one.
+var ErrHealthCheckUnsupported = errors.New("carrier has no health check")
+
+// ProbeRoute runs the health check of a carrier route now and returns its health.
+func (router *Router) ProbeRoute(name string) (core.RouteHealthStatus, error) {
+	route := router.FindCarrierRoute(name)
+	if route == nil {
+		return core.RouteHealthStatus{}, fmt.Errorf("unknown carrier route: %s", name)
+	}
+	checker, ok := route.Handler.(HealthChecker)
+	if !ok {
+		return route.HealthStatus(), ErrHealthCheckUnsupported
+	}
+	route.probe(checker)
+	return route.HealthStatus(), nil
+}
@@ -0,0 +1,93 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// discardingCarrier is a carrier handler that may deliver nothing, like a simulator carrier
+// without loopback.
+type discardingCarrier interface {
+	Discards() bool
+}
+
+// mirrorTarget reports whether the route can take the copies of a mirror. Only a carrier that
+// delivers nothing can, a copy sent to a real carrier would reach the recipient twice.
+func (route *Route) mirrorTarget() bool {
+	carrier, ok := route.Handler.(discardingCarrier)
+	return ok && carrier.Discards()
+}
+
+// mirrorSend sends a copy of a message that was sent to the mirror route of its rule, in the
+// background. The copy requests no receipt and its statuses are only recorded, so the outcome shows
+// in the metrics and health of the route without reaching the client.
+func (router *Router) mirrorSend(msg core.MsgQueueItem, source string, client *core.Client) {
+	if msg.MirrorRoute == "" || msg.Mirrored {
+		return
+	}
+	route := router.FindCarrierRoute(msg.MirrorRoute)
+	if route == nil {
+		return
+	}
+	if !route.mirrorTarget() {
+		// the rule was stored past validateRoutingRule, or the carrier changed since
+		var lm = router.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier.Mirror",
+			"MirrorRefused",
+			logrus.WarnLevel,
+			router.gateway.MsgFields(&msg, map[string]interface{}{
+				"route": route.Endpoint,
+			}), route.Endpoint,
+		))
+		return
+	}
+	msg.Mirrored = true
+	msg.SkipReceipt = true
+	msg.Delivery = nil
+	msg.Decision = nil
+	msg.CarrierMessageID = ""
+	msg.RevertUpgrade()
+	msg.RevertTransliteration()
+	router.rewriteSource(&msg, source, client, route.Endpoint)
+	router.transliterateMessage(&msg, client, route.Endpoint)
+
+	go func() {
+		ctx, cancel := msg.SendContext(context.Background())
+		defer cancel()
+
+		started := time.Now()
+		release, err := router.gateway.Limits.Acquire(route.Endpoint, msg.From)
+		if err == nil {
+			if router.upgradeToMMS(&msg, route.Endpoint) || msg.Type == core.MsgQueueItemType.MMS {
+				err = route.Handler.SendMMS(ctx, &msg)
+			} else {
+				err = route.Handler.SendSMS(ctx, &msg)
+			}
+			release()
+		}
+		router.gateway.ObserveCarrierSend(route.Endpoint, &msg, started, err)
+		if err == nil {
+			route.reportSuccess()
+		} else if !errors.Is(err, core.ErrPermanentFailure) && !errors.Is(err, core.ErrCarrierThrottled) {
+			route.reportFailure(err)
+		}
+
+		level := logrus.InfoLevel
+		if err != nil {
+			level = logrus.WarnLevel
+		}
+		var lm = router.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier.Mirror",
+			"MirrorSent",
+			level,
+			router.gateway.MsgFields(&msg, map[string]interface{}{
+				"route": route.Endpoint,
+			}), err,
+		))
+	}()
+}
@@ -0,0 +1,288 @@
+// Package router routes the messages of the clients to the carriers and the messages of the
+// carriers to the clients.
+package router
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/smpp"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+// Route is a destination messages can be sent to. Carrier routes are named after the carrier, so
+// several accounts of the same carrier type are separate routes.
+type Route struct {
+	Type     string
+	Endpoint string
+	Handler  core.CarrierHandler
+	health   *routeHealth
+	gateway  *core.Gateway
+}
+
+type Router struct {
+	gateway          *core.Gateway
+	routesMu         sync.RWMutex
+	Routes           []*Route
+	ClientMsgChan    chan core.MsgQueueItem
+	CarrierMsgChan   chan core.MsgQueueItem
+	MessageAckStatus chan core.MsgQueueItem
+	RetryPolicy      core.RetryPolicy
+	Rules            *RoutingEngine
+	Content          *ContentFilter
+	AutoReplies      *AutoResponder
+	Rewrites         *SourceRewriter
+	LCR              *LCRTable
+	Loops            *loopTracker
+	StoreForward     *storeForward
+	Maintenance      *maintenanceSet
+	pipeline         routerMiddleware
+	auditChan        chan *core.RoutingDecision
+	SMPP             SMPPDelivery     // nil until the SMPP server runs
+	MM4              MM4Delivery      // nil until the MM4 server runs
+	Inbound          []InboundHandler // offered the messages to clients first
+}
+
+// SMPPDelivery delivers messages and delivery receipts to the SMPP sessions of the clients, the
+// SMPP server of the gateway does.
+type SMPPDelivery interface {
+	FindSession(destination string) (*smpp.Session, error)
+	SendSMPP(ctx context.Context, msg core.MsgQueueItem, session *smpp.Session) error
+	SendDeliveryReceipt(msg core.MsgQueueItem, state pdu.MessageState, errCode string) error
+	WriteDeliveryReceipt(session *smpp.Session, msg core.MsgQueueItem, state pdu.MessageState, errCode string) error
+	// Reconnects delivers the usernames of the clients as they bind.
+	Reconnects() <-chan string
+	BoundClients() []string
+}
+
+// MM4Delivery delivers messages and delivery reports to the MM4 peers of the clients, the MM4
+// server of the gateway does.
+type MM4Delivery interface {
+	SendMM4(ctx context.Context, msg core.MsgQueueItem) error
+	SendMM4DeliveryReport(msg core.MsgQueueItem, client *core.Client, status string) error
+}
+
+// InboundHandler takes a message to a client before it is delivered over SMPP or MM4, like the
+// gRPC streams and the MQTT bridge do. ok is false for the messages it leaves to the others.
+type InboundHandler func(msg *core.MsgQueueItem, fromClient *core.Client, toClient *core.Client) (decision Decision, ok bool)
+
+// inbound offers a message to a client to the inbound handlers in order.
+func (router *Router) inbound(msg *core.MsgQueueItem, fromClient *core.Client, toClient *core.Client) (Decision, bool) {
+	for _, handler := range router.Inbound {
+		if decision, ok := handler(msg, fromClient, toClient); ok {
+			return decision, true
+		}
+	}
+	return Decision{}, false
+}
+
+// New creates the router of the gateway and loads the routing rules, the held messages and
+// the maintenance windows.
+func New(gateway *core.Gateway) (*Router, error) {
+	router := &Router{
+		gateway:        gateway,
+		Routes:         make([]*Route, 0),
+		ClientMsgChan:  make(chan core.MsgQueueItem, core.RouterQueueSize),
+		CarrierMsgChan: make(chan core.MsgQueueItem, core.RouterQueueSize),
+		Rules:          NewRoutingEngine(),
+		Content:        NewContentFilter(),
+		AutoReplies:    NewAutoResponder(),
+		Rewrites:       NewSourceRewriter(),
+		LCR:            NewLCRTable(),
+		Loops:          newLoopTracker(),
+		StoreForward:   newStoreForward(),
+		Maintenance:    newMaintenanceSet(),
+		auditChan:      make(chan *core.RoutingDecision, 1000),
+	}
+	router.AutoReplies.answered = core.CacheWithTTL(gateway.Cache, autoReplyInterval)
+
+	retryPolicy, err := core.LoadRetryPolicy()
+	if err != nil {
+		return nil, err
+	}
+	router.RetryPolicy = retryPolicy
+
+	if err := router.LoadRoutingRules(); err != nil {
+		return nil, fmt.Errorf("failed to load routing rules: %v", err)
+	}
+
+	if err := router.LoadHeldClients(); err != nil {
+		return nil, fmt.Errorf("failed to load held messages: %v", err)
+	}
+
+	if err := router.loadMaintenance(); err != nil {
+		return nil, fmt.Errorf("failed to load maintenance: %v", err)
+	}
+	return router, nil
+}
+
+// QueueDepths returns the messages waiting in the channels of the router.
+func (router *Router) QueueDepths() map[string]int {
+	return map[string]int{
+		"router_client":  len(router.ClientMsgChan),
+		"router_carrier": len(router.CarrierMsgChan),
+	}
+}
+
+func (router *Router) ClientMsgConsumer() {
+	var lm = router.gateway.LogManager
+	for delivery := range router.gateway.Queue.Consume("client") {
+		msgQueueItem, err := core.DecodeMsgQueueItem(delivery.Body)
+		if err != nil {
+			// unreadable payloads go to the dead letter queue instead of blocking the queue
+			lm.SendLog(lm.BuildLog(
+				"Router.Consume",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"queue": "client",
+					"logID": core.LogIDFromHeaders(delivery.Headers),
+				}, err,
+			))
+			_ = delivery.Nack(false)
+			continue
+		}
+		if msgQueueItem.LogID == "" {
+			msgQueueItem.LogID = core.LogIDFromHeaders(delivery.Headers)
+		}
+		if traceParent := core.TraceParentFromHeaders(delivery.Headers); traceParent != "" {
+			msgQueueItem.TraceParent = traceParent
+		}
+		delivery := delivery
+		msgQueueItem.Delivery = &delivery
+		if attempts := core.AttemptsFromHeaders(delivery.Headers); attempts > msgQueueItem.Attempts {
+			msgQueueItem.Attempts = attempts
+		}
+
+		span := core.StartMsgSpan("client receive", core.SpanKindConsumer, &msgQueueItem)
+		span.SetAttributes(map[string]interface{}{"messaging.destination.name": "client"})
+		router.ClientMsgChan <- msgQueueItem
+		span.End(nil)
+	}
+}
+
+func (router *Router) CarrierMsgConsumer() {
+	var lm = router.gateway.LogManager
+	for delivery := range router.gateway.Queue.Consume("carrier") {
+		msgQueueItem, err := core.DecodeMsgQueueItem(delivery.Body)
+		if err != nil {
+			// unreadable payloads go to the dead letter queue instead of blocking the queue
+			lm.SendLog(lm.BuildLog(
+				"Router.Consume",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"queue": "carrier",
+					"logID": core.LogIDFromHeaders(delivery.Headers),
+				}, err,
+			))
+			_ = delivery.Nack(false)
+			continue
+		}
+		if msgQueueItem.LogID == "" {
+			msgQueueItem.LogID = core.LogIDFromHeaders(delivery.Headers)
+		}
+		if traceParent := core.TraceParentFromHeaders(delivery.Headers); traceParent != "" {
+			msgQueueItem.TraceParent = traceParent
+		}
+		delivery := delivery
+		msgQueueItem.Delivery = &delivery
+		if attempts := core.AttemptsFromHeaders(delivery.Headers); attempts > msgQueueItem.Attempts {
+			msgQueueItem.Attempts = attempts
+		}
+
+		span := core.StartMsgSpan("carrier receive", core.SpanKindConsumer, &msgQueueItem)
+		span.SetAttributes(map[string]interface{}{"messaging.destination.name": "carrier"})
+		router.CarrierMsgChan <- msgQueueItem
+		span.End(nil)
+	}
+}
+
+func (router *Router) AddRoute(routeType, endpoint string, handler core.CarrierHandler) {
+	router.routesMu.Lock()
+	defer router.routesMu.Unlock()
+	router.Routes = append(router.Routes, &Route{Type: routeType, Endpoint: endpoint, Handler: handler, health: &routeHealth{}, gateway: router.gateway})
+}
+
+func (router *Router) findRouteByName(routeType, routeName string) *Route {
+	router.routesMu.RLock()
+	defer router.routesMu.RUnlock()
+	for _, route := range router.Routes {
+		if route.Type == routeType && route.Endpoint == routeName {
+			return route
+		}
+	}
+	return nil
+}
+
+// FindCarrierRoute returns the carrier route with the name. Rules, LCR entries and numbers that
+// predate named carriers refer to the carrier type instead, which still selects the carrier when
+// exactly one carrier has that type.
+func (router *Router) FindCarrierRoute(name string) *Route {
+	if route := router.findRouteByName("carrier", name); route != nil {
+		return route
+	}
+
+	var match *Route
+	for _, route := range router.routesOfType("carrier") {
+		if router.gateway.CarrierType(route.Endpoint) == strings.ToLower(name) {
+			if match != nil {
+				return nil // ambiguous, the name must be used
+			}
+			match = route
+		}
+	}
+	return match
+}
+
+// routesOfType returns a snapshot of the routes of a type.
+func (router *Router) routesOfType(routeType string) []*Route {
+	router.routesMu.RLock()
+	defer router.routesMu.RUnlock()
+	var routes []*Route
+	for _, route := range router.Routes {
+		if route.Type == routeType {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// SyncCarrierRoutes makes the carrier routes match the loaded carriers, one route per carrier
+// name. Routes of carriers that are still loaded keep their health.
+func (router *Router) SyncCarrierRoutes() {
+	router.gateway.Mu.RLock()
+	names := make([]string, 0, len(router.gateway.Carriers))
+	handlers := make(map[string]core.CarrierHandler, len(router.gateway.Carriers))
+	for name, handler := range router.gateway.Carriers {
+		names = append(names, name)
+		handlers[name] = handler
+	}
+	router.gateway.Mu.RUnlock()
+	sort.Strings(names)
+
+	router.routesMu.Lock()
+	defer router.routesMu.Unlock()
+
+	existing := make(map[string]*Route)
+	routes := make([]*Route, 0, len(router.Routes))
+	for _, route := range router.Routes {
+		if route.Type == "carrier" {
+			existing[route.Endpoint] = route
+		} else {
+			routes = append(routes, route)
+		}
+	}
+	for _, name := range names {
+		health := &routeHealth{}
+		if route, ok := existing[name]; ok {
+			health = route.health
+		}
+		routes = append(routes, &Route{Type: "carrier", Endpoint: name, Handler: handlers[name], health: health, gateway: router.gateway})
+	}
+	router.Routes = routes
+}
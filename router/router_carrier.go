@@ -0,0 +1,325 @@
+package router
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// CarrierRouter inbound from carriers, or in the "from_carrier" channel.
+// the inbound function on the carrier processors, simply pushes the msg to the rabbitmq, and
+// then this thing picks it up, for outbound, it's just the reverse.
+func (router *Router) CarrierRouter() {
+	lanes := newRouterLanes(router.routeThrough("carrier", router.routeCarrierMessage))
+	for msg := range router.CarrierMsgChan {
+		lanes.dispatch(msg)
+	}
+}
+
+// routeCarrierMessage routes a single message received from a carrier or the carrier queue.
+func (router *Router) routeCarrierMessage(msg core.MsgQueueItem) {
+	var lm = router.gateway.LogManager
+
+	to, _ := core.FormatToE164(msg.To)
+	msg.To = to
+	from, _ := core.FormatToE164(msg.From)
+	msg.From = from
+	router.unmaskDestination(&msg)
+	span := core.StartMsgSpan("carrier route", core.SpanKindInternal, &msg)
+	defer span.End(nil)
+	router.beginDecision(&msg, "carrier")
+	ctx, cancel := msg.SendContext(context.Background())
+	defer cancel()
+
+	if reason := router.detectLoop(&msg, "carrier"); reason != "" {
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier",
+			"RouterLoopDetected",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, map[string]interface{}{
+				"hops": msg.Hops,
+			}), reason,
+		))
+		router.deadLetter(msg, "carrier", reason)
+		return
+	}
+
+	if msg.Expired(time.Now()) {
+		router.expireMessage(msg, "carrier")
+		return
+	}
+
+	if msg.Type == core.MsgQueueItemType.MMS && msg.Files != nil {
+		if client, number, _ := router.gateway.LookupNumber(msg.To); core.MediaFallback(client, number) {
+			if err := router.gateway.FallbackToSMS(&msg, client); err != nil {
+				router.retry(msg, "carrier", core.RetryClasses.ClientSend, err.Error())
+				return
+			}
+			router.logMediaFallback(&msg, client)
+		}
+	}
+
+	switch msgType := msg.Type; msgType {
+	case core.MsgQueueItemType.SMS:
+		client, _ := router.gateway.FindClientByNumber(msg.To)
+		if client != nil && router.foreignCarrier(&msg, client) {
+			router.rejectForeignCarrier(msg, client)
+			return
+		}
+		if reason := router.gateway.InactiveNumber(msg.To); client != nil && reason != "" {
+			router.settle(ctx, msg, "carrier", router.rejectInactiveNumber(&msg, "carrier", reason))
+			return
+		}
+		if client != nil {
+			if decision, ok := router.maintenanceDecision(&msg, client, "carrier"); ok {
+				router.settle(ctx, msg, "carrier", decision)
+				return
+			}
+			router.handleKeyword(&msg, client)
+			router.autoReply(&msg, client)
+
+			// keep the order of messages held while the client was offline
+			if router.StoreForward.isHolding(client.ID) {
+				router.holdMessage(msg, client, "client has held messages")
+				return
+			}
+
+			session, err := router.SMPP.FindSession(msg.To)
+			if err != nil && router.forwardToSession(ctx, msg, client, "carrier") {
+				return
+			}
+			if err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Router.Carrier.SMS",
+					"RouterFindSMPP",
+					logrus.ErrorLevel,
+					router.gateway.MsgFields(&msg, map[string]interface{}{
+						"client": client.Username,
+					}), err,
+				))
+				router.holdMessage(msg, client, err.Error())
+				return
+			}
+			if session != nil {
+				err := router.SMPP.SendSMPP(ctx, msg, session)
+				if err != nil {
+					lm.SendLog(lm.BuildLog(
+						"Router.Carrier.SMS",
+						"RouterSendSMPP",
+						logrus.ErrorLevel,
+						router.gateway.MsgFields(&msg, map[string]interface{}{
+							"client": client.Username,
+						}), err,
+					))
+					router.retry(msg, "carrier", core.ClientRetryClass(err, core.RetryClasses.ClientSend), err.Error())
+					return
+				} else {
+					router.recordDecision(&msg, core.RoutingOutcomes.Delivered, "smpp:"+client.Username, "")
+					router.gateway.MsgRecordChan <- core.MsgRecord{
+						MsgQueueItem: msg,
+						Carrier:      "inbound",
+						ClientID:     client.ID,
+						Internal:     false,
+					}
+					if msg.Delivery != nil {
+						err := msg.Delivery.Ack()
+						if err != nil {
+							return
+						}
+					}
+					return
+				}
+			} else {
+				router.holdMessage(msg, client, "no SMPP session for destination")
+				return
+			}
+		}
+
+		client, _ = router.gateway.FindClientByNumber(msg.From)
+		if client == nil {
+			lm.SendLog(lm.BuildLog(
+				"Router.Carrier.SMS",
+				"Invalid sender number.",
+				logrus.ErrorLevel,
+				router.gateway.MsgFields(&msg, map[string]interface{}{
+					"from": msg.From,
+				}),
+			))
+			router.deadLetter(msg, "carrier", "no client found for sender or destination")
+			return
+		}
+
+		routes := router.outboundRoutes(&msg, client)
+		if len(routes) > 0 {
+			// add to outbound carrier queue
+			carrier, err := router.sendCarrier(ctx, &msg, routes)
+			if err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Router.Carrier.SMS",
+					"RouterSendCarrier",
+					logrus.ErrorLevel,
+					router.gateway.MsgFields(&msg, map[string]interface{}{
+						"client": client.Username,
+					}), err,
+				))
+				router.retry(msg, "carrier", core.CarrierRetryClass(err), err.Error())
+				return
+			}
+			router.recordDecision(&msg, core.RoutingOutcomes.Delivered, carrier, "")
+			router.gateway.MsgRecordChan <- core.MsgRecord{
+				MsgQueueItem: msg,
+				Carrier:      carrier,
+				ClientID:     client.ID,
+				Internal:     false,
+			}
+			if msg.Delivery != nil {
+				_ = msg.Delivery.Ack()
+			}
+			return
+		} else {
+			lm.SendLog(lm.BuildLog(
+				"Router.Carrier.MMS",
+				"RouterFindCarrier",
+				logrus.ErrorLevel,
+				router.gateway.MsgFields(&msg, map[string]interface{}{
+					"client": client.Username,
+				}),
+			))
+		}
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier.SMS",
+			"RouterSendFailed",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, map[string]interface{}{
+				"client": client.Username,
+			}),
+		))
+		router.deadLetter(msg, "carrier", "no route found for sender")
+		return
+	case core.MsgQueueItemType.MMS:
+		client, _ := router.gateway.FindClientByNumber(msg.To)
+
+		if msg.Files == nil {
+			lm.SendLog(lm.BuildLog(
+				"Router.Carrier.MMS",
+				"NoFiles",
+				logrus.ErrorLevel,
+				router.gateway.MsgFields(&msg, nil),
+			))
+			router.deadLetter(msg, "carrier", "no files were included")
+			return
+		}
+
+		if client != nil && router.foreignCarrier(&msg, client) {
+			router.rejectForeignCarrier(msg, client)
+			return
+		}
+		if reason := router.gateway.InactiveNumber(msg.To); client != nil && reason != "" {
+			router.settle(ctx, msg, "carrier", router.rejectInactiveNumber(&msg, "carrier", reason))
+			return
+		}
+		if client != nil && client.Profile.NoMMS {
+			router.deadLetter(msg, "carrier", "client takes no MMS")
+			return
+		}
+		if client != nil {
+			if decision, ok := router.maintenanceDecision(&msg, client, "carrier"); ok {
+				router.settle(ctx, msg, "carrier", decision)
+				return
+			}
+			router.autoReply(&msg, client)
+			err := router.MM4.SendMM4(ctx, msg)
+			if err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Router.Carrier.MMS",
+					"RouterSendMM4",
+					logrus.ErrorLevel,
+					router.gateway.MsgFields(&msg, map[string]interface{}{
+						"client": client.Username,
+					}), err,
+				))
+				// todo maybe to add to queue via postgres?
+				router.retry(msg, "carrier", core.ClientRetryClass(err, core.RetryClasses.ClientSend), err.Error())
+				return
+			}
+			router.recordDecision(&msg, core.RoutingOutcomes.Delivered, "mm4:"+client.Username, "")
+			router.gateway.MsgRecordChan <- core.MsgRecord{
+				MsgQueueItem: msg,
+				Carrier:      "inbound",
+				ClientID:     client.ID,
+				Internal:     false,
+			}
+			if msg.Delivery != nil {
+				err := msg.Delivery.Ack()
+				if err != nil {
+					return
+				}
+			}
+			return
+		}
+
+		client, _ = router.gateway.FindClientByNumber(msg.From)
+		if client == nil {
+			lm.SendLog(lm.BuildLog(
+				"Router.Carrier.MMS",
+				"Invalid sender number.",
+				logrus.ErrorLevel,
+				router.gateway.MsgFields(&msg, map[string]interface{}{
+					"from": msg.From,
+				}),
+			))
+			router.deadLetter(msg, "carrier", "no client found for sender or destination")
+			return
+		}
+
+		routes := router.outboundRoutes(&msg, client)
+		if len(routes) > 0 {
+			// add to outbound carrier queue
+			carrier, err := router.sendCarrier(ctx, &msg, routes)
+			if err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Router.Carrier.MMS",
+					"RouterSendCarrier",
+					logrus.ErrorLevel,
+					router.gateway.MsgFields(&msg, map[string]interface{}{
+						"client": client.Username,
+					}), err,
+				))
+				router.retry(msg, "carrier", core.CarrierRetryClass(err), err.Error())
+				return
+			}
+			router.recordDecision(&msg, core.RoutingOutcomes.Delivered, carrier, "")
+			router.gateway.MsgRecordChan <- core.MsgRecord{
+				MsgQueueItem: msg,
+				Carrier:      carrier,
+				ClientID:     client.ID,
+				Internal:     false,
+			}
+			if msg.Delivery != nil {
+				_ = msg.Delivery.Ack()
+			}
+			return
+		} else {
+			lm.SendLog(lm.BuildLog(
+				"Router.Carrier.MMS",
+				"RouterFindCarrier",
+				logrus.ErrorLevel,
+				router.gateway.MsgFields(&msg, map[string]interface{}{
+					"client": client.Username,
+				}),
+			))
+		}
+		// throw error?
+		lm.SendLog(lm.BuildLog(
+			"Router.Carrier.MMS",
+			"RouterSendFailed",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, map[string]interface{}{
+				"client": client.Username,
+			}),
+		))
+		router.deadLetter(msg, "carrier", "no route found for sender")
+		return
+	}
+}
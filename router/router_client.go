@@ -0,0 +1,258 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// ClientRouter starts the router that handles inbound and outbound from the sms and mms servers
+func (router *Router) ClientRouter() {
+	lanes := newRouterLanes(router.routeThrough("client", router.routeClientMessage))
+	for msg := range router.ClientMsgChan {
+		lanes.dispatch(msg)
+	}
+}
+
+// routeClientMessage routes a single message received from a client.
+func (router *Router) routeClientMessage(msg core.MsgQueueItem) {
+	to, _ := core.FormatToE164(msg.To)
+	msg.To = to
+	from, _ := core.FormatToE164(msg.From)
+	msg.From = from
+	span := core.StartMsgSpan("client route", core.SpanKindInternal, &msg)
+	defer span.End(nil)
+	router.beginDecision(&msg, "client")
+	ctx, cancel := msg.SendContext(context.Background())
+	defer cancel()
+
+	decision := router.decideClientMessage(ctx, &msg)
+	router.settle(ctx, msg, "client", decision)
+}
+
+// decideClientMessage runs the checks every message of a client passes and hands it to the
+// handler of its type.
+func (router *Router) decideClientMessage(ctx context.Context, msg *core.MsgQueueItem) Decision {
+	var lm = router.gateway.LogManager
+
+	if reason := router.detectLoop(msg, "client"); reason != "" {
+		lm.SendLog(lm.BuildLog(
+			"Router.Client",
+			"RouterLoopDetected",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"hops": msg.Hops,
+			}), reason,
+		))
+		return deadLetterDecision(reason)
+	}
+
+	if msg.Expired(time.Now()) {
+		return Decision{Kind: DecisionDeadLetter, Reason: "expired", Expired: true}
+	}
+
+	toClient, _ := router.gateway.FindClientByNumber(msg.To)
+	fromClient, _ := router.gateway.FindClientByNumber(msg.From)
+
+	if fromClient == nil && toClient == nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.Client.SMS",
+			"Invalid sender number.",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"from": msg.From,
+			}),
+		))
+		return deadLetterDecision("no client found for sender or destination")
+	}
+
+	if fromClient != nil {
+		if reason := router.gateway.InactiveNumber(msg.From); reason != "" {
+			return router.rejectInactiveNumber(msg, "client", reason)
+		}
+	}
+	if toClient != nil {
+		if reason := router.gateway.InactiveNumber(msg.To); reason != "" {
+			return router.rejectInactiveNumber(msg, "client", reason)
+		}
+	}
+
+	if fromClient != nil && toClient == nil {
+		if service := core.EmergencyService(msg.To); service != "" {
+			return router.rejectEmergency(msg, fromClient, service)
+		}
+	}
+
+	if fromClient != nil && !msg.SkipOptOut {
+		optedOut, err := router.gateway.IsOptedOut(msg.From, msg.To)
+		if err != nil {
+			// an unreadable opt-out list doesn't stop all traffic
+			lm.SendLog(lm.BuildLog(
+				"Router.Client",
+				"GenericError",
+				logrus.ErrorLevel,
+				router.gateway.MsgFields(msg, nil), err,
+			))
+		}
+		if optedOut {
+			return router.rejectOptedOut(msg, fromClient)
+		}
+	}
+
+	if fromClient != nil && toClient == nil {
+		if reason := core.DestinationBlocked(msg, fromClient); reason != "" {
+			return router.rejectDestination(msg, fromClient, reason)
+		}
+	}
+
+	if fromClient != nil && toClient == nil {
+		if decision, quiet := router.enforceQuietHours(msg, fromClient); quiet {
+			return decision
+		}
+		// retries and released messages were counted when the message was first routed
+		if msg.Attempts == 0 {
+			if decision, exceeded := router.enforceMonthlyQuota(msg, fromClient); exceeded {
+				return decision
+			}
+		}
+	}
+
+	// retries were counted when the message was first routed
+	if fromClient != nil && msg.Attempts == 0 && !core.CountTenantMessage(fromClient.TenantID, time.Now()) {
+		reason := "tenant daily message quota exceeded"
+		lm.SendLog(lm.BuildLog(
+			"Router.Client",
+			"TenantRejected",
+			logrus.WarnLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"client": fromClient.Username,
+				"tenant": fromClient.TenantID,
+			}), reason,
+		))
+		return deadLetterDecision(reason)
+	}
+
+	if fromClient != nil && toClient == nil {
+		// released quarantined messages were already screened
+		if !msg.Screened {
+			if decision, allowed := router.screenContent(msg, fromClient); !allowed {
+				return decision
+			}
+		}
+		if router.throttleTraffic(msg, fromClient) {
+			return RetryDecision(core.RetryClasses.Congestion, "client throttled after a traffic anomaly")
+		}
+	}
+
+	if toClient != nil {
+		if decision, ok := router.maintenanceDecision(msg, toClient, "client"); ok {
+			return decision
+		}
+	}
+
+	switch msg.Type {
+	case core.MsgQueueItemType.SMS:
+		return router.handleClientSMS(ctx, msg, fromClient, toClient)
+	case core.MsgQueueItemType.MMS:
+		return router.handleClientMMS(ctx, msg, fromClient, toClient)
+	}
+	return deadLetterDecision(fmt.Sprintf("unknown message type %q", msg.Type))
+}
+
+// handleClientSMS delivers an SMS to the SMPP session of the destination client, on this or
+// another instance, or queues it for a carrier.
+func (router *Router) handleClientSMS(ctx context.Context, msg *core.MsgQueueItem, fromClient *core.Client, toClient *core.Client) Decision {
+	if toClient == nil {
+		return router.carrierDecision(msg, fromClient)
+	}
+
+	if decision, ok := router.inbound(msg, fromClient, toClient); ok {
+		return decision
+	}
+
+	var lm = router.gateway.LogManager
+	session, err := router.SMPP.FindSession(msg.To)
+	if err != nil {
+		if decision, ok := router.sessionForward(msg, toClient, "client"); ok {
+			return decision
+		}
+	}
+	if err == nil && session == nil {
+		err = errors.New("no SMPP session for destination")
+	}
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.Client.SMS",
+			"RouterFindSMPP",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"toClient": toClient.Username,
+			}), err,
+		))
+		return RetryDecision(core.RetryClasses.ClientOffline, err.Error())
+	}
+
+	if err := router.SMPP.SendSMPP(ctx, *msg, session); err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.Client.SMS",
+			"RouterSendSMPP",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"toClient": toClient.Username,
+			}), err,
+		))
+		return RetryDecision(core.ClientRetryClass(err, core.RetryClasses.ClientSend), err.Error())
+	}
+	return AckDecision(core.RoutingOutcomes.Delivered, "smpp:"+toClient.Username, ClientRecords(fromClient, toClient)...)
+}
+
+// handleClientMMS delivers an MMS to the MM4 server of the destination client, or queues it for
+// a carrier.
+func (router *Router) handleClientMMS(ctx context.Context, msg *core.MsgQueueItem, fromClient *core.Client, toClient *core.Client) Decision {
+	if toClient == nil {
+		return router.carrierDecision(msg, fromClient)
+	}
+	if decision, ok := router.inbound(msg, fromClient, toClient); ok {
+		return decision
+	}
+	if _, number, _ := router.gateway.LookupNumber(msg.To); core.MediaFallback(toClient, number) {
+		if err := router.gateway.FallbackToSMS(msg, toClient); err != nil {
+			return RetryDecision(core.RetryClasses.ClientSend, err.Error())
+		}
+		router.logMediaFallback(msg, toClient)
+		return router.handleClientSMS(ctx, msg, fromClient, toClient)
+	}
+	if toClient.Profile.NoMMS {
+		return rejectDecision(core.ErrorClasses.PolicyBlock, "destination client takes no MMS")
+	}
+
+	if err := router.MM4.SendMM4(ctx, *msg); err != nil {
+		var lm = router.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.Client.MMS",
+			"RouterSendMM4",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"toClient": toClient.Username,
+			}), err,
+		))
+		return RetryDecision(core.ClientRetryClass(err, core.RetryClasses.ClientSend), err.Error())
+	}
+	return AckDecision(core.RoutingOutcomes.Delivered, "mm4:"+toClient.Username, ClientRecords(fromClient, toClient)...)
+}
+
+// ClientRecords are the message records of a message delivered to a client, one per client side.
+func ClientRecords(fromClient *core.Client, toClient *core.Client) []core.MsgRecord {
+	var records []core.MsgRecord
+	internal := fromClient != nil && toClient != nil
+	if fromClient != nil {
+		records = append(records, core.MsgRecord{Carrier: "from_client", ClientID: fromClient.ID, Internal: internal})
+	}
+	if toClient != nil {
+		records = append(records, core.MsgRecord{Carrier: "to_client", ClientID: toClient.ID, Internal: internal})
+	}
+	return records
+}
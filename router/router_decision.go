@@ -0,0 +1,175 @@
+package router
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// DecisionKind is what the router does with a message once its handler is done with it.
+type DecisionKind int
+
+const (
+	DecisionAck        DecisionKind = iota // delivered or held, the delivery is acked
+	DecisionRetryLater                     // published again after the backoff of the retry class
+	DecisionDeadLetter                     // parked in the dead letter queue
+	DecisionReroute                        // published to another queue, then acked
+)
+
+func (kind DecisionKind) String() string {
+	switch kind {
+	case DecisionAck:
+		return "ack"
+	case DecisionRetryLater:
+		return "retry_later"
+	case DecisionDeadLetter:
+		return "dead_letter"
+	case DecisionReroute:
+		return "reroute"
+	}
+	return "unknown"
+}
+
+// Decision is the outcome of a router handler. Handlers only decide, settle carries the decision
+// out, so every path acks, retries and dead-letters the message the same way.
+type Decision struct {
+	Kind    DecisionKind
+	Outcome string                 // routing outcome recorded for Ack and Reroute, see RoutingOutcomes
+	Route   string                 // where the message went, for Ack and Reroute
+	Queue   string                 // queue a rerouted message is published to
+	Reason  string                 // why the message is retried or dead-lettered, or the audit reason
+	Class   core.RetryClass        // retry class of RetryLater, and of a Reroute whose publish failed
+	Report  core.ErrorClass        // failure status reported to the sender of a dead-lettered message
+	Expired bool                   // dead-lettered because it expired, the sender gets an EXPIRED status
+	Headers map[string]interface{} // extra headers of a rerouted message
+	Delay   time.Duration          // how long a rerouted message waits before it is consumed
+	Records []core.MsgRecord       // records written once the message is acked
+}
+
+func AckDecision(outcome string, route string, records ...core.MsgRecord) Decision {
+	return Decision{Kind: DecisionAck, Outcome: outcome, Route: route, Records: records}
+}
+
+func RetryDecision(class core.RetryClass, reason string) Decision {
+	return Decision{Kind: DecisionRetryLater, Class: class, Reason: reason}
+}
+
+func deadLetterDecision(reason string) Decision {
+	return Decision{Kind: DecisionDeadLetter, Reason: reason}
+}
+
+// rejectDecision dead-letters the message and reports the failure class to its sender.
+func rejectDecision(class core.ErrorClass, reason string) Decision {
+	return Decision{Kind: DecisionDeadLetter, Reason: reason, Report: class}
+}
+
+func rerouteDecision(queue string, outcome string, route string) Decision {
+	return Decision{Kind: DecisionReroute, Queue: queue, Outcome: outcome, Route: route, Class: core.RetryClasses.Default}
+}
+
+// settle carries out the decision for a message consumed from the queue, ctx bounds the publish
+// of a rerouted message.
+func (router *Router) settle(ctx context.Context, msg core.MsgQueueItem, queue string, decision Decision) {
+	switch decision.Kind {
+	case DecisionAck:
+		outcome := decision.Outcome
+		if outcome == "" {
+			outcome = core.RoutingOutcomes.Delivered
+		}
+		router.recordDecision(&msg, outcome, decision.Route, decision.Reason)
+		for _, record := range decision.Records {
+			record.MsgQueueItem = msg
+			router.gateway.MsgRecordChan <- record
+		}
+		router.ackDelivery(&msg, queue)
+	case DecisionRetryLater:
+		router.retry(msg, queue, decision.Class, decision.Reason)
+	case DecisionDeadLetter:
+		if decision.Expired {
+			router.expireMessage(msg, queue)
+			return
+		}
+		if decision.Report != core.ErrorClasses.Unknown {
+			go router.reportFailure(msg, decision.Report)
+		}
+		router.deadLetter(msg, queue, decision.Reason)
+	case DecisionReroute:
+		router.reroute(ctx, msg, queue, decision)
+	}
+}
+
+// reroute publishes the message to the queue of the decision and acks the delivery it came from.
+// A failed publish is retried on the queue the message was consumed from.
+func (router *Router) reroute(ctx context.Context, msg core.MsgQueueItem, queue string, decision Decision) {
+	var lm = router.gateway.LogManager
+	span := core.StartMsgSpan(decision.Queue+" publish", core.SpanKindProducer, &msg)
+	marshal, err := core.EncodeMsgQueueItem(msg)
+	if err != nil {
+		span.End(err)
+		router.deadLetter(msg, queue, err.Error())
+		return
+	}
+	if decision.Delay > 0 {
+		err = router.gateway.Queue.PublishDelayed(ctx, decision.Queue, marshal, core.MessageHeaders(msg, decision.Headers), decision.Delay)
+	} else {
+		err = router.gateway.Queue.PublishWithHeaders(ctx, decision.Queue, marshal, core.MessageHeaders(msg, decision.Headers))
+	}
+	span.End(err)
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Router.Reroute",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(&msg, map[string]interface{}{
+				"queue": decision.Queue,
+			}), err,
+		))
+		router.retry(msg, queue, decision.Class, err.Error())
+		return
+	}
+	router.recordDecision(&msg, decision.Outcome, decision.Route, decision.Reason)
+	router.ackDelivery(&msg, queue)
+}
+
+// ackDelivery acks the delivery of the message, if it came from the queue. A failed ack is only
+// logged, the broker redelivers the message and the handlers don't mind seeing it twice.
+func (router *Router) ackDelivery(msg *core.MsgQueueItem, queue string) {
+	if msg.Delivery == nil {
+		return
+	}
+	if err := msg.Delivery.Ack(); err != nil {
+		var lm = router.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.Ack",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"queue": queue,
+			}), err,
+		))
+	}
+}
+
+// carrierDecision queues a message of a client for the carrier router, unless the client has no
+// route for it.
+func (router *Router) carrierDecision(msg *core.MsgQueueItem, fromClient *core.Client) Decision {
+	if !router.hasOutboundRoute(msg, fromClient) {
+		var lm = router.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.Client."+strings.ToUpper(string(msg.Type)),
+			"RouterFindCarrier",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"toClient": fromClient.Username,
+			}),
+		))
+		return deadLetterDecision("no carrier found for sender")
+	}
+	if isSelfAddressed(msg) {
+		return deadLetterDecision("loop detected: source equals destination")
+	}
+	msg.QueuedTimestamp = time.Now()
+	return rerouteDecision("carrier", core.RoutingOutcomes.Queued, "carrier")
+}
@@ -0,0 +1,214 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// recordingQueue is a MessageQueue that records what is published to it, publishes to failQueue
+// fail.
+type recordingQueue struct {
+	mu        sync.Mutex
+	published []publishedMessage
+	failQueue string
+}
+
+type publishedMessage struct {
+	queue   string
+	headers map[string]interface{}
+	delay   time.Duration
+}
+
+func (queue *recordingQueue) Publish(ctx context.Context, queueName string, data []byte) error {
+	return queue.PublishWithHeaders(ctx, queueName, data, nil)
+}
+
+func (queue *recordingQueue) PublishWithHeaders(ctx context.Context, queueName string, data []byte, headers map[string]interface{}) error {
+	return queue.PublishDelayed(ctx, queueName, data, headers, 0)
+}
+
+func (queue *recordingQueue) PublishDelayed(_ context.Context, queueName string, _ []byte, headers map[string]interface{}, delay time.Duration) error {
+	if queueName == queue.failQueue {
+		return errors.New("publish failed")
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.published = append(queue.published, publishedMessage{queue: queueName, headers: headers, delay: delay})
+	return nil
+}
+
+func (queue *recordingQueue) Consume(string) <-chan core.QueueDelivery { return nil }
+
+func (queue *recordingQueue) Ready() bool { return true }
+
+func (queue *recordingQueue) Accepting() bool { return true }
+
+func (queue *recordingQueue) Close() error { return nil }
+
+// newTestRouter returns a router of a gateway without clients, logging to stdout only.
+func newTestRouter(queue core.MessageQueue) *Router {
+	core.Configure(&core.Config{})
+	lm := &core.LogManager{Templates: make(map[string]string), LogChannel: make(chan *core.LoggingFormat)}
+	lm.LoadTemplates()
+	go func() {
+		for range lm.LogChannel {
+		}
+	}()
+	gateway := &core.Gateway{
+		LogManager:    lm,
+		Queue:         queue,
+		Cache:         core.NewLocalCache(100, time.Minute),
+		NumberIndex:   core.NewNumberIndex(),
+		Clients:       make(map[string]*core.Client),
+		MsgRecordChan: make(chan core.MsgRecord, 10),
+	}
+	router := &Router{gateway: gateway, RetryPolicy: core.DefaultRetryPolicy()}
+	gateway.Router = router
+	return router
+}
+
+func TestDecisionKindString(t *testing.T) {
+	tests := []struct {
+		kind DecisionKind
+		want string
+	}{
+		{DecisionAck, "ack"},
+		{DecisionRetryLater, "retry_later"},
+		{DecisionDeadLetter, "dead_letter"},
+		{DecisionReroute, "reroute"},
+		{DecisionKind(42), "unknown"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.want, test.kind.String())
+	}
+}
+
+func TestSettle(t *testing.T) {
+	tests := []struct {
+		name      string
+		decision  Decision
+		attempts  int
+		failQueue string
+		published []publishedMessage // headers only with the ones checked
+		acked     bool
+		nacked    bool
+		records   int
+	}{
+		{
+			name:     "ack",
+			decision: AckDecision(core.RoutingOutcomes.Delivered, "smpp:client", core.MsgRecord{}),
+			acked:    true,
+			records:  1,
+		},
+		{
+			name:      "retry later",
+			decision:  RetryDecision(core.RetryClasses.CarrierSend, "carrier down"),
+			published: []publishedMessage{{queue: "client", headers: map[string]interface{}{core.AttemptsHeader: int32(1), "x-retry-class": string(core.RetryClasses.CarrierSend)}, delay: 5 * time.Second}},
+			acked:     true,
+		},
+		{
+			name:      "retry later publish failed",
+			decision:  RetryDecision(core.RetryClasses.CarrierSend, "carrier down"),
+			failQueue: "client",
+			nacked:    true,
+		},
+		{
+			name:      "retry later out of attempts",
+			decision:  RetryDecision(core.RetryClasses.CarrierSend, "carrier down"),
+			attempts:  core.DefaultMaxAttempts - 1,
+			published: []publishedMessage{{queue: core.DeadLetterQueue, headers: map[string]interface{}{"x-origin-queue": "client", "x-dead-letter-reason": "carrier down"}}},
+			acked:     true,
+		},
+		{
+			name:      "dead letter",
+			decision:  deadLetterDecision("no carrier found for sender"),
+			published: []publishedMessage{{queue: core.DeadLetterQueue, headers: map[string]interface{}{"x-origin-queue": "client", "x-dead-letter-reason": "no carrier found for sender"}}},
+			acked:     true,
+		},
+		{
+			name:      "dead letter expired",
+			decision:  Decision{Kind: DecisionDeadLetter, Reason: "too late", Expired: true},
+			published: []publishedMessage{{queue: core.DeadLetterQueue, headers: map[string]interface{}{"x-dead-letter-reason": "expired"}}},
+			acked:     true,
+		},
+		{
+			name:      "reroute",
+			decision:  rerouteDecision("carrier", core.RoutingOutcomes.Queued, "carrier"),
+			published: []publishedMessage{{queue: "carrier"}},
+			acked:     true,
+		},
+		{
+			name: "reroute delayed",
+			decision: func() Decision {
+				decision := rerouteDecision("carrier", core.RoutingOutcomes.Queued, "carrier")
+				decision.Delay = time.Minute
+				return decision
+			}(),
+			published: []publishedMessage{{queue: "carrier", delay: time.Minute}},
+			acked:     true,
+		},
+		{
+			name:      "reroute publish failed",
+			decision:  rerouteDecision("carrier", core.RoutingOutcomes.Queued, "carrier"),
+			failQueue: "carrier",
+			published: []publishedMessage{{queue: "client", headers: map[string]interface{}{core.AttemptsHeader: int32(1), "x-retry-class": string(core.RetryClasses.Default)}, delay: 5 * time.Second}},
+			acked:     true,
+		},
+		{
+			name:      "dead letter publish failed",
+			decision:  deadLetterDecision("no carrier found for sender"),
+			failQueue: core.DeadLetterQueue,
+			nacked:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := &recordingQueue{failQueue: test.failQueue}
+			router := newTestRouter(queue)
+
+			acked, nacked := false, false
+			msg := core.MsgQueueItem{
+				LogID:    "test",
+				Type:     core.MsgQueueItemType.SMS,
+				From:     "+15550100001",
+				To:       "+15550100002",
+				Attempts: test.attempts,
+			}
+			delivery := core.NewQueueDelivery("client", nil, nil,
+				func() error {
+					acked = true
+					return nil
+				},
+				func(requeue bool) error {
+					nacked = requeue
+					return nil
+				},
+			)
+			msg.Delivery = &delivery
+			router.settle(context.Background(), msg, "client", test.decision)
+
+			require.Len(t, queue.published, len(test.published))
+			for i, want := range test.published {
+				got := queue.published[i]
+				require.Equal(t, want.queue, got.queue)
+				if want.delay != 0 {
+					// jittered
+					require.InDelta(t, float64(want.delay), float64(got.delay), float64(want.delay)/4)
+				} else {
+					require.Zero(t, got.delay)
+				}
+				for key, value := range want.headers {
+					require.Equal(t, value, got.headers[key], key)
+				}
+			}
+			require.Equal(t, test.acked, acked)
+			require.Equal(t, test.nacked, nacked)
+			require.Len(t, router.gateway.MsgRecordChan, test.records)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package router
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"zultys-smpp-mm4/core"
+)
+
+var (
+	routerLaneCount            int
+	routerLaneBuffer           int
+	routerConversationOrdering bool
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		routerLaneCount = cfg.Int("ROUTER_LANES", 8)
+		routerLaneBuffer = cfg.Int("ROUTER_LANE_BUFFER", 100)
+		routerConversationOrdering = cfg.Getenv("ROUTER_CONVERSATION_ORDERING") != "false"
+	})
+}
+
+// routerLanes spreads messages over a fixed set of worker goroutines. With conversation
+// ordering every message between the same pair of numbers lands on the same lane, so they are
+// routed one after another in the order received while other conversations run in parallel.
+type routerLanes struct {
+	lanes []chan core.MsgQueueItem
+	next  uint32
+}
+
+func newRouterLanes(handler func(core.MsgQueueItem)) *routerLanes {
+	l := &routerLanes{lanes: make([]chan core.MsgQueueItem, routerLaneCount)}
+	for i := range l.lanes {
+		lane := make(chan core.MsgQueueItem, routerLaneBuffer)
+		l.lanes[i] = lane
+		go func() {
+			for msg := range lane {
+				handler(msg)
+			}
+		}()
+	}
+	return l
+}
+
+// dispatch hands the message to its lane, blocking while that lane is full.
+func (l *routerLanes) dispatch(msg core.MsgQueueItem) {
+	var index uint32
+	if routerConversationOrdering {
+		index = conversationHash(msg) % uint32(len(l.lanes))
+	} else {
+		index = atomic.AddUint32(&l.next, 1) % uint32(len(l.lanes))
+	}
+	l.lanes[index] <- msg
+}
+
+// conversationHash hashes the pair of numbers independent of direction, so replies share the lane.
+func conversationHash(msg core.MsgQueueItem) uint32 {
+	a, b := core.NumberKey(msg.From), core.NumberKey(msg.To)
+	if a > b {
+		a, b = b, a
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(a + "|" + b))
+	return hash.Sum32()
+}
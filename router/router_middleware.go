@@ -0,0 +1,49 @@
+package router
+
+import (
+	"sync"
+	"zultys-smpp-mm4/core"
+)
+
+// MessageHandler routes a message taken from the queue of a router, "client" or "carrier", and
+// settles it: it acks, retries or dead-letters the message.
+type MessageHandler func(queue string, msg core.MsgQueueItem)
+
+// Middleware wraps the handler of the client and carrier routers. It can change the message
+// before calling next, or settle the message itself and not call next at all, e.g. with Reject.
+type Middleware func(next MessageHandler) MessageHandler
+
+// routerMiddleware is the middleware chain of the routers.
+type routerMiddleware struct {
+	mu         sync.RWMutex
+	middleware []Middleware
+}
+
+// Use adds middleware to the client and carrier routers. The first middleware added is the
+// outermost one. The chain is built when a router starts, so middleware is added before.
+func (router *Router) Use(middleware ...Middleware) {
+	router.pipeline.mu.Lock()
+	defer router.pipeline.mu.Unlock()
+	router.pipeline.middleware = append(router.pipeline.middleware, middleware...)
+}
+
+// routeThrough returns the handler of the lanes of a router, which passes the messages of the
+// queue through the middleware before route.
+func (router *Router) routeThrough(queue string, route func(msg core.MsgQueueItem)) func(msg core.MsgQueueItem) {
+	handler := MessageHandler(func(_ string, msg core.MsgQueueItem) {
+		route(msg)
+	})
+	router.pipeline.mu.RLock()
+	for i := len(router.pipeline.middleware) - 1; i >= 0; i-- {
+		handler = router.pipeline.middleware[i](handler)
+	}
+	router.pipeline.mu.RUnlock()
+	return func(msg core.MsgQueueItem) {
+		handler(queue, msg)
+	}
+}
+
+// Reject dead-letters a message of the queue that a middleware doesn't pass on.
+func (router *Router) Reject(queue string, msg core.MsgQueueItem, reason string) {
+	router.deadLetter(msg, queue, reason)
+}
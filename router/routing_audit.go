@@ -0,0 +1,175 @@
+package router
+
+import (
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// beginDecision starts the audit record for a message entering a router.
+func (router *Router) beginDecision(msg *core.MsgQueueItem, queue string) {
+	msg.Decision = &core.RoutingDecision{
+		LogID:   msg.LogID,
+		TraceID: msg.TraceID,
+		Queue:   queue,
+		Type:    string(msg.Type),
+		From:    msg.From,
+		To:      msg.To,
+	}
+}
+
+// recordDecision completes the audit record of the message with its outcome and queues it for
+// writing. Only the first outcome of a decision is recorded.
+func (router *Router) recordDecision(msg *core.MsgQueueItem, outcome string, route string, reason string) {
+	decision := msg.Decision
+	if decision == nil || decision.Outcome != "" || !core.RoutingAuditEnabled {
+		return
+	}
+
+	if msg.From != decision.From {
+		decision.RewrittenFrom = msg.From
+	}
+	if msg.To != decision.To {
+		decision.RewrittenTo = msg.To
+	}
+	decision.ServerID = router.gateway.ServerID
+	decision.Outcome = outcome
+	decision.Route = route
+	decision.Reason = reason
+	decision.CreatedAt = time.Now()
+
+	select {
+	case router.auditChan <- decision:
+	default:
+		// never hold up routing for the audit trail
+	}
+}
+
+// RoutingAuditWriter writes routing decisions to Postgres in batches, the RetentionPurger purges
+// records older than ROUTING_AUDIT_RETENTION.
+func (router *Router) RoutingAuditWriter() {
+	var lm = router.gateway.LogManager
+
+	flushTicker := time.NewTicker(time.Second)
+	defer flushTicker.Stop()
+
+	batch := make([]*core.RoutingDecision, 0, 100)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := router.gateway.DB.CreateInBatches(batch, 100).Error; err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Router.Audit",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case decision := <-router.auditChan:
+			batch = append(batch, decision)
+			if len(batch) >= 100 {
+				flush()
+			}
+		case <-flushTicker.C:
+			flush()
+		}
+	}
+}
+
+// RouteExplanation is the result of a routing dry run.
+type RouteExplanation struct {
+	From          string           `json:"from_number"`
+	To            string           `json:"to_number"`
+	Type          string           `json:"type"`
+	SourceClient  string           `json:"source_client,omitempty"`
+	Destination   string           `json:"destination"` // client or carrier
+	Country       string           `json:"destination_country,omitempty"`
+	Client        string           `json:"client,omitempty"`
+	RuleID        uint             `json:"rule_id,omitempty"`
+	RuleName      string           `json:"rule_name,omitempty"`
+	RewrittenFrom string           `json:"rewritten_from,omitempty"`
+	RewrittenTo   string           `json:"rewritten_to,omitempty"`
+	Source        string           `json:"source,omitempty"`
+	Routes        []ExplainedRoute `json:"routes,omitempty"`
+	Result        string           `json:"result"`
+}
+
+// ExplainedRoute is a carrier route in the order it would be tried.
+type ExplainedRoute struct {
+	Route   string `json:"route"`
+	Healthy bool   `json:"healthy"`
+}
+
+// ExplainRoute runs the routing decisions for a hypothetical message without sending anything.
+func (router *Router) ExplainRoute(from, to string, msgType core.MsgQueueType, message string) RouteExplanation {
+	msg := core.MsgQueueItem{
+		From:              from,
+		To:                to,
+		Type:              msgType,
+		Message:           message,
+		ReceivedTimestamp: time.Now(),
+	}
+	fromClient, _ := router.gateway.FindClientByNumber(from)
+	core.NormalizeAddresses(&msg, fromClient)
+
+	explanation := RouteExplanation{From: msg.From, To: msg.To, Type: string(msgType)}
+	if fromClient != nil {
+		explanation.SourceClient = fromClient.Username
+	}
+
+	if toClient, _ := router.gateway.FindClientByNumber(msg.To); toClient != nil {
+		explanation.Destination = "client"
+		explanation.Client = toClient.Username
+		if msgType == core.MsgQueueItemType.MMS {
+			explanation.Result = "delivered to client over MM4"
+		} else {
+			explanation.Result = "delivered to client over SMPP"
+		}
+		return explanation
+	}
+
+	explanation.Destination = "carrier"
+	explanation.Country = core.CountryOf(msg.To)
+	if fromClient == nil {
+		explanation.Result = "dead letter: no client found for sender or destination"
+		return explanation
+	}
+	if reason := core.DestinationBlocked(&msg, fromClient); reason != "" {
+		explanation.Result = "dead letter: " + reason
+		return explanation
+	}
+
+	plan := router.planRoutes(&msg, fromClient)
+	if plan.rule != nil {
+		explanation.RuleID = plan.rule.ID
+		explanation.RuleName = plan.rule.Name
+	}
+	if msg.From != explanation.From {
+		explanation.RewrittenFrom = msg.From
+	}
+	if msg.To != explanation.To {
+		explanation.RewrittenTo = msg.To
+	}
+	explanation.Source = plan.source
+	for _, route := range plan.routes {
+		explanation.Routes = append(explanation.Routes, ExplainedRoute{Route: route.Endpoint, Healthy: route.Healthy()})
+	}
+
+	if len(plan.routes) == 0 {
+		explanation.Result = "dead letter: no route found for sender"
+	} else {
+		names := make([]string, len(plan.routes))
+		for i, route := range plan.routes {
+			names[i] = route.Endpoint
+		}
+		explanation.Result = "sent to carrier, trying " + strings.Join(names, ", ")
+	}
+	return explanation
+}
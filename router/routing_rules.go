@@ -0,0 +1,162 @@
+package router
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// RoutingEngine holds the compiled routing rules, it is safe to swap the rules while routing.
+type RoutingEngine struct {
+	mu    sync.RWMutex
+	rules []*core.RoutingRule
+}
+
+func NewRoutingEngine() *RoutingEngine {
+	return &RoutingEngine{}
+}
+
+// ValidateRoutingRule compiles the rule and checks that its route and client exist and belong to
+// its tenant.
+func (router *Router) ValidateRoutingRule(rule *core.RoutingRule) error {
+	gateway := router.gateway
+	if err := rule.Compile(); err != nil {
+		return err
+	}
+	for _, route := range rule.Routes() {
+		if router.FindCarrierRoute(route) == nil {
+			return fmt.Errorf("unknown carrier route: %s", route)
+		}
+	}
+	if rule.MirrorRoute != "" && !router.FindCarrierRoute(rule.MirrorRoute).mirrorTarget() {
+		return fmt.Errorf("mirror_route must be a simulator carrier without loopback, a real carrier would deliver the copies")
+	}
+	if err := core.ValidateTenantID(rule.TenantID); err != nil {
+		return err
+	}
+	if rule.ClientID != 0 && rule.TenantID != 0 {
+		if client, ok := gateway.ClientByID(rule.ClientID); !ok || client.TenantID != rule.TenantID {
+			return fmt.Errorf("client %d does not belong to tenant %d", rule.ClientID, rule.TenantID)
+		}
+	}
+	for _, route := range rule.Routes() {
+		if err := router.checkTenantCarrier(rule.TenantID, route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match returns the first rule matching the message, or nil.
+func (engine *RoutingEngine) Match(msg *core.MsgQueueItem, client *core.Client) *core.RoutingRule {
+	engine.mu.RLock()
+	defer engine.mu.RUnlock()
+
+	now := time.Now()
+	for _, rule := range engine.rules {
+		if rule.Matches(msg, client, now) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Rules returns the loaded rules in evaluation order.
+func (engine *RoutingEngine) Rules() []*core.RoutingRule {
+	engine.mu.RLock()
+	defer engine.mu.RUnlock()
+	return append([]*core.RoutingRule(nil), engine.rules...)
+}
+
+// SetRules compiles and swaps in a new rule set, invalid rules are skipped and reported.
+func (engine *RoutingEngine) SetRules(rules []core.RoutingRule) []error {
+	var errs []error
+	compiled := make([]*core.RoutingRule, 0, len(rules))
+	for i := range rules {
+		rule := rules[i]
+		if err := rule.Compile(); err != nil {
+			errs = append(errs, fmt.Errorf("routing rule %d (%s): %w", rule.ID, rule.Name, err))
+			continue
+		}
+		compiled = append(compiled, &rule)
+	}
+
+	sort.SliceStable(compiled, func(i, j int) bool {
+		if compiled[i].Position == compiled[j].Position {
+			return compiled[i].ID < compiled[j].ID
+		}
+		return compiled[i].Position < compiled[j].Position
+	})
+
+	engine.mu.Lock()
+	engine.rules = compiled
+	engine.mu.Unlock()
+	return errs
+}
+
+// LoadRoutingRules loads the routing rules from the storage, and the least-cost routes, content
+// rules, auto-replies and tenant quotas from the database.
+func (router *Router) LoadRoutingRules() error {
+	gateway := router.gateway
+	rules, err := gateway.Storage.RoutingRules()
+	if err != nil {
+		return err
+	}
+	if err := router.LoadLCRRoutes(); err != nil {
+		return err
+	}
+	if err := router.loadContentRules(); err != nil {
+		return err
+	}
+	if err := router.loadAutoReplies(); err != nil {
+		return err
+	}
+	if err := router.loadSourceRewrites(); err != nil {
+		return err
+	}
+	if err := gateway.LoadTenants(); err != nil {
+		return err
+	}
+
+	var lm = gateway.LogManager
+	for _, err := range router.Rules.SetRules(rules) {
+		lm.SendLog(lm.BuildLog(
+			"Router.Rules.Load",
+			"RoutingRuleInvalid",
+			logrus.ErrorLevel,
+			nil, err,
+		))
+	}
+	gateway.Reloaded()
+	return nil
+}
+
+// WatchRoutingRules periodically reloads the routing rules so database edits take effect
+// without a restart.
+func (router *Router) WatchRoutingRules() {
+	gateway := router.gateway
+	interval := time.Minute
+	if v := core.Getenv("ROUTING_RULES_RELOAD_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			interval = d
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := router.LoadRoutingRules(); err != nil {
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"Router.Rules.Load",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+	}
+}
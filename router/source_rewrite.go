@@ -0,0 +1,327 @@
+package router
+
+import (
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+	"sort"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// validateSourceRewrite compiles the rewrite and checks its client, route and number.
+func (router *Router) validateSourceRewrite(rewrite *core.SourceRewrite) error {
+	gateway := router.gateway
+	if err := rewrite.Compile(); err != nil {
+		return core.Invalid("%v", err)
+	}
+	client, ok := gateway.ClientByID(rewrite.ClientID)
+	if !ok {
+		return core.Invalid("client %d does not exist", rewrite.ClientID)
+	}
+	if rewrite.Route != "" && router.FindCarrierRoute(rewrite.Route) == nil {
+		return core.Invalid("route %s does not exist", rewrite.Route)
+	}
+	if rewrite.Number != "" {
+		number, err := core.NormalizeNumber(rewrite.Number, client.DefaultCountryCode)
+		if err != nil {
+			return core.Invalid("invalid number %s: %v", rewrite.Number, err)
+		}
+		if owner := gateway.GetClient(number); owner == nil || owner.ID != client.ID {
+			return core.Invalid("number %s does not belong to client %d", number, client.ID)
+		}
+		rewrite.Number = number
+	}
+	return nil
+}
+
+// SourceRewriter holds the compiled source rewrites, it is safe to swap them while routing.
+type SourceRewriter struct {
+	mu       sync.RWMutex
+	rewrites []*core.SourceRewrite
+	clients  map[uint]bool // clients with rewrites, only their replies are unmasked
+}
+
+func NewSourceRewriter() *SourceRewriter {
+	return &SourceRewriter{}
+}
+
+// SetRewrites compiles and swaps in a new set of rewrites, invalid ones are skipped and reported.
+func (rewriter *SourceRewriter) SetRewrites(rewrites []core.SourceRewrite) []error {
+	var errs []error
+	compiled := make([]*core.SourceRewrite, 0, len(rewrites))
+	for i := range rewrites {
+		rewrite := rewrites[i]
+		if err := rewrite.Compile(); err != nil {
+			errs = append(errs, fmt.Errorf("source rewrite %d: %w", rewrite.ID, err))
+			continue
+		}
+		compiled = append(compiled, &rewrite)
+	}
+
+	sort.SliceStable(compiled, func(i, j int) bool {
+		if compiled[i].Position == compiled[j].Position {
+			return compiled[i].ID < compiled[j].ID
+		}
+		return compiled[i].Position < compiled[j].Position
+	})
+
+	clients := make(map[uint]bool)
+	for _, rewrite := range compiled {
+		clients[rewrite.ClientID] = true
+	}
+
+	rewriter.mu.Lock()
+	rewriter.rewrites, rewriter.clients = compiled, clients
+	rewriter.mu.Unlock()
+	return errs
+}
+
+// Rewrite returns the source to send a message of the client from on the route, and the rewrite
+// that changed it, nil when none did.
+func (rewriter *SourceRewriter) Rewrite(source string, client *core.Client, route string) (string, *core.SourceRewrite) {
+	if client == nil {
+		return source, nil
+	}
+	rewriter.mu.RLock()
+	defer rewriter.mu.RUnlock()
+	for _, rewrite := range rewriter.rewrites {
+		if rewrite.Disabled || rewrite.ClientID != client.ID || (rewrite.Route != "" && rewrite.Route != route) {
+			continue
+		}
+		if rewritten, ok := rewrite.Apply(source); ok {
+			return rewritten, rewrite
+		}
+	}
+	return source, nil
+}
+
+// HasClient reports whether the client has source rewrites.
+func (rewriter *SourceRewriter) HasClient(id uint) bool {
+	rewriter.mu.RLock()
+	defer rewriter.mu.RUnlock()
+	return rewriter.clients[id]
+}
+
+// loadSourceRewrites loads the source rewrites from the database.
+func (router *Router) loadSourceRewrites() error {
+	gateway := router.gateway
+	var rewrites []core.SourceRewrite
+	if err := gateway.DB.Order("position asc, id asc").Find(&rewrites).Error; err != nil {
+		return err
+	}
+	var lm = gateway.LogManager
+	for _, err := range router.Rewrites.SetRewrites(rewrites) {
+		lm.SendLog(lm.BuildLog(
+			"Router.SourceRewrite.Load",
+			"GenericError",
+			logrus.ErrorLevel,
+			nil, err,
+		))
+	}
+	return nil
+}
+
+// rewriteSource sets the source of a message to send on the route from the source the client
+// sent it from.
+func (router *Router) rewriteSource(msg *core.MsgQueueItem, source string, client *core.Client, route string) {
+	rewritten, rewrite := router.Rewrites.Rewrite(source, client, route)
+	msg.From = rewritten
+	if rewrite != nil && rewritten != source {
+		var lm = router.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.SourceRewrite",
+			"SourceRewritten",
+			logrus.DebugLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"route":   route,
+				"rewrite": rewrite.ID,
+			}), source,
+		))
+	}
+}
+
+// recordSourceMask remembers the source a message was sent from before it was rewritten, for the
+// replies to it.
+func (router *Router) recordSourceMask(msg *core.MsgQueueItem, source string, client *core.Client, route string) {
+	if msg.From == source || client == nil {
+		return
+	}
+	mask := core.SourceMask{
+		Masked:    core.NumberKey(msg.From),
+		Peer:      core.NumberKey(msg.To),
+		Source:    source,
+		ClientID:  client.ID,
+		Route:     route,
+		UpdatedAt: time.Now(),
+	}
+	err := router.gateway.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "masked"}, {Name: "peer"}},
+		DoUpdates: clause.AssignmentColumns([]string{"source", "client_id", "route", "updated_at"}),
+	}).Create(&mask).Error
+	if err != nil {
+		var lm = router.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Router.SourceRewrite",
+			"GenericError",
+			logrus.ErrorLevel,
+			router.gateway.MsgFields(msg, map[string]interface{}{
+				"client": client.Username,
+			}), err,
+		))
+	}
+}
+
+// unmaskDestination delivers a reply to a rewritten source to the number the conversation was
+// started from. Only numbers of clients with rewrites are looked up, removing the last rewrite of a
+// client ends the unmasking of its conversations.
+func (router *Router) unmaskDestination(msg *core.MsgQueueItem) {
+	if client, _ := router.gateway.FindClientByNumber(msg.To); client == nil || !router.Rewrites.HasClient(client.ID) {
+		return
+	}
+	var masks []core.SourceMask
+	err := router.gateway.DB.Where("masked = ? AND peer = ? AND updated_at > ?", core.NumberKey(msg.To), core.NumberKey(msg.From), time.Now().Add(-core.SourceMaskRetention)).
+		Limit(1).Find(&masks).Error
+	if err != nil || len(masks) == 0 || masks[0].Source == msg.To {
+		return
+	}
+	var lm = router.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Router.SourceRewrite",
+		"SourceUnmasked",
+		logrus.DebugLevel,
+		router.gateway.MsgFields(msg, map[string]interface{}{
+			"masked": msg.To,
+		}), masks[0].Source,
+	))
+	msg.To = masks[0].Source
+}
+
+// SetupSourceRewriteRoutes sets up the management of the source rewrites.
+func SetupSourceRewriteRoutes(app *iris.Application, router *Router) {
+	gateway := router.gateway
+	rewrites := app.Party("/rewrites", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// List source rewrites in evaluation order, optionally of a client
+		rewrites.Get("/", func(ctx iris.Context) {
+			query := gateway.DB.Order("position asc, id asc")
+			if client := ctx.URLParamIntDefault("client_id", 0); client > 0 {
+				query = query.Where("client_id = ?", client)
+			}
+			var list []core.SourceRewrite
+			if err := query.Find(&list).Error; err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			visible := make([]core.SourceRewrite, 0, len(list))
+			for _, rewrite := range list {
+				client, _ := gateway.ClientByID(rewrite.ClientID)
+				if core.KeyAllowsClient(ctx, client) {
+					visible = append(visible, rewrite)
+				}
+			}
+			ctx.JSON(visible)
+		})
+
+		// Add a source rewrite
+		rewrites.Post("/", func(ctx iris.Context) {
+			var rewrite core.SourceRewrite
+			if err := ctx.ReadJSON(&rewrite); err != nil {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid request data"))
+				return
+			}
+			rewrite.ID = 0
+			rewrite.Version = 0
+			if err := router.validateSourceRewrite(&rewrite); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			client, _ := gateway.ClientByID(rewrite.ClientID)
+			if err := gateway.CheckClientScope(ctx, client.Username); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.DB.Create(&rewrite).Error; err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := router.loadSourceRewrites(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(rewrite)
+		})
+
+		// Replace a source rewrite, the body carries the version it was read with
+		rewrites.Put("/{id:uint}", func(ctx iris.Context) {
+			var rewrite core.SourceRewrite
+			if err := ctx.ReadJSON(&rewrite); err != nil {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid request data"))
+				return
+			}
+			rewrite.ID = ctx.Params().GetUintDefault("id", 0)
+			if err := router.validateSourceRewrite(&rewrite); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			client, _ := gateway.ClientByID(rewrite.ClientID)
+			if err := gateway.CheckClientScope(ctx, client.Username); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := core.UpdateVersioned(gateway.DB, &rewrite, rewrite.ID, &rewrite.Version, "*"); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := router.loadSourceRewrites(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(rewrite)
+		})
+
+		// Delete a source rewrite
+		rewrites.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := core.DeleteVersioned(gateway.DB, &core.SourceRewrite{}, ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := router.loadSourceRewrites(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Source rewrite deleted"})
+		})
+
+		// Test the rewrites of a client on a route: {"client_id": 1, "route": "twilio", "from": "+1..."}
+		rewrites.Post("/test", func(ctx iris.Context) {
+			var req struct {
+				ClientID uint   `json:"client_id"`
+				Route    string `json:"route"`
+				From     string `json:"from"`
+			}
+			if err := ctx.ReadJSON(&req); err != nil {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid request data"))
+				return
+			}
+			client, ok := gateway.ClientByID(req.ClientID)
+			if !ok {
+				core.WriteProvisioningError(ctx, core.Invalid("client %d does not exist", req.ClientID))
+				return
+			}
+			if err := gateway.CheckClientScope(ctx, client.Username); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			from, rewrite := router.Rewrites.Rewrite(req.From, client, req.Route)
+			result := iris.Map{"from": from}
+			if rewrite != nil {
+				result["rewrite"] = rewrite.ID
+			}
+			ctx.JSON(result)
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+var storeForwardInterval time.Duration
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		storeForwardInterval = cfg.Duration("STORE_FORWARD_INTERVAL", time.Minute)
+	})
+}
+
+// storeForward tracks which clients have held messages, while a client has any, newer messages
+// for it are held too so they can't overtake the backlog.
+type storeForward struct {
+	mu      sync.Mutex
+	holding map[uint]bool
+}
+
+func newStoreForward() *storeForward {
+	return &storeForward{holding: make(map[uint]bool)}
+}
+
+func (sf *storeForward) isHolding(clientID uint) bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.holding[clientID]
+}
+
+// LoadHeldClients marks the clients that have held messages, e.g. from before a restart. In a
+// cluster other instances hold and flush messages too, so it is reloaded on every sweep.
+func (router *Router) LoadHeldClients() error {
+	gateway := router.gateway
+	sf := router.StoreForward
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	var clientIDs []uint
+	if err := gateway.DB.Model(&core.HeldMessage{}).Distinct("client_id").Pluck("client_id", &clientIDs).Error; err != nil {
+		return err
+	}
+	sf.holding = make(map[uint]bool, len(clientIDs))
+	for _, id := range clientIDs {
+		sf.holding[id] = true
+	}
+	return nil
+}
+
+// holdMessage stores the message for the client and acks the delivery. If it can't be stored
+// the message goes through the normal retry path instead.
+func (router *Router) holdMessage(msg core.MsgQueueItem, client *core.Client, reason string) {
+	var lm = router.gateway.LogManager
+
+	var sealed string
+	payload, err := core.EncodeMsgQueueItem(msg)
+	if err == nil {
+		sealed, err = router.gateway.SealPayload(&msg, payload)
+	}
+	if err != nil {
+		router.deadLetter(msg, "carrier", err.Error())
+		return
+	}
+
+	sf := router.StoreForward
+	sf.mu.Lock()
+	err = router.gateway.DB.Create(&core.HeldMessage{
+		ClientID:  client.ID,
+		MessageID: msg.LogID,
+		From:      msg.From,
+		To:        msg.To,
+		Payload:   sealed,
+	}).Error
+	if err == nil {
+		sf.holding[client.ID] = true
+	}
+	sf.mu.Unlock()
+
+	if err != nil {
+		router.retry(msg, "carrier", core.RetryClasses.ClientOffline, err.Error())
+		return
+	}
+	router.recordDecision(&msg, core.RoutingOutcomes.Held, "held:"+client.Username, reason)
+
+	lm.SendLog(lm.BuildLog(
+		"Router.StoreForward",
+		"StoreForwardHeld",
+		logrus.InfoLevel,
+		router.gateway.MsgFields(&msg, map[string]interface{}{
+			"client": client.Username,
+		}), reason,
+	))
+	if msg.Delivery != nil {
+		_ = msg.Delivery.Ack()
+	}
+}
+
+// flushHeldMessages delivers the held messages of a client in order. It stops at the first
+// failure so the remaining messages keep their order for the next bind.
+func (router *Router) flushHeldMessages(client *core.Client) error {
+	var lm = router.gateway.LogManager
+	sf := router.StoreForward
+
+	for {
+		var batch []core.HeldMessage
+		sf.mu.Lock()
+		err := router.gateway.DB.Where("client_id = ?", client.ID).Order("id asc").Limit(100).Find(&batch).Error
+		if err == nil && len(batch) == 0 {
+			// checked under the lock so a message held right now can't be missed
+			delete(sf.holding, client.ID)
+		}
+		sf.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for _, held := range batch {
+			msg, err := router.gateway.DecodePayload(held.Payload)
+			if err != nil {
+				router.deadLetter(core.MsgQueueItem{LogID: held.MessageID, From: held.From, To: held.To}, "carrier", err.Error())
+				router.gateway.DB.Delete(&core.HeldMessage{}, held.ID)
+				continue
+			}
+			router.beginDecision(&msg, "carrier")
+
+			if msg.Expired(time.Now()) {
+				router.gateway.DB.Delete(&core.HeldMessage{}, held.ID)
+				router.expireMessage(msg, "carrier")
+				continue
+			}
+
+			ctx, cancel := msg.SendContext(context.Background())
+			err = router.SMPP.SendSMPP(ctx, msg, nil)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("failed to deliver held message %s: %w", held.MessageID, err)
+			}
+			router.gateway.DB.Delete(&core.HeldMessage{}, held.ID)
+			router.recordDecision(&msg, core.RoutingOutcomes.Delivered, "smpp:"+client.Username, "released after bind")
+
+			router.gateway.MsgRecordChan <- core.MsgRecord{
+				MsgQueueItem: msg,
+				Carrier:      "inbound",
+				ClientID:     client.ID,
+				Internal:     false,
+			}
+			lm.SendLog(lm.BuildLog(
+				"Router.StoreForward",
+				"StoreForwardFlushed",
+				logrus.InfoLevel,
+				router.gateway.MsgFields(&msg, map[string]interface{}{
+					"client": client.Username,
+				}), time.Since(held.CreatedAt).Round(time.Second),
+			))
+		}
+	}
+}
+
+// StoreForwardDispatcher flushes held messages whenever a client binds, and periodically for
+// every bound client in case a flush was interrupted.
+func (router *Router) StoreForwardDispatcher() {
+	var lm = router.gateway.LogManager
+
+	flush := func(username string) {
+		router.gateway.Mu.RLock()
+		client, ok := router.gateway.Clients[username]
+		router.gateway.Mu.RUnlock()
+		if !ok || !router.StoreForward.isHolding(client.ID) {
+			return
+		}
+		// held until the maintenance ends, the ticker flushes them then
+		if _, inMaintenance := router.Maintenance.active(core.MaintenanceKinds.Client, username); inMaintenance {
+			return
+		}
+		if err := router.flushHeldMessages(client); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Router.StoreForward",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"client": username,
+				}, err,
+			))
+		}
+	}
+
+	// messages held by other instances of a cluster
+	reload := func() {
+		if !core.ClusterEnabled {
+			return
+		}
+		if err := router.LoadHeldClients(); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Router.StoreForward",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+	}
+
+	ticker := time.NewTicker(storeForwardInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case username := <-router.SMPP.Reconnects():
+			reload()
+			flush(username)
+		case <-ticker.C:
+			reload()
+			for _, username := range router.SMPP.BoundClients() {
+				flush(username)
+			}
+		}
+	}
+}
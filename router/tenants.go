@@ -0,0 +1,51 @@
+package router
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"zultys-smpp-mm4/core"
+)
+
+// routeAllowed reports whether the messages of a client may use a carrier route by the name rules
+// and LCR routes refer to it with. Routes that aren't loaded are left to the carrier router.
+func (router *Router) routeAllowed(name string, client *core.Client) bool {
+	route := router.FindCarrierRoute(name)
+	return route == nil || router.gateway.CarrierAllowed(route.Endpoint, client)
+}
+
+// foreignCarrier reports whether a message that arrived on a tenant's carrier account is for a
+// client of another tenant.
+func (router *Router) foreignCarrier(msg *core.MsgQueueItem, client *core.Client) bool {
+	return msg.InboundCarrier != "" && !router.gateway.CarrierAllowed(msg.InboundCarrier, client)
+}
+
+// rejectForeignCarrier dead-letters a message a tenant's carrier account delivered for a client of
+// another tenant, e.g. a number ported away without updating the carrier.
+func (router *Router) rejectForeignCarrier(msg core.MsgQueueItem, client *core.Client) {
+	var lm = router.gateway.LogManager
+	reason := fmt.Sprintf("carrier %s belongs to another tenant than the destination", msg.InboundCarrier)
+	lm.SendLog(lm.BuildLog(
+		"Router.Carrier",
+		"TenantRejected",
+		logrus.ErrorLevel,
+		router.gateway.MsgFields(&msg, map[string]interface{}{
+			"client":  client.Username,
+			"tenant":  client.TenantID,
+			"carrier": msg.InboundCarrier,
+		}), reason,
+	))
+	router.deadLetter(msg, "carrier", reason)
+}
+
+// checkTenantCarrier checks that a resource of the tenant may refer to the carrier route.
+func (router *Router) checkTenantCarrier(tenant uint, name string) error {
+	gateway := router.gateway
+	route := router.FindCarrierRoute(name)
+	if route == nil {
+		return nil
+	}
+	if owner := gateway.CarrierTenant(route.Endpoint); owner != 0 && owner != tenant {
+		return core.Invalid("carrier %s belongs to another tenant", route.Endpoint)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package router
+
+import (
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// throttleTraffic adds a message a client sends towards a carrier to the baselines, the first time
+// it is routed, and reports whether the client is throttled and the message over its limit. The
+// caller retries those later.
+func (router *Router) throttleTraffic(msg *core.MsgQueueItem, client *core.Client) bool {
+	if msg.Attempts == 0 {
+		core.ObserveTraffic(msg, client, time.Now())
+	}
+	return core.TrafficThrottled(client.Username)
+}
@@ -0,0 +1,343 @@
+// Package gateway is the SMS and MMS gateway between Zultys MX systems and the carriers. It wires
+// the packages of the gateway together: the SMPP server of smppserver and the MM4 server of mm4
+// the MX systems connect to, the router of router, the carrier handlers of carriers and the
+// storage of storage, all sharing the core.Gateway of core. cmd/zultys-smpp-mm4 runs it as a
+// service with Run, other programs can embed the parts they need through those packages.
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	_ "net/http/pprof"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/mm4"
+	"zultys-smpp-mm4/router"
+	"zultys-smpp-mm4/smppserver"
+	"zultys-smpp-mm4/storage"
+)
+
+// Run runs the gateway with the settings of cfg, see Load, and the command line arguments after
+// the program name, "migrate ..." runs the migrations instead. It returns once the web server
+// stopped, or after an upgrade once the SMPP sessions were drained.
+func Run(cfg *core.Config, args []string) error {
+	if len(args) > 0 && args[0] == "migrate" {
+		core.Configure(cfg)
+		return storage.RunMigrateCommand(args[1:])
+	}
+
+	gateway, err := NewGateway(cfg)
+	if err != nil {
+		return err
+	}
+
+	if core.Getenv("DEBUG") == "true" {
+		go func() {
+			err := http.ListenAndServe(core.Getenv("PPROF_LISTEN"), nil)
+			if err != nil {
+				return
+			}
+		}()
+	}
+
+	app := iris.New()
+	// init log manager for startup
+
+	queue, err := core.NewMessageQueue(gateway.Gateway)
+	if err != nil {
+		return err
+	}
+	defer func(queue core.MessageQueue) {
+		err := queue.Close()
+		if err != nil {
+			panic(err)
+		}
+	}(queue)
+
+	gateway.Queue = queue
+
+	err = gateway.LoadCarriers()
+	if err != nil {
+		return err
+	}
+
+	if issues := gateway.checkProvisioning(); len(issues) > 0 && provisioningCheckMode == "strict" {
+		return fmt.Errorf("PROVISIONING_CHECK is strict and the provisioning has %d issues, see the log", len(issues))
+	}
+
+	if core.HAEnabled {
+		// a standby only serves the API and the health checks until it holds the primary lease
+		go func() {
+			gateway.awaitPrimary()
+			gateway.Serve()
+		}()
+	} else {
+		gateway.Serve()
+	}
+
+	// Create and register the exporter with Prometheus
+	exporter := NewMetricExporter("gateway_metrics", gateway)
+	prometheus.MustRegister(exporter)
+
+	// Start the Prometheus HTTP server
+	prometheusExporter := PrometheusExporter{
+		Path:   core.Getenv("PROMETHEUS_PATH"),
+		Listen: core.Getenv("PROMETHEUS_LISTEN"),
+	}
+
+	go func() {
+		if err := prometheusExporter.Start(); err != nil && !upgrades.HandedOver() {
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"System.Startup.Prometheus",
+				"GenericError",
+				logrus.ErrorLevel,
+				/*		map[string]interface{}{
+						"module": "Configuration",
+					},*/
+				nil,
+				err,
+			))
+		}
+	}()
+
+	go gateway.ProcessMsgRecords()
+	go storage.MonitorPostgres(gateway.Gateway)
+	go gateway.SecretRefresher()
+	go gateway.ProvisioningListener()
+	go gateway.UpgradeListener()
+	go gateway.StartTracing()
+
+	// Start server
+	webListen := core.Getenv("WEB_LISTEN")
+	if webListen == "" {
+		webListen = "0.0.0.0:3000"
+	}
+
+	app.Use(ProxyIPMiddleware)
+
+	SetupCarrierRoutes(app, gateway)
+	SetupClientRoutes(app, gateway)
+	SetupStatsRoutes(app, gateway)
+	SetupDeadLetterRoutes(app, gateway)
+	SetupRoutingRuleRoutes(app, gateway)
+	SetupScheduleRoutes(app, gateway)
+	SetupRoutingAuditRoutes(app, gateway)
+	SetupPluginRoutes(app, gateway)
+	core.SetupMessageRoutes(app, gateway.Gateway)
+	core.SetupMessageSearchRoutes(app, gateway.Gateway)
+	SetupHealthRoutes(app, gateway)
+	SetupDashboardRoutes(app, gateway)
+	core.SetupCDRRoutes(app, gateway.Gateway)
+	core.SetupUsageRoutes(app, gateway.Gateway)
+	core.SetupEventRoutes(app, gateway.Gateway)
+	core.SetupAlertRoutes(app, gateway.Gateway)
+	core.SetupAPIKeyRoutes(app, gateway.Gateway)
+	core.SetupAuditRoutes(app, gateway.Gateway)
+	core.SetupTenantRoutes(app, gateway.Gateway)
+	core.SetupOptOutRoutes(app, gateway.Gateway)
+	router.SetupContentRoutes(app, gateway.Router)
+	router.SetupAutoReplyRoutes(app, gateway.Router)
+	router.SetupSourceRewriteRoutes(app, gateway.Router)
+	core.SetupTemplateRoutes(app, gateway.Gateway)
+	smppserver.SetupTraceRoutes(app, gateway.Gateway, func() *smppserver.Server { return gateway.SMPPServer })
+	mm4.SetupTraceRoutes(app, gateway.Gateway, func() *mm4.Server { return gateway.MM4Server })
+	core.SetupRetentionRoutes(app, gateway.Gateway)
+	router.SetupMaintenanceRoutes(app, gateway.Router)
+	core.SetupBindLockoutRoutes(app, gateway.Gateway)
+	core.SetupNumberStateRoutes(app, gateway.Gateway)
+	app.Get("/metrics", gateway.BasicAuthMiddleware, iris.FromStd(promhttp.Handler()))
+	app.Get("/health", func(ctx iris.Context) {
+		ctx.StatusCode(200)
+		return
+	})
+
+	// Define the /reload_clients route
+	// app.Get("/reload_clients", basicAuthMiddleware, gateway.webReloadClients)
+
+	// Define the /media/{id} route
+	app.Get("/media/{id}", gateway.webMediaFile)
+	// Define the /inbound/{carrier} route
+	app.Post("/inbound/{carrier}", gateway.webInboundCarrier)
+
+	listener, err := upgrades.Listen("web", webListen)
+	if err == nil {
+		if cert := core.Getenv("WEB_TLS_CERT"); cert != "" {
+			var pair tls.Certificate
+			if pair, err = tls.LoadX509KeyPair(cert, core.Getenv("WEB_TLS_KEY")); err == nil {
+				listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{pair}})
+			}
+		}
+	}
+	if err == nil {
+		err = app.Run(iris.Listener(listener))
+	}
+	if stopErr := gateway.stopped(); stopErr != nil {
+		return stopErr
+	}
+	if err != nil && !upgrades.HandedOver() {
+		var lm = gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"System.Startup.Web",
+			"GenericError",
+			logrus.ErrorLevel,
+			/*		map[string]interface{}{
+					"module": "Configuration",
+				},*/
+			nil,
+			err,
+		))
+	}
+	upgrades.wait()
+	return nil
+}
+
+// Serve starts the SMPP and MM4 listeners, the routers and the background jobs of the gateway.
+// The queue and the carriers have to be set up first.
+func (gateway *Gateway) Serve() {
+	go func() {
+		smppServer, err := smppserver.New(gateway.Gateway)
+		if err != nil {
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"System.Startup.SMPP",
+				"GenericError",
+				logrus.ErrorLevel,
+				/*		map[string]interface{}{
+						"module": "Configuration",
+					},*/
+				nil,
+				err,
+			))
+			panic(err)
+		}
+		gateway.SMPPServer = smppServer
+		gateway.Router.SMPP = smppServer
+		go gateway.Router.StoreForwardDispatcher()
+		go gateway.Router.ExpirySweeper()
+		if core.ClusterEnabled {
+			// after an upgrade the registrations are those of the sessions the previous process drains
+			if !upgrades.upgraded {
+				if err := smppServer.ClearSessions(); err != nil {
+					panic(err)
+				}
+			}
+			go smppServer.SessionHeartbeat()
+			go gateway.Router.InstanceMsgConsumer()
+		}
+
+		smppServer.Start(gateway.Gateway)
+	}()
+
+	go func() {
+		mm4Server := mm4.New(gateway.Gateway, gateway.Router, core.Getenv("MM4_LISTEN"))
+		gateway.MM4Server = mm4Server
+		gateway.Router.MM4 = mm4Server
+
+		err := mm4Server.Start()
+		if err != nil && !upgrades.HandedOver() {
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"System.Startup.MM4",
+				"GenericError",
+				logrus.ErrorLevel,
+				/*		map[string]interface{}{
+						"module": "Configuration",
+					},*/
+				nil,
+				err,
+			))
+			panic(err)
+		}
+	}()
+
+	if grpcListen := core.Getenv("GRPC_LISTEN"); grpcListen != "" {
+		go func() {
+			grpcServer, err := NewGRPCServer(gateway)
+			if err == nil {
+				gateway.GRPCServer = grpcServer
+				err = grpcServer.Start(grpcListen)
+			}
+			if err != nil && !upgrades.HandedOver() {
+				var lm = gateway.LogManager
+				lm.SendLog(lm.BuildLog(
+					"System.Startup.GRPC",
+					"GenericError",
+					logrus.ErrorLevel,
+					nil,
+					err,
+				))
+				panic(err)
+			}
+		}()
+	}
+
+	if broker := core.Getenv("MQTT_BROKER"); broker != "" {
+		bridge, err := NewMQTTBridge(gateway, broker)
+		if err != nil {
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"System.Startup.MQTT",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil,
+				err,
+			))
+			panic(err)
+		}
+		gateway.MQTT = bridge
+		gateway.Router.Inbound = append(gateway.Router.Inbound, bridge.inboundDecision)
+	}
+
+	go gateway.Router.ClientRouter()
+	go gateway.Router.CarrierRouter()
+	go gateway.Router.ClientMsgConsumer()
+	go gateway.Router.CarrierMsgConsumer()
+	go gateway.Router.DeadLetterConsumer()
+	go gateway.Router.WatchRoutingRules()
+	go gateway.ScheduleDispatcher()
+	go gateway.Router.RoutingAuditWriter()
+	go gateway.CDRWriter()
+	go gateway.EnvelopeWriter()
+	go gateway.UsageRollups()
+	go gateway.EventDispatcher()
+	go gateway.StartAlerting(gateway.boundClients)
+	go gateway.AuditWriter()
+	go gateway.RetentionPurger()
+	go gateway.PurgeCarrierMessages()
+	go gateway.Router.ReceiptAggregationSweeper()
+	go gateway.PurgeRateLimits()
+	go gateway.Router.RouteHealthChecker()
+	go gateway.NumberReconciler()
+	go gateway.NumberSyncer()
+	go gateway.Router.MaintenanceSweeper()
+}
+
+// Stop stops the gateway after a fatal error, such as losing the primary lease. The listeners are
+// closed and so are the SMPP sessions, Run returns err and closes the queue, which ends the
+// consumers. Only the first error is kept.
+func (gateway *Gateway) Stop(err error) {
+	gateway.Mu.Lock()
+	if gateway.stopErr != nil {
+		gateway.Mu.Unlock()
+		return
+	}
+	gateway.stopErr = err
+	gateway.Mu.Unlock()
+
+	upgrades.close()
+	if gateway.SMPPServer != nil {
+		gateway.SMPPServer.CloseSessions()
+	}
+}
+
+// stopped returns the error the gateway was stopped with, nil while it runs.
+func (gateway *Gateway) stopped() error {
+	gateway.Mu.RLock()
+	defer gateway.Mu.RUnlock()
+	return gateway.stopErr
+}
@@ -0,0 +1,25 @@
+package smpp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// Dial connects to an SMSC, over TLS when config isn't nil, and starts a session on the
+// connection. The context only bounds connecting.
+func Dial(ctx context.Context, address string, config *tls.Config) (session *Session, err error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	var parent net.Conn
+	if config == nil {
+		parent, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		parent, err = (&tls.Dialer{NetDialer: dialer, Config: config}).DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return
+	}
+	session = NewSession(context.Background(), parent)
+	return
+}
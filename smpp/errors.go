@@ -4,4 +4,5 @@ import "errors"
 
 var (
 	ErrConnectionClosed = errors.New("smpp: connection closed")
+	ErrResponseTimeout  = errors.New("smpp: no response before the deadline")
 )
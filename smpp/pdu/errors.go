@@ -19,8 +19,14 @@ var (
 const (
 	ErrInvalidCommandLength CommandStatus = 0x002
 	ErrInvalidCommandID     CommandStatus = 0x003
+	ErrInvalidBindStatus    CommandStatus = 0x004
+	ErrBindFailed           CommandStatus = 0x00D
+	ErrSystemError          CommandStatus = 0x008
+	ErrMessageQueueFull     CommandStatus = 0x014
 	ErrInvalidDestCount     CommandStatus = 0x033
 	ErrInvalidDestFlag      CommandStatus = 0x040
+	ErrInvalidScheduled     CommandStatus = 0x061
+	ErrInvalidExpiry        CommandStatus = 0x062
 	ErrInvalidTagLength     CommandStatus = 0x0C2
 	ErrUnknownError         CommandStatus = 0x0FF
 )
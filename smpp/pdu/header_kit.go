@@ -24,6 +24,15 @@ func ReadCommandStatus(packet any) CommandStatus {
 	return 0
 }
 
+// IsResponse reports whether the packet answers a request, the command_id of responses has the
+// high bit set.
+func IsResponse(packet any) bool {
+	if h := getHeader(packet); h != nil {
+		return h.CommandID&0x80000000 != 0
+	}
+	return false
+}
+
 func getHeader(packet any) *Header {
 	p := reflect.ValueOf(packet)
 	if p.Kind() == reflect.Ptr {
@@ -48,3 +48,12 @@ func TestSequence(t *testing.T) {
 	_ = ReadCommandStatus(&DeliverSM{})
 	WriteSequence(&DeliverSM{}, 0)
 }
+
+func TestIsResponse(t *testing.T) {
+	decoded, _ := hex.DecodeString("00000010800000050000001400000005")
+	packet, err := Unmarshal(bytes.NewReader(decoded))
+	require.NoError(t, err)
+	require.True(t, IsResponse(packet))
+	require.False(t, IsResponse(&DeliverSM{Header: Header{CommandID: 0x00000005}}))
+	require.False(t, IsResponse(new(struct{})))
+}
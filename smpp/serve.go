@@ -34,12 +34,30 @@ func ServeTCP(address string, handler Handler, config *tls.Config) (err error) {
 	}
 }*/
 
-func ServeTCP(address string, handler Handler, config *tls.Config) (err error) {
-	var list net.Listener
-	if config == nil {
-		list, err = net.Listen("tcp", address)
-	} else {
-		list, err = tls.Listen("tcp", address, config)
+// ServeTCP listens on the address and serves SMPP sessions until the listener fails.
+func ServeTCP(address string, handler Handler, config *tls.Config) error {
+	listener, err := ListenTCP(address, config)
+	if err != nil {
+		return err
+	}
+	return Serve(listener, handler)
+}
+
+// ListenTCP opens the listener ServeTCP serves on, behind the PROXY protocol when
+// HAPROXY_PROXY_PROTOCOL is true.
+func ListenTCP(address string, config *tls.Config) (net.Listener, error) {
+	list, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return WrapListener(list, config)
+}
+
+// WrapListener serves TLS on an open listener when config is set, and the PROXY protocol
+// like ListenTCP.
+func WrapListener(list net.Listener, config *tls.Config) (net.Listener, error) {
+	if config != nil {
+		list = tls.NewListener(list, config)
 	}
 
 	var proxyListener net.Listener
@@ -51,7 +69,7 @@ func ServeTCP(address string, handler Handler, config *tls.Config) (err error) {
 		// Wait for a connection and accept it
 		conn, err := proxyListener.Accept()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		/*defer func(conn net.Conn) {
@@ -74,10 +92,15 @@ func ServeTCP(address string, handler Handler, config *tls.Config) (err error) {
 	} else {
 		proxyListener = list
 	}
-	var parent net.Conn
+	return proxyListener, nil
+}
+
+// Serve accepts connections on the listener and serves each as an SMPP session.
+func Serve(listener net.Listener, handler Handler) error {
 	for {
-		if parent, err = proxyListener.Accept(); err != nil {
-			return
+		parent, err := listener.Accept()
+		if err != nil {
+			return err
 		}
 		go handler.Serve(NewSession(context.Background(), parent))
 	}
@@ -2,10 +2,12 @@ package smpp
 
 import (
 	"context"
+	"errors"
 	"io"
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 	"zultys-smpp-mm4/smpp/pdu"
 )
@@ -13,32 +15,56 @@ import (
 type Session struct {
 	Parent       net.Conn
 	receiveQueue chan any
-	pending      *sync.Map
+	pending      *sync.Map // callbacks of the requests waiting on a response, by sequence
+	sequence     atomic.Int32
 	NextSequence func() int32
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	LastSeen     time.Time
+	done         chan struct{}
+	observer     atomic.Pointer[Observer]
+	late         atomic.Pointer[func(any)]
 }
 
+// Observer sees every PDU read from or written to a session, outbound for written ones.
+type Observer func(packet any, outbound bool)
+
 func NewSession(ctx context.Context, parent net.Conn) (session *Session) {
-	random := rand.New(rand.NewSource(time.Now().Unix()))
 	session = &Session{
 		Parent:       parent,
 		receiveQueue: make(chan any),
 		pending:      new(sync.Map),
-		NextSequence: random.Int31,
 		ReadTimeout:  time.Minute * 15,
 		WriteTimeout: time.Minute * 15,
 		LastSeen:     time.Now(),
+		done:         make(chan struct{}),
 	}
+	// start at a random sequence, so a peer doesn't match responses of an earlier connection
+	session.sequence.Store(rand.New(rand.NewSource(time.Now().UnixNano())).Int31n(0x10000))
+	session.NextSequence = session.allocateSequence
 	go session.watch(ctx)
 	return
 }
 
+// allocateSequence numbers the requests of the session from 1 to 0x7FFFFFFF and around again,
+// skipping the sequences still waiting on a response. It is safe for concurrent submits.
+func (c *Session) allocateSequence() int32 {
+	for {
+		sequence := c.sequence.Add(1) & 0x7FFFFFFF
+		if sequence == 0 {
+			continue
+		}
+		if _, waiting := c.pending.Load(sequence); !waiting {
+			return sequence
+		}
+	}
+}
+
 //goland:noinspection SpellCheckingInspection
 func (c *Session) watch(ctx context.Context) {
 	var err error
 	var packet any
+	defer close(c.done)
 	for {
 		select {
 		case <-ctx.Done():
@@ -48,12 +74,13 @@ func (c *Session) watch(ctx context.Context) {
 		if c.ReadTimeout > 0 {
 			_ = c.Parent.SetReadDeadline(time.Now().Add(c.ReadTimeout))
 		}
-		if packet, err = pdu.Unmarshal(c.Parent); err == io.EOF {
+		if packet, err = pdu.Unmarshal(c.Parent); err == io.EOF || connectionLost(err) {
 			return
 		}
 		if packet == nil {
 			continue
 		}
+		c.observe(packet, false)
 		if status, ok := err.(pdu.CommandStatus); ok {
 			_ = c.Send(&pdu.GenericNACK{
 				Header: pdu.Header{CommandStatus: status, Sequence: pdu.ReadSequence(packet)},
@@ -65,6 +92,10 @@ func (c *Session) watch(ctx context.Context) {
 		if callback, ok := c.pending.Load(pdu.ReadSequence(packet)); ok {
 			callback.(func(any))(packet)
 			c.LastSeen = time.Now()
+		} else if pdu.IsResponse(packet) {
+			// the request was given up on, or never sent by this session
+			c.LastSeen = time.Now()
+			c.lateResponse(packet)
 		} else {
 			c.LastSeen = time.Now()
 			c.receiveQueue <- packet
@@ -75,20 +106,49 @@ func (c *Session) watch(ctx context.Context) {
 func (c *Session) Submit(ctx context.Context, packet pdu.Responsable) (resp any, err error) {
 	sequence := c.NextSequence()
 	pdu.WriteSequence(packet, sequence)
+	// register before sending, a fast response would otherwise land in the receive queue
+	returns := make(chan any, 1)
+	c.pending.Store(sequence, func(resp any) { returns <- resp })
 	if err = c.Send(packet); err != nil {
+		c.pending.Delete(sequence)
 		return
 	}
-	returns := make(chan any, 1)
-	c.pending.Store(sequence, func(resp any) { returns <- resp })
 	select {
 	case <-ctx.Done():
 		err = ErrConnectionClosed
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = ErrResponseTimeout
+		}
 	case resp = <-returns:
 	}
 	c.pending.Delete(sequence)
+	if err != nil {
+		// answered between the deadline and the delete
+		select {
+		case late := <-returns:
+			c.lateResponse(late)
+		default:
+		}
+	}
 	return
 }
 
+// SetLateResponse sets the callback of the responses that arrive after Submit gave up waiting
+// on them, or that answer no pending request. They are dropped without one.
+func (c *Session) SetLateResponse(callback func(packet any)) {
+	if callback == nil {
+		c.late.Store(nil)
+		return
+	}
+	c.late.Store(&callback)
+}
+
+func (c *Session) lateResponse(packet any) {
+	if callback := c.late.Load(); callback != nil {
+		(*callback)(packet)
+	}
+}
+
 func (c *Session) Send(packet any) (err error) {
 	sequence := pdu.ReadSequence(packet)
 	if sequence == 0 || sequence < 0 {
@@ -104,9 +164,27 @@ func (c *Session) Send(packet any) (err error) {
 	if err == io.EOF {
 		err = ErrConnectionClosed
 	}
+	if err == nil {
+		c.observe(packet, true)
+	}
 	return
 }
 
+// SetObserver sets the observer of the PDUs of the session, nil removes it.
+func (c *Session) SetObserver(observer Observer) {
+	if observer == nil {
+		c.observer.Store(nil)
+		return
+	}
+	c.observer.Store(&observer)
+}
+
+func (c *Session) observe(packet any, outbound bool) {
+	if observer := c.observer.Load(); observer != nil {
+		(*observer)(packet, outbound)
+	}
+}
+
 func (c *Session) EnquireLink(ctx context.Context, tick time.Duration, timeout time.Duration) (err error) {
 	ticker := time.NewTicker(tick)
 	defer ticker.Stop()
@@ -135,3 +213,18 @@ func (c *Session) Close(ctx context.Context) (err error) {
 func (c *Session) PDU() <-chan any {
 	return c.receiveQueue
 }
+
+// Done is closed once the connection is gone and no more PDUs are read.
+func (c *Session) Done() <-chan struct{} {
+	return c.done
+}
+
+// connectionLost reports whether a read error means the connection is gone, read timeouts
+// aren't.
+func connectionLost(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && !netErr.Timeout()
+}
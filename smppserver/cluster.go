@@ -0,0 +1,142 @@
+package smppserver
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+// registerSession records that the client is bound to this instance.
+func (srv *Server) registerSession(username, address string, boundAt time.Time) error {
+	if !core.ClusterEnabled {
+		return nil
+	}
+	return srv.gateway.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&core.SessionRegistration{
+		Username: username,
+		ServerID: srv.gateway.ServerID,
+		Address:  address,
+		BoundAt:  boundAt,
+		SeenAt:   time.Now(),
+	}).Error
+}
+
+// unregisterSession removes the registration of a client that unbound from this instance, a
+// registration of another instance is left alone.
+func (srv *Server) unregisterSession(username string) error {
+	if !core.ClusterEnabled {
+		return nil
+	}
+	return srv.gateway.DB.Where("username = ? AND server_id = ?", username, srv.gateway.ServerID).
+		Delete(&core.SessionRegistration{}).Error
+}
+
+// ClearSessions removes the registrations this instance left behind before a restart, its
+// clients bind again.
+func (srv *Server) ClearSessions() error {
+	return srv.gateway.DB.Where("server_id = ?", srv.gateway.ServerID).Delete(&core.SessionRegistration{}).Error
+}
+
+// SessionHeartbeat keeps the registrations of the sessions bound to this instance fresh. A client
+// that bound to another instance since is unbound here, so only one instance delivers to it.
+func (srv *Server) SessionHeartbeat() {
+	var lm = srv.gateway.LogManager
+
+	ticker := time.NewTicker(core.ClusterHeartbeat)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		srv.mu.RLock()
+		bound := make(map[string]time.Time, len(srv.bound))
+		for username, boundAt := range srv.bound {
+			bound[username] = boundAt
+		}
+		srv.mu.RUnlock()
+
+		for username, boundAt := range bound {
+			if err := srv.refreshSession(username, boundAt); err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Server.SMPP.Cluster",
+					"GenericError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"client": username,
+					}, err,
+				))
+			}
+		}
+	}
+}
+
+// refreshSession renews the registration of a local session, or closes the session if the client
+// bound to another instance after it bound here.
+func (srv *Server) refreshSession(username string, boundAt time.Time) error {
+	db := srv.gateway.DB
+	result := db.Model(&core.SessionRegistration{}).
+		Where("username = ? AND server_id = ?", username, srv.gateway.ServerID).
+		Update("seen_at", time.Now())
+	if result.Error != nil || result.RowsAffected == 1 {
+		return result.Error
+	}
+
+	var registration core.SessionRegistration
+	if err := db.Where("username = ?", username).Limit(1).Find(&registration).Error; err != nil {
+		return err
+	}
+	if registration.ServerID == "" || registration.BoundAt.Before(boundAt) || time.Since(registration.SeenAt) > core.ClusterSessionTTL {
+		// lost, e.g. while the database was unavailable at the bind
+		srv.mu.RLock()
+		session, ok := srv.conns[username]
+		srv.mu.RUnlock()
+		address := ""
+		if ok {
+			address, _ = srv.GetClientIP(session)
+		}
+		return srv.registerSession(username, address, boundAt)
+	}
+
+	srv.mu.RLock()
+	session, ok := srv.conns[username]
+	srv.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	var lm = srv.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Server.SMPP.Cluster",
+		"SMPPSessionTakenOver",
+		logrus.WarnLevel,
+		map[string]interface{}{
+			"client": username,
+		}, registration.ServerID,
+	))
+	srv.removeSession(session)
+	return session.Close(context.Background())
+}
+
+// forwardReceipt publishes a delivery receipt for a client bound to another instance to the queue
+// of that instance, it reports whether the receipt was forwarded.
+func (srv *Server) forwardReceipt(msg core.MsgQueueItem, state pdu.MessageState, errCode string) (bool, error) {
+	if !core.ClusterEnabled {
+		return false, nil
+	}
+	client, _, ok := srv.gateway.LookupNumber(msg.From)
+	if !ok {
+		return false, nil
+	}
+	serverID, err := srv.gateway.SessionInstance(client.Username)
+	if err != nil || serverID == "" {
+		return false, err
+	}
+	marshal, err := core.EncodeMsgQueueItem(msg)
+	if err != nil {
+		return false, err
+	}
+	return true, srv.gateway.Queue.PublishWithHeaders(context.Background(), core.InstanceQueueName(serverID), marshal, core.MessageHeaders(msg, map[string]interface{}{
+		core.ForwardKindHeader:  core.ForwardKinds.Receipt,
+		core.ReceiptStateHeader: int32(state),
+		core.ReceiptErrorHeader: errCode,
+	}))
+}
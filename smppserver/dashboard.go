@@ -0,0 +1,82 @@
+package smppserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/smpp"
+)
+
+// Sessions lists the bound SMPP sessions.
+func (srv *Server) Sessions() []SMPPClientInfo {
+	return srv.sessions(true)
+}
+
+// Receivers lists the sessions deliveries go out on, bound as transceivers or receivers.
+func (srv *Server) Receivers() []SMPPClientInfo {
+	return srv.sessions(false)
+}
+
+// sessions lists the bound sessions, with the transmitters or without.
+func (srv *Server) sessions(transmitters bool) []SMPPClientInfo {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	all := []map[string]*smpp.Session{srv.conns}
+	if transmitters {
+		all = append(all, srv.transmitters)
+	}
+	sessions := make([]SMPPClientInfo, 0, len(srv.conns)+len(srv.transmitters))
+	for _, conns := range all {
+		for username, session := range conns {
+			ip, err := srv.GetClientIP(session)
+			if err != nil {
+				ip = "unknown"
+			}
+			sessions = append(sessions, SMPPClientInfo{Username: username, IPAddress: ip, LastSeen: session.LastSeen, BindType: srv.bindTypes[session]})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Username < sessions[j].Username })
+	return sessions
+}
+
+// KickSession closes the SMPP session of a client, the client has to bind again.
+func (srv *Server) KickSession(username string) error {
+	srv.mu.RLock()
+	session, ok := srv.conns[username]
+	if !ok {
+		session, ok = srv.transmitters[username]
+	}
+	srv.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: no SMPP session of client %s", core.ErrNotFound, username)
+	}
+
+	var lm = srv.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Server.SMPP.Kick",
+		"SMPPSessionKicked",
+		logrus.InfoLevel,
+		map[string]interface{}{
+			"client": username,
+		},
+	))
+	srv.removeSession(session)
+	return session.Close(context.Background())
+}
+
+// CloseSessions closes every SMPP session, the clients have to bind again.
+func (srv *Server) CloseSessions() {
+	srv.mu.RLock()
+	sessions := make([]*smpp.Session, 0, len(srv.bindTypes))
+	for session := range srv.bindTypes {
+		sessions = append(sessions, session)
+	}
+	srv.mu.RUnlock()
+
+	for _, session := range sessions {
+		srv.removeSession(session)
+		_ = session.Close(context.Background())
+	}
+}
@@ -0,0 +1,94 @@
+package smppserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// The pacing of the clients without one in their profile, 0 delivers as fast as the client answers.
+var (
+	smppDeliverRate  float64
+	smppDeliverBurst int
+)
+
+var smppDeliverPacing = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "smpp_deliver_pacing_seconds",
+	Help:    "Time deliver_sm segments waited for the pacing of their client",
+	Buckets: prometheus.DefBuckets,
+}, []string{"client"})
+
+func init() {
+	prometheus.MustRegister(smppDeliverPacing)
+	core.OnConfigure(func(cfg *core.Config) {
+		smppDeliverRate = cfg.Float("SMPP_DELIVER_RATE", 0)
+		smppDeliverBurst = cfg.Int("SMPP_DELIVER_BURST", 0)
+	})
+}
+
+// deliverPace is how fast messages are delivered to a client: deliver_sm per second, and how
+// many go out at once before the rate applies, e.g. when a backlog is flushed after the client
+// rebinds. A zero rate is unpaced.
+type deliverPace struct {
+	rate  float64
+	burst int
+}
+
+// profilePace is the pacing of a client profile, SMPP_DELIVER_RATE and SMPP_DELIVER_BURST for
+// the fields it leaves at 0. The burst defaults to one second's worth.
+func profilePace(profile core.ClientProfile) deliverPace {
+	pace := deliverPace{rate: profile.DeliverRate, burst: profile.DeliverBurst}
+	if pace.rate == 0 {
+		pace.rate = smppDeliverRate
+	}
+	if pace.burst == 0 {
+		pace.burst = smppDeliverBurst
+	}
+	if pace.burst == 0 {
+		pace.burst = max(1, int(pace.rate))
+	}
+	return pace
+}
+
+// deliverPacers are the token buckets of the paced clients, by username.
+type deliverPacers struct {
+	mu      sync.Mutex
+	clients map[string]*deliverPacer
+}
+
+type deliverPacer struct {
+	pace    deliverPace
+	limiter *rate.Limiter
+}
+
+func newDeliverPacers() *deliverPacers {
+	return &deliverPacers{clients: make(map[string]*deliverPacer)}
+}
+
+// wait waits until the client may get the next deliver_sm. When that is later than ctx allows the
+// delivery fails with a congestion error right away, so the message goes back to the queue
+// instead of holding a router lane.
+func (pacers *deliverPacers) wait(ctx context.Context, username string, pace deliverPace) error {
+	if pace.rate <= 0 {
+		return nil
+	}
+	pacers.mu.Lock()
+	pacer, ok := pacers.clients[username]
+	// a changed profile starts a new bucket, unchanged ones keep theirs over reloads
+	if !ok || pacer.pace != pace {
+		pacer = &deliverPacer{pace: pace, limiter: rate.NewLimiter(rate.Limit(pace.rate), pace.burst)}
+		pacers.clients[username] = pacer
+	}
+	pacers.mu.Unlock()
+
+	started := time.Now()
+	if err := pacer.limiter.Wait(ctx); err != nil {
+		return core.ClassifyError(core.ErrorClasses.Congestion, "", fmt.Errorf("deliver pacing of %s at %v/s: %w", username, pace.rate, err))
+	}
+	smppDeliverPacing.WithLabelValues(username).Observe(time.Since(started).Seconds())
+	return nil
+}
@@ -0,0 +1,139 @@
+package smppserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/smpp"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+// smppCongestionBackoff is how long deliveries to a session wait after it answered a deliver_sm
+// with ESME_RMSGQFUL or ESME_RTHROTTLED, or stopped answering.
+var smppCongestionBackoff time.Duration
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		smppCongestionBackoff = cfg.Duration("SMPP_CONGESTION_BACKOFF", 5*time.Second)
+	})
+}
+
+// errSessionBackoff fails the deliveries to a session that is backing off.
+var errSessionBackoff = errors.New("session backing off after congestion")
+
+// deliverFlow is what the server learned from the deliver_sm_resp of a session.
+type deliverFlow struct {
+	client   string
+	answered atomic.Bool // the session answered a deliver_sm, so a missing response means congestion
+	mu       sync.Mutex
+	until    time.Time // deliveries wait until then
+}
+
+// deliverFlow returns the flow of a session, created on its first delivery.
+func (srv *Server) deliverFlow(session *smpp.Session, client string) *deliverFlow {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	flow, ok := srv.flows[session]
+	if !ok {
+		flow = &deliverFlow{client: client}
+		srv.flows[session] = flow
+	}
+	return flow
+}
+
+// remaining is how long deliveries to the session still wait, 0 when they don't.
+func (flow *deliverFlow) remaining(now time.Time) time.Duration {
+	flow.mu.Lock()
+	defer flow.mu.Unlock()
+	if now.Before(flow.until) {
+		return flow.until.Sub(now)
+	}
+	return 0
+}
+
+func (flow *deliverFlow) pause(now time.Time) {
+	flow.mu.Lock()
+	flow.until = now.Add(smppCongestionBackoff)
+	flow.mu.Unlock()
+}
+
+// checkBackoff fails a delivery to a session that is backing off with a congestion error, so the
+// router retries it with the congestion backoff instead of adding to the queue of the client.
+func (srv *Server) checkBackoff(session *smpp.Session, client string) error {
+	wait := srv.deliverFlow(session, client).remaining(time.Now())
+	if wait == 0 {
+		return nil
+	}
+	return core.ClassifyError(core.ErrorClasses.Congestion, "", fmt.Errorf("%w for %v", errSessionBackoff, wait.Round(time.Millisecond)))
+}
+
+// submitDeliver sends a deliver_sm and waits up to SMPP_RESPONSE_TIMEOUT for its deliver_sm_resp,
+// it returns the result of smpp_deliveries_total. A non-zero command_status fails the deliver_sm
+// with its error class, a congestion status backs the session off. A session that never answered
+// a deliver_sm is assumed to accept the ones it doesn't answer, once it answered one a missing
+// response counts as congestion.
+func (srv *Server) submitDeliver(parent context.Context, session *smpp.Session, client string, deliverSM *pdu.DeliverSM) (string, error) {
+	flow := srv.deliverFlow(session, client)
+
+	ctx, cancel := context.WithTimeout(parent, core.SMPPResponseTimeout)
+	started := time.Now()
+	resp, err := session.Submit(ctx, deliverSM)
+	cancel()
+	if parent.Err() != nil {
+		return "cancelled", fmt.Errorf("deliver_sm cancelled: %w", parent.Err())
+	}
+	if errors.Is(err, smpp.ErrResponseTimeout) {
+		if !flow.answered.Load() {
+			return "timeout", nil
+		}
+		flow.pause(time.Now())
+		return "timeout", core.ClassifyError(core.ErrorClasses.Congestion, "", fmt.Errorf("no deliver_sm_resp within %v: %w", core.SMPPResponseTimeout, err))
+	}
+	if err != nil {
+		return core.MetricError, fmt.Errorf("error sending deliver_sm: %v", err)
+	}
+	flow.answered.Store(true)
+	core.SMPPDeliverLatency.WithLabelValues(client).Observe(time.Since(started).Seconds())
+
+	if status := pdu.ReadCommandStatus(resp); status != 0 {
+		class := core.SMPPErrorClass(status)
+		if class == core.ErrorClasses.Congestion {
+			flow.pause(time.Now())
+		}
+		return "rejected", core.ClassifyError(class, fmt.Sprintf("0x%08X", uint32(status)), &core.SMPPError{Status: status})
+	}
+	return core.MetricSuccess, nil
+}
+
+// lateResponse logs a response the session sent after the wait for it ended, a late
+// deliver_sm_resp still shows the session answers.
+func (srv *Server) lateResponse(session *smpp.Session, packet any) {
+	srv.mu.RLock()
+	flow := srv.flows[session]
+	srv.mu.RUnlock()
+	client := "unknown"
+	if flow != nil {
+		client = flow.client
+		if _, ok := packet.(*pdu.DeliverSMResp); ok {
+			flow.answered.Store(true)
+			core.SMPPDeliveries.WithLabelValues(client, "late").Inc()
+		}
+	}
+
+	var lm = srv.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Server.SMPP.Response",
+		"SMPPLateResponse",
+		logrus.WarnLevel,
+		map[string]interface{}{
+			"client":         client,
+			"pdu":            fmt.Sprintf("%T", packet),
+			"command_status": fmt.Sprintf("0x%08X", uint32(pdu.ReadCommandStatus(packet))),
+		}, pdu.ReadSequence(packet),
+	))
+}
@@ -0,0 +1,556 @@
+package smppserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/smpp"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+// PDU captures record the decoded PDUs of the SMPP sessions of a client, or of one session, so
+// interop issues can be debugged from the management API without tcpdump on the host. Captures
+// are kept in memory by the instance the sessions are bound to.
+var (
+	smppTraceBuffer      int
+	smppTraceMaxCaptures int
+	smppTraceMaxDuration time.Duration
+	// message texts are replaced in captures unless SMPP_TRACE_REDACT is false or the capture
+	// asks for them, bind passwords always are
+	smppTraceRedact bool
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		smppTraceBuffer = cfg.Int("SMPP_TRACE_BUFFER", 2000)
+		smppTraceMaxCaptures = cfg.Int("SMPP_TRACE_MAX_CAPTURES", 10)
+		smppTraceMaxDuration = cfg.Duration("SMPP_TRACE_MAX_DURATION", time.Hour)
+		smppTraceRedact = cfg.Getenv("SMPP_TRACE_REDACT") != "false"
+	})
+}
+
+// tagMessagePayload is the message_payload TLV, carrying the text of long messages.
+const tagMessagePayload = 0x0424
+
+const redactedPassword = "********"
+
+// PDUCapture is a capture of the PDUs of the sessions of a client, or of the session with the
+// remote address. It records until it is stopped or Until passes, the buffer keeps the last
+// SMPP_TRACE_BUFFER PDUs.
+type PDUCapture struct {
+	ID        uint        `json:"id"`
+	Client    string      `json:"client,omitempty"`
+	Session   string      `json:"session,omitempty"`
+	Redact    bool        `json:"redact"`
+	StartedAt time.Time   `json:"started_at"`
+	Until     time.Time   `json:"until"`
+	Stopped   bool        `json:"stopped"`
+	Captured  int         `json:"captured"`
+	Dropped   int         `json:"dropped"` // captured PDUs pushed out of the buffer
+	PDUs      []TracedPDU `json:"pdus,omitempty"`
+
+	next int // where the next PDU goes once the buffer is full
+}
+
+// TracedPDU is a PDU of a capture, inbound ones were read from the client.
+type TracedPDU struct {
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session"`
+	Client    string    `json:"client,omitempty"`
+	Direction string    `json:"direction"` // "in" or "out"
+	Command   string    `json:"command"`
+	Sequence  int32     `json:"sequence"`
+	Status    string    `json:"status"`
+	Text      string    `json:"text,omitempty"` // decoded short message, unless redacted
+	PDU       any       `json:"pdu"`
+
+	raw           []byte
+	local, remote net.Addr
+}
+
+// pduTracer holds the captures of the SMPP server and the usernames its sessions bound with.
+type pduTracer struct {
+	mu       sync.Mutex
+	captures map[uint]*PDUCapture
+	sessions map[*smpp.Session]string
+	nextID   uint
+	active   atomic.Int32 // captures recording, PDUs aren't looked at without any
+}
+
+func newPDUTracer() *pduTracer {
+	return &pduTracer{
+		captures: make(map[uint]*PDUCapture),
+		sessions: make(map[*smpp.Session]string),
+	}
+}
+
+// observe records a PDU of a session in the captures it belongs to.
+func (t *pduTracer) observe(session *smpp.Session, packet any, outbound bool) {
+	if bind, ok := smppBindRequest(packet); ok && !outbound {
+		t.mu.Lock()
+		t.sessions[session] = bind.systemID
+		t.mu.Unlock()
+	}
+	if t.active.Load() == 0 {
+		return
+	}
+
+	now := time.Now()
+	remote := session.Parent.RemoteAddr()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	username := t.sessions[session]
+	var traced map[bool]TracedPDU // by redaction, built once for the captures wanting it
+	for _, capture := range t.captures {
+		if capture.Stopped {
+			continue
+		}
+		if now.After(capture.Until) {
+			t.stop(capture)
+			continue
+		}
+		if (capture.Client == "" || capture.Client != username) && (capture.Session == "" || capture.Session != remote.String()) {
+			continue
+		}
+		entry, ok := traced[capture.Redact]
+		if !ok {
+			entry = tracePDU(packet, capture.Redact)
+			entry.Time, entry.Session, entry.Client = now, remote.String(), username
+			entry.local, entry.remote = session.Parent.LocalAddr(), remote
+			entry.Direction = "in"
+			if outbound {
+				entry.Direction = "out"
+			}
+			if traced == nil {
+				traced = make(map[bool]TracedPDU)
+			}
+			traced[capture.Redact] = entry
+		}
+		capture.add(entry)
+	}
+}
+
+// forget drops the username of a closed session.
+func (t *pduTracer) forget(session *smpp.Session) {
+	t.mu.Lock()
+	delete(t.sessions, session)
+	t.mu.Unlock()
+}
+
+func (t *pduTracer) stop(capture *PDUCapture) {
+	if !capture.Stopped {
+		capture.Stopped = true
+		t.active.Add(-1)
+	}
+}
+
+func (capture *PDUCapture) add(entry TracedPDU) {
+	capture.Captured++
+	if len(capture.PDUs) < smppTraceBuffer {
+		capture.PDUs = append(capture.PDUs, entry)
+		return
+	}
+	capture.PDUs[capture.next] = entry
+	capture.next = (capture.next + 1) % len(capture.PDUs)
+	capture.Dropped++
+}
+
+// snapshot copies a capture with its PDUs in the order they were seen, or without them.
+func (capture *PDUCapture) snapshot(withPDUs bool) PDUCapture {
+	snapshot := *capture
+	snapshot.PDUs = nil
+	if withPDUs {
+		snapshot.PDUs = append(append([]TracedPDU{}, capture.PDUs[capture.next:]...), capture.PDUs[:capture.next]...)
+	}
+	return snapshot
+}
+
+// start starts a capture, for at most SMPP_TRACE_MAX_DURATION.
+func (t *pduTracer) start(capture PDUCapture, duration time.Duration) (PDUCapture, error) {
+	if capture.Client == "" && capture.Session == "" {
+		return PDUCapture{}, core.Invalid("client or session is required")
+	}
+	if duration <= 0 || duration > smppTraceMaxDuration {
+		duration = smppTraceMaxDuration
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.captures) >= smppTraceMaxCaptures {
+		return PDUCapture{}, core.Invalid("at most %d captures, delete one first", smppTraceMaxCaptures)
+	}
+	t.nextID++
+	capture.ID = t.nextID
+	capture.StartedAt = time.Now()
+	capture.Until = capture.StartedAt.Add(duration)
+	capture.Stopped, capture.Captured, capture.Dropped, capture.PDUs = false, 0, 0, nil
+	t.captures[capture.ID] = &capture
+	t.active.Add(1)
+	return capture.snapshot(false), nil
+}
+
+func (t *pduTracer) list() []PDUCapture {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]PDUCapture, 0, len(t.captures))
+	for _, capture := range t.captures {
+		if !capture.Stopped && time.Now().After(capture.Until) {
+			t.stop(capture)
+		}
+		list = append(list, capture.snapshot(false))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (t *pduTracer) get(id uint) (PDUCapture, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	capture, ok := t.captures[id]
+	if !ok {
+		return PDUCapture{}, core.ErrNotFound
+	}
+	if !capture.Stopped && time.Now().After(capture.Until) {
+		t.stop(capture)
+	}
+	return capture.snapshot(true), nil
+}
+
+// end stops a capture, and deletes it when remove is set.
+func (t *pduTracer) end(id uint, remove bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	capture, ok := t.captures[id]
+	if !ok {
+		return core.ErrNotFound
+	}
+	t.stop(capture)
+	if remove {
+		delete(t.captures, id)
+	}
+	return nil
+}
+
+// tracePDU decodes a PDU for a capture. The PDU is copied: bind passwords are replaced, and with
+// redact the short message and message_payload keep their length with every byte replaced.
+func tracePDU(packet any, redact bool) TracedPDU {
+	entry := TracedPDU{
+		Sequence: pdu.ReadSequence(packet),
+		Status:   pdu.ReadCommandStatus(packet).String(),
+		PDU:      packet,
+	}
+	v := reflect.ValueOf(packet)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return entry
+	}
+	entry.Command = v.Elem().Type().Name()
+	copied := reflect.New(v.Elem().Type())
+	copied.Elem().Set(v.Elem())
+	fields := copied.Elem()
+
+	if password := fields.FieldByName("Password"); password.IsValid() && password.Kind() == reflect.String && password.String() != "" {
+		password.SetString(redactedPassword)
+	}
+	if message, ok := fieldAddr(fields, "Message").(*pdu.ShortMessage); ok {
+		if redact {
+			message.Message = bytes.Repeat([]byte{'*'}, len(message.Message))
+		} else if text, err := message.Parse(); err == nil {
+			entry.Text = text
+		}
+	}
+	if tags, ok := fieldAddr(fields, "Tags").(*pdu.Tags); ok && redact {
+		if payload, ok := (*tags)[tagMessagePayload]; ok {
+			redacted := make(pdu.Tags, len(*tags))
+			for tag, value := range *tags {
+				redacted[tag] = value
+			}
+			redacted[tagMessagePayload] = bytes.Repeat([]byte{'*'}, len(payload))
+			*tags = redacted
+		}
+	}
+	entry.PDU = copied.Interface()
+
+	// the bytes of the PDU for the pcap export, as the copy marshals
+	var raw bytes.Buffer
+	if _, err := pdu.Marshal(&raw, copied.Interface()); err == nil && raw.Len() >= 16 {
+		entry.raw = raw.Bytes()
+		entry.Command = pdu.CommandID(binary.BigEndian.Uint32(entry.raw[4:8])).String()
+	}
+	return entry
+}
+
+func fieldAddr(fields reflect.Value, name string) any {
+	if field := fields.FieldByName(name); field.IsValid() && field.CanAddr() {
+		return field.Addr().Interface()
+	}
+	return nil
+}
+
+// writePcap writes the PDUs of a capture as a pcap file of raw IP packets, one TCP segment per
+// PDU between the addresses of its session, which Wireshark decodes as SMPP.
+func writePcap(w io.Writer, pdus []TracedPDU) error {
+	header := struct {
+		Magic        uint32
+		VersionMajor uint16
+		VersionMinor uint16
+		ThisZone     int32
+		SigFigs      uint32
+		SnapLen      uint32
+		LinkType     uint32
+	}{0xa1b2c3d4, 2, 4, 0, 0, 65535, 101} // LINKTYPE_RAW
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	sequences := make(map[string]uint32) // next TCP sequence number per direction of a session
+	for _, entry := range pdus {
+		if entry.raw == nil {
+			continue
+		}
+		src, dst := entry.remote, entry.local
+		if entry.Direction == "out" {
+			src, dst = dst, src
+		}
+		srcIP, srcPort := tcpEndpoint(src)
+		dstIP, dstPort := tcpEndpoint(dst)
+		forward, backward := src.String()+">"+dst.String(), dst.String()+">"+src.String()
+		seq, ack := sequences[forward], sequences[backward]
+		sequences[forward] = seq + uint32(len(entry.raw))
+
+		packet := ipPacket(srcIP, dstIP, tcpSegment(srcIP, dstIP, srcPort, dstPort, seq, ack, entry.raw))
+		record := struct {
+			Seconds  uint32
+			Micros   uint32
+			Included uint32
+			Original uint32
+		}{uint32(entry.Time.Unix()), uint32(entry.Time.Nanosecond() / 1000), uint32(len(packet)), uint32(len(packet))}
+		if err := binary.Write(w, binary.LittleEndian, record); err != nil {
+			return err
+		}
+		if _, err := w.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tcpEndpoint is the IP and port of an address, 127.0.0.1 when it has none.
+func tcpEndpoint(addr net.Addr) (net.IP, uint16) {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP != nil {
+		return tcp.IP, uint16(tcp.Port)
+	}
+	if addr != nil {
+		if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				var p int
+				fmt.Sscanf(port, "%d", &p)
+				return ip, uint16(p)
+			}
+		}
+	}
+	return net.IPv4(127, 0, 0, 1), 0
+}
+
+// tcpSegment is a PSH/ACK TCP segment carrying the payload.
+func tcpSegment(src, dst net.IP, srcPort, dstPort uint16, seq, ack uint32, payload []byte) []byte {
+	segment := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:2], srcPort)
+	binary.BigEndian.PutUint16(segment[2:4], dstPort)
+	binary.BigEndian.PutUint32(segment[4:8], seq)
+	binary.BigEndian.PutUint32(segment[8:12], ack)
+	segment[12] = 5 << 4 // data offset, no options
+	segment[13] = 0x18   // PSH, ACK
+	binary.BigEndian.PutUint16(segment[14:16], 65535)
+	copy(segment[20:], payload)
+
+	var pseudo []byte
+	if src.To4() != nil && dst.To4() != nil {
+		pseudo = append(append(pseudo, src.To4()...), dst.To4()...)
+		pseudo = append(pseudo, 0, 6, byte(len(segment)>>8), byte(len(segment)))
+	} else {
+		pseudo = append(append(pseudo, src.To16()...), dst.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(segment[16:18], internetChecksum(append(pseudo, segment...)))
+	return segment
+}
+
+// ipPacket wraps a TCP segment in an IPv4 header, or an IPv6 one when an address is IPv6.
+func ipPacket(src, dst net.IP, segment []byte) []byte {
+	if src.To4() != nil && dst.To4() != nil {
+		header := make([]byte, 20)
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:4], uint16(20+len(segment)))
+		header[8] = 64 // TTL
+		header[9] = 6  // TCP
+		copy(header[12:16], src.To4())
+		copy(header[16:20], dst.To4())
+		binary.BigEndian.PutUint16(header[10:12], internetChecksum(header))
+		return append(header, segment...)
+	}
+	header := make([]byte, 40)
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(segment)))
+	header[6] = 6  // TCP
+	header[7] = 64 // hop limit
+	copy(header[8:24], src.To16())
+	copy(header[24:40], dst.To16())
+	return append(header, segment...)
+}
+
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// SetupTraceRoutes sets up the PDU captures of the SMPP sessions, server returns nil until the
+// SMPP server runs.
+func SetupTraceRoutes(app *iris.Application, gateway *core.Gateway, server func() *Server) {
+	traces := app.Party("/admin/traces/smpp", gateway.BasicAuthMiddleware)
+	{
+		tracer := func(ctx iris.Context) *pduTracer {
+			srv := server()
+			if srv == nil {
+				core.WriteProvisioningError(ctx, core.ErrNotFound)
+				return nil
+			}
+			return srv.traces
+		}
+
+		// List the captures, without their PDUs
+		traces.Get("/", func(ctx iris.Context) {
+			if t := tracer(ctx); t != nil {
+				ctx.JSON(t.list())
+			}
+		})
+
+		// Start a capture of a client's sessions or of the session with a remote address
+		traces.Post("/", func(ctx iris.Context) {
+			var req struct {
+				Client   string `json:"client"`
+				Session  string `json:"session"`
+				Duration string `json:"duration"`
+				Redact   *bool  `json:"redact"`
+			}
+			if err := ctx.ReadJSON(&req); err != nil {
+				core.WriteProvisioningError(ctx, core.Invalid("invalid request data"))
+				return
+			}
+			t := tracer(ctx)
+			if t == nil {
+				return
+			}
+			var duration time.Duration
+			if req.Duration != "" {
+				var err error
+				if duration, err = time.ParseDuration(req.Duration); err != nil {
+					core.WriteProvisioningError(ctx, core.Invalid("invalid duration %s", req.Duration))
+					return
+				}
+			}
+			capture := PDUCapture{Client: req.Client, Session: req.Session, Redact: smppTraceRedact}
+			if req.Redact != nil {
+				capture.Redact = *req.Redact
+			}
+			capture, err := t.start(capture, duration)
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			var lm = gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"Server.SMPP.Trace",
+				"SMPPTraceStarted",
+				logrus.InfoLevel,
+				map[string]interface{}{
+					"client":  capture.Client,
+					"session": capture.Session,
+					"redact":  capture.Redact,
+				}, capture.Until.UTC().Format(time.RFC3339),
+			))
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(capture)
+		})
+
+		// A capture with its decoded PDUs
+		traces.Get("/{id:uint}", func(ctx iris.Context) {
+			t := tracer(ctx)
+			if t == nil {
+				return
+			}
+			capture, err := t.get(ctx.Params().GetUintDefault("id", 0))
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(capture)
+		})
+
+		// The PDUs of a capture as a pcap file
+		traces.Get("/{id:uint}/pcap", func(ctx iris.Context) {
+			t := tracer(ctx)
+			if t == nil {
+				return
+			}
+			capture, err := t.get(ctx.Params().GetUintDefault("id", 0))
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			var buf bytes.Buffer
+			if err := writePcap(&buf, capture.PDUs); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.ContentType("application/vnd.tcpdump.pcap")
+			ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=smpp-trace-%d.pcap", capture.ID))
+			ctx.Write(buf.Bytes())
+		})
+
+		// Stop a capture, keeping its PDUs
+		traces.Post("/{id:uint}/stop", func(ctx iris.Context) {
+			t := tracer(ctx)
+			if t == nil {
+				return
+			}
+			if err := t.end(ctx.Params().GetUintDefault("id", 0), false); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Capture stopped"})
+		})
+
+		// Delete a capture
+		traces.Delete("/{id:uint}", func(ctx iris.Context) {
+			t := tracer(ctx)
+			if t == nil {
+				return
+			}
+			if err := t.end(ctx.Params().GetUintDefault("id", 0), true); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Capture deleted"})
+		})
+	}
+}
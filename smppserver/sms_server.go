@@ -0,0 +1,966 @@
+// Package smppserver is the SMPP server the MX systems bind to for SMS.
+package smppserver
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/smpp"
+	"zultys-smpp-mm4/smpp/coding"
+	"zultys-smpp-mm4/smpp/pdu"
+)
+
+type Server struct {
+	TLS              *tls.Config
+	conns            map[string]*smpp.Session // sessions deliveries go out on, bound as transceivers or receivers
+	bound            map[string]time.Time     // when the sessions in conns bound
+	transmitters     map[string]*smpp.Session // sessions bound as transmitters, they only submit
+	bindTypes        map[*smpp.Session]string // how the sessions in conns and transmitters bound, see BindTypes
+	mu               sync.RWMutex
+	reconnectChannel chan string
+	gateway          *core.Gateway
+	dedup            *submitDeduper
+	traces           *pduTracer
+	flows            map[*smpp.Session]*deliverFlow // what the deliver_sm_resp of the sessions showed
+	pacers           *deliverPacers                 // see smpp_pacing.go
+	Status           core.ListenerStatus
+}
+
+func (srv *Server) Start(gateway *core.Gateway) {
+	handler := NewSimpleHandler(srv)
+	smppListen := core.Getenv("SMPP_LISTEN")
+	if smppListen == "" {
+		smppListen = "0.0.0.0:2775"
+	}
+
+	srv.gateway = gateway
+
+	/*srv.smsQueueCollection = gateway.MongoClient.Database(SMSQueueDBName).Collection(SMSQueueCollectionName)
+	 */
+	go func() {
+		tlsConfig, err := smppTLSConfig()
+		var listener net.Listener
+		if err == nil {
+			listener, err = srv.gateway.Listen("smpp", smppListen)
+		}
+		if err == nil {
+			listener, err = smpp.WrapListener(listener, tlsConfig)
+		}
+		if err == nil {
+			srv.Status.Listening(listener.Addr().String())
+			err = smpp.Serve(listener, handler)
+		}
+		if srv.gateway.HandedOver() {
+			// the bound sessions are served until the drain ends
+			return
+		}
+		srv.Status.Failed(err)
+		panic(err)
+	}()
+	// Start processing the SMS queue
+	/*go srv.processReconnectNotifications()*/
+
+	select {}
+}
+
+// smppTLSConfig is the TLS config of the SMPP listener from SMPP_TLS_CERT and SMPP_TLS_KEY, nil
+// listens without TLS.
+func smppTLSConfig() (*tls.Config, error) {
+	cert := core.Getenv("SMPP_TLS_CERT")
+	if cert == "" {
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(cert, core.Getenv("SMPP_TLS_KEY"))
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// New creates the SMPP server of the gateway, Start binds its listener.
+func New(gateway *core.Gateway) (*Server, error) {
+	return &Server{
+		gateway:          gateway,
+		conns:            make(map[string]*smpp.Session),
+		bound:            make(map[string]time.Time),
+		transmitters:     make(map[string]*smpp.Session),
+		bindTypes:        make(map[*smpp.Session]string),
+		flows:            make(map[*smpp.Session]*deliverFlow),
+		reconnectChannel: make(chan string, 100),
+		dedup:            newSubmitDeduper(),
+		traces:           newPDUTracer(),
+		pacers:           newDeliverPacers(),
+	}, nil
+}
+
+type SimpleHandler struct {
+	server *Server
+}
+
+func NewSimpleHandler(server *Server) *SimpleHandler {
+	return &SimpleHandler{server: server}
+}
+
+func (srv *Server) removeSession(session *smpp.Session) {
+	srv.traces.forget(session)
+	srv.mu.Lock()
+	removed := ""
+	bindType := srv.bindTypes[session]
+	delete(srv.bindTypes, session)
+	delete(srv.flows, session)
+	for username, sess := range srv.transmitters {
+		if sess == session {
+			delete(srv.transmitters, username)
+			srv.gateway.EmitEvent(core.EventTypes.ClientUnbound, username, map[string]interface{}{"protocol": "smpp", "bind_type": bindType})
+			break
+		}
+	}
+	for username, sess := range srv.conns {
+		if sess == session {
+			delete(srv.conns, username)
+			delete(srv.bound, username)
+			srv.gateway.EmitEvent(core.EventTypes.ClientUnbound, username, map[string]interface{}{"protocol": "smpp", "bind_type": bindType})
+			removed = username
+			break
+		}
+	}
+	srv.mu.Unlock()
+
+	if removed != "" {
+		if err := srv.unregisterSession(removed); err != nil {
+			var lm = srv.gateway.LogManager
+			lm.SendLog(lm.BuildLog(
+				"Server.SMPP.Cluster",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"client": removed,
+				}, err,
+			))
+		}
+	}
+}
+
+func (h *SimpleHandler) Serve(session *smpp.Session) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		_ = session.Close(ctx)
+		// Remove session from conns map
+		h.server.removeSession(session)
+	}()
+
+	session.SetObserver(func(packet any, outbound bool) {
+		h.server.traces.observe(session, packet, outbound)
+	})
+	session.SetLateResponse(func(packet any) {
+		h.server.lateResponse(session, packet)
+	})
+	go h.enquireLink(session, ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-session.Done():
+			return
+		case packet, ok := <-session.PDU():
+			if !ok {
+				// The receiveQueue is closed; exit the loop
+				return
+			}
+			h.handlePDU(session, packet)
+		}
+	}
+}
+
+func (h *SimpleHandler) enquireLink(session *smpp.Session, ctx context.Context) {
+	tick := time.NewTicker(15 * time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			err := session.EnquireLink(ctx, 15*time.Second, 5*time.Second)
+			if err != nil {
+				var lm = h.server.gateway.LogManager
+				lm.SendLog(lm.BuildLog(
+					"Server.SMPP.EnquireLink",
+					"SMPPEnquireLinkError",
+					logrus.ErrorLevel,
+					nil, err,
+				))
+
+				return
+			}
+		}
+	}
+}
+
+func (srv *Server) findAuthdSession(session *smpp.Session) error {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	if _, ok := srv.bindTypes[session]; ok {
+		return nil
+	}
+	for _, sess := range srv.conns {
+		currentConn, err := srv.GetClientIP(session)
+		loggedConn, err := srv.GetClientIP(sess)
+
+		if err != nil {
+			return fmt.Errorf("error getting client ip for auth check")
+		}
+
+		if currentConn == loggedConn {
+			return nil
+		}
+	}
+	return fmt.Errorf("unable to find matching session")
+}
+
+func (h *SimpleHandler) handlePDU(session *smpp.Session, packet any) {
+	var lm = h.server.gateway.LogManager
+
+	if bind, ok := smppBindRequest(packet); ok {
+		h.handleBind(session, bind)
+		return
+	}
+
+	switch p := packet.(type) {
+	case *pdu.SubmitSM:
+		err := h.server.findAuthdSession(session)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Server.SMPP.HandlePDU",
+				"AuthFailed",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"ip": session.Parent.RemoteAddr().String(),
+				}, err,
+			))
+		}
+		h.handleSubmitSM(session, p)
+	case *pdu.DeliverSM:
+		h.handleDeliverSM(session, p)
+	case *pdu.Unbind:
+		h.handleUnbind(session, p)
+	case pdu.Responsable:
+		err := session.Send(p.Resp())
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Server.SMPP.HandlePDU",
+				"SMPPResponsableError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"ip": session.Parent.RemoteAddr().String(),
+				}, err,
+			))
+		}
+	default:
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandlePDU",
+			"SMPPUnhandledPDU",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"ip": session.Parent.RemoteAddr().String(),
+			}, p,
+		))
+	}
+}
+
+// bindRequest is a bind_transceiver, bind_transmitter or bind_receiver.
+type bindRequest struct {
+	bindType string // see BindTypes
+	systemID string
+	password string
+	resp     func(status pdu.CommandStatus) any
+}
+
+// smppBindRequest returns the bind request of a bind PDU.
+func smppBindRequest(packet any) (bindRequest, bool) {
+	switch p := packet.(type) {
+	case *pdu.BindTransceiver:
+		return bindRequest{core.BindTypes.Transceiver, p.SystemID, p.Password, func(status pdu.CommandStatus) any {
+			resp := p.Resp().(*pdu.BindTransceiverResp)
+			resp.Header.CommandStatus = status
+			return resp
+		}}, true
+	case *pdu.BindTransmitter:
+		return bindRequest{core.BindTypes.Transmitter, p.SystemID, p.Password, func(status pdu.CommandStatus) any {
+			resp := p.Resp().(*pdu.BindTransmitterResp)
+			resp.Header.CommandStatus = status
+			return resp
+		}}, true
+	case *pdu.BindReceiver:
+		return bindRequest{core.BindTypes.Receiver, p.SystemID, p.Password, func(status pdu.CommandStatus) any {
+			resp := p.Resp().(*pdu.BindReceiverResp)
+			resp.Header.CommandStatus = status
+			return resp
+		}}, true
+	}
+	return bindRequest{}, false
+}
+
+func (h *SimpleHandler) handleBind(session *smpp.Session, bindReq bindRequest) {
+	var lm = h.server.gateway.LogManager
+
+	username := bindReq.systemID
+	password := bindReq.password
+
+	ip, err := h.server.GetClientIP(session)
+
+	if username == "" || password == "" {
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleBind",
+			"AuthFailed",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"ip":       ip,
+				"username": username,
+			},
+		))
+		core.SMPPBinds.WithLabelValues("unknown", "auth_failed").Inc()
+		h.server.gateway.BindFailed(username, ip)
+		return
+	}
+
+	// locked out binds aren't checked at all, so guessing goes on only once the lockout is over
+	if lockout, locked := h.server.gateway.BindLocked(username, ip); locked {
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleBind",
+			"BindRefused",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"ip":       ip,
+				"username": username,
+				"kind":     lockout.Kind,
+			}, lockout.LockedUntil.UTC().Format(time.RFC3339),
+		))
+		core.SMPPBinds.WithLabelValues("unknown", "locked_out").Inc()
+		if err := session.Send(bindReq.resp(pdu.ErrBindFailed)); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Server.SMPP.HandleBind",
+				"SMPPPDUError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"ip":       ip,
+					"username": username,
+				}, "BIND REQ",
+			))
+		}
+		return
+	}
+
+	authed, err := h.server.gateway.AuthClient(username, password)
+	if err != nil {
+		// the identity system of the client couldn't answer
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleBind",
+			"AuthFailed",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"ip":       session.Parent.RemoteAddr().String(),
+				"username": username,
+				"error":    err.Error(),
+			},
+		))
+		core.SMPPBinds.WithLabelValues("unknown", "auth_failed").Inc()
+		return
+	}
+
+	if authed {
+		h.server.gateway.ClearBindFailures(username)
+		h.server.gateway.Mu.RLock()
+		client := h.server.gateway.Clients[username]
+		h.server.gateway.Mu.RUnlock()
+		if client != nil && !client.Profile.AllowsBind(bindReq.bindType) {
+			lm.SendLog(lm.BuildLog(
+				"Server.SMPP.HandleBind",
+				"SMPPBindTypeRefused",
+				logrus.WarnLevel,
+				map[string]interface{}{
+					"ip":       session.Parent.RemoteAddr().String(),
+					"username": username,
+				}, core.ErrBindNotAllowed(client, bindReq.bindType),
+			))
+			core.SMPPBinds.WithLabelValues(username, "bind_type_refused").Inc()
+			if err := session.Send(bindReq.resp(pdu.ErrBindFailed)); err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Server.SMPP.HandleBind",
+					"SMPPPDUError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"ip":       session.Parent.RemoteAddr().String(),
+						"username": username,
+					}, "BIND REQ",
+				))
+			}
+			return
+		}
+
+		resp := bindReq.resp(0)
+		err = session.Send(resp)
+		if err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Server.SMPP.HandleBind",
+				"SMPPPDUError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"ip":       session.Parent.RemoteAddr().String(),
+					"username": username,
+				}, "BIND REQ",
+			))
+		}
+
+		core.SMPPBinds.WithLabelValues(username, core.MetricSuccess).Inc()
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleBind",
+			"AuthSuccess",
+			logrus.InfoLevel,
+			map[string]interface{}{
+				"ip":       session.Parent.RemoteAddr().String(),
+				"username": username,
+				"bindType": bindReq.bindType,
+			},
+		))
+
+		h.server.mu.Lock()
+		h.server.bindTypes[session] = bindReq.bindType
+		if bindReq.bindType == core.BindTypes.Transmitter {
+			// a transmitter only submits, deliveries keep going out on the receiving session
+			if oldSession, exists := h.server.transmitters[username]; exists && oldSession != session {
+				_ = oldSession.Close(context.Background())
+			}
+			h.server.transmitters[username] = session
+			h.server.mu.Unlock()
+			h.server.gateway.EmitEvent(core.EventTypes.ClientBound, username, map[string]interface{}{
+				"protocol":  "smpp",
+				"ip":        session.Parent.RemoteAddr().String(),
+				"bind_type": bindReq.bindType,
+			})
+			return
+		}
+		// Close old session if exists
+		if oldSession, exists := h.server.conns[username]; exists {
+			_ = oldSession.Close(context.Background())
+		}
+		boundAt := time.Now()
+		h.server.conns[username] = session
+		h.server.bound[username] = boundAt
+		h.server.mu.Unlock()
+		if err := h.server.registerSession(username, session.Parent.RemoteAddr().String(), boundAt); err != nil {
+			// the heartbeat registers it once the database is back
+			lm.SendLog(lm.BuildLog(
+				"Server.SMPP.Cluster",
+				"GenericError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"username": username,
+				}, err,
+			))
+		}
+		h.server.gateway.EmitEvent(core.EventTypes.ClientBound, username, map[string]interface{}{
+			"protocol":  "smpp",
+			"ip":        session.Parent.RemoteAddr().String(),
+			"bind_type": bindReq.bindType,
+		})
+
+		// flush anything held while the client was away, the periodic sweep catches a full channel
+		select {
+		case h.server.reconnectChannel <- username:
+		default:
+		}
+	} else {
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleBind",
+			"AuthFailed",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"ip":       session.Parent.RemoteAddr().String(),
+				"username": username,
+			},
+		))
+		core.SMPPBinds.WithLabelValues("unknown", "auth_failed").Inc()
+		h.server.gateway.BindFailed(username, ip)
+	}
+}
+
+func (h *SimpleHandler) handleSubmitSM(session *smpp.Session, submitSM *pdu.SubmitSM) {
+	transId := primitive.NewObjectID().Hex()
+	span := core.StartSpan("smpp submit_sm", core.SpanKindServer, "")
+	defer span.End(nil)
+	// Find the client associated with this session
+	var client *core.Client
+	h.server.mu.RLock()
+	bindType := h.server.bindTypes[session]
+	for _, conns := range []map[string]*smpp.Session{h.server.conns, h.server.transmitters} {
+		for username, conn := range conns {
+			if conn == session {
+				client = h.server.gateway.Clients[username]
+				break
+			}
+		}
+	}
+	h.server.mu.RUnlock()
+
+	var lm = h.server.gateway.LogManager
+
+	if bindType == core.BindTypes.Receiver {
+		// a receiver takes deliveries only
+		resp := submitSM.Resp().(*pdu.SubmitSMResp)
+		resp.Header.CommandStatus = pdu.ErrInvalidBindStatus
+		if err := session.Send(resp); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Server.SMPP.HandleSubmitSM",
+				"SMPPPDUError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"ip": session.Parent.RemoteAddr().String(),
+				}, err,
+			))
+		}
+		return
+	}
+
+	if client == nil {
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleSubmitSM",
+			"SMPPFindSession",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"ip": session.Parent.RemoteAddr().String(),
+			},
+		))
+		return
+	}
+
+	/*route := h.server.findRoute(submitSM.SourceAddr.String(), submitSM.DestAddr.String())
+	if route == nil {
+		logf.Level = logrus.WarnLevel
+		logf.Message = fmt.Sprintf("no route found for source %s and destination %s", submitSM.SourceAddr, submitSM.DestAddr)
+		logf.Print()
+		return
+	}*/
+
+	bestCoding := coding.BestSafeCoding(string(submitSM.Message.Message))
+
+	// todo fix this make better??
+	if bestCoding == coding.GSM7BitCoding {
+		bestCoding = coding.ASCIICoding
+	}
+
+	encodedMsg, _ := bestCoding.Encoding().NewDecoder().String(string(submitSM.Message.Message))
+
+	msgQueueItem := core.MsgQueueItem{
+		To:                submitSM.DestAddr.String(),
+		From:              submitSM.SourceAddr.String(),
+		ReceivedTimestamp: time.Now(),
+		Type:              core.MsgQueueItemType.SMS,
+		Encoding:          core.EncodingName(submitSM.Message.DataCoding),
+		Message:           encodedMsg,
+		SkipNumberCheck:   false,
+		LogID:             transId,
+		TraceParent:       span.TraceParent(),
+	}
+	core.NormalizeAddresses(&msgQueueItem, client)
+	span.SetAttributes(map[string]interface{}{
+		"smpp.system_id": client.Username,
+		"smpp.sequence":  int(submitSM.Header.Sequence),
+		"message.log_id": transId,
+	})
+
+	// a resent submit gets the original message_id back instead of being queued twice
+	dedupKey := submitDedupKey(client, &msgQueueItem, submitSM.Header.Sequence)
+	if originalID, duplicate := h.server.dedup.claim(dedupKey, transId); duplicate {
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleSubmitSM",
+			"SMPPDuplicateSubmit",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"logID":    originalID,
+				"systemID": client.Username,
+			}, submitSM.Header.Sequence,
+		))
+		core.SMPPSubmits.WithLabelValues(client.Username, "duplicate").Inc()
+		resp := submitSM.Resp().(*pdu.SubmitSMResp)
+		resp.MessageID = originalID
+		if err := session.Send(resp); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"Server.SMPP.HandleSubmitSM",
+				"SMPPPDUError",
+				logrus.ErrorLevel,
+				map[string]interface{}{
+					"ip": session.Parent.RemoteAddr().String(),
+				}, err,
+			))
+		}
+		return
+	}
+
+	if v, ok := submitSM.Tags[tagAllowInternational]; ok && len(v) > 0 && v[0] != 0 {
+		msgQueueItem.AllowInternational = true
+	}
+	if client.Profile.ReceiptsOnRequest && submitSM.RegisteredDelivery.MCDeliveryReceipt == 0 {
+		msgQueueItem.SkipReceipt = true
+	}
+
+	// the validity period overrides the default time-to-live
+	if submitSM.ValidityPeriod != "" {
+		expiresAt, err := core.ParseSMPPTime(submitSM.ValidityPeriod, msgQueueItem.ReceivedTimestamp)
+		if err != nil {
+			h.rejectSubmit(session, submitSM, client, transId, dedupKey, pdu.ErrInvalidExpiry, err)
+			return
+		}
+		msgQueueItem.ExpiresAt = expiresAt
+	}
+
+	if submitSM.ScheduleDeliveryTime != "" {
+		deliverAt, err := core.ParseSMPPTime(submitSM.ScheduleDeliveryTime, time.Now())
+		if err != nil {
+			h.rejectSubmit(session, submitSM, client, transId, dedupKey, pdu.ErrInvalidScheduled, err)
+			return
+		}
+		if deliverAt.After(time.Now()) {
+			resp := submitSM.Resp().(*pdu.SubmitSMResp)
+			if _, err := h.server.gateway.ScheduleMessage(msgQueueItem, client, deliverAt); err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Server.SMPP.HandleSubmitSM",
+					"GenericError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"logID": transId,
+					}, err,
+				))
+				resp.Header.CommandStatus = pdu.ErrSystemError
+				h.server.dedup.forget(dedupKey)
+				core.SMPPSubmits.WithLabelValues(client.Username, core.MetricError).Inc()
+			} else {
+				resp.MessageID = transId
+				core.SMPPSubmits.WithLabelValues(client.Username, "scheduled").Inc()
+			}
+			if err := session.Send(resp); err != nil {
+				lm.SendLog(lm.BuildLog(
+					"Server.SMPP.HandleSubmitSM",
+					"SMPPPDUError",
+					logrus.ErrorLevel,
+					map[string]interface{}{
+						"ip": session.Parent.RemoteAddr().String(),
+					}, err,
+				))
+			}
+			return
+		}
+	}
+
+	/*logf.AddField("to", msgQueueItem.To)
+	logf.AddField("from", msgQueueItem.From)
+	logf.AddField("systemID", client.Username)*/
+
+	resp := submitSM.Resp().(*pdu.SubmitSMResp)
+
+	// send to message queue, ESME_RMSGQFUL tells the client to back off and resubmit
+	if err := h.server.gateway.Router.OfferClientMessage(msgQueueItem); err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleSubmitSM",
+			"RouterQueueFull",
+			logrus.WarnLevel,
+			map[string]interface{}{
+				"logID":    transId,
+				"systemID": client.Username,
+			}, err,
+		))
+		resp.Header.CommandStatus = pdu.ErrMessageQueueFull
+		h.server.dedup.forget(dedupKey)
+		core.SMPPSubmits.WithLabelValues(client.Username, "queue_full").Inc()
+		span.End(err)
+	} else {
+		resp.MessageID = transId // referenced by delivery receipts
+		core.SMPPSubmits.WithLabelValues(client.Username, "accepted").Inc()
+	}
+
+	err := session.Send(resp)
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleSubmitSM",
+			"SMPPPDUError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"ip": session.Parent.RemoteAddr().String(),
+			}, err,
+		))
+	}
+}
+
+// rejectSubmit answers a submit_sm refused for one of its fields with the status, so the client
+// can resubmit it corrected.
+func (h *SimpleHandler) rejectSubmit(session *smpp.Session, submitSM *pdu.SubmitSM, client *core.Client, logID string, dedupKey string, status pdu.CommandStatus, err error) {
+	var lm = h.server.gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"Server.SMPP.HandleSubmitSM",
+		"SMPPSubmitRejected",
+		logrus.WarnLevel,
+		map[string]interface{}{
+			"logID":    logID,
+			"systemID": client.Username,
+			"status":   status,
+		}, err,
+	))
+	h.server.dedup.forget(dedupKey)
+	core.SMPPSubmits.WithLabelValues(client.Username, "invalid").Inc()
+
+	resp := submitSM.Resp().(*pdu.SubmitSMResp)
+	resp.Header.CommandStatus = status
+	if err := session.Send(resp); err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleSubmitSM",
+			"SMPPPDUError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"ip": session.Parent.RemoteAddr().String(),
+			}, err,
+		))
+	}
+}
+
+func (h *SimpleHandler) handleDeliverSM(session *smpp.Session, deliverSM *pdu.DeliverSM) {
+	resp := deliverSM.Resp()
+	err := session.Send(resp)
+	if err != nil {
+		var lm = h.server.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleDeliverSM",
+			"SMPPPDUError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"ip": session.Parent.RemoteAddr().String(),
+			}, err,
+		))
+	}
+}
+
+func (h *SimpleHandler) handleUnbind(session *smpp.Session, unbind *pdu.Unbind) {
+	var lm = h.server.gateway.LogManager
+
+	lm.SendLog(lm.BuildLog(
+		"Server.SMPP.HandleUnbind",
+		"ReceivedUnbind",
+		logrus.InfoLevel,
+		map[string]interface{}{
+			"ip": session.Parent.RemoteAddr().String(),
+		},
+	))
+
+	resp := unbind.Resp()
+	err := session.Send(resp)
+	if err != nil {
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.HandleUnbind",
+			"SMPPPDUError",
+			logrus.ErrorLevel,
+			map[string]interface{}{
+				"ip": session.Parent.RemoteAddr().String(),
+			}, err,
+		))
+	}
+
+	// Close the session and remove it from conns
+	_ = session.Close(context.Background())
+	h.server.removeSession(session)
+}
+
+// SendSMPP attempts to send an SMPPMessage via the SMPP server.
+// On failure, it notifies via sendFailureChannel and enqueues the message.
+// SendSMPP attempts to send an SMPPMessage via the SMPP server.
+// On failure, it notifies via sendFailureChannel and enqueues the message. Segments not yet
+// answered when ctx is done fail the delivery.
+func (s *Server) SendSMPP(parent context.Context, msg core.MsgQueueItem, session *smpp.Session) (err error) {
+	span := core.StartMsgSpan("smpp deliver_sm", core.SpanKindClient, &msg)
+	attempted := time.Now()
+	defer func() {
+		span.End(err)
+		route := "smpp:" + s.gateway.ClientLabel(msg.To)
+		s.gateway.RecordCDR(&msg, route, false, attempted, err)
+		if err == nil {
+			s.gateway.EmitMessageEvent(core.EventTypes.MessageDelivered, &msg, map[string]interface{}{"route": route})
+		}
+	}()
+
+	// Find the SMPP session associated with the destination number
+	session, err = s.FindSession(msg.To)
+	if err != nil {
+		return fmt.Errorf("error finding SMPP session: %v", err)
+	}
+
+	client := s.gateway.ClientLabel(msg.To)
+	if err := s.checkBackoff(session, client); err != nil {
+		core.SMPPDeliveries.WithLabelValues(client, "backoff").Inc()
+		return err
+	}
+
+	// cleanedContent := ValidateAndCleanSMS(msg.Message)
+
+	var profile core.ClientProfile
+	if destination, _, ok := s.gateway.LookupNumber(msg.To); ok {
+		profile = destination.Profile
+	}
+	text := msg.Message
+	if profile.Transliterate {
+		text = core.TransliterateText(client, "client", text)
+	}
+	segments, bestCoding := core.SMPPSegments(profile.DeliverText(text))
+	segments, dropped := profile.LimitSegments(segments)
+	if dropped > 0 {
+		var lm = s.gateway.LogManager
+		lm.SendLog(lm.BuildLog(
+			"Server.SMPP.SendSMPP",
+			"SMPPSegmentsCut",
+			logrus.WarnLevel,
+			s.gateway.MsgFields(&msg, map[string]interface{}{
+				"client": client,
+			}), dropped,
+		))
+	}
+	span.SetAttributes(map[string]interface{}{"smpp.system_id": client, "smpp.segments": len(segments)})
+	for _, encoded := range segments {
+		// Submit numbers the PDU from the sequences of the session
+		deliverSM := &pdu.DeliverSM{
+			SourceAddr: pdu.Address{TON: 0x01, NPI: 0x01, No: msg.From},
+			DestAddr:   pdu.Address{TON: 0x01, NPI: 0x01, No: msg.To},
+			Message:    pdu.ShortMessage{Message: encoded, DataCoding: bestCoding}, // todo fix encoding
+			RegisteredDelivery: pdu.RegisteredDelivery{
+				MCDeliveryReceipt: 1,
+			},
+		}
+		if err := s.pacers.wait(parent, client, profilePace(profile)); err != nil {
+			core.SMPPDeliveries.WithLabelValues(client, "paced").Inc()
+			return err
+		}
+		result, err := s.submitDeliver(parent, session, client, deliverSM)
+		core.SMPPDeliveries.WithLabelValues(client, result).Inc()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindSession returns the session of the client a destination number belongs to.
+func (srv *Server) FindSession(destination string) (*smpp.Session, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	client, _, ok := srv.gateway.LookupNumber(destination)
+	if !ok {
+		return nil, fmt.Errorf("no session found for destination: %s", destination)
+	}
+	if session, ok := srv.conns[client.Username]; ok {
+		return session, nil
+	}
+	return nil, fmt.Errorf("client found but not connected: %s", client.Username)
+}
+
+// Reconnects delivers the usernames of the clients as they bind.
+func (srv *Server) Reconnects() <-chan string {
+	return srv.reconnectChannel
+}
+
+// BoundClients returns the usernames of the clients bound to this instance.
+func (srv *Server) BoundClients() []string {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	bound := make([]string, 0, len(srv.conns))
+	for username := range srv.conns {
+		bound = append(bound, username)
+	}
+	return bound
+}
+
+func (srv *Server) GetClientIP(session *smpp.Session) (string, error) {
+	if session == nil {
+		return "", fmt.Errorf("session is nil")
+	}
+
+	// todo add proxy support?
+
+	addr := session.Parent.RemoteAddr()
+	if addr == nil {
+		return "", fmt.Errorf("could not retrieve remote address from session")
+	}
+
+	// addr.String() returns "IP:Port"
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", fmt.Errorf("error splitting host and port: %w", err)
+	}
+
+	return host, nil
+}
+
+// tagAllowInternational is the vendor specific TLV a client sets to a non-zero byte to send a
+// message abroad under the flag international policy
+const tagAllowInternational uint16 = 0x1400
+
+// receiptStat is the 7 character stat value of a delivery receipt text.
+func receiptStat(state pdu.MessageState) string {
+	switch state {
+	case core.MessageStateDelivered:
+		return "DELIVRD"
+	case core.MessageStateExpired:
+		return "EXPIRED"
+	case core.MessageStateUndeliverable:
+		return "UNDELIV"
+	case core.MessageStateRejected:
+		return "REJECTD"
+	}
+	return "UNKNOWN"
+}
+
+// SendDeliveryReceipt sends a delivery receipt for a message the client submitted, the id is
+// the message_id returned in the submit_sm_resp and errCode the err value of the receipt text.
+func (srv *Server) SendDeliveryReceipt(msg core.MsgQueueItem, state pdu.MessageState, errCode string) error {
+	session, err := srv.FindSession(msg.From)
+	if err != nil {
+		// the client may be bound to another instance of the cluster
+		if forwarded, forwardErr := srv.forwardReceipt(msg, state, errCode); forwarded || forwardErr != nil {
+			return forwardErr
+		}
+		return fmt.Errorf("error finding SMPP session: %v", err)
+	}
+	return srv.WriteDeliveryReceipt(session, msg, state, errCode)
+}
+
+// WriteDeliveryReceipt sends a delivery receipt on a session of the client.
+func (srv *Server) WriteDeliveryReceipt(session *smpp.Session, msg core.MsgQueueItem, state pdu.MessageState, errCode string) error {
+
+	text := []rune(msg.Message)
+	if len(text) > 20 {
+		text = text[:20]
+	}
+	submitted := msg.ReceivedTimestamp.UTC().Format("0601021504")
+	done := time.Now().UTC().Format("0601021504")
+	receipt := fmt.Sprintf("id:%s sub:001 dlvrd:000 submit date:%s done date:%s stat:%s err:%s text:%s",
+		msg.LogID, submitted, done, receiptStat(state), errCode, string(text))
+
+	deliverSM := &pdu.DeliverSM{
+		SourceAddr: pdu.Address{TON: 0x01, NPI: 0x01, No: msg.To},
+		DestAddr:   pdu.Address{TON: 0x01, NPI: 0x01, No: msg.From},
+		ESMClass:   pdu.ESMClass{MessageType: 0b0001}, // SMSC delivery receipt
+		Message:    pdu.ShortMessage{Message: []byte(receipt), DataCoding: coding.ASCIICoding},
+		Tags: pdu.Tags{
+			core.TagReceiptedMessageID: append([]byte(msg.LogID), 0),
+			core.TagMessageState:       {byte(state)},
+		},
+	}
+	if _, err := srv.submitDeliver(context.Background(), session, srv.gateway.ClientLabel(msg.From), deliverSM); err != nil {
+		return fmt.Errorf("error sending delivery receipt: %w", err)
+	}
+	return nil
+}
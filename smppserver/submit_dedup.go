@@ -0,0 +1,84 @@
+package smppserver
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+var (
+	// submitDedup suppresses the duplicate submit_sm PDUs unless SUBMIT_DEDUP is false.
+	submitDedup bool
+	// submitDedupWindow is how long a submit_sm is remembered after it was last seen.
+	submitDedupWindow time.Duration
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		submitDedup = cfg.Getenv("SUBMIT_DEDUP") != "false"
+		submitDedupWindow = cfg.Duration("SUBMIT_DEDUP_WINDOW", time.Minute)
+	})
+}
+
+// submitDeduper suppresses submit_sm PDUs that a client resends because the submit_sm_resp was
+// late. A resend is answered with the message_id of the original without queueing it again.
+type submitDeduper struct {
+	mu        sync.Mutex
+	seen      map[string]*dedupEntry
+	nextSweep time.Time
+}
+
+type dedupEntry struct {
+	messageID string
+	expires   time.Time
+}
+
+func newSubmitDeduper() *submitDeduper {
+	return &submitDeduper{seen: make(map[string]*dedupEntry)}
+}
+
+// submitDedupKey identifies a submit by client, addresses, content and PDU sequence number.
+func submitDedupKey(client *core.Client, msg *core.MsgQueueItem, sequence int32) string {
+	hash := sha1.New()
+	hash.Write([]byte(fmt.Sprintf("%d|%s|%s|%d|", client.ID, core.NumberKey(msg.From), core.NumberKey(msg.To), sequence)))
+	hash.Write([]byte(msg.Message))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// claim records the message ID for the key, or returns the ID of the original when the key was
+// seen within the window. Every hit slides the window forward.
+func (dedup *submitDeduper) claim(key string, messageID string) (string, bool) {
+	if !submitDedup {
+		return "", false
+	}
+
+	dedup.mu.Lock()
+	defer dedup.mu.Unlock()
+
+	now := time.Now()
+	if now.After(dedup.nextSweep) {
+		for k, entry := range dedup.seen {
+			if now.After(entry.expires) {
+				delete(dedup.seen, k)
+			}
+		}
+		dedup.nextSweep = now.Add(time.Second)
+	}
+
+	if entry, ok := dedup.seen[key]; ok && !now.After(entry.expires) {
+		entry.expires = now.Add(submitDedupWindow)
+		return entry.messageID, true
+	}
+	dedup.seen[key] = &dedupEntry{messageID: messageID, expires: now.Add(submitDedupWindow)}
+	return "", false
+}
+
+// forget drops a claim for a submit that was rejected, so a resend is accepted.
+func (dedup *submitDeduper) forget(key string) {
+	dedup.mu.Lock()
+	delete(dedup.seen, key)
+	dedup.mu.Unlock()
+}
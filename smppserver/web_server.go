@@ -0,0 +1,13 @@
+package smppserver
+
+import (
+	"time"
+)
+
+// SMPPClientInfo contains information about a connected SMPP client.
+type SMPPClientInfo struct {
+	Username  string    `json:"username"`
+	IPAddress string    `json:"ip_address"`
+	LastSeen  time.Time `json:"last_seen"`
+	BindType  string    `json:"bind_type"` // see BindTypes
+}
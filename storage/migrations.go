@@ -0,0 +1,626 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+	"os"
+	"strings"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+// SchemaMigration records a migration applied to the database, gormigrate only writes the ID.
+type SchemaMigration struct {
+	ID        string    `gorm:"primaryKey;size:255" json:"id"`
+	AppliedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"applied_at"`
+}
+
+// schemaMigrations change the schema from the one of the migration before them, each with an ID
+// that sorts after the IDs before it, YYYYMMDDNN_name. A released migration is never changed, a
+// change of a model, a renamed column or a backfill gets a migration of its own appended here.
+// Migrations declare the models they create or change as they are at the time, the current
+// models may have changed since.
+var schemaMigrations = []*gormigrate.Migration{
+	{
+		ID:       "2026101401_baseline",
+		Migrate:  migrateBaseline,
+		Rollback: rollbackBaseline,
+	},
+	{
+		// capability profiles of clients, and whether a receipt was requested for a carrier send
+		ID: "2026101402_client_profile",
+		Migrate: func(tx *gorm.DB) error {
+			type ClientProfile struct {
+				NoMMS             bool
+				NoUCS2            bool
+				MaxSegments       int
+				ReceiptsOnRequest bool
+				BindTypes         string
+				NoGroupMessages   bool
+			}
+			type Client struct {
+				ID      uint          `gorm:"primaryKey"`
+				Profile ClientProfile `gorm:"embedded;embeddedPrefix:profile_"`
+			}
+			type CarrierMessage struct {
+				ID          uint `gorm:"primaryKey"`
+				SkipReceipt bool
+			}
+			return tx.AutoMigrate(&Client{}, &CarrierMessage{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, "clients", "profile_no_mms", "profile_no_ucs2", "profile_max_segments", "profile_receipts_on_request", "profile_bind_types", "profile_no_group_messages"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "carrier_messages", "skip_receipt")
+		},
+	},
+	{
+		// number types of numbers, and routing rules and LCR entries by number type
+		ID: "2026101403_number_types",
+		Migrate: func(tx *gorm.DB) error {
+			type ClientNumber struct {
+				ID   uint `gorm:"primaryKey"`
+				Type string
+			}
+			type RoutingRule struct {
+				ID         uint `gorm:"primaryKey"`
+				SourceType string
+				DestType   string
+			}
+			type LCRRoute struct {
+				ID         uint `gorm:"primaryKey"`
+				NumberType string
+			}
+			return tx.AutoMigrate(&ClientNumber{}, &RoutingRule{}, &LCRRoute{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, "client_numbers", "type"); err != nil {
+				return err
+			}
+			if err := dropColumns(tx, "routing_rules", "source_type", "dest_type"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "lcr_routes", "number_type")
+		},
+	},
+	{
+		// auto-replies of client numbers
+		ID: "2026101404_auto_replies",
+		Migrate: func(tx *gorm.DB) error {
+			type AutoReply struct {
+				ID        uint   `gorm:"primaryKey"`
+				ClientID  uint   `gorm:"index;not null"`
+				Number    string `gorm:"index"`
+				Position  int
+				Disabled  bool
+				Keywords  string
+				TimeStart string
+				TimeEnd   string
+				TimeZone  string
+				Days      string
+				Reply     string `gorm:"not null"`
+				Version   uint   `gorm:"not null;default:1"`
+			}
+			return tx.AutoMigrate(&AutoReply{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("auto_replies")
+		},
+	},
+	{
+		ID: "2026101405_message_templates",
+		Migrate: func(tx *gorm.DB) error {
+			type MessageTemplate struct {
+				ID          uint   `gorm:"primaryKey"`
+				TenantID    uint   `gorm:"uniqueIndex:idx_message_template_name"`
+				Name        string `gorm:"uniqueIndex:idx_message_template_name;not null"`
+				Body        string `gorm:"not null"`
+				Description string
+				Version     uint `gorm:"not null;default:1"`
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}
+			return tx.AutoMigrate(&MessageTemplate{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("message_templates")
+		},
+	},
+	{
+		ID: "2026101406_source_rewrites",
+		Migrate: func(tx *gorm.DB) error {
+			type SourceRewrite struct {
+				ID          uint `gorm:"primaryKey"`
+				ClientID    uint `gorm:"index;not null"`
+				Route       string
+				Position    int
+				Disabled    bool
+				Match       string
+				Replace     string
+				Number      string
+				Description string
+				Version     uint `gorm:"not null;default:1"`
+			}
+			type SourceMask struct {
+				ID        uint   `gorm:"primaryKey"`
+				Masked    string `gorm:"uniqueIndex:idx_source_mask;not null"`
+				Peer      string `gorm:"uniqueIndex:idx_source_mask;not null"`
+				Source    string `gorm:"not null"`
+				ClientID  uint   `gorm:"index"`
+				Route     string
+				UpdatedAt time.Time `gorm:"index"`
+			}
+			return tx.AutoMigrate(&SourceRewrite{}, &SourceMask{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("source_masks", "source_rewrites")
+		},
+	},
+	{
+		// the parts of segmented messages, their receipts are aggregated
+		ID: "2026101407_receipt_aggregation",
+		Migrate: func(tx *gorm.DB) error {
+			type CarrierMessage struct {
+				ID          uint `gorm:"primaryKey"`
+				Segments    int
+				MultipartID string `gorm:"index"`
+				Aggregated  bool
+			}
+			return tx.AutoMigrate(&CarrierMessage{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "carrier_messages", "segments", "multipart_id", "aggregated")
+		},
+	},
+	{
+		// MMS delivered as SMS with signed links to their media, for clients and numbers
+		ID: "2026101408_mms_fallback",
+		Migrate: func(tx *gorm.DB) error {
+			type ClientProfile struct {
+				MMSFallback  bool
+				MediaLinkTTL int
+			}
+			type Client struct {
+				ID      uint          `gorm:"primaryKey"`
+				Profile ClientProfile `gorm:"embedded;embeddedPrefix:profile_"`
+			}
+			type ClientNumber struct {
+				ID          uint `gorm:"primaryKey"`
+				MMSFallback bool
+			}
+			type MediaFile struct {
+				ID     uint `gorm:"primaryKey"`
+				Signed bool
+			}
+			return tx.AutoMigrate(&Client{}, &ClientNumber{}, &MediaFile{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, "clients", "profile_mms_fallback", "profile_media_link_ttl"); err != nil {
+				return err
+			}
+			if err := dropColumns(tx, "client_numbers", "mms_fallback"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "media_files", "signed")
+		},
+	},
+	{
+		// canary and mirror routes of routing rules
+		ID: "2026101409_route_rollout",
+		Migrate: func(tx *gorm.DB) error {
+			type RoutingRule struct {
+				ID            uint `gorm:"primaryKey"`
+				CanaryRoute   string
+				CanaryPercent int
+				MirrorRoute   string
+			}
+			type CarrierMessage struct {
+				ID     uint `gorm:"primaryKey"`
+				Mirror bool
+			}
+			return tx.AutoMigrate(&RoutingRule{}, &CarrierMessage{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, "routing_rules", "canary_route", "canary_percent", "mirror_route"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "carrier_messages", "mirror")
+		},
+	},
+	{
+		// quiet hours of clients and tenants
+		ID: "2026101410_quiet_hours",
+		Migrate: func(tx *gorm.DB) error {
+			type QuietHours struct {
+				Start    string
+				End      string
+				Action   string
+				TimeZone string
+			}
+			type Client struct {
+				ID         uint       `gorm:"primaryKey"`
+				QuietHours QuietHours `gorm:"embedded;embeddedPrefix:quiet_"`
+			}
+			type Tenant struct {
+				ID         uint       `gorm:"primaryKey"`
+				QuietHours QuietHours `gorm:"embedded;embeddedPrefix:quiet_"`
+			}
+			return tx.AutoMigrate(&Client{}, &Tenant{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			for _, table := range []string{"clients", "tenants"} {
+				if err := dropColumns(tx, table, "quiet_start", "quiet_end", "quiet_action", "quiet_time_zone"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// numbers bridged to MQTT
+		ID: "2026101411_mqtt_bridge",
+		Migrate: func(tx *gorm.DB) error {
+			type ClientNumber struct {
+				ID   uint `gorm:"primaryKey"`
+				MQTT bool
+			}
+			return tx.AutoMigrate(&ClientNumber{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "client_numbers", "mqtt")
+		},
+	},
+	{
+		// monthly quotas of clients and tenants and their counters
+		ID: "2026101412_monthly_quotas",
+		Migrate: func(tx *gorm.DB) error {
+			type MonthlyQuota struct {
+				SMSSoft     int
+				SMSHard     int
+				MMSSoft     int
+				MMSHard     int
+				CycleDay    int
+				NotifyEmail string
+			}
+			type Client struct {
+				ID           uint         `gorm:"primaryKey"`
+				MonthlyQuota MonthlyQuota `gorm:"embedded;embeddedPrefix:quota_"`
+			}
+			type Tenant struct {
+				ID           uint         `gorm:"primaryKey"`
+				MonthlyQuota MonthlyQuota `gorm:"embedded;embeddedPrefix:quota_"`
+			}
+			type QuotaCounter struct {
+				ID         uint      `gorm:"primaryKey"`
+				Scope      string    `gorm:"uniqueIndex:idx_quota_counter;not null"`
+				OwnerID    uint      `gorm:"uniqueIndex:idx_quota_counter;not null"`
+				CycleStart time.Time `gorm:"uniqueIndex:idx_quota_counter;not null"`
+				Segments   int
+				MMS        int
+				SMSBlocked bool
+				MMSBlocked bool
+				UpdatedAt  time.Time
+			}
+			return tx.AutoMigrate(&Client{}, &Tenant{}, &QuotaCounter{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			for _, table := range []string{"clients", "tenants"} {
+				if err := dropColumns(tx, table, "quota_sms_soft", "quota_sms_hard", "quota_mms_soft", "quota_mms_hard", "quota_cycle_day", "quota_notify_email"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropTable("quota_counters")
+		},
+	},
+	{
+		// clients and routes in maintenance
+		ID: "2026101413_maintenance",
+		Migrate: func(tx *gorm.DB) error {
+			type Maintenance struct {
+				ID        uint   `gorm:"primaryKey"`
+				Kind      string `gorm:"uniqueIndex:idx_maintenance_target;not null"`
+				Name      string `gorm:"uniqueIndex:idx_maintenance_target;not null"`
+				Reason    string
+				Until     *time.Time
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&Maintenance{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("maintenances")
+		},
+	},
+	{
+		// deliver pacing in the client profiles
+		ID: "2026101414_deliver_pacing",
+		Migrate: func(tx *gorm.DB) error {
+			type ClientProfile struct {
+				DeliverRate  float64
+				DeliverBurst int
+			}
+			type Client struct {
+				ID      uint          `gorm:"primaryKey"`
+				Profile ClientProfile `gorm:"embedded;embeddedPrefix:profile_"`
+			}
+			return tx.AutoMigrate(&Client{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "clients", "profile_deliver_rate", "profile_deliver_burst")
+		},
+	},
+	{
+		// activation states of the numbers, the numbers stored before are active
+		ID: "2026101415_number_states",
+		Migrate: func(tx *gorm.DB) error {
+			type ClientNumber struct {
+				ID          uint `gorm:"primaryKey"`
+				State       string
+				StateReason string
+			}
+			type NumberVerification struct {
+				ID       uint   `gorm:"primaryKey"`
+				NumberID uint   `gorm:"uniqueIndex;not null"`
+				LogID    string `gorm:"index"`
+				To       string
+				Code     string
+				SentAt   time.Time
+			}
+			if err := tx.AutoMigrate(&ClientNumber{}, &NumberVerification{}); err != nil {
+				return err
+			}
+			return tx.Table("client_numbers").Where("state IS NULL OR state = ''").Update("state", "active").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable("number_verifications"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "client_numbers", "state", "state_reason")
+		},
+	},
+	{
+		// transliteration in the client profiles
+		ID: "2026101416_transliteration",
+		Migrate: func(tx *gorm.DB) error {
+			type ClientProfile struct {
+				Transliterate bool
+			}
+			type Client struct {
+				ID      uint          `gorm:"primaryKey"`
+				Profile ClientProfile `gorm:"embedded;embeddedPrefix:profile_"`
+			}
+			return tx.AutoMigrate(&Client{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "clients", "profile_transliterate")
+		},
+	},
+	{
+		// data keys of the message bodies encrypted at rest
+		ID: "2026101417_tenant_data_keys",
+		Migrate: func(tx *gorm.DB) error {
+			type TenantDataKey struct {
+				ID        uint   `gorm:"primaryKey"`
+				TenantID  uint   `gorm:"index;not null"`
+				Wrapped   string `gorm:"not null"`
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&TenantDataKey{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("tenant_data_keys")
+		},
+	},
+	{
+		// authenticators of the SMPP binds of clients
+		ID: "2026101418_client_auth",
+		Migrate: func(tx *gorm.DB) error {
+			type Client struct {
+				ID   uint `gorm:"primaryKey"`
+				Auth string
+			}
+			return tx.AutoMigrate(&Client{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "clients", "auth")
+		},
+	},
+}
+
+// dropColumns drops columns of a table, rollbacks name the columns their migration added.
+func dropColumns(tx *gorm.DB, table string, columns ...string) error {
+	for _, column := range columns {
+		if err := tx.Migrator().DropColumn(table, column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrationLock is the Postgres advisory lock instances hold while migrating, so instances starting
+// together don't migrate at once.
+const migrationLock = 7735134511
+
+// migrationOptions keep the table the migrations were recorded in before gormigrate ran them.
+var migrationOptions = &gormigrate.Options{
+	TableName:                 "schema_migrations",
+	IDColumnName:              "id",
+	IDColumnSize:              255,
+	ValidateUnknownMigrations: true,
+}
+
+// migrate runs fn in a transaction that holds the migration lock, with the migrator and the
+// applied migrations. It refuses a database with migrations this build doesn't know, it was
+// migrated by a newer version and the models of this one may not match it.
+func migrate(db *gorm.DB, fn func(tx *gorm.DB, m *gormigrate.Gormigrate, applied []SchemaMigration) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLock).Error; err != nil {
+			return err
+		}
+		if err := tx.AutoMigrate(&SchemaMigration{}); err != nil {
+			return err
+		}
+		applied, err := appliedMigrations(tx)
+		if err != nil {
+			return err
+		}
+
+		var unknown []string
+		for _, migration := range applied {
+			if findMigration(migration.ID) == nil {
+				unknown = append(unknown, migration.ID)
+			}
+		}
+		if len(unknown) > 0 {
+			return fmt.Errorf("the database schema is newer than this version, it has the unknown migrations %s", strings.Join(unknown, ", "))
+		}
+		// the transaction is the one of the lock, gormigrate doesn't start its own
+		return fn(tx, gormigrate.New(tx, migrationOptions, schemaMigrations), applied)
+	})
+}
+
+// appliedMigrations returns the applied migrations in order.
+func appliedMigrations(tx *gorm.DB) ([]SchemaMigration, error) {
+	var applied []SchemaMigration
+	err := tx.Order("id").Find(&applied).Error
+	return applied, err
+}
+
+func findMigration(id string) *gormigrate.Migration {
+	for _, migration := range schemaMigrations {
+		if migration.ID == id {
+			return migration
+		}
+	}
+	return nil
+}
+
+// migrationChanges returns the IDs of the migrations applied or rolled back by fn, in the order
+// they ran.
+func migrationChanges(tx *gorm.DB, before []SchemaMigration, fn func() error) ([]string, error) {
+	if err := fn(); err != nil {
+		return nil, err
+	}
+	after, err := appliedMigrations(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	was := make(map[string]bool, len(before))
+	for _, migration := range before {
+		was[migration.ID] = true
+	}
+	is := make(map[string]bool, len(after))
+	for _, migration := range after {
+		is[migration.ID] = true
+	}
+	var changed []string
+	for _, migration := range schemaMigrations {
+		if was[migration.ID] != is[migration.ID] {
+			changed = append(changed, migration.ID)
+		}
+	}
+	if len(after) < len(before) {
+		// rolled back newest first
+		for i, j := 0, len(changed)-1; i < j; i, j = i+1, j-1 {
+			changed[i], changed[j] = changed[j], changed[i]
+		}
+	}
+	return changed, nil
+}
+
+// MigrateUp applies the migrations not applied yet in order, all of them or none. It returns the
+// IDs of the applied ones.
+func MigrateUp(db *gorm.DB) ([]string, error) {
+	var ran []string
+	err := migrate(db, func(tx *gorm.DB, m *gormigrate.Gormigrate, applied []SchemaMigration) error {
+		var err error
+		ran, err = migrationChanges(tx, applied, m.Migrate)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ran, nil
+}
+
+// migrateDown rolls back the migrations applied after the target, newest first, or the last one
+// when the target is empty. It returns the IDs of the rolled back ones.
+func migrateDown(db *gorm.DB, target string) ([]string, error) {
+	if target != "" && findMigration(target) == nil {
+		return nil, fmt.Errorf("unknown migration %s", target)
+	}
+
+	var ran []string
+	err := migrate(db, func(tx *gorm.DB, m *gormigrate.Gormigrate, applied []SchemaMigration) error {
+		rollback := func() error {
+			if err := m.RollbackLast(); !errors.Is(err, gormigrate.ErrNoRunMigration) {
+				return err
+			}
+			return nil
+		}
+		if target != "" {
+			rollback = func() error { return m.RollbackTo(target) }
+		}
+		var err error
+		ran, err = migrationChanges(tx, applied, rollback)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ran, nil
+}
+
+// RunMigrateCommand runs `migrate status|up|down [ID]` against the database of the configuration,
+// for upgrades that migrate before the instances start and for rolling a release back.
+func RunMigrateCommand(args []string) error {
+	if core.StorageBackend != "postgres" {
+		return fmt.Errorf("migrate needs STORAGE_BACKEND postgres")
+	}
+	db, err := openPostgres()
+	if err != nil {
+		return err
+	}
+
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "status":
+		return migrate(db, func(_ *gorm.DB, _ *gormigrate.Gormigrate, applied []SchemaMigration) error {
+			at := make(map[string]time.Time, len(applied))
+			for _, migration := range applied {
+				at[migration.ID] = migration.AppliedAt
+			}
+			for _, migration := range schemaMigrations {
+				status := "pending"
+				if appliedAt, ok := at[migration.ID]; ok {
+					status = "applied " + appliedAt.Format(time.RFC3339)
+				}
+				fmt.Fprintf(os.Stdout, "%s\t%s\n", migration.ID, status)
+			}
+			return nil
+		})
+	case "up":
+		ran, err := MigrateUp(db)
+		for _, id := range ran {
+			fmt.Fprintf(os.Stdout, "applied %s\n", id)
+		}
+		return err
+	case "down":
+		target := ""
+		if len(args) > 1 {
+			target = args[1]
+		}
+		ran, err := migrateDown(db, target)
+		for _, id := range ran {
+			fmt.Fprintf(os.Stdout, "rolled back %s\n", id)
+		}
+		return err
+	}
+	return fmt.Errorf("usage: migrate status|up|down [ID]")
+}
@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// migrateBaseline creates the schema earlier versions kept up to date with AutoMigrate on every
+// start, a database created by them is left as it is.
+func migrateBaseline(tx *gorm.DB) error {
+	return tx.AutoMigrate(baselineModels()...)
+}
+
+// rollbackBaseline drops the tables of the baseline in the reverse order of their creation, their
+// data goes with them.
+func rollbackBaseline(tx *gorm.DB) error {
+	models := baselineModels()
+	for i := len(models) - 1; i >= 0; i-- {
+		if err := tx.Migrator().DropTable(models[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// baselineModels are the models of the baseline. The models are copied as they were then, so
+// the migration creates the same tables whatever the models became since.
+func baselineModels() []interface{} {
+	type ClientNumber struct {
+		ID                  uint   `gorm:"primaryKey"`
+		ClientID            uint   `gorm:"index;not null"`
+		Number              string `gorm:"unique;not null"`
+		Carrier             string
+		WebHook             string
+		MessagingServiceSID string
+		MessagingProfileID  string
+		ApplicationID       string
+		CampaignID          string
+		Version             uint `gorm:"not null;default:1"`
+	}
+	type DialPlanRule struct {
+		ID       uint `gorm:"primaryKey"`
+		ClientID uint `gorm:"index;not null"`
+		Position int
+		Pattern  string `gorm:"not null"`
+		Replace  string
+	}
+	type Client struct {
+		ID                  uint   `gorm:"primaryKey"`
+		TenantID            uint   `gorm:"index"`
+		Username            string `gorm:"unique;not null"`
+		Password            string `gorm:"not null"`
+		Address             string
+		Name                string
+		LogPrivacy          bool
+		Numbers             []ClientNumber `gorm:"foreignKey:ClientID"`
+		DefaultCountryCode  string
+		DialPlan            []DialPlanRule `gorm:"foreignKey:ClientID"`
+		StopReply           string
+		StartReply          string
+		HelpReply           string
+		InternationalPolicy string
+		AllowedCountries    string
+		Version             uint `gorm:"not null;default:1"`
+	}
+	type Carrier struct {
+		ID       uint   `gorm:"primaryKey"`
+		Name     string `gorm:"unique;not null"`
+		Type     string `gorm:"not null"`
+		Username string `gorm:"not null"`
+		Password string `gorm:"not null"`
+		UUID     string `gorm:"unique;not null"`
+		TenantID uint   `gorm:"index"`
+		Config   string `gorm:"type:text"`
+		Version  uint   `gorm:"not null;default:1"`
+	}
+	type MediaFile struct {
+		ID          uint `gorm:"primaryKey"`
+		FileName    string
+		ContentType string
+		Base64Data  string
+		LogID       string `gorm:"index"`
+		UploadAt    time.Time
+		ExpiresAt   time.Time `gorm:"index"`
+	}
+	type MsgRecordDBItem struct {
+		ID                uint `gorm:"primaryKey"`
+		ClientID          uint `gorm:"index;not null"`
+		To                string
+		From              string
+		ReceivedTimestamp time.Time
+		Type              string
+		MsgData           string
+		Carrier           string
+		Internal          bool
+		LogID             string
+		ServerID          string
+	}
+	type DeadLetter struct {
+		ID        uint   `gorm:"primaryKey"`
+		LogID     string `gorm:"index"`
+		Queue     string
+		Type      string
+		From      string
+		To        string
+		Reason    string
+		Attempts  int
+		Payload   string
+		ServerID  string
+		CreatedAt time.Time
+		UpdatedAt time.Time
+	}
+	type RoutingRule struct {
+		ID            uint `gorm:"primaryKey"`
+		Name          string
+		Position      int `gorm:"index"`
+		Disabled      bool
+		TenantID      uint `gorm:"index"`
+		ClientID      uint
+		MsgType       string
+		SourcePrefix  string
+		SourceRegex   string
+		DestPrefix    string
+		DestRegex     string
+		TimeStart     string
+		TimeEnd       string
+		TimeZone      string
+		MinLength     int
+		MaxLength     int
+		Route         string
+		SourceRewrite string
+		SourceReplace string
+		DestRewrite   string
+		DestReplace   string
+		Priority      int
+		TTL           int
+		Version       uint `gorm:"not null;default:1"`
+	}
+	type LCRRoute struct {
+		ID       uint   `gorm:"primaryKey"`
+		Prefix   string `gorm:"index"`
+		Route    string
+		Cost     float64
+		Weight   int
+		Priority int
+		Disabled bool
+		TenantID uint `gorm:"index"`
+		Version  uint `gorm:"not null;default:1"`
+	}
+	type ScheduledMessage struct {
+		ID        uint   `gorm:"primaryKey"`
+		MessageID string `gorm:"uniqueIndex;not null"`
+		ClientID  uint   `gorm:"index"`
+		From      string
+		To        string
+		DeliverAt time.Time `gorm:"index"`
+		Status    string    `gorm:"index"`
+		Payload   string
+		CreatedAt time.Time
+		UpdatedAt time.Time
+	}
+	type OutboxMessage struct {
+		ID          uint   `gorm:"primaryKey"`
+		Owner       string `gorm:"index"`
+		Queue       string `gorm:"not null"`
+		ContentType string
+		Headers     string
+		Expiration  string
+		Body        []byte
+		CreatedAt   time.Time
+	}
+	type HeldMessage struct {
+		ID        uint   `gorm:"primaryKey"`
+		ClientID  uint   `gorm:"index;not null"`
+		MessageID string `gorm:"index"`
+		From      string
+		To        string
+		Payload   string
+		CreatedAt time.Time
+	}
+	type RoutingDecision struct {
+		ID            uint   `gorm:"primaryKey"`
+		LogID         string `gorm:"index"`
+		TraceID       string `gorm:"index"`
+		ServerID      string
+		Queue         string
+		Type          string
+		From          string
+		To            string
+		RewrittenFrom string
+		RewrittenTo   string
+		RuleID        uint
+		RuleName      string
+		Source        string
+		Candidates    string
+		Failures      string
+		Route         string
+		Outcome       string
+		Reason        string
+		CreatedAt     time.Time `gorm:"index"`
+	}
+	type CarrierMessage struct {
+		ID                uint   `gorm:"primaryKey"`
+		Carrier           string `gorm:"uniqueIndex:idx_carrier_message"`
+		CarrierMessageID  string `gorm:"uniqueIndex:idx_carrier_message"`
+		LogID             string `gorm:"index"`
+		Type              string
+		From              string
+		To                string
+		Status            string
+		ErrorCode         string
+		ErrorClass        string
+		ReceivedTimestamp time.Time
+		CreatedAt         time.Time `gorm:"index"`
+		UpdatedAt         time.Time
+	}
+	type CarrierRateWindow struct {
+		Key    string `gorm:"primaryKey"`
+		Window int64  `gorm:"primaryKey;autoIncrement:false"`
+		Count  int    `gorm:"not null"`
+	}
+	type CDR struct {
+		ID               uint   `gorm:"primaryKey"`
+		LogID            string `gorm:"index"`
+		TraceID          string
+		ServerID         string
+		Direction        string
+		Client           string `gorm:"index"`
+		Type             string
+		From             string
+		To               string
+		Country          string
+		Segments         int
+		MediaCount       int
+		MediaSize        int
+		Route            string
+		Carrier          string
+		CarrierMessageID string
+		Attempt          int
+		Status           string
+		ErrorCode        string
+		ErrorClass       string
+		Error            string
+		ReceivedAt       time.Time
+		AttemptedAt      time.Time `gorm:"index"`
+		DurationMs       int64
+		CompletedAt      *time.Time
+		CreatedAt        time.Time
+		UpdatedAt        time.Time
+	}
+	type MessageEnvelope struct {
+		ID         uint   `gorm:"primaryKey"`
+		LogID      string `gorm:"uniqueIndex"`
+		TraceID    string
+		ServerID   string
+		Client     string `gorm:"index"`
+		Direction  string
+		Type       string
+		From       string `gorm:"index"`
+		To         string `gorm:"index"`
+		Content    string
+		Segments   int
+		MediaCount int
+		Route      string
+		Status     string `gorm:"index"`
+		Error      string
+		Attempts   int
+		ReceivedAt time.Time `gorm:"index"`
+		CreatedAt  time.Time
+		UpdatedAt  time.Time
+	}
+	type UsageRollup struct {
+		ID         uint      `gorm:"primaryKey"`
+		Day        time.Time `gorm:"type:date;uniqueIndex:idx_usage_rollup"`
+		Client     string    `gorm:"uniqueIndex:idx_usage_rollup"`
+		Direction  string    `gorm:"uniqueIndex:idx_usage_rollup"`
+		Route      string    `gorm:"uniqueIndex:idx_usage_rollup"`
+		Type       string    `gorm:"uniqueIndex:idx_usage_rollup"`
+		Messages   int64
+		Segments   int64
+		MediaCount int64
+		MediaBytes int64
+		Failed     int64
+		UpdatedAt  time.Time
+	}
+	type UsageRate struct {
+		ID        uint `gorm:"primaryKey"`
+		Client    string
+		Route     string
+		Direction string
+		Type      string
+		Price     float64
+		Version   uint `gorm:"not null;default:1"`
+	}
+	type EventSubscription struct {
+		ID       uint   `gorm:"primaryKey"`
+		Client   string `gorm:"index"`
+		TenantID uint   `gorm:"index"`
+		URL      string
+		Secret   string
+		Events   string
+		Disabled bool
+		Version  uint `gorm:"not null;default:1"`
+	}
+	type EventDelivery struct {
+		ID             uint `gorm:"primaryKey"`
+		SubscriptionID uint `gorm:"index"`
+		EventID        string
+		Type           string
+		Payload        string
+		Status         string `gorm:"index"`
+		Attempts       int
+		NextAttemptAt  time.Time `gorm:"index"`
+		ResponseStatus int
+		LastError      string
+		CreatedAt      time.Time `gorm:"index"`
+		UpdatedAt      time.Time
+	}
+	type APIKey struct {
+		ID        uint   `gorm:"primaryKey"`
+		Name      string `gorm:"not null"`
+		Prefix    string
+		Hash      string `gorm:"uniqueIndex;not null"`
+		Role      string `gorm:"not null"`
+		Clients   string
+		TenantID  uint
+		Disabled  bool
+		ExpiresAt *time.Time
+		CreatedAt time.Time
+		Version   uint `gorm:"not null;default:1"`
+	}
+	type AuditEntry struct {
+		ID        uint `gorm:"primaryKey"`
+		ServerID  string
+		Actor     string `gorm:"index"`
+		KeyID     uint
+		Role      string
+		IP        string
+		Method    string
+		Path      string `gorm:"index"`
+		Status    int
+		Body      string
+		CreatedAt time.Time `gorm:"index"`
+	}
+	type Tenant struct {
+		ID            uint   `gorm:"primaryKey"`
+		Name          string `gorm:"unique;not null"`
+		MaxClients    int
+		MaxNumbers    int
+		DailyMessages int
+		Version       uint `gorm:"not null;default:1"`
+	}
+	type OptOut struct {
+		ID        uint   `gorm:"primaryKey"`
+		ClientID  uint   `gorm:"index"`
+		Number    string `gorm:"uniqueIndex:idx_opt_out_pair;not null"`
+		Sender    string `gorm:"uniqueIndex:idx_opt_out_pair;not null"`
+		Keyword   string
+		CreatedAt time.Time
+	}
+	type ContentRule struct {
+		ID       uint `gorm:"primaryKey"`
+		Name     string
+		Position int `gorm:"index"`
+		Disabled bool
+		TenantID uint `gorm:"index"`
+		ClientID uint
+		Kind     string
+		Pattern  string
+		Action   string
+		Category string
+		Version  uint `gorm:"not null;default:1"`
+	}
+	type QuarantinedMessage struct {
+		ID         uint   `gorm:"primaryKey"`
+		MessageID  string `gorm:"index"`
+		ClientID   uint   `gorm:"index"`
+		TenantID   uint   `gorm:"index"`
+		From       string
+		To         string
+		Type       string
+		Message    string
+		Rule       string
+		Category   string
+		Reason     string
+		Status     string `gorm:"index"`
+		Payload    string
+		CreatedAt  time.Time
+		ReviewedAt *time.Time
+	}
+	type CarrierSend struct {
+		ID               uint   `gorm:"primaryKey"`
+		IdempotencyKey   string `gorm:"uniqueIndex;not null"`
+		Route            string
+		Status           string `gorm:"index"`
+		CarrierMessageID string
+		ServerID         string
+		CreatedAt        time.Time `gorm:"index"`
+		UpdatedAt        time.Time
+	}
+	type SessionRegistration struct {
+		Username string `gorm:"primaryKey"`
+		ServerID string `gorm:"index;not null"`
+		Address  string
+		BoundAt  time.Time
+		SeenAt   time.Time `gorm:"index"`
+	}
+	type GatewayLease struct {
+		Name       string `gorm:"primaryKey"`
+		Holder     string `gorm:"not null"`
+		AcquiredAt time.Time
+		ExpiresAt  time.Time
+	}
+
+	return []interface{}{&ClientNumber{}, &DialPlanRule{}, &Client{}, &Carrier{}, &MediaFile{}, &MsgRecordDBItem{}, &DeadLetter{}, &RoutingRule{}, &LCRRoute{}, &ScheduledMessage{}, &OutboxMessage{}, &HeldMessage{}, &RoutingDecision{}, &CarrierMessage{}, &CarrierRateWindow{}, &CDR{}, &MessageEnvelope{}, &UsageRollup{}, &UsageRate{}, &EventSubscription{}, &EventDelivery{}, &APIKey{}, &AuditEntry{}, &Tenant{}, &OptOut{}, &ContentRule{}, &QuarantinedMessage{}, &CarrierSend{}, &SessionRegistration{}, &GatewayLease{}}
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"log"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+func getPostgresDSN() string {
+	host := core.Getenv("POSTGRES_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+
+	port := core.Getenv("POSTGRES_PORT")
+	if port == "" {
+		port = "5432"
+	}
+
+	user := core.Getenv("POSTGRES_USER")
+	password := core.Getenv("POSTGRES_PASSWORD")
+	dbName := core.Getenv("POSTGRES_DB")
+	sslMode := core.Getenv("POSTGRES_SSLMODE")
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+
+	timeZone := core.Getenv("POSTGRES_TIMEZONE")
+	if timeZone == "" {
+		timeZone = "America/Vancouver"
+	}
+
+	dsn := fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s TimeZone=%s",
+		host, port, user, password, dbName, sslMode, timeZone,
+	)
+	if postgresStatementTimeout > 0 {
+		dsn += fmt.Sprintf(" statement_timeout=%d", postgresStatementTimeout.Milliseconds())
+	}
+
+	return dsn
+}
+
+var (
+	postgresMaxOpenConns     int // unlimited
+	postgresMaxIdleConns     int
+	postgresConnMaxLifetime  time.Duration
+	postgresConnMaxIdleTime  time.Duration
+	postgresStatementTimeout time.Duration // none
+	postgresStartupTimeout   time.Duration
+	postgresHealthInterval   time.Duration
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		postgresMaxOpenConns = cfg.Int("POSTGRES_MAX_OPEN_CONNS", 0)
+		postgresMaxIdleConns = cfg.Int("POSTGRES_MAX_IDLE_CONNS", 2)
+		postgresConnMaxLifetime = cfg.Duration("POSTGRES_CONN_MAX_LIFETIME", 30*time.Minute)
+		postgresConnMaxIdleTime = cfg.Duration("POSTGRES_CONN_MAX_IDLE_TIME", 5*time.Minute)
+		postgresStatementTimeout = cfg.Duration("POSTGRES_STATEMENT_TIMEOUT", 0)
+		postgresStartupTimeout = cfg.Duration("POSTGRES_STARTUP_TIMEOUT", 2*time.Minute)
+		postgresHealthInterval = cfg.Duration("POSTGRES_HEALTH_INTERVAL", 10*time.Second)
+	})
+}
+
+// openPostgres connects to the database with the configured pool. While Postgres isn't up yet it
+// retries with backoff for up to POSTGRES_STARTUP_TIMEOUT, so the gateway may start before it.
+func openPostgres() (*gorm.DB, error) {
+	deadline := time.Now().Add(postgresStartupTimeout)
+	delay := core.ReconnectDelay
+	for {
+		db, err := gorm.Open(postgres.Open(getPostgresDSN()), &gorm.Config{})
+		if err == nil {
+			sqlDB, err := db.DB()
+			if err != nil {
+				return nil, err
+			}
+			sqlDB.SetMaxOpenConns(postgresMaxOpenConns)
+			sqlDB.SetMaxIdleConns(postgresMaxIdleConns)
+			sqlDB.SetConnMaxLifetime(postgresConnMaxLifetime)
+			sqlDB.SetConnMaxIdleTime(postgresConnMaxIdleTime)
+			return db, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+		}
+		log.Printf("Failed to connect to PostgreSQL: %v. Retrying in %s...", err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, core.MaxReconnectDelay)
+	}
+}
+
+// MonitorPostgres pings the database every POSTGRES_HEALTH_INTERVAL. The pool replaces broken
+// connections as they are used, but after a failover idle connections to the old server may hang
+// until they time out; when a ping fails the idle connections are closed, so the pool reconnects
+// once Postgres is back without a restart.
+func MonitorPostgres(gateway *core.Gateway) {
+	var lm = gateway.LogManager
+	if core.StorageBackend != "postgres" {
+		return
+	}
+
+	sqlDB, err := gateway.DB.DB()
+	if err != nil {
+		return
+	}
+	ticker := time.NewTicker(postgresHealthInterval)
+	defer ticker.Stop()
+
+	var down time.Time
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), core.HealthCheckTimeout)
+		err := sqlDB.PingContext(ctx)
+		cancel()
+
+		switch {
+		case err != nil:
+			// dropping the idle connections makes the next queries dial again
+			sqlDB.SetMaxIdleConns(0)
+			sqlDB.SetMaxIdleConns(postgresMaxIdleConns)
+			if down.IsZero() {
+				down = time.Now()
+				lm.SendLog(lm.BuildLog(
+					"System.Postgres",
+					"PostgresDown",
+					logrus.ErrorLevel,
+					nil, err,
+				))
+			}
+		case !down.IsZero():
+			lm.SendLog(lm.BuildLog(
+				"System.Postgres",
+				"PostgresRecovered",
+				logrus.WarnLevel,
+				nil, time.Since(down).Round(time.Second),
+			))
+			down = time.Time{}
+		}
+	}
+}
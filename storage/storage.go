@@ -0,0 +1,308 @@
+// Package storage opens the storage of the provisioning, PostgreSQL or a file, and migrates the
+// PostgreSQL schema.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"zultys-smpp-mm4/core"
+)
+
+// discardRefused are the tables errNeedsPostgres refuses inserts into.
+var discardRefused = []string{"scheduled_messages", "held_messages", "quarantined_messages", "dead_letters", "carrier_sends", "tenant_data_keys"}
+
+// Open opens the backend selected by STORAGE_BACKEND and the database of the gateway. With
+// the file backend the database is a discardDB, nothing else is persisted either.
+func Open() (core.Storage, *gorm.DB, error) {
+	switch core.StorageBackend {
+	case "postgres":
+		db, err := openPostgres()
+		if err != nil {
+			return nil, nil, err
+		}
+		return &postgresStorage{db: db}, db, nil
+	case "file":
+		storage := &fileStorage{path: core.Getenv("STORAGE_FILE")}
+		if _, err := storage.read(); err != nil {
+			return nil, nil, err
+		}
+		db, err := openDiscardDB()
+		if err != nil {
+			return nil, nil, err
+		}
+		return storage, db, nil
+	}
+	return nil, nil, fmt.Errorf("unknown STORAGE_BACKEND: %s", core.StorageBackend)
+}
+
+type postgresStorage struct {
+	db *gorm.DB
+}
+
+func (storage *postgresStorage) Clients() ([]core.Client, error) {
+	var clients []core.Client
+	err := storage.db.Preload("Numbers").Preload("DialPlan").Find(&clients).Error
+	return clients, err
+}
+
+func (storage *postgresStorage) Numbers() ([]core.ClientNumber, error) {
+	var numbers []core.ClientNumber
+	err := storage.db.Find(&numbers).Error
+	return numbers, err
+}
+
+func (storage *postgresStorage) Carriers() ([]core.Carrier, error) {
+	var carriers []core.Carrier
+	err := storage.db.Find(&carriers).Error
+	return carriers, err
+}
+
+func (storage *postgresStorage) RoutingRules() ([]core.RoutingRule, error) {
+	var rules []core.RoutingRule
+	err := storage.db.Order("position asc, id asc").Find(&rules).Error
+	return rules, err
+}
+
+func (storage *postgresStorage) Encrypted() bool {
+	return true
+}
+
+// fileStorage reads the provisioning from a YAML file on every load, so an edited file takes
+// effect with a reload. The keys are those of the JSON API, the numbers and dial plan of a client
+// are listed under it, the config of a carrier may be a table. IDs are given in the order of the
+// file where they are unset, credentials are in the clear or secret references.
+type fileStorage struct {
+	path string
+}
+
+type storageFile struct {
+	Clients      []core.Client      `json:"clients"`
+	Carriers     []core.Carrier     `json:"carriers"`
+	RoutingRules []core.RoutingRule `json:"routing_rules"`
+}
+
+func (storage *fileStorage) read() (*storageFile, error) {
+	data, err := os.ReadFile(storage.path)
+	if err != nil {
+		return nil, fmt.Errorf("storage file: %w", err)
+	}
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("storage file %s: %w", storage.path, err)
+	}
+	if carriers, ok := tree["carriers"].([]interface{}); ok {
+		for _, raw := range carriers {
+			if carrier, ok := raw.(map[string]interface{}); ok {
+				if config, ok := carrier["config"].(map[string]interface{}); ok {
+					encoded, err := json.Marshal(config)
+					if err != nil {
+						return nil, fmt.Errorf("storage file %s: config of carrier %v: %w", storage.path, carrier["name"], err)
+					}
+					carrier["config"] = string(encoded)
+				}
+			}
+		}
+	}
+
+	// decoded by the JSON tags of the models
+	encoded, err := json.Marshal(tree)
+	if err != nil {
+		return nil, fmt.Errorf("storage file %s: %w", storage.path, err)
+	}
+	var file storageFile
+	if err := json.Unmarshal(encoded, &file); err != nil {
+		return nil, fmt.Errorf("storage file %s: %w", storage.path, err)
+	}
+
+	var nextNumber, nextRule uint
+	for i := range file.Clients {
+		client := &file.Clients[i]
+		if client.ID == 0 {
+			client.ID = uint(i + 1)
+		}
+		for j := range client.Numbers {
+			nextNumber++
+			if client.Numbers[j].ID == 0 {
+				client.Numbers[j].ID = nextNumber
+			}
+			client.Numbers[j].ClientID = client.ID
+		}
+		for j := range client.DialPlan {
+			nextRule++
+			if client.DialPlan[j].ID == 0 {
+				client.DialPlan[j].ID = nextRule
+			}
+			client.DialPlan[j].ClientID = client.ID
+		}
+	}
+	for i := range file.Carriers {
+		carrier := &file.Carriers[i]
+		if carrier.ID == 0 {
+			carrier.ID = uint(i + 1)
+		}
+		if carrier.UUID == "" {
+			carrier.UUID = carrier.Name
+		}
+	}
+	for i := range file.RoutingRules {
+		if file.RoutingRules[i].ID == 0 {
+			file.RoutingRules[i].ID = uint(i + 1)
+		}
+	}
+	return &file, nil
+}
+
+func (storage *fileStorage) Clients() ([]core.Client, error) {
+	file, err := storage.read()
+	if err != nil {
+		return nil, err
+	}
+	return file.Clients, nil
+}
+
+func (storage *fileStorage) Numbers() ([]core.ClientNumber, error) {
+	file, err := storage.read()
+	if err != nil {
+		return nil, err
+	}
+	var numbers []core.ClientNumber
+	for _, client := range file.Clients {
+		numbers = append(numbers, client.Numbers...)
+	}
+	return numbers, nil
+}
+
+func (storage *fileStorage) Carriers() ([]core.Carrier, error) {
+	file, err := storage.read()
+	if err != nil {
+		return nil, err
+	}
+	return file.Carriers, nil
+}
+
+func (storage *fileStorage) RoutingRules() ([]core.RoutingRule, error) {
+	file, err := storage.read()
+	if err != nil {
+		return nil, err
+	}
+	rules := file.RoutingRules
+	// ordered like the database orders them
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Position < rules[j].Position })
+	return rules, nil
+}
+
+func (storage *fileStorage) Encrypted() bool {
+	return false
+}
+
+// openDiscardDB opens a database that takes every write and finds nothing, for the file backend:
+// messages are routed as usual, but the records, CDRs and audit entries are dropped. Storing a
+// message for later fails with errNeedsPostgres instead, see discardRefused.
+func openDiscardDB() (*gorm.DB, error) {
+	discardOnce.Do(func() { sql.Register("discard", discardDriver{}) })
+	sqlDB, err := sql.Open("discard", "")
+	if err != nil {
+		return nil, err
+	}
+	// without RETURNING an insert reports the row it took
+	return gorm.Open(postgres.New(postgres.Config{Conn: sqlDB, WithoutReturning: true}), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+}
+
+var discardOnce sync.Once
+
+type discardDriver struct{}
+
+func (discardDriver) Open(string) (driver.Conn, error) {
+	return discardConn{}, nil
+}
+
+type discardConn struct{}
+
+func (discardConn) Prepare(query string) (driver.Stmt, error) {
+	return discardStmt{query: query}, nil
+}
+
+func (discardConn) Close() error {
+	return nil
+}
+
+func (discardConn) Begin() (driver.Tx, error) {
+	return discardTx{}, nil
+}
+
+func (discardConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	return discardExec(query)
+}
+
+func (discardConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return discardRows{}, nil
+}
+
+type discardTx struct{}
+
+func (discardTx) Commit() error { return nil }
+
+func (discardTx) Rollback() error { return nil }
+
+type discardStmt struct {
+	query string
+}
+
+func (discardStmt) Close() error { return nil }
+
+func (discardStmt) NumInput() int { return -1 }
+
+func (stmt discardStmt) Exec([]driver.Value) (driver.Result, error) {
+	return discardExec(stmt.query)
+}
+
+func (discardStmt) Query([]driver.Value) (driver.Rows, error) {
+	return discardRows{}, nil
+}
+
+// discardIDs numbers the inserted rows, as a database would.
+var discardIDs atomic.Int64
+
+// discardResult reports an insert as one row with a new ID, updates and deletes as no rows.
+type discardResult struct {
+	id   int64
+	rows int64
+}
+
+func discardExec(query string) (driver.Result, error) {
+	query = strings.TrimSpace(query)
+	if !strings.HasPrefix(strings.ToUpper(query), "INSERT") {
+		return discardResult{}, nil
+	}
+	for _, table := range discardRefused {
+		if strings.HasPrefix(query, `INSERT INTO "`+table+`"`) {
+			return nil, core.ErrNeedsPostgres
+		}
+	}
+	return discardResult{id: discardIDs.Add(1), rows: 1}, nil
+}
+
+func (result discardResult) LastInsertId() (int64, error) { return result.id, nil }
+
+func (result discardResult) RowsAffected() (int64, error) { return result.rows, nil }
+
+type discardRows struct{}
+
+func (discardRows) Columns() []string { return nil }
+
+func (discardRows) Close() error { return nil }
+
+func (discardRows) Next(dest []driver.Value) error { return io.EOF }
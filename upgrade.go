@@ -0,0 +1,334 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"zultys-smpp-mm4/core"
+)
+
+var (
+	upgradeTimeout      time.Duration
+	upgradeDrainTimeout time.Duration
+	upgradePIDFile      string // for service managers following the main process
+)
+
+// Set by the process handing over for the new one.
+const (
+	upgradeListenersEnv = "GATEWAY_UPGRADE_LISTENERS" // names of the listeners passed from fd 3 on
+	upgradeReadyEnv     = "GATEWAY_UPGRADE_READY"     // fd of the pipe the new process reports ready on
+)
+
+// upgrader keeps the listening sockets of the gateway so they can be handed to a new process of
+// the binary on SIGUSR2, like tableflip does: the new process serves on the same sockets, so no
+// connection is refused while it starts, and this one stops accepting once it is ready and exits
+// when its SMPP sessions have unbound or UPGRADE_DRAIN_TIMEOUT passed.
+type upgrader struct {
+	mu          sync.Mutex
+	listeners   map[string]net.Listener // by name: smpp, mm4, web and metrics
+	inherited   map[string]*os.File     // from the previous process, not listened on yet
+	ready       *os.File
+	upgraded    bool // started by an upgrade
+	upgrading   bool
+	handingOver bool
+	closing     bool // the listeners were closed to stop the gateway, see Gateway.Stop
+}
+
+// upgrades is the upgrader of the process, the first NewGateway takes over the sockets of the
+// previous process.
+var (
+	upgrades    *upgrader
+	upgradeOnce sync.Once
+)
+
+func init() {
+	core.OnConfigure(func(cfg *core.Config) {
+		upgradeTimeout = cfg.Duration("UPGRADE_TIMEOUT", time.Minute)
+		upgradeDrainTimeout = cfg.Duration("UPGRADE_DRAIN_TIMEOUT", 10*time.Minute)
+		upgradePIDFile = cfg.Getenv("UPGRADE_PID_FILE")
+	})
+}
+
+func newUpgrader() *upgrader {
+	upgrades := &upgrader{listeners: make(map[string]net.Listener), inherited: make(map[string]*os.File)}
+	if names := os.Getenv(upgradeListenersEnv); names != "" {
+		for i, name := range strings.Split(names, ",") {
+			upgrades.inherited[name] = os.NewFile(uintptr(3+i), name)
+		}
+		upgrades.upgraded = true
+	}
+	if fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv)); err == nil {
+		upgrades.ready = os.NewFile(uintptr(fd), "upgrade-ready")
+	}
+	// not passed on to the processes this one starts
+	_ = os.Unsetenv(upgradeListenersEnv)
+	_ = os.Unsetenv(upgradeReadyEnv)
+	return upgrades
+}
+
+// Listen opens the TCP listener of the name, or takes over the one of the previous process. The
+// previous process is told this one is ready once it listens on all of its sockets.
+func (upgrades *upgrader) Listen(name string, address string) (net.Listener, error) {
+	upgrades.mu.Lock()
+	defer upgrades.mu.Unlock()
+
+	var listener net.Listener
+	var err error
+	if file, ok := upgrades.inherited[name]; ok {
+		// the socket keeps the address of the previous process
+		listener, err = net.FileListener(file)
+		_ = file.Close()
+		delete(upgrades.inherited, name)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	upgrades.listeners[name] = listener
+
+	if upgrades.ready != nil && len(upgrades.inherited) == 0 {
+		_, _ = upgrades.ready.Write([]byte{1})
+		_ = upgrades.ready.Close()
+		upgrades.ready = nil
+	}
+	return listener, nil
+}
+
+// HandedOver reports whether the listeners were handed to a new process, or closed to stop the
+// gateway. The servers return from accepting then, without it being an error.
+func (upgrades *upgrader) HandedOver() bool {
+	upgrades.mu.Lock()
+	defer upgrades.mu.Unlock()
+	return upgrades.handingOver || upgrades.closing
+}
+
+// close closes the listeners to stop the gateway, they aren't handed over anymore.
+func (upgrades *upgrader) close() {
+	upgrades.mu.Lock()
+	defer upgrades.mu.Unlock()
+	upgrades.closing = true
+	for _, listener := range upgrades.listeners {
+		_ = listener.Close()
+	}
+}
+
+// wait blocks after the listeners were handed over, the drain ends the process.
+func (upgrades *upgrader) wait() {
+	upgrades.mu.Lock()
+	handingOver := upgrades.handingOver
+	upgrades.mu.Unlock()
+	if handingOver {
+		select {}
+	}
+}
+
+// UpgradeListener upgrades the gateway on SIGUSR2: replace the binary, then signal the running
+// process.
+func (gateway *Gateway) UpgradeListener() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	var lm = gateway.LogManager
+	if !upgrades.upgraded {
+		if err := writePIDFile(os.Getpid()); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.Upgrade",
+				"GenericError",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+	}
+	for range signals {
+		if err := gateway.upgrade(); err != nil {
+			lm.SendLog(lm.BuildLog(
+				"System.Upgrade",
+				"UpgradeFailed",
+				logrus.ErrorLevel,
+				nil, err,
+			))
+		}
+	}
+}
+
+// upgrade starts the binary again with the listeners and hands them over once it is ready. A new
+// process that exits or isn't ready within UPGRADE_TIMEOUT leaves this one serving.
+func (gateway *Gateway) upgrade() error {
+	if core.HAEnabled {
+		return errors.New("not available with HA_ENABLED, fail over to the standby instead")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	upgrades.mu.Lock()
+	if upgrades.upgrading || upgrades.handingOver {
+		upgrades.mu.Unlock()
+		return errors.New("an upgrade is already in progress")
+	}
+	if upgrades.closing {
+		upgrades.mu.Unlock()
+		return errors.New("the gateway is stopping")
+	}
+	var names []string
+	var files []*os.File
+	for name, listener := range upgrades.listeners {
+		tcp, ok := listener.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		file, err := tcp.File()
+		if err != nil {
+			upgrades.mu.Unlock()
+			closeFiles(files)
+			return fmt.Errorf("failed to pass the %s listener: %w", name, err)
+		}
+		names = append(names, name)
+		files = append(files, file)
+	}
+	upgrades.upgrading = true
+	upgrades.mu.Unlock()
+	defer func() {
+		upgrades.mu.Lock()
+		upgrades.upgrading = false
+		upgrades.mu.Unlock()
+	}()
+	defer closeFiles(files)
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWrite)
+	cmd.Env = append(os.Environ(),
+		upgradeListenersEnv+"="+strings.Join(names, ","),
+		fmt.Sprintf("%s=%d", upgradeReadyEnv, 3+len(files)),
+	)
+	err = cmd.Start()
+	_ = readyWrite.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", executable, err)
+	}
+
+	var lm = gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"System.Upgrade",
+		"UpgradeStarted",
+		logrus.WarnLevel,
+		nil, cmd.Process.Pid,
+	))
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan error, 1)
+	go func() {
+		// EOF when the new process exits without reporting ready
+		_, err := readyRead.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			return fmt.Errorf("the new process exited before it was ready: %v", <-exited)
+		}
+	case err := <-exited:
+		return fmt.Errorf("the new process exited before it was ready: %v", err)
+	case <-time.After(upgradeTimeout):
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("the new process wasn't ready within %s", upgradeTimeout)
+	}
+
+	if err := writePIDFile(cmd.Process.Pid); err != nil {
+		_ = cmd.Process.Kill()
+		return err
+	}
+
+	upgrades.mu.Lock()
+	upgrades.handingOver = true
+	for _, listener := range upgrades.listeners {
+		_ = listener.Close()
+	}
+	upgrades.mu.Unlock()
+
+	lm.SendLog(lm.BuildLog(
+		"System.Upgrade",
+		"UpgradeHandedOver",
+		logrus.WarnLevel,
+		nil, cmd.Process.Pid,
+	))
+	go gateway.drain()
+	return nil
+}
+
+// drain waits for the SMPP sessions of this process to unbind, for up to UPGRADE_DRAIN_TIMEOUT,
+// and exits. Until then they are served as before.
+func (gateway *Gateway) drain() {
+	deadline := time.Now().Add(upgradeDrainTimeout)
+	for gateway.boundSessions() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+
+	var lm = gateway.LogManager
+	lm.SendLog(lm.BuildLog(
+		"System.Upgrade",
+		"UpgradeDrained",
+		logrus.WarnLevel,
+		nil, gateway.boundSessions(),
+	))
+	if gateway.Queue != nil {
+		_ = gateway.Queue.Close()
+	}
+	os.Exit(0)
+}
+
+// boundClients lists the clients with an SMPP session, false while the SMPP server isn't running.
+func (gateway *Gateway) boundClients() ([]string, bool) {
+	srv := gateway.SMPPServer
+	if srv == nil {
+		return nil, false
+	}
+	var clients []string
+	for _, session := range srv.Sessions() {
+		clients = append(clients, session.Username)
+	}
+	return clients, true
+}
+
+// boundSessions returns the number of SMPP sessions bound to this process.
+func (gateway *Gateway) boundSessions() int {
+	srv := gateway.SMPPServer
+	if srv == nil {
+		return 0
+	}
+	return len(srv.Sessions())
+}
+
+// writePIDFile writes the PID of the process serving the gateway to UPGRADE_PID_FILE, when set.
+func writePIDFile(pid int) error {
+	if upgradePIDFile == "" {
+		return nil
+	}
+	return os.WriteFile(upgradePIDFile, []byte(strconv.Itoa(pid)+"\n"), 0644)
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		_ = file.Close()
+	}
+}
@@ -1,15 +1,20 @@
-package main
+package gateway
 
 import (
 	"encoding/base64"
+	"errors"
 	"github.com/kataras/iris/v12"
-	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net"
 	"net/http"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"zultys-smpp-mm4/carriers"
+	"zultys-smpp-mm4/core"
+	"zultys-smpp-mm4/router"
+	"zultys-smpp-mm4/smppserver"
 )
 
 // PasswordUpdateRequest defines the expected JSON request body
@@ -19,17 +24,10 @@ type PasswordUpdateRequest struct {
 
 // StatsResponse represents the overall statistics response.
 type StatsResponse struct {
-	SMPPConnectedClients int              `json:"smpp_connected_clients"`
-	SMPPClients          []SMPPClientInfo `json:"smpp_clients"`
-	MM4ConnectedClients  int              `json:"mm4_connected_clients"`
-	MM4Clients           []MM4ClientInfo  `json:"mm4_clients"`
-}
-
-// SMPPClientInfo contains information about a connected SMPP client.
-type SMPPClientInfo struct {
-	Username  string    `json:"username"`
-	IPAddress string    `json:"ip_address"`
-	LastSeen  time.Time `json:"last_seen"`
+	SMPPConnectedClients int                         `json:"smpp_connected_clients"`
+	SMPPClients          []smppserver.SMPPClientInfo `json:"smpp_clients"`
+	MM4ConnectedClients  int                         `json:"mm4_connected_clients"`
+	MM4Clients           []MM4ClientInfo             `json:"mm4_clients"`
 }
 
 // MM4ClientInfo contains information about a connected MM4 client.
@@ -40,271 +38,880 @@ type MM4ClientInfo struct {
 
 // SetupStatsRoutes sets up the HTTP routes for statistics.
 func SetupStatsRoutes(app *iris.Application, gateway *Gateway) {
-	stats := app.Party("/stats", gateway.basicAuthMiddleware)
+	stats := app.Party("/stats", gateway.BasicAuthMiddleware)
 	{
 		stats.Get("/", func(ctx iris.Context) {
 			statsResponse := StatsResponse{}
 
 			// Collect SMPP Server Stats
-			gateway.SMPPServer.mu.RLock()
-			smppConnCount := len(gateway.SMPPServer.conns)
-			statsResponse.SMPPConnectedClients = smppConnCount
+			statsResponse.SMPPClients = gateway.SMPPServer.Receivers()
+			statsResponse.SMPPConnectedClients = len(statsResponse.SMPPClients)
+
+			// Collect MM4 Server Stats
+			peers := gateway.MM4Server.Peers()
+			statsResponse.MM4ConnectedClients = len(peers)
+
+			mm4Clients := make([]MM4ClientInfo, 0, len(peers))
+			for clientID, connectedAt := range peers {
+				mm4Clients = append(mm4Clients, MM4ClientInfo{
+					ClientID:    clientID,
+					ConnectedAt: connectedAt,
+				})
+			}
+			statsResponse.MM4Clients = mm4Clients
+
+			// Return the stats as JSON
+			ctx.JSON(statsResponse)
+		})
+	}
+}
+
+// SetupCarrierRoutes sets up the HTTP routes for carrier management
+func SetupCarrierRoutes(app *iris.Application, gateway *Gateway) {
+	carriers := app.Party("/carriers", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// Add a new carrier
+		carriers.Post("/", func(ctx iris.Context) {
+			var carrier core.Carrier
+			if err := ctx.ReadJSON(&carrier); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid carrier data"})
+				return
+			}
+
+			// Validate required fields
+			if carrier.Name == "" || carrier.Type == "" || carrier.Username == "" || carrier.Password == "" {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "All fields (name, type, username, password) are required"})
+				return
+			}
+
+			if !core.KnownCarrierType(carrier.Type) {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Unknown carrier type"})
+				return
+			}
+			if err := core.ValidateCarrierConfig(carrier.Config); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			core.AssignTenant(ctx, &carrier.TenantID)
+			if err := core.ValidateTenantID(carrier.TenantID); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			// several accounts may share a type, the name tells them apart
+			gateway.Mu.RLock()
+			_, exists := gateway.Carriers[carrier.Name]
+			gateway.Mu.RUnlock()
+			if exists {
+				ctx.StatusCode(iris.StatusConflict)
+				ctx.JSON(iris.Map{"error": "A carrier with this name already exists"})
+				return
+			}
+
+			if err := gateway.AddCarrier(&carrier); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			// Return the carrier without exposing encrypted fields
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(core.PublicCarrier(carrier))
+		})
+
+		// Get a carrier account
+		carriers.Get("/{id:uint}", func(ctx iris.Context) {
+			var carrier core.Carrier
+			if err := gateway.DB.First(&carrier, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "Carrier not found"})
+				return
+			}
+
+			ctx.JSON(core.PublicCarrier(carrier))
+		})
+
+		// Replace the type, config and credentials of a carrier, the handler is reloaded
+		carriers.Put("/{id:uint}", func(ctx iris.Context) {
+			var update core.Carrier
+			if err := ctx.ReadJSON(&update); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid carrier data"})
+				return
+			}
+			core.AssignTenant(ctx, &update.TenantID)
+
+			carrier, err := gateway.UpdateCarrier(ctx.Params().GetUintDefault("id", 0), update)
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			ctx.JSON(carrier)
+		})
+
+		// Delete a carrier no number, rule or LCR route uses
+		carriers.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := gateway.DeleteCarrier(ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			ctx.JSON(iris.Map{"status": "Carrier deleted"})
+		})
+
+		// Reload carriers from the database
+		carriers.Post("/reload", func(ctx iris.Context) {
+			if err := gateway.ReloadCarriers(); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+			}
+
+			ctx.JSON(iris.Map{"status": "Carriers reloaded"})
+		})
+
+		// Show the health of every carrier route
+		carriers.Get("/health", func(ctx iris.Context) {
+			ctx.JSON(gateway.Router.RouteHealth())
+		})
+
+		// Run the health check of a carrier route now
+		carriers.Post("/{name:string}/probe", func(ctx iris.Context) {
+			status, err := gateway.Router.ProbeRoute(ctx.Params().Get("name"))
+			if err != nil && !errors.Is(err, router.ErrHealthCheckUnsupported) {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": err.Error(), "health": status})
+				return
+			}
+			ctx.JSON(status)
+		})
+
+		// Get all carriers
+		carriers.Get("/", func(ctx iris.Context) {
+			gateway.Mu.RLock()
+			defer gateway.Mu.RUnlock()
+
+			// every account of every carrier type, without the encrypted credentials
+			carrierList := make([]core.Carrier, 0, len(gateway.CarrierUUIDs))
+			for _, carrier := range gateway.CarrierUUIDs {
+				if core.CheckTenantScope(ctx, carrier.TenantID) != nil {
+					continue
+				}
+				carrierList = append(carrierList, core.PublicCarrier(carrier))
+			}
+			sort.Slice(carrierList, func(i, j int) bool { return carrierList[i].Name < carrierList[j].Name })
+
+			ctx.JSON(carrierList)
+		})
+	}
+}
+
+// SetupDeadLetterRoutes sets up the HTTP routes for inspecting and re-driving dead-lettered messages.
+func SetupDeadLetterRoutes(app *iris.Application, gateway *Gateway) {
+	deadLetters := app.Party("/deadletters", gateway.BasicAuthMiddleware)
+	{
+		// List dead letters, optionally filtered by queue and type
+		deadLetters.Get("/", func(ctx iris.Context) {
+			limit, err := strconv.Atoi(ctx.URLParamDefault("limit", "100"))
+			if err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid limit"})
+				return
+			}
+
+			list, err := gateway.ListDeadLetters(ctx.URLParam("queue"), ctx.URLParam("type"), limit)
+			if err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			for i := range list {
+				list[i].Payload = gateway.RevealBody(ctx, list[i].Payload)
+			}
+			ctx.JSON(list)
+		})
+
+		// Get a single dead letter including its raw payload
+		deadLetters.Get("/{id:uint}", func(ctx iris.Context) {
+			deadLetter, err := gateway.GetDeadLetter(ctx.Params().GetUintDefault("id", 0))
+			if err != nil {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			deadLetter.Payload = gateway.RevealBody(ctx, deadLetter.Payload)
+			ctx.JSON(deadLetter)
+		})
+
+		// Edit the addresses, body or origin queue of a dead letter before re-queueing it
+		deadLetters.Patch("/{id:uint}", func(ctx iris.Context) {
+			var update core.DeadLetterUpdate
+			if err := ctx.ReadJSON(&update); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid request data"})
+				return
+			}
+
+			deadLetter, err := gateway.UpdateDeadLetter(ctx.Params().GetUintDefault("id", 0), update)
+			if err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			deadLetter.Payload = gateway.RevealBody(ctx, deadLetter.Payload)
+			ctx.JSON(deadLetter)
+		})
+
+		// Re-queue a dead letter onto its origin queue
+		deadLetters.Post("/{id:uint}/requeue", func(ctx iris.Context) {
+			if err := gateway.RequeueDeadLetter(ctx.Params().GetUintDefault("id", 0)); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(iris.Map{"status": "Dead letter re-queued"})
+		})
+
+		// Purge a single dead letter
+		deadLetters.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := gateway.DB.Delete(&core.DeadLetter{}, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(iris.Map{"status": "Dead letter purged"})
+		})
+
+		// Purge all dead letters matching the queue and type filters
+		deadLetters.Delete("/", func(ctx iris.Context) {
+			purged, err := gateway.PurgeDeadLetters(ctx.URLParam("queue"), ctx.URLParam("type"))
+			if err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(iris.Map{"status": "Dead letters purged", "purged": purged})
+		})
+	}
+}
+
+func SetupRoutingRuleRoutes(app *iris.Application, gateway *Gateway) {
+	rules := app.Party("/routing/rules", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// List routing rules in evaluation order
+		rules.Get("/", func(ctx iris.Context) {
+			rules, err := gateway.Storage.RoutingRules()
+			if err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+			list := make([]core.RoutingRule, 0, len(rules))
+			for _, rule := range rules {
+				if tenant := core.RequestTenant(ctx); tenant == 0 || rule.TenantID == tenant {
+					list = append(list, rule)
+				}
+			}
+
+			ctx.JSON(list)
+		})
+
+		// Add a routing rule
+		rules.Post("/", func(ctx iris.Context) {
+			var rule core.RoutingRule
+			if err := ctx.ReadJSON(&rule); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid request data"})
+				return
+			}
+			rule.ID = 0
+			rule.Version = 0
+			core.AssignTenant(ctx, &rule.TenantID)
+
+			if err := gateway.Router.ValidateRoutingRule(&rule); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			if err := gateway.DB.Create(&rule).Error; err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			if err := gateway.Router.LoadRoutingRules(); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(rule)
+		})
+
+		// Replace a routing rule, the body carries the version it was read with
+		rules.Put("/{id:uint}", func(ctx iris.Context) {
+			id := ctx.Params().GetUintDefault("id", 0)
+
+			var existing core.RoutingRule
+			if err := gateway.DB.First(&existing, id).Error; err != nil {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "Routing rule not found"})
+				return
+			}
+
+			var rule core.RoutingRule
+			if err := ctx.ReadJSON(&rule); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid request data"})
+				return
+			}
+			rule.ID = existing.ID
+			core.AssignTenant(ctx, &rule.TenantID)
+
+			if err := gateway.Router.ValidateRoutingRule(&rule); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			if err := core.UpdateVersioned(gateway.DB, &rule, rule.ID, &rule.Version, "*"); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			if err := gateway.Router.LoadRoutingRules(); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(rule)
+		})
+
+		// Delete a routing rule
+		rules.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := core.DeleteVersioned(gateway.DB, &core.RoutingRule{}, ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			if err := gateway.Router.LoadRoutingRules(); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(iris.Map{"status": "Routing rule deleted"})
+		})
+
+		// Reload the rules from the database, e.g. after editing the table directly
+		rules.Post("/reload", func(ctx iris.Context) {
+			if err := gateway.Router.LoadRoutingRules(); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(iris.Map{"status": "Routing rules reloaded", "rules": len(gateway.Router.Rules.Rules())})
+		})
+	}
+
+	lcr := app.Party("/routing/lcr", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// List least-cost routing entries
+		lcr.Get("/", func(ctx iris.Context) {
+			var list []core.LCRRoute
+			query := gateway.DB.Order("prefix asc, priority asc, cost asc")
+			if tenant := core.RequestTenant(ctx); tenant != 0 {
+				query = query.Where("tenant_id = ?", tenant)
+			}
+			if err := query.Find(&list).Error; err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(list)
+		})
+
+		// Add or replace a least-cost routing entry
+		lcr.Post("/", func(ctx iris.Context) {
+			var entry core.LCRRoute
+			if err := ctx.ReadJSON(&entry); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid request data"})
+				return
+			}
 
-			smppClients := make([]SMPPClientInfo, 0, smppConnCount)
-			for username, session := range gateway.SMPPServer.conns {
-				ip, err := gateway.SMPPServer.GetClientIP(session)
+			if gateway.Router.FindCarrierRoute(entry.Route) == nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Unknown carrier route"})
+				return
+			}
+			if entry.ID != 0 {
+				owner, err := core.OwnerTenant(gateway.DB, &core.LCRRoute{}, entry.ID)
+				if err == nil {
+					err = core.CheckTenantScope(ctx, owner)
+				}
 				if err != nil {
-					logrus.WithFields(logrus.Fields{
-						"username": username,
-						"error":    err,
-					}).Error("Failed to get IP for SMPP session")
-					ip = "unknown"
+					core.WriteProvisioningError(ctx, err)
+					return
 				}
+			}
+			core.AssignTenant(ctx, &entry.TenantID)
+			if err := gateway.Router.ValidateLCRTenant(&entry); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			// an entry with an id replaces the stored one, as PUT does
+			var err error
+			if entry.ID != 0 {
+				err = core.UpdateVersioned(gateway.DB, &entry, entry.ID, &entry.Version, "*")
+			} else {
+				entry.Version = 0
+				err = gateway.DB.Create(&entry).Error
+			}
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			if err := gateway.Router.LoadLCRRoutes(); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(entry)
+		})
+
+		// Get a least-cost routing entry
+		lcr.Get("/{id:uint}", func(ctx iris.Context) {
+			var entry core.LCRRoute
+			if err := gateway.DB.First(&entry, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "LCR route not found"})
+				return
+			}
+
+			ctx.JSON(entry)
+		})
+
+		// Replace a least-cost routing entry, the body carries the version it was read with
+		lcr.Put("/{id:uint}", func(ctx iris.Context) {
+			var entry core.LCRRoute
+			if err := ctx.ReadJSON(&entry); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid request data"})
+				return
+			}
+			entry.ID = ctx.Params().GetUintDefault("id", 0)
+
+			if gateway.Router.FindCarrierRoute(entry.Route) == nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Unknown carrier route"})
+				return
+			}
+			core.AssignTenant(ctx, &entry.TenantID)
+			if err := gateway.Router.ValidateLCRTenant(&entry); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			if err := core.UpdateVersioned(gateway.DB, &entry, entry.ID, &entry.Version, "*"); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			if err := gateway.Router.LoadLCRRoutes(); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(entry)
+		})
+
+		// Delete a least-cost routing entry
+		lcr.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := core.DeleteVersioned(gateway.DB, &core.LCRRoute{}, ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			if err := gateway.Router.LoadLCRRoutes(); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.JSON(iris.Map{"status": "LCR route deleted"})
+		})
 
-				smppClients = append(smppClients, SMPPClientInfo{
-					Username:  username,
-					IPAddress: ip,
-					LastSeen:  session.LastSeen,
+		// Show the candidates and their health for a destination, in the order they would be tried
+		lcr.Get("/candidates/{number:string}", func(ctx iris.Context) {
+			var result []iris.Map
+			for _, candidate := range gateway.Router.LCR.Candidates(ctx.Params().Get("number"), uint(ctx.URLParamIntDefault("tenant_id", 0))) {
+				healthy := false
+				if route := gateway.Router.FindCarrierRoute(candidate.Route); route != nil {
+					healthy = route.Healthy()
+				}
+				result = append(result, iris.Map{
+					"route":       candidate.Route,
+					"prefix":      candidate.Prefix,
+					"number_type": candidate.NumberType,
+					"cost":        candidate.Cost,
+					"priority":    candidate.Priority,
+					"weight":      candidate.Weight,
+					"healthy":     healthy,
 				})
 			}
-			gateway.SMPPServer.mu.RUnlock()
-			statsResponse.SMPPClients = smppClients
 
-			// Collect MM4 Server Stats
-			gateway.MM4Server.mu.RLock()
-			mm4ConnCount := len(gateway.MM4Server.connectedClients)
-			statsResponse.MM4ConnectedClients = mm4ConnCount
+			ctx.JSON(result)
+		})
+	}
+}
+
+// ScheduleRequest is the body for scheduling a message through the API.
+type ScheduleRequest struct {
+	From      string    `json:"from_number"`
+	To        string    `json:"to_number"`
+	Message   string    `json:"message"`
+	DeliverAt time.Time `json:"deliver_at"`
+	// AllowInternational sends the message abroad for clients with the flag international policy
+	AllowInternational bool `json:"allow_international,omitempty"`
+}
+
+func SetupScheduleRoutes(app *iris.Application, gateway *Gateway) {
+	scheduled := app.Party("/scheduled", gateway.BasicAuthMiddleware)
+	{
+		// List scheduled messages, optionally filtered by status
+		scheduled.Get("/", func(ctx iris.Context) {
+			var list []core.ScheduledMessage
+			query := gateway.DB.Order("deliver_at asc")
+			if status := ctx.URLParam("status"); status != "" {
+				query = query.Where("status = ?", status)
+			}
+			if err := query.Limit(ctx.URLParamIntDefault("limit", 100)).Find(&list).Error; err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			for i := range list {
+				list[i].Payload = gateway.RevealBody(ctx, list[i].Payload)
+			}
+			ctx.JSON(list)
+		})
+
+		// Schedule an SMS for future delivery
+		scheduled.Post("/", func(ctx iris.Context) {
+			var req ScheduleRequest
+			if err := ctx.ReadJSON(&req); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid request data"})
+				return
+			}
+
+			if req.DeliverAt.Before(time.Now()) {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "deliver_at must be in the future"})
+				return
+			}
+
+			client, err := gateway.FindClientByNumber(req.From)
+			if err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			msg := core.MsgQueueItem{
+				To:                 req.To,
+				From:               req.From,
+				ReceivedTimestamp:  time.Now(),
+				Type:               core.MsgQueueItemType.SMS,
+				Message:            req.Message,
+				LogID:              primitive.NewObjectID().Hex(),
+				AllowInternational: req.AllowInternational,
+			}
+			core.NormalizeAddresses(&msg, client)
 
-			mm4Clients := make([]MM4ClientInfo, 0, mm4ConnCount)
-			for clientID, connectedAt := range gateway.MM4Server.connectedClients {
-				mm4Clients = append(mm4Clients, MM4ClientInfo{
-					ClientID:    clientID,
-					ConnectedAt: connectedAt,
-				})
+			result, err := gateway.ScheduleMessage(msg, client, req.DeliverAt)
+			if err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
 			}
-			gateway.MM4Server.mu.RUnlock()
-			statsResponse.MM4Clients = mm4Clients
 
-			// Return the stats as JSON
-			ctx.JSON(statsResponse)
+			result.Payload = gateway.RevealBody(ctx, result.Payload)
+			ctx.JSON(result)
 		})
-	}
-}
-
-// basicAuthMiddleware is a middleware that enforces Basic Authentication using an API key
-func (gateway *Gateway) basicAuthMiddleware(ctx iris.Context) {
-	// Retrieve the expected API key from environment variables
-	var lm = gateway.LogManager
-
-	expectedAPIKey := os.Getenv("API_KEY")
-	if expectedAPIKey == "" {
-		lm.SendLog(lm.BuildLog(
-			"Server.Web.AuthMiddleware",
-			"Authenticated web client",
-			logrus.ErrorLevel,
-			map[string]interface{}{
-				"ip": ctx.Values().GetString("client_ip"),
-			},
-		))
-		// Log the error
-		/*logf := LoggingFormat{
-			Type:    "middleware_auth",
-			Level:   logrus.ErrorLevel,
-			Message: "API_KEY environment variable not set",
-		}
-		logf.Print()*/
 
-		// Respond with 500 Internal Server Error
-		ctx.StatusCode(http.StatusInternalServerError)
-		ctx.WriteString("Internal Server Error")
-		return
-	}
+		// Get a scheduled message by message ID
+		scheduled.Get("/{id:string}", func(ctx iris.Context) {
+			result, err := gateway.GetScheduledMessage(ctx.Params().Get("id"))
+			if err != nil {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
 
-	// Get the Authorization header
-	authHeader := ctx.GetHeader("Authorization")
-	if authHeader == "" {
-		// Missing Authorization header
-		unauthorized(ctx, gateway, "Authorization header missing")
-		return
-	}
+			result.Payload = gateway.RevealBody(ctx, result.Payload)
+			ctx.JSON(result)
+		})
 
-	// Check if the Authorization header starts with "Basic "
-	const prefix = "Basic "
-	if len(authHeader) < len(prefix) || authHeader[:len(prefix)] != prefix {
-		// Invalid Authorization header format
-		unauthorized(ctx, gateway, "Invalid Authorization header format")
-		return
-	}
+		// Move the delivery time of a pending message
+		scheduled.Patch("/{id:string}", func(ctx iris.Context) {
+			var req struct {
+				DeliverAt time.Time `json:"deliver_at"`
+			}
+			if err := ctx.ReadJSON(&req); err != nil || req.DeliverAt.IsZero() {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid request data"})
+				return
+			}
 
-	// Decode the Base64 encoded credentials
-	encodedCredentials := authHeader[len(prefix):]
-	decodedBytes, err := base64.StdEncoding.DecodeString(encodedCredentials)
-	if err != nil {
-		// Failed to decode credentials
-		unauthorized(ctx, gateway, "Failed to decode credentials")
-		return
-	}
-	credentials := string(decodedBytes)
+			if err := gateway.RescheduleMessage(ctx.Params().Get("id"), req.DeliverAt); err != nil {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
 
-	// In Basic Auth, credentials are in the format "username:password"
-	colonIndex := indexOf(credentials, ':')
-	if colonIndex < 0 {
-		// Invalid credentials format
-		unauthorized(ctx, gateway, "Invalid credentials format")
-		return
-	}
+			ctx.JSON(iris.Map{"status": "Message rescheduled"})
+		})
 
-	// Extract the API key (password) from the credentials
-	// Username can be ignored or used as needed
-	// For this example, we'll assume the API key is the password
-	apiKey := credentials[colonIndex+1:]
+		// Cancel a pending message
+		scheduled.Delete("/{id:string}", func(ctx iris.Context) {
+			if err := gateway.CancelScheduledMessage(ctx.Params().Get("id")); err != nil {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
 
-	// Compare the provided API key with the expected one
-	if apiKey != expectedAPIKey {
-		// Invalid API key
-		unauthorized(ctx, gateway, "Invalid API key")
-		return
+			ctx.JSON(iris.Map{"status": "Scheduled message cancelled"})
+		})
 	}
+}
 
-	// Authentication successful, proceed to the handler
-	ctx.Next()
+// ExplainRequest is a hypothetical message for the routing dry run.
+type ExplainRequest struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Type    string `json:"type"` // sms (default) or mms
+	Message string `json:"message"`
 }
 
-// SetupCarrierRoutes sets up the HTTP routes for carrier management
-func SetupCarrierRoutes(app *iris.Application, gateway *Gateway) {
-	carriers := app.Party("/carriers", gateway.basicAuthMiddleware)
+// SetupRoutingAuditRoutes sets up the routing audit trail and dry run endpoints.
+func SetupRoutingAuditRoutes(app *iris.Application, gateway *Gateway) {
+	routing := app.Party("/routing", gateway.BasicAuthMiddleware)
 	{
-		// Add a new carrier
-		carriers.Post("/", func(ctx iris.Context) {
-			var carrier Carrier
-			if err := ctx.ReadJSON(&carrier); err != nil {
-				ctx.StatusCode(iris.StatusBadRequest)
-				ctx.JSON(iris.Map{"error": "Invalid carrier data"})
+		// List routing decisions, newest first
+		routing.Get("/audit", func(ctx iris.Context) {
+			query := gateway.DB.Order("id desc")
+			if logID := ctx.URLParam("log_id"); logID != "" {
+				query = query.Where("log_id = ?", logID)
 			}
-
-			// Validate required fields
-			if carrier.Name == "" || carrier.Type == "" || carrier.Username == "" || carrier.Password == "" {
-				ctx.StatusCode(iris.StatusBadRequest)
-				ctx.JSON(iris.Map{"error": "All fields (name, type, username, password) are required"})
+			if traceID := ctx.URLParam("trace_id"); traceID != "" {
+				query = query.Where("trace_id = ?", traceID)
+			}
+			if outcome := ctx.URLParam("outcome"); outcome != "" {
+				query = query.Where("outcome = ?", outcome)
 			}
 
-			if err := gateway.addCarrier(&carrier); err != nil {
+			var list []core.RoutingDecision
+			if err := query.Limit(ctx.URLParamIntDefault("limit", 100)).Find(&list).Error; err != nil {
 				ctx.StatusCode(iris.StatusInternalServerError)
 				ctx.JSON(iris.Map{"error": err.Error()})
+				return
 			}
 
-			// Return the carrier without exposing encrypted fields
-			responseCarrier := Carrier{
-				ID:   carrier.ID,
-				Name: carrier.Name,
-				Type: carrier.Type,
-			}
-
-			ctx.StatusCode(iris.StatusCreated)
-			ctx.JSON(responseCarrier)
+			ctx.JSON(list)
 		})
 
-		// Reload carriers from the database
-		carriers.Post("/reload", func(ctx iris.Context) {
-			if err := gateway.reloadCarriers(); err != nil {
+		// Show every decision made for a message, across retries and routers
+		routing.Get("/audit/{id:string}", func(ctx iris.Context) {
+			id := ctx.Params().Get("id")
+
+			var list []core.RoutingDecision
+			if err := gateway.DB.Where("log_id = ? OR trace_id = ?", id, id).Order("id asc").Find(&list).Error; err != nil {
 				ctx.StatusCode(iris.StatusInternalServerError)
 				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+			if len(list) == 0 {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "No routing decisions found"})
+				return
 			}
 
-			ctx.JSON(iris.Map{"status": "Carriers reloaded"})
+			ctx.JSON(list)
 		})
 
-		// Get all carriers
-		carriers.Get("/", func(ctx iris.Context) {
-			gateway.mu.RLock()
-			defer gateway.mu.RUnlock()
-
-			var carrierList []Carrier
-			/*for _, handler := range gateway.Carriers {
-				// Assuming each handler can provide its Carrier information
-				if base, ok := handler.(*BaseCarrierHandler); ok {
-					carrierList = append(carrierList, Carrier{Name: base.Name})
-				}
-			}*/
+		// Dry run the router for a hypothetical message
+		routing.Post("/explain", func(ctx iris.Context) {
+			var req ExplainRequest
+			if err := ctx.ReadJSON(&req); err != nil || req.From == "" || req.To == "" {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid request data"})
+				return
+			}
 
-			ctx.JSON(carrierList)
+			msgType := core.MsgQueueItemType.SMS
+			if req.Type == string(core.MsgQueueItemType.MMS) {
+				msgType = core.MsgQueueItemType.MMS
+			}
+
+			ctx.JSON(gateway.Router.ExplainRoute(req.From, req.To, msgType, req.Message))
 		})
 	}
 }
 
-// indexOf finds the index of the first occurrence of sep in s
-func indexOf(s string, sep byte) int {
-	for i := 0; i < len(s); i++ {
-		if s[i] == sep {
-			return i
-		}
-	}
-	return -1
-}
+// SetupPluginRoutes sets up the HTTP route carrier plugins register through at startup.
+func SetupPluginRoutes(app *iris.Application, gateway *Gateway) {
+	plugins := app.Party("/plugins", gateway.BasicAuthMiddleware)
+	{
+		plugins.Post("/register", func(ctx iris.Context) {
+			var req carriers.PluginRegisterRequest
+			if err := ctx.ReadJSON(&req); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid registration"})
+				return
+			}
 
-// unauthorized responds with a 401 status and a WWW-Authenticate header
-func unauthorized(ctx iris.Context, gateway *Gateway, message string) {
-	// Log the unauthorized access attempt
-	var lm = gateway.LogManager
-	lm.SendLog(lm.BuildLog(
-		"Server.Web.AuthMiddleware",
-		"Unauthorized web client",
-		logrus.ErrorLevel,
-		map[string]interface{}{
-			"ip": ctx.Values().GetString("client_ip"),
-		},
-	))
-
-	// Set the WWW-Authenticate header to indicate Basic Auth is required
-	ctx.Header("WWW-Authenticate", `Basic realm="Restricted"`)
-
-	// Respond with 401 Unauthorized
-	ctx.StatusCode(http.StatusUnauthorized)
-	ctx.WriteString(message)
+			uuid, err := carriers.RegisterPlugin(gateway.Gateway, req)
+			if err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+			ctx.JSON(iris.Map{"uuid": uuid})
+		})
+	}
 }
 
 // SetupClientRoutes sets up the HTTP routes for client management.
 func SetupClientRoutes(app *iris.Application, gateway *Gateway) {
-	clients := app.Party("/clients", gateway.basicAuthMiddleware)
+	clients := app.Party("/clients", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
 	{
 		// Add a new client
 		clients.Post("/", func(ctx iris.Context) {
-			var client Client
+			var client core.Client
 			if err := ctx.ReadJSON(&client); err != nil {
 				ctx.StatusCode(iris.StatusBadRequest)
 				ctx.JSON(iris.Map{"error": "Invalid client data"})
 				return
 			}
 
-			// Validate required fields
-			if client.Username == "" || client.Password == "" {
+			// Validate required fields, the password of clients of an identity system is its own
+			external := client.Auth != "" && client.Auth != core.ClientAuths.Local
+			if client.Username == "" || (client.Password == "" && !external) {
 				ctx.StatusCode(iris.StatusBadRequest)
 				ctx.JSON(iris.Map{"error": "Username and Password are required"})
 				return
 			}
 
-			if err := gateway.addClient(&client); err != nil {
+			core.AssignTenant(ctx, &client.TenantID)
+			if err := core.ValidateTenantID(client.TenantID); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.CheckClientQuota(client.TenantID); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := core.ValidateCountryPolicy(&client); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := client.Profile.Validate(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := client.QuietHours.Validate(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := client.MonthlyQuota.Validate(); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := core.ValidateClientAuth(client.Auth); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			if err := gateway.AddClient(&client); err != nil {
 				ctx.StatusCode(iris.StatusInternalServerError)
 				ctx.JSON(iris.Map{"error": err.Error()})
 				return
 			}
 
 			// Return the client without exposing encrypted fields
-			responseClient := Client{
-				ID:         client.ID,
-				Username:   client.Username,
-				Name:       client.Name,
-				Address:    client.Address,
-				LogPrivacy: client.LogPrivacy,
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(core.PublicClient(&client))
+		})
+
+		// Get a client
+		clients.Get("/{id:uint}", func(ctx iris.Context) {
+			client, ok := gateway.ClientByID(ctx.Params().GetUintDefault("id", 0))
+			if !ok {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "Client not found"})
+				return
 			}
 
-			ctx.StatusCode(iris.StatusCreated)
-			ctx.JSON(responseClient)
+			ctx.JSON(core.PublicClient(client))
+		})
+
+		// Replace the settings of a client, the body carries the version it was read with
+		clients.Put("/{id:uint}", func(ctx iris.Context) {
+			var update core.Client
+			if err := ctx.ReadJSON(&update); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid client data"})
+				return
+			}
+			core.AssignTenant(ctx, &update.TenantID)
+
+			client, err := gateway.UpdateClient(ctx.Params().GetUintDefault("id", 0), update)
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			ctx.JSON(client)
+		})
+
+		// Delete a client with its numbers and dial plan
+		clients.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := gateway.DeleteClient(ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			ctx.JSON(iris.Map{"status": "Client deleted"})
 		})
 
 		// Reload clients and numbers from the database
 		clients.Post("/reload", func(ctx iris.Context) {
-			if err := gateway.reloadClientsAndNumbers(); err != nil {
+			if err := gateway.ProvisioningChanged(); err != nil {
 				ctx.StatusCode(iris.StatusInternalServerError)
 				ctx.JSON(iris.Map{"error": err.Error()})
 				return
@@ -339,7 +946,7 @@ func SetupClientRoutes(app *iris.Application, gateway *Gateway) {
 			}
 
 			// Update the password
-			if err := gateway.updateClientPassword(uint(clientID), passwordUpdate.NewPassword); err != nil {
+			if err := gateway.UpdateClientPassword(uint(clientID), passwordUpdate.NewPassword); err != nil {
 				if err.Error() == "client not found in memory" {
 					ctx.StatusCode(iris.StatusNotFound)
 					ctx.JSON(iris.Map{"error": "Client not found"})
@@ -356,7 +963,7 @@ func SetupClientRoutes(app *iris.Application, gateway *Gateway) {
 		// Add a new number to a client
 		clients.Post("/{id}/numbers", func(ctx iris.Context) {
 			clientID := ctx.Params().Get("id")
-			var newNumber ClientNumber
+			var newNumber core.ClientNumber
 			if err := ctx.ReadJSON(&newNumber); err != nil {
 				ctx.StatusCode(iris.StatusBadRequest)
 				ctx.JSON(iris.Map{"error": "Invalid number data"})
@@ -371,31 +978,24 @@ func SetupClientRoutes(app *iris.Application, gateway *Gateway) {
 			}
 
 			// Add the number to the client
-			if err := gateway.addNumber(clientID, &newNumber); err != nil {
+			if err := gateway.AddNumber(clientID, &newNumber); err != nil {
 				ctx.StatusCode(iris.StatusInternalServerError)
 				ctx.JSON(iris.Map{"error": err.Error()})
 				return
 			}
 
 			// Return the newly added number
-			responseNumber := ClientNumber{
-				ID:       newNumber.ID,
-				ClientID: newNumber.ClientID,
-				Number:   newNumber.Number,
-				Carrier:  newNumber.Carrier,
-			}
-
 			ctx.StatusCode(iris.StatusCreated)
-			ctx.JSON(responseNumber)
+			ctx.JSON(newNumber)
 		})
 
 		// Get all numbers for a specific client
 		clients.Get("/{id}/numbers", func(ctx iris.Context) {
 			clientID := ctx.Params().Get("id")
 
-			gateway.mu.RLock()
+			gateway.Mu.RLock()
 			client, exists := gateway.Clients[clientID]
-			gateway.mu.RUnlock()
+			gateway.Mu.RUnlock()
 
 			if !exists {
 				ctx.StatusCode(iris.StatusNotFound)
@@ -408,27 +1008,201 @@ func SetupClientRoutes(app *iris.Application, gateway *Gateway) {
 
 		// Get all clients
 		clients.Get("/", func(ctx iris.Context) {
-			gateway.mu.RLock()
-			defer gateway.mu.RUnlock()
+			gateway.Mu.RLock()
+			defer gateway.Mu.RUnlock()
 
-			var clientList []Client
+			var clientList []core.Client
 			for _, client := range gateway.Clients {
-				// Return clients without exposing sensitive information
-				c := Client{
-					ID:         client.ID,
-					Username:   client.Username,
-					Name:       client.Name,
-					Address:    client.Address,
-					LogPrivacy: client.LogPrivacy,
-					Numbers:    client.Numbers,
+				if !core.KeyAllowsClient(ctx, client) {
+					continue
 				}
-				clientList = append(clientList, c)
+				// Return clients without exposing sensitive information
+				clientList = append(clientList, core.PublicClient(client))
 			}
 
 			ctx.JSON(clientList)
 		})
 	}
+
+	numbers := app.Party("/numbers", gateway.BasicAuthMiddleware, gateway.ProvisioningWritable)
+	{
+		// List all numbers
+		numbers.Get("/", func(ctx iris.Context) {
+			list, err := gateway.Storage.Numbers()
+			if err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].Number < list[j].Number })
+			visible := make([]core.ClientNumber, 0, len(list))
+			for _, number := range list {
+				client, _ := gateway.ClientByID(number.ClientID)
+				if core.KeyAllowsClient(ctx, client) {
+					visible = append(visible, number)
+				}
+			}
+
+			ctx.JSON(visible)
+		})
+
+		// Add a number to the client with client_id
+		numbers.Post("/", func(ctx iris.Context) {
+			var number core.ClientNumber
+			if err := ctx.ReadJSON(&number); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid number data"})
+				return
+			}
+			number.ID = 0
+			number.Version = 0
+
+			if err := gateway.ValidateNumber(0, &number); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			client, _ := gateway.ClientByID(number.ClientID)
+			if err := gateway.CheckClientScope(ctx, client.Username); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			if err := gateway.AddNumber(client.Username, &number); err != nil {
+				ctx.StatusCode(iris.StatusInternalServerError)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+
+			ctx.StatusCode(iris.StatusCreated)
+			ctx.JSON(number)
+		})
+
+		// Get a number
+		numbers.Get("/{id:uint}", func(ctx iris.Context) {
+			var number core.ClientNumber
+			if err := gateway.DB.First(&number, ctx.Params().GetUintDefault("id", 0)).Error; err != nil {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "Number not found"})
+				return
+			}
+
+			ctx.JSON(number)
+		})
+
+		// Replace a number, the body carries the version it was read with
+		numbers.Put("/{id:uint}", func(ctx iris.Context) {
+			var update core.ClientNumber
+			if err := ctx.ReadJSON(&update); err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "Invalid number data"})
+				return
+			}
+			// a key limited to some clients may only move the number to one of them
+			target := ""
+			if client, ok := gateway.ClientByID(update.ClientID); ok {
+				target = client.Username
+			}
+			if err := gateway.CheckClientScope(ctx, target); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			number, err := gateway.UpdateNumber(ctx.Params().GetUintDefault("id", 0), update)
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			ctx.JSON(number)
+		})
+
+		// Delete a number
+		numbers.Delete("/{id:uint}", func(ctx iris.Context) {
+			if err := gateway.DeleteNumber(ctx.Params().GetUintDefault("id", 0), uint(ctx.URLParamIntDefault("version", 0))); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+
+			ctx.JSON(iris.Map{"status": "Number deleted"})
+		})
+
+		// Look a number up with the carrier lookup, refresh=true skips the cache
+		numbers.Get("/lookup/{number:string}", func(ctx iris.Context) {
+			result, err := gateway.LookupCarrier(ctx.Params().Get("number"), ctx.URLParamDefault("refresh", "") == "true")
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(result)
+		})
+
+		// Show the cached verdict of the carrier that rejected a number as invalid
+		numbers.Get("/invalid/{number:string}", func(ctx iris.Context) {
+			verdict, ok := gateway.CachedInvalidDestination(ctx.Params().Get("number"))
+			if !ok {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "Number not cached as invalid"})
+				return
+			}
+			ctx.JSON(verdict)
+		})
+
+		// Send to a number cached as invalid again
+		numbers.Delete("/invalid/{number:string}", func(ctx iris.Context) {
+			if err := gateway.ForgetInvalidDestination(ctx.Params().Get("number")); err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(iris.Map{"status": "Number no longer cached as invalid"})
+		})
+
+		// Show the last reconciliation of the stored carriers with the lookup
+		numbers.Get("/reconcile", func(ctx iris.Context) {
+			report := core.LastReconciliation()
+			if report == nil {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "No reconciliation has run"})
+				return
+			}
+			ctx.JSON(report)
+		})
+
+		// Reconcile the stored carriers with the lookup now
+		numbers.Post("/reconcile", func(ctx iris.Context) {
+			if gateway.CarrierLookup == nil {
+				core.WriteProvisioningError(ctx, core.ErrNoCarrierLookup)
+				return
+			}
+			report, err := gateway.ReconcileNumbers()
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(report)
+		})
+
+		// Show the last sync of the stored numbers with the carrier accounts
+		numbers.Get("/sync", func(ctx iris.Context) {
+			report := core.LastNumberSync()
+			if report == nil {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "No number sync has run"})
+				return
+			}
+			ctx.JSON(report)
+		})
+
+		// Sync the stored numbers with the carrier accounts now
+		numbers.Post("/sync", func(ctx iris.Context) {
+			report, err := gateway.SyncNumbers()
+			if err != nil {
+				core.WriteProvisioningError(ctx, err)
+				return
+			}
+			ctx.JSON(report)
+		})
+	}
 }
+
 func (gateway *Gateway) webInboundCarrier(ctx iris.Context) {
 	// Extract the 'carrier' parameter from the URL
 	carrier := ctx.Params().Get("carrier") // the carrier is the uuid of the carrier
@@ -439,20 +1213,32 @@ func (gateway *Gateway) webInboundCarrier(ctx iris.Context) {
 		return
 	}
 
-	// Retrieve the corresponding inbound route handler
+	// Retrieve the corresponding inbound route handler, each carrier account has its own uuid
+	gateway.Mu.RLock()
 	carrierObj, exists := gateway.CarrierUUIDs[carrier]
+	inboundRoute, handlerExists := gateway.Carriers[carrierObj.Name]
+	gateway.Mu.RUnlock()
 	if exists {
-		inboundRoute, exists := gateway.Carriers[carrierObj.Name]
-		if exists {
+		if handlerExists {
+			// signatures, timestamps, replays and the allowlist are checked before the handler
+			// parses the webhook
+			nonce, ok := gateway.CheckWebhook(ctx, &carrierObj, inboundRoute)
+			if !ok {
+				return
+			}
 
 			// Call the Inbound method of the carrier handler
 			err := inboundRoute.Inbound(ctx)
 			if err != nil {
+				gateway.ReleaseWebhook(nonce)
 				// Respond with 500 Internal Server Error
 				ctx.StatusCode(http.StatusInternalServerError)
 				ctx.WriteString("failed to process inbound message")
 				return
 			}
+			if ctx.GetStatusCode() >= http.StatusInternalServerError {
+				gateway.ReleaseWebhook(nonce)
+			}
 			return
 		}
 		// Successfully processed the inbound message
@@ -494,7 +1280,7 @@ func (gateway *Gateway) webMediaFile(ctx iris.Context) {
 	}
 
 	// Retrieve the media file from MongoDB
-	mediaFile, err := gateway.getMediaFile(uint(id))
+	mediaFile, err := gateway.GetMediaFile(uint(id))
 	if err != nil {
 		// Log the error
 		/*logf := LoggingFormat{
@@ -512,6 +1298,12 @@ func (gateway *Gateway) webMediaFile(ctx iris.Context) {
 		return
 	}
 
+	if mediaFile.Signed && !core.ValidMediaLink(mediaFile.ID, ctx.URLParam("expires"), ctx.URLParam("sig")) {
+		ctx.StatusCode(http.StatusNotFound)
+		ctx.WriteString("media file not found")
+		return
+	}
+
 	if strings.Contains(mediaFile.ContentType, "application/smil") {
 		// todo
 		ctx.StatusCode(500)
@@ -549,7 +1341,7 @@ func (gateway *Gateway) webMediaFile(ctx iris.Context) {
 }
 
 func (gateway *Gateway) webReloadData(ctx iris.Context) {
-	if err := gateway.reloadClientsAndNumbers(); err != nil {
+	if err := gateway.ProvisioningChanged(); err != nil {
 		ctx.StatusCode(500)
 		ctx.JSON(iris.Map{"error": err.Error()})
 		return
@@ -557,16 +1349,6 @@ func (gateway *Gateway) webReloadData(ctx iris.Context) {
 	ctx.JSON(iris.Map{"status": "Data reloaded successfully"})
 }
 
-func isPrivateIP(ip net.IP) bool {
-	for _, cidr := range trustedProxies {
-		_, network, err := net.ParseCIDR(cidr)
-		if err == nil && network.Contains(ip) {
-			return true
-		}
-	}
-	return false
-}
-
 func ProxyIPMiddleware(ctx iris.Context) {
 	remoteIP := net.ParseIP(ctx.RemoteAddr())
 	if remoteIP == nil {
@@ -575,7 +1357,7 @@ func ProxyIPMiddleware(ctx iris.Context) {
 		return
 	}
 
-	if !isPrivateIP(remoteIP) {
+	if !core.IsPrivateIP(remoteIP) {
 		ctx.Values().Set("client_ip", remoteIP.String())
 		ctx.Next()
 		return
@@ -585,7 +1367,7 @@ func ProxyIPMiddleware(ctx iris.Context) {
 		ips := strings.Split(forwardedFor, ",")
 		for _, ip := range ips {
 			parsedIP := net.ParseIP(strings.TrimSpace(ip))
-			if parsedIP != nil && !isPrivateIP(parsedIP) {
+			if parsedIP != nil && !core.IsPrivateIP(parsedIP) {
 				ctx.Values().Set("client_ip", parsedIP.String())
 				ctx.Next()
 				return
@@ -595,7 +1377,7 @@ func ProxyIPMiddleware(ctx iris.Context) {
 
 	if realIP := ctx.GetHeader("X-Real-IP"); realIP != "" {
 		parsedIP := net.ParseIP(realIP)
-		if parsedIP != nil && !isPrivateIP(parsedIP) {
+		if parsedIP != nil && !core.IsPrivateIP(parsedIP) {
 			ctx.Values().Set("client_ip", parsedIP.String())
 			ctx.Next()
 			return